@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultAcceptQueueDepth   = 128
+	defaultAcceptQueueTimeout = 5 * time.Second
+	// acceptQueuePoll is how often the connection at the head of the queue
+	// checks for capacity freed by something other than a closed
+	// connection, such as a backend becoming healthy.
+	acceptQueuePoll = 100 * time.Millisecond
+)
+
+var (
+	errAcceptQueueFull    = errors.New("accept queue is full")
+	errAcceptQueueTimeout = errors.New("timed out in accept queue")
+)
+
+// acceptQueue holds client connections that arrive while every backend is at
+// its connection limit and releases them in arrival order as capacity frees.
+// Connections arriving while others are queued join the back of the queue,
+// so they cannot overtake connections that have waited longer.
+type acceptQueue struct {
+	depth   int
+	timeout time.Duration
+
+	mux     sync.Mutex
+	waiters []chan struct{}
+
+	admitted  atomic.Uint64
+	timeouts  atomic.Uint64
+	overflows atomic.Uint64
+	wait      latencyTracker
+}
+
+func newAcceptQueue(config *AcceptQueueConfig, maxConnections int64) (*acceptQueue, error) {
+	if config == nil || !config.Enabled {
+		return nil, nil
+	}
+	if maxConnections <= 0 {
+		return nil, fmt.Errorf("accept_queue requires max_connections")
+	}
+	q := &acceptQueue{depth: defaultAcceptQueueDepth, timeout: defaultAcceptQueueTimeout}
+	if config.Depth < 0 {
+		return nil, fmt.Errorf("accept_queue depth must not be negative")
+	} else if config.Depth > 0 {
+		q.depth = config.Depth
+	}
+	if config.Timeout != "" {
+		d, err := time.ParseDuration(config.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid accept_queue timeout: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("accept_queue timeout must be positive")
+		}
+		q.timeout = d
+	}
+	return q, nil
+}
+
+// Len returns the number of queued connections.
+func (q *acceptQueue) Len() int {
+	if q == nil {
+		return 0
+	}
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return len(q.waiters)
+}
+
+// admit returns the backend chosen by pick. If pick finds none while
+// saturated reports that backends are at their connection limit, or if
+// other connections are already queued, the connection waits in the queue
+// until pick succeeds, the queue timeout expires or ctx is done. A nil
+// queue never waits.
+func (q *acceptQueue) admit(ctx context.Context, pick func() *Backend, saturated func() bool) (*Backend, error) {
+	if q == nil {
+		return pick(), nil
+	}
+	q.mux.Lock()
+	if len(q.waiters) == 0 {
+		if b := pick(); b != nil || !saturated() {
+			q.mux.Unlock()
+			return b, nil
+		}
+	}
+	if len(q.waiters) >= q.depth {
+		q.mux.Unlock()
+		q.overflows.Add(1)
+		return nil, errAcceptQueueFull
+	}
+	w := make(chan struct{}, 1)
+	q.waiters = append(q.waiters, w)
+	q.mux.Unlock()
+
+	start := time.Now()
+	timeout := time.NewTimer(q.timeout)
+	defer timeout.Stop()
+	poll := time.NewTicker(acceptQueuePoll)
+	defer poll.Stop()
+	for {
+		select {
+		case <-w:
+		case <-poll.C:
+		case <-timeout.C:
+			q.leave(w)
+			q.timeouts.Add(1)
+			return nil, fmt.Errorf("%w after %s", errAcceptQueueTimeout, q.timeout)
+		case <-ctx.Done():
+			q.leave(w)
+			return nil, context.Cause(ctx)
+		}
+
+		q.mux.Lock()
+		if q.waiters[0] != w {
+			q.mux.Unlock()
+			continue
+		}
+		b := pick()
+		if b == nil {
+			q.mux.Unlock()
+			continue
+		}
+		q.waiters = q.waiters[1:]
+		q.mux.Unlock()
+		// More capacity may have freed up than this connection needs.
+		q.notify()
+		q.admitted.Add(1)
+		q.wait.Observe(time.Since(start))
+		return b, nil
+	}
+}
+
+// leave removes a waiter that gave up and wakes the next one in case the
+// waiter was at the head of the queue.
+func (q *acceptQueue) leave(w chan struct{}) {
+	q.mux.Lock()
+	if i := slices.Index(q.waiters, w); i >= 0 {
+		q.waiters = slices.Delete(q.waiters, i, i+1)
+	}
+	q.mux.Unlock()
+	q.notify()
+}
+
+// notify wakes the connection at the head of the queue, if any, to check
+// for capacity. It is called whenever a proxied connection closes.
+func (q *acceptQueue) notify() {
+	if q == nil {
+		return
+	}
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if len(q.waiters) > 0 {
+		select {
+		case q.waiters[0] <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// saturated reports whether a backend that could otherwise take
+// connections is at the per-backend connection limit.
+func (p *BaseServerPool) saturated() bool {
+	if p.maxConnections <= 0 {
+		return false
+	}
+	return slices.ContainsFunc(p.Backends(), func(b *Backend) bool {
+		return b.Healthy() && b.ActiveConnections() >= p.maxConnections
+	})
+}
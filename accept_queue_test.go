@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_newAcceptQueue(t *testing.T) {
+	if q, err := newAcceptQueue(&AcceptQueueConfig{}, 10); q != nil || err != nil {
+		t.Errorf("expected nil when disabled, got %v, %v", q, err)
+	}
+	q, err := newAcceptQueue(&AcceptQueueConfig{Enabled: true}, 10)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if q.depth != defaultAcceptQueueDepth || q.timeout != defaultAcceptQueueTimeout {
+		t.Errorf("expected defaults, got depth %d and timeout %s", q.depth, q.timeout)
+	}
+
+	for _, tc := range []struct {
+		config         AcceptQueueConfig
+		maxConnections int64
+	}{
+		{AcceptQueueConfig{Enabled: true}, 0},
+		{AcceptQueueConfig{Enabled: true, Depth: -1}, 10},
+		{AcceptQueueConfig{Enabled: true, Timeout: "soon"}, 10},
+		{AcceptQueueConfig{Enabled: true, Timeout: "0s"}, 10},
+	} {
+		if _, err := newAcceptQueue(&tc.config, tc.maxConnections); err == nil {
+			t.Errorf("expected error for %+v with max_connections %d", tc.config, tc.maxConnections)
+		}
+	}
+}
+
+func TestAcceptQueue_admit(t *testing.T) {
+	q := &acceptQueue{depth: 2, timeout: 2 * time.Second}
+	backend := &Backend{}
+	var mux sync.Mutex
+	capacity := 0
+	pick := func() *Backend {
+		mux.Lock()
+		defer mux.Unlock()
+		if capacity == 0 {
+			return nil
+		}
+		capacity--
+		return backend
+	}
+	free := func() {
+		mux.Lock()
+		capacity++
+		mux.Unlock()
+		q.notify()
+	}
+	saturated := func() bool { return true }
+
+	admitted := make(chan string, 2)
+	for _, name := range []string{"first", "second"} {
+		n := q.Len()
+		go func() {
+			if b, err := q.admit(t.Context(), pick, saturated); b == backend && err == nil {
+				admitted <- name
+			} else {
+				admitted <- err.Error()
+			}
+		}()
+		for q.Len() == n {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if _, err := q.admit(t.Context(), pick, saturated); !errors.Is(err, errAcceptQueueFull) {
+		t.Errorf("expected a full queue to refuse connections, got %v", err)
+	}
+
+	for _, want := range []string{"first", "second"} {
+		free()
+		if got := <-admitted; got != want {
+			t.Errorf("expected %s connection to be admitted, got %s", want, got)
+		}
+	}
+	if q.admitted.Load() != 2 || q.overflows.Load() != 1 || q.Len() != 0 {
+		t.Errorf("expected 2 admitted and 1 overflow, got %d and %d with %d queued",
+			q.admitted.Load(), q.overflows.Load(), q.Len())
+	}
+
+	// Without saturated backends, connections are not queued.
+	if b, err := q.admit(t.Context(), pick, func() bool { return false }); b != nil || err != nil {
+		t.Errorf("expected no backend and no error, got %v, %v", b, err)
+	}
+
+	q.timeout = 50 * time.Millisecond
+	if _, err := q.admit(t.Context(), pick, saturated); !errors.Is(err, errAcceptQueueTimeout) {
+		t.Errorf("expected queue timeout, got %v", err)
+	}
+	if q.timeouts.Load() != 1 || q.Len() != 0 {
+		t.Errorf("expected 1 timeout and an empty queue, got %d with %d queued", q.timeouts.Load(), q.Len())
+	}
+}
+
+func TestTCPServerPool_acceptQueue(t *testing.T) {
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:           "127.0.0.1:0",
+		MaxConnections: 1,
+		AcceptQueue:    &AcceptQueueConfig{Enabled: true},
+		Backends:       []BackendConfig{{URL: startNamedBackend(t, "a")}},
+	})
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	pool.backends[0].SetHealthy(true)
+	pool.Start()
+	defer pool.Shutdown(t.Context())
+
+	first, _, _ := dialEcho(t, pool)
+
+	second, err := net.Dial("tcp", pool.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect to load balancer: %v", err)
+	}
+	defer second.Close()
+	for pool.queue.Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	first.Close()
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if greeting, err := bufio.NewReader(second).ReadString('\n'); err != nil || greeting != "a\n" {
+		t.Errorf("expected queued connection to reach the backend, got %q, %v", greeting, err)
+	}
+}
+
+func TestNewUDPServerPool_acceptQueue(t *testing.T) {
+	_, err := NewUDPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:           "127.0.0.1:0",
+		MaxConnections: 1,
+		AcceptQueue:    &AcceptQueueConfig{Enabled: true},
+	})
+	if err == nil {
+		t.Errorf("expected error for accept_queue on a udp listener")
+	}
+}
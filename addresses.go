@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const defaultAddressHookTimeout = 10 * time.Second
+
+// listenAddresses returns every address a listener binds: Addr followed by
+// Addrs.
+func listenAddresses(config *Config) ([]string, error) {
+	addrs := append([]string{config.Addr}, config.Addrs...)
+	seen := make(map[string]bool)
+	for _, addr := range addrs[1:] {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid listener address %q: %w", addr, err)
+		}
+		if seen[addr] || addr == config.Addr {
+			return nil, fmt.Errorf("duplicate listener address %q", addr)
+		}
+		seen[addr] = true
+	}
+	return addrs, nil
+}
+
+// listenAddrs returns the addresses the pool's listener binds.
+func (p *BaseServerPool) listenAddrs() []string {
+	if len(p.addrs) == 0 {
+		return []string{p.addr}
+	}
+	return p.addrs
+}
+
+// addressHooks runs commands as a listener binds and releases each of its
+// addresses, so that nlb can manage its own VIPs without keepalived. The
+// address is appended to each command as its last argument and exported as
+// NLB_ADDRESS, NLB_HOST and NLB_PORT, along with NLB_EVENT (up or down),
+// NLB_LISTENER and NLB_PROTOCOL. A nil addressHooks runs nothing.
+type addressHooks struct {
+	up, down []string
+	timeout  time.Duration
+	listener string
+	protocol string
+	log      *log.Logger
+}
+
+func newAddressHooks(config *AddressHooksConfig, listener, protocol string, l *log.Logger) (*addressHooks, error) {
+	if config == nil || (len(config.Up) == 0 && len(config.Down) == 0) {
+		return nil, nil
+	}
+	h := &addressHooks{
+		up:       config.Up,
+		down:     config.Down,
+		timeout:  defaultAddressHookTimeout,
+		listener: listener,
+		protocol: protocol,
+		log:      l,
+	}
+	if config.Timeout != "" {
+		d, err := time.ParseDuration(config.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address_hooks timeout: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("address_hooks timeout must be positive")
+		}
+		h.timeout = d
+	}
+	return h, nil
+}
+
+// addressUp runs the up hook for addr before it is bound.
+func (h *addressHooks) addressUp(addr string) error {
+	if h == nil {
+		return nil
+	}
+	return h.run("up", h.up, addr)
+}
+
+// addressDown runs the down hook for addr after it is released. Failures
+// are logged, since the address is gone either way.
+func (h *addressHooks) addressDown(addr string) {
+	if h == nil {
+		return
+	}
+	if err := h.run("down", h.down, addr); err != nil {
+		warnf(h.log, "%v", err)
+	}
+}
+
+func (h *addressHooks) run(event string, command []string, addr string) error {
+	if len(command) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	host, port, _ := net.SplitHostPort(addr)
+	args := append(command[1:len(command):len(command)], addr)
+	cmd := exec.CommandContext(ctx, command[0], args...)
+	cmd.Env = append(os.Environ(),
+		"NLB_EVENT="+event,
+		"NLB_LISTENER="+h.listener,
+		"NLB_PROTOCOL="+h.protocol,
+		"NLB_ADDRESS="+addr,
+		"NLB_HOST="+host,
+		"NLB_PORT="+port,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("did not finish within %s", h.timeout)
+		}
+		out = bytes.TrimSpace(out)
+		if len(out) > maxExecOutput {
+			out = out[:maxExecOutput]
+		}
+		if len(out) > 0 {
+			return fmt.Errorf("%s hook for address %s failed (%v): %s", event, addr, err, out)
+		}
+		return fmt.Errorf("%s hook for address %s failed: %w", event, addr, err)
+	}
+	infof(h.log, "ran %s hook for address %s", event, addr)
+	return nil
+}
+
+// bindAddresses runs the up hook for each address and binds it. If any
+// address fails, those already bound are released again.
+func bindAddresses[T io.Closer](hooks *addressHooks, addrs []string, bind func(addr string) (T, error)) ([]T, error) {
+	var bound []T
+	for i, addr := range addrs {
+		err := hooks.addressUp(addr)
+		var c T
+		if err == nil {
+			if c, err = bind(addr); err != nil {
+				hooks.addressDown(addr)
+			}
+		}
+		if err != nil {
+			releaseAddresses(hooks, addrs[:i], bound)
+			return nil, err
+		}
+		bound = append(bound, c)
+	}
+	return bound, nil
+}
+
+// releaseAddresses closes each bound address and runs its down hook.
+func releaseAddresses[T io.Closer](hooks *addressHooks, addrs []string, bound []T) error {
+	var errs []error
+	for i, c := range bound {
+		if err := c.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+		hooks.addressDown(addrs[i])
+	}
+	return errors.Join(errs...)
+}
+
+// multiListener accepts connections from several listeners as one.
+type multiListener struct {
+	listeners []net.Listener
+	conns     chan acceptResult
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// newMultiListener merges listeners, returning the only one unchanged.
+// Addr reports the address of the first listener.
+func newMultiListener(listeners []net.Listener) net.Listener {
+	if len(listeners) == 1 {
+		return listeners[0]
+	}
+	m := &multiListener{
+		listeners: listeners,
+		conns:     make(chan acceptResult),
+		closed:    make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go m.acceptFrom(l)
+	}
+	return m
+}
+
+func (m *multiListener) acceptFrom(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		select {
+		case m.conns <- acceptResult{conn, err}:
+		case <-m.closed:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-m.conns:
+		return r.conn, r.err
+	case <-m.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes all listeners. Their down hooks are run by the pool.
+func (m *multiListener) Close() error {
+	err := net.ErrClosed
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		var errs []error
+		for _, l := range m.listeners {
+			errs = append(errs, l.Close())
+		}
+		err = errors.Join(errs...)
+	})
+	return err
+}
+
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_listenAddresses(t *testing.T) {
+	addrs, err := listenAddresses(&Config{Addr: ":80", Addrs: []string{"10.0.0.100:80", "[fd00::1]:80"}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !slices.Equal(addrs, []string{":80", "10.0.0.100:80", "[fd00::1]:80"}) {
+		t.Errorf("unexpected addresses %v", addrs)
+	}
+	for _, extra := range [][]string{{"10.0.0.100"}, {":80"}, {"10.0.0.100:80", "10.0.0.100:80"}} {
+		if _, err := listenAddresses(&Config{Addr: ":80", Addrs: extra}); err == nil {
+			t.Errorf("expected error for addrs %v", extra)
+		}
+	}
+}
+
+// hookLog returns address hooks that append "<event> <listener> <address>"
+// lines to a file, and a func returning the lines written so far.
+func hookLog(t *testing.T, failUp string) (*AddressHooksConfig, func() []string) {
+	t.Helper()
+	out := filepath.Join(t.TempDir(), "hooks.log")
+	script := `test "$1" != "` + failUp + `" || exit 1; echo "$NLB_EVENT $NLB_LISTENER $1" >> ` + out
+	config := &AddressHooksConfig{
+		Up:   []string{"sh", "-c", script, "hook"},
+		Down: []string{"sh", "-c", script, "hook"},
+	}
+	return config, func() []string {
+		data, _ := os.ReadFile(out)
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+}
+
+// freeAddrs returns n loopback addresses with distinct free TCP and UDP
+// ports.
+func freeAddrs(t *testing.T, n int) []string {
+	t.Helper()
+	var addrs []string
+	for range n {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		addrs = append(addrs, l.Addr().String())
+		defer l.Close()
+	}
+	return addrs
+}
+
+func TestTCPServerPool_addresses(t *testing.T) {
+	hooks, lines := hookLog(t, "")
+	addrs := freeAddrs(t, 2)
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Name:         "web",
+		Addr:         addrs[0],
+		Addrs:        addrs[1:],
+		AddressHooks: hooks,
+		Backends:     []BackendConfig{{URL: "debug://blue"}},
+	})
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	pool.StartHealthChecks()
+	pool.Start()
+
+	for _, addr := range addrs {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to connect to %s: %v", addr, err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if banner, err := bufio.NewReader(conn).ReadString('\n'); err != nil || !strings.Contains(banner, "debug://blue") {
+			t.Errorf("expected banner from %s, got %q, %v", addr, banner, err)
+		}
+		conn.Close()
+	}
+
+	pool.Shutdown(t.Context())
+	want := []string{"up web " + addrs[0], "up web " + addrs[1], "down web " + addrs[0], "down web " + addrs[1]}
+	if got := lines(); !slices.Equal(got, want) {
+		t.Errorf("expected hooks %v, got %v", want, got)
+	}
+	if _, err := net.Dial("tcp", addrs[1]); err == nil {
+		t.Errorf("expected %s to be released", addrs[1])
+	}
+}
+
+func TestNewTCPServerPool_addressHookFails(t *testing.T) {
+	addrs := freeAddrs(t, 2)
+	hooks, lines := hookLog(t, addrs[1])
+	_, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Name:         "web",
+		Addr:         addrs[0],
+		Addrs:        addrs[1:],
+		AddressHooks: hooks,
+	})
+	if err == nil {
+		t.Fatalf("expected error when an up hook fails")
+	}
+	want := []string{"up web " + addrs[0], "down web " + addrs[0]}
+	if got := lines(); !slices.Equal(got, want) {
+		t.Errorf("expected bound addresses to be released, got hooks %v", got)
+	}
+}
+
+func TestUDPServerPool_addresses(t *testing.T) {
+	addrs := freeAddrs(t, 2)
+	pool, err := NewUDPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:     addrs[0],
+		Addrs:    addrs[1:],
+		Backends: []BackendConfig{{URL: "debug://blue"}},
+	})
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	pool.StartHealthChecks()
+	if err := pool.Start(); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer pool.Shutdown(t.Context())
+
+	// A connected socket only receives replies sent from the address it
+	// dialed.
+	for _, addr := range addrs {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatalf("failed to dial %s: %v", addr, err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write([]byte("ping"))
+		buf := make([]byte, 1024)
+		if n, err := conn.Read(buf); err != nil || !strings.HasSuffix(string(buf[:n]), "\nping") {
+			t.Errorf("expected reply from %s, got %q, %v", addr, buf[:n], err)
+		}
+	}
+}
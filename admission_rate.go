@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// admissionSettings is the rate at which new connections may be sent to
+// each backend of a pool.
+type admissionSettings struct {
+	rate  float64
+	burst int
+}
+
+// newAdmissionSettings validates config, returning nil if backend
+// connection rates are not limited.
+func newAdmissionSettings(config *BackendConnectionRateConfig) (*admissionSettings, error) {
+	if config == nil {
+		return nil, nil
+	}
+	if config.Rate <= 0 {
+		return nil, fmt.Errorf("backend_connection_rate rate must be positive")
+	}
+	if config.Burst < 0 {
+		return nil, fmt.Errorf("backend_connection_rate burst must not be negative")
+	}
+	s := &admissionSettings{rate: config.Rate, burst: config.Burst}
+	if s.burst == 0 {
+		s.burst = max(1, int(math.Ceil(config.Rate)))
+	}
+	return s, nil
+}
+
+// admissionLimiter limits the rate of new connections to a backend, so that
+// a backend that has just recovered or started with cold caches takes on
+// load gradually instead of at the full arrival rate. Backends out of
+// tokens are skipped in favor of others.
+type admissionLimiter struct {
+	mux    sync.Mutex
+	bucket *tokenBucket
+}
+
+func newAdmissionLimiter(s *admissionSettings) *admissionLimiter {
+	if s == nil {
+		return nil
+	}
+	return &admissionLimiter{bucket: newTokenBucket(s.rate, s.burst, time.Now())}
+}
+
+// ready reports whether a new connection may be sent to the backend.
+func (a *admissionLimiter) ready(now time.Time) bool {
+	if a == nil {
+		return true
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	b := a.bucket
+	return b.tokens+max(0, now.Sub(b.last).Seconds())*b.rate >= 1
+}
+
+// admit takes a token for a new connection. Connections admitted while the
+// bucket is empty, such as those pinned to the backend or racing for its
+// last token, are still counted, leaving the bucket in debt of up to a
+// burst.
+func (a *admissionLimiter) admit(now time.Time) {
+	if a == nil {
+		return
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if !a.bucket.take(now) {
+		a.bucket.tokens = max(a.bucket.tokens-1, -a.bucket.burst)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_newAdmissionSettings(t *testing.T) {
+	if s, err := newAdmissionSettings(nil); s != nil || err != nil {
+		t.Errorf("expected no limit when not configured, got %v, %v", s, err)
+	}
+	for _, config := range []*BackendConnectionRateConfig{{}, {Rate: -1}, {Rate: 1, Burst: -1}} {
+		if _, err := newAdmissionSettings(config); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+	s, err := newAdmissionSettings(&BackendConnectionRateConfig{Rate: 2.5})
+	if err != nil {
+		t.Fatalf("failed to create settings: %v", err)
+	}
+	if s.burst != 3 {
+		t.Errorf("expected the burst to default to the rate rounded up, got %d", s.burst)
+	}
+	if s, _ := newAdmissionSettings(&BackendConnectionRateConfig{Rate: 0.1}); s.burst != 1 {
+		t.Errorf("expected a burst of at least 1, got %d", s.burst)
+	}
+}
+
+func TestAdmissionLimiter(t *testing.T) {
+	a := newAdmissionLimiter(&admissionSettings{rate: 10, burst: 2})
+	now := a.bucket.last
+	a.admit(now)
+	if !a.ready(now) {
+		t.Errorf("expected the limiter to be ready within its burst")
+	}
+	a.admit(now)
+	if a.ready(now) {
+		t.Errorf("expected the limiter not to be ready beyond its burst")
+	}
+	// Connections beyond the rate, such as pinned ones, are still counted.
+	a.admit(now)
+	if a.ready(now.Add(100 * time.Millisecond)) {
+		t.Errorf("expected the limiter to be in debt")
+	}
+	if !a.ready(now.Add(200 * time.Millisecond)) {
+		t.Errorf("expected the limiter to refill at its rate")
+	}
+
+	var none *admissionLimiter
+	none.admit(now)
+	if !none.ready(now) {
+		t.Errorf("expected a nil limiter to always be ready")
+	}
+}
+
+func TestBaseServerPool_backendConnectionRate(t *testing.T) {
+	pool := &BaseServerPool{log: log.New(io.Discard, "", 0), admissionSettings: &admissionSettings{rate: 0.001, burst: 2}}
+	pool.AddBackend("tcp://a:80")
+	pool.AddBackend("tcp://b:80")
+	a, b := pool.backends[0], pool.backends[1]
+	a.SetHealthy(true)
+	b.SetHealthy(true)
+
+	counts := make(map[*Backend]int)
+	for range 4 {
+		backend := pool.Next(nil)
+		if backend == nil {
+			t.Fatalf("expected a backend within the rate")
+		}
+		backend.acquire()()
+		counts[backend]++
+	}
+	if counts[a] != 2 || counts[b] != 2 {
+		t.Errorf("expected each backend to get its burst, got %d and %d", counts[a], counts[b])
+	}
+	if backend := pool.Next(nil); backend != nil {
+		t.Errorf("expected no backend once all exceed their rate, got %s", backend.URL)
+	}
+
+	rec := httptest.NewRecorder()
+	pool.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if want := `nlb_backend_rate_limited{backend="tcp://a:80"} 1`; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("expected metrics to contain %q", want)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultAffinityTimeout  = time.Second
+	defaultAffinityMaxBytes = 1024
+	maxAffinityMaxBytes     = 64 << 10
+)
+
+// affinityExtractor finds an affinity key in the first bytes a client sends.
+// extract returns the key with prefixMatch, prefixUndecided if more bytes
+// may reveal it, or prefixMismatch if data holds no key.
+type affinityExtractor interface {
+	extract(data []byte) (string, int)
+}
+
+// affinityExtractors builds the extractors an affinity config can select. An
+// extractor for another protocol is added by registering its constructor
+// here.
+var affinityExtractors = map[string]func(config *AffinityConfig) (affinityExtractor, error){
+	"resp":   newRESPExtractor,
+	"kafka":  newKafkaExtractor,
+	"header": newHeaderExtractor,
+	"regexp": newRegexpExtractor,
+}
+
+// affinity hashes connections to backends by a key parsed from the first
+// bytes clients send, so that clients sharing an application identity, such
+// as a cache key or client id, reach the same backend whatever their
+// address.
+type affinity struct {
+	extractor affinityExtractor
+	timeout   time.Duration
+	maxBytes  int
+
+	keyed   atomic.Uint64
+	unkeyed atomic.Uint64
+}
+
+func newAffinity(config *AffinityConfig) (*affinity, error) {
+	if config == nil || !config.Enabled {
+		return nil, nil
+	}
+	build, ok := affinityExtractors[config.Extractor]
+	if !ok {
+		return nil, fmt.Errorf("unsupported affinity extractor %q", config.Extractor)
+	}
+	extractor, err := build(config)
+	if err != nil {
+		return nil, fmt.Errorf("affinity %s extractor: %w", config.Extractor, err)
+	}
+	a := &affinity{extractor: extractor, timeout: defaultAffinityTimeout, maxBytes: defaultAffinityMaxBytes}
+	if config.Timeout != "" {
+		d, err := time.ParseDuration(config.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid affinity timeout: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("affinity timeout must be positive")
+		}
+		a.timeout = d
+	}
+	if config.MaxBytes != 0 {
+		if config.MaxBytes < 1 || config.MaxBytes > maxAffinityMaxBytes {
+			return nil, fmt.Errorf("affinity max_bytes must be between 1 and %d", maxAffinityMaxBytes)
+		}
+		a.maxBytes = config.MaxBytes
+	}
+	return a, nil
+}
+
+// count records whether a connection had a key.
+func (a *affinity) count(key string) string {
+	if key == "" {
+		a.unkeyed.Add(1)
+	} else {
+		a.keyed.Add(1)
+	}
+	return key
+}
+
+// read reads up to maxBytes from the client, waiting at most the timeout,
+// and returns a connection replaying them with the key they hold, or "" if
+// they hold none.
+func (a *affinity) read(conn net.Conn) (net.Conn, string) {
+	br := bufio.NewReaderSize(conn, a.maxBytes)
+	conn.SetReadDeadline(time.Now().Add(a.timeout))
+	var key string
+	peekUntil(br, func(b []byte) bool {
+		k, status := a.extractor.extract(b)
+		key = k
+		return status != prefixUndecided
+	})
+	conn.SetReadDeadline(time.Time{})
+	return &peekedConn{Conn: conn, r: br}, a.count(key)
+}
+
+// datagramKey returns the key a datagram holds, or "" if it holds none.
+func (a *affinity) datagramKey(data []byte) string {
+	key, status := a.extractor.extract(data)
+	if status != prefixMatch {
+		key = ""
+	}
+	return a.count(key)
+}
+
+// respExtractor takes the key of a Redis command, its first argument, in
+// either the RESP array or the inline form.
+type respExtractor struct{}
+
+func newRESPExtractor(*AffinityConfig) (affinityExtractor, error) {
+	return respExtractor{}, nil
+}
+
+func (respExtractor) extract(data []byte) (string, int) {
+	if len(data) == 0 {
+		return "", prefixUndecided
+	}
+	if data[0] != '*' {
+		line, ok := cutLine(data)
+		if !ok {
+			return "", prefixUndecided
+		}
+		fields := strings.Fields(string(line))
+		if len(fields) < 2 {
+			return "", prefixMismatch
+		}
+		return fields[1], prefixMatch
+	}
+
+	// *<count>\r\n$<len>\r\n<command>\r\n$<len>\r\n<key>\r\n
+	line, ok := cutLine(data[1:])
+	if !ok {
+		return "", prefixUndecided
+	}
+	if n, err := strconv.Atoi(string(line)); err != nil || n < 2 {
+		return "", prefixMismatch
+	}
+	rest := data[1+len(line)+2:]
+	for i := range 2 {
+		if len(rest) == 0 {
+			return "", prefixUndecided
+		}
+		if rest[0] != '$' {
+			return "", prefixMismatch
+		}
+		line, ok := cutLine(rest[1:])
+		if !ok {
+			return "", prefixUndecided
+		}
+		size, err := strconv.Atoi(string(line))
+		if err != nil || size < 0 {
+			return "", prefixMismatch
+		}
+		rest = rest[1+len(line)+2:]
+		if len(rest) < size {
+			return "", prefixUndecided
+		}
+		if i == 1 {
+			return string(rest[:size]), prefixMatch
+		}
+		rest = rest[min(size+2, len(rest)):]
+	}
+	return "", prefixMismatch
+}
+
+// cutLine returns data up to the first CRLF, and whether there is one.
+func cutLine(data []byte) ([]byte, bool) {
+	line, _, ok := bytes.Cut(data, []byte("\r\n"))
+	return line, ok
+}
+
+// kafkaExtractor takes the client id from the header of the first Kafka
+// request: its size, API key, API version and correlation id, followed by
+// the client id as a length-prefixed string.
+type kafkaExtractor struct{}
+
+func newKafkaExtractor(*AffinityConfig) (affinityExtractor, error) {
+	return kafkaExtractor{}, nil
+}
+
+func (kafkaExtractor) extract(data []byte) (string, int) {
+	const clientIDOffset = 4 + 2 + 2 + 4
+	if len(data) < clientIDOffset+2 {
+		return "", prefixUndecided
+	}
+	size := int16(binary.BigEndian.Uint16(data[clientIDOffset:]))
+	if size <= 0 {
+		// A null or empty client id.
+		return "", prefixMismatch
+	}
+	id := data[clientIDOffset+2:]
+	if len(id) < int(size) {
+		return "", prefixUndecided
+	}
+	return string(id[:size]), prefixMatch
+}
+
+// headerExtractor takes the value of a "Name: value" header line, e.g. in
+// an HTTP request or a line-based protocol, until the first empty line.
+type headerExtractor struct {
+	name string
+}
+
+func newHeaderExtractor(config *AffinityConfig) (affinityExtractor, error) {
+	if config.Header == "" {
+		return nil, errors.New("header is required")
+	}
+	return headerExtractor{name: config.Header}, nil
+}
+
+func (e headerExtractor) extract(data []byte) (string, int) {
+	for {
+		line, rest, ok := bytes.Cut(data, []byte("\n"))
+		if !ok {
+			return "", prefixUndecided
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) == 0 {
+			return "", prefixMismatch
+		}
+		if name, value, ok := bytes.Cut(line, []byte(":")); ok && strings.EqualFold(string(bytes.TrimSpace(name)), e.name) {
+			if value = bytes.TrimSpace(value); len(value) == 0 {
+				return "", prefixMismatch
+			}
+			return string(value), prefixMatch
+		}
+		data = rest
+	}
+}
+
+// regexpExtractor takes the first submatch of a pattern, or the whole match
+// if it has no group.
+type regexpExtractor struct {
+	pattern *regexp.Regexp
+}
+
+func newRegexpExtractor(config *AffinityConfig) (affinityExtractor, error) {
+	if config.Regexp == "" {
+		return nil, errors.New("regexp is required")
+	}
+	pattern, err := regexp.Compile(config.Regexp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regexp: %w", err)
+	}
+	return regexpExtractor{pattern: pattern}, nil
+}
+
+func (e regexpExtractor) extract(data []byte) (string, int) {
+	m := e.pattern.FindSubmatch(data)
+	switch {
+	case m == nil:
+		return "", prefixUndecided
+	case len(m) > 1:
+		return string(m[1]), prefixMatch
+	default:
+		return string(m[0]), prefixMatch
+	}
+}
+
+// nextForKey returns the backend an affinity key hashes to or, if it is
+// unavailable, the next available one. Local zone backends are preferred as
+// by Next.
+func (p *BaseServerPool) nextForKey(key string) *Backend {
+	s := p.currentSelection()
+	hash := hashKey(key)
+	if backend := p.selectHashed(s.local, hash, stickyClient{key: key}); backend != nil {
+		return backend
+	}
+	return p.selectHashed(s.backends, hash, stickyClient{key: key})
+}
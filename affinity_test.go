@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_newAffinity(t *testing.T) {
+	if a, err := newAffinity(nil); a != nil || err != nil {
+		t.Errorf("expected no affinity when not configured, got %v, %v", a, err)
+	}
+	a, err := newAffinity(&AffinityConfig{Enabled: true, Extractor: "resp"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if a.timeout != defaultAffinityTimeout || a.maxBytes != defaultAffinityMaxBytes {
+		t.Errorf("expected the defaults, got %s and %d", a.timeout, a.maxBytes)
+	}
+	for _, config := range []*AffinityConfig{
+		{Enabled: true, Extractor: "memcached"},
+		{Enabled: true, Extractor: "header"},
+		{Enabled: true, Extractor: "regexp"},
+		{Enabled: true, Extractor: "regexp", Regexp: "("},
+		{Enabled: true, Extractor: "resp", Timeout: "0s"},
+		{Enabled: true, Extractor: "resp", MaxBytes: maxAffinityMaxBytes + 1},
+	} {
+		if _, err := newAffinity(config); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
+
+func kafkaRequest(clientID string) []byte {
+	b := binary.BigEndian.AppendUint32(nil, 0) // size
+	b = binary.BigEndian.AppendUint16(b, 3)    // api key
+	b = binary.BigEndian.AppendUint16(b, 12)   // api version
+	b = binary.BigEndian.AppendUint32(b, 1)    // correlation id
+	b = binary.BigEndian.AppendUint16(b, uint16(len(clientID)))
+	return append(b, clientID...)
+}
+
+func Test_affinityExtractors(t *testing.T) {
+	config := &AffinityConfig{Header: "X-Tenant", Regexp: `user=(\w+)`}
+	tests := []struct {
+		extractor string
+		data      string
+		key       string
+		status    int
+	}{
+		{"resp", "*2\r\n$3\r\nGET\r\n$6\r\nuser:1\r\n", "user:1", prefixMatch},
+		{"resp", "*3\r\n$3\r\nSET\r\n$6\r\nuser:1\r\n$1\r\nx\r\n", "user:1", prefixMatch},
+		{"resp", "*2\r\n$3\r\nGET\r\n$6\r\nuse", "", prefixUndecided},
+		{"resp", "*1\r\n$4\r\nPING\r\n", "", prefixMismatch},
+		{"resp", "GET user:2\r\n", "user:2", prefixMatch},
+		{"resp", "GET user:2", "", prefixUndecided},
+		{"resp", "PING\r\n", "", prefixMismatch},
+		{"kafka", string(kafkaRequest("billing")), "billing", prefixMatch},
+		{"kafka", string(kafkaRequest("billing")[:16]), "", prefixUndecided},
+		{"kafka", string(kafkaRequest("")), "", prefixMismatch},
+		{"header", "GET / HTTP/1.1\r\nHost: a\r\nx-tenant: acme\r\n\r\n", "acme", prefixMatch},
+		{"header", "GET / HTTP/1.1\r\nHost: a\r\n", "", prefixUndecided},
+		{"header", "GET / HTTP/1.1\r\nHost: a\r\n\r\nX-Tenant: acme\r\n", "", prefixMismatch},
+		{"regexp", "HELLO user=bob\n", "bob", prefixMatch},
+		{"regexp", "HELLO", "", prefixUndecided},
+	}
+	for _, tt := range tests {
+		e, err := affinityExtractors[tt.extractor](config)
+		if err != nil {
+			t.Fatalf("failed to create %s extractor: %v", tt.extractor, err)
+		}
+		if key, status := e.extract([]byte(tt.data)); key != tt.key || status != tt.status {
+			t.Errorf("%s extractor on %q: expected %q, %d, got %q, %d", tt.extractor, tt.data, tt.key, tt.status, key, status)
+		}
+	}
+}
+
+func TestAffinity_read(t *testing.T) {
+	a, _ := newAffinity(&AffinityConfig{Enabled: true, Extractor: "resp"})
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	const request = "*2\r\n$3\r\nGET\r\n$6\r\nuser:1\r\n"
+	go client.Write([]byte(request))
+	conn, key := a.read(server)
+	if key != "user:1" {
+		t.Errorf("expected key user:1, got %q", key)
+	}
+	// The peeked bytes are replayed to the backend.
+	buf := make([]byte, len(request))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != request {
+		t.Errorf("expected the request to be replayed, got %q, %v", buf, err)
+	}
+	if a.keyed.Load() != 1 || a.unkeyed.Load() != 0 {
+		t.Errorf("expected one keyed connection, got %d keyed and %d unkeyed", a.keyed.Load(), a.unkeyed.Load())
+	}
+}
+
+func TestUDPServerPool_keyedBackend(t *testing.T) {
+	config := &Config{
+		Addr:     "127.0.0.1:0",
+		Affinity: &AffinityConfig{Enabled: true, Extractor: "regexp", Regexp: `^([\w-]+):`},
+	}
+	for _, addr := range []string{"10.0.0.1:53", "10.0.0.2:53", "10.0.0.3:53"} {
+		config.Backends = append(config.Backends, BackendConfig{URL: "udp://" + addr})
+	}
+	pool, err := NewUDPServerPool(log.New(io.Discard, "", 0), config)
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	for _, b := range pool.backends {
+		b.SetHealthy(true)
+	}
+
+	first := pool.keyedBackend([]byte("tenant-a:cpu 1"))
+	if first == nil {
+		t.Fatalf("expected a backend for a keyed datagram")
+	}
+	for range 5 {
+		if b := pool.keyedBackend([]byte("tenant-a:mem 2")); b != first {
+			t.Errorf("expected every datagram of a key to reach %s, got %v", first.URL, b)
+		}
+	}
+	if b := pool.keyedBackend([]byte("no key here")); b != nil {
+		t.Errorf("expected no backend for a datagram without a key, got %s", b.URL)
+	}
+
+	// The next available backend takes over while the key's is down.
+	first.SetHealthy(false)
+	if b := pool.keyedBackend([]byte("tenant-a:cpu 1")); b == nil || b == first {
+		t.Errorf("expected another backend while %s is down, got %v", first.URL, b)
+	}
+
+	rec := httptest.NewRecorder()
+	pool.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), `nlb_affinity_connections_total{result="keyed"} 7`) {
+		t.Errorf("expected 7 keyed datagrams in the metrics")
+	}
+}
+
+func TestTCPServerPool_affinity(t *testing.T) {
+	config := &Config{
+		Addr:     "127.0.0.1:0",
+		Affinity: &AffinityConfig{Enabled: true, Extractor: "resp", Timeout: "100ms"},
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		config.Backends = append(config.Backends, BackendConfig{URL: "tcp://" + startNamedBackend(t, name)})
+	}
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), config)
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	for _, b := range pool.backends {
+		b.SetHealthy(true)
+	}
+	if err := pool.Start(); err != nil {
+		t.Fatalf("failed to start server pool: %v", err)
+	}
+	shutdownOnCleanup(t, pool)
+
+	// backendFor returns the name of the backend a command reaches.
+	backendFor := func(command string) string {
+		t.Helper()
+		conn, err := net.Dial("tcp", pool.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte(command)); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		return string(buf[:1])
+	}
+
+	want := backendFor("GET session:42\r\n")
+	for range 5 {
+		if got := backendFor("*2\r\n$3\r\nGET\r\n$10\r\nsession:42\r\n"); got != want {
+			t.Errorf("expected every command on session:42 to reach backend %s, got %s", want, got)
+		}
+	}
+}
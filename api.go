@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// backendView is the JSON representation of a backend in the admin API.
+type backendView struct {
+	ID                string            `json:"id"`
+	URL               string            `json:"url"`
+	Healthy           bool              `json:"healthy"`
+	Error             string            `json:"error,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	ActiveConnections int64             `json:"active_connections"`
+	BytesSent         uint64            `json:"bytes_sent"`
+	BytesReceived     uint64            `json:"bytes_received"`
+	// SendRate and ReceiveRate are the bytes per second forwarded to and
+	// received from the backend over the last 10 seconds.
+	SendRate    float64 `json:"send_rate"`
+	ReceiveRate float64 `json:"receive_rate"`
+	// Circuit is the circuit breaker state, if circuit breaking is enabled.
+	Circuit string `json:"circuit,omitempty"`
+	// Flapping is set while the backend is held down for flapping.
+	Flapping bool `json:"flapping,omitempty"`
+	// State is the backend's health state: healthy, degraded or unhealthy.
+	State string `json:"state"`
+	// Degraded is set while the backend passes its health checks but is
+	// impaired, with DeepError if it fails its deep check.
+	Degraded  bool   `json:"degraded,omitempty"`
+	DeepError string `json:"deep_error,omitempty"`
+	// Group is the backend's blue/green group, if any.
+	Group string `json:"group,omitempty"`
+	// BackendGroup is the shared backend group the backend belongs to.
+	BackendGroup string `json:"backend_group,omitempty"`
+	// Forced is the health the backend is forced to through the admin API.
+	Forced       string `json:"forced,omitempty"`
+	ChecksPaused bool   `json:"checks_paused,omitempty"`
+	// Draining is set while the backend is drained through the admin API.
+	Draining bool `json:"draining,omitempty"`
+	// Sockets reports how sockets to a UDP backend are reused.
+	Sockets *socketView `json:"sockets,omitempty"`
+}
+
+func newBackendView(b *Backend) backendView {
+	v := backendView{
+		ID:                b.ID,
+		URL:               b.URL.String(),
+		Healthy:           b.Healthy(),
+		Labels:            b.Labels,
+		ActiveConnections: b.ActiveConnections(),
+		BytesSent:         b.BytesSent(),
+		BytesReceived:     b.BytesReceived(),
+		Group:             b.group,
+		BackendGroup:      b.sharedGroup,
+	}
+	now := time.Now()
+	v.SendRate, v.ReceiveRate = b.SendRate(now), b.ReceiveRate(now)
+	if err := b.LastError(); err != nil {
+		v.Error = err.Error()
+	}
+	if b.breaker != nil {
+		v.Circuit = b.breaker.State()
+	}
+	_, v.Flapping = b.history.heldDown(time.Now())
+	v.State = b.State()
+	v.Degraded, v.DeepError = v.State == stateDegraded, b.DeepError()
+	v.Forced, v.ChecksPaused = b.healthOverride()
+	v.Draining = b.Draining()
+	if b.URL.Scheme == "udp" {
+		sockets := b.sockets.view()
+		v.Sockets = &sockets
+	}
+	return v
+}
+
+// backendsAPIHandler lists the backends in the pool.
+func (p *BaseServerPool) backendsAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	views := []backendView{}
+	for _, b := range p.Backends() {
+		views = append(views, newBackendView(b))
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// healthHistoryAPIHandler returns a backend's recent health transitions and
+// whether it is held down for flapping.
+func (p *BaseServerPool) healthHistoryAPIHandler(w http.ResponseWriter, r *http.Request) {
+	b := p.findBackend(r.PathValue("backend"))
+	if b == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("backend %q not found", r.PathValue("backend")))
+		return
+	}
+	writeJSON(w, http.StatusOK, newHealthHistoryView(b, time.Now()))
+}
+
+// addBackendAPIHandler adds a backend described by a BackendConfig in the
+// request body.
+func (p *BaseServerPool) addBackendAPIHandler(w http.ResponseWriter, r *http.Request) {
+	var config BackendConfig
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	config.runtime = true
+	b, err := p.addBackend(config)
+	if errors.Is(err, errDuplicateBackend) {
+		writeError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	infof(p.log, "added backend %s (%s)", b.URL, b.ID)
+	writeJSON(w, http.StatusCreated, newBackendView(b))
+}
+
+// policyView is the JSON representation of the pool's traffic policy.
+type policyView struct {
+	Algorithm      string `json:"algorithm"`
+	StickySessions bool   `json:"sticky_sessions"`
+}
+
+// policyAPIHandler returns the current traffic policy.
+func (p *BaseServerPool) policyAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	algorithm, sticky := p.Policy()
+	writeJSON(w, http.StatusOK, policyView{Algorithm: algorithm, StickySessions: sticky})
+}
+
+// setPolicyAPIHandler updates the traffic policy. Fields omitted from the
+// request body keep their current value.
+func (p *BaseServerPool) setPolicyAPIHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Algorithm      *string `json:"algorithm"`
+		StickySessions *bool   `json:"sticky_sessions"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	algorithm, sticky := p.Policy()
+	if req.Algorithm != nil {
+		algorithm = *req.Algorithm
+	}
+	if req.StickySessions != nil {
+		sticky = *req.StickySessions
+	}
+	if err := p.SetPolicy(algorithm, sticky); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	algorithm, sticky = p.Policy()
+	infof(p.log, "traffic policy changed: algorithm=%s sticky_sessions=%t", algorithm, sticky)
+	writeJSON(w, http.StatusOK, policyView{Algorithm: algorithm, StickySessions: sticky})
+}
+
+// writeError writes err as a JSON error response.
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_backendsAPIHandler(t *testing.T) {
+	pool := &BaseServerPool{}
+	pool.addBackend(BackendConfig{URL: "http://localhost:8080", Labels: map[string]string{"zone": "a"}})
+	pool.AddBackend("http://localhost:8081")
+	pool.backends[0].SetHealthy(true)
+
+	rec := httptest.NewRecorder()
+	pool.backendsAPIHandler(rec, httptest.NewRequest("GET", "/api/backends", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", rec.Code)
+	}
+
+	var views []backendView
+	if err := json.NewDecoder(rec.Body).Decode(&views); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(views) != 2 {
+		t.Fatalf("expected 2 backends, got %d", len(views))
+	}
+	if views[0].URL != "http://localhost:8080" || !views[0].Healthy || views[0].Labels["zone"] != "a" {
+		t.Errorf("unexpected backend %+v", views[0])
+	}
+	if views[1].Healthy || views[1].Labels != nil {
+		t.Errorf("unexpected backend %+v", views[1])
+	}
+}
+
+func Test_addBackendAPIHandler(t *testing.T) {
+	pool := &BaseServerPool{log: log.New(io.Discard, "", 0)}
+
+	for _, tc := range []struct {
+		body string
+		code int
+	}{
+		{`{"url": "http://localhost:8080", "labels": {"zone": "a"}}`, http.StatusCreated},
+		{`{"url": "tcp://localhost:8080"}`, http.StatusConflict},
+		{`{"url": "localhost"}`, http.StatusBadRequest},
+		{`not json`, http.StatusBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		pool.addBackendAPIHandler(rec, httptest.NewRequest("POST", "/api/backends", strings.NewReader(tc.body)))
+		if rec.Code != tc.code {
+			t.Errorf("expected status %d for %s, got %d: %s", tc.code, tc.body, rec.Code, rec.Body)
+		}
+	}
+
+	if len(pool.backends) != 1 || pool.backends[0].Labels["zone"] != "a" {
+		t.Errorf("expected a single labelled backend, got %v", pool.backends)
+	}
+}
+
+func Test_setPolicyAPIHandler(t *testing.T) {
+	pool := &BaseServerPool{algorithm: AlgorithmRoundRobin, log: log.New(io.Discard, "", 0)}
+
+	rec := httptest.NewRecorder()
+	pool.setPolicyAPIHandler(rec, httptest.NewRequest("PUT", "/api/policy", strings.NewReader(`{"algorithm": "least-connections"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if algorithm, sticky := pool.Policy(); algorithm != AlgorithmLeastConnections || sticky {
+		t.Errorf("expected least-connections without sticky sessions, got %s/%t", algorithm, sticky)
+	}
+
+	rec = httptest.NewRecorder()
+	pool.setPolicyAPIHandler(rec, httptest.NewRequest("PUT", "/api/policy", strings.NewReader(`{"sticky_sessions": true}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if algorithm, sticky := pool.Policy(); algorithm != AlgorithmLeastConnections || !sticky {
+		t.Errorf("expected algorithm to be kept and sticky sessions enabled, got %s/%t", algorithm, sticky)
+	}
+
+	rec = httptest.NewRecorder()
+	pool.setPolicyAPIHandler(rec, httptest.NewRequest("PUT", "/api/policy", strings.NewReader(`{"algorithm": "random"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for unknown algorithm, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	pool.policyAPIHandler(rec, httptest.NewRequest("GET", "/api/policy", nil))
+	var policy policyView
+	if err := json.NewDecoder(rec.Body).Decode(&policy); err != nil {
+		t.Fatalf("failed to decode policy: %v", err)
+	}
+	if policy.Algorithm != AlgorithmLeastConnections || !policy.StickySessions {
+		t.Errorf("unexpected policy %+v", policy)
+	}
+}
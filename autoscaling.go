@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// utilizationReport is the payload published for autoscalers.
+type utilizationReport struct {
+	Timestamp time.Time            `json:"timestamp"`
+	Listener  string               `json:"listener"`
+	Backends  []backendUtilization `json:"backends"`
+}
+
+// backendUtilization describes the load observed on a single backend since
+// the previous report.
+type backendUtilization struct {
+	Backend                string   `json:"backend"`
+	Healthy                bool     `json:"healthy"`
+	ActiveConnections      int64    `json:"active_connections"`
+	MaxConnections         int64    `json:"max_connections,omitempty"`
+	Utilization            *float64 `json:"utilization,omitempty"`
+	BytesSentPerSecond     float64  `json:"bytes_sent_per_second"`
+	BytesReceivedPerSecond float64  `json:"bytes_received_per_second"`
+}
+
+// byteCounters is a snapshot of a backend's traffic counters.
+type byteCounters struct {
+	sent, received uint64
+}
+
+// utilizationExporter periodically publishes backend utilization to an HTTP
+// endpoint and/or a file.
+type utilizationExporter struct {
+	pool     ServerPool
+	listener string
+	interval time.Duration
+	url      string
+	file     string
+	client   *http.Client
+	log      *log.Logger
+
+	last     map[*Backend]byteCounters
+	lastTime time.Time
+	shutdown chan struct{}
+	done     chan struct{}
+}
+
+// newUtilizationExporter creates an exporter for the given pool.
+func newUtilizationExporter(l *log.Logger, config *AutoscalingExportConfig, listener string, pool ServerPool) (*utilizationExporter, error) {
+	if config.URL == "" && config.File == "" {
+		return nil, fmt.Errorf("autoscaling export requires a url or file")
+	}
+
+	if config.Interval == "" {
+		config.Interval = "30s"
+	}
+	interval, err := time.ParseDuration(config.Interval)
+	if err != nil {
+		return nil, fmt.Errorf("invalid autoscaling export interval: %w", err)
+	}
+
+	return &utilizationExporter{
+		pool:     pool,
+		listener: listener,
+		interval: interval,
+		url:      config.URL,
+		file:     config.File,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		log:      l,
+		last:     make(map[*Backend]byteCounters),
+		lastTime: time.Now(),
+		shutdown: make(chan struct{}),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Start begins publishing reports every interval.
+func (e *utilizationExporter) Start() {
+	go func() {
+		defer close(e.done)
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				if err := e.publish(e.report(now)); err != nil {
+					warnf(e.log, "error publishing utilization report: %v", err)
+				}
+			case <-e.shutdown:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops publishing reports and waits for the exporter to exit.
+func (e *utilizationExporter) Stop() {
+	close(e.shutdown)
+	<-e.done
+}
+
+// report computes utilization for every backend in the pool. Throughput is
+// averaged over the time since the previous report.
+func (e *utilizationExporter) report(now time.Time) utilizationReport {
+	elapsed := now.Sub(e.lastTime).Seconds()
+	e.lastTime = now
+
+	maxConns := e.pool.MaxConnections()
+	report := utilizationReport{Timestamp: now.UTC(), Listener: e.listener}
+	current := make(map[*Backend]byteCounters)
+	for _, b := range e.pool.Backends() {
+		counters := byteCounters{sent: b.BytesSent(), received: b.BytesReceived()}
+		current[b] = counters
+
+		u := backendUtilization{
+			Backend:           b.URL.String(),
+			Healthy:           b.Healthy(),
+			ActiveConnections: b.ActiveConnections(),
+			MaxConnections:    maxConns,
+		}
+		if maxConns > 0 {
+			utilization := float64(u.ActiveConnections) / float64(maxConns)
+			u.Utilization = &utilization
+		}
+		if elapsed > 0 {
+			prev := e.last[b]
+			u.BytesSentPerSecond = float64(counters.sent-prev.sent) / elapsed
+			u.BytesReceivedPerSecond = float64(counters.received-prev.received) / elapsed
+		}
+		report.Backends = append(report.Backends, u)
+	}
+	e.last = current
+	return report
+}
+
+// publish sends the report to the configured destinations.
+func (e *utilizationExporter) publish(report utilizationReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("could not encode report: %w", err)
+	}
+
+	if e.file != "" {
+		// Write to a temporary file first so readers never see a partial report.
+		tmp, err := os.CreateTemp(filepath.Dir(e.file), ".nlb-utilization-*")
+		if err != nil {
+			return fmt.Errorf("could not create report file: %w", err)
+		}
+		if _, err := tmp.Write(data); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return fmt.Errorf("could not write report file: %w", err)
+		}
+		tmp.Close()
+		if err := os.Rename(tmp.Name(), e.file); err != nil {
+			os.Remove(tmp.Name())
+			return fmt.Errorf("could not replace report file: %w", err)
+		}
+	}
+
+	if e.url != "" {
+		resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("could not post report: %w", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("unexpected status posting report: %s", resp.Status)
+		}
+	}
+
+	return nil
+}
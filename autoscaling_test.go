@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_utilizationExporter_report(t *testing.T) {
+	pool := &TCPServerPool{BaseServerPool: BaseServerPool{maxConnections: 4}}
+	pool.AddBackend("http://localhost:8080")
+	pool.backends[0].SetHealthy(true)
+	pool.backends[0].acquire()
+
+	e, err := newUtilizationExporter(log.New(io.Discard, "", 0), &AutoscalingExportConfig{File: "report.json"}, ":9090", pool)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	pool.backends[0].bytesSent.Add(2000)
+	pool.backends[0].bytesReceived.Add(500)
+	report := e.report(e.lastTime.Add(2 * time.Second))
+
+	if len(report.Backends) != 1 {
+		t.Fatalf("expected 1 backend, got %d", len(report.Backends))
+	}
+	u := report.Backends[0]
+	if u.ActiveConnections != 1 || u.MaxConnections != 4 {
+		t.Errorf("expected 1/4 connections, got %d/%d", u.ActiveConnections, u.MaxConnections)
+	}
+	if u.Utilization == nil || *u.Utilization != 0.25 {
+		t.Errorf("expected utilization 0.25, got %v", u.Utilization)
+	}
+	if u.BytesSentPerSecond != 1000 || u.BytesReceivedPerSecond != 250 {
+		t.Errorf("expected 1000/250 bytes per second, got %v/%v", u.BytesSentPerSecond, u.BytesReceivedPerSecond)
+	}
+}
+
+func Test_utilizationExporter_publish(t *testing.T) {
+	received := make(chan utilizationReport, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report utilizationReport
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			t.Errorf("failed to decode report: %v", err)
+		}
+		received <- report
+	}))
+	defer srv.Close()
+
+	file := filepath.Join(t.TempDir(), "report.json")
+	pool := &TCPServerPool{}
+	pool.AddBackend("http://localhost:8080")
+
+	e, err := newUtilizationExporter(log.New(io.Discard, "", 0), &AutoscalingExportConfig{URL: srv.URL, File: file}, ":9090", pool)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := e.publish(e.report(time.Now())); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	select {
+	case report := <-received:
+		if report.Listener != ":9090" || len(report.Backends) != 1 {
+			t.Errorf("unexpected report posted: %+v", report)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("timeout waiting for report")
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("failed to read report file: %v", err)
+	}
+	var report utilizationReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Errorf("failed to decode report file: %v", err)
+	}
+}
+
+func Test_newUtilizationExporter_noDestination(t *testing.T) {
+	if _, err := newUtilizationExporter(nil, &AutoscalingExportConfig{}, ":9090", &TCPServerPool{}); err == nil {
+		t.Errorf("expected error without url or file")
+	}
+}
@@ -1,16 +1,104 @@
 package main
 
 import (
+	"cmp"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"net"
 	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// errDuplicateBackend is returned when adding a backend whose address is
+// already in the pool.
+var errDuplicateBackend = errors.New("duplicate backend")
+
 // Backend represents a backend server with its URL and status.
 type Backend struct {
+	// ID is a stable identifier derived from the backend's address, and
+	// keyHash its hash for consistent sticky sessions.
+	ID        string
+	keyHash   int
 	URL       *url.URL
 	mux       sync.Mutex
 	isHealthy bool
-	Error     error
+	lastErr   error
+	// forced overrides the health checker with forceHealthy or
+	// forceUnhealthy if set, and checksPaused stops probing the backend.
+	forced       string
+	checksPaused bool
+	// Labels are arbitrary key/value metadata from the backend's config.
+	Labels map[string]string
+
+	// DialLatency tracks how long it takes to establish a connection to the backend.
+	DialLatency latencyTracker
+	// FirstByteLatency tracks the time between connecting to the backend and
+	// receiving its first byte.
+	FirstByteLatency latencyTracker
+	// dialHistogram buckets dial latencies, with the connections they were
+	// observed for as exemplars.
+	dialHistogram latencyHistogram
+	// ResponseTime is a moving average of recent dial (TCP) or round-trip
+	// (UDP) latency, used by the least-response-time algorithm.
+	ResponseTime ewma
+
+	// dialTimeout overrides the pool's dial timeout when non-zero.
+	dialTimeout time.Duration
+	// resolver is the pool's cache of backend hostname resolutions.
+	resolver *dnsCache
+	// device is the device, or VRF, connections to the backend are bound
+	// to, if any.
+	device string
+	// tls holds the backend's own TLS settings as configured, and
+	// tlsConfig is non-nil if connections to it are re-encrypted.
+	tls       *BackendTLSConfig
+	tlsConfig *tls.Config
+	// breaker is nil unless circuit breaking is enabled.
+	breaker *circuitBreaker
+	// admission is nil unless the rate of new connections is limited.
+	admission *admissionLimiter
+	// static is the response of a static backend.
+	static []byte
+	// slo is nil unless SLO tracking is enabled.
+	slo *sloTracker
+	// runtime is set on backends added through the admin API rather than
+	// the config file.
+	runtime bool
+	// group is the blue/green group of the backend, if any.
+	group string
+	// sharedGroup is the backend group whose shared health checks the
+	// backend follows, if any.
+	sharedGroup string
+	// history records the backend's recent health transitions, and probes
+	// the latency and outcome of its recent health check probes.
+	history healthHistory
+	probes  probeSeries
+	// degradation records why the backend is degraded, if it is.
+	degradation degradation
+	// removed is closed when the backend is removed from its pool.
+	removed chan struct{}
+	// drain is non-nil while the backend is draining, and closed if the
+	// drain is cancelled.
+	drain chan struct{}
+
+	activeConns   atomic.Int64
+	totalConns    atomic.Uint64
+	bytesSent     byteCounter
+	bytesReceived byteCounter
+	// sockets records how UDP sockets to the backend are reused.
+	sockets socketStats
+	// connsRecent and failuresRecent count connections and failures since
+	// statistics were last reset.
+	connsRecent    rollingCounter
+	failuresRecent rollingCounter
 }
 
 // Healthy checks the status of the backend.
@@ -26,3 +114,208 @@ func (b *Backend) SetHealthy(healthy bool) {
 	defer b.mux.Unlock()
 	b.isHealthy = healthy
 }
+
+// swapHealthy sets the status of the backend and returns the previous one.
+func (b *Backend) swapHealthy(healthy bool) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	was := b.isHealthy
+	b.isHealthy = healthy
+	return was
+}
+
+// Draining reports whether the backend is being drained.
+func (b *Backend) Draining() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.drain != nil
+}
+
+// startDrain marks the backend as draining and returns a channel that is
+// closed if the drain is cancelled, or nil if it is already draining.
+func (b *Backend) startDrain() chan struct{} {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.drain != nil {
+		return nil
+	}
+	b.drain = make(chan struct{})
+	return b.drain
+}
+
+// stopDrain cancels the backend's drain and reports whether it was
+// draining.
+func (b *Backend) stopDrain() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.drain == nil {
+		return false
+	}
+	close(b.drain)
+	b.drain = nil
+	return true
+}
+
+// LastError returns the error from the most recent failed health check, or
+// nil if the last check passed.
+func (b *Backend) LastError() error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.lastErr
+}
+
+func (b *Backend) setLastError(err error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.lastErr = err
+}
+
+// ActiveConnections returns the number of connections currently proxied to the backend.
+func (b *Backend) ActiveConnections() int64 {
+	return b.activeConns.Load()
+}
+
+// TotalConnections returns the number of connections proxied to the backend
+// since it was added.
+func (b *Backend) TotalConnections() uint64 {
+	return b.totalConns.Load()
+}
+
+// acquire records a new connection to the backend and returns a func that
+// releases it.
+func (b *Backend) acquire() func() {
+	b.totalConns.Add(1)
+	b.connsRecent.Add(time.Now())
+	b.admission.admit(time.Now())
+	b.activeConns.Add(1)
+	return func() { b.activeConns.Add(-1) }
+}
+
+// BytesSent returns the total number of bytes forwarded to the backend.
+func (b *Backend) BytesSent() uint64 {
+	return b.bytesSent.Load()
+}
+
+// BytesReceived returns the total number of bytes received from the backend.
+func (b *Backend) BytesReceived() uint64 {
+	return b.bytesReceived.Load()
+}
+
+// SendRate returns the bytes per second recently forwarded to the backend.
+func (b *Backend) SendRate(now time.Time) float64 {
+	return b.bytesSent.Rate(now)
+}
+
+// ReceiveRate returns the bytes per second recently received from the
+// backend.
+func (b *Backend) ReceiveRate(now time.Time) float64 {
+	return b.bytesReceived.Rate(now)
+}
+
+// parseBackendURL parses and validates the backend of a pool serving
+// protocol. Backends are URLs with a supported scheme and a host and port,
+// or a plain host:port or [v6]:port, which is normalized to a URL with the
+// protocol as its scheme. A tcp or udp scheme must match the protocol.
+func parseBackendURL(rawUrl, protocol string) (*url.URL, error) {
+	if portRangePattern.MatchString(rawUrl) {
+		return nil, fmt.Errorf("backend %s: port ranges are only supported in the config file", rawUrl)
+	}
+	if !strings.Contains(rawUrl, "://") {
+		host, port, err := net.SplitHostPort(rawUrl)
+		if err != nil {
+			return nil, fmt.Errorf("backend %s must be a URL or host:port: %w", rawUrl, err)
+		}
+		if host == "" || !validPort(port) {
+			return nil, fmt.Errorf("backend %s must include a host and port", rawUrl)
+		}
+		return &url.URL{Scheme: cmp.Or(protocol, "tcp"), Host: net.JoinHostPort(host, port)}, nil
+	}
+
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "tcp", "udp", "http", "https":
+		if u.Hostname() == "" || !validPort(u.Port()) {
+			return nil, fmt.Errorf("backend %s must include a host and port", rawUrl)
+		}
+		if (u.Scheme == "tcp" || u.Scheme == "udp") && protocol != "" && u.Scheme != protocol {
+			return nil, fmt.Errorf("backend %s cannot be used by a %s listener", rawUrl, protocol)
+		}
+	case debugScheme:
+		if u.Host == "" {
+			return nil, fmt.Errorf("backend %s must include a name", rawUrl)
+		}
+	case staticScheme:
+		if u.Host == "" {
+			return nil, fmt.Errorf("backend %s must include a name", rawUrl)
+		}
+		if protocol == "udp" {
+			return nil, fmt.Errorf("backend %s cannot be used by a udp listener", rawUrl)
+		}
+	default:
+		return nil, fmt.Errorf("backend %s has unsupported scheme %q", rawUrl, u.Scheme)
+	}
+	return u, nil
+}
+
+// maxPortRange is the largest number of backends a port range may expand to.
+const maxPortRange = 1024
+
+// portRangePattern matches a backend address ending in a port range.
+var portRangePattern = regexp.MustCompile(`^(.*:)(\d+)-(\d+)$`)
+
+// expandPortRanges expands each backend whose address ends in a port range,
+// such as 10.0.0.1:8000-8010, into one backend per port in the range. The
+// expanded backends share the labels and dial timeout of the entry.
+func expandPortRanges(backends []BackendConfig) ([]BackendConfig, error) {
+	expanded := make([]BackendConfig, 0, len(backends))
+	for _, bc := range backends {
+		m := portRangePattern.FindStringSubmatch(bc.URL)
+		if m == nil {
+			expanded = append(expanded, bc)
+			continue
+		}
+		first, err := strconv.ParseUint(m[2], 10, 16)
+		if err != nil || first == 0 {
+			return nil, fmt.Errorf("backend %s has an invalid port range", bc.URL)
+		}
+		last, err := strconv.ParseUint(m[3], 10, 16)
+		if err != nil || last < first {
+			return nil, fmt.Errorf("backend %s has an invalid port range", bc.URL)
+		}
+		if last-first >= maxPortRange {
+			return nil, fmt.Errorf("port range of backend %s exceeds %d ports", bc.URL, maxPortRange)
+		}
+		for port := first; port <= last; port++ {
+			b := bc
+			b.URL = m[1] + strconv.FormatUint(port, 10)
+			b.Labels = maps.Clone(bc.Labels)
+			expanded = append(expanded, b)
+		}
+	}
+	return expanded, nil
+}
+
+// validPort reports whether port is a port number between 1 and 65535.
+func validPort(port string) bool {
+	n, err := strconv.ParseUint(port, 10, 16)
+	return err == nil && n != 0
+}
+
+// backendKey returns the address that identifies a backend. Backends with
+// the same host and port are the same backend regardless of scheme.
+func backendKey(u *url.URL) string {
+	if u.Scheme == debugScheme || u.Scheme == staticScheme {
+		return u.Scheme + "://" + strings.ToLower(u.Host)
+	}
+	return strings.ToLower(u.Host)
+}
+
+// backendID derives a stable identifier from the backend's address.
+func backendID(u *url.URL) string {
+	h := fnv.New64a()
+	h.Write([]byte(backendKey(u)))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
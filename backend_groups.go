@@ -0,0 +1,459 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const defaultBackendGroupInterval = 10 * time.Second
+
+// backendGroups holds the backend groups in use by the listeners of a
+// process, so that listeners using the same group share its health checks.
+type backendGroups struct {
+	log *log.Logger
+
+	mux sync.Mutex
+	// groups are keyed by protocol and name, since probes depend on the
+	// protocol.
+	groups map[string]*backendGroup
+}
+
+func newBackendGroups(l *log.Logger) *backendGroups {
+	return &backendGroups{log: l, groups: make(map[string]*backendGroup)}
+}
+
+// get returns the group named by config for a pool of the given protocol,
+// creating it on first use. A group is defined by the config of the first
+// listener using it; listeners defining it differently are rejected. If g is
+// nil the group is not shared.
+func (g *backendGroups) get(l *log.Logger, config *Config, protocol string) (*backendGroup, error) {
+	name := config.BackendGroup
+	def, ok := config.BackendGroups[name]
+	if !ok || def == nil {
+		return nil, fmt.Errorf("backend group %q is not defined", name)
+	}
+	if g == nil {
+		return newBackendGroup(l, name, protocol, def)
+	}
+
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	key := protocol + "/" + name
+	if group, ok := g.groups[key]; ok {
+		if !reflect.DeepEqual(group.config, def) {
+			return nil, fmt.Errorf("backend group %q is defined differently by another listener", name)
+		}
+		return group, nil
+	}
+	group, err := newBackendGroup(g.log, name, protocol, def)
+	if err != nil {
+		return nil, err
+	}
+	g.groups[key] = group
+	return group, nil
+}
+
+// poolBackendGroup returns the backend group used by the listener, if any,
+// and the backends it adds to the pool.
+func poolBackendGroup(l *log.Logger, config *Config, protocol string) (*backendGroup, []BackendConfig, error) {
+	if config.BackendGroup == "" {
+		return nil, nil, nil
+	}
+	group, err := config.groups.get(l, config, protocol)
+	if err != nil {
+		return nil, nil, err
+	}
+	return group, group.currentBackends(), nil
+}
+
+// backendGroup is a named set of backends shared by several pools. Each
+// member is probed by a single loop, which runs while any pool is
+// subscribed to it, and the result is applied to the member's backend in
+// every subscribed pool. The members are discovered by the group's source;
+// unless it is static, it is re-resolved every refresh interval while any
+// pool uses the group, and members are added to and removed from every
+// pool as they come and go.
+type backendGroup struct {
+	name     string
+	protocol string
+	config   *BackendGroupConfig
+	interval time.Duration
+	check    healthCheck
+	resolver *dnsCache
+	log      *log.Logger
+	source   Resolver
+	refresh  time.Duration
+
+	mux      sync.Mutex
+	backends []BackendConfig
+	members  map[string]*groupMember
+	// pools are the pools whose health checks have started, which
+	// membership changes are applied to.
+	pools map[*BaseServerPool]bool
+	// cancel stops re-resolving the group; it is nil while no loop runs.
+	cancel context.CancelFunc
+}
+
+// groupMember is the shared health state of one member of a group.
+type groupMember struct {
+	// target is the backend probed on behalf of the subscribers.
+	target *Backend
+	// subscribers are the member's backends in each pool.
+	subscribers map[*Backend]*BaseServerPool
+	// cancel stops the probe loop; it is nil while no loop runs.
+	cancel context.CancelFunc
+	probed bool
+	err    error
+}
+
+func newBackendGroup(l *log.Logger, name, protocol string, config *BackendGroupConfig) (*backendGroup, error) {
+	if !listenerNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("invalid backend group name %q", name)
+	}
+	resolver := config.Resolver
+	switch {
+	case resolver == nil && len(config.Backends) == 0:
+		return nil, fmt.Errorf("backend group %q has no backends", name)
+	case resolver == nil:
+		resolver = &ResolverConfig{Type: "static", Backends: config.Backends}
+	case len(config.Backends) > 0:
+		return nil, fmt.Errorf("backend group %q: backends and resolver cannot both be set", name)
+	}
+	interval, err := time.ParseDuration(cmp.Or(config.HealthcheckInterval, defaultBackendGroupInterval.String()))
+	if err != nil {
+		return nil, fmt.Errorf("backend group %q: invalid healthcheck interval: %w", name, err)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("backend group %q: healthcheck interval must be positive", name)
+	}
+	g := &backendGroup{
+		name:     name,
+		protocol: protocol,
+		config:   config,
+		interval: interval,
+		log:      log.New(l.Writer(), fmt.Sprintf("%s[group %s] ", l.Prefix(), name), l.Flags()),
+		members:  make(map[string]*groupMember),
+		pools:    make(map[*BaseServerPool]bool),
+	}
+	if g.source, g.refresh, err = newResolver(resolver); err != nil {
+		return nil, fmt.Errorf("backend group %q: %w", name, err)
+	}
+	if g.check, err = newHealthCheck(g.log, protocol, config.HealthCheck); err != nil {
+		return nil, fmt.Errorf("backend group %q: %w", name, err)
+	}
+	if g.resolver, err = newDNSCache(nil); err != nil {
+		return nil, err
+	}
+
+	// Invalid static backends are configuration errors, whereas a dynamic
+	// group that cannot be resolved yet starts empty.
+	ctx, cancel := context.WithTimeout(context.Background(), cmp.Or(g.refresh, defaultResolverInterval))
+	specs, err := g.source.Resolve(ctx)
+	cancel()
+	if err != nil {
+		if g.refresh == 0 {
+			return nil, fmt.Errorf("backend group %q: %w", name, err)
+		}
+		warnf(g.log, "could not resolve backends: %v", err)
+	}
+	backends, err := g.parseSpecs(specs)
+	if err != nil {
+		if g.refresh == 0 {
+			return nil, fmt.Errorf("backend group %q: %w", name, err)
+		}
+		warnf(g.log, "ignoring invalid backends: %v", err)
+	}
+	g.update(backends)
+	return g, nil
+}
+
+// dynamic reports whether the group's members can change while it is in
+// use.
+func (g *backendGroup) dynamic() bool {
+	return g != nil && g.refresh > 0
+}
+
+// currentBackends returns the configs of the group's current members.
+func (g *backendGroup) currentBackends() []BackendConfig {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	return g.backends
+}
+
+// parseSpecs returns the configs of the resolved backends, skipping invalid
+// and duplicate ones.
+func (g *backendGroup) parseSpecs(specs []BackendSpec) ([]BackendConfig, error) {
+	configs := make([]BackendConfig, 0, len(specs))
+	for _, s := range specs {
+		configs = append(configs, BackendConfig{URL: s.URL, Labels: s.Labels})
+	}
+	configs, err := expandPortRanges(configs)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		backends []BackendConfig
+		errs     []error
+	)
+	seen := make(map[string]bool)
+	for _, bc := range configs {
+		u, err := parseBackendURL(bc.URL, g.protocol)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid backend: %w", err))
+			continue
+		}
+		id := backendID(u)
+		if seen[id] {
+			errs = append(errs, fmt.Errorf("duplicate backend %s", bc.URL))
+			continue
+		}
+		seen[id] = true
+		bc.sharedGroup = g.name
+		backends = append(backends, bc)
+	}
+	return backends, errors.Join(errs...)
+}
+
+// update makes the group's members those in backends, which must have been
+// returned by parseSpecs, and applies the change to every attached pool. It
+// returns the URLs of the members added and removed.
+func (g *backendGroup) update(backends []BackendConfig) (added, removed []string) {
+	desired := make(map[string]*url.URL, len(backends))
+	for _, bc := range backends {
+		u, _ := parseBackendURL(bc.URL, g.protocol)
+		desired[backendID(u)] = u
+	}
+
+	g.mux.Lock()
+	var removedIDs []string
+	for id, m := range g.members {
+		if desired[id] != nil {
+			continue
+		}
+		if m.cancel != nil {
+			m.cancel()
+		}
+		delete(g.members, id)
+		removedIDs = append(removedIDs, id)
+		removed = append(removed, m.target.URL.String())
+	}
+	var addedConfigs []BackendConfig
+	for _, bc := range backends {
+		u, _ := parseBackendURL(bc.URL, g.protocol)
+		id := backendID(u)
+		if g.members[id] != nil {
+			continue
+		}
+		g.members[id] = &groupMember{
+			target:      &Backend{ID: id, URL: u, resolver: g.resolver},
+			subscribers: make(map[*Backend]*BaseServerPool),
+		}
+		addedConfigs = append(addedConfigs, bc)
+		added = append(added, u.String())
+	}
+	g.backends = backends
+	pools := make([]*BaseServerPool, 0, len(g.pools))
+	for p := range g.pools {
+		pools = append(pools, p)
+	}
+	g.mux.Unlock()
+
+	for _, p := range pools {
+		for _, id := range removedIDs {
+			p.removeBackend(id)
+		}
+		for _, bc := range addedConfigs {
+			g.addTo(p, bc)
+		}
+	}
+	return added, removed
+}
+
+// addTo adds a member to p. A pool already holding a backend with the
+// member's address keeps it.
+func (g *backendGroup) addTo(p *BaseServerPool, bc BackendConfig) {
+	if _, err := p.addBackend(bc); err != nil && !errors.Is(err, errDuplicateBackend) {
+		warnf(g.log, "could not add backend %s: %v", bc.URL, err)
+	}
+}
+
+// attach applies membership changes to p from now on, bringing its group
+// backends up to date first, and starts re-resolving the group if it is
+// dynamic and no other pool uses it.
+func (g *backendGroup) attach(p *BaseServerPool) {
+	if g == nil {
+		return
+	}
+	g.mux.Lock()
+	g.pools[p] = true
+	backends := g.backends
+	members := make(map[string]bool, len(g.members))
+	for id := range g.members {
+		members[id] = true
+	}
+	if g.refresh > 0 && g.cancel == nil {
+		var ctx context.Context
+		ctx, g.cancel = context.WithCancel(context.Background())
+		go g.resolve(ctx)
+	}
+	g.mux.Unlock()
+
+	// The pool was created with the members of the time.
+	for _, b := range p.Backends() {
+		if b.sharedGroup == g.name && !members[b.ID] {
+			p.removeBackend(b.ID)
+		}
+	}
+	for _, bc := range backends {
+		g.addTo(p, bc)
+	}
+}
+
+// resolve re-resolves the group every refresh interval, and whenever a
+// source that is a Watcher signals a change, until ctx is cancelled. If
+// resolving fails the group keeps its members.
+func (g *backendGroup) resolve(ctx context.Context) {
+	var changes <-chan struct{}
+	// A watched source may have changed before it was watched.
+	wait := true
+	if w, ok := g.source.(Watcher); ok {
+		var err error
+		if changes, err = w.Watch(ctx); err != nil {
+			warnf(g.log, "%v, resolving backends every %s", err, g.refresh)
+		} else {
+			wait = false
+		}
+	}
+	for {
+		if wait {
+			select {
+			case <-time.After(g.refresh):
+			case <-changes:
+			case <-ctx.Done():
+				return
+			}
+		}
+		wait = true
+		resolveCtx, cancel := context.WithTimeout(ctx, g.refresh)
+		specs, err := g.source.Resolve(resolveCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			warnf(g.log, "could not resolve backends: %v", err)
+			continue
+		}
+		backends, err := g.parseSpecs(specs)
+		if err != nil {
+			warnf(g.log, "ignoring invalid backends: %v", err)
+		}
+		if added, removed := g.update(backends); len(added) > 0 || len(removed) > 0 {
+			infof(g.log, "backends changed: added %v, removed %v", added, removed)
+		}
+	}
+}
+
+// subscribe applies the health of the member to b, the member's backend in
+// p, from now on, starting to probe the member if no other pool does.
+func (g *backendGroup) subscribe(p *BaseServerPool, b *Backend) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	m := g.members[b.ID]
+	if m == nil {
+		return
+	}
+	m.subscribers[b] = p
+	if m.probed {
+		p.applyHealthCheck(b, m.err)
+	}
+	if m.cancel == nil {
+		var ctx context.Context
+		ctx, m.cancel = context.WithCancel(context.Background())
+		go g.run(ctx, m)
+	}
+}
+
+// unsubscribe stops applying health and membership changes to the backends
+// of p, stopping the probe loops no other pool is subscribed to and
+// re-resolving once no pool uses the group.
+func (g *backendGroup) unsubscribe(p *BaseServerPool) {
+	if g == nil {
+		return
+	}
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	delete(g.pools, p)
+	if len(g.pools) == 0 && g.cancel != nil {
+		g.cancel()
+		g.cancel = nil
+	}
+	for _, m := range g.members {
+		for b, sp := range m.subscribers {
+			if sp == p {
+				delete(m.subscribers, b)
+			}
+		}
+		if len(m.subscribers) == 0 && m.cancel != nil {
+			m.cancel()
+			m.cancel = nil
+		}
+	}
+}
+
+// run probes a member every interval until ctx is cancelled, applying each
+// result to its subscribers. Backends removed from their pool are
+// unsubscribed.
+func (g *backendGroup) run(ctx context.Context, m *groupMember) {
+	for {
+		probeCtx, cancel := context.WithTimeout(ctx, g.check.timeout)
+		start := time.Now()
+		err := g.check.prober.probe(probeCtx, m.target)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		sample := newProbeSample(start, err)
+		if err != nil {
+			warnf(g.log, "health check failed for backend %s: %v", m.target.URL.Host, err)
+		}
+
+		g.mux.Lock()
+		m.probed, m.err = true, err
+		for b, p := range m.subscribers {
+			select {
+			case <-b.removed:
+				delete(m.subscribers, b)
+			default:
+				b.probes.record(sample)
+				p.applyHealthCheck(b, err)
+			}
+		}
+		g.mux.Unlock()
+
+		select {
+		case <-time.After(g.interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// applyHealthCheck records the result of a probe of the backend, unless its
+// checks are paused or its health is forced.
+func (p *BaseServerPool) applyHealthCheck(b *Backend, err error) {
+	if _, paused := b.healthOverride(); paused {
+		return
+	}
+	b.setLastError(err)
+	if forced, _ := b.healthOverride(); forced == "" {
+		p.setProbedHealth(b, err == nil)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingProbe counts its probes and reports every backend healthy.
+type countingProbe struct {
+	probes *atomic.Int32
+}
+
+func (p countingProbe) probe(context.Context, *Backend) error {
+	p.probes.Add(1)
+	return nil
+}
+
+func Test_newBackendGroup(t *testing.T) {
+	l := log.New(io.Discard, "", 0)
+	g, err := newBackendGroup(l, "fleet", "tcp", &BackendGroupConfig{Backends: []BackendConfig{{URL: "10.0.0.1:8000-8001"}}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(g.backends) != 2 || g.backends[1].sharedGroup != "fleet" || g.interval != defaultBackendGroupInterval {
+		t.Errorf("expected two members with the default interval, got %+v and %s", g.backends, g.interval)
+	}
+	for name, config := range map[string]*BackendGroupConfig{
+		"fleet":  {},
+		"-fleet": {Backends: []BackendConfig{{URL: "10.0.0.1:8000"}}},
+		"dupes":  {Backends: []BackendConfig{{URL: "10.0.0.1:8000"}, {URL: "tcp://10.0.0.1:8000"}}},
+		"udp":    {Backends: []BackendConfig{{URL: "udp://10.0.0.1:53"}}},
+		"slow":   {Backends: []BackendConfig{{URL: "10.0.0.1:8000"}}, HealthcheckInterval: "-1s"},
+		"both":   {Backends: []BackendConfig{{URL: "10.0.0.1:8000"}}, Resolver: &ResolverConfig{Type: "file", Path: "backends.json"}},
+	} {
+		if _, err := newBackendGroup(l, name, "tcp", config); err == nil {
+			t.Errorf("expected error for group %q", name)
+		}
+	}
+
+	groups := newBackendGroups(l)
+	if _, err := groups.get(l, &Config{BackendGroup: "missing"}, "tcp"); err == nil {
+		t.Errorf("expected error for an undefined group")
+	}
+	config := &Config{BackendGroup: "fleet", BackendGroups: map[string]*BackendGroupConfig{"fleet": {Backends: []BackendConfig{{URL: "10.0.0.1:8000"}}}}}
+	first, _ := groups.get(l, config, "tcp")
+	if second, _ := groups.get(l, config, "tcp"); second != first {
+		t.Errorf("expected listeners of a protocol to share the group")
+	}
+	if udp, _ := groups.get(l, &Config{BackendGroup: "fleet", BackendGroups: map[string]*BackendGroupConfig{"fleet": {Backends: []BackendConfig{{URL: "10.0.0.1:8000"}}}}}, "udp"); udp == first {
+		t.Errorf("expected a separate group per protocol")
+	}
+	other := &Config{BackendGroup: "fleet", BackendGroups: map[string]*BackendGroupConfig{"fleet": {Backends: []BackendConfig{{URL: "10.0.0.2:8000"}}}}}
+	if _, err := groups.get(l, other, "tcp"); err == nil || !strings.Contains(err.Error(), "defined differently") {
+		t.Errorf("expected error for a conflicting definition, got %v", err)
+	}
+}
+
+func TestBackendGroup_sharedHealthChecks(t *testing.T) {
+	l := log.New(io.Discard, "", 0)
+	groups := newBackendGroups(l)
+	newPool := func(own string) *TCPServerPool {
+		t.Helper()
+		pool, err := NewTCPServerPool(l, &Config{
+			Addr:                "127.0.0.1:0",
+			HealthcheckInterval: "1h",
+			Backends:            []BackendConfig{{URL: own}},
+			BackendGroup:        "fleet",
+			BackendGroups: map[string]*BackendGroupConfig{
+				"fleet": {Backends: []BackendConfig{{URL: "tcp://127.0.0.1:1"}, {URL: "tcp://127.0.0.1:2"}}, HealthcheckInterval: "1h"},
+			},
+			groups: groups,
+		})
+		if err != nil {
+			t.Fatalf("failed to create server pool: %v", err)
+		}
+		t.Cleanup(func() { pool.Shutdown(context.Background()) })
+		return pool
+	}
+	web, api := newPool("debug://web"), newPool("debug://api")
+	group := groups.groups["tcp/fleet"]
+	var probes atomic.Int32
+	group.check = healthCheck{prober: countingProbe{&probes}, timeout: time.Second}
+
+	web.StartHealthChecks()
+	api.StartHealthChecks()
+	deadline := time.Now().Add(2 * time.Second)
+	for web.HealthyBackends() != 3 || api.HealthyBackends() != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected every backend to be healthy, got %d and %d", web.HealthyBackends(), api.HealthyBackends())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if probes.Load() != 2 {
+		t.Errorf("expected each member to be probed once for both pools, got %d probes", probes.Load())
+	}
+	if v := newBackendView(web.backends[1]); v.BackendGroup != "fleet" {
+		t.Errorf("expected the backend to report its group, got %+v", v)
+	}
+
+	web.stopHealthChecks(t.Context())
+	group.mux.Lock()
+	defer group.mux.Unlock()
+	for _, m := range group.members {
+		if m.cancel == nil || len(m.subscribers) != 1 {
+			t.Errorf("expected the probes to keep running for the other pool, got %d subscribers", len(m.subscribers))
+		}
+	}
+	group.mux.Unlock()
+	api.stopHealthChecks(t.Context())
+	group.mux.Lock()
+	for _, m := range group.members {
+		if m.cancel != nil {
+			t.Errorf("expected the probes to stop with the last pool")
+		}
+	}
+}
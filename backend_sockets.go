@@ -0,0 +1,46 @@
+package main
+
+import "sync/atomic"
+
+// socketStats records how the sockets a UDP pool opens to a backend are
+// reused, so that flows can be tuned from data. A datagram sent on a socket
+// already open to the backend is a hit, and a socket opened for a datagram
+// is a miss. TCP connections are never reused: each client connection has
+// its own connection to the backend.
+type socketStats struct {
+	hits   atomic.Uint64
+	misses atomic.Uint64
+	// open counts the flow sockets open to the backend, and pending those
+	// waiting for a reply.
+	open    atomic.Int64
+	pending atomic.Int64
+}
+
+// socketView reports a backend's socket reuse.
+type socketView struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+	// ReuseRatio is the share of datagrams sent on an open socket, and
+	// RequestsPerSocket the average number of datagrams sent on each
+	// socket opened.
+	ReuseRatio        float64 `json:"reuse_ratio"`
+	RequestsPerSocket float64 `json:"requests_per_socket"`
+	Open              int64   `json:"open"`
+	Idle              int64   `json:"idle"`
+}
+
+func (s *socketStats) view() socketView {
+	v := socketView{
+		Hits:   s.hits.Load(),
+		Misses: s.misses.Load(),
+		Open:   s.open.Load(),
+	}
+	v.Idle = max(v.Open-s.pending.Load(), 0)
+	if total := v.Hits + v.Misses; total > 0 {
+		v.ReuseRatio = float64(v.Hits) / float64(total)
+	}
+	if v.Misses > 0 {
+		v.RequestsPerSocket = float64(v.Hits+v.Misses) / float64(v.Misses)
+	}
+	return v
+}
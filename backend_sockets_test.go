@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSocketStats_view(t *testing.T) {
+	var s socketStats
+	if v := s.view(); v.ReuseRatio != 0 || v.RequestsPerSocket != 0 {
+		t.Errorf("expected no ratios without datagrams, got %+v", v)
+	}
+	s.misses.Add(2)
+	s.hits.Add(6)
+	s.open.Add(2)
+	s.pending.Add(1)
+	v := s.view()
+	if v.ReuseRatio != 0.75 || v.RequestsPerSocket != 4 || v.Open != 2 || v.Idle != 1 {
+		t.Errorf("unexpected view %+v", v)
+	}
+}
+
+func TestUDPServerPool_socketMetrics(t *testing.T) {
+	backend := startUDPResponder(t, func(b []byte) []byte { return b })
+	pool, err := NewUDPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:     "127.0.0.1:0",
+		Backends: []BackendConfig{{URL: backend.LocalAddr().String()}},
+	})
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	pool.backends[0].SetHealthy(true)
+	if err := pool.Start(); err != nil {
+		t.Fatalf("failed to start pool: %v", err)
+	}
+	defer pool.Shutdown(t.Context())
+
+	// Without flows every datagram opens a socket to the backend.
+	client := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+	for range 2 {
+		pool.handleConnection(t.Context(), pool.conn, client, []byte("ping"))
+	}
+
+	rec := httptest.NewRecorder()
+	pool.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	url := pool.backends[0].URL.String()
+	for _, want := range []string{
+		`nlb_backend_socket_requests_total{backend="` + url + `",result="hit"} 0`,
+		`nlb_backend_socket_requests_total{backend="` + url + `",result="miss"} 2`,
+		`nlb_backend_socket_reuse_ratio{backend="` + url + `"} 0`,
+		`nlb_backend_sockets{backend="` + url + `",state="idle"} 0`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("expected metrics to contain %q", want)
+		}
+	}
+	if v := newBackendView(pool.backends[0]); v.Sockets == nil || v.Sockets.Misses != 2 {
+		t.Errorf("expected the backend view to report socket reuse, got %+v", v.Sockets)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Health states of a backend. A degraded backend passes its health checks
+// but is impaired: it stays in rotation with a reduced share of
+// connections.
+const (
+	stateHealthy   = "healthy"
+	stateDegraded  = "degraded"
+	stateUnhealthy = "unhealthy"
+)
+
+// healthStates lists the health states in the order they are reported.
+var healthStates = []string{stateHealthy, stateDegraded, stateUnhealthy}
+
+const defaultDegradedWeight = 0.25
+
+// degradation is the state of the checks that can degrade a backend.
+type degradation struct {
+	// deepFailing is set while the backend fails its deep health check,
+	// with deepErr its last error.
+	deepFailing atomic.Bool
+	deepErr     atomic.Pointer[string]
+	// slow is set while the backend passes its health checks slower than
+	// the degraded_latency of its health check.
+	slow atomic.Bool
+	// chosen counts the times the backend was chosen while degraded.
+	chosen atomic.Uint64
+}
+
+// State returns the backend's health state. A backend forced degraded
+// through the admin API is degraded regardless of its checks, and one
+// forced healthy is never degraded.
+func (b *Backend) State() string {
+	if !b.Healthy() {
+		return stateUnhealthy
+	}
+	switch forced, _ := b.healthOverride(); forced {
+	case forceDegraded:
+		return stateDegraded
+	case forceHealthy:
+		return stateHealthy
+	}
+	if b.degradation.deepFailing.Load() || b.degradation.slow.Load() {
+		return stateDegraded
+	}
+	return stateHealthy
+}
+
+// Degraded reports whether the backend passes its health checks but is
+// impaired.
+func (b *Backend) Degraded() bool {
+	return b.State() == stateDegraded
+}
+
+// parseDegradedWeight returns how many times a degraded backend must be
+// chosen for one connection to be sent to it given the share of its usual
+// connections it receives, or 0 if it only gets connections when no other
+// backend is available.
+func parseDegradedWeight(weight *float64) (uint64, error) {
+	w := defaultDegradedWeight
+	if weight != nil {
+		w = *weight
+	}
+	if w < 0 || w > 1 {
+		return 0, fmt.Errorf("degraded_weight must be between 0 and 1")
+	}
+	if w == 0 {
+		return 0, nil
+	}
+	return uint64(math.Round(1 / w)), nil
+}
+
+// setSlow records whether a passing probe of the backend took longer than
+// its health check's degraded latency, logging changes.
+func (p *BaseServerPool) setSlow(b *Backend, elapsed, limit time.Duration) {
+	slow := limit > 0 && elapsed > limit
+	if b.degradation.slow.Swap(slow) == slow {
+		return
+	}
+	if slow {
+		infof(p.log, "health check of backend %s took %s, over %s, degrading it", b.URL.Host, elapsed.Round(time.Millisecond), limit)
+	} else {
+		infof(p.log, "health check of backend %s is fast again", b.URL.Host)
+	}
+}
+
+// throttled reports whether a connection should go to another backend than
+// b, which it was about to be sent to, because b is degraded and has had
+// its share. Sticky sessions are never moved.
+func (p *BaseServerPool) throttled(s *backendSelection, b *Backend) bool {
+	if s.stickySessions || !b.Degraded() {
+		return false
+	}
+	n := b.degradation.chosen.Add(1)
+	return p.degradedEvery == 0 || n%p.degradedEvery != 0
+}
+
+// undegraded returns the backends that are not degraded.
+func undegraded(backends []*Backend) []*Backend {
+	var result []*Backend
+	for _, b := range backends {
+		if !b.Degraded() {
+			result = append(result, b)
+		}
+	}
+	return result
+}
+
+// stateCounts returns the number of backends in each health state.
+func stateCounts(backends []*Backend) map[string]int {
+	counts := make(map[string]int, len(healthStates))
+	for _, b := range backends {
+		counts[b.State()]++
+	}
+	return counts
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_parseDegradedWeight(t *testing.T) {
+	if every, err := parseDegradedWeight(nil); err != nil || every != 4 {
+		t.Errorf("expected every 4th connection by default, got %d, %v", every, err)
+	}
+	for _, tt := range []struct {
+		weight float64
+		every  uint64
+	}{
+		{0.5, 2},
+		{1, 1},
+		{0, 0},
+	} {
+		every, err := parseDegradedWeight(&tt.weight)
+		if err != nil || every != tt.every {
+			t.Errorf("expected every %d, got %d, %v", tt.every, every, err)
+		}
+	}
+	for _, weight := range []float64{-0.5, 2} {
+		if _, err := parseDegradedWeight(&weight); err == nil {
+			t.Errorf("expected an error for weight %v", weight)
+		}
+	}
+}
+
+func TestBackend_State(t *testing.T) {
+	pool := newConsoleTestPool("web", true)
+	b := pool.backends[0]
+	if got := b.State(); got != stateHealthy {
+		t.Errorf("expected %s, got %s", stateHealthy, got)
+	}
+	b.degradation.slow.Store(true)
+	if got := b.State(); got != stateDegraded {
+		t.Errorf("expected a slow backend to be %s, got %s", stateDegraded, got)
+	}
+	pool.setHealthy(b, false)
+	if got := b.State(); got != stateUnhealthy {
+		t.Errorf("expected %s, got %s", stateUnhealthy, got)
+	}
+
+	forced := forceHealthy
+	if err := pool.overrideHealth(b, &forced, nil); err != nil {
+		t.Fatalf("failed to override health: %v", err)
+	}
+	if got := b.State(); got != stateHealthy {
+		t.Errorf("expected a backend forced healthy to be %s, got %s", stateHealthy, got)
+	}
+	b.degradation.slow.Store(false)
+	forced = forceDegraded
+	if err := pool.overrideHealth(b, &forced, nil); err != nil {
+		t.Fatalf("failed to override health: %v", err)
+	}
+	if !b.Healthy() || b.State() != stateDegraded {
+		t.Errorf("expected a backend forced degraded to be healthy and degraded, got %s", b.State())
+	}
+	if v := newBackendView(b); v.State != stateDegraded || !v.Degraded {
+		t.Errorf("expected backend view to report degraded, got %+v", v)
+	}
+
+	rec := httptest.NewRecorder()
+	pool.dashboardHandler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if !strings.Contains(rec.Body.String(), `class="status degraded"`) {
+		t.Errorf("expected the dashboard to highlight the degraded backend")
+	}
+	rec = httptest.NewRecorder()
+	pool.metricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{`nlb_backends{state="healthy"} 0`, `nlb_backends{state="degraded"} 1`, `nlb_backends{state="unhealthy"} 0`} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("expected metrics to contain %q", want)
+		}
+	}
+}
+
+// slowProbe passes after sleeping for its delay.
+type slowProbe time.Duration
+
+func (p slowProbe) probe(ctx context.Context, b *Backend) error {
+	time.Sleep(time.Duration(p))
+	return nil
+}
+
+func TestBaseServerPool_degradedLatency(t *testing.T) {
+	l := log.New(io.Discard, "", 0)
+	for _, latency := range []string{"slow", "0s"} {
+		if _, err := newHealthCheck(l, "tcp", &HealthCheckConfig{DegradedLatency: latency}); err == nil {
+			t.Errorf("expected an error for degraded_latency %q", latency)
+		}
+	}
+
+	var logs syncBuffer
+	pool := &BaseServerPool{
+		log:         log.New(&logs, "", 0),
+		healthCheck: healthCheck{prober: slowProbe(20 * time.Millisecond), timeout: time.Second, degradedLatency: 5 * time.Millisecond},
+	}
+	pool.AddBackend("tcp://a:80")
+	b := pool.backends[0]
+	b.SetHealthy(true)
+	if err := pool.runProbe(t.Context(), b); err != nil {
+		t.Fatalf("expected the probe to pass, got %v", err)
+	}
+	if !b.Degraded() || !strings.Contains(logs.String(), "degrading it") {
+		t.Errorf("expected a slow backend to be degraded, got %s: %q", b.State(), logs.String())
+	}
+
+	pool.healthCheck.degradedLatency = time.Second
+	pool.runProbe(t.Context(), b)
+	if b.Degraded() {
+		t.Errorf("expected the backend to recover once its probes are fast")
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+	"slices"
+	"testing"
+)
 
 func TestIsHealthy(t *testing.T) {
 	b := &Backend{}
@@ -25,3 +28,107 @@ func TestSetHealthy(t *testing.T) {
 		t.Errorf("Expected backend to be dead")
 	}
 }
+
+func TestActiveConnections(t *testing.T) {
+	b := &Backend{}
+	release := b.acquire()
+	b.acquire()
+	if b.ActiveConnections() != 2 {
+		t.Errorf("expected 2 active connections, got %d", b.ActiveConnections())
+	}
+	release()
+	if b.ActiveConnections() != 1 {
+		t.Errorf("expected 1 active connection, got %d", b.ActiveConnections())
+	}
+}
+
+func Test_parseBackendURL(t *testing.T) {
+	for _, valid := range []string{"tcp://10.0.0.1:8000", "udp://[::1]:53", "http://localhost:8080", "debug://blue"} {
+		if _, err := parseBackendURL(valid, ""); err != nil {
+			t.Errorf("expected %s to be valid, got %v", valid, err)
+		}
+	}
+	for _, invalid := range []string{"ftp://10.0.0.1:21", "tcp://10.0.0.1", "http://%zz", "debug://", "tcp://10.0.0.1:0",
+		"localhost", ":8080", "localhost:0", "localhost:http", "localhost:65536", "::1:53"} {
+		if _, err := parseBackendURL(invalid, ""); err == nil {
+			t.Errorf("expected %s to be invalid", invalid)
+		}
+	}
+}
+
+func Test_parseBackendURL_hostPort(t *testing.T) {
+	for _, tt := range []struct {
+		raw, protocol, want string
+	}{
+		{"localhost:8080", "tcp", "tcp://localhost:8080"},
+		{"10.0.0.1:53", "udp", "udp://10.0.0.1:53"},
+		{"[2001:db8::1]:53", "udp", "udp://[2001:db8::1]:53"},
+		{"localhost:8080", "", "tcp://localhost:8080"},
+	} {
+		u, err := parseBackendURL(tt.raw, tt.protocol)
+		if err != nil {
+			t.Errorf("expected %s to be valid, got %v", tt.raw, err)
+			continue
+		}
+		if u.String() != tt.want {
+			t.Errorf("expected %s to be normalized to %s, got %s", tt.raw, tt.want, u)
+		}
+	}
+
+	if _, err := parseBackendURL("udp://10.0.0.1:53", "tcp"); err == nil {
+		t.Errorf("expected udp backend to be invalid for a tcp listener")
+	}
+	if _, err := parseBackendURL("tcp://10.0.0.1:80", "udp"); err == nil {
+		t.Errorf("expected tcp backend to be invalid for a udp listener")
+	}
+	if _, err := parseBackendURL("http://10.0.0.1:80", "udp"); err != nil {
+		t.Errorf("expected http backend to remain valid for a udp listener, got %v", err)
+	}
+}
+
+func Test_backendID(t *testing.T) {
+	a, _ := parseBackendURL("tcp://LocalHost:8080", "")
+	b, _ := parseBackendURL("http://localhost:8080", "")
+	c, _ := parseBackendURL("http://localhost:8081", "")
+
+	if backendID(a) != backendID(b) {
+		t.Errorf("expected backends with the same address to share an id")
+	}
+	if backendID(a) == backendID(c) {
+		t.Errorf("expected backends with different ports to have different ids")
+	}
+	if len(backendID(a)) != 16 {
+		t.Errorf("expected 16 character id, got %q", backendID(a))
+	}
+}
+
+func Test_expandPortRanges(t *testing.T) {
+	expanded, err := expandPortRanges([]BackendConfig{
+		{URL: "10.0.0.1:8000-8002", Labels: map[string]string{"tier": "worker"}},
+		{URL: "udp://[::1]:53"},
+		{URL: "tcp://10.0.0.2:9000-9000", DialTimeout: "1s"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var urls []string
+	for _, bc := range expanded {
+		urls = append(urls, bc.URL)
+	}
+	want := []string{"10.0.0.1:8000", "10.0.0.1:8001", "10.0.0.1:8002", "udp://[::1]:53", "tcp://10.0.0.2:9000"}
+	if !slices.Equal(urls, want) {
+		t.Errorf("expected %v, got %v", want, urls)
+	}
+	if expanded[1].Labels["tier"] != "worker" || expanded[4].DialTimeout != "1s" {
+		t.Errorf("expected expanded backends to keep their settings, got %+v", expanded)
+	}
+
+	for _, invalid := range []string{"10.0.0.1:8010-8000", "10.0.0.1:0-10", "10.0.0.1:65000-70000", "10.0.0.1:1-2000"} {
+		if _, err := expandPortRanges([]BackendConfig{{URL: invalid}}); err == nil {
+			t.Errorf("expected error for %s", invalid)
+		}
+	}
+	if _, err := parseBackendURL("10.0.0.1:8000-8002", "tcp"); err == nil {
+		t.Errorf("expected unexpanded port range to be invalid")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// newBackendTLSConfig builds the client TLS config used to re-encrypt
+// connections to a backend at host. Settings of the backend override those
+// of the pool. It returns nil if neither enables TLS.
+func newBackendTLSConfig(pool, backend *BackendTLSConfig, host string) (*tls.Config, error) {
+	var poolSettings, backendSettings BackendTLSConfig
+	if pool != nil {
+		poolSettings = *pool
+	}
+	if backend != nil {
+		backendSettings = *backend
+	}
+	if !poolSettings.Enabled && !backendSettings.Enabled {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		// Without a server name, the certificate is verified against the
+		// backend's host name or IP address.
+		ServerName:         cmp.Or(backendSettings.ServerName, poolSettings.ServerName, host),
+		NextProtos:         backendSettings.ALPN,
+		InsecureSkipVerify: backendSettings.InsecureSkipVerify || poolSettings.InsecureSkipVerify,
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = poolSettings.ALPN
+	}
+	if caFile := cmp.Or(backendSettings.CAFile, poolSettings.CAFile); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read backend TLS CA file: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("backend TLS CA file %s contains no certificates", caFile)
+		}
+	}
+	return config, nil
+}
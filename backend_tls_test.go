@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func Test_newBackendTLSConfig(t *testing.T) {
+	if c, err := newBackendTLSConfig(nil, &BackendTLSConfig{ServerName: "api.internal"}, "10.0.0.1"); c != nil || err != nil {
+		t.Errorf("expected no TLS unless enabled, got %v, %v", c, err)
+	}
+
+	pool := &BackendTLSConfig{Enabled: true, ALPN: []string{"http/1.1"}, InsecureSkipVerify: true}
+	c, err := newBackendTLSConfig(pool, nil, "backend.example")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if c.ServerName != "backend.example" || !slices.Equal(c.NextProtos, []string{"http/1.1"}) || !c.InsecureSkipVerify {
+		t.Errorf("expected pool settings with the backend host as server name, got %+v", c)
+	}
+
+	c, err = newBackendTLSConfig(pool, &BackendTLSConfig{ServerName: "api.internal", ALPN: []string{"h2"}}, "10.0.0.1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if c.ServerName != "api.internal" || !slices.Equal(c.NextProtos, []string{"h2"}) {
+		t.Errorf("expected backend settings to override the pool, got %+v", c)
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(empty, nil, 0o600)
+	for _, caFile := range []string{filepath.Join(t.TempDir(), "missing.pem"), empty} {
+		if _, err := newBackendTLSConfig(&BackendTLSConfig{Enabled: true, CAFile: caFile}, nil, "10.0.0.1"); err == nil {
+			t.Errorf("expected error for CA file %s", caFile)
+		}
+	}
+}
+
+func TestTCPServerPool_backendTLS(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("testdata/test_cert.pem", "testdata/test_key.pem")
+	if err != nil {
+		t.Fatalf("failed to load key pair: %v", err)
+	}
+	hellos := make(chan *tls.ClientHelloInfo, 1)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			hellos <- hello
+			return nil, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// Health probes connect without a handshake.
+			go func() {
+				defer conn.Close()
+				tlsConn := conn.(*tls.Conn)
+				if err := tlsConn.Handshake(); err != nil {
+					return
+				}
+				io.WriteString(conn, tlsConn.ConnectionState().NegotiatedProtocol)
+			}()
+		}
+	}()
+
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:       "127.0.0.1:0",
+		BackendTLS: &BackendTLSConfig{Enabled: true, CAFile: "testdata/test_cert.pem"},
+		Backends: []BackendConfig{{
+			URL: ln.Addr().String(),
+			TLS: &BackendTLSConfig{ServerName: "localhost", ALPN: []string{"h2"}},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	// The test certificate may have expired, so verify it as of its issue date.
+	pool.backends[0].tlsConfig.Time = func() time.Time { return cert.Leaf.NotBefore }
+	pool.backends[0].SetHealthy(true)
+	pool.Start()
+	defer pool.Shutdown(t.Context())
+
+	conn, err := net.Dial("tcp", pool.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect to load balancer: %v", err)
+	}
+	defer conn.Close()
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if string(got) != "h2" {
+		t.Errorf("expected h2 to be negotiated with the backend, got %q", got)
+	}
+	if hello := <-hellos; hello.ServerName != "localhost" {
+		t.Errorf("expected SNI localhost, got %q", hello.ServerName)
+	}
+}
+
+func TestNewUDPServerPool_backendTLS(t *testing.T) {
+	_, err := NewUDPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:       "127.0.0.1:0",
+		BackendTLS: &BackendTLSConfig{Enabled: true},
+	})
+	if err == nil {
+		t.Errorf("expected error for backend_tls on a udp listener")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const benchUsage = `usage: nlb bench [flags] <address>
+
+Opens connections to address at a steady rate for a duration, sending a
+payload on each and waiting for the first byte of the reply, and reports
+the latency percentiles and errors. With -protocol udp each request is a
+datagram sent from its own socket.
+
+flags:
+`
+
+// benchConfig is the load generated by nlb bench.
+type benchConfig struct {
+	protocol    string
+	addr        string
+	rate        int
+	concurrency int
+	size        int
+	duration    time.Duration
+	timeout     time.Duration
+	// reply waits for the first byte of a reply; otherwise a request ends
+	// once the payload is sent.
+	reply bool
+}
+
+// benchResult is the outcome of a bench run.
+type benchResult struct {
+	mux       sync.Mutex
+	latencies []time.Duration
+	// errors counts the failed requests by the step that failed: dial,
+	// write, read or timeout.
+	errors map[string]int
+	// skipped counts the requests not started because concurrency requests
+	// were already in flight.
+	skipped int
+	elapsed time.Duration
+}
+
+func (r *benchResult) observe(d time.Duration, step string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if step != "" {
+		r.errors[step]++
+		return
+	}
+	r.latencies = append(r.latencies, d)
+}
+
+// runBench runs nlb bench, writing its report to out.
+func runBench(ctx context.Context, out io.Writer, args []string) error {
+	flags := flag.NewFlagSet("nlb bench", flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.Usage = func() {
+		fmt.Fprint(out, benchUsage)
+		flags.PrintDefaults()
+	}
+	var config benchConfig
+	flags.StringVar(&config.protocol, "protocol", "tcp", "protocol to send with: tcp or udp")
+	flags.IntVar(&config.rate, "rate", 100, "connections (or datagrams) opened per second")
+	flags.IntVar(&config.concurrency, "concurrency", 100, "maximum requests in flight; requests over it are skipped")
+	flags.IntVar(&config.size, "size", 64, "payload size in bytes")
+	flags.DurationVar(&config.duration, "duration", 10*time.Second, "how long to generate load")
+	flags.DurationVar(&config.timeout, "timeout", 2*time.Second, "timeout of each request")
+	flags.BoolVar(&config.reply, "reply", true, "wait for the first byte of a reply to each request")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("please provide an address")
+	}
+	config.addr = flags.Arg(0)
+	if err := config.validate(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "sending %d %s requests/s of %d bytes to %s for %s\n", config.rate, config.protocol, config.size, config.addr, config.duration)
+	result := runBenchLoad(ctx, &config)
+	result.report(out)
+	return nil
+}
+
+func (c *benchConfig) validate() error {
+	switch {
+	case c.protocol != "tcp" && c.protocol != "udp":
+		return fmt.Errorf("unsupported protocol %q", c.protocol)
+	case c.rate <= 0:
+		return errors.New("rate must be positive")
+	case c.concurrency <= 0:
+		return errors.New("concurrency must be positive")
+	case c.size < 0 || c.protocol == "udp" && c.size > 65507:
+		return fmt.Errorf("invalid payload size %d", c.size)
+	case c.duration <= 0:
+		return errors.New("duration must be positive")
+	case c.timeout <= 0:
+		return errors.New("timeout must be positive")
+	}
+	return nil
+}
+
+// runBenchLoad starts a request every 1/rate until the duration elapses or
+// ctx is cancelled, and waits for the requests in flight.
+func runBenchLoad(ctx context.Context, config *benchConfig) *benchResult {
+	result := &benchResult{errors: make(map[string]int)}
+	payload := make([]byte, config.size)
+	for i := range payload {
+		payload[i] = byte('a' + i%26)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.duration)
+	defer cancel()
+	ticker := time.NewTicker(time.Second / time.Duration(config.rate))
+	defer ticker.Stop()
+	sem := make(chan struct{}, config.concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-ticker.C:
+		}
+		select {
+		case sem <- struct{}{}:
+		default:
+			result.mux.Lock()
+			result.skipped++
+			result.mux.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			result.observe(benchRequest(config, payload))
+		}()
+	}
+	wg.Wait()
+	result.elapsed = time.Since(start)
+	return result
+}
+
+// benchRequest sends one request and returns its latency, or the step that
+// failed.
+func benchRequest(config *benchConfig, payload []byte) (time.Duration, string) {
+	start := time.Now()
+	conn, err := net.DialTimeout(config.protocol, config.addr, config.timeout)
+	if err != nil {
+		return 0, benchErrorStep("dial", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(start.Add(config.timeout))
+	if _, err := conn.Write(payload); err != nil {
+		return 0, benchErrorStep("write", err)
+	}
+	if config.reply {
+		// A datagram is read whole, whereas the first byte of a stream
+		// will do.
+		buf := make([]byte, 1)
+		if config.protocol == "udp" {
+			buf = make([]byte, 65507)
+		}
+		if _, err := conn.Read(buf); err != nil {
+			return 0, benchErrorStep("read", err)
+		}
+	}
+	return time.Since(start), ""
+}
+
+// benchErrorStep returns the step to count a request failing at step with
+// err under: timeouts are counted apart whatever the step.
+func benchErrorStep(step string, err error) string {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return "timeout"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	return step
+}
+
+// report writes the request count and rate, the latency percentiles of the
+// requests that succeeded and the errors by step.
+func (r *benchResult) report(out io.Writer) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	failed := 0
+	for _, n := range r.errors {
+		failed += n
+	}
+	total := len(r.latencies) + failed
+	rate := 0.0
+	if r.elapsed > 0 {
+		rate = float64(total) / r.elapsed.Seconds()
+	}
+	fmt.Fprintf(out, "requests: %d in %s (%.1f/s), %d succeeded, %d failed, %d skipped\n",
+		total, r.elapsed.Round(time.Millisecond), rate, len(r.latencies), failed, r.skipped)
+
+	latencies := slices.Clone(r.latencies)
+	slices.Sort(latencies)
+	if len(latencies) > 0 {
+		fmt.Fprintf(out, "latency: min %s, p50 %s, p90 %s, p99 %s, max %s\n",
+			formatLatency(latencies[0]), formatLatency(percentile(latencies, 50)), formatLatency(percentile(latencies, 90)),
+			formatLatency(percentile(latencies, 99)), formatLatency(latencies[len(latencies)-1]))
+	}
+	steps := make([]string, 0, len(r.errors))
+	for step := range r.errors {
+		steps = append(steps, step)
+	}
+	slices.Sort(steps)
+	for _, step := range steps {
+		fmt.Fprintf(out, "errors: %s: %d\n", step, r.errors[step])
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunBench(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 64)
+				n, _ := conn.Read(buf)
+				conn.Write(buf[:n])
+			}()
+		}
+	}()
+	udp := startUDPResponder(t, func(b []byte) []byte { return b })
+
+	for _, target := range []struct{ protocol, addr string }{
+		{"tcp", ln.Addr().String()},
+		{"udp", udp.LocalAddr().String()},
+	} {
+		var out syncBuffer
+		err := runBench(t.Context(), &out, []string{"-protocol", target.protocol, "-rate", "200", "-duration", "100ms", target.addr})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !strings.Contains(out.String(), " 0 failed") || !strings.Contains(out.String(), "latency: min ") {
+			t.Errorf("expected %s requests to succeed, got %q", target.protocol, out.String())
+		}
+	}
+}
+
+func TestRunBench_errors(t *testing.T) {
+	// Nothing listens on the port once the listener is closed.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	var out syncBuffer
+	if err := runBench(t.Context(), &out, []string{"-rate", "100", "-duration", "50ms", addr}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !strings.Contains(out.String(), "errors: dial: ") || strings.Contains(out.String(), "latency:") {
+		t.Errorf("expected dial errors only, got %q", out.String())
+	}
+
+	for _, args := range [][]string{
+		{},
+		{"-protocol", "sctp", addr},
+		{"-rate", "0", addr},
+		{"-protocol", "udp", "-size", "70000", addr},
+		{"-duration", "-1s", addr},
+	} {
+		if err := runBench(t.Context(), &out, args); err == nil {
+			t.Errorf("expected an error for %v", args)
+		}
+	}
+}
+
+func Test_benchErrorStep(t *testing.T) {
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now())
+	_, err := conn.Read(make([]byte, 1))
+	if step := benchErrorStep("read", err); step != "timeout" {
+		t.Errorf("expected timeout, got %s", step)
+	}
+	if step := benchErrorStep("dial", net.ErrClosed); step != "dial" {
+		t.Errorf("expected dial, got %s", step)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"syscall"
+)
+
+// socketControl is a function run on a socket before it is bound or
+// connected, as set by net.ListenConfig and net.Dialer.
+type socketControl = func(network, address string, c syscall.RawConn) error
+
+// chainControl returns a socketControl running each of controls that is not
+// nil in turn, or nil if all are.
+func chainControl(controls ...socketControl) socketControl {
+	controls = slices.DeleteFunc(controls, func(f socketControl) bool { return f == nil })
+	if len(controls) == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		for _, f := range controls {
+			if err := f(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// bindDevice returns a socketControl binding sockets to the device, or nil
+// if device is empty. On a host with VRFs, binding to a VRF device keeps
+// the socket's traffic in that VRF's routing table.
+func bindDevice(device string) socketControl {
+	if device == "" {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if err := setBindToDevice(c, device); err != nil {
+			return fmt.Errorf("error binding to device %s: %w", device, err)
+		}
+		return nil
+	}
+}
+
+// checkDevices validates the devices a listener and its backend connections
+// are bound to.
+func checkDevices(config *Config) error {
+	for _, d := range []struct{ key, device string }{{"device", config.Device}, {"backend_device", config.BackendDevice}} {
+		if d.device == "" {
+			continue
+		}
+		if !bindDeviceSupported {
+			return fmt.Errorf("%s: binding to a device is not supported on this platform", d.key)
+		}
+		if _, err := net.InterfaceByName(d.device); err != nil {
+			return fmt.Errorf("invalid %s %q: %w", d.key, d.device, err)
+		}
+	}
+	return nil
+}
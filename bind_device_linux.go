@@ -0,0 +1,18 @@
+package main
+
+import "syscall"
+
+const bindDeviceSupported = true
+
+// setBindToDevice restricts a socket to the network device, or VRF, with
+// the given name.
+func setBindToDevice(c syscall.RawConn, device string) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.BindToDevice(int(fd), device)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+const bindDeviceSupported = false
+
+// setBindToDevice is not supported on this platform.
+func setBindToDevice(c syscall.RawConn, device string) error {
+	return errors.New("binding to a device is not supported on this platform")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_chainControl(t *testing.T) {
+	if chainControl(nil, nil) != nil {
+		t.Errorf("expected no control when all are nil")
+	}
+	var calls []string
+	control := func(name string, err error) socketControl {
+		return func(string, string, syscall.RawConn) error {
+			calls = append(calls, name)
+			return err
+		}
+	}
+	errFailed := errors.New("failed")
+	err := chainControl(control("a", nil), nil, control("b", errFailed), control("c", nil))("tcp", "", nil)
+	if !errors.Is(err, errFailed) || len(calls) != 2 || calls[0] != "a" || calls[1] != "b" {
+		t.Errorf("expected controls to run in turn until one fails, got %v, %v", calls, err)
+	}
+	if bindDevice("") != nil {
+		t.Errorf("expected no control without a device")
+	}
+}
+
+func Test_checkDevices(t *testing.T) {
+	if err := checkDevices(&Config{Device: "nlb-missing0"}); err == nil {
+		t.Errorf("expected an error for a missing device")
+	}
+	if err := checkDevices(&Config{BackendDevice: "nlb-missing0"}); err == nil {
+		t.Errorf("expected an error for a missing backend device")
+	}
+	if err := checkDevices(&Config{}); err != nil {
+		t.Errorf("expected no error without devices, got %v", err)
+	}
+}
+
+func TestTCPServerPool_bindDevice(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("binding to a device is only supported on linux")
+	}
+	lo, err := loopbackInterface()
+	if err != nil {
+		t.Skipf("no loopback interface: %v", err)
+	}
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:          "127.0.0.1:0",
+		Backends:      []BackendConfig{{URL: "tcp://" + startNamedBackend(t, "a")}},
+		Device:        lo,
+		BackendDevice: lo,
+	})
+	if err != nil {
+		if errors.Is(err, syscall.EPERM) {
+			t.Skipf("not permitted to bind to a device: %v", err)
+		}
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	shutdownOnCleanup(t, pool)
+	if err := pool.healthCheck.prober.probe(t.Context(), pool.backends[0]); err != nil {
+		t.Fatalf("expected a probe over the backend device to pass, got %v", err)
+	}
+	pool.backends[0].SetHealthy(true)
+	if err := pool.Start(); err != nil {
+		t.Fatalf("failed to start server pool: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", pool.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "a\n" {
+		t.Errorf("expected the backend's greeting, got %q, %v", buf, err)
+	}
+}
+
+// loopbackInterface returns the name of the loopback interface.
+func loopbackInterface() (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			return iface.Name, nil
+		}
+	}
+	return "", errors.New("not found")
+}
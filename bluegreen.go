@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errBlueGreenDisabled = errors.New("blue_green is not configured for this listener")
+	errUnknownGroup      = errors.New("unknown backend group")
+	errGroupUnhealthy    = errors.New("backend group has no healthy backends")
+	errGroupDrained      = errors.New("backend group switched away from and drained")
+)
+
+// blueGreen routes new traffic to the active one of two named backend
+// groups. Switching groups is atomic: every connection routed after the
+// switch goes to the new group, while connections already open are left to
+// finish or drained.
+type blueGreen struct {
+	groups []string
+	active atomic.Pointer[string]
+
+	mux      sync.Mutex
+	switched time.Time
+	// draining is the group whose connections are being drained, if any.
+	draining string
+}
+
+// newBlueGreen validates config and returns the backends of its groups,
+// tagged with their group. It returns nil if blue/green is not configured.
+func newBlueGreen(config *BlueGreenConfig) (*blueGreen, []BackendConfig, error) {
+	if config == nil {
+		return nil, nil, nil
+	}
+	if len(config.Groups) != 2 {
+		return nil, nil, fmt.Errorf("blue_green must define exactly two groups, got %d", len(config.Groups))
+	}
+	bg := &blueGreen{}
+	var backends []BackendConfig
+	for name, group := range config.Groups {
+		if !listenerNameRegexp.MatchString(name) {
+			return nil, nil, fmt.Errorf("blue_green: invalid group name %q", name)
+		}
+		if len(group) == 0 {
+			return nil, nil, fmt.Errorf("blue_green: group %q has no backends", name)
+		}
+		expanded, err := expandPortRanges(group)
+		if err != nil {
+			return nil, nil, fmt.Errorf("blue_green: group %q: %w", name, err)
+		}
+		for _, bc := range expanded {
+			bc.group = name
+			backends = append(backends, bc)
+		}
+		bg.groups = append(bg.groups, name)
+	}
+	slices.Sort(bg.groups)
+	if !slices.Contains(bg.groups, config.Active) {
+		return nil, nil, fmt.Errorf("blue_green: active group %q is not defined", config.Active)
+	}
+	active := config.Active
+	bg.active.Store(&active)
+	// Keep the order of the backends stable across restarts.
+	slices.SortStableFunc(backends, func(a, b BackendConfig) int {
+		return slices.Index(bg.groups, a.group) - slices.Index(bg.groups, b.group)
+	})
+	return bg, backends, nil
+}
+
+// Active returns the group receiving new traffic.
+func (bg *blueGreen) Active() string {
+	return *bg.active.Load()
+}
+
+// routes reports whether new traffic may be routed to b. Backends outside
+// the groups are always eligible.
+func (bg *blueGreen) routes(b *Backend) bool {
+	return bg == nil || b.group == "" || b.group == bg.Active()
+}
+
+// blueGreenView is the blue/green state in the admin API.
+type blueGreenView struct {
+	Active   string              `json:"active"`
+	Switched *time.Time          `json:"switched,omitempty"`
+	Draining string              `json:"draining,omitempty"`
+	Groups   map[string][]string `json:"groups"`
+}
+
+func (p *BaseServerPool) blueGreenView() blueGreenView {
+	bg := p.blueGreen
+	v := blueGreenView{Active: bg.Active(), Groups: make(map[string][]string)}
+	bg.mux.Lock()
+	if !bg.switched.IsZero() {
+		switched := bg.switched
+		v.Switched = &switched
+	}
+	v.Draining = bg.draining
+	bg.mux.Unlock()
+	for _, name := range bg.groups {
+		v.Groups[name] = []string{}
+	}
+	for _, b := range p.Backends() {
+		if b.group != "" {
+			v.Groups[b.group] = append(v.Groups[b.group], b.URL.String())
+		}
+	}
+	return v
+}
+
+// switchGroup makes group the active group and returns the previously
+// active one. Unless force is set, the group must have a healthy backend.
+// If drain is positive, connections to the previous group are given that
+// long to finish and are then closed.
+func (p *BaseServerPool) switchGroup(group string, force bool, drain time.Duration) (string, error) {
+	bg := p.blueGreen
+	if bg == nil {
+		return "", errBlueGreenDisabled
+	}
+	if !slices.Contains(bg.groups, group) {
+		return "", fmt.Errorf("%w %q", errUnknownGroup, group)
+	}
+	if !force && !slices.ContainsFunc(p.Backends(), func(b *Backend) bool { return b.group == group && b.Healthy() }) {
+		return "", fmt.Errorf("%w: %s", errGroupUnhealthy, group)
+	}
+
+	bg.mux.Lock()
+	defer bg.mux.Unlock()
+	from := bg.Active()
+	if from == group {
+		return from, nil
+	}
+	bg.active.Store(&group)
+	bg.switched = time.Now()
+	infof(p.log, "blue/green: switched new traffic from group %s to group %s", from, group)
+	if drain > 0 {
+		bg.draining = from
+		go p.drainGroup(from, drain)
+	}
+	return from, nil
+}
+
+// drainGroup waits up to timeout for the connections to a group that is no
+// longer active to finish, then closes the remaining ones. It gives up if
+// the group becomes active again or the pool shuts down.
+func (p *BaseServerPool) drainGroup(group string, timeout time.Duration) {
+	bg := p.blueGreen
+	defer func() {
+		bg.mux.Lock()
+		defer bg.mux.Unlock()
+		if bg.draining == group {
+			bg.draining = ""
+		}
+	}()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-p.shutdown:
+			return
+		case <-deadline.C:
+			waiting = false
+		case <-ticker.C:
+			if bg.Active() == group {
+				return
+			}
+			if p.groupConnections(group) == 0 {
+				infof(p.log, "blue/green: group %s drained", group)
+				return
+			}
+		}
+	}
+	if bg.Active() == group {
+		return
+	}
+	n := p.conns.closeWhere(func(c *trackedConn) bool {
+		b := c.backend.Load()
+		return b != nil && b.group == group
+	}, errGroupDrained)
+	infof(p.log, "blue/green: closed %d connections to group %s after %s", n, group, timeout)
+}
+
+// groupConnections returns the number of open connections to a group.
+func (p *BaseServerPool) groupConnections(group string) int64 {
+	var n int64
+	for _, b := range p.Backends() {
+		if b.group == group {
+			n += b.ActiveConnections()
+		}
+	}
+	return n
+}
+
+// blueGreenAPIHandler returns the active group and the backends of each
+// group.
+func (p *BaseServerPool) blueGreenAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	if p.blueGreen == nil {
+		writeError(w, http.StatusNotFound, errBlueGreenDisabled)
+		return
+	}
+	writeJSON(w, http.StatusOK, p.blueGreenView())
+}
+
+// switchGroupAPIHandler switches new traffic to the group in the request
+// body, optionally draining the previous group.
+func (p *BaseServerPool) switchGroupAPIHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Group string `json:"group"`
+		Force bool   `json:"force"`
+		Drain string `json:"drain"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	var drain time.Duration
+	if req.Drain != "" {
+		var err error
+		if drain, err = time.ParseDuration(req.Drain); err != nil || drain <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid drain %q: must be a positive duration", req.Drain))
+			return
+		}
+	}
+
+	_, err := p.switchGroup(req.Group, req.Force, drain)
+	switch {
+	case errors.Is(err, errBlueGreenDisabled), errors.Is(err, errUnknownGroup):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, errGroupUnhealthy):
+		writeError(w, http.StatusConflict, err)
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		writeJSON(w, http.StatusOK, p.blueGreenView())
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_newBlueGreen(t *testing.T) {
+	if bg, backends, err := newBlueGreen(nil); bg != nil || backends != nil || err != nil {
+		t.Errorf("expected nil when disabled, got %v, %v, %v", bg, backends, err)
+	}
+	bg, backends, err := newBlueGreen(&BlueGreenConfig{
+		Groups: map[string][]BackendConfig{
+			"green": {{URL: "10.0.0.2:80"}},
+			"blue":  {{URL: "10.0.0.1:80-81"}},
+		},
+		Active: "blue",
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if bg.Active() != "blue" || len(backends) != 3 {
+		t.Fatalf("expected blue to be active with 3 backends, got %s, %v", bg.Active(), backends)
+	}
+	if backends[0].group != "blue" || backends[1].group != "blue" || backends[2].group != "green" {
+		t.Errorf("expected backends tagged with their groups in group order, got %+v", backends)
+	}
+
+	for _, cfg := range []*BlueGreenConfig{
+		{Groups: map[string][]BackendConfig{"blue": {{URL: "10.0.0.1:80"}}}, Active: "blue"},
+		{Groups: map[string][]BackendConfig{"blue": {{URL: "10.0.0.1:80"}}, "green": {}}, Active: "blue"},
+		{Groups: map[string][]BackendConfig{"blue": {{URL: "10.0.0.1:80"}}, "green": {{URL: "10.0.0.2:80"}}}, Active: "red"},
+		{Groups: map[string][]BackendConfig{"blue": {{URL: "10.0.0.1:80"}}, "gr/een": {{URL: "10.0.0.2:80"}}}, Active: "blue"},
+	} {
+		if _, _, err := newBlueGreen(cfg); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
+
+func TestTCPServerPool_blueGreen(t *testing.T) {
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr: "127.0.0.1:0",
+		BlueGreen: &BlueGreenConfig{
+			Groups: map[string][]BackendConfig{
+				"blue":  {{URL: "tcp://" + startNamedBackend(t, "blue")}},
+				"green": {{URL: "tcp://" + startNamedBackend(t, "green")}},
+			},
+			Active: "blue",
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	pool.backends[0].SetHealthy(true)
+	pool.Start()
+	defer pool.Shutdown(t.Context())
+
+	mux := http.NewServeMux()
+	registerPoolRoutes(mux, "", pool)
+	switchTo := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("POST", "/api/blue-green/switch", strings.NewReader(body)))
+		return rec
+	}
+	expectGreeting := func(want string) (net.Conn, *bufio.Reader) {
+		t.Helper()
+		conn, r, greeting := dialEcho(t, pool)
+		if greeting != want+"\n" {
+			t.Errorf("expected connection to %s, got %q", want, greeting)
+		}
+		return conn, r
+	}
+
+	blue, blueReader := expectGreeting("blue")
+	defer blue.Close()
+
+	if rec := switchTo(`{"group": "green"}`); rec.Code != http.StatusConflict {
+		t.Errorf("expected status 409 for a group without healthy backends, got %d", rec.Code)
+	}
+	if rec := switchTo(`{"group": "red"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for an unknown group, got %d", rec.Code)
+	}
+	if rec := switchTo(`{"group": "green", "drain": "soon"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid drain, got %d", rec.Code)
+	}
+
+	pool.backends[1].SetHealthy(true)
+	rec := switchTo(`{"group": "green", "drain": "200ms"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var view blueGreenView
+	if err := json.NewDecoder(rec.Body).Decode(&view); err != nil {
+		t.Fatalf("failed to decode view: %v", err)
+	}
+	if view.Active != "green" || view.Draining != "blue" || view.Switched == nil || len(view.Groups["blue"]) != 1 {
+		t.Errorf("unexpected view %+v", view)
+	}
+
+	green, _ := expectGreeting("green")
+	defer green.Close()
+
+	// The connection to blue stays open until the drain times out.
+	blue.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	expectClosed(t, blueReader)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("expected blue connection to be closed after the drain timeout, closed after %s", elapsed)
+	}
+	if snap := pool.snapshot(); snap.ActiveGroup != "green" {
+		t.Errorf("expected snapshot to record the active group, got %q", snap.ActiveGroup)
+	}
+}
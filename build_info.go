@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// version, commit and buildDate describe the nlb release, set at build
+// time with -ldflags "-X main.version=... -X main.commit=...
+// -X main.buildDate=...". Without them, the commit and date recorded by
+// the Go toolchain are used, if any.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// processStart is when the process started.
+var processStart = time.Now()
+
+// buildInfo describes the running binary.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+	// Features are the platform-specific features supported by the build.
+	Features []string `json:"features"`
+}
+
+func newBuildInfo() buildInfo {
+	info := buildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Features:  buildFeatures(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = s.Value
+			}
+		}
+	}
+	return info
+}
+
+// buildFeatures returns the platform-specific features supported by the
+// build, in alphabetical order.
+func buildFeatures() []string {
+	features := []string{}
+	for _, f := range []struct {
+		name      string
+		supported bool
+	}{
+		{"bind_device", bindDeviceSupported},
+		{"reuse_addr", reuseAddrSupported},
+		{"reuse_port", reusePortSupported},
+		{"tcp_backlog", tcpBacklogSupported},
+		{"tcp_fast_open", tcpFastOpenSupported},
+	} {
+		if f.supported {
+			features = append(features, f.name)
+		}
+	}
+	return features
+}
+
+// infoView is the JSON representation of the process in the admin API.
+type infoView struct {
+	buildInfo
+	Started time.Time `json:"started"`
+	Uptime  string    `json:"uptime"`
+}
+
+func newInfoView(now time.Time) infoView {
+	return infoView{
+		buildInfo: newBuildInfo(),
+		Started:   processStart,
+		Uptime:    now.Sub(processStart).Round(time.Second).String(),
+	}
+}
+
+// infoAPIHandler reports the version and build of nlb and the uptime of
+// the process, for fleet inventories.
+func infoAPIHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, newInfoView(time.Now()))
+}
+
+// runVersion prints the version and build of nlb.
+func runVersion(_ context.Context, out io.Writer, args []string) error {
+	flags := flag.NewFlagSet("nlb version", flag.ContinueOnError)
+	flags.SetOutput(out)
+	asJSON := flags.Bool("json", false, "print the build info as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	info := newBuildInfo()
+	if *asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+	fmt.Fprintf(out, "nlb %s\n", info.Version)
+	if info.Commit != "" {
+		fmt.Fprintf(out, "commit:   %s\n", info.Commit)
+	}
+	if info.BuildDate != "" {
+		fmt.Fprintf(out, "built:    %s\n", info.BuildDate)
+	}
+	fmt.Fprintf(out, "go:       %s %s\n", info.GoVersion, info.Platform)
+	fmt.Fprintf(out, "features: %v\n", info.Features)
+	return nil
+}
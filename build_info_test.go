@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_newBuildInfo(t *testing.T) {
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "1.2.3", "abc123", "2024-01-01T00:00:00Z"
+
+	info := newBuildInfo()
+	if info.Version != "1.2.3" || info.Commit != "abc123" || info.BuildDate != "2024-01-01T00:00:00Z" {
+		t.Errorf("expected the values set with ldflags, got %+v", info)
+	}
+	if info.GoVersion != runtime.Version() || info.Platform != runtime.GOOS+"/"+runtime.GOARCH {
+		t.Errorf("expected the go version and platform, got %+v", info)
+	}
+	if bindDeviceSupported != strings.Contains(strings.Join(info.Features, ","), "bind_device") {
+		t.Errorf("expected features to match the platform, got %v", info.Features)
+	}
+}
+
+func Test_infoAPIHandler(t *testing.T) {
+	c := newConsole([]namedPool{{pool: consoleTestPool{newConsoleTestPool("web", true)}}}, tmpl, nil)
+	rec := httptest.NewRecorder()
+	c.handler("").ServeHTTP(rec, httptest.NewRequest("GET", "/api/info", nil))
+	if rec.Code != 200 {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	var info infoView
+	if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+		t.Fatalf("failed to decode info: %v", err)
+	}
+	if info.Version != version || info.GoVersion == "" || info.Uptime == "" || !info.Started.Equal(processStart) {
+		t.Errorf("unexpected info %+v", info)
+	}
+	if v := newInfoView(processStart.Add(90 * time.Second)); v.Uptime != "1m30s" {
+		t.Errorf("expected uptime 1m30s, got %s", v.Uptime)
+	}
+}
+
+func Test_runVersion(t *testing.T) {
+	var out bytes.Buffer
+	if err := runVersion(t.Context(), &out, nil); err != nil {
+		t.Fatalf("failed to print version: %v", err)
+	}
+	if !strings.HasPrefix(out.String(), "nlb "+version+"\n") || !strings.Contains(out.String(), runtime.Version()) {
+		t.Errorf("unexpected output %q", out.String())
+	}
+
+	out.Reset()
+	if err := runVersion(t.Context(), &out, []string{"-json"}); err != nil {
+		t.Fatalf("failed to print version: %v", err)
+	}
+	var info buildInfo
+	if err := json.Unmarshal(out.Bytes(), &info); err != nil || info.Version != version {
+		t.Errorf("expected the build info as json, got %q, %v", out.String(), err)
+	}
+}
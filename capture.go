@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Capture defaults and limits.
+const (
+	defaultCaptureConnections = 10
+	defaultCaptureMaxBytes    = 10 << 20
+	maxCaptureMaxBytes        = 1 << 30
+)
+
+// Capture directions recorded in the dump.
+const (
+	captureToBackend = "client_to_backend"
+	captureToClient  = "backend_to_client"
+)
+
+var errCaptureRunning = errors.New("a capture is already running")
+
+// captureRequest starts a capture of a backend's traffic. Capturing stops
+// after Connections connections (or UDP exchanges) have completed, after
+// Duration, or once MaxBytes of payload have been written, whichever comes
+// first.
+type captureRequest struct {
+	// Backend is the ID, URL or host:port of the backend to capture.
+	Backend     string `json:"backend"`
+	Connections int    `json:"connections"`
+	Duration    string `json:"duration"`
+	MaxBytes    int64  `json:"max_bytes"`
+}
+
+// captureStatus is the JSON representation of a capture in the admin API.
+type captureStatus struct {
+	Active      bool      `json:"active"`
+	Backend     string    `json:"backend"`
+	File        string    `json:"file"`
+	Started     time.Time `json:"started"`
+	Connections int       `json:"connections"`
+	Bytes       int64     `json:"bytes"`
+	// Reason is why a finished capture stopped.
+	Reason string `json:"reason,omitempty"`
+}
+
+// captureRecord is one line of a capture dump. Data is base64 encoded.
+type captureRecord struct {
+	Time      time.Time `json:"time"`
+	Conn      int       `json:"conn"`
+	ConnID    string    `json:"conn_id,omitempty"`
+	Event     string    `json:"event"`
+	Client    string    `json:"client,omitempty"`
+	Backend   string    `json:"backend,omitempty"`
+	Protocol  string    `json:"protocol,omitempty"`
+	Direction string    `json:"direction,omitempty"`
+	Length    int       `json:"length,omitempty"`
+	Data      []byte    `json:"data,omitempty"`
+}
+
+// trafficCapture writes the proxied traffic of one backend to a JSON lines
+// dump file.
+type trafficCapture struct {
+	backend        *Backend
+	maxConnections int
+	maxBytes       int64
+
+	mux    sync.Mutex
+	file   *os.File
+	enc    *json.Encoder
+	timer  *time.Timer
+	status captureStatus
+	// open is the number of captured connections still in progress.
+	open int
+}
+
+// capturer manages the pool's traffic capture. Only one capture runs at a
+// time. Captures are disabled unless dir is set.
+type capturer struct {
+	dir string
+
+	mux     sync.Mutex
+	current *trafficCapture
+}
+
+// validateCaptureDir checks that captures can be written to dir.
+func validateCaptureDir(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("invalid capture_dir: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("invalid capture_dir: %s is not a directory", dir)
+	}
+	return nil
+}
+
+// start begins capturing traffic for backend as described by req.
+func (c *capturer) start(backend *Backend, req captureRequest) (captureStatus, error) {
+	if req.Connections < 0 || req.MaxBytes < 0 {
+		return captureStatus{}, fmt.Errorf("connections and max_bytes must not be negative")
+	}
+	var duration time.Duration
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil {
+			return captureStatus{}, fmt.Errorf("invalid duration: %w", err)
+		}
+		if d <= 0 {
+			return captureStatus{}, fmt.Errorf("duration must be positive")
+		}
+		duration = d
+	}
+	if req.Connections == 0 && duration == 0 {
+		req.Connections = defaultCaptureConnections
+	}
+	if req.MaxBytes == 0 {
+		req.MaxBytes = defaultCaptureMaxBytes
+	}
+	req.MaxBytes = min(req.MaxBytes, maxCaptureMaxBytes)
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.current != nil && c.current.active() {
+		return captureStatus{}, errCaptureRunning
+	}
+
+	now := time.Now()
+	name := fmt.Sprintf("capture-%s-%s.jsonl", backend.ID, now.UTC().Format("20060102T150405.000"))
+	f, err := os.OpenFile(filepath.Join(c.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return captureStatus{}, fmt.Errorf("error creating capture file: %w", err)
+	}
+
+	tc := &trafficCapture{
+		backend:        backend,
+		maxConnections: req.Connections,
+		maxBytes:       req.MaxBytes,
+		file:           f,
+		enc:            json.NewEncoder(f),
+		status: captureStatus{
+			Active:  true,
+			Backend: backend.URL.String(),
+			File:    f.Name(),
+			Started: now,
+		},
+	}
+	if duration > 0 {
+		tc.timer = time.AfterFunc(duration, func() { tc.stop("duration elapsed") })
+	}
+	c.current = tc
+	return tc.snapshot(), nil
+}
+
+// stop ends the running capture, if any, and returns its status.
+func (c *capturer) stop() (captureStatus, bool) {
+	c.mux.Lock()
+	tc := c.current
+	c.mux.Unlock()
+	if tc == nil {
+		return captureStatus{}, false
+	}
+	tc.stop("stopped")
+	return tc.snapshot(), true
+}
+
+// status returns the status of the running or most recent capture.
+func (c *capturer) status() (captureStatus, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.current == nil {
+		return captureStatus{}, false
+	}
+	return c.current.snapshot(), true
+}
+
+// session starts recording a new connection to backend if a capture of it is
+// running and has not reached its connection limit. It returns nil
+// otherwise; a nil session records nothing.
+func (c *capturer) session(backend *Backend, client net.Addr, protocol, connID string) *captureSession {
+	if c.dir == "" {
+		return nil
+	}
+	c.mux.Lock()
+	tc := c.current
+	c.mux.Unlock()
+	if tc == nil || tc.backend != backend {
+		return nil
+	}
+
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	if !tc.status.Active || (tc.maxConnections > 0 && tc.status.Connections >= tc.maxConnections) {
+		return nil
+	}
+	tc.status.Connections++
+	tc.open++
+	s := &captureSession{capture: tc, conn: tc.status.Connections}
+	tc.writeLocked(captureRecord{
+		Time:     time.Now(),
+		Conn:     s.conn,
+		ConnID:   connID,
+		Event:    "open",
+		Client:   client.String(),
+		Backend:  backend.URL.Host,
+		Protocol: protocol,
+	})
+	return s
+}
+
+func (tc *trafficCapture) active() bool {
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	return tc.status.Active
+}
+
+func (tc *trafficCapture) snapshot() captureStatus {
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	return tc.status
+}
+
+// stop closes the dump file. Traffic recorded afterwards is discarded.
+func (tc *trafficCapture) stop(reason string) {
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	tc.stopLocked(reason)
+}
+
+func (tc *trafficCapture) stopLocked(reason string) {
+	if !tc.status.Active {
+		return
+	}
+	tc.status.Active = false
+	tc.status.Reason = reason
+	if tc.timer != nil {
+		tc.timer.Stop()
+	}
+	tc.file.Close()
+}
+
+func (tc *trafficCapture) writeLocked(r captureRecord) {
+	if !tc.status.Active {
+		return
+	}
+	if err := tc.enc.Encode(r); err != nil {
+		tc.stopLocked(fmt.Sprintf("write error: %v", err))
+	}
+}
+
+// captureSession records the traffic of one captured connection.
+type captureSession struct {
+	capture *trafficCapture
+	conn    int
+	// closed is guarded by capture.mux.
+	closed bool
+}
+
+// record writes data sent in direction to the dump, truncating the capture
+// once its byte limit is reached.
+func (s *captureSession) record(direction string, data []byte) {
+	if s == nil || len(data) == 0 {
+		return
+	}
+	tc := s.capture
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	if !tc.status.Active || s.closed {
+		return
+	}
+
+	r := captureRecord{Time: time.Now(), Conn: s.conn, Event: "data", Direction: direction, Length: len(data)}
+	remaining := tc.maxBytes - tc.status.Bytes
+	if int64(len(data)) > remaining {
+		data = data[:remaining]
+	}
+	r.Data = data
+	tc.status.Bytes += int64(len(data))
+	tc.writeLocked(r)
+	if tc.status.Bytes >= tc.maxBytes {
+		tc.stopLocked("size limit reached")
+	}
+}
+
+// close records the end of the connection. The capture stops once its last
+// connection closes after the connection limit was reached.
+func (s *captureSession) close() {
+	if s == nil {
+		return
+	}
+	tc := s.capture
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	tc.open--
+	tc.writeLocked(captureRecord{Time: time.Now(), Conn: s.conn, Event: "close"})
+	if tc.maxConnections > 0 && tc.status.Connections >= tc.maxConnections && tc.open == 0 {
+		tc.stopLocked("connection limit reached")
+	}
+}
+
+// writer returns a writer that records everything written to w.
+func (s *captureSession) writer(w io.Writer, direction string) io.Writer {
+	if s == nil {
+		return w
+	}
+	return &captureWriter{w: w, session: s, direction: direction}
+}
+
+type captureWriter struct {
+	w         io.Writer
+	session   *captureSession
+	direction string
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.session.record(cw.direction, b[:n])
+	return n, err
+}
+
+// captureAPIHandler returns the status of the running or most recent capture.
+func (p *BaseServerPool) captureAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	status, ok := p.capture.status()
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("no capture has been started"))
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// startCaptureAPIHandler starts capturing a backend's traffic.
+func (p *BaseServerPool) startCaptureAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if p.capture.dir == "" {
+		writeError(w, http.StatusServiceUnavailable, errors.New("traffic capture is disabled; set capture_dir to enable it"))
+		return
+	}
+	var req captureRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	backend := p.findBackend(req.Backend)
+	if backend == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("backend %q not found", req.Backend))
+		return
+	}
+
+	status, err := p.capture.start(backend, req)
+	if errors.Is(err, errCaptureRunning) {
+		writeError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	infof(p.log, "capturing traffic for backend %s to %s", backend.URL, status.File)
+	writeJSON(w, http.StatusCreated, status)
+}
+
+// stopCaptureAPIHandler stops the running capture.
+func (p *BaseServerPool) stopCaptureAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	status, ok := p.capture.stop()
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("no capture has been started"))
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readCapture decodes the records of a capture dump.
+func readCapture(t *testing.T, path string) []captureRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open capture: %v", err)
+	}
+	defer f.Close()
+
+	var records []captureRecord
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var r captureRecord
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatalf("invalid capture record %q: %v", s.Text(), err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func newCaptureTestBackend(t *testing.T) *Backend {
+	t.Helper()
+	pool := &BaseServerPool{}
+	b, err := pool.addBackend(BackendConfig{URL: "tcp://127.0.0.1:9000"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	return b
+}
+
+func TestCapturer_connectionLimit(t *testing.T) {
+	b := newCaptureTestBackend(t)
+	c := &capturer{dir: t.TempDir()}
+	client := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5000}
+
+	status, err := c.start(b, captureRequest{Connections: 1})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !status.Active {
+		t.Fatalf("expected capture to be active")
+	}
+	if _, err := c.start(b, captureRequest{}); err != errCaptureRunning {
+		t.Errorf("expected %v, got %v", errCaptureRunning, err)
+	}
+	if s := c.session(&Backend{}, client, "tcp", ""); s != nil {
+		t.Errorf("expected no session for another backend")
+	}
+
+	s := c.session(b, client, "tcp", "abc-1")
+	if s == nil {
+		t.Fatalf("expected a capture session")
+	}
+	if c.session(b, client, "tcp", "") != nil {
+		t.Errorf("expected no session beyond the connection limit")
+	}
+	s.record(captureToBackend, []byte("ping"))
+	s.record(captureToClient, []byte("pong"))
+	s.close()
+	s.record(captureToBackend, []byte("late"))
+
+	status, _ = c.status()
+	if status.Active || status.Reason != "connection limit reached" {
+		t.Errorf("expected capture to stop at the connection limit, got %+v", status)
+	}
+	if status.Connections != 1 || status.Bytes != 8 {
+		t.Errorf("expected 1 connection and 8 bytes, got %d and %d", status.Connections, status.Bytes)
+	}
+
+	records := readCapture(t, status.File)
+	var events []string
+	for _, r := range records {
+		events = append(events, r.Event+":"+r.Direction+":"+string(r.Data))
+	}
+	want := "open::,data:client_to_backend:ping,data:backend_to_client:pong,close::"
+	if got := strings.Join(events, ","); got != want {
+		t.Errorf("expected records %s, got %s", want, got)
+	}
+	if records[0].Client != client.String() || records[0].Backend != "127.0.0.1:9000" || records[0].Protocol != "tcp" || records[0].ConnID != "abc-1" {
+		t.Errorf("unexpected open record %+v", records[0])
+	}
+}
+
+func TestCapturer_maxBytes(t *testing.T) {
+	b := newCaptureTestBackend(t)
+	c := &capturer{dir: t.TempDir()}
+	if _, err := c.start(b, captureRequest{MaxBytes: 6}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	s := c.session(b, &net.TCPAddr{}, "tcp", "")
+	s.record(captureToBackend, []byte("abcd"))
+	s.record(captureToBackend, []byte("efgh"))
+
+	status, _ := c.status()
+	if status.Active || status.Reason != "size limit reached" || status.Bytes != 6 {
+		t.Errorf("expected capture to stop at 6 bytes, got %+v", status)
+	}
+	records := readCapture(t, status.File)
+	last := records[len(records)-1]
+	if string(last.Data) != "ef" || last.Length != 4 {
+		t.Errorf("expected truncated record with length 4, got %+v", last)
+	}
+}
+
+func TestCapturer_duration(t *testing.T) {
+	b := newCaptureTestBackend(t)
+	c := &capturer{dir: t.TempDir()}
+	if _, err := c.start(b, captureRequest{Duration: "20ms"}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if status, _ := c.status(); !status.Active {
+			if status.Reason != "duration elapsed" {
+				t.Errorf("expected duration elapsed, got %q", status.Reason)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("expected capture to stop after its duration")
+}
+
+func TestCapturer_invalid(t *testing.T) {
+	b := newCaptureTestBackend(t)
+	c := &capturer{dir: t.TempDir()}
+	for _, req := range []captureRequest{
+		{Connections: -1},
+		{MaxBytes: -1},
+		{Duration: "later"},
+		{Duration: "0s"},
+	} {
+		if _, err := c.start(b, req); err == nil {
+			t.Errorf("expected error for %+v", req)
+		}
+	}
+}
+
+func TestCaptureAPI(t *testing.T) {
+	pool := &BaseServerPool{log: log.New(io.Discard, "", 0)}
+	pool.AddBackend("tcp://127.0.0.1:9000")
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/capture", pool.captureAPIHandler)
+	mux.HandleFunc("POST /api/capture", pool.startCaptureAPIHandler)
+	mux.HandleFunc("DELETE /api/capture", pool.stopCaptureAPIHandler)
+
+	do := func(method, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, "/api/capture", strings.NewReader(body)))
+		return rr
+	}
+
+	if rr := do(http.MethodPost, `{"backend": "127.0.0.1:9000"}`); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d when disabled, got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+
+	pool.capture.dir = t.TempDir()
+	if rr := do(http.MethodGet, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("expected status %d before any capture, got %d", http.StatusNotFound, rr.Code)
+	}
+	if rr := do(http.MethodPost, `{"backend": "10.0.0.1:1"}`); rr.Code != http.StatusNotFound {
+		t.Errorf("expected status %d for unknown backend, got %d", http.StatusNotFound, rr.Code)
+	}
+	if rr := do(http.MethodPost, `{"backend": "127.0.0.1:9000", "duration": "soon"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for invalid duration, got %d", http.StatusBadRequest, rr.Code)
+	}
+	if rr := do(http.MethodPost, `{"backend": "tcp://127.0.0.1:9000", "connections": 5}`); rr.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body)
+	}
+	if rr := do(http.MethodPost, `{"backend": "127.0.0.1:9000"}`); rr.Code != http.StatusConflict {
+		t.Errorf("expected status %d while running, got %d", http.StatusConflict, rr.Code)
+	}
+
+	rr := do(http.MethodDelete, "")
+	var status captureStatus
+	json.NewDecoder(rr.Body).Decode(&status)
+	if rr.Code != http.StatusOK || status.Active || status.Reason != "stopped" {
+		t.Errorf("expected stopped capture, got %d %+v", rr.Code, status)
+	}
+}
+
+func TestTCPServerPool_capture(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:       "127.0.0.1:0",
+		Backends:   []BackendConfig{{URL: "tcp://" + backend.Addr().String()}},
+		CaptureDir: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	pool.backends[0].SetHealthy(true)
+	pool.Start()
+	defer pool.Shutdown(t.Context())
+
+	if _, err := pool.capture.start(pool.backends[0], captureRequest{Connections: 1}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	conn, err := net.Dial("tcp", pool.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("failed to read echo: %v", err)
+	}
+	conn.Close()
+
+	var status captureStatus
+	deadline := time.Now().Add(2 * time.Second)
+	for status, _ = pool.capture.status(); status.Active && time.Now().Before(deadline); status, _ = pool.capture.status() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.Active {
+		t.Fatalf("expected capture to finish after one connection")
+	}
+
+	got := map[string]string{}
+	for _, r := range readCapture(t, status.File) {
+		if r.Event == "data" {
+			got[r.Direction] += string(r.Data)
+		}
+	}
+	if got[captureToBackend] != "hello" || got[captureToClient] != "hello" {
+		t.Errorf("expected hello in both directions, got %v", got)
+	}
+}
+
+func TestNewTCPServerPool_invalidCaptureDir(t *testing.T) {
+	_, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:       "127.0.0.1:0",
+		CaptureDir: "/nonexistent/captures",
+	})
+	if err == nil {
+		t.Errorf("expected error for missing capture_dir")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states.
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// circuitBreakerSettings holds the validated circuit breaker config shared by
+// every backend of a pool.
+type circuitBreakerSettings struct {
+	failureThreshold int
+	openDuration     time.Duration
+	halfOpenTrials   int
+}
+
+// newCircuitBreakerSettings validates config, returning nil if circuit
+// breaking is not enabled.
+func newCircuitBreakerSettings(config *CircuitBreakerConfig) (*circuitBreakerSettings, error) {
+	if config == nil || !config.Enabled {
+		return nil, nil
+	}
+
+	s := &circuitBreakerSettings{
+		failureThreshold: config.FailureThreshold,
+		openDuration:     30 * time.Second,
+		halfOpenTrials:   config.HalfOpenTrials,
+	}
+	if s.failureThreshold == 0 {
+		s.failureThreshold = 5
+	}
+	if s.halfOpenTrials == 0 {
+		s.halfOpenTrials = 1
+	}
+	if s.failureThreshold < 0 || s.halfOpenTrials < 0 {
+		return nil, fmt.Errorf("circuit breaker failure_threshold and half_open_trials must be positive")
+	}
+	if config.OpenDuration != "" {
+		d, err := time.ParseDuration(config.OpenDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid circuit breaker open_duration: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("circuit breaker open_duration must be positive")
+		}
+		s.openDuration = d
+	}
+	return s, nil
+}
+
+// circuitBreaker stops traffic to a backend after repeated connection
+// failures. Once open, it rejects connections until the open duration has
+// passed, then lets a limited number of trial connections through: a
+// successful trial closes the circuit and a failed one reopens it. A nil
+// *circuitBreaker never trips.
+type circuitBreaker struct {
+	settings *circuitBreakerSettings
+	now      func() time.Time
+
+	mux       sync.Mutex
+	state     string
+	failures  int
+	openUntil time.Time
+	trials    int
+}
+
+func newCircuitBreaker(settings *circuitBreakerSettings) *circuitBreaker {
+	if settings == nil {
+		return nil
+	}
+	return &circuitBreaker{settings: settings, now: time.Now, state: circuitClosed}
+}
+
+// State returns the current state, moving an open circuit whose open
+// duration has passed to half-open.
+func (c *circuitBreaker) State() string {
+	if c == nil {
+		return circuitClosed
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.advance()
+	return c.state
+}
+
+// Ready reports whether a connection would currently be allowed, without
+// reserving a trial. It is used when selecting a backend.
+func (c *circuitBreaker) Ready() bool {
+	if c == nil {
+		return true
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.advance()
+	switch c.state {
+	case circuitOpen:
+		return false
+	case circuitHalfOpen:
+		return c.trials < c.settings.halfOpenTrials
+	default:
+		return true
+	}
+}
+
+// Allow reports whether a connection may be attempted. In the half-open state
+// it reserves one of the trial connections; the outcome must be reported
+// with Success or Failure.
+func (c *circuitBreaker) Allow() bool {
+	if c == nil {
+		return true
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.advance()
+	switch c.state {
+	case circuitOpen:
+		return false
+	case circuitHalfOpen:
+		if c.trials >= c.settings.halfOpenTrials {
+			return false
+		}
+		c.trials++
+		return true
+	default:
+		return true
+	}
+}
+
+// Success records a successful connection, closing the circuit.
+func (c *circuitBreaker) Success() {
+	if c == nil {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.state = circuitClosed
+	c.failures = 0
+	c.trials = 0
+}
+
+// Failure records a failed connection. It reports whether this failure
+// opened the circuit.
+func (c *circuitBreaker) Failure() bool {
+	if c == nil {
+		return false
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.advance()
+	switch c.state {
+	case circuitHalfOpen:
+		c.open()
+		return true
+	case circuitClosed:
+		c.failures++
+		if c.failures >= c.settings.failureThreshold {
+			c.open()
+			return true
+		}
+	}
+	return false
+}
+
+func (c *circuitBreaker) open() {
+	c.state = circuitOpen
+	c.openUntil = c.now().Add(c.settings.openDuration)
+	c.failures = 0
+	c.trials = 0
+}
+
+// advance moves an open circuit to half-open once its open duration has
+// passed. The caller must hold c.mux.
+func (c *circuitBreaker) advance() {
+	if c.state == circuitOpen && !c.now().Before(c.openUntil) {
+		c.state = circuitHalfOpen
+		c.trials = 0
+	}
+}
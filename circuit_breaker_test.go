@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewCircuitBreakerSettings(t *testing.T) {
+	s, err := newCircuitBreakerSettings(nil)
+	if err != nil || s != nil {
+		t.Errorf("expected nil settings when not configured, got %v, %v", s, err)
+	}
+
+	s, err = newCircuitBreakerSettings(&CircuitBreakerConfig{Enabled: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if s.failureThreshold != 5 || s.openDuration != 30*time.Second || s.halfOpenTrials != 1 {
+		t.Errorf("unexpected defaults %+v", s)
+	}
+
+	for _, cfg := range []*CircuitBreakerConfig{
+		{Enabled: true, OpenDuration: "a while"},
+		{Enabled: true, OpenDuration: "-1s"},
+		{Enabled: true, FailureThreshold: -1},
+	} {
+		if _, err := newCircuitBreakerSettings(cfg); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := newCircuitBreaker(&circuitBreakerSettings{failureThreshold: 3, openDuration: 10 * time.Second, halfOpenTrials: 1})
+	c.now = func() time.Time { return now }
+
+	// Failures must be consecutive to trip the circuit.
+	c.Failure()
+	c.Failure()
+	c.Success()
+	c.Failure()
+	if c.Failure() {
+		t.Errorf("expected circuit to stay closed")
+	}
+	if !c.Failure() || c.State() != circuitOpen {
+		t.Fatalf("expected circuit to open after 3 failures, got %s", c.State())
+	}
+	if c.Ready() || c.Allow() {
+		t.Errorf("expected open circuit to reject connections")
+	}
+
+	now = now.Add(10 * time.Second)
+	if !c.Ready() || c.State() != circuitHalfOpen {
+		t.Fatalf("expected circuit to be half-open, got %s", c.State())
+	}
+	if !c.Allow() {
+		t.Errorf("expected a trial connection to be allowed")
+	}
+	if c.Ready() || c.Allow() {
+		t.Errorf("expected only one trial connection")
+	}
+
+	// A failed trial reopens the circuit.
+	if !c.Failure() || c.State() != circuitOpen {
+		t.Errorf("expected failed trial to reopen the circuit, got %s", c.State())
+	}
+
+	now = now.Add(10 * time.Second)
+	c.Allow()
+	c.Success()
+	if c.State() != circuitClosed || !c.Allow() {
+		t.Errorf("expected successful trial to close the circuit, got %s", c.State())
+	}
+}
+
+func TestCircuitBreaker_nil(t *testing.T) {
+	var c *circuitBreaker
+	if !c.Allow() || !c.Ready() || c.Failure() || c.State() != circuitClosed {
+		t.Errorf("expected nil breaker to never trip")
+	}
+	c.Success()
+}
+
+func TestTCPServerPool_circuitBreaker(t *testing.T) {
+	// Reserve a port with nothing listening on it.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	deadAddr := ln.Addr().String()
+	ln.Close()
+
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:           "127.0.0.1:0",
+		Backends:       []BackendConfig{{URL: "tcp://" + deadAddr}},
+		CircuitBreaker: &CircuitBreakerConfig{Enabled: true, FailureThreshold: 2, OpenDuration: "1h"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	backend := pool.backends[0]
+	backend.SetHealthy(true)
+	pool.Start()
+	defer pool.Shutdown(t.Context())
+
+	for range 2 {
+		conn, err := net.Dial("tcp", pool.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+
+	if state := backend.breaker.State(); state != circuitOpen {
+		t.Fatalf("expected circuit to be open, got %s", state)
+	}
+	if b := pool.Next(&net.TCPAddr{}); b != nil {
+		t.Errorf("expected backend with open circuit not to be selected, got %s", b.URL)
+	}
+	if v := newBackendView(backend); v.Circuit != circuitOpen {
+		t.Errorf("expected api view to report open circuit, got %q", v.Circuit)
+	}
+}
+
+func TestUDPServerPool_circuitBreakerConnectDelay(t *testing.T) {
+	for _, flows := range []*UDPFlowConfig{nil, {Enabled: true}} {
+		pool, err := NewUDPServerPool(log.New(io.Discard, "", 0), &Config{
+			Addr:           "127.0.0.1:0",
+			Backends:       []BackendConfig{{URL: "udp://127.0.0.1:1"}},
+			CircuitBreaker: &CircuitBreakerConfig{Enabled: true, FailureThreshold: 1, OpenDuration: "10s"},
+			FaultInjection: &FaultInjectionConfig{Enabled: true, ConnectDelay: "1h"},
+			UDPFlows:       flows,
+		})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		backend := pool.backends[0]
+		backend.SetHealthy(true)
+		now := time.Now()
+		backend.breaker.now = func() time.Time { return now }
+		backend.failed()
+		now = now.Add(10 * time.Second)
+
+		// A datagram whose connect delay ends with its context must leave
+		// the half-open trial to the next one.
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+		pool.handleConnection(ctx, nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}, []byte("ping"))
+		if !backend.breaker.Allow() {
+			t.Errorf("expected the half-open trial to be free with flows %v", flows != nil)
+		}
+	}
+}
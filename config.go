@@ -1,34 +1,1031 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"maps"
 	"os"
+	"regexp"
+	"slices"
 )
 
+// currentConfigVersion is the config schema version understood by this build.
+// Configs without a version are treated as version 1.
+const currentConfigVersion = 1
+
+// configMigration upgrades a raw config from one schema version to the next.
+type configMigration func(raw map[string]any) error
+
+// configMigrations holds the migration from each version to its successor,
+// keyed by the version it upgrades from.
+var configMigrations = map[int]configMigration{}
+
 type Config struct {
-	Addr                string   `json:"addr"`
-	ConsoleAddr         string   `json:"console_addr"`
-	Protocol            string   `json:"protocol"`
-	Backends            []string `json:"backends"`
-	StickySessions      bool     `json:"sticky_sessions"`
-	TLSCertPath         string   `json:"tls_cert_path"`
-	TLSKeyPath          string   `json:"tls_key_path"`
-	HealthcheckInterval string   `json:"healthcheck_interval"`
+	// Version is the schema version of the config file.
+	Version int `json:"version"`
+	// Strict rejects configs containing unknown fields.
+	Strict bool `json:"strict"`
+
+	// Listeners defines several named listeners served by one process and
+	// console. Each inherits the top-level settings it does not set itself,
+	// except addr, addrs and autoscaling_export. Name identifies a listener.
+	Listeners []*Config `json:"listeners"`
+	Name      string    `json:"name"`
+
+	Addr                string          `json:"addr"`
+	ConsoleAddr         string          `json:"console_addr"`
+	Protocol            string          `json:"protocol"`
+	Backends            []BackendConfig `json:"backends"`
+	StickySessions      bool            `json:"sticky_sessions"`
+	StickyKey           string          `json:"sticky_key"`
+	StickyHashing       string          `json:"sticky_hashing"`
+	TLSCertPath         string          `json:"tls_cert_path"`
+	TLSKeyPath          string          `json:"tls_key_path"`
+	HealthcheckInterval string          `json:"healthcheck_interval"`
+	Algorithm           string          `json:"algorithm"`
+	MaxConnections      int64           `json:"max_connections"`
+	// Addrs are further addresses, such as VIPs, bound by the listener
+	// besides Addr. Connections to any of them share its backends.
+	Addrs []string `json:"addrs"`
+	// StickyFailover controls whether sticky clients moved off a failed
+	// backend return to it once it recovers.
+	StickyFailover *StickyFailoverConfig `json:"sticky_failover"`
+	// AddressHooks run commands as the listener binds and releases each of
+	// its addresses.
+	AddressHooks *AddressHooksConfig `json:"address_hooks"`
+	// Device binds the listener to a network device, and BackendDevice
+	// connections to backends, including health checks, with
+	// SO_BINDTODEVICE. Naming a VRF device keeps traffic in that VRF.
+	// Linux only.
+	Device        string `json:"device"`
+	BackendDevice string `json:"backend_device"`
+	// DialTimeout bounds connecting to a backend on the data path (default
+	// 2s). Health check probes are bounded by HealthCheck.Timeout instead.
+	DialTimeout string `json:"dial_timeout"`
+	// ConnectionTimeout closes client connections and UDP flows that have
+	// been open longer than it. Connections are not limited if it is unset.
+	ConnectionTimeout string `json:"connection_timeout"`
+	// LongConnections sets how drains treat long-lived connections.
+	LongConnections *LongConnectionsConfig `json:"long_connections"`
+	// LocalZone enables zone-aware routing: backends whose ZoneLabel label
+	// (default "zone") matches it are preferred over other backends.
+	LocalZone string `json:"local_zone"`
+	ZoneLabel string `json:"zone_label"`
+	// MinHealthyBackends is the number of backends that must pass a health
+	// check before the pool reports ready (default 1). If WaitForReady is
+	// set, no traffic is accepted until then. Once ready, dropping below it
+	// logs a critical alarm.
+	MinHealthyBackends int  `json:"min_healthy_backends"`
+	WaitForReady       bool `json:"wait_for_ready"`
+	// FailStatic keeps routing to the backends that were last healthy while
+	// the pool is below MinHealthyBackends, rather than to healthy ones only.
+	FailStatic bool `json:"fail_static"`
+
+	// Shutdown bounds each phase of a graceful shutdown. It applies to the
+	// whole process and is not inherited by listeners.
+	Shutdown *ShutdownConfig `json:"shutdown"`
+
+	// State saves runtime state to a file and restores it at startup. It
+	// applies to the whole process and is not inherited by listeners.
+	State *StateConfig `json:"state"`
+
+	// CaptureDir is where traffic captures started through the admin API
+	// are written. Capturing is disabled unless it is set.
+	CaptureDir string `json:"capture_dir"`
+
+	// Exemplars annotates latency histogram buckets with the ID of a
+	// connection they counted when metrics are scraped in the OpenMetrics
+	// format.
+	Exemplars bool `json:"exemplars"`
+
+	// TemplateDir and StaticDir override the embedded dashboard templates
+	// and assets. Files missing from them fall back to the defaults.
+	TemplateDir string `json:"template_dir"`
+	StaticDir   string `json:"static_dir"`
+
+	// HealthCheck configures how backends are probed. BackendHealthChecks
+	// overrides it for individual backends, keyed by backend URL or host:port.
+	HealthCheck         *HealthCheckConfig            `json:"health_check"`
+	BackendHealthChecks map[string]*HealthCheckConfig `json:"backend_health_checks"`
+	// DeepHealthCheck probes backends more thoroughly at a lower frequency
+	// and degrades those that pass HealthCheck but fail it.
+	DeepHealthCheck *DeepHealthCheckConfig `json:"deep_health_check"`
+	// DegradedWeight is the share of its usual connections a degraded
+	// backend receives while others are available (default 0.25).
+	DegradedWeight *float64 `json:"degraded_weight"`
+
+	// FlapDetection holds down backends whose health changes too often.
+	FlapDetection *FlapDetectionConfig `json:"flap_detection"`
+	// Quarantine removes backends that have been down for a long time from
+	// rotation until they pass a health check again.
+	Quarantine *QuarantineConfig `json:"quarantine"`
+
+	// CircuitBreaker stops sending traffic to backends that repeatedly fail
+	// to accept connections.
+	CircuitBreaker *CircuitBreakerConfig `json:"circuit_breaker"`
+
+	// BackendConnectionRate limits the rate of new connections sent to
+	// each backend.
+	BackendConnectionRate *BackendConnectionRateConfig `json:"backend_connection_rate"`
+
+	// PanicRecovery configures how panics handling client connections are
+	// recovered from.
+	PanicRecovery *PanicRecoveryConfig `json:"panic_recovery"`
+	// LogSampling logs the debug lines of some connections whatever the
+	// log level.
+	LogSampling *LogSamplingConfig `json:"log_sampling"`
+
+	// SLO tracks each backend's success rate against an objective.
+	SLO *SLOConfig `json:"slo"`
+
+	// TCPOptions tunes socket options on TCP client and backend connections.
+	TCPOptions *TCPOptionsConfig `json:"tcp_options"`
+	// BackendTLS re-encrypts connections to the backends of a TCP listener.
+	BackendTLS *BackendTLSConfig `json:"backend_tls"`
+	// DNSCache tunes how long backend hostname resolutions are cached.
+	DNSCache *DNSCacheConfig `json:"dns_cache"`
+	// Sniff detects TLS, HTTP and raw TCP on a TCP listener and applies a
+	// policy to each.
+	Sniff *SniffConfig `json:"sniff"`
+	// Socks5 makes a TCP listener accept SOCKS5 CONNECT requests and
+	// forward them through the backends, which are SOCKS5 egress nodes.
+	Socks5 *Socks5Config `json:"socks5"`
+	// AcceptQueue holds connections to a TCP listener that arrive while
+	// every backend is at MaxConnections, instead of closing them.
+	AcceptQueue *AcceptQueueConfig `json:"accept_queue"`
+	// FDLimit sheds new connections while the process is close to its
+	// limit on open file descriptors.
+	FDLimit *FDLimitConfig `json:"fd_limit"`
+	// PriorityClasses sheds clients of lower priority first as backends
+	// approach MaxConnections.
+	PriorityClasses *PriorityClassesConfig `json:"priority_classes"`
+	// GeoIP tags connections with the client's country and AS number and
+	// routes clients from some regions to groups of backends.
+	GeoIP *GeoIPConfig `json:"geoip"`
+	// SourceFilter rejects clients from bogon ranges and denied
+	// autonomous systems.
+	SourceFilter *SourceFilterConfig `json:"source_filter"`
+	// FirstByteRouting routes connections to a TCP listener to a group of
+	// backends by the first bytes the client sends.
+	FirstByteRouting *FirstByteRoutingConfig `json:"first_byte_routing"`
+	// ProtocolValidation rejects connections to a TCP listener whose first
+	// bytes do not look like the expected protocol.
+	ProtocolValidation *ProtocolValidationConfig `json:"protocol_validation"`
+	// Affinity hashes connections and datagrams to backends by a key
+	// parsed from the first bytes clients send.
+	Affinity *AffinityConfig `json:"affinity"`
+	// DeferDial waits for clients of a TCP listener to send data before a
+	// backend is chosen and dialed.
+	DeferDial *DeferDialConfig `json:"defer_dial"`
+	// PinBackend lets allowlisted clients pin a connection to a backend.
+	PinBackend *PinBackendConfig `json:"pin_backend"`
+	// UDPFlows keeps per-client UDP flows open across datagrams.
+	UDPFlows *UDPFlowConfig `json:"udp_flows"`
+	// UDPFanOut sends each datagram to a UDP listener to all of its
+	// backends rather than one.
+	UDPFanOut *UDPFanOutConfig `json:"udp_fan_out"`
+	// UDPFlood drops datagrams from sources, or in total, beyond a rate.
+	UDPFlood *UDPFloodConfig `json:"udp_flood"`
+	// UDPResponse bounds the wait for backend replies to datagrams, or
+	// disables it for protocols that never reply.
+	UDPResponse *UDPResponseConfig `json:"udp_response"`
+	// UDPSink forwards datagrams of one-way workloads at the highest rate.
+	UDPSink *UDPSinkConfig `json:"udp_sink"`
+	// UDPReceiveSockets is the number of sockets bound to each address of
+	// a UDP listener with SO_REUSEPORT, each with a read loop of its own,
+	// to process datagrams on several cores. It defaults to one and is only
+	// supported on Linux.
+	UDPReceiveSockets int `json:"udp_receive_sockets"`
+	// UDPBatchSize is the number of datagrams a UDP listener reads per
+	// recvmmsg call, and at most writes per sendmmsg call to a backend in
+	// sink mode. It defaults to 32 on Linux, and is one elsewhere.
+	UDPBatchSize int `json:"udp_batch_size"`
+
+	// BlueGreen defines two groups of backends, of which only the active one
+	// receives new traffic, and lets the admin API switch between them.
+	BlueGreen *BlueGreenConfig `json:"blue_green"`
+
+	// BackendGroups defines named fleets of backends, which a listener uses
+	// by naming one in BackendGroup, alongside its own Backends. Each group
+	// is health checked once for every listener of a protocol using it.
+	BackendGroups map[string]*BackendGroupConfig `json:"backend_groups"`
+	BackendGroup  string                         `json:"backend_group"`
+
+	// SharedHealth combines the health checks of backends on the same host
+	// into one health state, across all listeners enabling it.
+	SharedHealth *SharedHealthConfig `json:"shared_health"`
+
+	// XDS discovers backends from the endpoints of a cluster served by an
+	// xDS management server.
+	XDS *XDSConfig `json:"xds"`
+
+	AutoscalingExport *AutoscalingExportConfig `json:"autoscaling_export"`
+	FaultInjection    *FaultInjectionConfig    `json:"fault_injection"`
+
+	// SelfTest configures the checks run at startup, before the listeners
+	// bind their addresses.
+	SelfTest *SelfTestConfig `json:"self_test"`
+
+	// UptimeHistory persists backend health transitions so that the
+	// dashboard can show uptime over the last day and week. It applies to
+	// the whole process and is not inherited by listeners.
+	UptimeHistory *UptimeHistoryConfig `json:"uptime_history"`
+
+	// groups shares backend groups between the listeners of a process. If
+	// nil, the listener checks its backend group on its own.
+	groups *backendGroups
+	// health shares health states between the listeners of a process that
+	// enable SharedHealth. If nil, only the listener's own backends share.
+	health *sharedHealth
+	// uptime records the health transitions of the listeners' backends, or
+	// is nil.
+	uptime *uptimeLog
+}
+
+// BackendConfig describes a backend. In JSON it may be given either as a
+// plain URL string or as an object.
+type BackendConfig struct {
+	URL string `json:"url"`
+	// Labels are arbitrary key/value metadata such as zone or tier.
+	Labels map[string]string `json:"labels,omitempty"`
+	// DialTimeout overrides the pool's dial_timeout for this backend.
+	DialTimeout string `json:"dial_timeout,omitempty"`
+	// TLS overrides the pool's backend_tls settings for this backend.
+	TLS *BackendTLSConfig `json:"tls,omitempty"`
+	// Static is the response of a static:// backend.
+	Static *StaticResponseConfig `json:"static,omitempty"`
+
+	// runtime marks a backend added through the admin API.
+	runtime bool
+	// group is the blue/green group of the backend, if any.
+	group string
+	// sharedGroup is the backend group the backend belongs to, if any.
+	sharedGroup string
+}
+
+// StaticResponseConfig is the response a static:// backend writes to every
+// connection before closing it: Body, or the contents of File, read when
+// the backend is added. With HTTPStatus, such as 503, it is sent as an
+// HTTP/1.1 response with that status and ContentType (default text/plain).
+type StaticResponseConfig struct {
+	Body        string `json:"body"`
+	File        string `json:"file"`
+	HTTPStatus  int    `json:"http_status"`
+	ContentType string `json:"content_type"`
+}
+
+// UnmarshalJSON accepts either a URL string or a backend object.
+func (b *BackendConfig) UnmarshalJSON(data []byte) error {
+	var rawURL string
+	if err := json.Unmarshal(data, &rawURL); err == nil {
+		*b = BackendConfig{URL: rawURL}
+		return nil
+	}
+
+	// Use an alias type to avoid recursing into this method.
+	type backendConfig BackendConfig
+	var bc backendConfig
+	if err := json.Unmarshal(data, &bc); err != nil {
+		return err
+	}
+	*b = BackendConfig(bc)
+	return nil
+}
+
+// XDSConfig configures backend discovery from an xDS management server
+// (Envoy CDS and EDS) over the REST-JSON transport.
+type XDSConfig struct {
+	// Server is the base URL of the management server's REST endpoint.
+	Server string `json:"server"`
+	// Cluster is the cluster whose endpoints become backends.
+	Cluster string `json:"cluster"`
+	// NodeID (default the hostname) and NodeCluster identify nlb to the
+	// management server.
+	NodeID      string `json:"node_id"`
+	NodeCluster string `json:"node_cluster"`
+	// Interval is how often the server is polled (default 30s) and Timeout
+	// bounds each request (default 5s).
+	Interval string `json:"interval"`
+	Timeout  string `json:"timeout"`
+}
+
+// FlapDetectionConfig flags a backend as flapping once its health changes
+// Transitions times (default 5) within Window (default 5m), and keeps it out
+// of rotation for HoldDown (default 2m) after the last change.
+type FlapDetectionConfig struct {
+	Enabled     bool   `json:"enabled"`
+	Transitions int    `json:"transitions"`
+	Window      string `json:"window"`
+	HoldDown    string `json:"hold_down"`
+}
+
+// QuarantineConfig removes a backend from the pool once its health checks
+// have failed for After (default 30m). Quarantined backends are probed every
+// Recheck (default 5m) and added back once a probe passes; with Forget set,
+// they are dropped for good after being quarantined that long.
+type QuarantineConfig struct {
+	Enabled bool   `json:"enabled"`
+	After   string `json:"after"`
+	Recheck string `json:"recheck"`
+	Forget  string `json:"forget"`
+}
+
+// BackendTLSConfig configures TLS on connections to backends.
+type BackendTLSConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// ServerName is sent as SNI and used to verify the backend's certificate
+	// (default the backend's host).
+	ServerName string `json:"server_name,omitempty"`
+	// ALPN is the list of application protocols offered, e.g. ["h2"].
+	ALPN []string `json:"alpn,omitempty"`
+	// CAFile verifies backend certificates instead of the system roots.
+	CAFile             string `json:"ca_file,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+// BlueGreenConfig defines the groups of a blue/green listener. Their backends
+// are health checked alongside the listener's other backends, which receive
+// traffic whichever group is active.
+type BlueGreenConfig struct {
+	// Groups maps each of the two group names to its backends.
+	Groups map[string][]BackendConfig `json:"groups"`
+	// Active is the group that receives new traffic at startup.
+	Active string `json:"active"`
+}
+
+// SelfTestConfig configures the startup self-test. Address conflicts and
+// addresses that cannot be bound are always reported; with DialBackends each
+// backend is also dialed once, waiting up to Timeout (default 2s).
+type SelfTestConfig struct {
+	DialBackends bool   `json:"dial_backends"`
+	Timeout      string `json:"timeout"`
+}
+
+// BackendGroupConfig defines a backend group. Its members are probed with
+// HealthCheck every HealthcheckInterval (default 10s), whatever the health
+// check settings of the listeners using the group. The members are either
+// listed in Backends or discovered by Resolver.
+type BackendGroupConfig struct {
+	Backends            []BackendConfig    `json:"backends"`
+	Resolver            *ResolverConfig    `json:"resolver"`
+	HealthCheck         *HealthCheckConfig `json:"health_check"`
+	HealthcheckInterval string             `json:"healthcheck_interval"`
+}
+
+// ResolverConfig selects how the members of a backend group are discovered.
+// Type is "static" for the backends listed in Backends, "dns" for the
+// addresses Name resolves to on Port, or the targets of its SRV records if
+// Port is unset, or "file" for the backends listed in the file at Path,
+// which is re-read as soon as it changes. Resolvers other than static are
+// re-resolved every Interval (default 30s).
+type ResolverConfig struct {
+	Type     string          `json:"type"`
+	Interval string          `json:"interval"`
+	Backends []BackendConfig `json:"backends"`
+	Name     string          `json:"name"`
+	Port     int             `json:"port"`
+	Path     string          `json:"path"`
+}
+
+// SharedHealthConfig shares one health state per backend host. Require is
+// "all" (the default) for a host to be healthy only while every check of
+// it passes, such as both a TCP and a UDP listener's, or "any" for it to be
+// healthy while any passes.
+type SharedHealthConfig struct {
+	Enabled bool   `json:"enabled"`
+	Require string `json:"require"`
+}
+
+// StateConfig configures persistence of runtime state: traffic policy and
+// backends changed through the admin API and learned backend response times.
+type StateConfig struct {
+	// Path is the file the state is saved to.
+	Path string `json:"path"`
+	// Interval is how often the state is saved (default 30s). It is also
+	// saved on shutdown.
+	Interval string `json:"interval"`
+}
+
+// UptimeHistoryConfig keeps backend health transitions in an append-only
+// file at Path for Retention (default 168h, the longest uptime shown).
+type UptimeHistoryConfig struct {
+	Path      string `json:"path"`
+	Retention string `json:"retention"`
+}
+
+// AutoscalingExportConfig configures periodic publishing of backend
+// utilization for consumption by autoscalers. At least one of URL or File
+// must be set.
+type AutoscalingExportConfig struct {
+	Interval string `json:"interval"`
+	URL      string `json:"url"`
+	File     string `json:"file"`
 }
 
 func loadConfig(filePath string) (*Config, error) {
-	f, err := os.Open(filePath)
+	raw, err := readRawConfig(filePath)
 	if err != nil {
-		return nil, fmt.Errorf("could not open config file: %w", err)
+		return nil, err
 	}
-	defer f.Close()
+	if raw, err = expandIncludes(raw, filePath); err != nil {
+		return nil, err
+	}
+	return decodeRawConfig(raw)
+}
 
-	decoder := json.NewDecoder(f)
+// decodeRawConfig decodes a raw config at the current schema version,
+// resolving its listeners.
+func decodeRawConfig(raw map[string]any) (*Config, error) {
+	migrated, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode migrated config: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(migrated))
+	if strict, _ := raw["strict"].(bool); strict {
+		decoder.DisallowUnknownFields()
+	}
 	config := &Config{}
 	if err := decoder.Decode(config); err != nil {
 		return nil, fmt.Errorf("could not decode config json: %w", err)
 	}
+	if err := resolveListeners(config, raw); err != nil {
+		return nil, err
+	}
 
 	return config, nil
 }
+
+// readRawConfig reads a config file as a raw map, migrated to the current
+// schema version.
+func readRawConfig(filePath string) (map[string]any, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("could not open config file: %w", err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %w", err)
+	}
+
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("could not decode config json: %w", err)
+	}
+
+	version := 1
+	if v, ok := raw["version"]; ok {
+		n, ok := v.(float64)
+		if !ok || n != float64(int(n)) || n < 1 {
+			return nil, fmt.Errorf("invalid config version: %v", v)
+		}
+		version = int(n)
+	}
+	if err := migrateConfig(raw, version, currentConfigVersion, configMigrations); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// nonInheritedKeys are top-level settings that listeners do not inherit.
+var nonInheritedKeys = []string{"version", "strict", "includes", "console_addr", "listeners", "name", "addr", "addrs", "autoscaling_export", "shutdown", "state", "self_test", "uptime_history"}
+
+var listenerNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// resolveListeners replaces each entry of config.Listeners with the
+// top-level settings overlaid by the listener's own.
+func resolveListeners(config *Config, raw map[string]any) error {
+	rawListeners, _ := raw["listeners"].([]any)
+	if len(rawListeners) == 0 {
+		config.Listeners = nil
+		return nil
+	}
+
+	names := make(map[string]bool)
+	for i, rl := range rawListeners {
+		listener, _ := rl.(map[string]any)
+		lc, err := resolveListener(raw, listener, config.Strict)
+		if err != nil {
+			return fmt.Errorf("listener %d: %w", i, err)
+		}
+		if names[lc.Name] {
+			return fmt.Errorf("duplicate listener name %q", lc.Name)
+		}
+		names[lc.Name] = true
+		config.Listeners[i] = lc
+	}
+	return nil
+}
+
+// resolveListener decodes a raw listener overlaid on the top-level settings
+// of raw it inherits.
+func resolveListener(raw, listener map[string]any, strict bool) (*Config, error) {
+	merged := make(map[string]any)
+	for k, v := range raw {
+		if !slices.Contains(nonInheritedKeys, k) {
+			merged[k] = v
+		}
+	}
+	maps.Copy(merged, listener)
+
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode listener: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	lc := &Config{}
+	if err := decoder.Decode(lc); err != nil {
+		return nil, fmt.Errorf("could not decode listener: %w", err)
+	}
+
+	switch {
+	case len(lc.Listeners) > 0:
+		return nil, fmt.Errorf("listener %q: listeners cannot be nested", lc.Name)
+	case !listenerNameRegexp.MatchString(lc.Name):
+		return nil, fmt.Errorf("invalid name %q", lc.Name)
+	}
+	return lc, nil
+}
+
+// listenerConfigs returns the config of each listener. A config without
+// listeners describes a single listener.
+func (c *Config) listenerConfigs() []*Config {
+	if len(c.Listeners) == 0 {
+		return []*Config{c}
+	}
+	return c.Listeners
+}
+
+// migrateConfig upgrades a raw config from version from to version to by
+// applying each intermediate migration in order.
+func migrateConfig(raw map[string]any, from, to int, migrations map[int]configMigration) error {
+	if from > to {
+		return fmt.Errorf("unsupported config version %d: this build supports up to version %d", from, to)
+	}
+	for v := from; v < to; v++ {
+		migrate, ok := migrations[v]
+		if !ok {
+			return fmt.Errorf("no migration from config version %d", v)
+		}
+		if err := migrate(raw); err != nil {
+			return fmt.Errorf("could not migrate config from version %d: %w", v, err)
+		}
+	}
+	raw["version"] = to
+	return nil
+}
+
+// HealthCheckConfig configures a health check probe. For UDP backends the
+// default probe sends "ping" and expects "pong".
+type HealthCheckConfig struct {
+	// Type selects the probe. It defaults to the protocol's native check;
+	// "dns" sends a DNS query to UDP backends, "icmp" sends ICMP echo
+	// requests and "exec" runs Command.
+	Type string `json:"type"`
+	// Payload is sent to UDP backends; PayloadHex takes precedence and
+	// allows binary payloads.
+	Payload    string `json:"payload"`
+	PayloadHex string `json:"payload_hex"`
+	// Expect is the exact expected response; ExpectHex takes precedence and
+	// allows binary responses. ExpectRegex matches the response against a
+	// regular expression instead. If none is set, any response is accepted.
+	Expect      string `json:"expect"`
+	ExpectHex   string `json:"expect_hex"`
+	ExpectRegex string `json:"expect_regex"`
+	// DNSName is the name queried by "dns" probes, defaulting to the root.
+	DNSName string `json:"dns_name"`
+	// Command is run by "exec" probes with the backend URL as its last
+	// argument. A zero exit status marks the backend healthy.
+	Command []string `json:"command"`
+	// Timeout bounds each probe (default 2s).
+	Timeout string `json:"timeout"`
+	// DegradedLatency degrades backends whose probes pass but take longer.
+	DegradedLatency string `json:"degraded_latency"`
+}
+
+// DeepHealthCheckConfig configures a deep health check, run every Interval
+// (default 1m). On TCP listeners Type may be "tls" to complete a TLS
+// handshake, and a Payload is sent and its response validated as by UDP
+// health checks; on UDP listeners it takes the same settings as a regular
+// health check.
+type DeepHealthCheckConfig struct {
+	HealthCheckConfig
+	Interval string `json:"interval"`
+}
+
+// PanicRecoveryConfig configures panic recovery. A panic in the goroutine
+// handling a client connection or datagram closes that connection and is
+// logged with its stack trace; with ReportDir set, a crash report is also
+// written there. Disabled lets panics crash the process instead.
+type PanicRecoveryConfig struct {
+	Disabled  bool   `json:"disabled"`
+	ReportDir string `json:"report_dir"`
+}
+
+// LogSamplingConfig selects the connections, and UDP datagrams, whose
+// debug lines are logged at info level: one in Every (none if 0) and all
+// those from Clients (IP addresses or CIDR prefixes).
+type LogSamplingConfig struct {
+	Every   int      `json:"every"`
+	Clients []string `json:"clients"`
+}
+
+// CircuitBreakerConfig configures per-backend circuit breakers. After
+// FailureThreshold (default 5) consecutive connection failures a backend's
+// circuit opens and connections fail fast for OpenDuration (default 30s).
+// Then up to HalfOpenTrials (default 1) trial connections are let through;
+// a successful trial closes the circuit and a failed one reopens it.
+type CircuitBreakerConfig struct {
+	Enabled          bool   `json:"enabled"`
+	FailureThreshold int    `json:"failure_threshold"`
+	OpenDuration     string `json:"open_duration"`
+	HalfOpenTrials   int    `json:"half_open_trials"`
+}
+
+// BackendConnectionRateConfig allows each backend Rate new connections
+// (UDP flows or datagrams) per second on average, with bursts of up to
+// Burst (default Rate, rounded up). A backend beyond its rate is skipped
+// in favor of other available backends.
+type BackendConnectionRateConfig struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// TCPOptionsConfig configures TCP socket options. Keepalive settings apply to
+// both client and backend connections; unset values use the OS defaults.
+type TCPOptionsConfig struct {
+	// KeepAliveIdle is the idle time before the first keepalive probe. A
+	// negative value disables keepalives.
+	KeepAliveIdle     string `json:"keepalive_idle"`
+	KeepAliveInterval string `json:"keepalive_interval"`
+	KeepAliveCount    int    `json:"keepalive_count"`
+	// NoDelay sets TCP_NODELAY on client and backend connections (default
+	// true).
+	NoDelay *bool `json:"no_delay"`
+	// FastOpenQueue enables TCP Fast Open on the listener with the given
+	// pending queue length. Linux only.
+	FastOpenQueue int `json:"fast_open_queue"`
+	// Backlog sets the length of the listener's queue of connections not
+	// yet accepted, capped by the kernel (net.core.somaxconn on Linux).
+	// Unix only.
+	Backlog int `json:"backlog"`
+	// Linger sets SO_LINGER on client and backend connections: closing
+	// them blocks for up to Linger, in whole seconds, to send data still
+	// buffered, and "0s" resets them instead. Unset keeps the OS default.
+	Linger string `json:"linger"`
+	// CloseDelay delays closing a client connection after its backend
+	// closes: the end of stream is passed on to the client as a half-close
+	// and the client is given up to CloseDelay to read the rest of the
+	// response and close its side, so that no final data is lost to a
+	// reset.
+	CloseDelay string `json:"close_delay"`
+}
+
+// FirstByteRoutingConfig routes each connection by the first bytes the
+// client sends, read for up to Timeout (default 1s) and MaxBytes (default
+// 64), so that several protocols can share a port. Rules are tried in order
+// and the first matching one routes the connection to the backends whose
+// GroupLabel label (default "protocol") is its Group. Connections matching
+// no rule, including clients that send nothing in time, go to the Default
+// group, or are rejected if it is empty.
+type FirstByteRoutingConfig struct {
+	Enabled    bool                  `json:"enabled"`
+	Timeout    string                `json:"timeout"`
+	MaxBytes   int                   `json:"max_bytes"`
+	GroupLabel string                `json:"group_label"`
+	Rules      []FirstByteRuleConfig `json:"rules"`
+	Default    string                `json:"default"`
+}
+
+// StickyFailoverConfig controls where sticky clients, and clients with an
+// affinity key, go once the backend they hash to has failed. By default
+// they return to it as soon as it is available again. With ReturnToPrimary
+// false they stay on the backend they failed over to, for stateful
+// applications whose sessions cannot move back, until they have not
+// connected for Timeout (default 30m).
+type StickyFailoverConfig struct {
+	ReturnToPrimary *bool  `json:"return_to_primary"`
+	Timeout         string `json:"timeout"`
+}
+
+// AffinityConfig sends clients sharing an application identity to the same
+// backend, whatever their address. Extractor parses a key from the first
+// bytes a client sends, read for up to Timeout (default 1s) and MaxBytes
+// (default 1024), and the key is hashed to a backend as sticky sessions hash
+// the client address: "resp" takes the key of a Redis command, "kafka" the
+// client id of a Kafka request, "header" the value of the Header header line
+// and "regexp" the first submatch of Regexp. Connections without a key are
+// balanced as usual. A UDP listener parses the key from each datagram.
+type AffinityConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Extractor string `json:"extractor"`
+	Header    string `json:"header"`
+	Regexp    string `json:"regexp"`
+	Timeout   string `json:"timeout"`
+	MaxBytes  int    `json:"max_bytes"`
+}
+
+// FirstByteRuleConfig matches the first bytes of a connection by exactly
+// one of a literal Prefix, a hex encoded PrefixHex (e.g. "16 03" for TLS)
+// or a Regexp.
+type FirstByteRuleConfig struct {
+	Group     string `json:"group"`
+	Prefix    string `json:"prefix"`
+	PrefixHex string `json:"prefix_hex"`
+	Regexp    string `json:"regexp"`
+}
+
+// ProtocolValidationConfig validates the first bytes of each connection
+// before a backend is dialed, waiting up to Timeout (default 1s). Expect is
+// "tls", a TLS handshake record holding a ClientHello of at most
+// MaxFirstMessage bytes (default 16384); "line", a first line of printable
+// ASCII of at most MaxFirstMessage bytes (default 4096); or "http", a first
+// line that is an HTTP request line. Clients that send nothing in time are
+// rejected unless AllowSilent is set.
+type ProtocolValidationConfig struct {
+	Expect          string `json:"expect"`
+	MaxFirstMessage int    `json:"max_first_message"`
+	Timeout         string `json:"timeout"`
+	AllowSilent     bool   `json:"allow_silent"`
+}
+
+// DeferDialConfig defers choosing and dialing a backend until the client
+// sends its first bytes, so idle connections never reach a backend. Clients
+// that send nothing within Timeout (default 10s) are closed. It must not be
+// used with protocols where the server speaks first, such as SMTP.
+type DeferDialConfig struct {
+	Enabled bool   `json:"enabled"`
+	Timeout string `json:"timeout"`
+}
+
+// SniffConfig configures protocol sniffing on a TCP listener. The first bytes
+// of each connection are peeked, waiting up to Timeout (default 1s), to tell
+// TLS, HTTP and raw TCP apart; clients that send nothing in time are raw TCP.
+type SniffConfig struct {
+	Enabled bool   `json:"enabled"`
+	Timeout string `json:"timeout"`
+	// TLS is "passthrough" (default), "terminate" using the listener's
+	// certificate, or "reject".
+	TLS string `json:"tls"`
+	// HTTP is "route" (default) to route requests by Host to backends whose
+	// HostLabel label (default "host") matches, "passthrough" or "reject".
+	// Terminated TLS connections are routed by SNI the same way.
+	HTTP      string `json:"http"`
+	HostLabel string `json:"host_label"`
+	// TCP is "passthrough" (default) or "reject".
+	TCP string `json:"tcp"`
+}
+
+// Socks5Config configures SOCKS5 ingress. Clients must support
+// unauthenticated SOCKS5 and complete the handshake within HandshakeTimeout
+// (default 10s). Each CONNECT is forwarded to a backend egress node chosen
+// by the pool's algorithm; egress nodes must also accept unauthenticated
+// SOCKS5.
+type Socks5Config struct {
+	Enabled          bool   `json:"enabled"`
+	HandshakeTimeout string `json:"handshake_timeout"`
+}
+
+// DNSCacheConfig tunes the cache of backend hostname resolutions shared by
+// health checks and the data path. Answers are cached for their DNS TTL,
+// clamped to [MinTTL, MaxTTL] (default 1s and 5m), and failed lookups for
+// NegativeTTL (default 5s). Disabled resolves on every connection.
+type DNSCacheConfig struct {
+	Disabled    bool   `json:"disabled"`
+	MinTTL      string `json:"min_ttl"`
+	MaxTTL      string `json:"max_ttl"`
+	NegativeTTL string `json:"negative_ttl"`
+}
+
+// AddressHooksConfig configures the commands run for each address of a
+// listener: Up before the address is bound, for example to add a VIP to an
+// interface and send gratuitous ARP, and Down after it is released. Each is
+// a command and its arguments, bounded by Timeout (default 10s).
+type AddressHooksConfig struct {
+	Up      []string `json:"up"`
+	Down    []string `json:"down"`
+	Timeout string   `json:"timeout"`
+}
+
+// AcceptQueueConfig configures the accept queue. Up to Depth connections
+// (default 128) wait up to Timeout (default 5s) for a backend below its
+// connection limit and are released in arrival order.
+type AcceptQueueConfig struct {
+	Enabled bool   `json:"enabled"`
+	Depth   int    `json:"depth"`
+	Timeout string `json:"timeout"`
+}
+
+// FDLimitConfig sheds new connections, closing them as they are accepted,
+// while the file descriptors open in the process are above Watermark
+// (default 0.9) of its soft limit (ulimit -n). A UDP listener drops
+// datagrams that would open a new exchange instead.
+type FDLimitConfig struct {
+	Enabled   bool    `json:"enabled"`
+	Watermark float64 `json:"watermark"`
+}
+
+// PriorityClassesConfig maps clients to priority classes by address. Once
+// the share of the healthy backends' max_connections in use reaches a
+// class's ShedAt, new connections from its clients are shed. Clients in no
+// class are shed at DefaultShedAt (default 0.8); a class without ShedAt is
+// never shed before the backends are full.
+type PriorityClassesConfig struct {
+	Classes       []PriorityClassConfig `json:"classes"`
+	DefaultShedAt float64               `json:"default_shed_at"`
+}
+
+// PriorityClassConfig is a priority class. Clients are IP addresses or CIDR
+// prefixes; a client belongs to the first class that lists it.
+type PriorityClassConfig struct {
+	Name    string   `json:"name"`
+	Clients []string `json:"clients"`
+	ShedAt  float64  `json:"shed_at"`
+}
+
+// GeoIPConfig looks clients up in MaxMind databases: CountryDB is a GeoIP2
+// or GeoLite2 Country or City database and ASNDB an ASN database, in the
+// .mmdb format. Connection log lines are tagged with the client's country
+// and AS number. Rules are tried in order and the first matching one routes
+// the client to the backends whose GroupLabel label (default "region") is
+// its Group; clients matching no rule, or whose group has no available
+// backend, are balanced across all backends.
+type GeoIPConfig struct {
+	Enabled    bool              `json:"enabled"`
+	CountryDB  string            `json:"country_db"`
+	ASNDB      string            `json:"asn_db"`
+	GroupLabel string            `json:"group_label"`
+	Rules      []GeoIPRuleConfig `json:"rules"`
+}
+
+// GeoIPRuleConfig matches clients by ISO country code (e.g. "DE") or
+// continent code (e.g. "EU").
+type GeoIPRuleConfig struct {
+	Countries  []string `json:"countries"`
+	Continents []string `json:"continents"`
+	Group      string   `json:"group"`
+}
+
+// SourceFilterConfig rejects connections, and drops datagrams, as they
+// arrive. With Bogons, sources in reserved, private and unallocated ranges
+// are rejected, which suits listeners exposed to the internet. Deny (IP
+// addresses or CIDR prefixes) rejects flagged clients, and DenyASNs clients
+// in the listed autonomous systems, looked up in the geoip asn_db. Clients
+// in Allow are exempt. Action is "reject" (the default) to close rejected
+// TCP connections right away or "tarpit" to hold them as set by Tarpit.
+type SourceFilterConfig struct {
+	Bogons   bool          `json:"bogons"`
+	Deny     []string      `json:"deny"`
+	DenyASNs []uint64      `json:"deny_asns"`
+	Allow    []string      `json:"allow"`
+	Action   string        `json:"action"`
+	Tarpit   *TarpitConfig `json:"tarpit"`
+}
+
+// TarpitConfig configures the tarpit of a source filter. Rejected TCP
+// connections are held for Hold (default 30s) plus up to half of it, then
+// reset. At most MaxConnections (default 1024) are held at once; others are
+// closed right away.
+type TarpitConfig struct {
+	Hold           string `json:"hold"`
+	MaxConnections int    `json:"max_connections"`
+}
+
+// PinBackendConfig configures backend pinning for testing. A client whose
+// address is in AllowedClients (IP addresses or CIDR prefixes) may start a
+// TCP connection or UDP flow with the line "X-NLB-Backend: <backend>\n",
+// naming a backend by ID, URL or host:port, to send it to that backend
+// whatever its health. The line is not forwarded. TCP clients that send
+// nothing within Timeout (default 500ms) are balanced as usual.
+type PinBackendConfig struct {
+	Enabled        bool     `json:"enabled"`
+	AllowedClients []string `json:"allowed_clients"`
+	Timeout        string   `json:"timeout"`
+}
+
+// ShutdownConfig sets the timeout of each shutdown phase. On shutdown all
+// listeners stop accepting, then autoscaling exporters are stopped
+// (Exporters, default 2s), in-flight connections drain (Drain, default 5s),
+// health checks stop (HealthChecks, default 2s) and finally the console
+// shuts down (Console, default 5s). While connections drain, the
+// connections left on each backend are logged every ReportInterval
+// (default 5s).
+type ShutdownConfig struct {
+	Drain        string `json:"drain"`
+	Exporters    string `json:"exporters"`
+	HealthChecks string `json:"health_checks"`
+	Console      string `json:"console"`
+
+	ReportInterval string `json:"report_interval"`
+}
+
+// UDPFlowConfig configures per-client UDP flows. Each client address is
+// pinned to one backend socket until the flow has been idle for IdleTimeout
+// (default 60s), so the backend may send any number of replies and NAT
+// mappings stay stable for long exchanges.
+type UDPFlowConfig struct {
+	Enabled     bool   `json:"enabled"`
+	IdleTimeout string `json:"idle_timeout"`
+	// ConnectedSockets gives each flow a client-facing socket bound to the
+	// listener address with SO_REUSEADDR (and SO_REUSEPORT on macOS) and
+	// connected to the client, so replies always leave from the address and
+	// port the client targeted. Supported on Linux and macOS.
+	ConnectedSockets bool `json:"connected_sockets"`
+}
+
+// UDPFloodConfig protects the backends of a UDP listener from floods. Each
+// source, grouped by its IPv4Prefix (default 32) or IPv6Prefix (default 64)
+// bits, may send SourceRate datagrams per second (default 100) with bursts
+// of SourceBurst (default SourceRate). If GlobalRate is set, the listener
+// forwards at most that many datagrams per second in total, with bursts of
+// GlobalBurst (default GlobalRate). At most MaxSources sources (default
+// 65536) are tracked; datagrams from new sources are dropped while the
+// table is full of sources that are still limited.
+type UDPFloodConfig struct {
+	Enabled     bool    `json:"enabled"`
+	SourceRate  float64 `json:"source_rate"`
+	SourceBurst int     `json:"source_burst"`
+	GlobalRate  float64 `json:"global_rate"`
+	GlobalBurst int     `json:"global_burst"`
+	MaxSources  int     `json:"max_sources"`
+	IPv4Prefix  int     `json:"ipv4_prefix"`
+	IPv6Prefix  int     `json:"ipv6_prefix"`
+}
+
+// SLOConfig tracks the success rate of each backend's requests (TCP dials
+// and UDP exchanges) against Objective, a percentage (default 99.9), over
+// Windows (default 5m and 1h; whole minutes up to 24h). If MaxBurnRate is
+// set, a backend spending its error budget faster than that over the
+// shortest window, with at least MinRequests (default 10) in it, is taken
+// out of rotation until its burn rate drops.
+type SLOConfig struct {
+	Enabled     bool     `json:"enabled"`
+	Objective   float64  `json:"objective"`
+	Windows     []string `json:"windows"`
+	MaxBurnRate float64  `json:"max_burn_rate"`
+	MinRequests int      `json:"min_requests"`
+}
+
+// LongConnectionsConfig sets how drains treat long-lived connections such as
+// MQTT sessions or websockets. A backend drained through the admin API is
+// no longer selected, its connections are given Grace (default 5m) to finish
+// and the rest are then closed. Shutdown likewise waits up to Grace instead
+// of the shutdown drain timeout. Connections open longer than Threshold
+// (default 1m) are reported as long-lived.
+type LongConnectionsConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Threshold string `json:"threshold"`
+	Grace     string `json:"grace"`
+}
+
+// UDPFanOutConfig duplicates each datagram to every healthy backend, e.g. to
+// mirror statsd metrics or query redundant DNS resolvers. Reply is "none"
+// (the default), discarding backend replies, or "first", returning the first
+// reply received within Timeout (default 2s) to the client.
+type UDPFanOutConfig struct {
+	Enabled bool   `json:"enabled"`
+	Reply   string `json:"reply"`
+	Timeout string `json:"timeout"`
+}
+
+// UDPResponseConfig configures how a UDP listener waits for the backend's
+// reply to a datagram it forwards outside a flow. A backend not replying
+// within Timeout (default 5s) counts as a failure. With FireAndForget, for
+// protocols such as syslog where no reply is expected, datagrams are sent
+// without waiting for one.
+type UDPResponseConfig struct {
+	Timeout       string `json:"timeout"`
+	FireAndForget bool   `json:"fire_and_forget"`
+}
+
+// UDPSinkConfig enables the sink mode of a UDP listener for unidirectional
+// workloads such as metrics, logs or NetFlow. Datagrams are written to a
+// socket kept open to each backend straight from the listener's read loop,
+// and backend replies are never read. It cannot be combined with UDP flows
+// or fan-out.
+type UDPSinkConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+// FaultInjectionConfig configures artificial failures for resilience testing.
+// It should never be enabled in production. Percentages range from 0 to 100.
+type FaultInjectionConfig struct {
+	Enabled bool `json:"enabled"`
+	// ConnectDelay is added before dialing a backend for ConnectDelayPercent
+	// of connections (all connections if unset).
+	ConnectDelay        string  `json:"connect_delay"`
+	ConnectDelayPercent float64 `json:"connect_delay_percent"`
+	// ResetPercent of TCP client connections are reset after being accepted.
+	ResetPercent float64 `json:"reset_percent"`
+	// DropPercent of UDP datagrams are dropped. BackendDropPercent overrides
+	// it for individual backends, keyed by backend URL or host:port.
+	DropPercent        float64            `json:"drop_percent"`
+	BackendDropPercent map[string]float64 `json:"backend_drop_percent"`
+}
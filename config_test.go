@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"strings"
 	"testing"
 )
@@ -26,11 +27,11 @@ func Test_loadConfig(t *testing.T) {
 	if len(cfg.Backends) != 2 {
 		t.Errorf("expected 2 backends, got %d", len(cfg.Backends))
 	}
-	if cfg.Backends[0] != "http://127.0.0.1:8000" {
-		t.Errorf("expected first backend to be 'http://127.0.0.1:8000', got %s", cfg.Backends[0])
+	if cfg.Backends[0].URL != "http://127.0.0.1:8000" {
+		t.Errorf("expected first backend to be 'http://127.0.0.1:8000', got %s", cfg.Backends[0].URL)
 	}
-	if cfg.Backends[1] != "http://127.0.0.1:8001" {
-		t.Errorf("expected second backend to be 'http://127.0.0.1:8001', got %s", cfg.Backends[1])
+	if cfg.Backends[1].URL != "http://127.0.0.1:8001" {
+		t.Errorf("expected second backend to be 'http://127.0.0.1:8001', got %s", cfg.Backends[1].URL)
 	}
 	if !cfg.StickySessions {
 		t.Errorf("expected StickySessions to be true, got %v", cfg.StickySessions)
@@ -65,3 +66,126 @@ func Test_loadConfig_invalidJSON(t *testing.T) {
 		t.Errorf("expected JSON decode error, got %v", err)
 	}
 }
+
+func Test_loadConfig_strictRejectsUnknownFields(t *testing.T) {
+	_, err := loadConfig("testdata/strict.json")
+	if err == nil || !strings.Contains(err.Error(), `unknown field "sticky_sesions"`) {
+		t.Errorf("expected unknown field error, got %v", err)
+	}
+}
+
+func Test_loadConfig_unsupportedVersion(t *testing.T) {
+	_, err := loadConfig("testdata/future.json")
+	if err == nil || !strings.Contains(err.Error(), "unsupported config version 99") {
+		t.Errorf("expected unsupported version error, got %v", err)
+	}
+}
+
+func Test_loadConfig_defaultsVersion(t *testing.T) {
+	cfg, err := loadConfig("testdata/config.json")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cfg.Version != currentConfigVersion {
+		t.Errorf("expected version %d, got %d", currentConfigVersion, cfg.Version)
+	}
+}
+
+func Test_migrateConfig(t *testing.T) {
+	migrations := map[int]configMigration{
+		1: func(raw map[string]any) error {
+			raw["health_check_interval"] = raw["healthcheck_interval"]
+			delete(raw, "healthcheck_interval")
+			return nil
+		},
+		2: func(raw map[string]any) error {
+			raw["migrated"] = true
+			return nil
+		},
+	}
+
+	raw := map[string]any{"healthcheck_interval": "5s"}
+	if err := migrateConfig(raw, 1, 3, migrations); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if raw["health_check_interval"] != "5s" || raw["migrated"] != true || raw["version"] != 3 {
+		t.Errorf("expected all migrations to be applied in order, got %v", raw)
+	}
+
+	if err := migrateConfig(map[string]any{}, 1, 4, migrations); err == nil {
+		t.Errorf("expected error for missing migration")
+	}
+}
+
+func Test_loadConfig_backendObjects(t *testing.T) {
+	cfg, err := loadConfig("testdata/labels.json")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(cfg.Backends) != 2 {
+		t.Fatalf("expected 2 backends, got %d", len(cfg.Backends))
+	}
+	if cfg.Backends[0].URL != "http://127.0.0.1:8000" || cfg.Backends[0].Labels != nil {
+		t.Errorf("expected plain backend, got %+v", cfg.Backends[0])
+	}
+	if cfg.Backends[1].URL != "http://127.0.0.1:8001" || cfg.Backends[1].Labels["zone"] != "us-east-1a" {
+		t.Errorf("expected labelled backend, got %+v", cfg.Backends[1])
+	}
+}
+
+func Test_loadConfig_listeners(t *testing.T) {
+	cfg, err := loadConfig("testdata/listeners.json")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	listeners := cfg.listenerConfigs()
+	if len(listeners) != 2 {
+		t.Fatalf("expected 2 listeners, got %d", len(listeners))
+	}
+	web, dns := listeners[0], listeners[1]
+	if web.Name != "web" || web.Addr != ":9090" || web.Protocol != "tcp" || web.Algorithm != "least-connections" {
+		t.Errorf("expected web listener to inherit top-level settings, got %+v", web)
+	}
+	if len(web.Backends) != 1 || web.Backends[0].URL != "http://127.0.0.1:8001" {
+		t.Errorf("expected web listener to inherit backends, got %+v", web.Backends)
+	}
+	if dns.Protocol != "udp" || dns.HealthcheckInterval != "5s" || dns.Backends[0].URL != "udp://127.0.0.1:53" {
+		t.Errorf("expected dns listener to override protocol and backends, got %+v", dns)
+	}
+	if web.ConsoleAddr != "" {
+		t.Errorf("expected console_addr not to be inherited, got %q", web.ConsoleAddr)
+	}
+}
+
+func Test_loadConfig_singleListener(t *testing.T) {
+	cfg, err := loadConfig("testdata/config.json")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if listeners := cfg.listenerConfigs(); len(listeners) != 1 || listeners[0] != cfg {
+		t.Errorf("expected the config to describe a single listener, got %v", listeners)
+	}
+}
+
+func Test_resolveListeners_invalid(t *testing.T) {
+	for _, tc := range []struct {
+		listeners string
+		want      string
+	}{
+		{`[{"addr": ":1"}]`, `invalid name ""`},
+		{`[{"name": "a b"}]`, `invalid name "a b"`},
+		{`[{"name": "a"}, {"name": "a"}]`, `duplicate listener name "a"`},
+		{`[{"name": "a", "listeners": [{"name": "b"}]}]`, "cannot be nested"},
+	} {
+		var raw map[string]any
+		if err := json.Unmarshal([]byte(`{"listeners": `+tc.listeners+`}`), &raw); err != nil {
+			t.Fatalf("invalid test input: %v", err)
+		}
+		cfg := &Config{Listeners: make([]*Config, len(raw["listeners"].([]any)))}
+		err := resolveListeners(cfg, raw)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("expected error containing %q for %s, got %v", tc.want, tc.listeners, err)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons an in-flight connection is cancelled, reported as the cause of
+// its context.
+var (
+	errConnectionClosed  = errors.New("closed through the admin API")
+	errConnectionTimeout = errors.New("connection_timeout exceeded")
+	errDrainTimeout      = errors.New("drain timeout exceeded")
+)
+
+// parseConnectionTimeout parses a connection_timeout setting, returning zero
+// if unset.
+func parseConnectionTimeout(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid connection_timeout: %w", err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("connection_timeout must be positive")
+	}
+	return d, nil
+}
+
+// connIDPrefix makes connection IDs unique across restarts.
+var connIDPrefix = func() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}()
+
+// connSeq numbers the connections accepted by all listeners.
+var connSeq atomic.Uint64
+
+// newConnID returns an ID that is unique to a connection, or to the
+// exchange of a UDP datagram, across listeners and restarts.
+func newConnID() string {
+	return connIDPrefix + "-" + strconv.FormatUint(connSeq.Add(1), 10)
+}
+
+// connLogger returns a logger that tags each line with the connection ID.
+func connLogger(l *log.Logger, id string) *log.Logger {
+	return log.New(l.Writer(), l.Prefix()+"[conn "+id+"] ", l.Flags())
+}
+
+// trackedConn is an in-flight client connection or UDP flow.
+type trackedConn struct {
+	id      string
+	client  net.Addr
+	start   time.Time
+	backend atomic.Pointer[Backend]
+	cancel  context.CancelCauseFunc
+}
+
+type trackedConnKey struct{}
+
+// connID returns the ID of a tracked connection, or "" if ctx does not
+// belong to one.
+func connID(ctx context.Context) string {
+	if c, ok := ctx.Value(trackedConnKey{}).(*trackedConn); ok {
+		return c.id
+	}
+	return ""
+}
+
+// cancelConn closes a tracked connection with cause.
+func cancelConn(ctx context.Context, cause error) {
+	if c, ok := ctx.Value(trackedConnKey{}).(*trackedConn); ok {
+		c.cancel(cause)
+	}
+}
+
+// setConnBackend records the backend a tracked connection was routed to.
+func setConnBackend(ctx context.Context, b *Backend) {
+	if c, ok := ctx.Value(trackedConnKey{}).(*trackedConn); ok {
+		c.backend.Store(b)
+	}
+}
+
+// connTracker tracks the in-flight connections of a pool. Each connection
+// gets a context that is cancelled when it is closed through the admin API,
+// when it exceeds the connection timeout or when the pool gives up draining.
+// The zero value is ready to use.
+type connTracker struct {
+	mux    sync.Mutex
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	conns  map[string]*trackedConn
+}
+
+// init must be called with t.mux held.
+func (t *connTracker) init() {
+	if t.ctx == nil {
+		t.ctx, t.cancel = context.WithCancelCause(context.Background())
+		t.conns = make(map[string]*trackedConn)
+	}
+}
+
+// context returns the context all connections derive from. It is
+// cancelled by cancelAll.
+func (t *connTracker) context() context.Context {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.init()
+	return t.ctx
+}
+
+// track registers the connection with the given ID from client and returns
+// its context, which is cancelled after timeout if it is positive. The
+// returned function must be called once the connection is closed.
+func (t *connTracker) track(id string, client net.Addr, timeout time.Duration) (context.Context, func()) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.init()
+	c := &trackedConn{id: id, client: client, start: time.Now()}
+	ctx, cancel := context.WithCancelCause(t.ctx)
+	c.cancel = cancel
+	stopTimer := func() bool { return false }
+	if timeout > 0 {
+		stopTimer = time.AfterFunc(timeout, func() { cancel(errConnectionTimeout) }).Stop
+	}
+	t.conns[c.id] = c
+	return context.WithValue(ctx, trackedConnKey{}, c), func() {
+		stopTimer()
+		cancel(context.Canceled)
+		t.mux.Lock()
+		defer t.mux.Unlock()
+		delete(t.conns, c.id)
+	}
+}
+
+// close cancels the connection with the given ID. It reports whether the
+// connection was found.
+func (t *connTracker) close(id string, cause error) bool {
+	t.mux.Lock()
+	c, ok := t.conns[id]
+	t.mux.Unlock()
+	if ok {
+		c.cancel(cause)
+	}
+	return ok
+}
+
+// cancelAll cancels every in-flight connection, and any tracked after it,
+// with cause. It returns the number of connections cancelled.
+func (t *connTracker) cancelAll(cause error) int {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.init()
+	t.cancel(cause)
+	return len(t.conns)
+}
+
+// closeWhere cancels the in-flight connections for which match returns true
+// and returns how many were cancelled.
+func (t *connTracker) closeWhere(match func(*trackedConn) bool, cause error) int {
+	t.mux.Lock()
+	var matched []*trackedConn
+	for _, c := range t.conns {
+		if match(c) {
+			matched = append(matched, c)
+		}
+	}
+	t.mux.Unlock()
+	for _, c := range matched {
+		c.cancel(cause)
+	}
+	return len(matched)
+}
+
+// countWhere returns the number of in-flight connections for which match
+// returns true, and how many of them were opened before cutoff.
+func (t *connTracker) countWhere(match func(*trackedConn) bool, cutoff time.Time) (n, before int) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	for _, c := range t.conns {
+		if match(c) {
+			n++
+			if c.start.Before(cutoff) {
+				before++
+			}
+		}
+	}
+	return n, before
+}
+
+// Len returns the number of in-flight connections.
+func (t *connTracker) Len() int {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return len(t.conns)
+}
+
+// connectionView is the JSON representation of an in-flight connection in
+// the admin API.
+type connectionView struct {
+	ID       string    `json:"id"`
+	Client   string    `json:"client"`
+	Backend  string    `json:"backend,omitempty"`
+	Started  time.Time `json:"started"`
+	Duration string    `json:"duration"`
+}
+
+func (t *connTracker) views(now time.Time) []connectionView {
+	t.mux.Lock()
+	views := make([]connectionView, 0, len(t.conns))
+	for _, c := range t.conns {
+		v := connectionView{
+			ID:       c.id,
+			Client:   c.client.String(),
+			Started:  c.start,
+			Duration: now.Sub(c.start).Round(time.Second).String(),
+		}
+		if b := c.backend.Load(); b != nil {
+			v.Backend = b.URL.Host
+		}
+		views = append(views, v)
+	}
+	t.mux.Unlock()
+	slices.SortFunc(views, func(a, b connectionView) int {
+		return cmp.Or(a.Started.Compare(b.Started), cmp.Compare(a.ID, b.ID))
+	})
+	return views
+}
+
+// connectionsAPIHandler lists the pool's in-flight connections.
+func (p *BaseServerPool) connectionsAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, p.conns.views(time.Now()))
+}
+
+// closeConnectionAPIHandler closes an in-flight connection.
+func (p *BaseServerPool) closeConnectionAPIHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !p.conns.close(id, errConnectionClosed) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("connection %q not found", id))
+		return
+	}
+	infof(p.log, "closing connection %s through the admin API", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// drainOrCancel waits for wg like waitContext and, if ctx expires first,
+// cancels the connections still in flight. With a long-connection policy,
+// it reports how many of them are long-lived.
+func (p *BaseServerPool) drainOrCancel(ctx context.Context, wg *sync.WaitGroup) error {
+	deadline, _ := ctx.Deadline()
+	p.shutdownDrain.CompareAndSwap(nil, &drainState{started: time.Now(), deadline: deadline})
+	all := func(*trackedConn) bool { return true }
+	if p.longConns != nil {
+		if n, long := p.conns.countWhere(all, time.Now().Add(-p.longConns.threshold)); n > 0 {
+			infof(p.log, "waiting for %d connections (%d long-lived) to finish", n, long)
+		}
+	}
+	err := waitContext(ctx, wg)
+	if err != nil {
+		_, long := p.conns.countWhere(all, time.Now().Add(-p.longConns.Threshold()))
+		if n := p.conns.cancelAll(errDrainTimeout); n > 0 {
+			if p.longConns != nil {
+				infof(p.log, "closing %d connections (%d long-lived) still open after the drain timeout", n, long)
+			} else {
+				infof(p.log, "closing %d connections still open after the drain timeout", n)
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_parseConnectionTimeout(t *testing.T) {
+	if d, err := parseConnectionTimeout(""); d != 0 || err != nil {
+		t.Errorf("expected no timeout when unset, got %s, %v", d, err)
+	}
+	if d, err := parseConnectionTimeout("1m"); d != time.Minute || err != nil {
+		t.Errorf("expected 1m, got %s, %v", d, err)
+	}
+	for _, s := range []string{"soon", "0s", "-1s"} {
+		if _, err := parseConnectionTimeout(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
+
+func TestNewConnID(t *testing.T) {
+	a, b := newConnID(), newConnID()
+	if a == b || !strings.HasPrefix(a, connIDPrefix+"-") || len(connIDPrefix) != 8 {
+		t.Errorf("expected distinct IDs with the process prefix, got %q and %q", a, b)
+	}
+	var buf bytes.Buffer
+	connLogger(log.New(&buf, "nlb: ", 0), a).Printf("dial failed")
+	if want := "nlb: [conn " + a + "] dial failed\n"; buf.String() != want {
+		t.Errorf("expected %q, got %q", want, buf.String())
+	}
+}
+
+func TestConnTracker(t *testing.T) {
+	var tracker connTracker
+	client := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+
+	ctx, done := tracker.track(newConnID(), client, 0)
+	setConnBackend(ctx, &Backend{URL: &url.URL{Scheme: "tcp", Host: "10.0.1.1:80"}})
+	views := tracker.views(time.Now())
+	if len(views) != 1 || views[0].Client != "10.0.0.1:5000" || views[0].Backend != "10.0.1.1:80" {
+		t.Fatalf("expected tracked connection to the backend, got %+v", views)
+	}
+	if !tracker.close(views[0].ID, errConnectionClosed) {
+		t.Fatalf("expected connection to be found")
+	}
+	if !errors.Is(context.Cause(ctx), errConnectionClosed) {
+		t.Errorf("expected cause %v, got %v", errConnectionClosed, context.Cause(ctx))
+	}
+	done()
+	if tracker.Len() != 0 || tracker.close(views[0].ID, errConnectionClosed) {
+		t.Errorf("expected closed connection to be untracked")
+	}
+
+	ctx, done = tracker.track(newConnID(), client, 10*time.Millisecond)
+	defer done()
+	select {
+	case <-ctx.Done():
+		if !errors.Is(context.Cause(ctx), errConnectionTimeout) {
+			t.Errorf("expected cause %v, got %v", errConnectionTimeout, context.Cause(ctx))
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected connection to time out")
+	}
+
+	ctx, done = tracker.track(newConnID(), client, 0)
+	defer done()
+	if n := tracker.cancelAll(errDrainTimeout); n != 2 {
+		t.Errorf("expected 2 connections to be cancelled, got %d", n)
+	}
+	if !errors.Is(context.Cause(ctx), errDrainTimeout) {
+		t.Errorf("expected cause %v, got %v", errDrainTimeout, context.Cause(ctx))
+	}
+	if ctx, done := tracker.track(newConnID(), client, 0); ctx.Err() == nil {
+		t.Errorf("expected connections tracked after cancelAll to be cancelled")
+	} else {
+		done()
+	}
+}
+
+// dialEcho connects to the pool and reads the backend's greeting.
+func dialEcho(t *testing.T, pool *TCPServerPool) (net.Conn, *bufio.Reader, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", pool.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect to load balancer: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	greeting, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read greeting: %v", err)
+	}
+	return conn, r, greeting
+}
+
+func expectClosed(t *testing.T, r *bufio.Reader) {
+	t.Helper()
+	if _, err := r.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected connection to be closed, got %v", err)
+	}
+}
+
+func TestTCPServerPool_closeConnection(t *testing.T) {
+	var out syncBuffer
+	pool, err := NewTCPServerPool(log.New(&out, "", 0), &Config{
+		Addr:              "127.0.0.1:0",
+		Backends:          []BackendConfig{{URL: "tcp://" + startNamedBackend(t, "a")}},
+		ConnectionTimeout: "200ms",
+	})
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	pool.backends[0].SetHealthy(true)
+	pool.Start()
+	defer pool.Shutdown(t.Context())
+
+	mux := http.NewServeMux()
+	registerPoolRoutes(mux, "", pool)
+	_, r, _ := dialEcho(t, pool)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/connections", nil))
+	var views []connectionView
+	if err := json.NewDecoder(rec.Body).Decode(&views); err != nil {
+		t.Fatalf("failed to decode connections: %v", err)
+	}
+	if len(views) != 1 || views[0].Backend != pool.backends[0].URL.Host {
+		t.Fatalf("expected one connection to the backend, got %+v", views)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("DELETE", "/api/connections/"+views[0].ID, nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", rec.Code)
+	}
+	expectClosed(t, r)
+	// The access log line is tagged with the same ID as the API.
+	want := fmt.Sprintf("[conn %s] connection from", views[0].ID)
+	for start := time.Now(); !strings.Contains(out.String(), want) && time.Since(start) < time.Second; {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("expected log to contain %q, got %q", want, out.String())
+	}
+
+	for _, id := range []string{"unknown", connIDPrefix + "-0"} {
+		rec = httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("DELETE", "/api/connections/"+id, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("expected status 404 for connection %q, got %d", id, rec.Code)
+		}
+	}
+
+	// The connection timeout closes connections that stay open too long.
+	start := time.Now()
+	_, r, _ = dialEcho(t, pool)
+	expectClosed(t, r)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected connection to be closed after its timeout, took %s", elapsed)
+	}
+}
+
+func TestTCPServerPool_drainCancelsConnections(t *testing.T) {
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:     "127.0.0.1:0",
+		Backends: []BackendConfig{{URL: "tcp://" + startNamedBackend(t, "a")}},
+	})
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	pool.backends[0].SetHealthy(true)
+	pool.Start()
+
+	_, r, _ := dialEcho(t, pool)
+	pool.StopAccepting()
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	if err := pool.Drain(ctx); err == nil {
+		t.Errorf("expected drain to time out")
+	}
+	expectClosed(t, r)
+	if err := waitContext(t.Context(), &pool.wg); err != nil {
+		t.Errorf("expected connections to finish after being cancelled, got %v", err)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// namedPool is a server pool together with the name of its listener.
+type namedPool struct {
+	name string
+	pool ServerPool
+}
+
+// console serves the dashboard and admin API for every listener.
+type console struct {
+	tmpl *template.Template
+	// listeners adds and removes listeners at runtime. It is nil if the
+	// listeners are fixed.
+	listeners *listenerManager
+
+	mux    sync.RWMutex
+	pools  []namedPool
+	routes map[string]http.Handler
+}
+
+// newConsole creates a console serving pools. If listeners is not nil,
+// listeners can also be added and removed through the admin API.
+func newConsole(pools []namedPool, tmpl *template.Template, listeners *listenerManager) *console {
+	return &console{tmpl: tmpl, listeners: listeners, pools: pools, routes: make(map[string]http.Handler)}
+}
+
+// handler builds the console's HTTP handler. A single fixed pool is served at
+// the root. Otherwise an index page lists the listeners, each pool's
+// dashboard and APIs are served under /listeners/{name}/ and the probe
+// endpoints at the root aggregate all pools.
+func (c *console) handler(staticDir string) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/static/", http.StripPrefix("/static/", staticHandler(staticDir)))
+	mux.HandleFunc("GET /api/info", infoAPIHandler)
+	mux.HandleFunc("GET /api/log-level", logLevelAPIHandler)
+	mux.HandleFunc("PUT /api/log-level", setLogLevelAPIHandler)
+	if pools := c.snapshot(); len(pools) == 1 && c.listeners == nil {
+		registerPoolRoutes(mux, "", pools[0].pool)
+		return mux
+	}
+
+	c.mux.Lock()
+	for _, np := range c.pools {
+		c.routes[np.name] = poolRoutes(np)
+	}
+	c.mux.Unlock()
+
+	mux.HandleFunc("/{$}", c.indexHandler)
+	mux.HandleFunc("/ready", c.readyHandler)
+	mux.HandleFunc("/healthz", c.healthzHandler)
+	mux.HandleFunc("/readyz", c.readyzHandler)
+	mux.HandleFunc("GET /api/listeners", c.listenersAPIHandler)
+	mux.HandleFunc("GET /api/sd/targets", c.sdTargetsAPIHandler)
+	if c.listeners != nil {
+		mux.HandleFunc("POST /api/listeners", localOnly(c.addListenerAPIHandler))
+		mux.HandleFunc("DELETE /api/listeners/{name}", localOnly(c.removeListenerAPIHandler))
+	}
+	mux.HandleFunc(listenerPath("{name}")+"/", c.listenerHandler)
+	return mux
+}
+
+// localOnly restricts h to clients on the loopback interface. The console
+// has no authentication, and adding a listener changes the config file.
+func localOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			writeError(w, http.StatusForbidden, errors.New("only allowed from localhost"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+func listenerPath(name string) string {
+	return "/listeners/" + name
+}
+
+// register adds a pool to the console, serving its routes under its
+// listener path.
+func (c *console) register(np namedPool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.pools = append(c.pools, np)
+	c.routes[np.name] = poolRoutes(np)
+}
+
+// poolRoutes returns a handler for a pool's routes under its listener path.
+func poolRoutes(np namedPool) http.Handler {
+	routes := http.NewServeMux()
+	registerPoolRoutes(routes, listenerPath(np.name), np.pool)
+	return routes
+}
+
+// unregister removes a pool from the console and returns it.
+func (c *console) unregister(name string) (namedPool, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	i := slices.IndexFunc(c.pools, func(np namedPool) bool { return np.name == name })
+	if i < 0 {
+		return namedPool{}, false
+	}
+	np := c.pools[i]
+	c.pools = slices.Delete(c.pools, i, i+1)
+	delete(c.routes, name)
+	return np, true
+}
+
+// snapshot returns the pools currently served.
+func (c *console) snapshot() []namedPool {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return slices.Clone(c.pools)
+}
+
+func (c *console) exists(name string) bool {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	_, ok := c.routes[name]
+	return ok
+}
+
+// listenerHandler dispatches a request to the routes of the listener named
+// in its path.
+func (c *console) listenerHandler(w http.ResponseWriter, r *http.Request) {
+	c.mux.RLock()
+	routes, ok := c.routes[r.PathValue("name")]
+	c.mux.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	routes.ServeHTTP(w, r)
+}
+
+// addListenerAPIHandler starts a listener described by the request body,
+// which takes the same form as an entry of the config's listeners.
+func (c *console) addListenerAPIHandler(w http.ResponseWriter, r *http.Request) {
+	var listener map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&listener); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	np, err := c.listeners.add(listener, c.exists)
+	if errors.Is(err, errDuplicateListener) {
+		writeError(w, http.StatusConflict, err)
+		return
+	} else if errors.Is(err, errConfigStore) {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	c.register(np)
+
+	infof(c.listeners.logger(np.name), "added listener %s", np.name)
+	writeJSON(w, http.StatusCreated, c.summary(np, time.Now()))
+}
+
+// removeListenerAPIHandler stops a listener and removes it from the config.
+func (c *console) removeListenerAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if err := c.listeners.checkRemovable(r.PathValue("name")); errors.Is(err, errIncludedListener) {
+		writeError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	np, ok := c.unregister(r.PathValue("name"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("listener %q not found", r.PathValue("name")))
+		return
+	}
+	if err := c.listeners.remove(np); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	infof(c.listeners.logger(np.name), "removed listener %s", np.name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// registerPoolRoutes registers a pool's dashboard, probes and admin API
+// under prefix.
+func registerPoolRoutes(mux *http.ServeMux, prefix string, pool ServerPool) {
+	if prefix == "" {
+		mux.HandleFunc("/", pool.dashboardHandler)
+	} else {
+		mux.HandleFunc(prefix+"/{$}", pool.dashboardHandler)
+	}
+	mux.HandleFunc(prefix+"/metrics", negotiateMetrics(pool.metricsHandler))
+	mux.HandleFunc(prefix+"/ready", pool.readyHandler)
+	mux.HandleFunc(prefix+"/healthz", pool.healthzHandler)
+	mux.HandleFunc(prefix+"/readyz", pool.readyzHandler)
+	mux.HandleFunc("GET "+prefix+"/api/backends", pool.backendsAPIHandler)
+	mux.HandleFunc("POST "+prefix+"/api/backends", pool.addBackendAPIHandler)
+	mux.HandleFunc("GET "+prefix+"/api/backends/{backend}/health", pool.healthHistoryAPIHandler)
+	mux.HandleFunc("GET "+prefix+"/api/backends/{backend}/probes", pool.probesAPIHandler)
+	mux.HandleFunc("PUT "+prefix+"/api/backends/{backend}/health", pool.overrideHealthAPIHandler)
+	mux.HandleFunc("GET "+prefix+"/api/backends/{backend}/drain", pool.drainStatusAPIHandler)
+	mux.HandleFunc("POST "+prefix+"/api/backends/{backend}/drain", pool.drainBackendAPIHandler)
+	mux.HandleFunc("DELETE "+prefix+"/api/backends/{backend}/drain", pool.undrainBackendAPIHandler)
+	mux.HandleFunc("GET "+prefix+"/api/state", pool.stateAPIHandler)
+	mux.HandleFunc("GET "+prefix+"/api/stats", pool.statsAPIHandler)
+	mux.HandleFunc("POST "+prefix+"/api/stats/reset", pool.resetStatsAPIHandler)
+	mux.HandleFunc("GET "+prefix+"/api/slo", pool.sloAPIHandler)
+	mux.HandleFunc("GET "+prefix+"/api/sd/targets", pool.sdTargetsAPIHandler)
+	mux.HandleFunc("GET "+prefix+"/api/flood", pool.floodAPIHandler)
+	mux.HandleFunc("GET "+prefix+"/api/shutdown", pool.shutdownAPIHandler)
+	mux.HandleFunc("GET "+prefix+"/api/quarantine", pool.quarantineAPIHandler)
+	mux.HandleFunc("DELETE "+prefix+"/api/quarantine/{backend}", pool.forgetQuarantinedAPIHandler)
+	mux.HandleFunc("GET "+prefix+"/api/blue-green", pool.blueGreenAPIHandler)
+	mux.HandleFunc("POST "+prefix+"/api/blue-green/switch", pool.switchGroupAPIHandler)
+	mux.HandleFunc("GET "+prefix+"/api/connections", pool.connectionsAPIHandler)
+	mux.HandleFunc("DELETE "+prefix+"/api/connections/{id}", pool.closeConnectionAPIHandler)
+	mux.HandleFunc("GET "+prefix+"/api/policy", pool.policyAPIHandler)
+	mux.HandleFunc("PUT "+prefix+"/api/policy", pool.setPolicyAPIHandler)
+	mux.HandleFunc("GET "+prefix+"/api/capture", pool.captureAPIHandler)
+	mux.HandleFunc("POST "+prefix+"/api/capture", pool.startCaptureAPIHandler)
+	mux.HandleFunc("DELETE "+prefix+"/api/capture", pool.stopCaptureAPIHandler)
+}
+
+// listenerSummary describes one listener on the console index.
+type listenerSummary struct {
+	Name     string       `json:"name"`
+	Path     string       `json:"path"`
+	Protocol string       `json:"protocol"`
+	Address  string       `json:"address"`
+	TLS      bool         `json:"tls"`
+	Status   poolStatus   `json:"status"`
+	Stats    listenerView `json:"stats"`
+}
+
+func (c *console) summaries(now time.Time) []listenerSummary {
+	pools := c.snapshot()
+	summaries := make([]listenerSummary, 0, len(pools))
+	for _, np := range pools {
+		summaries = append(summaries, c.summary(np, now))
+	}
+	return summaries
+}
+
+func (c *console) summary(np namedPool, now time.Time) listenerSummary {
+	view := np.pool.dashboard(now)
+	return listenerSummary{
+		Name:     np.name,
+		Path:     listenerPath(np.name) + "/",
+		Protocol: view.Listener.Protocol,
+		Address:  view.Listener.Address,
+		TLS:      view.Listener.TLS,
+		Status:   np.pool.status(),
+		Stats:    view.Listener.listenerView,
+	}
+}
+
+// indexView is the data rendered by the console index template.
+type indexView struct {
+	Version   string
+	Listeners []listenerSummary
+}
+
+func (c *console) indexHandler(w http.ResponseWriter, _ *http.Request) {
+	view := indexView{Version: version, Listeners: c.summaries(time.Now())}
+	if err := c.tmpl.ExecuteTemplate(w, "index.html.tmpl", view); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+}
+
+// listenersAPIHandler lists the listeners and their status.
+func (c *console) listenersAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, c.summaries(time.Now()))
+}
+
+// readyHandler responds 200 once every pool is ready and 503 until then.
+func (c *console) readyHandler(w http.ResponseWriter, _ *http.Request) {
+	for _, np := range c.snapshot() {
+		if !np.pool.status().Ready {
+			http.Error(w, "not ready: listener "+np.name, http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Write([]byte("ready\n"))
+}
+
+// healthzHandler is a liveness probe that fails if any pool fails its own.
+func (c *console) healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	c.writeStatuses(w, poolStatus.alive)
+}
+
+// readyzHandler is a readiness probe that fails if any pool fails its own.
+func (c *console) readyzHandler(w http.ResponseWriter, _ *http.Request) {
+	c.writeStatuses(w, poolStatus.serving)
+}
+
+// writeStatuses writes the status of every pool keyed by listener name, with
+// a status code reflecting whether all of them pass check.
+func (c *console) writeStatuses(w http.ResponseWriter, check func(poolStatus) bool) {
+	pools := c.snapshot()
+	statuses := make(map[string]poolStatus, len(pools))
+	code := http.StatusOK
+	for _, np := range pools {
+		s := np.pool.status()
+		statuses[np.name] = s
+		if !check(s) {
+			code = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, code, statuses)
+}
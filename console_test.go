@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// consoleTestPool adapts a BaseServerPool to the ServerPool interface.
+type consoleTestPool struct {
+	*BaseServerPool
+}
+
+func (consoleTestPool) Start() error                   { return nil }
+func (consoleTestPool) Shutdown(context.Context) error { return nil }
+func (consoleTestPool) StopAccepting() error           { return nil }
+func (consoleTestPool) Drain(context.Context) error    { return nil }
+
+func newConsoleTestPool(name string, healthy bool) *BaseServerPool {
+	pool := &BaseServerPool{
+		name:     name,
+		protocol: "tcp",
+		addr:     ":9090",
+		ready:    make(chan struct{}),
+		log:      log.New(io.Discard, "", 0),
+	}
+	pool.AddBackend("http://localhost:8080")
+	pool.listening.Store(true)
+	pool.setHealthy(pool.backends[0], healthy)
+	return pool
+}
+
+func TestNewConsoleMux_singleListener(t *testing.T) {
+	pool := newConsoleTestPool("", true)
+	srv := httptest.NewServer(newConsole([]namedPool{{pool: consoleTestPool{pool}}}, tmpl, nil).handler(""))
+	defer srv.Close()
+
+	for _, path := range []string{"/", "/api/backends", "/api/state", "/readyz", "/static/style.css"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("failed to get %s: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200 for %s, got %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestNewConsoleMux_multipleListeners(t *testing.T) {
+	web := newConsoleTestPool("web", true)
+	dns := newConsoleTestPool("dns", false)
+	dns.AddBackend("http://localhost:8081")
+	srv := httptest.NewServer(newConsole([]namedPool{{"web", consoleTestPool{web}}, {"dns", consoleTestPool{dns}}}, tmpl, nil).handler(""))
+	defer srv.Close()
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("failed to get %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	code, body := get("/")
+	if code != http.StatusOK {
+		t.Errorf("expected status 200 for index, got %d", code)
+	}
+	for _, want := range []string{`<a href="/listeners/web/">web</a>`, `<a href="/listeners/dns/">dns</a>`, "0 / 2"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected index to contain %q, got %q", want, body)
+		}
+	}
+
+	code, body = get("/listeners/dns/")
+	if code != http.StatusOK || !strings.Contains(body, `<span class="label">dns</span>`) {
+		t.Errorf("expected dns dashboard, got %d %q", code, body)
+	}
+
+	code, body = get("/listeners/dns/api/backends")
+	var views []backendView
+	if err := json.Unmarshal([]byte(body), &views); err != nil || code != http.StatusOK {
+		t.Fatalf("expected backends list, got %d %q", code, body)
+	}
+	if len(views) != 2 {
+		t.Errorf("expected 2 dns backends, got %d", len(views))
+	}
+
+	code, body = get("/api/listeners")
+	var listeners []listenerSummary
+	if err := json.Unmarshal([]byte(body), &listeners); err != nil || code != http.StatusOK {
+		t.Fatalf("expected listeners list, got %d %q", code, body)
+	}
+	if len(listeners) != 2 || listeners[0].Name != "web" || !listeners[0].Status.Ready || listeners[1].Status.Ready {
+		t.Errorf("unexpected listeners %+v", listeners)
+	}
+
+	if code, _ := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected aggregate readyz to fail while dns is not ready, got %d", code)
+	}
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Errorf("expected aggregate healthz to pass, got %d", code)
+	}
+	if code, _ := get("/listeners/web/readyz"); code != http.StatusOK {
+		t.Errorf("expected web readyz to pass, got %d", code)
+	}
+	if code, _ := get("/api/backends"); code != http.StatusNotFound {
+		t.Errorf("expected un-namespaced API to be absent, got %d", code)
+	}
+
+	dns.setHealthy(dns.backends[0], true)
+	if code, _ := get("/ready"); code != http.StatusOK {
+		t.Errorf("expected aggregate ready once all listeners are ready, got %d", code)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	defaultCtlAddr          = "http://localhost:8080"
+	defaultCtlEventInterval = 2 * time.Second
+)
+
+const ctlUsage = `usage: nlb ctl [flags] <command> [args]
+
+commands:
+  backends                   list the backends and their health
+  stats                      show listener and backend statistics
+  drain <backend> [grace]    stop selecting a backend and drain its connections
+  enable <backend>           put a drained backend back into rotation
+  policy [algorithm]         show or switch the load balancing algorithm
+  events                     print backend health, circuit and drain changes
+
+flags:
+`
+
+// ctlClient talks to the admin API of a running nlb.
+type ctlClient struct {
+	// base is the console URL, including the listener path if the console
+	// serves several listeners.
+	base   string
+	client *http.Client
+}
+
+func newCtlClient(addr, listener string) *ctlClient {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	base := strings.TrimSuffix(addr, "/")
+	if listener != "" {
+		base += listenerPath(url.PathEscape(listener))
+	}
+	return &ctlClient{base: base, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// do sends a request with body encoded as JSON, if not nil, and decodes the
+// response into v, if not nil. API errors are returned with their message.
+func (c *ctlClient) do(ctx context.Context, method, path string, body, v any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, cmp.Or(apiErr.Error, "no details"))
+	}
+	if v == nil {
+		return nil
+	}
+	// A console serving a single pool answers unknown paths with the
+	// dashboard.
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		return fmt.Errorf("%s %s returned %q instead of JSON: check the console address and listener", method, path, ct)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid response from %s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+// runCtl runs an nlb ctl command, writing its output to out.
+func runCtl(ctx context.Context, out io.Writer, args []string) error {
+	flags := flag.NewFlagSet("nlb ctl", flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.Usage = func() {
+		fmt.Fprint(out, ctlUsage)
+		flags.PrintDefaults()
+	}
+	addr := flags.String("addr", cmp.Or(os.Getenv("NLB_CONSOLE"), defaultCtlAddr), "console address, defaults to $NLB_CONSOLE")
+	listener := flags.String("listener", "", "listener to manage when the console serves several")
+	interval := flags.Duration("interval", defaultCtlEventInterval, "how often events polls the backends")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	args = flags.Args()
+	if len(args) == 0 {
+		flags.Usage()
+		return fmt.Errorf("please provide a command")
+	}
+
+	c := newCtlClient(*addr, *listener)
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "backends":
+		return c.backends(ctx, out)
+	case "stats":
+		return c.stats(ctx, out)
+	case "drain":
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf("usage: nlb ctl drain <backend> [grace]")
+		}
+		var grace string
+		if len(args) == 2 {
+			grace = args[1]
+		}
+		return c.drain(ctx, out, args[0], grace)
+	case "enable":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: nlb ctl enable <backend>")
+		}
+		return c.enable(ctx, out, args[0])
+	case "policy":
+		if len(args) > 1 {
+			return fmt.Errorf("usage: nlb ctl policy [algorithm]")
+		}
+		var algorithm string
+		if len(args) == 1 {
+			algorithm = args[0]
+		}
+		return c.policy(ctx, out, algorithm)
+	case "events":
+		if *interval <= 0 {
+			return fmt.Errorf("interval must be positive")
+		}
+		return c.events(ctx, out, *interval)
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+// backendStatus summarizes why a backend is or is not receiving traffic.
+func backendStatus(v backendView) string {
+	status := "down"
+	if v.Healthy {
+		status = "up"
+	}
+	if v.Forced != "" {
+		status += " (forced)"
+	}
+	switch {
+	case v.Draining:
+		status += ", draining"
+	case v.Flapping:
+		status += ", flapping"
+	case v.Circuit != "" && v.Circuit != "closed":
+		status += ", circuit " + v.Circuit
+	}
+	return status
+}
+
+func (c *ctlClient) backends(ctx context.Context, out io.Writer) error {
+	var views []backendView
+	if err := c.do(ctx, http.MethodGet, "/api/backends", nil, &views); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tURL\tSTATUS\tACTIVE\tSENT\tRECEIVED\tERROR")
+	for _, v := range views {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\t%s\n", v.ID, v.URL, backendStatus(v), v.ActiveConnections, v.BytesSent, v.BytesReceived, v.Error)
+	}
+	return tw.Flush()
+}
+
+func (c *ctlClient) stats(ctx context.Context, out io.Writer) error {
+	var state stateView
+	if err := c.do(ctx, http.MethodGet, "/api/state", nil, &state); err != nil {
+		return err
+	}
+	l, s := state.Listener, state.Status
+	fmt.Fprintf(out, "algorithm: %s (sticky sessions: %t)\n", state.Config.Algorithm, state.Config.StickySessions)
+	fmt.Fprintf(out, "ready: %t, %d/%d backends healthy\n", s.Ready, s.HealthyBackends, s.TotalBackends)
+	fmt.Fprintf(out, "connections: %d active, %d accepted (%.1f/s), %d rejected (%.1f/s)\n\n", l.ActiveConnections, l.Accepted, l.AcceptRate, l.Rejected, l.RejectRate)
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "URL\tSTATUS\tACTIVE\tTOTAL\tDIAL P50\tDIAL P99\tSEND/S\tRECEIVE/S")
+	for _, b := range state.Backends {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\n", b.URL, backendStatus(b.backendView), b.ActiveConnections, b.TotalConnections,
+			formatLatency(secondsToDuration(b.DialLatencyP50)), formatLatency(secondsToDuration(b.DialLatencyP99)),
+			formatThroughput(b.SendRate), formatThroughput(b.ReceiveRate))
+	}
+	return tw.Flush()
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+func (c *ctlClient) drain(ctx context.Context, out io.Writer, backend, grace string) error {
+	var body map[string]string
+	if grace != "" {
+		body = map[string]string{"grace": grace}
+	}
+	var v drainView
+	if err := c.do(ctx, http.MethodPost, "/api/backends/"+url.PathEscape(backend)+"/drain", body, &v); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "draining %s: %d connections (%d long-lived) remaining\n", v.Backend, v.Connections, v.LongConnections)
+	return nil
+}
+
+func (c *ctlClient) enable(ctx context.Context, out io.Writer, backend string) error {
+	var v drainView
+	if err := c.do(ctx, http.MethodDelete, "/api/backends/"+url.PathEscape(backend)+"/drain", nil, &v); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s is back in rotation\n", v.Backend)
+	return nil
+}
+
+func (c *ctlClient) policy(ctx context.Context, out io.Writer, algorithm string) error {
+	var v policyView
+	var err error
+	if algorithm == "" {
+		err = c.do(ctx, http.MethodGet, "/api/policy", nil, &v)
+	} else {
+		err = c.do(ctx, http.MethodPut, "/api/policy", map[string]string{"algorithm": algorithm}, &v)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "algorithm: %s (sticky sessions: %t)\n", v.Algorithm, v.StickySessions)
+	return nil
+}
+
+// events polls the backends every interval and prints each change in their
+// status until ctx is cancelled.
+func (c *ctlClient) events(ctx context.Context, out io.Writer, interval time.Duration) error {
+	last := make(map[string]string)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for first := true; ; first = false {
+		var views []backendView
+		if err := c.do(ctx, http.MethodGet, "/api/backends", nil, &views); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		now := time.Now().Format(time.RFC3339)
+		seen := make(map[string]bool)
+		for _, v := range views {
+			seen[v.URL] = true
+			status := backendStatus(v)
+			prev, ok := last[v.URL]
+			switch {
+			case first:
+				fmt.Fprintf(out, "%s %s %s\n", now, v.URL, status)
+			case !ok:
+				fmt.Fprintf(out, "%s %s added: %s\n", now, v.URL, status)
+			case prev != status:
+				fmt.Fprintf(out, "%s %s %s -> %s\n", now, v.URL, prev, status)
+			}
+			last[v.URL] = status
+		}
+		for u := range last {
+			if !seen[u] {
+				fmt.Fprintf(out, "%s %s removed\n", now, u)
+				delete(last, u)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
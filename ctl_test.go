@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newCtlTestServer serves the console of two listeners, web and dns, and
+// returns the pool of web.
+func newCtlTestServer(t *testing.T) (*BaseServerPool, string) {
+	t.Helper()
+	pool := newConsoleTestPool("web", true)
+	pool.algorithm = AlgorithmRoundRobin
+	pools := []namedPool{{name: "web", pool: consoleTestPool{pool}}, {name: "dns", pool: consoleTestPool{newConsoleTestPool("dns", true)}}}
+	srv := httptest.NewServer(newConsole(pools, tmpl, nil).handler(""))
+	t.Cleanup(srv.Close)
+	return pool, srv.URL
+}
+
+func TestRunCtl(t *testing.T) {
+	pool, addr := newCtlTestServer(t)
+	ctl := func(args ...string) (string, error) {
+		var out syncBuffer
+		err := runCtl(t.Context(), &out, append([]string{"-addr", addr, "-listener", "web"}, args...))
+		return out.String(), err
+	}
+
+	out, err := ctl("backends")
+	if err != nil || !strings.Contains(out, "http://localhost:8080") || !strings.Contains(out, "up") {
+		t.Errorf("expected the backend to be listed as up, got %q, %v", out, err)
+	}
+
+	if out, err = ctl("drain", "localhost:8080", "1m"); err != nil || !strings.Contains(out, "draining http://localhost:8080") {
+		t.Errorf("expected the backend to be drained, got %q, %v", out, err)
+	}
+	if !pool.backends[0].Draining() {
+		t.Errorf("expected the backend to be draining")
+	}
+	if _, err = ctl("drain", "localhost:8080"); err == nil || !strings.Contains(err.Error(), "already draining") {
+		t.Errorf("expected the API error for a second drain, got %v", err)
+	}
+	if out, err = ctl("backends"); err != nil || !strings.Contains(out, "up, draining") {
+		t.Errorf("expected the backend to be listed as draining, got %q, %v", out, err)
+	}
+	if _, err = ctl("enable", "localhost:8080"); err != nil || pool.backends[0].Draining() {
+		t.Errorf("expected the backend to be back in rotation, got %v", err)
+	}
+
+	if out, err = ctl("policy", "least-connections"); err != nil || !strings.Contains(out, "algorithm: least-connections") {
+		t.Errorf("expected the algorithm to be switched, got %q, %v", out, err)
+	}
+	if algorithm, _ := pool.Policy(); algorithm != AlgorithmLeastConnections {
+		t.Errorf("expected least-connections, got %s", algorithm)
+	}
+
+	if out, err = ctl("stats"); err != nil || !strings.Contains(out, "1/1 backends healthy") {
+		t.Errorf("expected stats, got %q, %v", out, err)
+	}
+
+	for _, args := range [][]string{{}, {"restart"}, {"drain"}, {"enable", "a", "b"}, {"drain", "missing:1"}} {
+		if _, err := ctl(args...); err == nil {
+			t.Errorf("expected error for %v", args)
+		}
+	}
+}
+
+func TestRunCtl_singleListener(t *testing.T) {
+	srv := httptest.NewServer(newConsole([]namedPool{{pool: consoleTestPool{newConsoleTestPool("", true)}}}, tmpl, nil).handler(""))
+	defer srv.Close()
+
+	var out syncBuffer
+	if err := runCtl(t.Context(), &out, []string{"-addr", srv.URL, "backends"}); err != nil || !strings.Contains(out.String(), "http://localhost:8080") {
+		t.Errorf("expected the backend to be listed, got %q, %v", out.String(), err)
+	}
+	// The dashboard is served for paths under an unknown listener.
+	if err := runCtl(t.Context(), &out, []string{"-addr", srv.URL, "-listener", "web", "backends"}); err == nil || !strings.Contains(err.Error(), "instead of JSON") {
+		t.Errorf("expected error for a listener of a single pool console, got %v", err)
+	}
+}
+
+func TestCtlClient_events(t *testing.T) {
+	pool, addr := newCtlTestServer(t)
+	ctx, cancel := context.WithCancel(t.Context())
+	var out syncBuffer
+	done := make(chan error, 1)
+	go func() {
+		done <- newCtlClient(strings.TrimPrefix(addr, "http://"), "web").events(ctx, &out, 20*time.Millisecond)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	pool.setHealthy(pool.backends[0], false)
+	time.Sleep(100 * time.Millisecond)
+	pool.AddBackend("http://localhost:8081")
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, want := range []string{"http://localhost:8080 up\n", "http://localhost:8080 up -> down\n", "http://localhost:8081 added: down\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected output to contain %q, got %q", want, out.String())
+		}
+	}
+}
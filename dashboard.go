@@ -0,0 +1,232 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+//go:embed templates static
+var embeddedAssets embed.FS
+
+const dashboardTemplateName = "dashboard.html.tmpl"
+
+var tmpl = template.Must(loadDashboardTemplate(""))
+
+// loadDashboardTemplate parses the embedded dashboard templates and then any
+// *.tmpl files in dir, which replace embedded templates of the same name and
+// may define additional templates.
+func loadDashboardTemplate(dir string) (*template.Template, error) {
+	t := template.New(dashboardTemplateName).Funcs(template.FuncMap{
+		"now":        time.Now,
+		"latency":    formatLatency,
+		"throughput": formatThroughput,
+		"reuse":      formatReuse,
+		"sparkline":  formatSparkline,
+		"uptime":     formatUptime,
+		"strip":      formatUptimeStrip,
+	})
+	t, err := t.ParseFS(embeddedAssets, "templates/*.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		return t, nil
+	}
+
+	matches, err := fs.Glob(os.DirFS(dir), "*.tmpl")
+	if err != nil {
+		return nil, fmt.Errorf("invalid template_dir: %w", err)
+	}
+	if len(matches) == 0 {
+		return t, nil
+	}
+	if t, err = t.ParseFS(os.DirFS(dir), "*.tmpl"); err != nil {
+		return nil, fmt.Errorf("error parsing templates in %s: %w", dir, err)
+	}
+	return t, nil
+}
+
+// overlayFS serves files from the first file system that has them.
+type overlayFS []fs.FS
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	err := fs.ErrNotExist
+	for _, fsys := range o {
+		var f fs.File
+		if f, err = fsys.Open(name); err == nil || !errors.Is(err, fs.ErrNotExist) {
+			return f, err
+		}
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+}
+
+// staticHandler serves dashboard assets from dir, falling back to the
+// embedded defaults for files dir does not contain.
+func staticHandler(dir string) http.Handler {
+	embedded, _ := fs.Sub(embeddedAssets, "static")
+	fsys := overlayFS{embedded}
+	if dir != "" {
+		fsys = overlayFS{os.DirFS(dir), embedded}
+	}
+	return http.FileServer(http.FS(fsys))
+}
+
+// dashboardView is the data rendered by the dashboard template.
+type dashboardView struct {
+	Version   string
+	StartTime time.Time
+	Uptime    time.Duration
+	Listener  dashboardListener
+	Backends  []dashboardBackend
+	// Quarantined lists the backends removed from the pool after being
+	// down for too long.
+	Quarantined []quarantinedView
+	// UptimeHistory is set when backend uptime over the last day and week
+	// is shown.
+	UptimeHistory bool
+}
+
+// dashboardListener describes the pool's listener and its statistics.
+type dashboardListener struct {
+	// Name is set when the console serves several listeners.
+	Name     string
+	Protocol string
+	Address  string
+	TLS      bool
+	listenerView
+	// Recent counts connections over the last 1, 5 and 15 minutes.
+	Recent listenerRollingView
+}
+
+// dashboardBackend is a backend row with its share of all connections, used
+// for the distribution chart.
+type dashboardBackend struct {
+	*Backend
+	Connections uint64
+	Share       float64
+	// Flapping is set while the backend is held down, and Transitions is
+	// its recent health history.
+	Flapping    bool
+	Transitions []healthTransition
+	// SendRate and ReceiveRate are the backend's recent throughput in bytes
+	// per second.
+	SendRate    float64
+	ReceiveRate float64
+	// Sockets is the backend's socket reuse, shown for UDP listeners.
+	Sockets socketView
+	// Probes are the backend's recent health check probes.
+	Probes []probeSample
+	// Uptime24h and Uptime7d are the backend's uptime over the last day and
+	// week, and Strip24h and Strip7d the same periods in hourly and 6 hour
+	// slots.
+	Uptime24h uptimeSlot
+	Uptime7d  uptimeSlot
+	Strip24h  []uptimeSlot
+	Strip7d   []uptimeSlot
+}
+
+func (p *BaseServerPool) dashboard(now time.Time) dashboardView {
+	backends := p.Backends()
+
+	view := dashboardView{
+		Version:   version,
+		StartTime: p.startTime,
+		Listener: dashboardListener{
+			Name:         p.name,
+			Protocol:     p.protocol,
+			Address:      strings.Join(p.listenAddrs(), ", "),
+			TLS:          p.tls,
+			listenerView: p.stats.view(now),
+			Recent: listenerRollingView{
+				Accepted: p.stats.acceptedRecent.view(now),
+				Rejected: p.stats.rejectedRecent.view(now),
+			},
+		},
+		Quarantined:   p.quarantine.quarantined(),
+		UptimeHistory: p.uptime != nil,
+	}
+	if !p.startTime.IsZero() {
+		view.Uptime = now.Sub(p.startTime).Round(time.Second)
+	}
+
+	var total uint64
+	for _, b := range backends {
+		row := dashboardBackend{
+			Backend:     b,
+			Connections: b.TotalConnections(),
+			Transitions: b.history.transitions(),
+			SendRate:    b.SendRate(now),
+			ReceiveRate: b.ReceiveRate(now),
+			Sockets:     b.sockets.view(),
+			Probes:      b.probes.recent(),
+		}
+		_, row.Flapping = b.history.heldDown(now)
+		if p.uptime != nil {
+			url := b.URL.String()
+			row.Uptime24h = p.uptime.uptime(p.name, url, now, 24*time.Hour)
+			row.Uptime7d = p.uptime.uptime(p.name, url, now, 7*24*time.Hour)
+			row.Strip24h = p.uptime.strip(p.name, url, now, 24*time.Hour, 24)
+			row.Strip7d = p.uptime.strip(p.name, url, now, 7*24*time.Hour, 28)
+		}
+		total += row.Connections
+		view.Backends = append(view.Backends, row)
+	}
+	if total > 0 {
+		for i := range view.Backends {
+			view.Backends[i].Share = 100 * float64(view.Backends[i].Connections) / float64(total)
+		}
+	}
+	return view
+}
+
+func (p *BaseServerPool) dashboardHandler(w http.ResponseWriter, _ *http.Request) {
+	t := p.tmpl
+	if t == nil {
+		t = tmpl
+	}
+	if err := t.Execute(w, p.dashboard(time.Now())); err != nil {
+		warnf(p.log, "error executing template: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+}
+
+// formatLatency renders a latency for the dashboard.
+func formatLatency(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return d.Round(time.Microsecond).String()
+}
+
+// formatThroughput renders a throughput in bytes per second for the
+// dashboard.
+func formatThroughput(rate float64) string {
+	switch {
+	case rate == 0:
+		return "-"
+	case rate < 1<<10:
+		return fmt.Sprintf("%.0f B/s", rate)
+	case rate < 1<<20:
+		return fmt.Sprintf("%.1f KiB/s", rate/(1<<10))
+	case rate < 1<<30:
+		return fmt.Sprintf("%.1f MiB/s", rate/(1<<20))
+	default:
+		return fmt.Sprintf("%.1f GiB/s", rate/(1<<30))
+	}
+}
+
+// formatReuse renders a backend's socket reuse for the dashboard.
+func formatReuse(v socketView) string {
+	if v.Hits+v.Misses == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f%% (%.1f/socket), %d idle of %d", 100*v.ReuseRatio, v.RequestsPerSocket, v.Idle, v.Open)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadDashboardTemplate_override(t *testing.T) {
+	dir := t.TempDir()
+	custom := `{{ define "brand" }}ACME{{ end }}<h1>{{ template "brand" }}</h1>{{ .Listener.Protocol }} {{ .Version }}`
+	if err := os.WriteFile(filepath.Join(dir, dashboardTemplateName), []byte(custom), 0o644); err != nil {
+		t.Fatalf("failed to write template: %v", err)
+	}
+
+	tmpl, err := loadDashboardTemplate(dir)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	pool := &BaseServerPool{protocol: "tcp", tmpl: tmpl}
+
+	rec := httptest.NewRecorder()
+	pool.dashboardHandler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if body := rec.Body.String(); body != "<h1>ACME</h1>tcp "+version {
+		t.Errorf("expected custom template output, got %q", body)
+	}
+}
+
+func TestLoadDashboardTemplate_fallback(t *testing.T) {
+	tmpl, err := loadDashboardTemplate(t.TempDir())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if tmpl.Lookup(dashboardTemplateName) == nil {
+		t.Errorf("expected embedded dashboard template to be used")
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "broken.tmpl"), []byte("{{ .Missing"), 0o644)
+	if _, err := loadDashboardTemplate(dir); err == nil {
+		t.Errorf("expected error for invalid template")
+	}
+}
+
+func TestStaticHandler(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "style.css"), []byte("body { color: red; }"), 0o644)
+	os.WriteFile(filepath.Join(dir, "logo.svg"), []byte("<svg></svg>"), 0o644)
+
+	for _, tc := range []struct {
+		dir, path, want string
+		code            int
+	}{
+		{"", "/style.css", "linear-gradient", http.StatusOK},
+		{dir, "/style.css", "color: red", http.StatusOK},
+		{dir, "/logo.svg", "<svg>", http.StatusOK},
+		{"", "/logo.svg", "", http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		staticHandler(tc.dir).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		body, _ := io.ReadAll(rec.Body)
+		if rec.Code != tc.code {
+			t.Errorf("expected status %d for %s in %q, got %d", tc.code, tc.path, tc.dir, rec.Code)
+		}
+		if !strings.Contains(string(body), tc.want) {
+			t.Errorf("expected %s in %q to contain %q, got %q", tc.path, tc.dir, tc.want, body)
+		}
+	}
+}
+
+func Test_dashboard_listenerInfo(t *testing.T) {
+	start := time.Now().Add(-90 * time.Minute)
+	pool := &BaseServerPool{protocol: "tcp", addr: ":9090", tls: true, startTime: start}
+
+	view := pool.dashboard(start.Add(time.Hour + 500*time.Millisecond))
+	if view.Uptime != time.Hour+time.Second {
+		t.Errorf("expected uptime 1h0m1s, got %s", view.Uptime)
+	}
+	if view.Version != version || view.Listener.Protocol != "tcp" || view.Listener.Address != ":9090" || !view.Listener.TLS {
+		t.Errorf("unexpected view %+v", view)
+	}
+
+	rec := httptest.NewRecorder()
+	pool.dashboardHandler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if want := `<span class="label">tcp+tls :9090</span>`; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("expected html to contain %q, got %q", want, rec.Body.String())
+	}
+}
+
+func Test_dashboardHandler_charts(t *testing.T) {
+	u, err := newUptimeLog(&UptimeHistoryConfig{Path: filepath.Join(t.TempDir(), "uptime.jsonl")})
+	if err != nil {
+		t.Fatalf("failed to create uptime history: %v", err)
+	}
+	defer u.Close()
+	pool := &BaseServerPool{protocol: "tcp", uptime: u}
+	pool.AddBackend("http://localhost:8080")
+	b := pool.backends[0]
+	b.probes.record(probeSample{Time: time.Now(), Latency: 10 * time.Millisecond})
+	u.record(pool.name, b.URL.String(), uptimeUp, time.Now().Add(-time.Hour))
+
+	rec := httptest.NewRecorder()
+	pool.dashboardHandler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	for _, want := range []string{`<svg class="sparkline"`, `<svg class="uptime-strip"`} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("expected html to contain %q, got %q", want, rec.Body.String())
+		}
+	}
+}
+
+func Test_dashboardHandler_escapesBackends(t *testing.T) {
+	pool := &BaseServerPool{protocol: "tcp"}
+	if _, err := pool.addBackend(BackendConfig{URL: "tcp://10.0.0.1:80", Labels: map[string]string{"zone": "<script>alert(1)</script>"}}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	pool.dashboardHandler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if body := rec.Body.String(); strings.Contains(body, "<script>") || !strings.Contains(body, "zone=&lt;script&gt;") {
+		t.Errorf("expected the label to be escaped, got %q", body)
+	}
+}
+
+func Test_formatThroughput(t *testing.T) {
+	for rate, want := range map[float64]string{
+		0:               "-",
+		512:             "512 B/s",
+		1536:            "1.5 KiB/s",
+		3 << 20:         "3.0 MiB/s",
+		2.5 * (1 << 30): "2.5 GiB/s",
+	} {
+		if got := formatThroughput(rate); got != want {
+			t.Errorf("expected %q for %f, got %q", want, rate, got)
+		}
+	}
+}
+
+func Test_formatReuse(t *testing.T) {
+	if got := formatReuse(socketView{}); got != "-" {
+		t.Errorf("expected - without datagrams, got %q", got)
+	}
+	v := socketView{Hits: 3, Misses: 1, ReuseRatio: 0.75, RequestsPerSocket: 4, Open: 2, Idle: 1}
+	if got, want := formatReuse(v), "75% (4.0/socket), 1 idle of 2"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
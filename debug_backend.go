@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// debugScheme is the URL scheme of the built-in debug backend, which echoes
+// received bytes instead of forwarding them, e.g. "debug://blue".
+const debugScheme = "debug"
+
+// isDebugBackend reports whether the backend is a built-in debug backend.
+func isDebugBackend(b *Backend) bool {
+	return b.URL.Scheme == debugScheme
+}
+
+// debugBanner describes the connection as seen by the debug backend.
+func debugBanner(backend *Backend, client net.Addr) string {
+	return fmt.Sprintf("nlb debug backend=%s client=%s time=%s\n",
+		backend.URL.String(), client, time.Now().UTC().Format(time.RFC3339Nano))
+}
+
+// dialDebugBackend returns an in-memory connection served by a debug backend
+// that writes a metadata banner and then echoes everything it receives.
+func dialDebugBackend(backend *Backend, client net.Addr, l *log.Logger) net.Conn {
+	clientSide, serverSide := net.Pipe()
+	go func() {
+		defer serverSide.Close()
+		banner := debugBanner(backend, client)
+		debugf(l, "%s", banner)
+		if _, err := io.WriteString(serverSide, banner); err != nil {
+			return
+		}
+		io.Copy(serverSide, serverSide)
+	}()
+	return clientSide
+}
+
+// debugResponse returns the reply of a debug backend to a UDP datagram: the
+// metadata banner followed by the datagram itself.
+func debugResponse(backend *Backend, client net.Addr, data []byte, l *log.Logger) []byte {
+	banner := debugBanner(backend, client)
+	debugf(l, "%s", banner)
+	return append([]byte(banner), data...)
+}
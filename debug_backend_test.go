@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_proxy_debugBackend(t *testing.T) {
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:     "127.0.0.1:0",
+		Backends: []BackendConfig{{URL: "debug://blue"}},
+	})
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	pool.StartHealthChecks()
+	pool.Start()
+	defer pool.Shutdown(t.Context())
+
+	conn, err := net.Dial("tcp", pool.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect to load balancer: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	r := bufio.NewReader(conn)
+	banner, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read banner: %v", err)
+	}
+	if !strings.Contains(banner, "backend=debug://blue") || !strings.Contains(banner, "client="+conn.LocalAddr().String()) {
+		t.Errorf("unexpected banner %q", banner)
+	}
+
+	if _, err := conn.Write([]byte("hello\n")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	echo, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read echo: %v", err)
+	}
+	if echo != "hello\n" {
+		t.Errorf("expected echo %q, got %q", "hello\n", echo)
+	}
+}
+
+func Test_debugResponse(t *testing.T) {
+	pool := &BaseServerPool{}
+	pool.AddBackend("debug://green")
+	client := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5000}
+
+	resp := string(debugResponse(pool.backends[0], client, []byte("ping"), log.New(io.Discard, "", 0)))
+	if !strings.HasPrefix(resp, "nlb debug backend=debug://green client=127.0.0.1:5000 ") {
+		t.Errorf("unexpected banner in %q", resp)
+	}
+	if !strings.HasSuffix(resp, "\nping") {
+		t.Errorf("expected datagram to be echoed in %q", resp)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// HealthCheckTLS is the deep health check type that completes a TLS
+// handshake with TCP backends.
+const HealthCheckTLS = "tls"
+
+const defaultDeepCheckInterval = time.Minute
+
+// deepHealthCheck is a slower, more thorough health check run at a lower
+// frequency on top of the regular one, such as a TLS handshake or an
+// application query. A backend that passes its regular checks but fails
+// its deep check is degraded.
+type deepHealthCheck struct {
+	check    healthCheck
+	interval time.Duration
+}
+
+func newDeepHealthCheck(l *log.Logger, protocol string, config *DeepHealthCheckConfig) (*deepHealthCheck, error) {
+	if config == nil {
+		return nil, nil
+	}
+	d := &deepHealthCheck{interval: defaultDeepCheckInterval}
+	if config.Interval != "" {
+		interval, err := time.ParseDuration(config.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deep_health_check interval: %w", err)
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("deep_health_check interval must be positive")
+		}
+		d.interval = interval
+	}
+
+	hc := config.HealthCheckConfig
+	pr, err := newDeepProber(l, protocol, &hc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deep_health_check: %w", err)
+	}
+	d.check = healthCheck{prober: pr, timeout: healthCheckTimeout}
+	if hc.Timeout != "" {
+		if d.check.timeout, err = time.ParseDuration(hc.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid deep_health_check timeout: %w", err)
+		}
+		if d.check.timeout <= 0 {
+			return nil, fmt.Errorf("deep_health_check timeout must be positive")
+		}
+	}
+	return d, nil
+}
+
+// newDeepProber builds the prober of a deep health check. TCP backends are
+// sent the payload, if any, after a TLS handshake if the type is "tls";
+// other types are those of regular health checks.
+func newDeepProber(l *log.Logger, protocol string, config *HealthCheckConfig) (prober, error) {
+	if protocol != "tcp" || config.Type == HealthCheckExec || config.Type == HealthCheckICMP {
+		return newProber(l, protocol, config)
+	}
+	p := &tcpDeepProbe{tls: config.Type == HealthCheckTLS}
+	switch config.Type {
+	case "", HealthCheckTLS:
+	default:
+		return nil, fmt.Errorf("unsupported tcp health check type: %s", config.Type)
+	}
+	if config.Payload != "" || config.PayloadHex != "" {
+		exchange := *config
+		exchange.Type = ""
+		var err error
+		if p.exchange, err = newUDPProbe(&exchange); err != nil {
+			return nil, err
+		}
+	}
+	if !p.tls && p.exchange == nil {
+		return nil, fmt.Errorf("tcp deep health check requires type %q or a payload", HealthCheckTLS)
+	}
+	return p, nil
+}
+
+// tcpDeepProbe connects to a TCP backend, optionally completes a TLS
+// handshake, and optionally sends a payload and validates the response.
+type tcpDeepProbe struct {
+	tls      bool
+	exchange *udpProbe
+}
+
+func (p *tcpDeepProbe) probe(ctx context.Context, b *Backend) error {
+	addr, err := b.dialAddr(ctx)
+	if err != nil {
+		return err
+	}
+	d := net.Dialer{Control: bindDevice(b.device)}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer bindDeadline(ctx, conn)()
+
+	if p.tls {
+		// Backends that are not re-encrypted are verified against their
+		// host name.
+		config := b.tlsConfig
+		if config == nil {
+			config = &tls.Config{ServerName: b.URL.Hostname()}
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return fmt.Errorf("tls handshake failed: %w", err)
+		}
+		conn = tlsConn
+	}
+	if p.exchange != nil {
+		return p.exchange.check(conn)
+	}
+	return nil
+}
+
+// DeepError returns the error of the backend's last deep check, or "".
+func (b *Backend) DeepError() string {
+	if err := b.degradation.deepErr.Load(); err != nil {
+		return *err
+	}
+	return ""
+}
+
+// startDeepCheck runs the pool's deep check of the backend every interval
+// until the backend is removed or health checks stop.
+func (p *BaseServerPool) startDeepCheck(backend *Backend) {
+	d := p.deepCheck
+	if d == nil {
+		return
+	}
+	p.checker.Go(func(ctx context.Context) {
+		for {
+			if _, paused := backend.healthOverride(); !paused {
+				probeCtx, cancel := context.WithTimeout(ctx, d.check.timeout)
+				err := d.check.prober.probe(probeCtx, backend)
+				cancel()
+				if ctx.Err() != nil {
+					return
+				}
+				p.setDeepResult(backend, err)
+			}
+			select {
+			case <-time.After(d.interval):
+			case <-backend.removed:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// setDeepResult records the outcome of a deep check, logging changes.
+func (p *BaseServerPool) setDeepResult(b *Backend, err error) {
+	if err == nil {
+		b.degradation.deepErr.Store(nil)
+		if b.degradation.deepFailing.Swap(false) {
+			infof(p.log, "deep health check passed again for backend %s", b.URL.Host)
+		}
+		return
+	}
+	msg := err.Error()
+	b.degradation.deepErr.Store(&msg)
+	if !b.degradation.deepFailing.Swap(true) {
+		warnf(p.log, "deep health check failed for backend %s, degrading it: %v", b.URL.Host, err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func Test_newDeepHealthCheck(t *testing.T) {
+	l := log.New(io.Discard, "", 0)
+	if d, err := newDeepHealthCheck(l, "tcp", nil); d != nil || err != nil {
+		t.Errorf("expected no deep check when not configured, got %v, %v", d, err)
+	}
+	for _, config := range []*DeepHealthCheckConfig{
+		{},
+		{HealthCheckConfig: HealthCheckConfig{Type: HealthCheckDNS}},
+		{HealthCheckConfig: HealthCheckConfig{Type: HealthCheckTLS}, Interval: "soon"},
+		{HealthCheckConfig: HealthCheckConfig{Type: HealthCheckTLS}, Interval: "-1m"},
+		{HealthCheckConfig: HealthCheckConfig{Type: HealthCheckTLS, Timeout: "0s"}},
+	} {
+		if _, err := newDeepHealthCheck(l, "tcp", config); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+	d, err := newDeepHealthCheck(l, "tcp", &DeepHealthCheckConfig{HealthCheckConfig: HealthCheckConfig{Type: HealthCheckTLS}})
+	if err != nil {
+		t.Fatalf("failed to create deep check: %v", err)
+	}
+	if d.interval != defaultDeepCheckInterval {
+		t.Errorf("expected the default interval, got %s", d.interval)
+	}
+	if _, err := newDeepHealthCheck(l, "udp", &DeepHealthCheckConfig{HealthCheckConfig: HealthCheckConfig{Type: HealthCheckDNS}}); err != nil {
+		t.Errorf("expected a dns deep check on a udp listener to be valid, got %v", err)
+	}
+}
+
+func TestTCPDeepProbe(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	b := &Backend{URL: &url.URL{Scheme: "tcp", Host: u.Host}}
+	probe := &tcpDeepProbe{tls: true}
+
+	if err := probe.probe(t.Context(), b); err == nil {
+		t.Errorf("expected a handshake with an untrusted certificate to fail")
+	}
+	b.tlsConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	b.tlsConfig.ServerName = "127.0.0.1"
+	if err := probe.probe(t.Context(), b); err != nil {
+		t.Errorf("expected the handshake to succeed, got %v", err)
+	}
+
+	echo := &Backend{URL: &url.URL{Scheme: "tcp", Host: startTCPEcho(t)}}
+	if err := probe.probe(t.Context(), echo); err == nil {
+		t.Errorf("expected a handshake with a plain tcp backend to fail")
+	}
+	p, err := newDeepProber(log.New(io.Discard, "", 0), "tcp", &HealthCheckConfig{Payload: "ping", Expect: "ping"})
+	if err != nil {
+		t.Fatalf("failed to create probe: %v", err)
+	}
+	if err := p.probe(t.Context(), echo); err != nil {
+		t.Errorf("expected the echoed payload to pass, got %v", err)
+	}
+	p, _ = newDeepProber(log.New(io.Discard, "", 0), "tcp", &HealthCheckConfig{Payload: "ping", Expect: "pong"})
+	if err := p.probe(t.Context(), echo); err == nil {
+		t.Errorf("expected an unexpected response to fail")
+	}
+}
+
+func TestBaseServerPool_degraded(t *testing.T) {
+	var logs syncBuffer
+	pool := &BaseServerPool{log: log.New(&logs, "", 0), degradedEvery: 4}
+	pool.AddBackend("tcp://a:80")
+	pool.AddBackend("tcp://b:80")
+	a, b := pool.backends[0], pool.backends[1]
+	a.SetHealthy(true)
+	b.SetHealthy(true)
+
+	pool.setDeepResult(a, errors.New("tls handshake failed"))
+	if !a.Degraded() || a.DeepError() != "tls handshake failed" {
+		t.Fatalf("expected backend to be degraded")
+	}
+	if !strings.Contains(logs.String(), "degrading it") {
+		t.Errorf("expected the degradation to be logged, got %q", logs.String())
+	}
+	counts := make(map[*Backend]int)
+	for range 80 {
+		counts[pool.Next(nil)]++
+	}
+	if counts[a] == 0 || counts[a] > 15 {
+		t.Errorf("expected the degraded backend to get about a quarter of its share, got %d of 80", counts[a])
+	}
+
+	// Only connections that could go elsewhere are moved.
+	b.SetHealthy(false)
+	if got := pool.Next(nil); got != a {
+		t.Errorf("expected the degraded backend when no other is available, got %v", got)
+	}
+	b.SetHealthy(true)
+
+	rec := httptest.NewRecorder()
+	pool.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if want := `nlb_backend_degraded{backend="tcp://a:80"} 1`; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("expected metrics to contain %q", want)
+	}
+	if v := newBackendView(a); !v.Degraded || v.DeepError == "" {
+		t.Errorf("expected backend view to report degraded, got %+v", v)
+	}
+
+	pool.setDeepResult(a, nil)
+	if a.Degraded() || a.DeepError() != "" {
+		t.Errorf("expected backend to recover")
+	}
+	a.SetHealthy(false)
+	pool.setDeepResult(a, context.DeadlineExceeded)
+	if a.Degraded() {
+		t.Errorf("expected a down backend not to be reported degraded")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+const defaultDeferDialTimeout = 10 * time.Second
+
+// deferredDial holds client connections until they send data before a
+// backend is chosen and dialed, so that floods of idle connections do not
+// use up backend connections.
+type deferredDial struct {
+	timeout time.Duration
+}
+
+func newDeferredDial(config *DeferDialConfig) (*deferredDial, error) {
+	if config == nil || !config.Enabled {
+		return nil, nil
+	}
+	d := &deferredDial{timeout: defaultDeferDialTimeout}
+	if config.Timeout != "" {
+		timeout, err := time.ParseDuration(config.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid defer_dial timeout: %w", err)
+		}
+		if timeout <= 0 {
+			return nil, fmt.Errorf("defer_dial timeout must be positive")
+		}
+		d.timeout = timeout
+	}
+	return d, nil
+}
+
+// errNoClientData is returned when a client sends nothing before the
+// deferred dial timeout.
+var errNoClientData = errors.New("client sent no data")
+
+// wait waits for the client's first bytes and returns a connection
+// replaying them. It returns an error wrapping errNoClientData if the
+// client sent nothing within the timeout. A nil deferredDial returns conn
+// right away.
+func (d *deferredDial) wait(conn net.Conn) (net.Conn, error) {
+	if d == nil {
+		return conn, nil
+	}
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(d.timeout))
+	_, err := br.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, fmt.Errorf("%w within %s", errNoClientData, d.timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error waiting for client data: %w", err)
+	}
+	return &peekedConn{Conn: conn, r: br}, nil
+}
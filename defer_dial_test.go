@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_newDeferredDial(t *testing.T) {
+	if d, err := newDeferredDial(nil); d != nil || err != nil {
+		t.Errorf("expected no deferred dial when not configured, got %v, %v", d, err)
+	}
+	d, err := newDeferredDial(&DeferDialConfig{Enabled: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if d.timeout != defaultDeferDialTimeout {
+		t.Errorf("expected timeout %s, got %s", defaultDeferDialTimeout, d.timeout)
+	}
+	for _, timeout := range []string{"soon", "0s", "-1s"} {
+		if _, err := newDeferredDial(&DeferDialConfig{Enabled: true, Timeout: timeout}); err == nil {
+			t.Errorf("expected error for timeout %q", timeout)
+		}
+	}
+}
+
+func TestTCPServerPool_deferDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	var dialed atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			dialed.Add(1)
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:      "127.0.0.1:0",
+		Backends:  []BackendConfig{{URL: "tcp://" + ln.Addr().String()}},
+		DeferDial: &DeferDialConfig{Enabled: true, Timeout: "100ms"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	pool.backends[0].SetHealthy(true)
+	pool.Start()
+	defer pool.Shutdown(t.Context())
+	addr := pool.listener.Addr().String()
+
+	// A client that sends nothing is closed without dialing the backend.
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer idle.Close()
+	idle.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the idle connection to be closed, got %v", err)
+	}
+	if n := dialed.Load(); n != 0 {
+		t.Errorf("expected the backend not to be dialed for an idle client, got %d dials", n)
+	}
+	if n := pool.stats.idleClients.Load(); n != 1 {
+		t.Errorf("expected 1 idle client, got %d", n)
+	}
+
+	// The first bytes of a client are replayed to the backend.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello\n"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Errorf("expected the backend to echo hello, got %q, %v", line, err)
+	}
+
+	rec := httptest.NewRecorder()
+	pool.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if want := "nlb_deferred_dial_idle_clients_total 1"; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("expected metrics to contain %q", want)
+	}
+}
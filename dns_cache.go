@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dnsTypeA     = 1
+	dnsTypeAAAA  = 28
+	dnsTypeCNAME = 5
+
+	defaultDNSMinTTL      = time.Second
+	defaultDNSMaxTTL      = 5 * time.Minute
+	defaultDNSNegativeTTL = 5 * time.Second
+	// defaultDNSTTL is used for answers from the system resolver, which
+	// does not report TTLs, such as names in /etc/hosts.
+	defaultDNSTTL = 30 * time.Second
+	// dnsLookupTimeout bounds a lookup, whichever caller started it.
+	dnsLookupTimeout = 5 * time.Second
+	// dnsServerTimeout bounds waiting for a single nameserver.
+	dnsServerTimeout = 2 * time.Second
+)
+
+// resolvConfPath is read for nameservers on each lookup.
+var resolvConfPath = "/etc/resolv.conf"
+
+// errDNSTruncated is returned for a truncated DNS response, which falls back
+// to the system resolver.
+var errDNSTruncated = errors.New("dns response truncated")
+
+// dnsCache resolves backend hostnames for both health checks and the data
+// path, caching each answer for its DNS TTL, clamped to [minTTL, maxTTL], so
+// that neither resolves on every connection or datagram. Failed lookups are
+// cached for negativeTTL; if an expired answer exists it keeps being served
+// in the meantime. Concurrent lookups of the same name share one query. A
+// nil *dnsCache resolves every lookup through the system resolver.
+type dnsCache struct {
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	now         func() time.Time
+	// lookup resolves a name, returning a zero TTL if it is not known.
+	lookup func(ctx context.Context, host string) ([]netip.Addr, time.Duration, error)
+	// nameservers overrides those in resolvConfPath if set.
+	nameservers []string
+
+	mux     sync.Mutex
+	entries map[string]*dnsEntry
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+	errors atomic.Uint64
+}
+
+type dnsEntry struct {
+	// done is closed once the lookup filling the entry has finished.
+	done    chan struct{}
+	addrs   []netip.Addr
+	err     error
+	expires time.Time
+}
+
+// newDNSCache returns a cache configured by config, or nil if it is
+// disabled.
+func newDNSCache(config *DNSCacheConfig) (*dnsCache, error) {
+	c := &dnsCache{
+		minTTL:      defaultDNSMinTTL,
+		maxTTL:      defaultDNSMaxTTL,
+		negativeTTL: defaultDNSNegativeTTL,
+		now:         time.Now,
+		entries:     make(map[string]*dnsEntry),
+	}
+	c.lookup = c.lookupTTL
+	if config == nil {
+		return c, nil
+	}
+	if config.Disabled {
+		return nil, nil
+	}
+	for _, s := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"min_ttl", config.MinTTL, &c.minTTL},
+		{"max_ttl", config.MaxTTL, &c.maxTTL},
+		{"negative_ttl", config.NegativeTTL, &c.negativeTTL},
+	} {
+		if s.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dns_cache %s: %w", s.name, err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("dns_cache %s must not be negative", s.name)
+		}
+		*s.dst = d
+	}
+	if c.minTTL > c.maxTTL {
+		return nil, fmt.Errorf("dns_cache min_ttl must not exceed max_ttl")
+	}
+	return c, nil
+}
+
+// resolve returns the addresses of host. IP addresses are returned as is.
+func (c *dnsCache) resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{ip}, nil
+	}
+	if c == nil {
+		return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	}
+
+	c.mux.Lock()
+	e, ok := c.entries[host]
+	if ok && (!isDone(e.done) || c.now().Before(e.expires)) {
+		c.mux.Unlock()
+		c.hits.Add(1)
+		select {
+		case <-e.done:
+			return e.addrs, e.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	next := &dnsEntry{done: make(chan struct{})}
+	c.entries[host] = next
+	c.mux.Unlock()
+	c.misses.Add(1)
+
+	// The lookup outlives a cancelled caller, since others may be waiting
+	// on it and its answer is cached.
+	lookupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), dnsLookupTimeout)
+	defer cancel()
+	addrs, ttl, err := c.lookup(lookupCtx, host)
+	switch {
+	case err == nil && len(addrs) == 0:
+		err = fmt.Errorf("no addresses found for %s", host)
+		fallthrough
+	case err != nil:
+		c.errors.Add(1)
+		next.err, next.expires = err, c.now().Add(c.negativeTTL)
+		if ok && e.err == nil {
+			// Serve the stale answer rather than failing.
+			next.addrs, next.err = e.addrs, nil
+		}
+	default:
+		if ttl == 0 {
+			ttl = defaultDNSTTL
+		}
+		next.addrs, next.expires = addrs, c.now().Add(min(max(ttl, c.minTTL), c.maxTTL))
+	}
+	close(next.done)
+	return next.addrs, next.err
+}
+
+// resolveOne returns a single address of host, preferring IPv4 like
+// net.ResolveIPAddr.
+func (c *dnsCache) resolveOne(ctx context.Context, host string) (netip.Addr, error) {
+	addrs, err := c.resolve(ctx, host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	for _, addr := range addrs {
+		if addr.Is4() || addr.Is4In6() {
+			return addr.Unmap(), nil
+		}
+	}
+	return addrs[0], nil
+}
+
+// Len returns the number of cached names.
+func (c *dnsCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return len(c.entries)
+}
+
+func isDone(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// lookupTTL queries the configured nameservers directly for fully qualified
+// names so that the answer's TTL is known, and falls back to the system
+// resolver for other names, for names the nameservers do not know, such as
+// those in /etc/hosts, and if no nameserver answers.
+func (c *dnsCache) lookupTTL(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	if strings.Contains(strings.TrimSuffix(host, "."), ".") {
+		servers := c.nameservers
+		if servers == nil {
+			servers = readNameservers(resolvConfPath)
+		}
+		for _, server := range servers {
+			serverCtx, cancel := context.WithTimeout(ctx, dnsServerTimeout)
+			addrs, ttl, err := exchangeDNS(serverCtx, server, host)
+			cancel()
+			if err == nil {
+				if len(addrs) > 0 {
+					return addrs, ttl, nil
+				}
+				break
+			}
+		}
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	return addrs, 0, err
+}
+
+// readNameservers returns the nameservers listed in a resolv.conf file.
+func readNameservers(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			if ip, err := netip.ParseAddr(fields[1]); err == nil {
+				servers = append(servers, netip.AddrPortFrom(ip, 53).String())
+			}
+		}
+	}
+	return servers
+}
+
+// exchangeDNS sends A and AAAA queries for name to server and returns the
+// addresses answered along with the lowest TTL of the answers. A name the
+// server does not know yields no addresses and no error.
+func exchangeDNS(ctx context.Context, server, name string) ([]netip.Addr, time.Duration, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	defer bindDeadline(ctx, conn)()
+
+	id := uint16(rand.Uint32())
+	pending := make(map[uint16]bool)
+	for i, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		query, err := dnsQuery(id+uint16(i), name, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		if _, err := conn.Write(query); err != nil {
+			return nil, 0, fmt.Errorf("error writing dns query: %w", err)
+		}
+		pending[id+uint16(i)] = true
+	}
+
+	var addrs []netip.Addr
+	var ttl time.Duration
+	buf := make([]byte, 4096)
+	for len(pending) > 0 {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error reading dns response: %w", err)
+		}
+		resp, err := parseDNSResponse(buf[:n])
+		if err != nil {
+			return nil, 0, err
+		}
+		if !pending[resp.id] {
+			continue
+		}
+		delete(pending, resp.id)
+		if resp.rcode != 0 && resp.rcode != 3 { // NOERROR, NXDOMAIN
+			return nil, 0, fmt.Errorf("dns response code %d", resp.rcode)
+		}
+		if len(resp.addrs) > 0 && (len(addrs) == 0 || resp.ttl < ttl) {
+			ttl = resp.ttl
+		}
+		addrs = append(addrs, resp.addrs...)
+	}
+	return addrs, ttl, nil
+}
+
+type dnsResponse struct {
+	id    uint16
+	rcode int
+	addrs []netip.Addr
+	// ttl is the lowest TTL of the answer records, including any CNAMEs
+	// leading to the addresses.
+	ttl time.Duration
+}
+
+// parseDNSResponse parses the A and AAAA answers of a DNS response.
+func parseDNSResponse(msg []byte) (dnsResponse, error) {
+	if len(msg) < 12 {
+		return dnsResponse{}, fmt.Errorf("short dns response: %d bytes", len(msg))
+	}
+	resp := dnsResponse{id: binary.BigEndian.Uint16(msg[0:2])}
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	if flags&0x8000 == 0 {
+		return dnsResponse{}, fmt.Errorf("dns response is not a reply")
+	}
+	if flags&0x0200 != 0 {
+		return dnsResponse{}, errDNSTruncated
+	}
+	resp.rcode = int(flags & 0x000f)
+	qdcount := binary.BigEndian.Uint16(msg[4:6])
+	ancount := binary.BigEndian.Uint16(msg[6:8])
+
+	off := 12
+	var err error
+	for range qdcount {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return dnsResponse{}, err
+		}
+		off += 4 // QTYPE, QCLASS
+	}
+	first := true
+	for range ancount {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return dnsResponse{}, err
+		}
+		if off+10 > len(msg) {
+			return dnsResponse{}, fmt.Errorf("malformed dns answer")
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		class := binary.BigEndian.Uint16(msg[off+2:])
+		ttl := time.Duration(binary.BigEndian.Uint32(msg[off+4:])) * time.Second
+		length := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+length > len(msg) {
+			return dnsResponse{}, fmt.Errorf("malformed dns answer")
+		}
+		rdata := msg[off : off+length]
+		off += length
+		if class != 1 { // IN
+			continue
+		}
+		switch {
+		case rtype == dnsTypeA && length == 4:
+			resp.addrs = append(resp.addrs, netip.AddrFrom4([4]byte(rdata)))
+		case rtype == dnsTypeAAAA && length == 16:
+			resp.addrs = append(resp.addrs, netip.AddrFrom16([16]byte(rdata)))
+		case rtype != dnsTypeCNAME:
+			continue
+		}
+		if first || ttl < resp.ttl {
+			resp.ttl, first = ttl, false
+		}
+	}
+	return resp, nil
+}
+
+// skipDNSName returns the offset following the possibly compressed name
+// starting at off.
+func skipDNSName(msg []byte, off int) (int, error) {
+	for off < len(msg) {
+		switch l := int(msg[off]); {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0:
+			if off+2 > len(msg) {
+				return 0, fmt.Errorf("malformed dns name")
+			}
+			return off + 2, nil
+		case l&0xc0 != 0:
+			return 0, fmt.Errorf("malformed dns name")
+		default:
+			off += 1 + l
+		}
+	}
+	return 0, fmt.Errorf("malformed dns name")
+}
+
+// dialAddr returns the address to connect to the backend at, resolving its
+// hostname through the pool's DNS cache.
+func (b *Backend) dialAddr(ctx context.Context) (string, error) {
+	if b.resolver == nil {
+		return b.URL.Host, nil
+	}
+	addr, err := b.resolver.resolveOne(ctx, b.URL.Hostname())
+	if err != nil {
+		return "", fmt.Errorf("error resolving backend %s: %w", b.URL.Host, err)
+	}
+	return net.JoinHostPort(addr.String(), b.URL.Port()), nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_newDNSCache(t *testing.T) {
+	c, err := newDNSCache(nil)
+	if err != nil || c == nil {
+		t.Fatalf("expected the cache to be enabled by default, got %v, %v", c, err)
+	}
+	if c.minTTL != defaultDNSMinTTL || c.maxTTL != defaultDNSMaxTTL || c.negativeTTL != defaultDNSNegativeTTL {
+		t.Errorf("expected defaults, got %s, %s and %s", c.minTTL, c.maxTTL, c.negativeTTL)
+	}
+	if c, err := newDNSCache(&DNSCacheConfig{Disabled: true}); c != nil || err != nil {
+		t.Errorf("expected nil when disabled, got %v, %v", c, err)
+	}
+	for _, config := range []DNSCacheConfig{
+		{MinTTL: "soon"},
+		{NegativeTTL: "-1s"},
+		{MinTTL: "1m", MaxTTL: "10s"},
+	} {
+		if _, err := newDNSCache(&config); err == nil {
+			t.Errorf("expected error for %+v", config)
+		}
+	}
+}
+
+func TestDNSCache_resolve(t *testing.T) {
+	now := time.Now()
+	c, _ := newDNSCache(&DNSCacheConfig{MinTTL: "5s", MaxTTL: "1m"})
+	c.now = func() time.Time { return now }
+	var lookups atomic.Int32
+	answer := []netip.Addr{netip.MustParseAddr("::1"), netip.MustParseAddr("10.0.0.1")}
+	var ttl time.Duration
+	var lookupErr error
+	c.lookup = func(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+		lookups.Add(1)
+		return answer, ttl, lookupErr
+	}
+
+	ttl = time.Second
+	for range 3 {
+		if addr, err := c.resolveOne(t.Context(), "backend.example"); err != nil || addr.String() != "10.0.0.1" {
+			t.Errorf("expected 10.0.0.1, got %s, %v", addr, err)
+		}
+	}
+	if lookups.Load() != 1 || c.hits.Load() != 2 {
+		t.Errorf("expected 1 lookup and 2 hits, got %d and %d", lookups.Load(), c.hits.Load())
+	}
+
+	// The 1s TTL is raised to min_ttl.
+	now = now.Add(4 * time.Second)
+	c.resolve(t.Context(), "backend.example")
+	if lookups.Load() != 1 {
+		t.Errorf("expected the answer to be cached for min_ttl, got %d lookups", lookups.Load())
+	}
+	now = now.Add(2 * time.Second)
+
+	// A failed lookup keeps serving the expired answer.
+	lookupErr = errors.New("timeout")
+	if addrs, err := c.resolve(t.Context(), "backend.example"); err != nil || !slices.Equal(addrs, answer) {
+		t.Errorf("expected the stale answer, got %v, %v", addrs, err)
+	}
+	if lookups.Load() != 2 || c.errors.Load() != 1 {
+		t.Errorf("expected a second, failed lookup, got %d lookups and %d errors", lookups.Load(), c.errors.Load())
+	}
+
+	// Failures are cached for negative_ttl.
+	for range 2 {
+		if _, err := c.resolve(t.Context(), "missing.example"); err == nil {
+			t.Errorf("expected error for a failed lookup")
+		}
+	}
+	if lookups.Load() != 3 {
+		t.Errorf("expected the failure to be cached, got %d lookups", lookups.Load())
+	}
+	now = now.Add(c.negativeTTL)
+	lookupErr, ttl = nil, 0
+	if _, err := c.resolve(t.Context(), "missing.example"); err != nil {
+		t.Errorf("expected the name to be looked up again, got %v", err)
+	}
+
+	// IP addresses are not looked up.
+	if addrs, err := c.resolve(t.Context(), "192.0.2.1"); err != nil || len(addrs) != 1 || lookups.Load() != 4 {
+		t.Errorf("expected the address as is without a lookup, got %v, %v", addrs, err)
+	}
+	if c.Len() != 2 {
+		t.Errorf("expected 2 cached names, got %d", c.Len())
+	}
+}
+
+// startDNSServer starts a nameserver answering A queries for name with addr
+// and TTL 60 through a CNAME with TTL 30, and AAAA queries with no records.
+// It returns its address and a count of the queries received.
+func startDNSServer(t *testing.T, name string, addr [4]byte) (string, *atomic.Int32) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	qname, _ := encodeDNSName(name)
+	var queries atomic.Int32
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries.Add(1)
+			query := buf[:n]
+			resp := append([]byte{}, query[:12]...)
+			binary.BigEndian.PutUint16(resp[2:4], 0x8180) // QR, RD, RA
+			resp = append(resp, query[12:]...)
+			if binary.BigEndian.Uint16(query[n-4:]) == dnsTypeA {
+				binary.BigEndian.PutUint16(resp[6:8], 2)
+				// CNAME pointing back at the question name, then an A record.
+				resp = append(resp, 0xc0, 12, 0, dnsTypeCNAME, 0, 1, 0, 0, 0, 30, 0, byte(len(qname)))
+				resp = append(resp, qname...)
+				resp = append(resp, 0xc0, 12, 0, dnsTypeA, 0, 1, 0, 0, 0, 60, 0, 4)
+				resp = append(resp, addr[:]...)
+			}
+			conn.WriteTo(resp, from)
+		}
+	}()
+	return conn.LocalAddr().String(), &queries
+}
+
+func TestDNSCache_lookupTTL(t *testing.T) {
+	server, queries := startDNSServer(t, "backend.example", [4]byte{127, 0, 0, 1})
+	c, _ := newDNSCache(nil)
+	c.nameservers = []string{server}
+
+	addrs, ttl, err := c.lookupTTL(t.Context(), "backend.example")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !slices.Equal(addrs, []netip.Addr{netip.MustParseAddr("127.0.0.1")}) || ttl != 30*time.Second {
+		t.Errorf("expected 127.0.0.1 with the CNAME's 30s TTL, got %v and %s", addrs, ttl)
+	}
+	if queries.Load() != 2 {
+		t.Errorf("expected A and AAAA queries, got %d", queries.Load())
+	}
+
+	// Names without a dot go to the system resolver, which knows localhost.
+	if addrs, ttl, err := c.lookupTTL(t.Context(), "localhost"); err != nil || len(addrs) == 0 || ttl != 0 {
+		t.Errorf("expected localhost from the system resolver, got %v, %s, %v", addrs, ttl, err)
+	}
+	if queries.Load() != 2 {
+		t.Errorf("expected no query for localhost, got %d", queries.Load())
+	}
+}
+
+func Test_parseDNSResponse(t *testing.T) {
+	for _, msg := range [][]byte{
+		{0, 1, 0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0},       // not a reply
+		{0, 1, 0x82, 0, 0, 0, 0, 0, 0, 0, 0, 0},       // truncated
+		{0, 1, 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0, 3}, // bad name
+	} {
+		if _, err := parseDNSResponse(msg); err == nil {
+			t.Errorf("expected error for %v", msg)
+		}
+	}
+	resp, err := parseDNSResponse([]byte{0, 1, 0x81, 0x83, 0, 0, 0, 0, 0, 0, 0, 0})
+	if err != nil || resp.rcode != 3 || len(resp.addrs) != 0 {
+		t.Errorf("expected NXDOMAIN without addresses, got %+v, %v", resp, err)
+	}
+}
+
+func TestUDPServerPool_dnsCache(t *testing.T) {
+	server, queries := startDNSServer(t, "backend.example", [4]byte{127, 0, 0, 1})
+	backend := startUDPResponder(t, func(b []byte) []byte { return b })
+	_, port, _ := net.SplitHostPort(backend.LocalAddr().String())
+	pool, err := NewUDPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:     "127.0.0.1:0",
+		Backends: []BackendConfig{{URL: "backend.example:" + port}},
+	})
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	pool.resolver.nameservers = []string{server}
+	pool.backends[0].SetHealthy(true)
+	if err := pool.Start(); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer pool.Shutdown(t.Context())
+
+	conn, err := net.Dial("udp", pool.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 1024)
+	for range 3 {
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write([]byte("ping"))
+		if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "ping" {
+			t.Fatalf("expected echo, got %q, %v", buf[:n], err)
+		}
+	}
+	if queries.Load() != 2 {
+		t.Errorf("expected the backend to be resolved once, got %d queries", queries.Load())
+	}
+}
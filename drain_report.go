@@ -0,0 +1,128 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const defaultDrainReportInterval = 5 * time.Second
+
+// drainState records when the pool started draining on shutdown and when
+// it gives up on the connections still in flight.
+type drainState struct {
+	started  time.Time
+	deadline time.Time
+}
+
+// backendDrainCount is the number of connections still open to a backend.
+type backendDrainCount struct {
+	Backend     string `json:"backend"`
+	Connections int    `json:"connections"`
+}
+
+// shutdownView reports what the pool's shutdown is waiting on: the
+// connections still in flight, by backend, and how long before they are
+// closed.
+type shutdownView struct {
+	ShuttingDown bool `json:"shutting_down"`
+	// Draining is set once the pool waits for its connections to finish.
+	Draining    bool       `json:"draining"`
+	Started     *time.Time `json:"started,omitempty"`
+	Deadline    *time.Time `json:"deadline,omitempty"`
+	Remaining   string     `json:"remaining,omitempty"`
+	Connections int        `json:"connections"`
+	// Unassigned counts connections not yet routed to a backend.
+	Unassigned int                 `json:"unassigned,omitempty"`
+	Backends   []backendDrainCount `json:"backends"`
+}
+
+// shutdownReport returns the pool's shutdown progress at now.
+func (p *BaseServerPool) shutdownReport(now time.Time) shutdownView {
+	v := shutdownView{ShuttingDown: p.shuttingDown.Load(), Backends: []backendDrainCount{}}
+	if s := p.shutdownDrain.Load(); s != nil {
+		v.Draining = true
+		v.Started = &s.started
+		if !s.deadline.IsZero() {
+			v.Deadline = &s.deadline
+			v.Remaining = max(s.deadline.Sub(now), 0).Round(time.Second).String()
+		}
+	}
+
+	counts := make(map[string]int)
+	p.conns.countWhere(func(c *trackedConn) bool {
+		v.Connections++
+		if b := c.backend.Load(); b != nil {
+			counts[b.URL.Host]++
+		} else {
+			v.Unassigned++
+		}
+		return false
+	}, now)
+	for backend, n := range counts {
+		v.Backends = append(v.Backends, backendDrainCount{Backend: backend, Connections: n})
+	}
+	slices.SortFunc(v.Backends, func(a, b backendDrainCount) int {
+		return cmp.Or(cmp.Compare(b.Connections, a.Connections), cmp.Compare(a.Backend, b.Backend))
+	})
+	return v
+}
+
+// String summarizes the connections the drain is waiting on.
+func (v shutdownView) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d connections remaining", v.Connections)
+	if v.Remaining != "" {
+		fmt.Fprintf(&b, ", closing them in %s", v.Remaining)
+	}
+	var parts []string
+	for _, c := range v.Backends {
+		parts = append(parts, fmt.Sprintf("%s: %d", c.Backend, c.Connections))
+	}
+	if v.Unassigned > 0 {
+		parts = append(parts, fmt.Sprintf("not yet routed: %d", v.Unassigned))
+	}
+	if len(parts) > 0 {
+		fmt.Fprintf(&b, " (%s)", strings.Join(parts, ", "))
+	}
+	return b.String()
+}
+
+// shutdownAPIHandler reports the pool's shutdown progress.
+func (p *BaseServerPool) shutdownAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, p.shutdownReport(time.Now()))
+}
+
+// reportDrain logs the connections each pool is still waiting on every
+// interval until ctx is done or the returned func is called.
+func reportDrain(ctx context.Context, l *log.Logger, pools []namedPool, interval time.Duration) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				for _, np := range pools {
+					v := np.pool.shutdownReport(now)
+					if v.Connections == 0 {
+						continue
+					}
+					if np.name != "" {
+						infof(l, "draining listener %s: %s", np.name, v)
+					} else {
+						infof(l, "draining: %s", v)
+					}
+				}
+			}
+		}
+	}()
+	return cancel
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBaseServerPool_shutdownReport(t *testing.T) {
+	pool := newConsoleTestPool("", true)
+	b, _ := pool.addBackend(BackendConfig{URL: "tcp://10.0.0.1:9000"})
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}
+	for _, backend := range []*Backend{b, b, pool.backends[0], nil} {
+		ctx, done := pool.conns.track(newConnID(), client, 0)
+		defer done()
+		if backend != nil {
+			setConnBackend(ctx, backend)
+		}
+	}
+
+	v := pool.shutdownReport(time.Now())
+	if v.ShuttingDown || v.Draining || v.Connections != 4 || v.Unassigned != 1 {
+		t.Fatalf("unexpected report before shutdown %+v", v)
+	}
+	if len(v.Backends) != 2 || v.Backends[0].Backend != "10.0.0.1:9000" || v.Backends[0].Connections != 2 {
+		t.Errorf("expected backends ordered by connections, got %+v", v.Backends)
+	}
+
+	// Draining records the deadline connections are closed at.
+	pool.shuttingDown.Store(true)
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	drained := make(chan error)
+	go func() { drained <- pool.drainOrCancel(ctx, &wg) }()
+	for pool.shutdownDrain.Load() == nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	rec := httptest.NewRecorder()
+	pool.shutdownAPIHandler(rec, httptest.NewRequest("GET", "/api/shutdown", nil))
+	if err := json.NewDecoder(rec.Body).Decode(&v); err != nil {
+		t.Fatalf("failed to decode report: %v", err)
+	}
+	if !v.ShuttingDown || !v.Draining || v.Deadline == nil || v.Remaining == "" {
+		t.Errorf("expected a draining report with a deadline, got %+v", v)
+	}
+	want := "4 connections remaining, closing them in 1m0s (10.0.0.1:9000: 2, localhost:8080: 1, not yet routed: 1)"
+	if got := v.String(); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	wg.Done()
+	if err := <-drained; err != nil {
+		t.Errorf("expected the drain to finish, got %v", err)
+	}
+}
+
+func Test_reportDrain(t *testing.T) {
+	idle, busy := newConsoleTestPool("idle", true), newConsoleTestPool("busy", true)
+	ctx, done := busy.conns.track(newConnID(), &net.TCPAddr{}, 0)
+	defer done()
+	setConnBackend(ctx, busy.backends[0])
+
+	var out syncBuffer
+	stop := reportDrain(t.Context(), log.New(&out, "", 0), []namedPool{
+		{name: "idle", pool: consoleTestPool{idle}},
+		{name: "busy", pool: consoleTestPool{busy}},
+	}, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	stop()
+
+	logs := out.String()
+	if !strings.Contains(logs, "draining listener busy: 1 connections remaining (localhost:8080: 1)") {
+		t.Errorf("expected the busy listener to be reported, got %q", logs)
+	}
+	if strings.Contains(logs, "listener idle") {
+		t.Errorf("expected listeners without connections not to be reported, got %q", logs)
+	}
+}
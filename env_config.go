@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// envPrefix starts the name of each environment variable setting a config
+// key, e.g. NLB_ADDR for addr.
+const envPrefix = "NLB_"
+
+// envKeys are the top-level config keys that can be set from the
+// environment or with -set, keyed by their environment variable and holding
+// the type of their field.
+var envKeys = func() map[string]reflect.Type {
+	keys := make(map[string]reflect.Type)
+	t := reflect.TypeFor[Config]()
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || name == "" || name == "-" || slices.Contains(fileOnlyKeys, name) {
+			continue
+		}
+		keys[envPrefix+strings.ToUpper(name)] = f.Type
+	}
+	return keys
+}()
+
+// fileOnlyKeys are the config keys not set from the environment: listeners
+// are only supported by config files, the environment is always read at the
+// current schema version and decoded strictly.
+var fileOnlyKeys = []string{"listeners", "version", "strict"}
+
+// envKey returns the config key set by the environment variable name.
+func envKey(name string) string {
+	return strings.ToLower(strings.TrimPrefix(name, envPrefix))
+}
+
+// parseEnvValue converts the value of a config key given as a string to
+// the raw config value of a field of type t. Strings are taken as is,
+// booleans are parsed, lists of strings and of backends are comma-separated
+// unless given as a JSON array, and any other value is JSON, e.g.
+// NLB_MAX_CONNECTIONS=100 or NLB_HEALTH_CHECK={"type":"http"}.
+func parseEnvValue(t reflect.Type, value string) (any, error) {
+	switch t.Kind() {
+	case reflect.String:
+		return value, nil
+	case reflect.Bool:
+		return strconv.ParseBool(value)
+	case reflect.Slice:
+		elem := t.Elem()
+		if elem.Kind() == reflect.String || elem == reflect.TypeFor[BackendConfig]() {
+			if strings.HasPrefix(strings.TrimSpace(value), "[") {
+				break
+			}
+			list := []any{}
+			for item := range strings.SplitSeq(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			return list, nil
+		}
+	}
+	var v any
+	if err := json.Unmarshal([]byte(value), &v); err != nil {
+		return nil, fmt.Errorf("invalid json: %w", err)
+	}
+	return v, nil
+}
+
+// rawConfigFromEnv builds a raw config from the NLB_ variables in environ,
+// overridden by the key=value pairs in sets, and returns the names of the
+// NLB_ variables naming no config key. Those are ignored rather than
+// rejected, as the environment holds variables set for other purposes,
+// such as the NLB_SERVICE_HOST and NLB_PORT Kubernetes sets for a Service
+// named nlb; unknown keys in sets are rejected, so that typos are not
+// silently ignored.
+func rawConfigFromEnv(environ, sets []string) (map[string]any, []string, error) {
+	raw := map[string]any{}
+	var ignored []string
+	set := func(name, value, source string) error {
+		t, ok := envKeys[name]
+		if !ok {
+			return fmt.Errorf("unknown config %s %s", source, name)
+		}
+		v, err := parseEnvValue(t, value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %s: %w", source, name, err)
+		}
+		raw[envKey(name)] = v
+		return nil
+	}
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, envPrefix) {
+			continue
+		}
+		if _, ok := envKeys[name]; !ok && !slices.Contains(fileOnlyKeys, envKey(name)) {
+			ignored = append(ignored, name)
+			continue
+		}
+		if err := set(name, value, "environment variable"); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, kv := range sets {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid -set %q: expected key=value", kv)
+		}
+		if err := set(envPrefix+strings.ToUpper(key), value, "key"); err != nil {
+			return nil, nil, err
+		}
+	}
+	return raw, ignored, nil
+}
+
+// configFromEnv builds the config of nlb run without a config file from
+// the NLB_ variables in environ and the key=value pairs in sets, for
+// container deployments where mounting a file is awkward. The variables
+// are decoded strictly, as a config file would be with strict set. The
+// names of the ignored NLB_ variables are returned alongside the config.
+func configFromEnv(environ, sets []string) (*Config, []string, error) {
+	raw, ignored, err := rawConfigFromEnv(environ, sets)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(raw) == 0 {
+		return nil, nil, fmt.Errorf("no config file given and no %s environment variables set", envPrefix)
+	}
+	raw["strict"] = true
+	config, err := decodeRawConfig(raw)
+	return config, ignored, err
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func Test_configFromEnv(t *testing.T) {
+	config, ignored, err := configFromEnv([]string{
+		"PATH=/usr/bin",
+		// Kubernetes sets these for a Service named nlb.
+		"NLB_SERVICE_HOST=10.96.0.10",
+		"NLB_PORT=tcp://10.96.0.10:80",
+		"NLB_PORT_80_TCP_PORT=80",
+		"NLB_ADDR=:80",
+		"NLB_PROTOCOL=tcp",
+		"NLB_BACKENDS=10.0.0.1:8080, http://10.0.0.2:8080,",
+		"NLB_MAX_CONNECTIONS=100",
+		"NLB_STICKY_SESSIONS=1",
+		"NLB_ADDRS=10.0.0.10:80,10.0.0.11:80",
+		`NLB_HEALTH_CHECK={"type": "tcp", "timeout": "1s"}`,
+	}, []string{"addr=:8080", "console_addr=:8081"})
+	if err != nil {
+		t.Fatalf("failed to build config: %v", err)
+	}
+	if want := []string{"NLB_SERVICE_HOST", "NLB_PORT", "NLB_PORT_80_TCP_PORT"}; !slices.Equal(ignored, want) {
+		t.Errorf("expected %v to be ignored, got %v", want, ignored)
+	}
+	if config.Addr != ":8080" || config.ConsoleAddr != ":8081" || config.Protocol != "tcp" {
+		t.Errorf("expected -set to override the environment, got %q, %q, %q", config.Addr, config.ConsoleAddr, config.Protocol)
+	}
+	if len(config.Backends) != 2 || config.Backends[0].URL != "10.0.0.1:8080" || config.Backends[1].URL != "http://10.0.0.2:8080" {
+		t.Errorf("expected backends from a comma-separated list, got %+v", config.Backends)
+	}
+	if config.MaxConnections != 100 || !config.StickySessions || len(config.Addrs) != 2 {
+		t.Errorf("expected numbers, booleans and lists to be parsed, got %+v", config)
+	}
+	if config.HealthCheck == nil || config.HealthCheck.Timeout != "1s" {
+		t.Errorf("expected the health check to be decoded from json, got %+v", config.HealthCheck)
+	}
+
+	config, _, err = configFromEnv([]string{`NLB_BACKENDS=[{"url": "10.0.0.1:8080", "labels": {"zone": "a"}}]`}, nil)
+	if err != nil || len(config.Backends) != 1 || config.Backends[0].Labels["zone"] != "a" {
+		t.Errorf("expected backends from a json array, got %+v, %v", config, err)
+	}
+
+	for _, tt := range []struct {
+		environ, sets []string
+	}{
+		{nil, nil},
+		{[]string{"NLB_SERVICE_HOST=10.96.0.10"}, nil},
+		{[]string{"NLB_LISTENERS=[]"}, nil},
+		{[]string{"NLB_STICKY_SESSIONS=maybe"}, nil},
+		{[]string{"NLB_MAX_CONNECTIONS=many"}, nil},
+		{[]string{`NLB_HEALTH_CHECK={"typ": "tcp"}`}, nil},
+		{nil, []string{"addr"}},
+		{nil, []string{"adrr=:80"}},
+	} {
+		if _, _, err := configFromEnv(tt.environ, tt.sets); err == nil {
+			t.Errorf("expected an error for %v %v", tt.environ, tt.sets)
+		}
+	}
+}
+
+func Test_run_setWithConfigFile(t *testing.T) {
+	var out bytes.Buffer
+	err := run(t.Context(), &out, []string{"-set", "addr=:80", "config.json"})
+	if err == nil || !strings.Contains(err.Error(), "-set") {
+		t.Errorf("expected -set to be rejected with a config file, got %v", err)
+	}
+}
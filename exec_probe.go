@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Health check type that runs an external command.
+const (
+	HealthCheckExec = "exec"
+)
+
+// maxExecOutput bounds how much command output is included in errors.
+const maxExecOutput = 256
+
+// execProbe considers a backend healthy if a command exits with status zero.
+// The backend URL is appended as the last argument and exported to the
+// command as NLB_BACKEND_URL, NLB_BACKEND_HOST and NLB_BACKEND_PORT.
+type execProbe struct {
+	command []string
+}
+
+func newExecProbe(config *HealthCheckConfig) (*execProbe, error) {
+	if len(config.Command) == 0 {
+		return nil, fmt.Errorf("exec health check requires a command")
+	}
+	return &execProbe{command: config.Command}, nil
+}
+
+func (p *execProbe) probe(ctx context.Context, b *Backend) error {
+	args := append(p.command[1:len(p.command):len(p.command)], b.URL.String())
+	cmd := exec.CommandContext(ctx, p.command[0], args...)
+	cmd.Env = append(os.Environ(),
+		"NLB_BACKEND_URL="+b.URL.String(),
+		"NLB_BACKEND_HOST="+b.URL.Hostname(),
+		"NLB_BACKEND_PORT="+b.URL.Port(),
+	)
+
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("health check command did not finish: %w", ctx.Err())
+	}
+
+	out = bytes.TrimSpace(out)
+	if len(out) > maxExecOutput {
+		out = out[:maxExecOutput]
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(out) > 0 {
+		return fmt.Errorf("health check command failed (%v): %s", err, out)
+	}
+	return fmt.Errorf("health check command failed: %w", err)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestExecProbe_probe(t *testing.T) {
+	u, _ := url.Parse("tcp://127.0.0.1:8080")
+	b := &Backend{URL: u}
+
+	probe, err := newExecProbe(&HealthCheckConfig{Command: []string{
+		"sh", "-c", `test "$1" = "$NLB_BACKEND_URL" && test "$NLB_BACKEND_PORT" = 8080`, "check",
+	}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := probe.probe(t.Context(), b); err != nil {
+		t.Errorf("expected probe to pass, got %v", err)
+	}
+
+	probe, _ = newExecProbe(&HealthCheckConfig{Command: []string{"sh", "-c", "echo backend is sad; exit 2"}})
+	err = probe.probe(t.Context(), b)
+	if err == nil || !strings.Contains(err.Error(), "backend is sad") {
+		t.Errorf("expected failure with command output, got %v", err)
+	}
+
+	if _, err := newExecProbe(&HealthCheckConfig{}); err == nil {
+		t.Errorf("expected error without command")
+	}
+}
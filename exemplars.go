@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// openMetricsContentType is the content type of the OpenMetrics text format,
+// the only exposition format that carries exemplars.
+const openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets of latency
+// histograms.
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// exemplar is a sample observed by a latency histogram together with the ID
+// of the connection it was observed for.
+type exemplar struct {
+	id    string
+	value time.Duration
+	time  time.Time
+}
+
+// latencyHistogram counts latency samples in latencyBuckets and keeps the
+// latest exemplar of each bucket. The zero value is ready to use.
+type latencyHistogram struct {
+	mux       sync.Mutex
+	counts    []uint64
+	exemplars []exemplar
+	count     uint64
+	sum       time.Duration
+}
+
+// Observe records a latency sample of the connection with the given ID,
+// which is kept as its bucket's exemplar unless empty.
+func (h *latencyHistogram) Observe(d time.Duration, id string) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets)+1)
+		h.exemplars = make([]exemplar, len(latencyBuckets)+1)
+	}
+	i := len(latencyBuckets)
+	for j, le := range latencyBuckets {
+		if d.Seconds() <= le {
+			i = j
+			break
+		}
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += d
+	if id != "" {
+		h.exemplars[i] = exemplar{id: id, value: d, time: time.Now()}
+	}
+}
+
+// snapshot returns copies of the histogram's bucket counts, which are not
+// cumulative, and exemplars.
+func (h *latencyHistogram) snapshot() (counts []uint64, exemplars []exemplar, count uint64, sum time.Duration) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	counts = make([]uint64, len(latencyBuckets)+1)
+	exemplars = make([]exemplar, len(latencyBuckets)+1)
+	copy(counts, h.counts)
+	copy(exemplars, h.exemplars)
+	return counts, exemplars, h.count, h.sum
+}
+
+// observeDial records the time taken to connect to the backend for the
+// connection with the given ID, or "" if unknown.
+func (b *Backend) observeDial(d time.Duration, id string) {
+	b.DialLatency.Observe(d)
+	b.dialHistogram.Observe(d, id)
+}
+
+// writeLatencyHistogram writes a histogram metric family with per-backend
+// buckets. With exemplars set, each bucket is annotated with the ID of the
+// latest connection it counted as its trace_id.
+func writeLatencyHistogram(w io.Writer, name, help string, backends []*Backend, hist func(*Backend) *latencyHistogram, exemplars bool) {
+	writeMetricHeader(w, name, help, "histogram")
+	for _, b := range backends {
+		counts, ex, count, sum := hist(b).snapshot()
+		var cumulative uint64
+		for i, c := range counts {
+			cumulative += c
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = strconv.FormatFloat(latencyBuckets[i], 'f', -1, 64)
+			}
+			fmt.Fprintf(w, "%s_bucket{backend=%q,le=%q} %d", name, b.URL.String(), le, cumulative)
+			if e := ex[i]; exemplars && e.id != "" {
+				fmt.Fprintf(w, " # {trace_id=%q} %s %s", e.id, formatSeconds(e.value),
+					strconv.FormatFloat(float64(e.time.UnixMilli())/1000, 'f', 3, 64))
+			}
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%s_sum{backend=%q} %s\n", name, b.URL.String(), formatSeconds(sum))
+		fmt.Fprintf(w, "%s_count{backend=%q} %d\n", name, b.URL.String(), count)
+	}
+}
+
+// acceptsOpenMetrics reports whether the scraper asked for the OpenMetrics
+// format.
+func acceptsOpenMetrics(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+}
+
+// negotiateMetrics serves metrics in the OpenMetrics format to scrapers
+// asking for it and in the Prometheus text format to others.
+func negotiateMetrics(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsOpenMetrics(r) {
+			h(w, r)
+			return
+		}
+		buf := newResponseBuffer()
+		h(buf, r)
+		w.Header().Set("Content-Type", openMetricsContentType)
+		writeOpenMetrics(w, buf.String())
+	}
+}
+
+// writeOpenMetrics rewrites metrics in the Prometheus text format to the
+// OpenMetrics format: counter families are named without their _total
+// suffix, and the exposition ends with # EOF.
+func writeOpenMetrics(w io.Writer, text string) {
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(nil, 1<<20)
+	counters := make(map[string]bool)
+	var lines []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if fields := strings.Fields(line); len(fields) == 4 && fields[1] == "TYPE" && fields[3] == "counter" {
+			counters[fields[2]] = true
+		}
+		lines = append(lines, line)
+	}
+	for _, line := range lines {
+		if fields := strings.Fields(line); len(fields) >= 3 && fields[0] == "#" && counters[fields[2]] {
+			line = strings.Replace(line, fields[2], strings.TrimSuffix(fields[2], "_total"), 1)
+		}
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintln(w, "# EOF")
+}
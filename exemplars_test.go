@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var h latencyHistogram
+	h.Observe(3*time.Millisecond, "a-1")
+	h.Observe(4*time.Millisecond, "")
+	h.Observe(10*time.Second, "a-2")
+	counts, exemplars, count, sum := h.snapshot()
+	if counts[2] != 2 || counts[len(latencyBuckets)] != 1 || count != 3 || sum != 10*time.Second+7*time.Millisecond {
+		t.Errorf("unexpected histogram %v, count %d, sum %s", counts, count, sum)
+	}
+	if exemplars[2].id != "a-1" || exemplars[len(latencyBuckets)].id != "a-2" {
+		t.Errorf("expected the latest identified sample of each bucket as its exemplar, got %+v", exemplars)
+	}
+}
+
+func TestBaseServerPool_metricsExemplars(t *testing.T) {
+	pool := newConsoleTestPool("web", true)
+	pool.backends[0].observeDial(2*time.Millisecond, "5f3a9c21-42")
+	scrape := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		negotiateMetrics(pool.metricsHandler)(rec, req)
+		return rec
+	}
+	bucket := `nlb_backend_dial_duration_seconds_bucket{backend="http://localhost:8080",le="0.0025"} 1`
+
+	rec := scrape("text/plain")
+	if !strings.Contains(rec.Body.String(), bucket+"\n") {
+		t.Errorf("expected metrics to contain %q without an exemplar", bucket)
+	}
+	rec = scrape("application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5")
+	if strings.Contains(rec.Body.String(), "trace_id") {
+		t.Errorf("expected no exemplars unless enabled")
+	}
+
+	pool.exemplars = true
+	rec = scrape("text/plain")
+	if strings.Contains(rec.Body.String(), "trace_id") {
+		t.Errorf("expected no exemplars in the Prometheus text format")
+	}
+	rec = scrape("application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5")
+	body := rec.Body.String()
+	if ct := rec.Header().Get("Content-Type"); ct != openMetricsContentType {
+		t.Errorf("expected content type %q, got %q", openMetricsContentType, ct)
+	}
+	for _, want := range []string{bucket + ` # {trace_id="5f3a9c21-42"} 0.002 `, "# TYPE nlb_listener_accepted_connections counter\n", "nlb_listener_accepted_connections_total 0\n"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected openmetrics to contain %q", want)
+		}
+	}
+	if !strings.HasSuffix(body, "# EOF\n") {
+		t.Errorf("expected openmetrics to end with # EOF")
+	}
+}
+
+func Test_writeOpenMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	writeOpenMetrics(&buf, "# HELP a_total A.\n# TYPE a_total counter\na_total 1\n# HELP b_total B.\n# TYPE b_total gauge\nb_total 2\n")
+	want := "# HELP a A.\n# TYPE a counter\na_total 1\n# HELP b_total B.\n# TYPE b_total gauge\nb_total 2\n# EOF\n"
+	if buf.String() != want {
+		t.Errorf("expected %q, got %q", want, buf.String())
+	}
+}
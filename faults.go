@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+// faultInjector injects artificial failures into the data path for
+// resilience testing. A nil *faultInjector injects nothing.
+type faultInjector struct {
+	connectDelay        time.Duration
+	connectDelayPercent float64
+	resetPercent        float64
+	dropPercent         float64
+	backendDropPercent  map[string]float64
+	random              func() float64
+}
+
+// newFaultInjector returns an injector for the given config, or nil if fault
+// injection is not enabled.
+func newFaultInjector(config *FaultInjectionConfig) (*faultInjector, error) {
+	if config == nil || !config.Enabled {
+		return nil, nil
+	}
+
+	f := &faultInjector{
+		connectDelayPercent: config.ConnectDelayPercent,
+		resetPercent:        config.ResetPercent,
+		dropPercent:         config.DropPercent,
+		backendDropPercent:  config.BackendDropPercent,
+		random:              rand.Float64,
+	}
+	if config.ConnectDelay != "" {
+		d, err := time.ParseDuration(config.ConnectDelay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fault injection connect delay: %w", err)
+		}
+		f.connectDelay = d
+		if f.connectDelayPercent == 0 {
+			f.connectDelayPercent = 100
+		}
+	}
+
+	percents := []float64{f.connectDelayPercent, f.resetPercent, f.dropPercent}
+	for _, p := range f.backendDropPercent {
+		percents = append(percents, p)
+	}
+	for _, p := range percents {
+		if p < 0 || p > 100 {
+			return nil, fmt.Errorf("invalid fault injection percentage: %v", p)
+		}
+	}
+
+	return f, nil
+}
+
+// roll reports whether an event with the given percentage chance occurs.
+func (f *faultInjector) roll(percent float64) bool {
+	return percent > 0 && f.random()*100 < percent
+}
+
+// ConnectDelay returns the artificial delay to apply before dialing a backend.
+func (f *faultInjector) ConnectDelay() time.Duration {
+	if f == nil || !f.roll(f.connectDelayPercent) {
+		return 0
+	}
+	return f.connectDelay
+}
+
+// WaitConnectDelay waits for the artificial delay to apply before dialing a
+// backend, returning early with ctx's error if ctx is done, so that a long
+// delay does not hold connections past shutdown.
+func (f *faultInjector) WaitConnectDelay(ctx context.Context) error {
+	delay := f.ConnectDelay()
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// MaybeReset aborts the client connection with a TCP reset and reports
+// whether it did so.
+func (f *faultInjector) MaybeReset(conn net.Conn) bool {
+	if f == nil || !f.roll(f.resetPercent) {
+		return false
+	}
+	if nc, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = nc.NetConn()
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		// A zero linger discards unsent data and sends RST instead of FIN.
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+	return true
+}
+
+// ShouldDrop reports whether a datagram destined for the backend should be dropped.
+func (f *faultInjector) ShouldDrop(b *Backend) bool {
+	if f == nil {
+		return false
+	}
+	if p, ok := f.backendDropPercent[b.URL.String()]; ok {
+		return f.roll(p)
+	}
+	if p, ok := f.backendDropPercent[b.URL.Host]; ok {
+		return f.roll(p)
+	}
+	return f.roll(f.dropPercent)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_newFaultInjector(t *testing.T) {
+	f, err := newFaultInjector(&FaultInjectionConfig{Enabled: false, ResetPercent: 50})
+	if err != nil || f != nil {
+		t.Errorf("expected nil injector when disabled, got %v (%v)", f, err)
+	}
+
+	f, err = newFaultInjector(&FaultInjectionConfig{Enabled: true, ConnectDelay: "10ms"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if f.connectDelay != 10*time.Millisecond || f.connectDelayPercent != 100 {
+		t.Errorf("expected 10ms delay for all connections, got %s for %v%%", f.connectDelay, f.connectDelayPercent)
+	}
+
+	if _, err := newFaultInjector(&FaultInjectionConfig{Enabled: true, DropPercent: 101}); err == nil {
+		t.Errorf("expected error for invalid percentage")
+	}
+	if _, err := newFaultInjector(&FaultInjectionConfig{Enabled: true, ConnectDelay: "soon"}); err == nil {
+		t.Errorf("expected error for invalid delay")
+	}
+}
+
+func TestFaultInjector_nil(t *testing.T) {
+	var f *faultInjector
+	if f.ConnectDelay() != 0 || f.ShouldDrop(&Backend{}) || f.MaybeReset(nil) {
+		t.Errorf("expected nil injector to inject nothing")
+	}
+}
+
+func TestFaultInjector_ShouldDrop(t *testing.T) {
+	f, err := newFaultInjector(&FaultInjectionConfig{
+		Enabled:            true,
+		DropPercent:        10,
+		BackendDropPercent: map[string]float64{"http://localhost:8081": 50},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	f.random = func() float64 { return 0.3 }
+
+	u1, _ := url.Parse("http://localhost:8080")
+	u2, _ := url.Parse("http://localhost:8081")
+	if f.ShouldDrop(&Backend{URL: u1}) {
+		t.Errorf("expected default drop percentage to apply")
+	}
+	if !f.ShouldDrop(&Backend{URL: u2}) {
+		t.Errorf("expected backend drop percentage to apply")
+	}
+}
+
+func TestFaultInjector_MaybeReset(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+
+	f := &faultInjector{resetPercent: 100, random: func() float64 { return 0 }}
+	if !f.MaybeReset(conn) {
+		t.Fatalf("expected connection to be reset")
+	}
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(make([]byte, 1))
+	if !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("expected connection reset, got %v", err)
+	}
+}
+
+func TestFaultInjector_WaitConnectDelay(t *testing.T) {
+	f, err := newFaultInjector(&FaultInjectionConfig{Enabled: true, ConnectDelay: "1h"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	start := time.Now()
+	if err := f.WaitConnectDelay(ctx); err != context.Canceled || time.Since(start) > time.Second {
+		t.Errorf("expected the delay to end with the context, got %v after %s", err, time.Since(start))
+	}
+	var none *faultInjector
+	if err := none.WaitConnectDelay(ctx); err != nil {
+		t.Errorf("expected no delay without fault injection, got %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// fdSampleInterval is how long a count of open file descriptors is reused,
+// since counting them lists a directory.
+const fdSampleInterval = time.Second
+
+// defaultFDWatermark is the share of the file descriptor limit above which
+// new connections are shed.
+const defaultFDWatermark = 0.9
+
+// Delays between accepts while the process is out of file descriptors.
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// fdMonitor samples the file descriptors open in the process. The zero
+// value is ready to use.
+type fdMonitor struct {
+	mux     sync.Mutex
+	sampled time.Time
+	open    int
+	limit   int
+	err     error
+}
+
+// processFDs monitors the file descriptors of the process, which all
+// listeners share.
+var processFDs fdMonitor
+
+// usage returns the number of open file descriptors and their soft limit,
+// counted at most fdSampleInterval before now.
+func (m *fdMonitor) usage(now time.Time) (open, limit int, err error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.sampled.IsZero() || now.Sub(m.sampled) >= fdSampleInterval {
+		m.open, m.limit, m.err = openFDs()
+		m.sampled = now
+	}
+	return m.open, m.limit, m.err
+}
+
+// fdLimit sheds new connections while the file descriptors open in the
+// process are above a watermark of the limit, so that the listener keeps
+// serving the connections it has instead of failing to accept or dial.
+type fdLimit struct {
+	watermark float64
+	monitor   *fdMonitor
+	shedding  atomic.Bool
+	shed      atomic.Uint64
+}
+
+func newFDLimit(config *FDLimitConfig) (*fdLimit, error) {
+	if config == nil || !config.Enabled {
+		return nil, nil
+	}
+	f := &fdLimit{watermark: defaultFDWatermark, monitor: &processFDs}
+	if config.Watermark != 0 {
+		if config.Watermark < 0 || config.Watermark > 1 {
+			return nil, fmt.Errorf("fd_limit watermark must be between 0 and 1")
+		}
+		f.watermark = config.Watermark
+	}
+	if _, _, err := openFDs(); err != nil {
+		return nil, fmt.Errorf("fd_limit: %w", err)
+	}
+	return f, nil
+}
+
+// admit reports whether a new connection may be served at now, logging to
+// l when shedding starts and stops. A nil fdLimit admits every connection.
+func (f *fdLimit) admit(now time.Time, l *log.Logger) bool {
+	if f == nil {
+		return true
+	}
+	open, limit, err := f.monitor.usage(now)
+	if err != nil || limit <= 0 {
+		return true
+	}
+	over := float64(open) >= f.watermark*float64(limit)
+	if f.shedding.Swap(over) != over {
+		if over {
+			infof(l, "%d of %d file descriptors open, above the %.0f%% watermark: shedding new connections", open, limit, 100*f.watermark)
+		} else {
+			infof(l, "%d of %d file descriptors open, below the %.0f%% watermark: accepting new connections", open, limit, 100*f.watermark)
+		}
+	}
+	if over {
+		f.shed.Add(1)
+	}
+	return !over
+}
+
+// isFDExhausted reports whether err is due to the process or the system
+// running out of file descriptors.
+func isFDExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// nextAcceptBackoff returns how long to wait before accepting again after
+// running out of file descriptors, doubling the previous wait.
+func nextAcceptBackoff(prev time.Duration) time.Duration {
+	return min(max(2*prev, minAcceptBackoff), maxAcceptBackoff)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_newFDLimit(t *testing.T) {
+	if f, err := newFDLimit(nil); f != nil || err != nil {
+		t.Errorf("expected no limit when not configured, got %v, %v", f, err)
+	}
+	for _, watermark := range []float64{-0.5, 1.5} {
+		if _, err := newFDLimit(&FDLimitConfig{Enabled: true, Watermark: watermark}); err == nil {
+			t.Errorf("expected an error for watermark %v", watermark)
+		}
+	}
+	if _, _, err := openFDs(); err != nil {
+		t.Skipf("open file descriptors cannot be counted: %v", err)
+	}
+	f, err := newFDLimit(&FDLimitConfig{Enabled: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if f.watermark != defaultFDWatermark {
+		t.Errorf("expected watermark %v, got %v", defaultFDWatermark, f.watermark)
+	}
+}
+
+func Test_openFDs(t *testing.T) {
+	open, limit, err := openFDs()
+	if err != nil {
+		t.Skipf("open file descriptors cannot be counted: %v", err)
+	}
+	// At least stdin, stdout and stderr are open.
+	if open < 3 || limit < open {
+		t.Errorf("unexpected usage of %d of %d file descriptors", open, limit)
+	}
+}
+
+func TestFDLimit_admit(t *testing.T) {
+	var f *fdLimit
+	if !f.admit(time.Now(), nil) {
+		t.Errorf("expected a nil limit to admit every connection")
+	}
+
+	now := time.Now()
+	monitor := &fdMonitor{sampled: now, open: 80, limit: 100}
+	f = &fdLimit{watermark: 0.9, monitor: monitor}
+	var logs strings.Builder
+	l := log.New(&logs, "", 0)
+	if !f.admit(now, l) {
+		t.Errorf("expected a connection below the watermark to be admitted")
+	}
+	monitor.open = 90
+	for range 2 {
+		if f.admit(now, l) {
+			t.Errorf("expected a connection at the watermark to be shed")
+		}
+	}
+	monitor.open = 50
+	if !f.admit(now, l) {
+		t.Errorf("expected connections to be admitted once below the watermark")
+	}
+	if got := f.shed.Load(); got != 2 {
+		t.Errorf("expected 2 shed connections, got %d", got)
+	}
+	// Only the transitions are logged.
+	if lines := strings.Count(logs.String(), "\n"); lines != 2 || !strings.Contains(logs.String(), "shedding new connections") {
+		t.Errorf("unexpected logs %q", logs.String())
+	}
+}
+
+func Test_isFDExhausted(t *testing.T) {
+	err := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", syscall.EMFILE)}
+	if !isFDExhausted(err) {
+		t.Errorf("expected %v to be reported as out of file descriptors", err)
+	}
+	if isFDExhausted(net.ErrClosed) {
+		t.Errorf("expected %v not to be reported as out of file descriptors", net.ErrClosed)
+	}
+}
+
+func Test_nextAcceptBackoff(t *testing.T) {
+	var backoff time.Duration
+	for _, want := range []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond} {
+		if backoff = nextAcceptBackoff(backoff); backoff != want {
+			t.Errorf("expected backoff %s, got %s", want, backoff)
+		}
+	}
+	if got := nextAcceptBackoff(800 * time.Millisecond); got != maxAcceptBackoff {
+		t.Errorf("expected backoff to be capped at %s, got %s", maxAcceptBackoff, got)
+	}
+}
+
+func TestBaseServerPool_metricsHandler_fdLimit(t *testing.T) {
+	if _, _, err := openFDs(); err != nil {
+		t.Skipf("open file descriptors cannot be counted: %v", err)
+	}
+	pool := newConsoleTestPool("", true)
+	pool.fdLimit = &fdLimit{watermark: 0.9, monitor: &processFDs}
+	pool.fdLimit.shed.Add(3)
+	rec := httptest.NewRecorder()
+	pool.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{"nlb_open_fds ", "nlb_max_fds ", "nlb_fd_shedding 0", "nlb_fd_shed_connections_total 3"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("expected metrics to contain %q", want)
+		}
+	}
+}
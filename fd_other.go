@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// openFDs is not supported on this platform.
+func openFDs() (open, limit int, err error) {
+	return 0, 0, errors.New("counting open file descriptors is not supported on this platform")
+}
@@ -0,0 +1,27 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"math"
+	"os"
+	"syscall"
+)
+
+// openFDs returns the number of file descriptors open in the process and
+// its soft limit on them.
+func openFDs() (open, limit int, err error) {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, 0, os.NewSyscallError("getrlimit", err)
+	}
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		if entries, err = os.ReadDir("/dev/fd"); err != nil {
+			return 0, 0, err
+		}
+	}
+	// Reading the directory opened one more descriptor, which is closed
+	// by now.
+	return max(len(entries)-1, 0), int(min(rlimit.Cur, uint64(math.MaxInt))), nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultFirstByteTimeout  = time.Second
+	defaultFirstByteMaxBytes = 64
+	maxFirstByteMaxBytes     = 4096
+	defaultFirstByteLabel    = "protocol"
+)
+
+// firstByteUnmatched counts connections no rule matched.
+const firstByteUnmatched = "unmatched"
+
+// firstByteRule routes connections whose first bytes start with prefix, or
+// match pattern, to the backends of group.
+type firstByteRule struct {
+	group   string
+	prefix  []byte
+	pattern *regexp.Regexp
+}
+
+// match reports whether the rule matches data, or prefixUndecided if more
+// bytes are needed to tell.
+func (r *firstByteRule) match(data []byte) int {
+	if r.pattern != nil {
+		if r.pattern.Match(data) {
+			return prefixMatch
+		}
+		return prefixUndecided
+	}
+	switch {
+	case bytes.HasPrefix(data, r.prefix):
+		return prefixMatch
+	case len(data) < len(r.prefix) && bytes.HasPrefix(r.prefix, data):
+		return prefixUndecided
+	default:
+		return prefixMismatch
+	}
+}
+
+// firstByteRouter reads the first bytes clients of a TCP listener send and
+// routes each connection to the backends of the group of the first rule
+// they match, so several protocols can share a port.
+type firstByteRouter struct {
+	timeout  time.Duration
+	maxBytes int
+	label    string
+	rules    []*firstByteRule
+	// fallback is the group of connections no rule matches, including
+	// clients that send nothing in time; if empty they are rejected.
+	fallback string
+
+	routed map[string]*atomic.Uint64
+}
+
+func newFirstByteRouter(cfg *FirstByteRoutingConfig) (*firstByteRouter, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+	if len(cfg.Rules) == 0 {
+		return nil, fmt.Errorf("first_byte_routing requires at least one rule")
+	}
+	r := &firstByteRouter{
+		timeout:  defaultFirstByteTimeout,
+		maxBytes: cmp.Or(cfg.MaxBytes, defaultFirstByteMaxBytes),
+		label:    cmp.Or(cfg.GroupLabel, defaultFirstByteLabel),
+		fallback: cfg.Default,
+		routed:   map[string]*atomic.Uint64{firstByteUnmatched: new(atomic.Uint64)},
+	}
+	if cfg.Timeout != "" {
+		d, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid first_byte_routing timeout: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("first_byte_routing timeout must be positive")
+		}
+		r.timeout = d
+	}
+	if r.maxBytes < 1 || r.maxBytes > maxFirstByteMaxBytes {
+		return nil, fmt.Errorf("first_byte_routing max_bytes must be between 1 and %d", maxFirstByteMaxBytes)
+	}
+	for i, rc := range cfg.Rules {
+		rule, err := newFirstByteRule(rc)
+		if err != nil {
+			return nil, fmt.Errorf("first_byte_routing rule %d: %w", i, err)
+		}
+		if len(rule.prefix) > r.maxBytes {
+			return nil, fmt.Errorf("first_byte_routing rule %d: prefix is longer than max_bytes", i)
+		}
+		r.rules = append(r.rules, rule)
+		r.routed[rule.group] = new(atomic.Uint64)
+	}
+	if r.fallback != "" {
+		r.routed[r.fallback] = new(atomic.Uint64)
+	}
+	return r, nil
+}
+
+func newFirstByteRule(rc FirstByteRuleConfig) (*firstByteRule, error) {
+	if rc.Group == "" {
+		return nil, errors.New("group is required")
+	}
+	rule := &firstByteRule{group: rc.Group}
+	set := 0
+	if rc.Prefix != "" {
+		rule.prefix = []byte(rc.Prefix)
+		set++
+	}
+	if rc.PrefixHex != "" {
+		prefix, err := hex.DecodeString(strings.ReplaceAll(rc.PrefixHex, " ", ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix_hex: %w", err)
+		}
+		rule.prefix = prefix
+		set++
+	}
+	if rc.Regexp != "" {
+		pattern, err := regexp.Compile(rc.Regexp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regexp: %w", err)
+		}
+		rule.pattern = pattern
+		set++
+	}
+	if set != 1 || (rule.pattern == nil && len(rule.prefix) == 0) {
+		return nil, errors.New("exactly one of prefix, prefix_hex and regexp must be set")
+	}
+	return rule, nil
+}
+
+// classify returns the group of the first rule matching data, which is all
+// the client sent if final is set. It returns false if an earlier rule
+// needs more bytes to tell.
+func (r *firstByteRouter) classify(data []byte, final bool) (string, bool) {
+	for _, rule := range r.rules {
+		switch rule.match(data) {
+		case prefixMatch:
+			return rule.group, true
+		case prefixUndecided:
+			if !final {
+				return "", false
+			}
+		}
+	}
+	return "", true
+}
+
+// route reads up to maxBytes from the client, waiting at most the timeout,
+// and returns a connection replaying them with the group the connection is
+// routed to. It returns an error if no rule matches and there is no default
+// group.
+func (r *firstByteRouter) route(conn net.Conn) (net.Conn, string, error) {
+	br := bufio.NewReaderSize(conn, r.maxBytes)
+	conn.SetReadDeadline(time.Now().Add(r.timeout))
+	var group string
+	data := peekUntil(br, func(b []byte) bool {
+		g, decided := r.classify(b, len(b) >= r.maxBytes)
+		group = g
+		return decided
+	})
+	conn.SetReadDeadline(time.Time{})
+	if group == "" {
+		// The client stopped sending, or sent all it could, before the
+		// rules were decided.
+		group, _ = r.classify(data, true)
+	}
+	if group == "" {
+		group = r.fallback
+	}
+	if group == "" {
+		r.routed[firstByteUnmatched].Add(1)
+		return nil, "", fmt.Errorf("no first_byte_routing rule matches the first %d bytes", len(data))
+	}
+	r.routed[group].Add(1)
+	return &peekedConn{Conn: conn, r: br}, group, nil
+}
+
+// Routed returns the number of connections routed to each group, and
+// rejected as unmatched.
+func (r *firstByteRouter) Routed() map[string]uint64 {
+	counts := make(map[string]uint64, len(r.routed))
+	for group, n := range r.routed {
+		counts[group] = n.Load()
+	}
+	return counts
+}
+
+// nextInGroup returns the next available backend whose label is group, or
+// nil if there is none.
+func (p *BaseServerPool) nextInGroup(conn net.Addr, label, group string) *Backend {
+	s := p.currentSelection()
+	return p.selectBackend(s, s.labelled[labelValue{label, group}], conn)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_newFirstByteRouter(t *testing.T) {
+	if r, err := newFirstByteRouter(nil); r != nil || err != nil {
+		t.Errorf("expected no router when not configured, got %v, %v", r, err)
+	}
+	r, err := newFirstByteRouter(&FirstByteRoutingConfig{Enabled: true, Rules: []FirstByteRuleConfig{{Group: "tls", PrefixHex: "16 03"}}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if r.timeout != defaultFirstByteTimeout || r.maxBytes != defaultFirstByteMaxBytes || r.label != defaultFirstByteLabel {
+		t.Errorf("unexpected defaults %+v", r)
+	}
+	if string(r.rules[0].prefix) != "\x16\x03" {
+		t.Errorf("expected the hex prefix to be decoded, got %q", r.rules[0].prefix)
+	}
+
+	for _, cfg := range []*FirstByteRoutingConfig{
+		{Enabled: true},
+		{Enabled: true, Rules: []FirstByteRuleConfig{{Prefix: "SSH-"}}},
+		{Enabled: true, Rules: []FirstByteRuleConfig{{Group: "ssh"}}},
+		{Enabled: true, Rules: []FirstByteRuleConfig{{Group: "ssh", Prefix: "SSH-", Regexp: "^SSH"}}},
+		{Enabled: true, Rules: []FirstByteRuleConfig{{Group: "tls", PrefixHex: "zz"}}},
+		{Enabled: true, Rules: []FirstByteRuleConfig{{Group: "http", Regexp: "("}}},
+		{Enabled: true, MaxBytes: 2, Rules: []FirstByteRuleConfig{{Group: "ssh", Prefix: "SSH-"}}},
+		{Enabled: true, Timeout: "0s", Rules: []FirstByteRuleConfig{{Group: "ssh", Prefix: "SSH-"}}},
+	} {
+		if _, err := newFirstByteRouter(cfg); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
+
+func TestFirstByteRouter_classify(t *testing.T) {
+	r, err := newFirstByteRouter(&FirstByteRoutingConfig{Enabled: true, Rules: []FirstByteRuleConfig{
+		{Group: "ssh", Prefix: "SSH-"},
+		{Group: "http", Regexp: `^(GET|POST) `},
+		{Group: "tls", PrefixHex: "16"},
+	}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	tests := []struct {
+		data    string
+		final   bool
+		group   string
+		decided bool
+	}{
+		{"SS", false, "", false},
+		{"SSH-2.0-OpenSSH", false, "ssh", true},
+		{"GET / HTTP/1.1", false, "http", true},
+		// The regexp rule may still match once more bytes arrive.
+		{"\x16\x03\x01", false, "", false},
+		{"\x16\x03\x01", true, "tls", true},
+		{"hello", true, "", true},
+	}
+	for _, tt := range tests {
+		group, decided := r.classify([]byte(tt.data), tt.final)
+		if group != tt.group || decided != tt.decided {
+			t.Errorf("classify(%q, %t): expected %q, %t, got %q, %t", tt.data, tt.final, tt.group, tt.decided, group, decided)
+		}
+	}
+}
+
+func TestTCPServerPool_firstByteRouting(t *testing.T) {
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr: "127.0.0.1:0",
+		Backends: []BackendConfig{
+			{URL: "tcp://" + startNamedBackend(t, "ssh"), Labels: map[string]string{"protocol": "ssh"}},
+			{URL: "tcp://" + startNamedBackend(t, "web"), Labels: map[string]string{"protocol": "http"}},
+		},
+		FirstByteRouting: &FirstByteRoutingConfig{
+			Enabled: true,
+			Timeout: "100ms",
+			Rules: []FirstByteRuleConfig{
+				{Group: "ssh", Prefix: "SSH-"},
+				{Group: "http", Regexp: `^[A-Z]+ \S+ HTTP/1\.[01]\r\n`},
+			},
+			Default: "ssh",
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, b := range pool.backends {
+		b.SetHealthy(true)
+	}
+	pool.Start()
+	defer pool.Shutdown(t.Context())
+	addr := pool.listener.Addr().String()
+
+	connect := func(send string) string {
+		t.Helper()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(send))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		r := bufio.NewReader(conn)
+		name, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read greeting: %v", err)
+		}
+		if send != "" {
+			// The bytes read to route the connection reach the backend.
+			echo := make([]byte, len(send))
+			if _, err := io.ReadFull(r, echo); err != nil || string(echo) != send {
+				t.Errorf("expected %q to be echoed, got %q, %v", send, echo, err)
+			}
+		}
+		return strings.TrimSpace(name)
+	}
+
+	if got := connect("SSH-2.0-client\r\n"); got != "ssh" {
+		t.Errorf("expected the SSH client to reach ssh, got %s", got)
+	}
+	if got := connect("GET / HTTP/1.1\r\nHost: x\r\n\r\n"); got != "web" {
+		t.Errorf("expected the HTTP client to reach web, got %s", got)
+	}
+	// Clients sending nothing go to the default group.
+	if got := connect(""); got != "ssh" {
+		t.Errorf("expected a silent client to reach the default group, got %s", got)
+	}
+
+	rec := httptest.NewRecorder()
+	pool.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`nlb_first_byte_routed_connections_total{group="ssh"} 2`,
+		`nlb_first_byte_routed_connections_total{group="http"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("expected metrics to contain %q", want)
+		}
+	}
+}
+
+func TestTCPServerPool_firstByteRouting_unmatched(t *testing.T) {
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:     "127.0.0.1:0",
+		Backends: []BackendConfig{{URL: "tcp://" + startNamedBackend(t, "ssh"), Labels: map[string]string{"protocol": "ssh"}}},
+		FirstByteRouting: &FirstByteRoutingConfig{
+			Enabled: true,
+			Rules:   []FirstByteRuleConfig{{Group: "ssh", Prefix: "SSH-"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	pool.backends[0].SetHealthy(true)
+	pool.Start()
+	defer pool.Shutdown(t.Context())
+
+	conn, err := net.Dial("tcp", pool.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("HELO example.com\r\n"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the unmatched connection to be closed, got %v", err)
+	}
+	if got := pool.firstByte.Routed()[firstByteUnmatched]; got != 1 {
+		t.Errorf("expected 1 unmatched connection, got %d", got)
+	}
+}
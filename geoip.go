@@ -0,0 +1,191 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// geoInfo is what the GeoIP databases know about a client.
+type geoInfo struct {
+	Country   string
+	Continent string
+	ASN       uint64
+}
+
+// tag returns the prefix of the client's log lines, or "" if nothing is
+// known about it.
+func (info geoInfo) tag() string {
+	var parts []string
+	if info.Country != "" {
+		parts = append(parts, info.Country)
+	}
+	if info.ASN != 0 {
+		parts = append(parts, "AS"+strconv.FormatUint(info.ASN, 10))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "[geo " + strings.Join(parts, " ") + "] "
+}
+
+// geoRule routes clients from any of its countries or continents to a
+// backend group.
+type geoRule struct {
+	countries  []string
+	continents []string
+	group      string
+}
+
+func (r geoRule) matches(info geoInfo) bool {
+	return (info.Country != "" && slices.Contains(r.countries, info.Country)) ||
+		(info.Continent != "" && slices.Contains(r.continents, info.Continent))
+}
+
+// geoIP tags connections with the country and autonomous system of the
+// client, looked up in MaxMind databases, and routes clients from some
+// regions to the backends whose label is a given group.
+type geoIP struct {
+	country *mmdb
+	asn     *mmdb
+	label   string
+	rules   []geoRule
+
+	mux       sync.Mutex
+	countries map[string]uint64
+	routed    map[string]*atomic.Uint64
+}
+
+func newGeoIP(config *GeoIPConfig) (*geoIP, error) {
+	if config == nil || !config.Enabled {
+		return nil, nil
+	}
+	if config.CountryDB == "" && config.ASNDB == "" {
+		return nil, fmt.Errorf("geoip requires country_db or asn_db")
+	}
+	g := &geoIP{
+		label:     cmp.Or(config.GroupLabel, "region"),
+		countries: make(map[string]uint64),
+		routed:    make(map[string]*atomic.Uint64),
+	}
+	var err error
+	if config.CountryDB != "" {
+		if g.country, err = openMMDB(config.CountryDB); err != nil {
+			return nil, fmt.Errorf("invalid geoip country_db: %w", err)
+		}
+	}
+	if config.ASNDB != "" {
+		if g.asn, err = openMMDB(config.ASNDB); err != nil {
+			return nil, fmt.Errorf("invalid geoip asn_db: %w", err)
+		}
+	}
+	if len(config.Rules) > 0 && g.country == nil {
+		return nil, fmt.Errorf("geoip rules require country_db")
+	}
+	for i, rc := range config.Rules {
+		if rc.Group == "" {
+			return nil, fmt.Errorf("geoip rule %d requires a group", i)
+		}
+		if len(rc.Countries) == 0 && len(rc.Continents) == 0 {
+			return nil, fmt.Errorf("geoip rule %d requires countries or continents", i)
+		}
+		rule := geoRule{group: rc.Group}
+		for _, c := range rc.Countries {
+			rule.countries = append(rule.countries, strings.ToUpper(c))
+		}
+		for _, c := range rc.Continents {
+			rule.continents = append(rule.continents, strings.ToUpper(c))
+		}
+		g.rules = append(g.rules, rule)
+		if g.routed[rc.Group] == nil {
+			g.routed[rc.Group] = new(atomic.Uint64)
+		}
+	}
+	return g, nil
+}
+
+// lookup returns what the databases know about a client. Lookup errors are
+// treated as the client not being found.
+func (g *geoIP) lookup(client net.Addr) geoInfo {
+	var info geoInfo
+	addr, ok := addrFromNetAddr(client)
+	if !ok {
+		return info
+	}
+	if g.country != nil {
+		if record, err := g.country.lookup(addr); err == nil && record != nil {
+			info.Country = recordString(record, "country", "iso_code")
+			if info.Country == "" {
+				info.Country = recordString(record, "registered_country", "iso_code")
+			}
+			info.Continent = recordString(record, "continent", "code")
+		}
+	}
+	if g.asn != nil {
+		if record, err := g.asn.lookup(addr); err == nil && record != nil {
+			info.ASN, _ = record["autonomous_system_number"].(uint64)
+		}
+	}
+	return info
+}
+
+// recordString returns the string at path in a record, or "".
+func recordString(record map[string]any, path ...string) string {
+	var v any = record
+	for _, key := range path {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return ""
+		}
+		v = m[key]
+	}
+	s, _ := v.(string)
+	return s
+}
+
+// locate looks up a client, counts it by country and returns the logger of
+// its connection, tagged with its country and AS number, and the group its
+// region is routed to, if any. A nil geoIP returns l and no group.
+func (g *geoIP) locate(client net.Addr, l *log.Logger) (*log.Logger, string) {
+	if g == nil {
+		return l, ""
+	}
+	info := g.lookup(client)
+	g.mux.Lock()
+	g.countries[cmp.Or(info.Country, "unknown")]++
+	g.mux.Unlock()
+	if tag := info.tag(); tag != "" {
+		l = log.New(l.Writer(), l.Prefix()+tag, l.Flags())
+	}
+	for _, r := range g.rules {
+		if r.matches(info) {
+			return l, r.group
+		}
+	}
+	return l, ""
+}
+
+// Countries returns the number of clients seen from each country, with
+// clients not found in the database counted as "unknown".
+func (g *geoIP) Countries() map[string]uint64 {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	return maps.Clone(g.countries)
+}
+
+// nextInRegion returns the next available backend of the group a client's
+// region is routed to, or any backend if the group has none available.
+func (p *BaseServerPool) nextInRegion(conn net.Addr, group string) *Backend {
+	if b := p.nextInGroup(conn, p.geoIP.label, group); b != nil {
+		p.geoIP.routed[group].Add(1)
+		return b
+	}
+	return p.Next(conn)
+}
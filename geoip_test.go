@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testGeoNetworks locates loopback clients in Germany, in AS 64500.
+var testGeoNetworks = map[string]map[string]any{
+	"127.0.0.0/8": {
+		"continent": map[string]any{"code": "EU"},
+		"country":   map[string]any{"iso_code": "DE"},
+	},
+	"192.0.2.0/24": {
+		"continent":          map[string]any{"code": "NA"},
+		"registered_country": map[string]any{"iso_code": "US"},
+	},
+}
+
+var testASNNetworks = map[string]map[string]any{
+	"127.0.0.0/8": {
+		"autonomous_system_number":       uint32(64500),
+		"autonomous_system_organization": "Example",
+	},
+}
+
+func Test_newGeoIP(t *testing.T) {
+	if g, err := newGeoIP(nil); g != nil || err != nil {
+		t.Errorf("expected no geoip when not configured, got %v, %v", g, err)
+	}
+	countryDB := writeTestMMDB(t, testGeoNetworks)
+	for _, config := range []*GeoIPConfig{
+		{Enabled: true},
+		{Enabled: true, CountryDB: "/nonexistent.mmdb"},
+		{Enabled: true, ASNDB: writeTestMMDB(t, testASNNetworks), Rules: []GeoIPRuleConfig{{Countries: []string{"DE"}, Group: "eu"}}},
+		{Enabled: true, CountryDB: countryDB, Rules: []GeoIPRuleConfig{{Countries: []string{"DE"}}}},
+		{Enabled: true, CountryDB: countryDB, Rules: []GeoIPRuleConfig{{Group: "eu"}}},
+	} {
+		if _, err := newGeoIP(config); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
+
+func TestGeoIP_locate(t *testing.T) {
+	g, err := newGeoIP(&GeoIPConfig{
+		Enabled:   true,
+		CountryDB: writeTestMMDB(t, testGeoNetworks),
+		ASNDB:     writeTestMMDB(t, testASNNetworks),
+		Rules: []GeoIPRuleConfig{
+			{Countries: []string{"fr"}, Group: "eu-west"},
+			{Continents: []string{"eu"}, Group: "eu"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create geoip: %v", err)
+	}
+	var logs bytes.Buffer
+	base := log.New(&logs, "[conn 1] ", 0)
+	for _, tt := range []struct {
+		client string
+		tag    string
+		group  string
+	}{
+		{"127.0.0.1", "[conn 1] [geo DE AS64500] ", "eu"},
+		{"192.0.2.1", "[conn 1] [geo US] ", ""},
+		{"203.0.113.1", "[conn 1] ", ""},
+	} {
+		l, group := g.locate(&net.TCPAddr{IP: net.ParseIP(tt.client)}, base)
+		if l.Prefix() != tt.tag || group != tt.group {
+			t.Errorf("expected %s to be tagged %q and routed to %q, got %q and %q", tt.client, tt.tag, tt.group, l.Prefix(), group)
+		}
+	}
+	if got := g.Countries(); got["DE"] != 1 || got["US"] != 1 || got["unknown"] != 1 {
+		t.Errorf("unexpected country counts %v", got)
+	}
+
+	var none *geoIP
+	if l, group := none.locate(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, base); l != base || group != "" {
+		t.Errorf("expected a nil geoip to leave connections untagged")
+	}
+}
+
+func TestTCPServerPool_geoIP(t *testing.T) {
+	config := &Config{
+		Addr: "127.0.0.1:0",
+		GeoIP: &GeoIPConfig{
+			Enabled:   true,
+			CountryDB: writeTestMMDB(t, testGeoNetworks),
+			Rules:     []GeoIPRuleConfig{{Countries: []string{"DE"}, Group: "eu"}},
+		},
+		Backends: []BackendConfig{
+			{URL: "tcp://" + startNamedBackend(t, "a"), Labels: map[string]string{"region": "us"}},
+			{URL: "tcp://" + startNamedBackend(t, "b"), Labels: map[string]string{"region": "eu"}},
+		},
+	}
+	var logs syncBuffer
+	pool, err := NewTCPServerPool(log.New(&logs, "", 0), config)
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	for _, b := range pool.backends {
+		b.SetHealthy(true)
+	}
+	if err := pool.Start(); err != nil {
+		t.Fatalf("failed to start server pool: %v", err)
+	}
+	shutdownOnCleanup(t, pool)
+
+	for range 4 {
+		conn, err := net.Dial("tcp", pool.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		conn.Close()
+		if got := string(buf[:1]); got != "b" {
+			t.Errorf("expected a client in Germany to reach the eu backend, got %s", got)
+		}
+	}
+	waitFor(t, "the connections to be logged", func() bool { return strings.Count(logs.String(), "closed after") == 4 })
+	if !strings.Contains(logs.String(), "[geo DE] connection from") {
+		t.Errorf("expected connection logs to be tagged with the country, got %q", logs.String())
+	}
+
+	rec := httptest.NewRecorder()
+	pool.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{`nlb_geoip_connections_total{country="DE"} 4`, `nlb_geoip_routed_connections_total{group="eu"} 4`} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("expected metrics to contain %q", want)
+		}
+	}
+}
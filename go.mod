@@ -1,3 +1,9 @@
 module github.com/npezzotti/go-lb
 
 go 1.24.4
+
+require (
+	github.com/fsnotify/fsnotify v1.9.0
+	golang.org/x/net v0.44.0
+	golang.org/x/sys v0.36.0
+)
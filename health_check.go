@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Health check types shared by all protocols.
+const (
+	HealthCheckICMP = "icmp"
+)
+
+// healthCheckTimeout is the default bound on a single health check probe.
+const healthCheckTimeout = 2 * time.Second
+
+// prober checks the health of a single backend. Probes must give up when ctx
+// is done; its deadline is the probe timeout.
+type prober interface {
+	probe(ctx context.Context, b *Backend) error
+}
+
+// healthCheck is a prober together with its per-probe timeout and the
+// latency above which a passing probe degrades the backend, if any.
+type healthCheck struct {
+	prober          prober
+	timeout         time.Duration
+	degradedLatency time.Duration
+}
+
+// newHealthCheck builds the health check described by config for a pool of
+// the given protocol.
+func newHealthCheck(l *log.Logger, protocol string, config *HealthCheckConfig) (healthCheck, error) {
+	pr, err := newProber(l, protocol, config)
+	if err != nil {
+		return healthCheck{}, err
+	}
+	hc := healthCheck{prober: pr, timeout: healthCheckTimeout}
+	if config != nil && config.Timeout != "" {
+		if hc.timeout, err = time.ParseDuration(config.Timeout); err != nil {
+			return healthCheck{}, fmt.Errorf("invalid health check timeout: %w", err)
+		}
+		if hc.timeout <= 0 {
+			return healthCheck{}, fmt.Errorf("health check timeout must be positive")
+		}
+	}
+	if config != nil && config.DegradedLatency != "" {
+		if hc.degradedLatency, err = time.ParseDuration(config.DegradedLatency); err != nil {
+			return healthCheck{}, fmt.Errorf("invalid health check degraded_latency: %w", err)
+		}
+		if hc.degradedLatency <= 0 {
+			return healthCheck{}, fmt.Errorf("health check degraded_latency must be positive")
+		}
+	}
+	return hc, nil
+}
+
+// newProber builds the prober described by config for a pool of the given
+// protocol. A nil config yields the protocol's native check.
+func newProber(l *log.Logger, protocol string, config *HealthCheckConfig) (prober, error) {
+	if config != nil && config.Type == HealthCheckExec {
+		return newExecProbe(config)
+	}
+	if config != nil && config.Type == HealthCheckICMP {
+		pinger, err := newICMPPinger()
+		if err != nil {
+			warnf(l, "WARNING: icmp health checks unavailable, falling back to %s checks: %v", protocol, err)
+			return newProber(l, protocol, nil)
+		}
+		return pinger, nil
+	}
+
+	switch protocol {
+	case "udp":
+		return newUDPProbe(config)
+	default:
+		if config != nil && config.Type != "" {
+			return nil, fmt.Errorf("unsupported %s health check type: %s", protocol, config.Type)
+		}
+		return tcpProbe{}, nil
+	}
+}
+
+// initHealthChecks builds the default and per-backend health checks from
+// config.
+func (p *BaseServerPool) initHealthChecks(protocol string, config *Config) error {
+	var err error
+	if p.healthCheck, err = newHealthCheck(p.log, protocol, config.HealthCheck); err != nil {
+		return err
+	}
+	p.backendHealthChecks = make(map[string]healthCheck)
+	for backend, hc := range config.BackendHealthChecks {
+		if p.backendHealthChecks[backend], err = newHealthCheck(p.log, protocol, hc); err != nil {
+			return fmt.Errorf("invalid health check for backend %s: %w", backend, err)
+		}
+	}
+	if p.degradedEvery, err = parseDegradedWeight(config.DegradedWeight); err != nil {
+		return err
+	}
+	p.deepCheck, err = newDeepHealthCheck(p.log, protocol, config.DeepHealthCheck)
+	return err
+}
+
+// healthChecker owns the health check loops of a pool. Stopping it cancels
+// in-flight probes and waits for every loop to exit.
+type healthChecker struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// resources counts the loops as goroutines of the pool.
+	resources *resourceUsage
+}
+
+func newHealthChecker(resources *resourceUsage) *healthChecker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &healthChecker{ctx: ctx, cancel: cancel, resources: resources}
+}
+
+// Go runs f in a new goroutine tracked by the checker.
+func (h *healthChecker) Go(f func(ctx context.Context)) {
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		h.resources.add(1, 0)
+		defer h.resources.add(-1, 0)
+		f(h.ctx)
+	}()
+}
+
+// Stop cancels every loop and waits for them to exit, or for ctx to be done.
+func (h *healthChecker) Stop(ctx context.Context) error {
+	h.cancel()
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("health checks did not stop: %w", ctx.Err())
+	}
+}
+
+// StartHealthChecks starts probing every backend in the pool. Backends added
+// afterwards are probed as soon as they are added.
+func (p *BaseServerPool) StartHealthChecks() {
+	p.backendsMutex.Lock()
+	if p.checker == nil {
+		p.checker = newHealthChecker(&p.resources)
+	}
+	p.backendsMutex.Unlock()
+
+	p.backendGroup.attach(p)
+	p.healthChecksStarted.Store(true)
+	for _, b := range p.Backends() {
+		p.startHealthCheck(b)
+	}
+	p.shadow.startHealthChecks()
+}
+
+// stopHealthChecks stops all health check loops, cancelling in-flight probes.
+func (p *BaseServerPool) stopHealthChecks(ctx context.Context) error {
+	p.backendGroup.unsubscribe(p)
+	p.sharedHealth.leave(p)
+	if p.shadow != nil {
+		if err := p.shadow.pool.stopHealthChecks(ctx); err != nil {
+			return err
+		}
+	}
+	p.backendsMutex.Lock()
+	checker := p.checker
+	p.backendsMutex.Unlock()
+	if checker == nil {
+		return nil
+	}
+	if err := checker.Stop(ctx); err != nil {
+		return err
+	}
+	// Backend health is not known while the listener is stopped.
+	now := time.Now()
+	for _, b := range p.Backends() {
+		p.recordUptime(b, uptimeUnknown, now)
+	}
+	return nil
+}
+
+// startHealthCheck probes the backend every health check interval until
+// health checks are stopped. Debug and static backends are always healthy,
+// and members of a backend group follow the group's shared health checks.
+// Probes are skipped while the backend's checks are paused, and do not
+// change its health while it is forced healthy or unhealthy. With a
+// quarantine, a backend failing its probes for too long is removed from the
+// pool.
+func (p *BaseServerPool) startHealthCheck(backend *Backend) {
+	if isDebugBackend(backend) || isStaticBackend(backend) {
+		p.setHealthy(backend, true)
+		return
+	}
+	if backend.sharedGroup != "" {
+		p.backendGroup.subscribe(p, backend)
+		return
+	}
+
+	p.startDeepCheck(backend)
+	p.checker.Go(func(ctx context.Context) {
+		// downSince is when the backend started failing its probes.
+		var downSince time.Time
+		for {
+			if _, paused := backend.healthOverride(); !paused {
+				err := p.runProbe(ctx, backend)
+				if ctx.Err() != nil {
+					// Cancelled mid-probe: the result says nothing about the backend.
+					return
+				}
+				if err != nil {
+					warnf(p.log, "health check failed for backend %s: %v", backend.URL.Host, err)
+				} else {
+					debugf(p.log, "health check passed for backend %s", backend.URL.Host)
+				}
+				backend.setLastError(err)
+				// The override may have changed during the probe.
+				forced, paused := backend.healthOverride()
+				if forced == "" && !paused {
+					p.setProbedHealth(backend, err == nil)
+				}
+				switch now := time.Now(); {
+				case err == nil:
+					downSince = time.Time{}
+				case downSince.IsZero():
+					downSince = now
+				case forced == "" && !paused && p.quarantine.due(downSince, now):
+					p.quarantineBackend(backend, downSince)
+					return
+				}
+			}
+
+			select {
+			case <-time.After(p.healthcheckInterval):
+			case <-backend.removed:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// runProbe runs a single probe of the backend bounded by its timeout and
+// records its latency and outcome, unless ctx is cancelled. A passing probe
+// slower than the health check's degraded latency degrades the backend.
+func (p *BaseServerPool) runProbe(ctx context.Context, backend *Backend) error {
+	hc := p.healthCheckFor(backend)
+	probeCtx, cancel := context.WithTimeout(ctx, hc.timeout)
+	defer cancel()
+	start := time.Now()
+	err := hc.prober.probe(probeCtx, backend)
+	if ctx.Err() == nil {
+		backend.probes.record(newProbeSample(start, err))
+		if err == nil {
+			p.setSlow(backend, time.Since(start), hc.degradedLatency)
+		}
+	}
+	return err
+}
+
+// healthCheckFor returns the health check for the backend.
+func (p *BaseServerPool) healthCheckFor(b *Backend) healthCheck {
+	if hc, ok := p.backendHealthChecks[b.URL.String()]; ok {
+		return hc
+	}
+	if hc, ok := p.backendHealthChecks[b.URL.Host]; ok {
+		return hc
+	}
+	return p.healthCheck
+}
+
+// bindDeadline applies ctx's deadline to conn and interrupts blocked I/O if
+// ctx is cancelled. Call the returned func once the probe is done.
+func bindDeadline(ctx context.Context, conn interface{ SetDeadline(time.Time) error }) func() bool {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+}
+
+// tcpProbe considers a backend healthy if a TCP connection can be established.
+type tcpProbe struct{}
+
+func (tcpProbe) probe(ctx context.Context, b *Backend) error {
+	addr, err := b.dialAddr(ctx)
+	if err != nil {
+		return err
+	}
+	d := net.Dialer{Control: bindDevice(b.device)}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
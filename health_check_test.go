@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func Test_newProber(t *testing.T) {
+	l := log.New(io.Discard, "", 0)
+
+	pr, err := newProber(l, "tcp", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, ok := pr.(tcpProbe); !ok {
+		t.Errorf("expected tcp probe, got %T", pr)
+	}
+
+	pr, err = newProber(l, "udp", nil)
+	if err != nil || pr != defaultUDPProbe {
+		t.Errorf("expected default udp probe, got %T (%v)", pr, err)
+	}
+
+	if _, err := newProber(l, "tcp", &HealthCheckConfig{Type: HealthCheckDNS}); err == nil {
+		t.Errorf("expected error for dns probe on tcp pool")
+	}
+
+	// ICMP falls back to the native check when sockets are unavailable.
+	pr, err = newProber(l, "tcp", &HealthCheckConfig{Type: HealthCheckICMP})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	switch pr.(type) {
+	case *icmpPinger, tcpProbe:
+	default:
+		t.Errorf("expected icmp or tcp probe, got %T", pr)
+	}
+}
+
+func TestBaseServerPool_healthCheckFor(t *testing.T) {
+	pool := &BaseServerPool{log: log.New(io.Discard, "", 0)}
+	err := pool.initHealthChecks("udp", &Config{
+		BackendHealthChecks: map[string]*HealthCheckConfig{
+			"udp://127.0.0.1:53": {Type: HealthCheckDNS},
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	pool.AddBackend("udp://127.0.0.1:53")
+	pool.AddBackend("udp://127.0.0.1:8080")
+
+	if pr := pool.healthCheckFor(pool.backends[0]).prober.(*udpProbe); pr.dnsName != "." {
+		t.Errorf("expected dns probe for overridden backend, got %+v", pr)
+	}
+	if pr := pool.healthCheckFor(pool.backends[1]).prober; pr != defaultUDPProbe {
+		t.Errorf("expected default probe, got %+v", pr)
+	}
+}
+
+func Test_tcpProbe(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	u, _ := url.Parse("tcp://" + ln.Addr().String())
+	b := &Backend{URL: u}
+
+	if err := (tcpProbe{}).probe(t.Context(), b); err != nil {
+		t.Errorf("expected probe to succeed, got %v", err)
+	}
+	ln.Close()
+	if err := (tcpProbe{}).probe(t.Context(), b); err == nil {
+		t.Errorf("expected probe to fail after listener closed")
+	}
+}
+
+func Test_newHealthCheck_timeout(t *testing.T) {
+	l := log.New(io.Discard, "", 0)
+
+	hc, err := newHealthCheck(l, "tcp", nil)
+	if err != nil || hc.timeout != healthCheckTimeout {
+		t.Errorf("expected default timeout, got %s (%v)", hc.timeout, err)
+	}
+	hc, err = newHealthCheck(l, "udp", &HealthCheckConfig{Payload: "ping", Timeout: "250ms"})
+	if err != nil || hc.timeout != 250*time.Millisecond {
+		t.Errorf("expected 250ms timeout, got %s (%v)", hc.timeout, err)
+	}
+	for _, timeout := range []string{"soon", "0s"} {
+		if _, err := newHealthCheck(l, "tcp", &HealthCheckConfig{Timeout: timeout}); err == nil {
+			t.Errorf("expected error for timeout %q", timeout)
+		}
+	}
+}
+
+// blockingProbe blocks until its context is done.
+type blockingProbe struct {
+	started chan struct{}
+}
+
+func (p blockingProbe) probe(ctx context.Context, b *Backend) error {
+	p.started <- struct{}{}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestBaseServerPool_stopHealthChecks(t *testing.T) {
+	started := make(chan struct{}, 1)
+	pool := &BaseServerPool{
+		healthcheckInterval: time.Hour,
+		healthCheck:         healthCheck{prober: blockingProbe{started}, timeout: time.Hour},
+		log:                 log.New(io.Discard, "", 0),
+	}
+	pool.AddBackend("tcp://127.0.0.1:8080")
+	pool.StartHealthChecks()
+
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for probe to start")
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 2*time.Second)
+	defer cancel()
+	if err := pool.stopHealthChecks(ctx); err != nil {
+		t.Fatalf("expected in-flight probe to be cancelled, got %v", err)
+	}
+	if pool.backends[0].Healthy() || pool.backends[0].LastError() != nil {
+		t.Errorf("expected a cancelled probe not to change backend state")
+	}
+}
+
+func TestBaseServerPool_probeTimeout(t *testing.T) {
+	// A UDP backend that never answers.
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	pool := &BaseServerPool{
+		healthCheck: healthCheck{prober: defaultUDPProbe, timeout: 50 * time.Millisecond},
+	}
+	pool.AddBackend("udp://" + conn.LocalAddr().String())
+
+	start := time.Now()
+	if err := pool.runProbe(t.Context(), pool.backends[0]); err == nil {
+		t.Errorf("expected probe to time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected probe to give up after its timeout, took %s", elapsed)
+	}
+}
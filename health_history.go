@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// healthHistorySize is the number of health transitions kept per backend.
+const healthHistorySize = 32
+
+// Flap detection defaults.
+const (
+	defaultFlapTransitions = 5
+	defaultFlapWindow      = 5 * time.Minute
+	defaultFlapHoldDown    = 2 * time.Minute
+)
+
+// healthTransition is a change of a backend's health check result.
+type healthTransition struct {
+	Time    time.Time `json:"time"`
+	Healthy bool      `json:"healthy"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// healthHistory is a ring buffer of a backend's recent health transitions.
+// The zero value is ready to use.
+type healthHistory struct {
+	mux    sync.Mutex
+	events [healthHistorySize]healthTransition
+	next   int
+	count  int
+	// holdUntil is when a flapping backend's hold-down ends.
+	holdUntil time.Time
+}
+
+// record adds a transition, overwriting the oldest once the buffer is full.
+func (h *healthHistory) record(t healthTransition) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.events[h.next] = t
+	h.next = (h.next + 1) % healthHistorySize
+	h.count = min(h.count+1, healthHistorySize)
+}
+
+// transitions returns the recorded transitions, oldest first.
+func (h *healthHistory) transitions() []healthTransition {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	out := make([]healthTransition, 0, h.count)
+	for i := range h.count {
+		out = append(out, h.events[(h.next-h.count+i+healthHistorySize)%healthHistorySize])
+	}
+	return out
+}
+
+// countSince returns the number of transitions at or after t.
+func (h *healthHistory) countSince(t time.Time) int {
+	n := 0
+	for _, e := range h.transitions() {
+		if !e.Time.Before(t) {
+			n++
+		}
+	}
+	return n
+}
+
+// holdDown keeps the backend out of rotation until t.
+func (h *healthHistory) holdDown(t time.Time) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.holdUntil = t
+}
+
+// heldDown returns when the backend's hold-down ends and whether it is
+// still held down at now.
+func (h *healthHistory) heldDown(now time.Time) (time.Time, bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return h.holdUntil, now.Before(h.holdUntil)
+}
+
+// flapDetector flags backends whose health changes too often and holds them
+// down, so that an unstable backend is not repeatedly put back in rotation.
+type flapDetector struct {
+	transitions int
+	window      time.Duration
+	holdDown    time.Duration
+}
+
+func newFlapDetector(config *FlapDetectionConfig) (*flapDetector, error) {
+	if config == nil || !config.Enabled {
+		return nil, nil
+	}
+	f := &flapDetector{
+		transitions: defaultFlapTransitions,
+		window:      defaultFlapWindow,
+		holdDown:    defaultFlapHoldDown,
+	}
+	if config.Transitions != 0 {
+		if config.Transitions < 2 || config.Transitions > healthHistorySize {
+			return nil, fmt.Errorf("flap_detection transitions must be between 2 and %d", healthHistorySize)
+		}
+		f.transitions = config.Transitions
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"window", config.Window, &f.window},
+		{"hold_down", config.HoldDown, &f.holdDown},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid flap_detection %s: %w", d.name, err)
+		}
+		if v <= 0 {
+			return nil, fmt.Errorf("flap_detection %s must be positive", d.name)
+		}
+		*d.dst = v
+	}
+	return f, nil
+}
+
+// observe checks a backend after a health transition at now and reports
+// whether it started a hold-down. Each further transition while flapping
+// extends the hold-down.
+func (f *flapDetector) observe(b *Backend, now time.Time) bool {
+	if f == nil || b.history.countSince(now.Add(-f.window)) < f.transitions {
+		return false
+	}
+	_, held := b.history.heldDown(now)
+	b.history.holdDown(now.Add(f.holdDown))
+	return !held
+}
+
+// recordTransition records a change of the backend's health and applies
+// flap detection.
+func (p *BaseServerPool) recordTransition(b *Backend, healthy bool, now time.Time) {
+	t := healthTransition{Time: now, Healthy: healthy}
+	if err := b.LastError(); err != nil && !healthy {
+		t.Error = err.Error()
+	}
+	b.history.record(t)
+	p.recordUptime(b, map[bool]string{true: uptimeUp, false: uptimeDown}[healthy], now)
+	if p.flaps.observe(b, now) {
+		infof(p.log, "backend %s is flapping (%d health transitions in %s), holding it down for %s",
+			b.URL.Host, p.flaps.transitions, p.flaps.window, p.flaps.holdDown)
+	}
+}
+
+// healthHistoryView is a backend's health history in the admin API.
+type healthHistoryView struct {
+	Flapping      bool               `json:"flapping"`
+	HoldDownUntil *time.Time         `json:"hold_down_until,omitempty"`
+	Transitions   []healthTransition `json:"transitions"`
+}
+
+func newHealthHistoryView(b *Backend, now time.Time) healthHistoryView {
+	v := healthHistoryView{Transitions: b.history.transitions()}
+	if until, held := b.history.heldDown(now); held {
+		v.Flapping = true
+		v.HoldDownUntil = &until
+	}
+	return v
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthHistory(t *testing.T) {
+	var h healthHistory
+	start := time.Now()
+	for i := range healthHistorySize + 3 {
+		h.record(healthTransition{Time: start.Add(time.Duration(i) * time.Second), Healthy: i%2 == 0})
+	}
+	transitions := h.transitions()
+	if len(transitions) != healthHistorySize {
+		t.Fatalf("expected %d transitions, got %d", healthHistorySize, len(transitions))
+	}
+	if !transitions[0].Time.Equal(start.Add(3 * time.Second)) {
+		t.Errorf("expected oldest transitions to be overwritten, got %s first", transitions[0].Time)
+	}
+	if got := h.countSince(start.Add(time.Duration(healthHistorySize) * time.Second)); got != 3 {
+		t.Errorf("expected 3 recent transitions, got %d", got)
+	}
+}
+
+func Test_newFlapDetector(t *testing.T) {
+	if f, err := newFlapDetector(&FlapDetectionConfig{}); f != nil || err != nil {
+		t.Errorf("expected nil detector when disabled, got %v, %v", f, err)
+	}
+	f, err := newFlapDetector(&FlapDetectionConfig{Enabled: true, Window: "1m"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if f.transitions != defaultFlapTransitions || f.window != time.Minute || f.holdDown != defaultFlapHoldDown {
+		t.Errorf("unexpected detector %+v", f)
+	}
+	for _, cfg := range []*FlapDetectionConfig{
+		{Enabled: true, Transitions: 1},
+		{Enabled: true, Transitions: healthHistorySize + 1},
+		{Enabled: true, Window: "0s"},
+		{Enabled: true, HoldDown: "later"},
+	} {
+		if _, err := newFlapDetector(cfg); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
+
+func TestBaseServerPool_flapDetection(t *testing.T) {
+	pool := newConsoleTestPool("web", true)
+	pool.flaps = &flapDetector{transitions: 4, window: time.Minute, holdDown: time.Hour}
+	b := pool.backends[0]
+
+	pool.setHealthy(b, false)
+	b.setLastError(errors.New("connection refused"))
+	pool.setHealthy(b, false) // not a transition
+	if pool.Next(nil) != nil {
+		t.Fatalf("expected no available backend while down")
+	}
+	pool.setHealthy(b, true)
+	if !pool.available(b) {
+		t.Fatalf("expected backend to be available before it flaps")
+	}
+	// The fourth transition within the window starts a hold-down.
+	pool.setHealthy(b, false)
+	pool.setHealthy(b, true)
+	if pool.available(b) {
+		t.Errorf("expected flapping backend to be held down")
+	}
+	if !newBackendView(b).Flapping {
+		t.Errorf("expected backend view to report flapping")
+	}
+
+	mux := http.NewServeMux()
+	registerPoolRoutes(mux, "", consoleTestPool{pool})
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/backends/"+b.ID+"/health", nil))
+	var view healthHistoryView
+	if err := json.NewDecoder(rec.Body).Decode(&view); err != nil {
+		t.Fatalf("failed to decode history: %v", err)
+	}
+	if !view.Flapping || view.HoldDownUntil == nil || len(view.Transitions) != 5 {
+		t.Errorf("expected flapping backend with 5 transitions, got %+v", view)
+	}
+	if last := view.Transitions[len(view.Transitions)-2]; last.Healthy || last.Error != "connection refused" {
+		t.Errorf("expected down transition with its error, got %+v", last)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/backends/unknown/health", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for unknown backend, got %d", rec.Code)
+	}
+}
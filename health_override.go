@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Values of a forced backend health.
+const (
+	forceHealthy   = "healthy"
+	forceDegraded  = "degraded"
+	forceUnhealthy = "unhealthy"
+)
+
+// healthOverride returns the health the backend is forced to, if any, and
+// whether its health checks are paused.
+func (b *Backend) healthOverride() (forced string, paused bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.forced, b.checksPaused
+}
+
+func (b *Backend) setHealthOverride(forced string, paused bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.forced = forced
+	b.checksPaused = paused
+}
+
+// overrideHealth forces the backend healthy, degraded or unhealthy, or hands it back
+// to the health checker if forced is empty, and pauses or resumes its health
+// checks. Nil arguments keep their current value. While forced, probes
+// still run and record their errors but do not change the backend's health.
+func (p *BaseServerPool) overrideHealth(b *Backend, forced *string, paused *bool) error {
+	curForced, curPaused := b.healthOverride()
+	if forced != nil {
+		switch *forced {
+		case "", forceHealthy, forceDegraded, forceUnhealthy:
+			curForced = *forced
+		default:
+			return fmt.Errorf("invalid force %q: must be %q, %q, %q or empty", *forced, forceHealthy, forceDegraded, forceUnhealthy)
+		}
+	}
+	if paused != nil {
+		curPaused = *paused
+	}
+	b.setHealthOverride(curForced, curPaused)
+	if curForced != "" {
+		p.setHealthy(b, curForced != forceUnhealthy)
+	}
+	infof(p.log, "health override for backend %s: force=%q checks_paused=%t", b.URL.Host, curForced, curPaused)
+	return nil
+}
+
+// overrideHealthAPIHandler forces a backend's health or pauses its health
+// checks, for example during planned network maintenance. Fields omitted
+// from the request body keep their current value.
+func (p *BaseServerPool) overrideHealthAPIHandler(w http.ResponseWriter, r *http.Request) {
+	b := p.findBackend(r.PathValue("backend"))
+	if b == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("backend %q not found", r.PathValue("backend")))
+		return
+	}
+	var req struct {
+		Force        *string `json:"force"`
+		ChecksPaused *bool   `json:"checks_paused"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	if err := p.overrideHealth(b, req.Force, req.ChecksPaused); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newBackendView(b))
+}
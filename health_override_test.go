@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBaseServerPool_overrideHealthAPIHandler(t *testing.T) {
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:                "127.0.0.1:0",
+		HealthcheckInterval: "10ms",
+		Backends:            []BackendConfig{{URL: startNamedBackend(t, "a")}},
+	})
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	pool.StartHealthChecks()
+	defer pool.stopHealthChecks(t.Context())
+	b := pool.backends[0]
+
+	mux := http.NewServeMux()
+	registerPoolRoutes(mux, "", pool)
+	override := func(backend, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("PUT", "/api/backends/"+backend+"/health", strings.NewReader(body)))
+		return rec
+	}
+
+	time.Sleep(100 * time.Millisecond) // Wait for health checks to run
+	if !b.Healthy() {
+		t.Fatalf("expected backend to pass health checks")
+	}
+
+	rec := override(b.ID, `{"force": "unhealthy"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var view backendView
+	if err := json.NewDecoder(rec.Body).Decode(&view); err != nil {
+		t.Fatalf("failed to decode view: %v", err)
+	}
+	if view.Healthy || view.Forced != forceUnhealthy || view.ChecksPaused {
+		t.Errorf("unexpected view %+v", view)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if b.Healthy() {
+		t.Errorf("expected passing health checks not to override a forced health")
+	}
+
+	// Releasing the override while paused keeps the forced health.
+	override(b.ID, `{"force": "", "checks_paused": true}`)
+	time.Sleep(50 * time.Millisecond)
+	if forced, paused := b.healthOverride(); b.Healthy() || forced != "" || !paused {
+		t.Errorf("expected backend to stay unhealthy with paused checks, got healthy=%t forced=%q paused=%t", b.Healthy(), forced, paused)
+	}
+
+	override(b.ID, `{"checks_paused": false}`)
+	time.Sleep(50 * time.Millisecond)
+	if !b.Healthy() {
+		t.Errorf("expected backend to be healthy once checks resume")
+	}
+
+	if rec := override(b.ID, `{"force": "maybe"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid force, got %d", rec.Code)
+	}
+	if rec := override("unknown", `{"force": "healthy"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for an unknown backend, got %d", rec.Code)
+	}
+}
+
+func TestBaseServerPool_restoreHealthOverride(t *testing.T) {
+	pool := newConsoleTestPool("", true)
+	forced, paused := forceUnhealthy, true
+	pool.overrideHealth(pool.backends[0], &forced, &paused)
+
+	restored := newConsoleTestPool("", true)
+	if err := restored.restore(pool.snapshot()); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	b := restored.backends[0]
+	if forced, paused := b.healthOverride(); b.Healthy() || forced != forceUnhealthy || !paused {
+		t.Errorf("expected health override to be restored, got healthy=%t forced=%q paused=%t", b.Healthy(), forced, paused)
+	}
+}
@@ -1,22 +1,125 @@
 package main
 
 import (
+	"fmt"
 	"hash/fnv"
+	"io"
 	"net"
-	"strings"
+	"os"
+	"path/filepath"
 )
 
 // getIpFromAddr extracts the IP address from the connection.
 func getIpFromAddr(addr net.Addr) net.IP {
-	ip := strings.Split(addr.String(), ":")[0]
-	return net.ParseIP(ip)
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+// v4InV6Prefix is the prefix of an IPv4 address in its 16-byte form.
+var v4InV6Prefix = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
+
+// ipPrefix returns what to hash before ip for it to be hashed in its 16-byte
+// form, so that an IPv4 address hashes the same whichever form it is in.
+func ipPrefix(ip net.IP) []byte {
+	if len(ip) == net.IPv4len {
+		return v4InV6Prefix
+	}
+	return nil
 }
 
 // hashIp hashes the IP address to a consistent integer.
 func hashIp(ip net.IP) int {
 	h := fnv.New32a()
+	h.Write(ipPrefix(ip))
 	h.Write(ip)
 	hash := h.Sum32()
 	return int(hash)
 }
 
+// hashClient hashes a client address to a consistent integer by its IP or,
+// with StickyKeyIPPort, by its IP and source port, which spreads clients
+// sharing an address, such as behind a NAT, across backends.
+func hashClient(addr net.Addr, key string) int {
+	ip := getIpFromAddr(addr)
+	if key != StickyKeyIPPort {
+		return hashIp(ip)
+	}
+	_, port, _ := net.SplitHostPort(addr.String())
+	h := fnv.New32a()
+	h.Write(ipPrefix(ip))
+	h.Write(ip)
+	h.Write([]byte(port))
+	return int(h.Sum32())
+}
+
+// hashKey hashes an affinity key to a consistent integer.
+func hashKey(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32())
+}
+
+// rendezvousScore returns the score of a backend, whose ID hashes to
+// keyHash, for a client hashing to hash. The client goes to the backend
+// scoring highest.
+func rendezvousScore(hash, keyHash int) uint64 {
+	// splitmix64 finalizer, spreading the combined hashes evenly.
+	x := uint64(uint32(hash))<<32 | uint64(uint32(keyHash))
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// countingWriter wraps a writer and adds the number of bytes written to n.
+type countingWriter struct {
+	w io.Writer
+	n *byteCounter
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n.Add(n)
+	return n, err
+}
+
+// writeFileAtomic replaces the file at path with data. The data is written to
+// a temporary file first and renamed, so the file is never left half
+// written. An existing file keeps its permissions.
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("could not write %s: %w", path, err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write %s: %w", path, err)
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("could not write %s: %w", path, err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("could not replace %s: %w", path, err)
+	}
+	return nil
+}
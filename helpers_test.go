@@ -13,6 +13,50 @@ func Test_getIpFromAddr(t *testing.T) {
 	}
 }
 
+func Test_getIpFromAddr_ipv6(t *testing.T) {
+	for _, addr := range []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5678},
+		&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5678},
+		stringAddr("[2001:db8::1]:5678"),
+	} {
+		if ip := getIpFromAddr(addr); !ip.Equal(net.ParseIP("2001:db8::1")) {
+			t.Errorf("expected 2001:db8::1 for %s, got %s", addr, ip)
+		}
+	}
+
+	// IPv6 clients hash apart rather than all to the hash of a nil IP.
+	a := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5678}
+	b := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 5678}
+	if hashClient(a, StickyKeyIP) == hashClient(b, StickyKeyIP) || hashClient(a, StickyKeyIP) == hashIp(nil) {
+		t.Errorf("expected IPv6 clients to hash by their address")
+	}
+	// An IPv4 address hashes the same in its 4 and 16-byte forms.
+	v4 := &net.TCPAddr{IP: net.IPv4(192, 168, 1, 100).To4(), Port: 5678}
+	if hashClient(v4, StickyKeyIP) != hashIp(net.ParseIP("192.168.1.100")) {
+		t.Errorf("expected a 4-byte IPv4 address to hash as its 16-byte form")
+	}
+}
+
+// stringAddr is a net.Addr other than a TCP or UDP address.
+type stringAddr string
+
+func (a stringAddr) Network() string { return "test" }
+func (a stringAddr) String() string  { return string(a) }
+
+func Test_hashClient(t *testing.T) {
+	a := &net.TCPAddr{IP: net.ParseIP("192.168.1.100"), Port: 5678}
+	b := &net.TCPAddr{IP: net.ParseIP("192.168.1.100"), Port: 5679}
+	if hashClient(a, StickyKeyIP) != hashIp(a.IP) || hashClient(a, StickyKeyIP) != hashClient(b, StickyKeyIP) {
+		t.Errorf("expected the ip key to hash the client IP only")
+	}
+	if hashClient(a, StickyKeyIPPort) == hashClient(b, StickyKeyIPPort) {
+		t.Errorf("expected the ip_port key to hash the source port")
+	}
+	if hashClient(a, StickyKeyIPPort) != hashClient(&net.TCPAddr{IP: a.IP, Port: a.Port}, StickyKeyIPPort) {
+		t.Errorf("expected the ip_port hash to be consistent")
+	}
+}
+
 func Test_hashIp(t *testing.T) {
 	ip := net.ParseIP("192.168.1.100")
 	hash := hashIp(ip)
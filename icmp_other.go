@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package main
+
+import "net"
+
+// listenICMPUnprivileged is not supported on this platform.
+func listenICMPUnprivileged(v6 bool) (net.PacketConn, error) {
+	return nil, errICMPUnsupported
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+)
+
+// ICMP echo message types.
+const (
+	icmpv4EchoRequest = 8
+	icmpv4EchoReply   = 0
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+)
+
+// icmpPayload is carried in every echo request to recognise our replies.
+var icmpPayload = []byte("nlb-health-check")
+
+// icmpPinger checks L3 reachability of backends with ICMP echo requests. It
+// uses raw sockets when privileged and unprivileged datagram ICMP sockets
+// otherwise.
+type icmpPinger struct {
+	privileged bool
+}
+
+// newICMPPinger detects which kind of ICMP socket can be opened and returns
+// an error if neither is permitted.
+func newICMPPinger() (*icmpPinger, error) {
+	if conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0"); err == nil {
+		conn.Close()
+		return &icmpPinger{privileged: true}, nil
+	}
+	conn, err := listenICMPUnprivileged(false)
+	if err != nil {
+		return nil, fmt.Errorf("no raw socket privileges and unprivileged icmp unavailable: %w", err)
+	}
+	conn.Close()
+	return &icmpPinger{}, nil
+}
+
+func (p *icmpPinger) listen(v6 bool) (net.PacketConn, error) {
+	if !p.privileged {
+		return listenICMPUnprivileged(v6)
+	}
+	if v6 {
+		return net.ListenPacket("ip6:ipv6-icmp", "::")
+	}
+	return net.ListenPacket("ip4:icmp", "0.0.0.0")
+}
+
+func (p *icmpPinger) probe(ctx context.Context, b *Backend) error {
+	ip, err := b.resolver.resolveOne(ctx, b.URL.Hostname())
+	if err != nil {
+		return err
+	}
+	ipAddr := &net.IPAddr{IP: ip.AsSlice(), Zone: ip.Zone()}
+	v6 := ip.Is6()
+
+	conn, err := p.listen(v6)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer bindDeadline(ctx, conn)()
+
+	// Unprivileged sockets rewrite the identifier, so replies are matched on
+	// sequence number and payload.
+	seq := uint16(rand.Uint32())
+	reqType, replyType := byte(icmpv4EchoRequest), byte(icmpv4EchoReply)
+	if v6 {
+		reqType, replyType = icmpv6EchoRequest, icmpv6EchoReply
+	}
+
+	var dst net.Addr = ipAddr
+	if !p.privileged {
+		dst = &net.UDPAddr{IP: ipAddr.IP, Zone: ipAddr.Zone}
+	}
+	if _, err := conn.WriteTo(icmpEchoRequest(reqType, uint16(rand.Uint32()), seq, v6), dst); err != nil {
+		return fmt.Errorf("error sending icmp echo: %w", err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return fmt.Errorf("no icmp echo reply: %w", err)
+		}
+		if !sameIP(from, ipAddr.IP) {
+			continue
+		}
+		if isICMPEchoReply(buf[:n], replyType, seq) {
+			return nil
+		}
+	}
+}
+
+// icmpEchoRequest builds an echo request. ICMPv6 checksums are computed by
+// the kernel.
+func icmpEchoRequest(typ byte, id, seq uint16, v6 bool) []byte {
+	msg := make([]byte, 8, 8+len(icmpPayload))
+	msg[0] = typ
+	binary.BigEndian.PutUint16(msg[4:6], id)
+	binary.BigEndian.PutUint16(msg[6:8], seq)
+	msg = append(msg, icmpPayload...)
+	if !v6 {
+		binary.BigEndian.PutUint16(msg[2:4], icmpChecksum(msg))
+	}
+	return msg
+}
+
+// isICMPEchoReply reports whether msg is the reply to our request.
+func isICMPEchoReply(msg []byte, replyType byte, seq uint16) bool {
+	return len(msg) >= 8 && msg[0] == replyType &&
+		binary.BigEndian.Uint16(msg[6:8]) == seq &&
+		bytes.Equal(msg[8:], icmpPayload)
+}
+
+// icmpChecksum computes the internet checksum of b.
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// sameIP reports whether addr refers to ip.
+func sameIP(addr net.Addr, ip net.IP) bool {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP.Equal(ip)
+	case *net.UDPAddr:
+		return a.IP.Equal(ip)
+	}
+	return false
+}
+
+// errICMPUnsupported is returned on platforms without unprivileged ICMP sockets.
+var errICMPUnsupported = errors.New("unprivileged icmp sockets are not supported on this platform")
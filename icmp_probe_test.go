@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func Test_icmpChecksum(t *testing.T) {
+	msg := icmpEchoRequest(icmpv4EchoRequest, 1, 1, false)
+	if icmpChecksum(msg) != 0 {
+		t.Errorf("expected checksum over a checksummed message to be zero")
+	}
+}
+
+func Test_isICMPEchoReply(t *testing.T) {
+	reply := icmpEchoRequest(icmpv4EchoReply, 7, 42, false)
+	if !isICMPEchoReply(reply, icmpv4EchoReply, 42) {
+		t.Errorf("expected reply to match")
+	}
+	if isICMPEchoReply(reply, icmpv4EchoReply, 43) {
+		t.Errorf("expected reply with different sequence not to match")
+	}
+	if isICMPEchoReply(reply[:8], icmpv4EchoReply, 42) {
+		t.Errorf("expected reply without payload not to match")
+	}
+}
+
+func TestICMPPinger_probe(t *testing.T) {
+	pinger, err := newICMPPinger()
+	if err != nil {
+		t.Skipf("icmp unavailable: %v", err)
+	}
+
+	u, _ := url.Parse("tcp://127.0.0.1:8080")
+	if err := pinger.probe(t.Context(), &Backend{URL: u}); err != nil {
+		t.Errorf("expected loopback to reply, got %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// errIncludedListener is returned when removing a listener defined in an
+// included config file, which the admin API does not rewrite.
+var errIncludedListener = errors.New("listener is defined in an included config file")
+
+// configIncluder merges included config files into a raw config. Listeners
+// and top-level backends are appended; objects are merged key by key. Any
+// other setting, listener name or backend address defined by two files is a
+// conflict.
+type configIncluder struct {
+	root string
+	// origins maps the dotted path of each setting taken from an included
+	// file to that file. Settings without an origin come from root.
+	origins map[string]string
+	// listeners and backends map each listener name and backend address to
+	// the file defining it.
+	listeners map[string]string
+	backends  map[string]string
+	// including holds the files being included, to detect cycles.
+	including []string
+}
+
+// expandIncludes returns raw, read from filePath, with the config files
+// matched by its includes merged into it. Include paths are glob patterns
+// relative to the including file, and included files may include others.
+// raw is not modified.
+func expandIncludes(raw map[string]any, filePath string) (map[string]any, error) {
+	if _, ok := raw["includes"]; !ok {
+		return raw, nil
+	}
+	merged, err := cloneRawConfig(raw)
+	if err != nil {
+		return nil, err
+	}
+	ci := &configIncluder{
+		root:      filePath,
+		origins:   make(map[string]string),
+		listeners: make(map[string]string),
+		backends:  make(map[string]string),
+		including: []string{absPath(filePath)},
+	}
+	for _, rl := range rawList(merged["listeners"]) {
+		ci.listeners[rawListenerName(rl)] = filePath
+	}
+	for _, rb := range rawList(merged["backends"]) {
+		ci.backends[rawBackendURL(rb)] = filePath
+	}
+	includes := merged["includes"]
+	delete(merged, "includes")
+	if err := ci.includeAll(merged, includes, filePath); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+// includeAll merges the files matched by includes, read from filePath, into
+// dst.
+func (ci *configIncluder) includeAll(dst map[string]any, includes any, filePath string) error {
+	patterns, err := includePatterns(includes)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filePath, err)
+	}
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(filePath), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("%s: invalid include %q: %w", filePath, pattern, err)
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, `*?[`) {
+			return fmt.Errorf("%s: included file %s not found", filePath, pattern)
+		}
+		for _, match := range matches {
+			if err := ci.include(dst, match); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// include merges an included file, and the files it includes, into dst.
+func (ci *configIncluder) include(dst map[string]any, filePath string) error {
+	abs := absPath(filePath)
+	if slices.Contains(ci.including, abs) {
+		return fmt.Errorf("config include cycle: %s", strings.Join(append(ci.including, abs), " -> "))
+	}
+	ci.including = append(ci.including, abs)
+	defer func() { ci.including = ci.including[:len(ci.including)-1] }()
+
+	src, err := readRawConfig(filePath)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filePath, err)
+	}
+	// Each file carries its own schema version.
+	delete(src, "version")
+	includes := src["includes"]
+	delete(src, "includes")
+	if err := ci.merge(dst, src, "", filePath); err != nil {
+		return err
+	}
+	return ci.includeAll(dst, includes, filePath)
+}
+
+// merge merges src, read from filePath, into dst, whose dotted path is path.
+func (ci *configIncluder) merge(dst, src map[string]any, path, filePath string) error {
+	for _, k := range slices.Sorted(maps.Keys(src)) {
+		v := src[k]
+		p := k
+		if path != "" {
+			p = path + "." + k
+		}
+		cur, ok := dst[k]
+		switch {
+		case !ok:
+			if err := ci.claim(p, v, filePath); err != nil {
+				return err
+			}
+			dst[k] = v
+			ci.origins[p] = filePath
+		case p == "listeners" || p == "backends":
+			curList, ok1 := cur.([]any)
+			srcList, ok2 := v.([]any)
+			if !ok1 || !ok2 {
+				return fmt.Errorf("%s must be a list in %s and %s", p, ci.origin(p), filePath)
+			}
+			if err := ci.claim(p, v, filePath); err != nil {
+				return err
+			}
+			dst[k] = append(curList, srcList...)
+		default:
+			curMap, ok1 := cur.(map[string]any)
+			srcMap, ok2 := v.(map[string]any)
+			if ok1 && ok2 {
+				if err := ci.merge(curMap, srcMap, p, filePath); err != nil {
+					return err
+				}
+				continue
+			}
+			if !reflect.DeepEqual(cur, v) {
+				return fmt.Errorf("config conflict: %s is set by both %s and %s", p, ci.origin(p), filePath)
+			}
+		}
+	}
+	return nil
+}
+
+// claim records the listeners or backends defined by filePath, reporting
+// any already defined by another file.
+func (ci *configIncluder) claim(path string, v any, filePath string) error {
+	var defined map[string]string
+	var key func(any) string
+	switch path {
+	case "listeners":
+		defined, key = ci.listeners, rawListenerName
+	case "backends":
+		defined, key = ci.backends, rawBackendURL
+	default:
+		return nil
+	}
+	for _, item := range rawList(v) {
+		k := key(item)
+		if other, ok := defined[k]; ok {
+			return fmt.Errorf("config conflict: %s %q is defined in both %s and %s", strings.TrimSuffix(path, "s"), k, other, filePath)
+		}
+		defined[k] = filePath
+	}
+	return nil
+}
+
+// origin returns the file that set the setting at path.
+func (ci *configIncluder) origin(path string) string {
+	for {
+		if f, ok := ci.origins[path]; ok {
+			return f
+		}
+		i := strings.LastIndex(path, ".")
+		if i < 0 {
+			return ci.root
+		}
+		path = path[:i]
+	}
+}
+
+func includePatterns(v any) ([]string, error) {
+	if v == nil {
+		return nil, nil
+	}
+	list, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("includes must be a list of file paths")
+	}
+	var patterns []string
+	for _, p := range list {
+		s, ok := p.(string)
+		if !ok || s == "" {
+			return nil, fmt.Errorf("invalid include %v: must be a file path or glob pattern", p)
+		}
+		patterns = append(patterns, s)
+	}
+	return patterns, nil
+}
+
+func rawList(v any) []any {
+	list, _ := v.([]any)
+	return list
+}
+
+// rawBackendURL returns the address of a backend given as a URL string or
+// object.
+func rawBackendURL(rb any) string {
+	if s, ok := rb.(string); ok {
+		return s
+	}
+	backend, _ := rb.(map[string]any)
+	u, _ := backend["url"].(string)
+	return u
+}
+
+func absPath(filePath string) string {
+	if abs, err := filepath.Abs(filePath); err == nil {
+		return abs
+	}
+	return filepath.Clean(filePath)
+}
+
+// cloneRawConfig deep copies a raw config.
+func cloneRawConfig(raw map[string]any) (map[string]any, error) {
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode config: %w", err)
+	}
+	var clone map[string]any
+	if err := json.Unmarshal(data, &clone); err != nil {
+		return nil, fmt.Errorf("could not decode config: %w", err)
+	}
+	return clone, nil
+}
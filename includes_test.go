@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfigFiles writes files, keyed by path relative to dir, and returns
+// the path of config.json.
+func writeConfigFiles(t *testing.T, dir string, files map[string]string) string {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+	return filepath.Join(dir, "config.json")
+}
+
+func Test_loadConfig_includes(t *testing.T) {
+	path := writeConfigFiles(t, t.TempDir(), map[string]string{
+		"config.json": `{
+			"protocol": "tcp",
+			"algorithm": "least-connections",
+			"backends": ["tcp://127.0.0.1:8001"],
+			"backend_health_checks": {"127.0.0.1:8001": {"timeout": "1s"}},
+			"includes": ["backends.json", "listeners/*.json", "optional/*.json"]
+		}`,
+		"backends.json": `{
+			"backends": [{"url": "tcp://127.0.0.1:8002", "labels": {"zone": "b"}}],
+			"backend_health_checks": {"127.0.0.1:8002": {"timeout": "3s"}},
+			"algorithm": "least-connections"
+		}`,
+		"listeners/web.json": `{"listeners": [{"name": "web", "addr": ":9090"}]}`,
+		"listeners/dns.json": `{"version": 1, "listeners": [{"name": "dns", "addr": ":5353", "protocol": "udp", "backends": ["udp://127.0.0.1:53"]}], "includes": ["../dns/*.json"]}`,
+		"dns/checks.json":    `{"backend_health_checks": {"127.0.0.1:53": {"type": "dns"}}}`,
+	})
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(cfg.Backends) != 2 || cfg.Backends[1].Labels["zone"] != "b" {
+		t.Errorf("expected the included backend to be appended, got %+v", cfg.Backends)
+	}
+	if len(cfg.BackendHealthChecks) != 3 || cfg.BackendHealthChecks["127.0.0.1:53"].Type != "dns" {
+		t.Errorf("expected the health checks of every file to be merged, got %v", cfg.BackendHealthChecks)
+	}
+	// Matches of a pattern are included in lexical order.
+	if len(cfg.Listeners) != 2 || cfg.Listeners[0].Name != "dns" || cfg.Listeners[1].Name != "web" {
+		t.Fatalf("expected the dns and web listeners, got %+v", cfg.Listeners)
+	}
+	if web := cfg.Listeners[1]; len(web.Backends) != 2 || web.Algorithm != AlgorithmLeastConnections {
+		t.Errorf("expected web to inherit the merged top-level settings, got %+v", web)
+	}
+}
+
+func Test_loadConfig_includeConflicts(t *testing.T) {
+	for name, tt := range map[string]struct {
+		files map[string]string
+		want  string
+	}{
+		"setting": {
+			files: map[string]string{
+				"config.json": `{"algorithm": "round-robin", "includes": ["a.json"]}`,
+				"a.json":      `{"algorithm": "least-connections"}`,
+			},
+			want: "algorithm is set by both",
+		},
+		"nested setting": {
+			files: map[string]string{
+				"config.json": `{"includes": ["a.json", "b.json"]}`,
+				"a.json":      `{"health_check": {"timeout": "1s"}}`,
+				"b.json":      `{"health_check": {"timeout": "2s"}}`,
+			},
+			want: "health_check.timeout is set by both",
+		},
+		"listener": {
+			files: map[string]string{
+				"config.json": `{"listeners": [{"name": "web", "addr": ":80"}], "includes": ["a.json"]}`,
+				"a.json":      `{"listeners": [{"name": "web", "addr": ":81"}]}`,
+			},
+			want: `listener "web" is defined in both`,
+		},
+		"backend": {
+			files: map[string]string{
+				"config.json": `{"includes": ["a.json", "b.json"]}`,
+				"a.json":      `{"backends": ["tcp://127.0.0.1:8001"]}`,
+				"b.json":      `{"backends": [{"url": "tcp://127.0.0.1:8001"}]}`,
+			},
+			want: `backend "tcp://127.0.0.1:8001" is defined in both`,
+		},
+		"cycle": {
+			files: map[string]string{
+				"config.json": `{"includes": ["a.json"]}`,
+				"a.json":      `{"includes": ["config.json"]}`,
+			},
+			want: "include cycle",
+		},
+		"missing file": {
+			files: map[string]string{"config.json": `{"includes": ["missing.json"]}`},
+			want:  "not found",
+		},
+		"invalid includes": {
+			files: map[string]string{"config.json": `{"includes": "a.json"}`},
+			want:  "must be a list",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := loadConfig(writeConfigFiles(t, t.TempDir(), tt.files))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestListenerManager_includedListeners(t *testing.T) {
+	path := writeConfigFiles(t, t.TempDir(), map[string]string{
+		"config.json": `{"protocol": "tcp", "listeners": [{"name": "web", "addr": "127.0.0.1:0"}], "includes": ["api.json"]}`,
+		"api.json":    `{"backends": ["tcp://127.0.0.1:1"], "listeners": [{"name": "api", "addr": "127.0.0.1:0"}]}`,
+	})
+	timeouts, _ := newShutdownTimeouts(nil)
+	listeners := newListenerManager(io.Discard, path, timeouts, true, nil)
+
+	if err := listeners.checkRemovable("api"); !errors.Is(err, errIncludedListener) {
+		t.Errorf("expected an included listener not to be removable, got %v", err)
+	}
+	if err := listeners.checkRemovable("web"); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	if _, err := listeners.add(map[string]any{"name": "api", "addr": "127.0.0.1:0"}, func(string) bool { return false }); !errors.Is(err, errDuplicateListener) {
+		t.Errorf("expected an included listener's name to be taken, got %v", err)
+	}
+	np, err := listeners.add(map[string]any{"name": "admin", "addr": "127.0.0.1:0"}, func(string) bool { return false })
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer np.pool.Shutdown(t.Context())
+	if backends := np.pool.Backends(); len(backends) != 1 || backends[0].URL.Host != "127.0.0.1:1" {
+		t.Errorf("expected the listener to inherit the included backends, got %v", backends)
+	}
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), `"includes"`) || strings.Contains(string(data), "127.0.0.1:1") {
+		t.Errorf("expected the config file to keep its includes without inlining them, got %s", data)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// latencySampleSize is the number of most recent samples kept by a latencyTracker.
+const latencySampleSize = 1024
+
+// latencyTracker records latency samples in a fixed-size rolling window and
+// computes percentiles over them. The zero value is ready to use.
+type latencyTracker struct {
+	mux     sync.Mutex
+	samples []time.Duration
+	next    int
+	count   uint64
+	sum     time.Duration
+}
+
+// Observe records a latency sample, evicting the oldest one once the window is full.
+func (t *latencyTracker) Observe(d time.Duration) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.count++
+	t.sum += d
+	if len(t.samples) < latencySampleSize {
+		t.samples = append(t.samples, d)
+		return
+	}
+	t.samples[t.next] = d
+	t.next = (t.next + 1) % latencySampleSize
+}
+
+// Percentile returns the p-th percentile (0-100) of the samples in the
+// window, or zero if nothing has been recorded yet.
+func (t *latencyTracker) Percentile(p float64) time.Duration {
+	t.mux.Lock()
+	samples := slices.Clone(t.samples)
+	t.mux.Unlock()
+
+	slices.Sort(samples)
+	return percentile(samples, p)
+}
+
+// percentile returns the p-th percentile (0-100) of sorted samples, or zero
+// if there are none.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	idx = max(0, min(idx, len(sorted)-1))
+	return sorted[idx]
+}
+
+// Count returns the total number of samples ever recorded.
+func (t *latencyTracker) Count() uint64 {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.count
+}
+
+// Sum returns the total of all samples ever recorded.
+func (t *latencyTracker) Sum() time.Duration {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.sum
+}
+
+// ewmaAlpha is the weight given to the newest sample in an ewma.
+const ewmaAlpha = 0.3
+
+// ewma is an exponentially weighted moving average of latency samples. The
+// zero value is ready to use.
+type ewma struct {
+	mux   sync.Mutex
+	value float64
+	set   bool
+}
+
+// Observe folds a latency sample into the average.
+func (e *ewma) Observe(d time.Duration) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	if !e.set {
+		e.value, e.set = float64(d), true
+		return
+	}
+	e.value = ewmaAlpha*float64(d) + (1-ewmaAlpha)*e.value
+}
+
+// Seed sets the average to d if nothing has been recorded yet.
+func (e *ewma) Seed(d time.Duration) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if !e.set {
+		e.value, e.set = float64(d), true
+	}
+}
+
+// Value returns the current average, or zero if nothing has been recorded.
+func (e *ewma) Value() time.Duration {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return time.Duration(e.value)
+}
+
+// firstByteReader wraps a reader and reports the time elapsed between start
+// and the first successful read.
+type firstByteReader struct {
+	r       io.Reader
+	start   time.Time
+	observe func(time.Duration)
+	seen    bool
+}
+
+func (f *firstByteReader) Read(b []byte) (int, error) {
+	n, err := f.r.Read(b)
+	if n > 0 && !f.seen {
+		f.seen = true
+		f.observe(time.Since(f.start))
+	}
+	return n, err
+}
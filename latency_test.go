@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyTracker_Percentile(t *testing.T) {
+	var tracker latencyTracker
+	if p := tracker.Percentile(50); p != 0 {
+		t.Errorf("expected 0 for empty tracker, got %s", p)
+	}
+
+	for i := 1; i <= 100; i++ {
+		tracker.Observe(time.Duration(i) * time.Millisecond)
+	}
+
+	if p := tracker.Percentile(50); p != 50*time.Millisecond {
+		t.Errorf("expected p50 to be 50ms, got %s", p)
+	}
+	if p := tracker.Percentile(99); p != 99*time.Millisecond {
+		t.Errorf("expected p99 to be 99ms, got %s", p)
+	}
+	if p := tracker.Percentile(100); p != 100*time.Millisecond {
+		t.Errorf("expected p100 to be 100ms, got %s", p)
+	}
+	if tracker.Count() != 100 {
+		t.Errorf("expected count to be 100, got %d", tracker.Count())
+	}
+	if tracker.Sum() != 5050*time.Millisecond {
+		t.Errorf("expected sum to be 5050ms, got %s", tracker.Sum())
+	}
+}
+
+func TestLatencyTracker_rollingWindow(t *testing.T) {
+	var tracker latencyTracker
+	for range latencySampleSize {
+		tracker.Observe(time.Second)
+	}
+	for range latencySampleSize {
+		tracker.Observe(time.Millisecond)
+	}
+
+	if p := tracker.Percentile(99); p != time.Millisecond {
+		t.Errorf("expected old samples to be evicted, got p99 %s", p)
+	}
+	if tracker.Count() != 2*latencySampleSize {
+		t.Errorf("expected count to be %d, got %d", 2*latencySampleSize, tracker.Count())
+	}
+}
+
+func Test_firstByteReader(t *testing.T) {
+	var observed []time.Duration
+	r := &firstByteReader{
+		r:       strings.NewReader("hello"),
+		start:   time.Now(),
+		observe: func(d time.Duration) { observed = append(observed, d) },
+	}
+
+	buf := make([]byte, 2)
+	for {
+		if _, err := r.Read(buf); err != nil {
+			break
+		}
+	}
+
+	if len(observed) != 1 {
+		t.Errorf("expected a single observation, got %d", len(observed))
+	}
+}
+
+func TestEWMA(t *testing.T) {
+	var e ewma
+	if e.Value() != 0 {
+		t.Errorf("expected 0 for empty average, got %s", e.Value())
+	}
+
+	e.Observe(100 * time.Millisecond)
+	if e.Value() != 100*time.Millisecond {
+		t.Errorf("expected first sample to seed the average, got %s", e.Value())
+	}
+
+	e.Observe(200 * time.Millisecond)
+	if e.Value() != 130*time.Millisecond {
+		t.Errorf("expected 130ms, got %s", e.Value())
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateWindow is the period over which accept and reject rates are averaged.
+const rateWindow = 60
+
+// rateCounter counts events in one-second buckets over a sliding window.
+type rateCounter struct {
+	mux     sync.Mutex
+	counts  [rateWindow]uint64
+	seconds [rateWindow]int64
+}
+
+// Add records an event at now.
+func (r *rateCounter) Add(now time.Time) {
+	r.AddN(now, 1)
+}
+
+// AddN records n events at now.
+func (r *rateCounter) AddN(now time.Time, n uint64) {
+	sec := now.Unix()
+	i := sec % rateWindow
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.seconds[i] != sec {
+		r.seconds[i] = sec
+		r.counts[i] = 0
+	}
+	r.counts[i] += n
+}
+
+// Rate returns the average number of events per second over the window
+// ending at now.
+func (r *rateCounter) Rate(now time.Time) float64 {
+	return r.RateOver(now, rateWindow)
+}
+
+// RateOver returns the average number of events per second over the last
+// seconds ending at now, which must be at most rateWindow.
+func (r *rateCounter) RateOver(now time.Time, seconds int64) float64 {
+	sec := now.Unix()
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	var total uint64
+	for i := range r.counts {
+		if sec-r.seconds[i] < seconds {
+			total += r.counts[i]
+		}
+	}
+	return float64(total) / float64(seconds)
+}
+
+// throughputWindow is the period in seconds over which backend throughput
+// is averaged.
+const throughputWindow = 10
+
+// byteCounter counts the bytes transferred in one direction, in total and
+// per second.
+type byteCounter struct {
+	total atomic.Uint64
+	rate  rateCounter
+	// recent counts the bytes since statistics were last reset.
+	recent rollingCounter
+}
+
+// Add records n bytes transferred now.
+func (c *byteCounter) Add(n int) {
+	if n <= 0 {
+		return
+	}
+	now := time.Now()
+	c.total.Add(uint64(n))
+	c.rate.AddN(now, uint64(n))
+	c.recent.AddN(now, uint64(n))
+}
+
+// Load returns the total number of bytes transferred.
+func (c *byteCounter) Load() uint64 {
+	return c.total.Load()
+}
+
+// Rate returns the throughput in bytes per second over the throughput
+// window ending at now.
+func (c *byteCounter) Rate(now time.Time) float64 {
+	return c.rate.RateOver(now, throughputWindow)
+}
+
+// listenerStats tracks connections handled by a pool's listener. For UDP
+// every datagram that opens a new exchange counts as a connection.
+type listenerStats struct {
+	active     atomic.Int64
+	accepted   atomic.Uint64
+	rejected   atomic.Uint64
+	acceptRate rateCounter
+	rejectRate rateCounter
+	// deadClients and deadBackends count connections closed because the
+	// peer stopped answering keepalive probes.
+	deadClients  atomic.Uint64
+	deadBackends atomic.Uint64
+	// idleClients counts connections closed because the client sent
+	// nothing before a backend would have been dialed.
+	idleClients atomic.Uint64
+	// acceptedRecent and rejectedRecent count connections since
+	// statistics were last reset at resetAt.
+	acceptedRecent rollingCounter
+	rejectedRecent rollingCounter
+	resetAt        atomic.Pointer[time.Time]
+}
+
+// accept records an accepted connection and returns a func to call when it
+// is closed.
+func (s *listenerStats) accept() func() {
+	now := time.Now()
+	s.accepted.Add(1)
+	s.acceptRate.Add(now)
+	s.acceptedRecent.Add(now)
+	s.active.Add(1)
+	return func() { s.active.Add(-1) }
+}
+
+// reject records a connection that could not be served by any backend.
+func (s *listenerStats) reject() {
+	now := time.Now()
+	s.rejected.Add(1)
+	s.rejectRate.Add(now)
+	s.rejectedRecent.Add(now)
+}
+
+// listenerView is a snapshot of listener statistics.
+type listenerView struct {
+	ActiveConnections int64   `json:"active_connections"`
+	Accepted          uint64  `json:"accepted"`
+	Rejected          uint64  `json:"rejected"`
+	AcceptRate        float64 `json:"accept_rate"`
+	RejectRate        float64 `json:"reject_rate"`
+	DeadPeers         uint64  `json:"dead_peer_evictions"`
+}
+
+func (s *listenerStats) view(now time.Time) listenerView {
+	return listenerView{
+		ActiveConnections: s.active.Load(),
+		Accepted:          s.accepted.Load(),
+		Rejected:          s.rejected.Load(),
+		AcceptRate:        s.acceptRate.Rate(now),
+		RejectRate:        s.rejectRate.Rate(now),
+		DeadPeers:         s.deadClients.Load() + s.deadBackends.Load(),
+	}
+}
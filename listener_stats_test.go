@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateCounter(t *testing.T) {
+	var r rateCounter
+	now := time.Unix(1000, 0)
+	if rate := r.Rate(now); rate != 0 {
+		t.Errorf("expected rate 0, got %f", rate)
+	}
+
+	for i := range 120 {
+		r.Add(now.Add(time.Duration(i) * 500 * time.Millisecond))
+	}
+	// 120 events over 60 seconds.
+	end := now.Add(59 * time.Second)
+	if rate := r.Rate(end); rate != 2 {
+		t.Errorf("expected rate 2, got %f", rate)
+	}
+
+	// Events older than the window are not counted.
+	if rate := r.Rate(end.Add(30 * time.Second)); rate != 1 {
+		t.Errorf("expected rate 1, got %f", rate)
+	}
+	if rate := r.Rate(end.Add(2 * time.Minute)); rate != 0 {
+		t.Errorf("expected rate 0, got %f", rate)
+	}
+}
+
+func TestRateCounter_RateOver(t *testing.T) {
+	var r rateCounter
+	now := time.Unix(1000, 0)
+	r.AddN(now.Add(-30*time.Second), 1000)
+	r.AddN(now.Add(-5*time.Second), 400)
+	r.AddN(now, 600)
+	if rate := r.RateOver(now, 10); rate != 100 {
+		t.Errorf("expected rate 100 over 10 seconds, got %f", rate)
+	}
+	if rate := r.Rate(now); rate != 2000.0/rateWindow {
+		t.Errorf("expected rate %f over the full window, got %f", 2000.0/rateWindow, rate)
+	}
+}
+
+func TestByteCounter(t *testing.T) {
+	var c byteCounter
+	c.Add(0)
+	c.Add(-1)
+	c.Add(2000)
+	if c.Load() != 2000 {
+		t.Errorf("expected 2000 bytes, got %d", c.Load())
+	}
+	if rate := c.Rate(time.Now()); rate != 2000/throughputWindow {
+		t.Errorf("expected rate %d, got %f", 2000/throughputWindow, rate)
+	}
+	if rate := c.Rate(time.Now().Add(throughputWindow * time.Second)); rate != 0 {
+		t.Errorf("expected rate 0 once the window has passed, got %f", rate)
+	}
+}
+
+func TestListenerStats(t *testing.T) {
+	var s listenerStats
+	done := s.accept()
+	s.accept()()
+	s.reject()
+
+	v := s.view(time.Now())
+	if v.ActiveConnections != 1 || v.Accepted != 2 || v.Rejected != 1 {
+		t.Errorf("expected 1 active, 2 accepted, 1 rejected, got %+v", v)
+	}
+	if v.AcceptRate <= 0 || v.RejectRate <= 0 {
+		t.Errorf("expected non-zero rates, got %+v", v)
+	}
+
+	done()
+	if v := s.view(time.Now()); v.ActiveConnections != 0 {
+		t.Errorf("expected 0 active connections, got %d", v.ActiveConnections)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sync"
+)
+
+// listenerManager starts and stops listeners, both at startup and when they
+// are added or removed at runtime through the admin API. Runtime changes are
+// persisted to the config file so they survive a restart.
+type listenerManager struct {
+	out        io.Writer
+	configPath string
+	timeouts   shutdownTimeouts
+	// prefixLogs prefixes each listener's log lines with its name.
+	prefixLogs bool
+	// shadow is a candidate config evaluated as a dry run alongside the
+	// listeners' own, or nil.
+	shadow *Config
+	// state restores the saved runtime state of each listener before it
+	// starts. It is nil if state persistence is disabled.
+	state *stateStore
+
+	// groups and health share backend groups and health states between
+	// the listeners.
+	groups *backendGroups
+	health *sharedHealth
+	// uptime records backend health transitions, or is nil.
+	uptime *uptimeLog
+
+	// mux serializes changes to the listeners and the config file.
+	mux       sync.Mutex
+	exporters map[string]*utilizationExporter
+}
+
+func newListenerManager(out io.Writer, configPath string, timeouts shutdownTimeouts, prefixLogs bool, state *stateStore) *listenerManager {
+	return &listenerManager{
+		out:        out,
+		configPath: configPath,
+		timeouts:   timeouts,
+		prefixLogs: prefixLogs,
+		state:      state,
+		groups:     newBackendGroups(log.New(out, "nlb: ", log.LstdFlags)),
+		health:     newSharedHealth(),
+		exporters:  make(map[string]*utilizationExporter),
+	}
+}
+
+func (m *listenerManager) logger(name string) *log.Logger {
+	if m.prefixLogs {
+		return log.New(m.out, fmt.Sprintf("nlb: [%s] ", name), log.LstdFlags)
+	}
+	return log.New(m.out, "nlb: ", log.LstdFlags)
+}
+
+// create creates the pool for a listener without starting it and restores
+// its saved state.
+func (m *listenerManager) create(lc *Config) (ServerPool, error) {
+	lc.groups, lc.health, lc.uptime = m.groups, m.health, m.uptime
+	pool, err := newServerPool(m.logger(lc.Name), lc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create server pool: %v", err)
+	}
+	m.state.restore(lc.Name, pool)
+	if err := m.attachShadow(lc.Name, pool); err != nil {
+		pool.Shutdown(context.Background())
+		return nil, err
+	}
+	return pool, nil
+}
+
+// start starts a created pool's health checks, traffic and autoscaling
+// exporter. On error the pool is shut down. The caller must hold m.mux.
+func (m *listenerManager) start(lc *Config, pool ServerPool) error {
+	pool.StartHealthChecks()
+	if err := pool.Start(); err != nil {
+		pool.Shutdown(context.Background())
+		return fmt.Errorf("failed to start server pool: %v", err)
+	}
+
+	if lc.AutoscalingExport != nil {
+		exporter, err := newUtilizationExporter(m.logger(lc.Name), lc.AutoscalingExport, lc.Addr, pool)
+		if err != nil {
+			pool.Shutdown(context.Background())
+			return fmt.Errorf("failed to create autoscaling exporter: %v", err)
+		}
+		exporter.Start()
+		m.exporters[lc.Name] = exporter
+	}
+	return nil
+}
+
+// attachShadow evaluates the listener of the dry-run config with the given
+// name alongside the pool.
+func (m *listenerManager) attachShadow(name string, pool ServerPool) error {
+	if m.shadow == nil {
+		return nil
+	}
+	for _, sc := range m.shadow.listenerConfigs() {
+		if sc.Name == name {
+			if err := pool.attachShadow(sc); err != nil {
+				return fmt.Errorf("invalid dry-run config: %w", err)
+			}
+			return nil
+		}
+	}
+	infof(m.logger(name), "dry-run: candidate config has no listener %q", name)
+	return nil
+}
+
+// startListener creates and starts a listener from the config file.
+func (m *listenerManager) startListener(lc *Config) (namedPool, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	pool, err := m.create(lc)
+	if err != nil {
+		return namedPool{}, err
+	}
+	if err := m.start(lc, pool); err != nil {
+		return namedPool{}, err
+	}
+	return namedPool{name: lc.Name, pool: pool}, nil
+}
+
+// stopExporters stops the autoscaling exporter of every listener.
+func (m *listenerManager) stopExporters() {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for name, exporter := range m.exporters {
+		exporter.Stop()
+		delete(m.exporters, name)
+	}
+}
+
+// add decodes a listener from its raw config, inheriting the top-level
+// settings of the config file, starts it and appends it to the file, so that
+// a listener failing to start is not started again on restart. exists
+// reports whether a listener name is already in use.
+func (m *listenerManager) add(listener map[string]any, exists func(name string) bool) (namedPool, error) {
+	if err := checkRuntimeListener(listener); err != nil {
+		return namedPool{}, err
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	raw, err := readRawConfig(m.configPath)
+	if err != nil {
+		return namedPool{}, fmt.Errorf("%w: %w", errConfigStore, err)
+	}
+	// The listener inherits settings from included files too, but is only
+	// written to the main config file.
+	merged, err := expandIncludes(raw, m.configPath)
+	if err != nil {
+		return namedPool{}, fmt.Errorf("%w: %w", errConfigStore, err)
+	}
+	strict, _ := merged["strict"].(bool)
+	lc, err := resolveListener(merged, listener, strict)
+	if err != nil {
+		return namedPool{}, err
+	}
+	rawListeners, _ := raw["listeners"].([]any)
+	if exists(lc.Name) || slices.ContainsFunc(rawList(merged["listeners"]), func(rl any) bool { return rawListenerName(rl) == lc.Name }) {
+		return namedPool{}, fmt.Errorf("%w: %s", errDuplicateListener, lc.Name)
+	}
+
+	pool, err := m.create(lc)
+	if err != nil {
+		return namedPool{}, err
+	}
+	if err := m.start(lc, pool); err != nil {
+		return namedPool{}, err
+	}
+	raw["listeners"] = append(rawListeners, listener)
+	if err := writeRawConfig(m.configPath, raw); err != nil {
+		if exporter := m.exporters[lc.Name]; exporter != nil {
+			exporter.Stop()
+			delete(m.exporters, lc.Name)
+		}
+		pool.Shutdown(context.Background())
+		return namedPool{}, fmt.Errorf("%w: %w", errConfigStore, err)
+	}
+	return namedPool{name: lc.Name, pool: pool}, nil
+}
+
+// checkRuntimeListener rejects the settings of a listener added through the
+// API that run commands or write or read files of nlb's host, which only
+// the config file may set. Settings inherited from the file are allowed.
+func checkRuntimeListener(listener map[string]any) error {
+	data, err := json.Marshal(listener)
+	if err != nil {
+		return fmt.Errorf("could not encode listener: %w", err)
+	}
+	var lc Config
+	if err := json.Unmarshal(data, &lc); err != nil {
+		return fmt.Errorf("could not decode listener: %w", err)
+	}
+	checks := []*HealthCheckConfig{lc.HealthCheck}
+	for _, hc := range lc.BackendHealthChecks {
+		checks = append(checks, hc)
+	}
+	if lc.DeepHealthCheck != nil {
+		checks = append(checks, &lc.DeepHealthCheck.HealthCheckConfig)
+	}
+	for _, g := range lc.BackendGroups {
+		if g != nil {
+			checks = append(checks, g.HealthCheck)
+		}
+	}
+	for _, hc := range checks {
+		if hc != nil && hc.Type == HealthCheckExec {
+			return errors.New("exec health checks cannot be set on listeners added at runtime")
+		}
+	}
+	switch {
+	case lc.AddressHooks != nil:
+		return errors.New("address_hooks cannot be set on listeners added at runtime")
+	case lc.CaptureDir != "":
+		return errors.New("capture_dir cannot be set on listeners added at runtime")
+	case lc.PanicRecovery != nil && lc.PanicRecovery.ReportDir != "":
+		return errors.New("panic_recovery report_dir cannot be set on listeners added at runtime")
+	case lc.TemplateDir != "":
+		return errors.New("template_dir cannot be set on listeners added at runtime")
+	}
+	return nil
+}
+
+// remove stops a listener, bounding each phase by the shutdown timeouts, and
+// removes it from the config file.
+func (m *listenerManager) remove(np namedPool) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	shutdown := newShutdownManager(m.logger(np.name))
+	shutdown.add("stop accepting", 0, func(context.Context) error {
+		return np.pool.StopAccepting()
+	})
+	if exporter := m.exporters[np.name]; exporter != nil {
+		delete(m.exporters, np.name)
+		shutdown.add("stop exporter", m.timeouts.exporters, func(context.Context) error {
+			exporter.Stop()
+			return nil
+		})
+	}
+	shutdown.add("drain connections", max(m.timeouts.drain, np.pool.longConnectionGrace()), np.pool.Drain)
+	shutdown.add("stop health checks", m.timeouts.healthChecks, np.pool.stopHealthChecks)
+	stopErr := shutdown.run()
+
+	raw, err := readRawConfig(m.configPath)
+	if err == nil {
+		rawListeners, _ := raw["listeners"].([]any)
+		raw["listeners"] = slices.DeleteFunc(rawListeners, func(rl any) bool { return rawListenerName(rl) == np.name })
+		err = writeRawConfig(m.configPath, raw)
+	}
+	if err != nil {
+		err = fmt.Errorf("%w: %w", errConfigStore, err)
+	}
+	return errors.Join(stopErr, err)
+}
+
+// checkRemovable returns errIncludedListener if the listener is defined in
+// a file included by the config file rather than in the file itself.
+func (m *listenerManager) checkRemovable(name string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	raw, err := readRawConfig(m.configPath)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errConfigStore, err)
+	}
+	if _, ok := raw["includes"]; !ok || slices.ContainsFunc(rawList(raw["listeners"]), func(rl any) bool { return rawListenerName(rl) == name }) {
+		return nil
+	}
+	merged, err := expandIncludes(raw, m.configPath)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errConfigStore, err)
+	}
+	if slices.ContainsFunc(rawList(merged["listeners"]), func(rl any) bool { return rawListenerName(rl) == name }) {
+		return fmt.Errorf("%w: %s", errIncludedListener, name)
+	}
+	return nil
+}
+
+func rawListenerName(rl any) string {
+	listener, _ := rl.(map[string]any)
+	name, _ := listener["name"].(string)
+	return name
+}
+
+// writeRawConfig replaces the config file with raw.
+func writeRawConfig(filePath string, raw map[string]any) error {
+	raw["version"] = currentConfigVersion
+	data, err := json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode config: %w", err)
+	}
+	return writeFileAtomic(filePath, append(data, '\n'))
+}
+
+var (
+	errDuplicateListener = errors.New("duplicate listener")
+	// errConfigStore is returned when the config file cannot be read or
+	// updated.
+	errConfigStore = errors.New("could not update config file")
+)
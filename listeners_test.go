@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConsole_addRemoveListener(t *testing.T) {
+	backend := startNamedBackend(t, "a")
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{
+		"protocol": "tcp",
+		"backends": ["tcp://`+backend+`"],
+		"listeners": [{"name": "web", "addr": "127.0.0.1:0"}]
+	}`), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	timeouts, _ := newShutdownTimeouts(nil)
+	listeners := newListenerManager(io.Discard, path, timeouts, true, nil)
+	web, err := listeners.startListener(config.Listeners[0])
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer web.pool.Shutdown(t.Context())
+	c := newConsole([]namedPool{web}, tmpl, listeners)
+	srv := httptest.NewServer(c.handler(""))
+	defer srv.Close()
+
+	do := func(method, path, body string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to %s %s: %v", method, path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := do("POST", "/api/listeners", `{"name": "api", "addr": "127.0.0.1:0"}`); code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", code)
+	}
+	if code := do("GET", "/listeners/api/api/backends", ""); code != http.StatusOK {
+		t.Errorf("expected new listener's routes to be served, got %d", code)
+	}
+	for body, want := range map[string]int{
+		`{"name": "api", "addr": "127.0.0.1:0"}`:      http.StatusConflict,
+		`{"name": "web", "addr": "127.0.0.1:0"}`:      http.StatusConflict,
+		`{"name": "bad name", "addr": "127.0.0.1:0"}`: http.StatusBadRequest,
+		`{"name": "x", "protocol": "sctp"}`:           http.StatusBadRequest,
+		`not json`:                                    http.StatusBadRequest,
+		// Settings running commands or touching files are left to the file.
+		`{"name": "x", "addr": "127.0.0.1:0", "health_check": {"type": "exec", "command": ["true"]}}`:       http.StatusBadRequest,
+		`{"name": "x", "addr": "127.0.0.1:0", "backend_groups": {"g": {"health_check": {"type": "exec"}}}}`: http.StatusBadRequest,
+		`{"name": "x", "addr": "127.0.0.1:0", "address_hooks": {"up": ["true"]}}`:                           http.StatusBadRequest,
+		`{"name": "x", "addr": "127.0.0.1:0", "capture_dir": "/tmp"}`:                                       http.StatusBadRequest,
+		`{"name": "x", "addr": "127.0.0.1:0", "panic_recovery": {"report_dir": "/tmp"}}`:                    http.StatusBadRequest,
+		// A listener failing to start is not written to the config.
+		`{"name": "x", "addr": "127.0.0.1:0", "autoscaling_export": {"url": "http://127.0.0.1:1", "interval": "soon"}}`: http.StatusBadRequest,
+	} {
+		if code := do("POST", "/api/listeners", body); code != want {
+			t.Errorf("expected status %d for %s, got %d", want, body, code)
+		}
+	}
+
+	// The new listener inherits the top-level backends and proxies to them.
+	var summaries []listenerSummary
+	resp, err := http.Get(srv.URL + "/api/listeners")
+	if err != nil {
+		t.Fatalf("failed to list listeners: %v", err)
+	}
+	json.NewDecoder(resp.Body).Decode(&summaries)
+	resp.Body.Close()
+	if len(summaries) != 2 || summaries[1].Name != "api" {
+		t.Fatalf("expected web and api listeners, got %+v", summaries)
+	}
+	addr := c.snapshot()[1].pool.(*TCPServerPool).listener.Addr().String()
+	var greeting []byte
+	for deadline := time.Now().Add(2 * time.Second); string(greeting) != "a\n" && time.Now().Before(deadline); {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to connect to new listener: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		greeting = make([]byte, 2)
+		io.ReadFull(conn, greeting)
+		conn.Close()
+	}
+	if string(greeting) != "a\n" {
+		t.Errorf("expected greeting from backend a, got %q", greeting)
+	}
+
+	reloaded, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("expected persisted config to load, got %v", err)
+	}
+	if len(reloaded.Listeners) != 2 || reloaded.Listeners[1].Name != "api" || len(reloaded.Listeners[1].Backends) != 1 {
+		t.Errorf("expected api listener to be persisted, got %+v", reloaded.Listeners)
+	}
+
+	// Listeners are only changed from localhost.
+	for _, req := range []*http.Request{
+		httptest.NewRequest("POST", "/api/listeners", strings.NewReader(`{"name": "remote", "addr": "127.0.0.1:0"}`)),
+		httptest.NewRequest("DELETE", "/api/listeners/api", nil),
+	} {
+		rec := httptest.NewRecorder()
+		c.handler("").ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("expected status 403 for %s from %s, got %d", req.Method, req.RemoteAddr, rec.Code)
+		}
+	}
+
+	if code := do("DELETE", "/api/listeners/api", ""); code != http.StatusNoContent {
+		t.Errorf("expected status 204, got %d", code)
+	}
+	if code := do("DELETE", "/api/listeners/api", ""); code != http.StatusNotFound {
+		t.Errorf("expected status 404 for removed listener, got %d", code)
+	}
+	if code := do("GET", "/listeners/api/api/backends", ""); code != http.StatusNotFound {
+		t.Errorf("expected removed listener's routes to be gone, got %d", code)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Errorf("expected removed listener to stop accepting")
+	}
+	reloaded, err = loadConfig(path)
+	if err != nil {
+		t.Fatalf("expected persisted config to load, got %v", err)
+	}
+	if len(reloaded.Listeners) != 1 || reloaded.Listeners[0].Name != "web" {
+		t.Errorf("expected api listener to be removed from config, got %+v", reloaded.Listeners)
+	}
+}
+
+func TestNewConsole_fixedListeners(t *testing.T) {
+	web := newConsoleTestPool("web", true)
+	dns := newConsoleTestPool("dns", true)
+	srv := httptest.NewServer(newConsole([]namedPool{{"web", consoleTestPool{web}}, {"dns", consoleTestPool{dns}}}, tmpl, nil).handler(""))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/api/listeners", "application/json", strings.NewReader(`{"name": "api"}`))
+	if err != nil {
+		t.Fatalf("failed to post listener: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405 without a listener manager, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// logLevel is the verbosity of the log. The zero value is info.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota - 1
+	levelInfo
+	levelWarn
+)
+
+var logLevelNames = map[logLevel]string{levelDebug: "debug", levelInfo: "info", levelWarn: "warn"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for level, name := range logLevelNames {
+		if s == name {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level %q: must be %q, %q or %q", s, "debug", "info", "warn")
+}
+
+// logLevels is the log level of the process, changed at runtime through the
+// admin API and signals.
+var logLevels logLevelControl
+
+// logLevelControl holds a log level, which can be temporarily raised to
+// debug. The zero value is at info.
+type logLevelControl struct {
+	level atomic.Int64
+	// debugUntil is when a temporary debug level ends, in Unix nanoseconds,
+	// or 0.
+	debugUntil atomic.Int64
+}
+
+// Level returns the level in effect at now.
+func (c *logLevelControl) Level(now time.Time) logLevel {
+	if until := c.debugUntil.Load(); until != 0 && now.UnixNano() < until {
+		return levelDebug
+	}
+	return logLevel(c.level.Load())
+}
+
+// DebugUntil returns when a temporary debug level in effect at now ends, or
+// the zero time.
+func (c *logLevelControl) DebugUntil(now time.Time) time.Time {
+	if until := c.debugUntil.Load(); until != 0 && now.UnixNano() < until {
+		return time.Unix(0, until)
+	}
+	return time.Time{}
+}
+
+// Set sets the level, ending any temporary debug level.
+func (c *logLevelControl) Set(level logLevel) {
+	c.level.Store(int64(level))
+	c.debugUntil.Store(0)
+}
+
+// DebugFor logs at debug for d from now, then returns to the level set.
+func (c *logLevelControl) DebugFor(d time.Duration, now time.Time) {
+	c.debugUntil.Store(now.Add(d).UnixNano())
+}
+
+// Step makes the log more verbose for a negative delta and less for a
+// positive one, within the known levels, and returns the new level.
+func (c *logLevelControl) Step(delta int, now time.Time) logLevel {
+	level := min(max(c.Level(now)+logLevel(delta), levelDebug), levelWarn)
+	c.Set(level)
+	return level
+}
+
+// enabled reports whether lines at level are logged.
+func (c *logLevelControl) enabled(level logLevel) bool {
+	return level >= c.Level(time.Now())
+}
+
+// debugf logs a line at debug level. Arguments are not formatted unless it
+// is enabled.
+func debugf(l *log.Logger, format string, args ...any) {
+	if logLevels.enabled(levelDebug) {
+		l.Printf("DEBUG: "+format, args...)
+	}
+}
+
+// infof logs a line at info level.
+func infof(l *log.Logger, format string, args ...any) {
+	if logLevels.enabled(levelInfo) {
+		l.Printf(format, args...)
+	}
+}
+
+// warnf logs a line reporting a warning, an error or a failure. Warn is
+// the least verbose level, so these lines are always logged.
+func warnf(l *log.Logger, format string, args ...any) {
+	l.Printf(format, args...)
+}
+
+// logLevelView is the JSON representation of the log level.
+type logLevelView struct {
+	Level string `json:"level"`
+	// DebugUntil is when a temporary debug level ends.
+	DebugUntil *time.Time `json:"debug_until,omitempty"`
+}
+
+func newLogLevelView(c *logLevelControl, now time.Time) logLevelView {
+	v := logLevelView{Level: c.Level(now).String()}
+	if until := c.DebugUntil(now); !until.IsZero() {
+		v.DebugUntil = &until
+	}
+	return v
+}
+
+// logLevelAPIHandler returns the log level.
+func logLevelAPIHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, newLogLevelView(&logLevels, time.Now()))
+}
+
+// setLogLevelAPIHandler sets the log level. With a duration, the log is at
+// debug for that long and then returns to its previous level.
+func setLogLevelAPIHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Level    string `json:"level"`
+		Duration string `json:"duration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	now := time.Now()
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid duration: %w", err))
+			return
+		}
+		if d <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("duration must be positive"))
+			return
+		}
+		if req.Level != "" && req.Level != levelDebug.String() {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("a duration can only be given for level %q", levelDebug))
+			return
+		}
+		logLevels.DebugFor(d, now)
+		writeJSON(w, http.StatusOK, newLogLevelView(&logLevels, now))
+		return
+	}
+	level, err := parseLogLevel(req.Level)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	logLevels.Set(level)
+	writeJSON(w, http.StatusOK, newLogLevelView(&logLevels, now))
+}
@@ -0,0 +1,37 @@
+//go:build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// handleLogLevelSignals makes the log more verbose on SIGUSR1 and less on
+// SIGUSR2 until the returned func is called.
+func handleLogLevelSignals(l *log.Logger) func() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1, syscall.SIGUSR2)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-sigChan:
+				delta := 1
+				if sig == syscall.SIGUSR1 {
+					delta = -1
+				}
+				infof(l, "received %s, log level is now %s", sig, logLevels.Step(delta, time.Now()))
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigChan)
+		close(done)
+	}
+}
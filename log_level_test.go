@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogLevelControl(t *testing.T) {
+	var c logLevelControl
+	now := time.Now()
+	if c.Level(now) != levelInfo {
+		t.Errorf("expected info by default, got %s", c.Level(now))
+	}
+	c.DebugFor(time.Minute, now)
+	if c.Level(now) != levelDebug || c.DebugUntil(now).IsZero() {
+		t.Errorf("expected debug for a minute, got %s", c.Level(now))
+	}
+	if later := now.Add(2 * time.Minute); c.Level(later) != levelInfo || !c.DebugUntil(later).IsZero() {
+		t.Errorf("expected info once the minute is over, got %s", c.Level(later))
+	}
+	if got := c.Step(1, now); got != levelInfo {
+		t.Errorf("expected stepping down from a temporary debug level to give info, got %s", got)
+	}
+	for _, want := range []logLevel{levelWarn, levelWarn} {
+		if got := c.Step(1, now); got != want {
+			t.Errorf("expected %s, got %s", want, got)
+		}
+	}
+	c.Step(-5, now)
+	if c.Level(now) != levelDebug {
+		t.Errorf("expected stepping up to stop at debug, got %s", c.Level(now))
+	}
+}
+
+func TestLogLevelHelpers(t *testing.T) {
+	t.Cleanup(func() { logLevels.Set(levelInfo) })
+	var buf bytes.Buffer
+	l := log.New(&buf, "nlb: ", 0)
+	logAll := func() {
+		debugf(l, "connected")
+		infof(l, "server pool ready")
+		// The level is the helper's, whatever the line says.
+		infof(l, "connection from %s to failover-a:80 closed", "ERROR DEBUG: ")
+		warnf(l, "health check of backend a:80 timed out")
+	}
+	for _, tt := range []struct {
+		level logLevel
+		lines int
+	}{{levelDebug, 4}, {levelInfo, 3}, {levelWarn, 1}} {
+		buf.Reset()
+		logLevels.Set(tt.level)
+		logAll()
+		if n := strings.Count(buf.String(), "\n"); n != tt.lines {
+			t.Errorf("expected %d lines at %s, got %q", tt.lines, tt.level, buf.String())
+		}
+	}
+}
+
+func TestLogLevelAPI(t *testing.T) {
+	t.Cleanup(func() { logLevels.Set(levelInfo) })
+	put := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		setLogLevelAPIHandler(rec, httptest.NewRequest(http.MethodPut, "/api/log-level", strings.NewReader(body)))
+		return rec
+	}
+	for _, body := range []string{`{"level":"verbose"}`, `{"duration":"soon"}`, `{"duration":"-1m"}`, `{"level":"warn","duration":"1m"}`, `nope`} {
+		if rec := put(body); rec.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400 for %s, got %d", body, rec.Code)
+		}
+	}
+	if rec := put(`{"level":"warn"}`); rec.Code != http.StatusOK || logLevels.Level(time.Now()) != levelWarn {
+		t.Errorf("expected the level to be set to warn, got %d: %s", rec.Code, rec.Body)
+	}
+
+	var logs bytes.Buffer
+	l := log.New(&logs, "", 0)
+	debugf(l, "hidden")
+	put(`{"duration":"10m"}`)
+	debugf(l, "shown")
+	if logs.String() != "DEBUG: shown\n" {
+		t.Errorf("expected only the line logged at debug to be written, got %q", logs.String())
+	}
+
+	rec := httptest.NewRecorder()
+	logLevelAPIHandler(rec, httptest.NewRequest(http.MethodGet, "/api/log-level", nil))
+	var v logLevelView
+	if err := json.NewDecoder(rec.Body).Decode(&v); err != nil {
+		t.Fatalf("failed to decode log level: %v", err)
+	}
+	if v.Level != "debug" || v.DebugUntil == nil || time.Until(*v.DebugUntil) < 9*time.Minute {
+		t.Errorf("expected debug for 10 minutes, got %+v", v)
+	}
+}
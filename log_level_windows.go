@@ -0,0 +1,9 @@
+package main
+
+import "log"
+
+// handleLogLevelSignals does nothing: Windows has no user signals. The log
+// level is changed through the admin API instead.
+func handleLogLevelSignals(*log.Logger) func() {
+	return func() {}
+}
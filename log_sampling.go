@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+)
+
+// logSampler picks the connections whose debug lines are logged whatever
+// the log level, so that per-connection detail can be kept in production
+// without logging every connection.
+type logSampler struct {
+	// every samples one connection in every, or none if 0.
+	every   uint64
+	clients []netip.Prefix
+	n       atomic.Uint64
+}
+
+func newLogSampler(config *LogSamplingConfig) (*logSampler, error) {
+	if config == nil || (config.Every == 0 && len(config.Clients) == 0) {
+		return nil, nil
+	}
+	if config.Every < 0 {
+		return nil, fmt.Errorf("log_sampling every must not be negative")
+	}
+	s := &logSampler{every: uint64(config.Every)}
+	for _, c := range config.Clients {
+		prefix, err := parsePrefix(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log_sampling client %q: %w", c, err)
+		}
+		s.clients = append(s.clients, prefix)
+	}
+	return s, nil
+}
+
+// sample reports whether the debug lines of a new connection from client
+// are logged. A nil logSampler samples nothing.
+func (s *logSampler) sample(client net.Addr) bool {
+	if s == nil {
+		return false
+	}
+	if addr, ok := addrFromNetAddr(client); ok && slices.ContainsFunc(s.clients, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+		return true
+	}
+	return s.every > 0 && s.n.Add(1)%s.every == 1%s.every
+}
+
+// connDebugf logs a line about a connection at debug level, or at info
+// level if the connection is sampled.
+func connDebugf(l *log.Logger, sampled bool, format string, args ...any) {
+	switch {
+	case logLevels.enabled(levelDebug):
+		l.Printf("DEBUG: "+format, args...)
+	case sampled && logLevels.enabled(levelInfo):
+		l.Printf("SAMPLED: "+format, args...)
+	}
+}
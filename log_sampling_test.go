@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strings"
+	"testing"
+)
+
+func Test_newLogSampler(t *testing.T) {
+	if s, err := newLogSampler(nil); s != nil || err != nil {
+		t.Errorf("expected no sampler when not configured, got %v, %v", s, err)
+	}
+	for _, config := range []*LogSamplingConfig{{Every: -1}, {Clients: []string{"10.0.0.0/33"}}} {
+		if _, err := newLogSampler(config); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
+
+func TestLogSampler_sample(t *testing.T) {
+	s, err := newLogSampler(&LogSamplingConfig{Every: 4, Clients: []string{"10.1.0.0/16"}})
+	if err != nil {
+		t.Fatalf("failed to create sampler: %v", err)
+	}
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}
+	sampled := 0
+	for range 100 {
+		if s.sample(client) {
+			sampled++
+		}
+	}
+	if sampled != 25 {
+		t.Errorf("expected 1 in 4 connections to be sampled, got %d of 100", sampled)
+	}
+	for range 3 {
+		if !s.sample(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}) {
+			t.Errorf("expected every connection from a sampled client to be sampled")
+		}
+	}
+	var none *logSampler
+	if none.sample(client) {
+		t.Errorf("expected a nil sampler to sample nothing")
+	}
+}
+
+func Test_connDebugf(t *testing.T) {
+	var buf bytes.Buffer
+	l := log.New(&buf, "", 0)
+	connDebugf(l, false, "not sampled")
+	connDebugf(l, true, "sampled")
+	if buf.String() != "SAMPLED: sampled\n" {
+		t.Errorf("expected only the sampled line at info, got %q", buf.String())
+	}
+
+	logLevels.Set(levelWarn)
+	t.Cleanup(func() { logLevels.Set(levelInfo) })
+	buf.Reset()
+	connDebugf(l, true, "sampled")
+	if strings.Contains(buf.String(), "sampled") {
+		t.Errorf("expected sampled lines to be dropped at warn, got %q", buf.String())
+	}
+}
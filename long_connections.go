@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultLongConnectionThreshold = time.Minute
+	defaultLongConnectionGrace     = 5 * time.Minute
+)
+
+// errBackendDrained is the cause of connections closed because the grace
+// period of their backend's drain ran out.
+var errBackendDrained = errors.New("backend drained")
+
+// longConnPolicy governs how drains treat long-lived connections, such as
+// MQTT sessions or websockets, which rarely finish on their own. Draining a
+// backend stops selecting it, waits up to grace for its connections to
+// finish and then closes the rest; shutdown drains wait up to grace too.
+// Connections open longer than threshold are reported as long-lived. A nil
+// *longConnPolicy applies the defaults to backend drains and leaves shutdown
+// to the shutdown drain timeout.
+type longConnPolicy struct {
+	threshold time.Duration
+	grace     time.Duration
+}
+
+// newLongConnPolicy validates config, returning nil if the policy is not
+// enabled.
+func newLongConnPolicy(config *LongConnectionsConfig) (*longConnPolicy, error) {
+	if config == nil || !config.Enabled {
+		return nil, nil
+	}
+	lp := &longConnPolicy{
+		threshold: defaultLongConnectionThreshold,
+		grace:     defaultLongConnectionGrace,
+	}
+	for _, f := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"threshold", config.Threshold, &lp.threshold},
+		{"grace", config.Grace, &lp.grace},
+	} {
+		if f.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(f.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid long_connections %s: %w", f.name, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("long_connections %s must be positive", f.name)
+		}
+		*f.dst = d
+	}
+	return lp, nil
+}
+
+// Threshold returns the age from which a connection is long-lived.
+func (lp *longConnPolicy) Threshold() time.Duration {
+	if lp == nil {
+		return defaultLongConnectionThreshold
+	}
+	return lp.threshold
+}
+
+// Grace returns how long a drained backend's connections may stay open.
+func (lp *longConnPolicy) Grace() time.Duration {
+	if lp == nil {
+		return defaultLongConnectionGrace
+	}
+	return lp.grace
+}
+
+// longConnectionGrace returns how long shutdown should wait for the pool's
+// connections to drain, or zero to use the shutdown drain timeout.
+func (p *BaseServerPool) longConnectionGrace() time.Duration {
+	if p.longConns == nil {
+		return 0
+	}
+	return p.longConns.grace
+}
+
+// backendConnections returns the number of in-flight connections to the
+// backend and how many of them are long-lived.
+func (p *BaseServerPool) backendConnections(b *Backend, now time.Time) (n, long int) {
+	return p.conns.countWhere(func(c *trackedConn) bool {
+		return c.backend.Load() == b
+	}, now.Add(-p.longConns.Threshold()))
+}
+
+// drainBackend stops selecting the backend and closes the connections still
+// pinning it once grace has passed. The backend stays out of rotation until
+// undrainBackend is called. It reports false if the backend is already
+// draining.
+func (p *BaseServerPool) drainBackend(b *Backend, grace time.Duration) bool {
+	cancelled := b.startDrain()
+	if cancelled == nil {
+		return false
+	}
+	n, long := p.backendConnections(b, time.Now())
+	infof(p.log, "draining backend %s: waiting up to %s for %d connections (%d long-lived)", b.URL.Host, grace, n, long)
+	go p.waitBackendDrained(b, grace, cancelled)
+	return true
+}
+
+// undrainBackend puts a draining backend back into rotation. It reports
+// false if the backend was not draining.
+func (p *BaseServerPool) undrainBackend(b *Backend) bool {
+	if !b.stopDrain() {
+		return false
+	}
+	infof(p.log, "backend %s is no longer draining", b.URL.Host)
+	return true
+}
+
+// waitBackendDrained waits up to grace for the backend's connections to
+// finish, then closes the remaining ones. It gives up if the drain is
+// cancelled, the backend is removed or the pool shuts down.
+func (p *BaseServerPool) waitBackendDrained(b *Backend, grace time.Duration, cancelled <-chan struct{}) {
+	deadline := time.NewTimer(grace)
+	defer deadline.Stop()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.shutdown:
+			return
+		case <-b.removed:
+			return
+		case <-cancelled:
+			return
+		case <-ticker.C:
+			if b.ActiveConnections() == 0 {
+				infof(p.log, "backend %s drained", b.URL.Host)
+				return
+			}
+		case <-deadline.C:
+			_, long := p.backendConnections(b, time.Now())
+			n := p.conns.closeWhere(func(c *trackedConn) bool {
+				return c.backend.Load() == b
+			}, errBackendDrained)
+			infof(p.log, "closing %d connections (%d long-lived) still pinning backend %s after %s", n, long, b.URL.Host, grace)
+			return
+		}
+	}
+}
+
+// drainView reports the progress of a backend drain.
+type drainView struct {
+	Backend  string `json:"backend"`
+	Draining bool   `json:"draining"`
+	// Connections are the in-flight connections pinning the backend, of
+	// which LongConnections have been open longer than the threshold.
+	Connections     int `json:"connections"`
+	LongConnections int `json:"long_connections"`
+}
+
+func (p *BaseServerPool) newDrainView(b *Backend) drainView {
+	v := drainView{Backend: b.URL.String(), Draining: b.Draining()}
+	v.Connections, v.LongConnections = p.backendConnections(b, time.Now())
+	return v
+}
+
+// drainStatusAPIHandler reports whether a backend is draining and how many
+// connections still pin it.
+func (p *BaseServerPool) drainStatusAPIHandler(w http.ResponseWriter, r *http.Request) {
+	b := p.findBackend(r.PathValue("backend"))
+	if b == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("backend %q not found", r.PathValue("backend")))
+		return
+	}
+	writeJSON(w, http.StatusOK, p.newDrainView(b))
+}
+
+// drainBackendAPIHandler starts draining a backend. The request body may set
+// the grace period, which defaults to the long_connections grace.
+func (p *BaseServerPool) drainBackendAPIHandler(w http.ResponseWriter, r *http.Request) {
+	b := p.findBackend(r.PathValue("backend"))
+	if b == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("backend %q not found", r.PathValue("backend")))
+		return
+	}
+	var req struct {
+		Grace string `json:"grace"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	grace := p.longConns.Grace()
+	if req.Grace != "" {
+		var err error
+		if grace, err = time.ParseDuration(req.Grace); err != nil || grace <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid grace %q: must be a positive duration", req.Grace))
+			return
+		}
+	}
+	if !p.drainBackend(b, grace) {
+		writeError(w, http.StatusConflict, fmt.Errorf("backend %s is already draining", b.URL.Host))
+		return
+	}
+	writeJSON(w, http.StatusAccepted, p.newDrainView(b))
+}
+
+// undrainBackendAPIHandler cancels a backend's drain, putting it back into
+// rotation.
+func (p *BaseServerPool) undrainBackendAPIHandler(w http.ResponseWriter, r *http.Request) {
+	b := p.findBackend(r.PathValue("backend"))
+	if b == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("backend %q not found", r.PathValue("backend")))
+		return
+	}
+	if !p.undrainBackend(b) {
+		writeError(w, http.StatusConflict, fmt.Errorf("backend %s is not draining", b.URL.Host))
+		return
+	}
+	writeJSON(w, http.StatusOK, p.newDrainView(b))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_newLongConnPolicy(t *testing.T) {
+	if lp, err := newLongConnPolicy(&LongConnectionsConfig{}); lp != nil || err != nil {
+		t.Errorf("expected nil when disabled, got %v, %v", lp, err)
+	}
+	var nilPolicy *longConnPolicy
+	if nilPolicy.Threshold() != defaultLongConnectionThreshold || nilPolicy.Grace() != defaultLongConnectionGrace {
+		t.Errorf("expected a nil policy to use the defaults")
+	}
+	lp, err := newLongConnPolicy(&LongConnectionsConfig{Enabled: true, Grace: "10m"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if lp.Threshold() != defaultLongConnectionThreshold || lp.Grace() != 10*time.Minute {
+		t.Errorf("expected threshold %s and grace 10m, got %s and %s", defaultLongConnectionThreshold, lp.Threshold(), lp.Grace())
+	}
+	for _, config := range []LongConnectionsConfig{
+		{Enabled: true, Threshold: "long"},
+		{Enabled: true, Grace: "0s"},
+	} {
+		if _, err := newLongConnPolicy(&config); err == nil {
+			t.Errorf("expected error for %+v", config)
+		}
+	}
+}
+
+func TestBaseServerPool_drainBackendAPIHandler(t *testing.T) {
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:            "127.0.0.1:0",
+		Backends:        []BackendConfig{{URL: startNamedBackend(t, "a")}, {URL: startNamedBackend(t, "b")}},
+		LongConnections: &LongConnectionsConfig{Enabled: true, Threshold: "1ms"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	for _, b := range pool.backends {
+		b.SetHealthy(true)
+	}
+	pool.Start()
+	defer pool.Shutdown(t.Context())
+
+	mux := http.NewServeMux()
+	registerPoolRoutes(mux, "", pool)
+	serve := func(method, backend, body string) (int, drainView) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, "/api/backends/"+backend+"/drain", strings.NewReader(body)))
+		var view drainView
+		json.NewDecoder(rec.Body).Decode(&view)
+		return rec.Code, view
+	}
+
+	_, r, greeting := dialEcho(t, pool)
+	drained := pool.backends[0]
+	if greeting != "a\n" {
+		drained = pool.backends[1]
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	code, view := serve("POST", drained.ID, `{"grace": "200ms"}`)
+	if code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d", code)
+	}
+	if !view.Draining || view.Connections != 1 || view.LongConnections != 1 {
+		t.Errorf("expected one long-lived connection pinning the draining backend, got %+v", view)
+	}
+	if code, _ := serve("POST", drained.ID, ""); code != http.StatusConflict {
+		t.Errorf("expected status 409 for a backend already draining, got %d", code)
+	}
+	for range 4 {
+		if b := pool.Next(nil); b == drained {
+			t.Errorf("expected draining backend not to be selected")
+		}
+	}
+
+	// The connection is closed once the grace period has passed.
+	expectClosed(t, r)
+	if _, view := serve("GET", drained.ID, ""); !view.Draining || view.Connections != 0 {
+		t.Errorf("expected a drained backend without connections, got %+v", view)
+	}
+
+	if code, view := serve("DELETE", drained.ID, ""); code != http.StatusOK || view.Draining {
+		t.Errorf("expected the drain to be cancelled, got %d: %+v", code, view)
+	}
+	if code, _ := serve("DELETE", drained.ID, ""); code != http.StatusConflict {
+		t.Errorf("expected status 409 for a backend not draining, got %d", code)
+	}
+	if code, _ := serve("POST", drained.ID, `{"grace": "soon"}`); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid grace, got %d", code)
+	}
+	if code, _ := serve("GET", "missing", ""); code != http.StatusNotFound {
+		t.Errorf("expected status 404 for an unknown backend, got %d", code)
+	}
+}
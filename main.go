@@ -2,81 +2,259 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
-	"time"
+	"strings"
+	"syscall"
 )
 
+// shutdownSignals stop nlb gracefully. On Windows, closing the console,
+// logging off and system shutdown are delivered as SIGTERM.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// subcommands are the tools run by nlb <command> instead of the balancer:
+// nlb ctl manages a running nlb through its admin API, nlb bench generates
+// load against one, and nlb version prints the version and build.
+var subcommands = map[string]func(ctx context.Context, out io.Writer, args []string) error{
+	"ctl":     runCtl,
+	"bench":   runBench,
+	"version": runVersion,
+}
+
 func main() {
-	if err := run(os.Args[1:]); err != nil {
+	if len(os.Args) > 1 && subcommands[os.Args[1]] != nil {
+		ctx, stop := signal.NotifyContext(context.Background(), shutdownSignals...)
+		defer stop()
+		if err := subcommands[os.Args[1]](ctx, os.Stdout, os.Args[2:]); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return
+			}
+			log.Fatalf("error: %v", err)
+		}
+		return
+	}
+
+	// When started by the Windows service manager, nlb runs as a service.
+	if isService, err := runService(os.Args[1:]); isService {
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	} else if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+	if err := run(ctx, os.Stdout, os.Args[1:]); err != nil {
 		log.Fatalf("error: %v", err)
 	}
 }
 
-func run(args []string) error {
-	if len(args) < 1 {
-		return fmt.Errorf("please provide the path to the config file as the first argument")
+// signalContext returns a context that is cancelled when a shutdown signal
+// is received, with the signal as its cause.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, shutdownSignals...)
+	go func() {
+		select {
+		case sig := <-sigChan:
+			cancel(fmt.Errorf("received signal: %s", sig))
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(sigChan)
+		cancel(context.Canceled)
+	}
+}
+
+// newServerPool creates a pool for the protocol of the given listener config.
+func newServerPool(l *log.Logger, config *Config) (ServerPool, error) {
+	switch config.Protocol {
+	case "tcp":
+		return NewTCPServerPool(l, config)
+	case "udp":
+		return NewUDPServerPool(l, config)
+	case protocolTCPUDP:
+		return newServicePool(l, config)
+	default:
+		return nil, fmt.Errorf("unsupported protocol: %s", config.Protocol)
+	}
+}
+
+// run starts the listeners and console described by the config file in
+// args, or by the environment if there is none, and serves until ctx is
+// cancelled, then shuts down. Logs are written to out.
+func run(ctx context.Context, out io.Writer, args []string) error {
+	flags := flag.NewFlagSet("nlb", flag.ContinueOnError)
+	flags.SetOutput(out)
+	dryRun := flags.String("dry-run", "", "evaluate the routing decisions of this candidate config alongside the active one")
+	selfTestOnly := flags.Bool("self-test", false, "check the config's addresses and dial each backend, print a report and exit")
+	var sets []string
+	flags.Func("set", "set a config `key=value` when running without a config file, overriding its NLB_ environment variable", func(kv string) error {
+		sets = append(sets, kv)
+		return nil
+	})
+	if err := flags.Parse(args); err != nil {
+		return err
 	}
+	args = flags.Args()
 
+	// Without a config file, the config is built from the environment.
 	var err error
-	config, err := loadConfig(args[0])
+	var config *Config
+	var configPath string
+	var ignoredEnv []string
+	if len(args) > 0 {
+		if len(sets) > 0 {
+			return fmt.Errorf("-set cannot be used with a config file")
+		}
+		configPath = args[0]
+		config, err = loadConfig(configPath)
+	} else {
+		config, ignoredEnv, err = configFromEnv(os.Environ(), sets)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to load config: %v", err)
 	}
+	var candidate *Config
+	if *dryRun != "" {
+		if candidate, err = loadConfig(*dryRun); err != nil {
+			return fmt.Errorf("failed to load dry-run config: %v", err)
+		}
+	}
+
+	if *selfTestOnly {
+		report, err := selfTest(ctx, config, true)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+		if report.failed() {
+			return fmt.Errorf("self-test failed with %d errors", report.Errors)
+		}
+		return nil
+	}
 
-	l := log.New(os.Stdout, "nlb: ", log.LstdFlags)
+	l := log.New(out, "nlb: ", log.LstdFlags)
+	defer handleLogLevelSignals(l)()
+	if len(ignoredEnv) > 0 {
+		warnf(l, "ignoring environment variables naming no config key: %s", strings.Join(ignoredEnv, ", "))
+	}
 
-	var pool ServerPool
-	switch config.Protocol {
-	case "tcp":
-		pool, err = NewTCPServerPool(l, config)
-	case "udp":
-		pool, err = NewUDPServerPool(l, config)
-	default:
-		return fmt.Errorf("unsupported protocol: %s", config.Protocol)
+	// Report conflicts before any listener binds, rather than failing on
+	// the first one.
+	report, err := selfTest(ctx, config, config.SelfTest != nil && config.SelfTest.DialBackends)
+	if err != nil {
+		return err
+	}
+	if report.failed() || report.Warnings > 0 {
+		report.log(l)
+	}
+	if report.failed() {
+		return fmt.Errorf("startup self-test failed with %d errors", report.Errors)
 	}
+
+	timeouts, err := newShutdownTimeouts(config.Shutdown)
 	if err != nil {
-		return fmt.Errorf("failed to create server pool: %v", err)
+		return err
 	}
 
-	pool.StartHealthChecks()
-	pool.Start()
+	state, err := newStateStore(l, config.State)
+	if err != nil {
+		return err
+	}
+	uptime, err := newUptimeLog(config.UptimeHistory)
+	if err != nil {
+		return err
+	}
+	listeners := newListenerManager(out, configPath, timeouts, len(config.Listeners) > 0, state)
+	listeners.shadow = candidate
+	listeners.uptime = uptime
+	var pools []namedPool
+	for _, lc := range config.listenerConfigs() {
+		np, err := listeners.startListener(lc)
+		if err != nil {
+			return err
+		}
+		pools = append(pools, np)
+	}
 
-	// Setup HTTP handlers for the dashboard
-	mux := http.NewServeMux()
-	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
-	mux.HandleFunc("/", pool.dashboardHandler)
-	srv := &http.Server{Addr: config.ConsoleAddr, Handler: mux}
+	consoleTmpl, err := loadDashboardTemplate(config.TemplateDir)
+	if err != nil {
+		return fmt.Errorf("failed to load dashboard templates: %v", err)
+	}
+	// Listeners can only be added at runtime to configs that define
+	// listeners, since a single pool is served at the console root.
+	var admin *listenerManager
+	if len(config.Listeners) > 0 {
+		admin = listeners
+	}
+	c := newConsole(pools, consoleTmpl, admin)
+	srv := &http.Server{Addr: config.ConsoleAddr, Handler: c.handler(config.StaticDir)}
+	state.Start(c.snapshot)
 
 	httpErrChan := make(chan error, 1)
 	go func() {
 		httpErrChan <- srv.ListenAndServe()
 	}()
 
-	l.Printf("dashboard available at %s", srv.Addr)
-
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt)
+	infof(l, "dashboard available at %s", srv.Addr)
 
 	select {
 	case err := <-httpErrChan:
 		return fmt.Errorf("http server error: %v", err)
-	case sig := <-sigChan:
-		l.Printf("received signal: %s", sig)
+	case <-ctx.Done():
+		infof(l, "%v", context.Cause(ctx))
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	if err := pool.Shutdown(ctx); err != nil {
-		l.Printf("error during shutdown: %v", err)
+	pools = c.snapshot()
+	shutdown := newShutdownManager(l)
+	shutdown.add("stop accepting", 0, func(context.Context) error {
+		return forEach(pools, func(np namedPool) error { return np.pool.StopAccepting() })
+	})
+	shutdown.add("stop exporters", timeouts.exporters, func(context.Context) error {
+		listeners.stopExporters()
+		return nil
+	})
+	drainTimeout := timeouts.drain
+	for _, np := range pools {
+		// Long-lived connections are given their grace period instead.
+		drainTimeout = max(drainTimeout, np.pool.longConnectionGrace())
 	}
-
-	if err := srv.Shutdown(ctx); err != nil {
-		l.Printf("error shutting down http server: %v", err)
+	shutdown.add("drain connections", drainTimeout, func(ctx context.Context) error {
+		defer reportDrain(ctx, l, pools, timeouts.report)()
+		return forEach(pools, func(np namedPool) error { return np.pool.Drain(ctx) })
+	})
+	shutdown.add("stop health checks", timeouts.healthChecks, func(ctx context.Context) error {
+		return forEach(pools, func(np namedPool) error { return np.pool.stopHealthChecks(ctx) })
+	})
+	if uptime != nil {
+		shutdown.add("close uptime history", 0, func(context.Context) error {
+			return uptime.Close()
+		})
+	}
+	if state != nil {
+		shutdown.add("save state", timeouts.exporters, func(context.Context) error {
+			return state.Stop(pools)
+		})
+	}
+	shutdown.add("stop console", timeouts.console, srv.Shutdown)
+	if err := shutdown.run(); err != nil {
+		warnf(l, "error during shutdown: %v", err)
 	}
 
 	return nil
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mux sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.String()
+}
+
+func TestRun_shutdownOnCancel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{"addr": "127.0.0.1:0", "console_addr": "127.0.0.1:0", "protocol": "tcp",
+		"backends": ["tcp://127.0.0.1:1"], "shutdown": {"drain": "1s"}}`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	ctx, cancel := context.WithCancelCause(t.Context())
+	var out syncBuffer
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, &out, []string{path}) }()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel(context.Canceled)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected run to return after cancellation")
+	}
+	for _, want := range []string{"shutdown phase 1/5: stop accepting", "shutdown completed"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected log to contain %q, got %q", want, out.String())
+		}
+	}
+}
+
+func TestSignalContext(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signals cannot be sent to the current process on windows")
+	}
+	ctx, stop := signalContext()
+	defer stop()
+
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatalf("failed to find process: %v", err)
+	}
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("failed to send SIGTERM: %v", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		if cause := context.Cause(ctx); !strings.Contains(cause.Error(), "terminated") {
+			t.Errorf("expected the signal as the cause, got %v", cause)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("expected SIGTERM to cancel the context")
+	}
+}
+
+func TestRun_dryRun(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	candidate := filepath.Join(dir, "candidate.json")
+	for file, config := range map[string]string{
+		path: `{"addr": "127.0.0.1:0", "console_addr": "127.0.0.1:0", "protocol": "tcp",
+			"backends": ["tcp://127.0.0.1:1"], "shutdown": {"drain": "1s"}}`,
+		candidate: `{"protocol": "tcp", "algorithm": "least-connections", "backends": ["tcp://127.0.0.1:1", "tcp://127.0.0.1:2"]}`,
+	} {
+		if err := os.WriteFile(file, []byte(config), 0o600); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancelCause(t.Context())
+	var out syncBuffer
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, &out, []string{"--dry-run", candidate, path}) }()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel(context.Canceled)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected run to return after cancellation")
+	}
+	if want := "dry-run: evaluating candidate config (algorithm least-connections, 2 backends, new: 127.0.0.1:2)"; !strings.Contains(out.String(), want) {
+		t.Errorf("expected log to contain %q, got %q", want, out.String())
+	}
+
+	if err := run(t.Context(), &out, []string{"--dry-run", filepath.Join(dir, "missing.json"), path}); err == nil {
+		t.Errorf("expected error for a missing dry-run config")
+	}
+}
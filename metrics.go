@@ -0,0 +1,401 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metricsHandler exposes pool statistics in the Prometheus text format.
+func (p *BaseServerPool) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	backends := p.Backends()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeMetricHeader(w, "nlb_listener_active_connections", "Number of client connections currently open.", "gauge")
+	fmt.Fprintf(w, "nlb_listener_active_connections %d\n", p.stats.active.Load())
+	writeMetricHeader(w, "nlb_listener_accepted_connections_total", "Client connections accepted by the listener.", "counter")
+	fmt.Fprintf(w, "nlb_listener_accepted_connections_total %d\n", p.stats.accepted.Load())
+	writeMetricHeader(w, "nlb_listener_rejected_connections_total", "Client connections that could not be served by any backend.", "counter")
+	fmt.Fprintf(w, "nlb_listener_rejected_connections_total %d\n", p.stats.rejected.Load())
+	writeMetricHeader(w, "nlb_listener_goroutines", "Goroutines serving the listener: accept and read loops, connections, datagrams, UDP flows and health checks.", "gauge")
+	fmt.Fprintf(w, "nlb_listener_goroutines %d\n", p.resources.Goroutines())
+	writeMetricHeader(w, "nlb_listener_buffer_bytes", "Approximate memory held by the buffers of the listener's connections, datagrams and UDP flows.", "gauge")
+	fmt.Fprintf(w, "nlb_listener_buffer_bytes %d\n", p.resources.BufferBytes())
+	below, failingStatic := 0, 0
+	if isBelow, isStatic := p.floor.state(); isBelow {
+		below = 1
+		if isStatic {
+			failingStatic = 1
+		}
+	}
+	if p.stickyFailover != nil {
+		writeMetricHeader(w, "nlb_sticky_remaps_total", "Sticky clients moved off a failed backend (failover) and back to it (return).", "counter")
+		fmt.Fprintf(w, "nlb_sticky_remaps_total{event=\"failover\"} %d\n", p.stickyFailover.failovers.Load())
+		fmt.Fprintf(w, "nlb_sticky_remaps_total{event=\"return\"} %d\n", p.stickyFailover.returns.Load())
+		writeMetricHeader(w, "nlb_sticky_remapped_clients", "Sticky clients currently on another backend than the one they hash to.", "gauge")
+		fmt.Fprintf(w, "nlb_sticky_remapped_clients %d\n", p.stickyFailover.Remapped())
+	}
+	if p.queue != nil {
+		writeMetricHeader(w, "nlb_accept_queue_depth", "Client connections waiting for a backend below its connection limit.", "gauge")
+		fmt.Fprintf(w, "nlb_accept_queue_depth %d\n", p.queue.Len())
+		writeMetricHeader(w, "nlb_accept_queue_connections_total", "Queued client connections by outcome.", "counter")
+		fmt.Fprintf(w, "nlb_accept_queue_connections_total{result=\"admitted\"} %d\n", p.queue.admitted.Load())
+		fmt.Fprintf(w, "nlb_accept_queue_connections_total{result=\"timeout\"} %d\n", p.queue.timeouts.Load())
+		fmt.Fprintf(w, "nlb_accept_queue_connections_total{result=\"overflow\"} %d\n", p.queue.overflows.Load())
+		writeMetricHeader(w, "nlb_accept_queue_wait_seconds", "Time admitted connections waited in the accept queue.", "summary")
+		for _, q := range []float64{50, 90, 99} {
+			fmt.Fprintf(w, "nlb_accept_queue_wait_seconds{quantile=\"%s\"} %s\n",
+				strconv.FormatFloat(q/100, 'f', -1, 64), formatSeconds(p.queue.wait.Percentile(q)))
+		}
+		fmt.Fprintf(w, "nlb_accept_queue_wait_seconds_sum %s\n", formatSeconds(p.queue.wait.Sum()))
+		fmt.Fprintf(w, "nlb_accept_queue_wait_seconds_count %d\n", p.queue.wait.Count())
+	}
+	if p.quarantine != nil {
+		writeMetricHeader(w, "nlb_quarantined_backends", "Backends removed from the pool after failing health checks for the quarantine period.", "gauge")
+		fmt.Fprintf(w, "nlb_quarantined_backends %d\n", p.quarantine.Len())
+		writeMetricHeader(w, "nlb_quarantine_restored_total", "Quarantined backends added back after passing a health check.", "counter")
+		fmt.Fprintf(w, "nlb_quarantine_restored_total %d\n", p.quarantine.restored.Load())
+	}
+	if p.flood != nil {
+		writeMetricHeader(w, "nlb_udp_dropped_datagrams_total", "Datagrams dropped by the UDP flood guard, by reason.", "counter")
+		for _, reason := range []string{dropSourceRate, dropGlobalRate, dropSourceTable} {
+			fmt.Fprintf(w, "nlb_udp_dropped_datagrams_total{reason=%q} %d\n", reason, p.flood.Dropped(reason))
+		}
+		writeMetricHeader(w, "nlb_udp_flood_sources", "Source prefixes tracked by the UDP flood guard.", "gauge")
+		fmt.Fprintf(w, "nlb_udp_flood_sources %d\n", p.flood.Sources())
+	}
+	if p.receivers != nil {
+		writeMetricHeader(w, "nlb_udp_received_datagrams_total", "Datagrams read by each receive socket of the UDP listener's addresses.", "counter")
+		for shard := range p.receivers.sockets {
+			fmt.Fprintf(w, "nlb_udp_received_datagrams_total{socket=\"%d\"} %d\n", shard, p.receivers.Received(shard))
+		}
+	}
+	if p.resolver != nil {
+		writeMetricHeader(w, "nlb_dns_cache_entries", "Backend hostnames in the DNS cache.", "gauge")
+		fmt.Fprintf(w, "nlb_dns_cache_entries %d\n", p.resolver.Len())
+		writeMetricHeader(w, "nlb_dns_cache_lookups_total", "Backend hostname resolutions by whether they were answered from the cache.", "counter")
+		fmt.Fprintf(w, "nlb_dns_cache_lookups_total{result=\"hit\"} %d\n", p.resolver.hits.Load())
+		fmt.Fprintf(w, "nlb_dns_cache_lookups_total{result=\"miss\"} %d\n", p.resolver.misses.Load())
+		writeMetricHeader(w, "nlb_dns_cache_errors_total", "Failed backend hostname lookups.", "counter")
+		fmt.Fprintf(w, "nlb_dns_cache_errors_total %d\n", p.resolver.errors.Load())
+	}
+	writeMetricHeader(w, "nlb_below_min_healthy", "Whether fewer backends than min_healthy_backends are passing health checks.", "gauge")
+	fmt.Fprintf(w, "nlb_below_min_healthy %d\n", below)
+	writeMetricHeader(w, "nlb_min_healthy_alarms_total", "Times the pool dropped below min_healthy_backends after becoming ready.", "counter")
+	fmt.Fprintf(w, "nlb_min_healthy_alarms_total %d\n", p.floor.alarms.Load())
+	writeMetricHeader(w, "nlb_failing_static", "Whether the pool is routing to its last known good backends.", "gauge")
+	fmt.Fprintf(w, "nlb_failing_static %d\n", failingStatic)
+	if p.protocol == "tcp" {
+		writeMetricHeader(w, "nlb_dead_peer_evictions_total", "Connections closed because the client or backend stopped answering keepalive probes.", "counter")
+		fmt.Fprintf(w, "nlb_dead_peer_evictions_total{peer=\"client\"} %d\n", p.stats.deadClients.Load())
+		fmt.Fprintf(w, "nlb_dead_peer_evictions_total{peer=\"backend\"} %d\n", p.stats.deadBackends.Load())
+		writeMetricHeader(w, "nlb_deferred_dial_idle_clients_total", "Connections closed because the client sent no data within the defer_dial timeout.", "counter")
+		fmt.Fprintf(w, "nlb_deferred_dial_idle_clients_total %d\n", p.stats.idleClients.Load())
+	}
+	if p.sniffer != nil {
+		writeMetricHeader(w, "nlb_sniffed_connections_total", "Client connections by detected protocol.", "counter")
+		counts := p.sniffer.Sniffed()
+		for _, protocol := range []string{sniffHTTP, sniffTCP, sniffTLS} {
+			fmt.Fprintf(w, "nlb_sniffed_connections_total{protocol=%q} %d\n", protocol, counts[protocol])
+		}
+	}
+
+	if p.firstByte != nil {
+		writeMetricHeader(w, "nlb_first_byte_routed_connections_total", "Client connections by the backend group chosen from their first bytes.", "counter")
+		counts := p.firstByte.Routed()
+		for _, group := range slices.Sorted(maps.Keys(counts)) {
+			fmt.Fprintf(w, "nlb_first_byte_routed_connections_total{group=%q} %d\n", group, counts[group])
+		}
+	}
+
+	if p.validator != nil {
+		writeMetricHeader(w, "nlb_protocol_validation_connections_total", "Client connections by the outcome of validating their first bytes.", "counter")
+		counts := p.validator.Results()
+		for _, result := range slices.Sorted(maps.Keys(counts)) {
+			fmt.Fprintf(w, "nlb_protocol_validation_connections_total{result=%q} %d\n", result, counts[result])
+		}
+	}
+
+	if p.affinity != nil {
+		writeMetricHeader(w, "nlb_affinity_connections_total", "Client connections and datagrams by whether an affinity key was found in their first bytes.", "counter")
+		fmt.Fprintf(w, "nlb_affinity_connections_total{result=\"keyed\"} %d\n", p.affinity.keyed.Load())
+		fmt.Fprintf(w, "nlb_affinity_connections_total{result=\"unkeyed\"} %d\n", p.affinity.unkeyed.Load())
+	}
+	if open, limit, err := processFDs.usage(time.Now()); err == nil {
+		writeMetricHeader(w, "nlb_open_fds", "File descriptors open in the process.", "gauge")
+		fmt.Fprintf(w, "nlb_open_fds %d\n", open)
+		writeMetricHeader(w, "nlb_max_fds", "Soft limit on the file descriptors the process may open.", "gauge")
+		fmt.Fprintf(w, "nlb_max_fds %d\n", limit)
+	}
+	if p.priority != nil {
+		writeMetricHeader(w, "nlb_priority_connections_total", "Client connections by priority class and whether they were admitted or shed.", "counter")
+		for _, c := range p.priority.all() {
+			fmt.Fprintf(w, "nlb_priority_connections_total{class=%q,result=\"admitted\"} %d\n", c.name, c.admitted.Load())
+			fmt.Fprintf(w, "nlb_priority_connections_total{class=%q,result=\"shed\"} %d\n", c.name, c.shed.Load())
+		}
+	}
+	if p.geoIP != nil {
+		writeMetricHeader(w, "nlb_geoip_connections_total", "Client connections by the client's country, or unknown if not found.", "counter")
+		countries := p.geoIP.Countries()
+		for _, country := range slices.Sorted(maps.Keys(countries)) {
+			fmt.Fprintf(w, "nlb_geoip_connections_total{country=%q} %d\n", country, countries[country])
+		}
+		if len(p.geoIP.routed) > 0 {
+			writeMetricHeader(w, "nlb_geoip_routed_connections_total", "Client connections routed to a backend group by region.", "counter")
+			for _, group := range slices.Sorted(maps.Keys(p.geoIP.routed)) {
+				fmt.Fprintf(w, "nlb_geoip_routed_connections_total{group=%q} %d\n", group, p.geoIP.routed[group].Load())
+			}
+		}
+	}
+	if p.sourceFilter != nil {
+		writeMetricHeader(w, "nlb_source_filter_rejected_total", "Client connections and datagrams rejected by source address, by reason.", "counter")
+		fmt.Fprintf(w, "nlb_source_filter_rejected_total{reason=%q} %d\n", filterBogon, p.sourceFilter.rejectedBogons.Load())
+		fmt.Fprintf(w, "nlb_source_filter_rejected_total{reason=%q} %d\n", filterASN, p.sourceFilter.rejectedASNs.Load())
+		fmt.Fprintf(w, "nlb_source_filter_rejected_total{reason=%q} %d\n", filterDenied, p.sourceFilter.rejectedDenied.Load())
+	}
+	if p.sourceFilter != nil && p.sourceFilter.tarpit != nil {
+		t := p.sourceFilter.tarpit
+		writeMetricHeader(w, "nlb_tarpit_connections", "Rejected client connections currently held in the tarpit.", "gauge")
+		fmt.Fprintf(w, "nlb_tarpit_connections %d\n", t.Held())
+		writeMetricHeader(w, "nlb_tarpit_connections_total", "Rejected client connections held in the tarpit, or closed because it was full.", "counter")
+		fmt.Fprintf(w, "nlb_tarpit_connections_total{result=\"held\"} %d\n", t.trapped.Load())
+		fmt.Fprintf(w, "nlb_tarpit_connections_total{result=\"overflow\"} %d\n", t.overflow.Load())
+	}
+	if p.fdLimit != nil {
+		shedding := 0
+		if p.fdLimit.shedding.Load() {
+			shedding = 1
+		}
+		writeMetricHeader(w, "nlb_fd_shedding", "Whether new connections are shed because open file descriptors are above the watermark.", "gauge")
+		fmt.Fprintf(w, "nlb_fd_shedding %d\n", shedding)
+		writeMetricHeader(w, "nlb_fd_shed_connections_total", "Connections shed because open file descriptors were above the watermark.", "counter")
+		fmt.Fprintf(w, "nlb_fd_shed_connections_total %d\n", p.fdLimit.shed.Load())
+	}
+
+	if p.shadow != nil {
+		writeMetricHeader(w, "nlb_dry_run_decisions_total", "Routing decisions compared against the dry-run config, by whether it would have chosen the same backend.", "counter")
+		fmt.Fprintf(w, "nlb_dry_run_decisions_total{result=\"match\"} %d\n", p.shadow.matched.Load())
+		fmt.Fprintf(w, "nlb_dry_run_decisions_total{result=\"differ\"} %d\n", p.shadow.differed.Load())
+	}
+	if p.panics != nil {
+		writeMetricHeader(w, "nlb_connection_panics_total", "Panics recovered from while handling client connections and datagrams.", "counter")
+		fmt.Fprintf(w, "nlb_connection_panics_total %d\n", p.panics.Panics())
+	}
+
+	writeMetricHeader(w, "nlb_backend_connections_total", "Connections proxied to the backend.", "counter")
+	for _, b := range backends {
+		fmt.Fprintf(w, "nlb_backend_connections_total{backend=%q} %d\n", b.URL.String(), b.TotalConnections())
+	}
+
+	if p.protocol == "udp" {
+		writeMetricHeader(w, "nlb_backend_socket_requests_total", "Datagrams sent to the backend, by whether they reused an open socket (hit) or opened one (miss).", "counter")
+		for _, b := range backends {
+			fmt.Fprintf(w, "nlb_backend_socket_requests_total{backend=%q,result=\"hit\"} %d\n", b.URL.String(), b.sockets.hits.Load())
+			fmt.Fprintf(w, "nlb_backend_socket_requests_total{backend=%q,result=\"miss\"} %d\n", b.URL.String(), b.sockets.misses.Load())
+		}
+		writeMetricHeader(w, "nlb_backend_socket_reuse_ratio", "Share of datagrams to the backend sent on an open socket.", "gauge")
+		for _, b := range backends {
+			fmt.Fprintf(w, "nlb_backend_socket_reuse_ratio{backend=%q} %g\n", b.URL.String(), b.sockets.view().ReuseRatio)
+		}
+		writeMetricHeader(w, "nlb_backend_sockets", "Flow sockets open to the backend, by whether they are waiting for a reply.", "gauge")
+		for _, b := range backends {
+			v := b.sockets.view()
+			fmt.Fprintf(w, "nlb_backend_sockets{backend=%q,state=\"idle\"} %d\n", b.URL.String(), v.Idle)
+			fmt.Fprintf(w, "nlb_backend_sockets{backend=%q,state=\"busy\"} %d\n", b.URL.String(), v.Open-v.Idle)
+		}
+	}
+
+	writeMetricHeader(w, "nlb_backend_probe_duration_seconds", "Duration of the backend's most recent health check probe.", "gauge")
+	for _, b := range backends {
+		if s, ok := b.probes.last(); ok {
+			fmt.Fprintf(w, "nlb_backend_probe_duration_seconds{backend=%q} %g\n", b.URL.String(), s.Latency.Seconds())
+		}
+	}
+
+	writeMetricHeader(w, "nlb_backend_up", "Whether the backend is passing health checks.", "gauge")
+	for _, b := range backends {
+		up := 0
+		if b.Healthy() {
+			up = 1
+		}
+		fmt.Fprintf(w, "nlb_backend_up{backend=%q} %d\n", b.URL.String(), up)
+	}
+
+	writeMetricHeader(w, "nlb_backend_info", "Backend metadata, with one label per configured backend label.", "gauge")
+	for _, b := range backends {
+		fmt.Fprintf(w, "nlb_backend_info{backend=%q%s} 1\n", b.URL.String(), formatLabels(b.Labels))
+	}
+
+	writeMetricHeader(w, "nlb_backend_circuit_open", "Whether the backend's circuit breaker is open.", "gauge")
+	for _, b := range backends {
+		open := 0
+		if b.breaker.State() == circuitOpen {
+			open = 1
+		}
+		fmt.Fprintf(w, "nlb_backend_circuit_open{backend=%q} %d\n", b.URL.String(), open)
+	}
+
+	if p.admissionSettings != nil {
+		writeMetricHeader(w, "nlb_backend_rate_limited", "Whether the backend is skipped for exceeding its new connection rate.", "gauge")
+		for _, b := range backends {
+			limited := 0
+			if !b.admission.ready(time.Now()) {
+				limited = 1
+			}
+			fmt.Fprintf(w, "nlb_backend_rate_limited{backend=%q} %d\n", b.URL.String(), limited)
+		}
+	}
+
+	writeMetricHeader(w, "nlb_backend_flapping", "Whether the backend is held down for flapping.", "gauge")
+	for _, b := range backends {
+		flapping := 0
+		if _, held := b.history.heldDown(time.Now()); held {
+			flapping = 1
+		}
+		fmt.Fprintf(w, "nlb_backend_flapping{backend=%q} %d\n", b.URL.String(), flapping)
+	}
+
+	writeMetricHeader(w, "nlb_backend_degraded", "Whether the backend passes its health checks but is degraded.", "gauge")
+	for _, b := range backends {
+		degraded := 0
+		if b.Degraded() {
+			degraded = 1
+		}
+		fmt.Fprintf(w, "nlb_backend_degraded{backend=%q} %d\n", b.URL.String(), degraded)
+	}
+
+	writeMetricHeader(w, "nlb_backends", "Backends in the pool by health state.", "gauge")
+	counts := stateCounts(backends)
+	for _, state := range healthStates {
+		fmt.Fprintf(w, "nlb_backends{state=%q} %d\n", state, counts[state])
+	}
+
+	writeMetricHeader(w, "nlb_backend_active_connections", "Number of connections currently proxied to the backend.", "gauge")
+	for _, b := range backends {
+		fmt.Fprintf(w, "nlb_backend_active_connections{backend=%q} %d\n", b.URL.String(), b.ActiveConnections())
+	}
+
+	if p.longConns != nil {
+		writeMetricHeader(w, "nlb_backend_long_connections", "Connections to the backend open longer than the long_connections threshold.", "gauge")
+		now := time.Now()
+		for _, b := range backends {
+			_, long := p.backendConnections(b, now)
+			fmt.Fprintf(w, "nlb_backend_long_connections{backend=%q} %d\n", b.URL.String(), long)
+		}
+	}
+
+	if p.sloSettings != nil {
+		now := time.Now()
+		writeMetricHeader(w, "nlb_backend_slo_requests_total", "Backend requests (TCP dials and UDP exchanges) counted against the SLO, by result.", "counter")
+		for _, b := range backends {
+			if b.slo != nil {
+				fmt.Fprintf(w, "nlb_backend_slo_requests_total{backend=%q,result=\"success\"} %d\n", b.URL.String(), b.slo.successes.Load())
+				fmt.Fprintf(w, "nlb_backend_slo_requests_total{backend=%q,result=\"failure\"} %d\n", b.URL.String(), b.slo.failures.Load())
+			}
+		}
+		writeMetricHeader(w, "nlb_backend_slo_burn_rate", "Rate at which the backend spends its error budget over the window; 1 spends exactly the budget.", "gauge")
+		for _, b := range backends {
+			for _, d := range p.sloSettings.windows {
+				if b.slo != nil {
+					rate, _ := b.slo.burnRate(now, d)
+					fmt.Fprintf(w, "nlb_backend_slo_burn_rate{backend=%q,window=%q} %g\n", b.URL.String(), d, rate)
+				}
+			}
+		}
+		writeMetricHeader(w, "nlb_backend_slo_error_budget_remaining", "Fraction of the error budget of the longest SLO window left unspent.", "gauge")
+		for _, b := range backends {
+			if b.slo != nil {
+				rate, _ := b.slo.burnRate(now, p.sloSettings.windows[len(p.sloSettings.windows)-1])
+				fmt.Fprintf(w, "nlb_backend_slo_error_budget_remaining{backend=%q} %g\n", b.URL.String(), 1-rate)
+			}
+		}
+	}
+
+	writeMetricHeader(w, "nlb_backend_draining", "Whether the backend is being drained through the admin API.", "gauge")
+	for _, b := range backends {
+		draining := 0
+		if b.Draining() {
+			draining = 1
+		}
+		fmt.Fprintf(w, "nlb_backend_draining{backend=%q} %d\n", b.URL.String(), draining)
+	}
+
+	writeMetricHeader(w, "nlb_backend_bytes_total", "Bytes forwarded to (sent) and received from the backend.", "counter")
+	for _, b := range backends {
+		fmt.Fprintf(w, "nlb_backend_bytes_total{backend=%q,direction=\"sent\"} %d\n", b.URL.String(), b.BytesSent())
+		fmt.Fprintf(w, "nlb_backend_bytes_total{backend=%q,direction=\"received\"} %d\n", b.URL.String(), b.BytesReceived())
+	}
+
+	now := time.Now()
+	writeMetricHeader(w, "nlb_backend_throughput_bytes_per_second", "Bytes per second forwarded to (sent) and received from the backend over the last 10 seconds.", "gauge")
+	for _, b := range backends {
+		fmt.Fprintf(w, "nlb_backend_throughput_bytes_per_second{backend=%q,direction=\"sent\"} %g\n", b.URL.String(), b.SendRate(now))
+		fmt.Fprintf(w, "nlb_backend_throughput_bytes_per_second{backend=%q,direction=\"received\"} %g\n", b.URL.String(), b.ReceiveRate(now))
+	}
+
+	writeMetricHeader(w, "nlb_backend_response_time_seconds", "Moving average of the backend response time.", "gauge")
+	for _, b := range backends {
+		fmt.Fprintf(w, "nlb_backend_response_time_seconds{backend=%q} %s\n", b.URL.String(), formatSeconds(b.ResponseTime.Value()))
+	}
+
+	writeLatencySummary(w, "nlb_backend_dial_latency_seconds",
+		"Time taken to establish a connection to the backend.", backends,
+		func(b *Backend) *latencyTracker { return &b.DialLatency })
+	writeLatencySummary(w, "nlb_backend_first_byte_latency_seconds",
+		"Time between connecting to the backend and receiving its first byte.", backends,
+		func(b *Backend) *latencyTracker { return &b.FirstByteLatency })
+	writeLatencyHistogram(w, "nlb_backend_dial_duration_seconds",
+		"Time taken to establish a connection to the backend.", backends,
+		func(b *Backend) *latencyHistogram { return &b.dialHistogram }, p.exemplars && acceptsOpenMetrics(r))
+}
+
+// writeMetricHeader writes the HELP and TYPE lines for a metric family.
+func writeMetricHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// writeLatencySummary writes a summary metric family with per-backend quantiles.
+func writeLatencySummary(w io.Writer, name, help string, backends []*Backend, tracker func(*Backend) *latencyTracker) {
+	writeMetricHeader(w, name, help, "summary")
+	for _, b := range backends {
+		t := tracker(b)
+		for _, q := range []float64{50, 90, 99} {
+			fmt.Fprintf(w, "%s{backend=%q,quantile=\"%s\"} %s\n", name, b.URL.String(),
+				strconv.FormatFloat(q/100, 'f', -1, 64), formatSeconds(t.Percentile(q)))
+		}
+		fmt.Fprintf(w, "%s_sum{backend=%q} %s\n", name, b.URL.String(), formatSeconds(t.Sum()))
+		fmt.Fprintf(w, "%s_count{backend=%q} %d\n", name, b.URL.String(), t.Count())
+	}
+}
+
+// formatLabels renders backend labels as additional Prometheus labels named
+// label_<key>, sorted by key.
+func formatLabels(labels map[string]string) string {
+	var sb strings.Builder
+	for _, k := range slices.Sorted(maps.Keys(labels)) {
+		fmt.Fprintf(&sb, ",label_%s=%q", sanitizeLabelName(k), labels[k])
+	}
+	return sb.String()
+}
+
+// sanitizeLabelName replaces characters that are not valid in Prometheus
+// label names with underscores.
+func sanitizeLabelName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// formatSeconds formats a duration as fractional seconds.
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
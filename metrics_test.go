@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_metricsHandler(t *testing.T) {
+	pool := &BaseServerPool{}
+	pool.addBackend(BackendConfig{
+		URL:    "http://localhost:8080",
+		Labels: map[string]string{"zone": "us-east-1a", "app-tier": "web"},
+	})
+	pool.backends[0].SetHealthy(true)
+	pool.backends[0].DialLatency.Observe(2 * time.Millisecond)
+	pool.backends[0].FirstByteLatency.Observe(500 * time.Millisecond)
+	pool.backends[0].acquire()()
+	pool.backends[0].bytesSent.Add(5000)
+	pool.stats.accept()()
+	pool.stats.reject()
+
+	rec := httptest.NewRecorder()
+	pool.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, _ := io.ReadAll(rec.Body)
+	for _, want := range []string{
+		`nlb_backend_up{backend="http://localhost:8080"} 1`,
+		`nlb_backend_info{backend="http://localhost:8080",label_app_tier="web",label_zone="us-east-1a"} 1`,
+		`nlb_backend_dial_latency_seconds{backend="http://localhost:8080",quantile="0.5"} 0.002`,
+		`nlb_backend_dial_latency_seconds_count{backend="http://localhost:8080"} 1`,
+		`nlb_backend_first_byte_latency_seconds{backend="http://localhost:8080",quantile="0.99"} 0.5`,
+		`nlb_backend_connections_total{backend="http://localhost:8080"} 1`,
+		`nlb_backend_bytes_total{backend="http://localhost:8080",direction="sent"} 5000`,
+		`nlb_backend_throughput_bytes_per_second{backend="http://localhost:8080",direction="sent"} 500`,
+		`nlb_backend_throughput_bytes_per_second{backend="http://localhost:8080",direction="received"} 0`,
+		`nlb_listener_active_connections 0`,
+		`nlb_listener_accepted_connections_total 1`,
+		`nlb_listener_rejected_connections_total 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("expected metrics to contain %q, got %q", want, body)
+		}
+	}
+}
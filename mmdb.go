@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+)
+
+// mmdbMetadataMarker starts the metadata section at the end of a MaxMind DB
+// file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbMaxDepth bounds the nesting of decoded values, so that a corrupt file
+// cannot recurse forever.
+const mmdbMaxDepth = 32
+
+var errMMDBCorrupt = errors.New("corrupt MaxMind DB")
+
+// Data types of the MaxMind DB format.
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// mmdb is a MaxMind DB file, such as a GeoIP2 or GeoLite2 database, read
+// into memory. Only the subset of the format needed to look up records is
+// implemented; see https://maxmind.github.io/MaxMind-DB/.
+type mmdb struct {
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	databaseType string
+	tree         []byte
+	data         []byte
+	// ipv4Start is the node at which IPv4 lookups start in an IPv6 tree,
+	// where IPv4 addresses are stored as ::a.b.c.d.
+	ipv4Start uint
+}
+
+func openMMDB(path string) (*mmdb, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := parseMMDB(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return db, nil
+}
+
+func parseMMDB(buf []byte) (*mmdb, error) {
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	v, _, err := mmdbDecoder{buf[i+len(mmdbMetadataMarker):]}.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+	meta, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("invalid metadata")
+	}
+	db := &mmdb{}
+	for _, f := range []struct {
+		key string
+		dst *uint
+	}{
+		{"node_count", &db.nodeCount},
+		{"record_size", &db.recordSize},
+		{"ip_version", &db.ipVersion},
+	} {
+		n, ok := meta[f.key].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("metadata is missing %s", f.key)
+		}
+		*f.dst = uint(n)
+	}
+	db.databaseType, _ = meta["database_type"].(string)
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", db.ipVersion)
+	}
+	treeSize := db.recordSize / 4 * db.nodeCount
+	// The search tree is followed by 16 zero bytes and the data section.
+	if treeSize+16 > uint(i) {
+		return nil, errMMDBCorrupt
+	}
+	db.tree, db.data = buf[:treeSize], buf[treeSize+16:i]
+	if db.ipVersion == 6 {
+		node := uint(0)
+		for range 96 {
+			if node >= db.nodeCount {
+				break
+			}
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node.
+func (db *mmdb) record(node, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		b := db.tree[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := db.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(db.tree[node*8+bit*4:]))
+	}
+}
+
+// lookup returns the record of the network containing addr, or nil if
+// there is none.
+func (db *mmdb) lookup(addr netip.Addr) (map[string]any, error) {
+	addr = addr.Unmap()
+	node := uint(0)
+	if addr.Is4() && db.ipVersion == 6 {
+		node = db.ipv4Start
+	} else if addr.Is6() && db.ipVersion == 4 {
+		return nil, nil
+	}
+	ip := addr.AsSlice()
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(ip[i/8]>>(7-i%8))&1)
+	}
+	switch {
+	case node == db.nodeCount:
+		return nil, nil
+	case node < db.nodeCount:
+		return nil, errMMDBCorrupt
+	}
+	// Records point past the tree and the separator.
+	offset := node - db.nodeCount - 16
+	v, _, err := mmdbDecoder{db.data}.decode(offset, 0)
+	if err != nil {
+		return nil, err
+	}
+	record, ok := v.(map[string]any)
+	if !ok {
+		return nil, errMMDBCorrupt
+	}
+	return record, nil
+}
+
+// mmdbDecoder decodes values from the data section of a MaxMind DB, to
+// which pointers are relative.
+type mmdbDecoder struct {
+	buf []byte
+}
+
+// decode decodes the value at offset and returns the offset following it.
+// Maps decode to map[string]any, arrays to []any, unsigned integers to
+// uint64 (or []byte if wider), int32 to int64 and floats to float64.
+func (d mmdbDecoder) decode(offset uint, depth int) (any, uint, error) {
+	if depth > mmdbMaxDepth || offset >= uint(len(d.buf)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	ctrl := d.buf[offset]
+	offset++
+	typ := uint(ctrl >> 5)
+	if typ == mmdbPointer {
+		ptr, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(ptr, depth+1)
+		return v, next, err
+	}
+	if typ == mmdbExtended {
+		if offset >= uint(len(d.buf)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		typ = 7 + uint(d.buf[offset])
+		offset++
+	}
+	size, offset, err := d.size(ctrl, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]any, min(size, 64))
+		for range size {
+			k, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			if m[key], offset, err = d.decode(next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]any, 0, min(size, 64))
+		for range size {
+			v, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a, offset = append(a, v), next
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+	if offset+size > uint(len(d.buf)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	b, next := d.buf[offset:offset+size], offset+size
+	switch typ {
+	case mmdbString:
+		return string(b), next, nil
+	case mmdbBytes:
+		return b, next, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), next, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbUint128:
+		if size > 8 {
+			return b, next, nil
+		}
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, next, nil
+	case mmdbInt32:
+		if size > 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		// Values shorter than 4 bytes are not sign extended.
+		return int64(int32(n)), next, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported MaxMind DB data type %d", typ)
+	}
+}
+
+// size decodes the size of a value following its control byte.
+func (d mmdbDecoder) size(ctrl byte, offset uint) (uint, uint, error) {
+	size := uint(ctrl & 0x1f)
+	if size < 29 {
+		return size, offset, nil
+	}
+	n := size - 28
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, errMMDBCorrupt
+	}
+	var ext uint
+	for _, c := range d.buf[offset : offset+n] {
+		ext = ext<<8 | uint(c)
+	}
+	switch size {
+	case 29:
+		return 29 + ext, offset + n, nil
+	case 30:
+		return 285 + ext, offset + n, nil
+	default:
+		return 65821 + ext, offset + n, nil
+	}
+}
+
+// pointer decodes a pointer following its control byte.
+func (d mmdbDecoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	ss := uint(ctrl>>3) & 3
+	n := ss + 1
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, errMMDBCorrupt
+	}
+	var ptr uint
+	if ss < 3 {
+		ptr = uint(ctrl & 7)
+	}
+	for _, c := range d.buf[offset : offset+n] {
+		ptr = ptr<<8 | uint(c)
+	}
+	switch ss {
+	case 1:
+		ptr += 2048
+	case 2:
+		ptr += 526336
+	}
+	return ptr, offset + n, nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// mmdbControl encodes the control byte, and any extended type and size
+// bytes, of a value.
+func mmdbControl(typ, size int) []byte {
+	var b []byte
+	ctrl := byte(typ << 5)
+	if typ > 7 {
+		ctrl = 0
+	}
+	switch {
+	case size < 29:
+		b = append(b, ctrl|byte(size))
+	case size < 285:
+		b = append(b, ctrl|29)
+	case size < 65821:
+		b = append(b, ctrl|30)
+	default:
+		b = append(b, ctrl|31)
+	}
+	if typ > 7 {
+		b = append(b, byte(typ-7))
+	}
+	switch {
+	case size < 29:
+	case size < 285:
+		b = append(b, byte(size-29))
+	case size < 65821:
+		b = binary.BigEndian.AppendUint16(b, uint16(size-285))
+	default:
+		n := size - 65821
+		b = append(b, byte(n>>16), byte(n>>8), byte(n))
+	}
+	return b
+}
+
+// mmdbEncode encodes a value in the MaxMind DB data format.
+func mmdbEncode(v any) []byte {
+	switch v := v.(type) {
+	case string:
+		return append(mmdbControl(mmdbString, len(v)), v...)
+	case uint16:
+		return binary.BigEndian.AppendUint16(mmdbControl(mmdbUint16, 2), v)
+	case uint32:
+		return binary.BigEndian.AppendUint32(mmdbControl(mmdbUint32, 4), v)
+	case uint64:
+		return binary.BigEndian.AppendUint64(mmdbControl(mmdbUint64, 8), v)
+	case int32:
+		return binary.BigEndian.AppendUint32(mmdbControl(mmdbInt32, 4), uint32(v))
+	case float64:
+		return binary.BigEndian.AppendUint64(mmdbControl(mmdbDouble, 8), math.Float64bits(v))
+	case bool:
+		if v {
+			return mmdbControl(mmdbBool, 1)
+		}
+		return mmdbControl(mmdbBool, 0)
+	case []any:
+		b := mmdbControl(mmdbArray, len(v))
+		for _, e := range v {
+			b = append(b, mmdbEncode(e)...)
+		}
+		return b
+	case map[string]any:
+		b := mmdbControl(mmdbMap, len(v))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			b = append(b, mmdbEncode(k)...)
+			b = append(b, mmdbEncode(v[k])...)
+		}
+		return b
+	}
+	panic("unsupported type")
+}
+
+// buildTestMMDB builds a MaxMind DB mapping each network to its record.
+// IPv4 networks in an IPv6 database are stored as ::a.b.c.d.
+func buildTestMMDB(t *testing.T, ipVersion, recordSize int, networks map[string]map[string]any) []byte {
+	t.Helper()
+	const empty = -1
+	// Leaves are encoded as -2 - the index of their record.
+	nodes := [][2]int{{empty, empty}}
+	var data []byte
+	var offsets []int
+	prefixes := make([]string, 0, len(networks))
+	for p := range networks {
+		prefixes = append(prefixes, p)
+	}
+	slices.Sort(prefixes)
+	for _, s := range prefixes {
+		prefix := netip.MustParsePrefix(s)
+		ip, bits := prefix.Addr().AsSlice(), prefix.Bits()
+		if ipVersion == 6 && prefix.Addr().Is4() {
+			ip, bits = append(make([]byte, 12), ip...), bits+96
+		}
+		offsets = append(offsets, len(data))
+		data = append(data, mmdbEncode(networks[s])...)
+		node := 0
+		for i := range bits {
+			bit := int(ip[i/8]>>(7-i%8)) & 1
+			if i == bits-1 {
+				nodes[node][bit] = -2 - (len(offsets) - 1)
+				break
+			}
+			if nodes[node][bit] == empty {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+	nodeCount := len(nodes)
+	value := func(r int) uint32 {
+		switch {
+		case r == empty:
+			return uint32(nodeCount)
+		case r < 0:
+			return uint32(nodeCount + 16 + offsets[-2-r])
+		}
+		return uint32(r)
+	}
+	var buf []byte
+	for _, n := range nodes {
+		l, r := value(n[0]), value(n[1])
+		switch recordSize {
+		case 24:
+			buf = append(buf, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			buf = append(buf, byte(l>>16), byte(l>>8), byte(l), byte(l>>24<<4)|byte(r>>24&0x0f), byte(r>>16), byte(r>>8), byte(r))
+		case 32:
+			buf = binary.BigEndian.AppendUint32(buf, l)
+			buf = binary.BigEndian.AppendUint32(buf, r)
+		}
+	}
+	buf = append(buf, make([]byte, 16)...)
+	buf = append(buf, data...)
+	buf = append(buf, mmdbMetadataMarker...)
+	return append(buf, mmdbEncode(map[string]any{
+		"node_count":    uint32(nodeCount),
+		"record_size":   uint16(recordSize),
+		"ip_version":    uint16(ipVersion),
+		"database_type": "Test-Country",
+	})...)
+}
+
+// writeTestMMDB writes a MaxMind DB built by buildTestMMDB to a temporary
+// file and returns its path.
+func writeTestMMDB(t *testing.T, networks map[string]map[string]any) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, buildTestMMDB(t, 6, 24, networks), 0o644); err != nil {
+		t.Fatalf("failed to write database: %v", err)
+	}
+	return path
+}
+
+func TestMMDB_lookup(t *testing.T) {
+	networks := map[string]map[string]any{
+		"192.0.2.0/24":    {"country": map[string]any{"iso_code": "DE"}},
+		"198.51.100.0/25": {"country": map[string]any{"iso_code": "FR"}},
+		"2001:db8::/32":   {"country": map[string]any{"iso_code": "JP"}},
+	}
+	for _, ipVersion := range []int{6, 4} {
+		for _, recordSize := range []int{24, 28, 32} {
+			if ipVersion == 4 {
+				delete(networks, "2001:db8::/32")
+			}
+			db, err := parseMMDB(buildTestMMDB(t, ipVersion, recordSize, networks))
+			if err != nil {
+				t.Fatalf("IPv%d, %d bit records: failed to parse database: %v", ipVersion, recordSize, err)
+			}
+			if db.databaseType != "Test-Country" {
+				t.Errorf("expected database type Test-Country, got %q", db.databaseType)
+			}
+			for _, tt := range []struct {
+				addr    string
+				country string
+			}{
+				{"192.0.2.77", "DE"},
+				{"::ffff:192.0.2.1", "DE"},
+				{"198.51.100.1", "FR"},
+				{"198.51.100.200", ""},
+				{"203.0.113.1", ""},
+				{"2001:db8::1", "JP"},
+			} {
+				want := tt.country
+				if ipVersion == 4 && tt.addr == "2001:db8::1" {
+					want = ""
+				}
+				record, err := db.lookup(netip.MustParseAddr(tt.addr))
+				if err != nil {
+					t.Fatalf("failed to look up %s: %v", tt.addr, err)
+				}
+				if got := recordString(record, "country", "iso_code"); got != want {
+					t.Errorf("IPv%d, %d bit records: expected %s in %q, got %q", ipVersion, recordSize, tt.addr, want, got)
+				}
+			}
+		}
+	}
+}
+
+func TestMMDBDecoder_decode(t *testing.T) {
+	long := string(bytes.Repeat([]byte("x"), 300))
+	value := map[string]any{
+		"string": "hello",
+		"long":   long,
+		"uint16": uint16(443),
+		"uint32": uint32(15169),
+		"uint64": uint64(1) << 40,
+		"int32":  int32(-5),
+		"double": 1.5,
+		"bool":   true,
+		"array":  []any{"a", uint32(1)},
+	}
+	want := map[string]any{
+		"string": "hello",
+		"long":   long,
+		"uint16": uint64(443),
+		"uint32": uint64(15169),
+		"uint64": uint64(1) << 40,
+		"int32":  int64(-5),
+		"double": 1.5,
+		"bool":   true,
+		"array":  []any{"a", uint64(1)},
+	}
+	got, next, err := mmdbDecoder{mmdbEncode(value)}.decode(0, 0)
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if int(next) != len(mmdbEncode(value)) {
+		t.Errorf("expected the whole value to be consumed, got %d bytes", next)
+	}
+
+	// A map whose value is a pointer to a string earlier in the data.
+	buf := mmdbEncode("DE")
+	buf = append(buf, mmdbControl(mmdbMap, 1)...)
+	buf = append(buf, mmdbEncode("iso_code")...)
+	buf = append(buf, 1<<5, 0)
+	m, _, err := mmdbDecoder{buf}.decode(3, 0)
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if !reflect.DeepEqual(m, map[string]any{"iso_code": "DE"}) {
+		t.Errorf("expected the pointer to be followed, got %v", m)
+	}
+
+	// A map containing a pointer to itself.
+	loop := append(mmdbControl(mmdbMap, 1), mmdbEncode("k")...)
+	loop = append(loop, 1<<5, 0)
+	if _, _, err := (mmdbDecoder{loop}).decode(0, 0); err == nil {
+		t.Errorf("expected an error for a self-referencing value")
+	}
+	for _, corrupt := range [][]byte{{}, mmdbControl(mmdbString, 5), {0}} {
+		if _, _, err := (mmdbDecoder{corrupt}).decode(0, 0); err == nil {
+			t.Errorf("expected an error decoding %x", corrupt)
+		}
+	}
+}
+
+func Test_parseMMDB_invalid(t *testing.T) {
+	valid := buildTestMMDB(t, 6, 24, map[string]map[string]any{"192.0.2.0/24": {}})
+	for name, buf := range map[string][]byte{
+		"no metadata": []byte("not a database"),
+		"truncated":   valid[20:],
+		"record size": append(append([]byte{}, mmdbMetadataMarker...), mmdbEncode(map[string]any{
+			"node_count": uint32(1), "record_size": uint16(20), "ip_version": uint16(6),
+		})...),
+	} {
+		if _, err := parseMMDB(buf); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
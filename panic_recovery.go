@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// panicRecovery recovers from panics in the goroutines handling client
+// connections and datagrams, so that a bug triggered by one connection
+// closes that connection instead of the whole process.
+type panicRecovery struct {
+	listener  string
+	reportDir string
+	panics    atomic.Uint64
+}
+
+// newPanicRecovery returns the panic recovery of a listener. Recovery is on
+// unless disabled, in which case it returns nil and panics crash the
+// process.
+func newPanicRecovery(config *PanicRecoveryConfig, listener string) (*panicRecovery, error) {
+	r := &panicRecovery{listener: listener}
+	if config == nil {
+		return r, nil
+	}
+	if config.Disabled {
+		return nil, nil
+	}
+	if config.ReportDir != "" {
+		info, err := os.Stat(config.ReportDir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid panic_recovery report_dir: %w", err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("panic_recovery report_dir %s is not a directory", config.ReportDir)
+		}
+		r.reportDir = config.ReportDir
+	}
+	return r, nil
+}
+
+// guard recovers from a panic of the goroutine handling the connection with
+// the given ID, logging it with its stack trace, counting it and writing a
+// crash report if configured. It must be deferred directly. A nil
+// panicRecovery lets the panic crash the process.
+func (r *panicRecovery) guard(l *log.Logger, id string, client net.Addr) {
+	if r == nil {
+		return
+	}
+	v := recover()
+	if v == nil {
+		return
+	}
+	stack := debug.Stack()
+	r.panics.Add(1)
+	warnf(l, "recovered from panic handling connection from %s: %v\n%s", client, v, stack)
+	if r.reportDir == "" {
+		return
+	}
+	path, err := r.writeReport(time.Now(), id, client, v, stack)
+	if err != nil {
+		warnf(l, "error writing crash report: %v", err)
+		return
+	}
+	infof(l, "crash report written to %s", path)
+}
+
+// writeReport writes a crash report to the report directory and returns
+// its path.
+func (r *panicRecovery) writeReport(now time.Time, id string, client net.Addr, v any, stack []byte) (string, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "time: %s\n", now.Format(time.RFC3339Nano))
+	fmt.Fprintf(&buf, "listener: %s\n", r.listener)
+	fmt.Fprintf(&buf, "connection: %s\n", id)
+	fmt.Fprintf(&buf, "client: %s\n", client)
+	fmt.Fprintf(&buf, "panic: %v\n\n%s", v, stack)
+	name := "crash-" + now.UTC().Format("20060102T150405.000000000")
+	if id != "" {
+		name += "-" + id
+	}
+	path := filepath.Join(r.reportDir, name+".txt")
+	return path, os.WriteFile(path, buf.Bytes(), 0o644)
+}
+
+// Panics returns the number of panics recovered from.
+func (r *panicRecovery) Panics() uint64 {
+	if r == nil {
+		return 0
+	}
+	return r.panics.Load()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_newPanicRecovery(t *testing.T) {
+	if r, err := newPanicRecovery(nil, "web"); r == nil || err != nil {
+		t.Errorf("expected panic recovery to be on by default, got %v, %v", r, err)
+	}
+	if r, err := newPanicRecovery(&PanicRecoveryConfig{Disabled: true}, "web"); r != nil || err != nil {
+		t.Errorf("expected no panic recovery when disabled, got %v, %v", r, err)
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, nil, 0o644)
+	for _, reportDir := range []string{filepath.Join(dir, "missing"), file} {
+		if _, err := newPanicRecovery(&PanicRecoveryConfig{ReportDir: reportDir}, "web"); err == nil {
+			t.Errorf("expected an error for report_dir %s", reportDir)
+		}
+	}
+}
+
+func TestPanicRecovery_guard(t *testing.T) {
+	dir := t.TempDir()
+	r, err := newPanicRecovery(&PanicRecoveryConfig{ReportDir: dir}, "web")
+	if err != nil {
+		t.Fatalf("failed to create panic recovery: %v", err)
+	}
+	var logs syncBuffer
+	client := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer r.guard(log.New(&logs, "", 0), "5f3a9c21-42", client)
+		panic("malformed preamble")
+	}()
+	<-done
+
+	if r.Panics() != 1 {
+		t.Errorf("expected 1 panic, got %d", r.Panics())
+	}
+	if !strings.Contains(logs.String(), "malformed preamble") || !strings.Contains(logs.String(), "goroutine") {
+		t.Errorf("expected the panic to be logged with its stack trace, got %q", logs.String())
+	}
+	reports, _ := filepath.Glob(filepath.Join(dir, "crash-*-5f3a9c21-42.txt"))
+	if len(reports) != 1 {
+		t.Fatalf("expected a crash report, got %v", reports)
+	}
+	data, _ := os.ReadFile(reports[0])
+	for _, want := range []string{"listener: web", "client: 192.0.2.1:40000", "panic: malformed preamble"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("expected crash report to contain %q", want)
+		}
+	}
+}
+
+func TestPanicRecovery_disabled(t *testing.T) {
+	var r *panicRecovery
+	defer func() {
+		if v := recover(); v != "boom" {
+			t.Errorf("expected the panic to propagate, got %v", v)
+		}
+	}()
+	func() {
+		defer r.guard(log.New(io.Discard, "", 0), "", nil)
+		panic("boom")
+	}()
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// pinPreamble starts the line a client sends to pin its connection to a
+// backend, e.g. "X-NLB-Backend: 10.0.0.1:8080\n".
+const pinPreamble = "X-NLB-Backend:"
+
+const (
+	defaultPinTimeout = 500 * time.Millisecond
+	// maxPinLine bounds the length of the preamble line.
+	maxPinLine = 512
+)
+
+// backendPinning lets allowlisted clients pin a connection to a backend of
+// their choice with a preamble, to test a single backend through the load
+// balancer. Preambles from other clients are proxied like any other data.
+type backendPinning struct {
+	allowed []netip.Prefix
+	timeout time.Duration
+}
+
+func newBackendPinning(cfg *PinBackendConfig) (*backendPinning, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+	if len(cfg.AllowedClients) == 0 {
+		return nil, fmt.Errorf("pin_backend requires allowed_clients")
+	}
+	p := &backendPinning{timeout: defaultPinTimeout}
+	for _, s := range cfg.AllowedClients {
+		prefix, err := parsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pin_backend allowed client %q: %w", s, err)
+		}
+		p.allowed = append(p.allowed, prefix)
+	}
+	if cfg.Timeout != "" {
+		d, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pin_backend timeout: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("pin_backend timeout must be positive")
+		}
+		p.timeout = d
+	}
+	return p, nil
+}
+
+// parsePrefix parses a CIDR prefix or a single IP address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// allows reports whether the client may pin its connections.
+func (p *backendPinning) allows(client net.Addr) bool {
+	if p == nil {
+		return false
+	}
+	addr, ok := addrFromNetAddr(client)
+	if !ok {
+		return false
+	}
+	for _, prefix := range p.allowed {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// readPreamble looks for a pinning preamble at the start of conn. It returns
+// the connection to proxy, without the preamble but replaying any other bytes
+// peeked, and the requested backend, or "" if there was no preamble.
+func (p *backendPinning) readPreamble(conn net.Conn) (net.Conn, string, error) {
+	br := bufio.NewReaderSize(conn, maxPinLine)
+	conn.SetReadDeadline(time.Now().Add(p.timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	data := peekUntil(br, func(b []byte) bool {
+		return len(b) >= len(pinPreamble) || !strings.HasPrefix(pinPreamble, string(b))
+	})
+	peeked := &peekedConn{Conn: conn, r: br}
+	if !bytes.HasPrefix(data, []byte(pinPreamble)) {
+		return peeked, "", nil
+	}
+
+	line, err := br.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, "", errors.New("pinning preamble is too long")
+	} else if err != nil {
+		return nil, "", fmt.Errorf("error reading pinning preamble: %w", err)
+	}
+	name := preambleBackend(line)
+	if name == "" {
+		return nil, "", errors.New("pinning preamble does not name a backend")
+	}
+	return peeked, name, nil
+}
+
+// parsePreamble splits a pinning preamble off the start of a datagram. It
+// returns the requested backend and the rest of the datagram, and false if
+// the datagram does not start with a preamble.
+func parsePreamble(data []byte) (string, []byte, bool) {
+	if !bytes.HasPrefix(data, []byte(pinPreamble)) {
+		return "", data, false
+	}
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return "", data, false
+	}
+	return preambleBackend(data[:i+1]), data[i+1:], true
+}
+
+// preambleBackend returns the backend named by a preamble line.
+func preambleBackend(line []byte) string {
+	return strings.TrimSpace(string(line[len(pinPreamble):]))
+}
+
+// addrFromNetAddr returns the IP address of a TCP or UDP address.
+func addrFromNetAddr(a net.Addr) (netip.Addr, bool) {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		addr, ok := netip.AddrFromSlice(a.IP)
+		return addr.Unmap(), ok
+	case *net.UDPAddr:
+		addr, ok := netip.AddrFromSlice(a.IP)
+		return addr.Unmap(), ok
+	}
+	ap, err := netip.ParseAddrPort(a.String())
+	return ap.Addr().Unmap(), err == nil
+}
+
+// pinnedBackend returns the backend named by a preamble, or an error if it
+// is not in the pool.
+func (p *BaseServerPool) pinnedBackend(name string) (*Backend, error) {
+	b := p.findBackend(name)
+	if b == nil {
+		return nil, fmt.Errorf("pinned backend %q not found", name)
+	}
+	return b, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewBackendPinning(t *testing.T) {
+	if p, err := newBackendPinning(&PinBackendConfig{AllowedClients: []string{"10.0.0.1"}}); p != nil || err != nil {
+		t.Errorf("expected nil pinning when disabled, got %v, %v", p, err)
+	}
+	for _, cfg := range []*PinBackendConfig{
+		{Enabled: true},
+		{Enabled: true, AllowedClients: []string{"not-an-ip"}},
+		{Enabled: true, AllowedClients: []string{"10.0.0.0/33"}},
+		{Enabled: true, AllowedClients: []string{"10.0.0.1"}, Timeout: "0s"},
+	} {
+		if _, err := newBackendPinning(cfg); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
+
+func TestBackendPinning_allows(t *testing.T) {
+	p, err := newBackendPinning(&PinBackendConfig{Enabled: true, AllowedClients: []string{"10.1.2.3", "192.168.0.0/16", "fd00::/8"}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}, true},
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.4"), Port: 1}, false},
+		{&net.UDPAddr{IP: net.ParseIP("::ffff:192.168.5.6"), Port: 1}, true},
+		{&net.UDPAddr{IP: net.ParseIP("fd12::1"), Port: 1}, true},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}, false},
+	}
+	for _, tt := range tests {
+		if got := p.allows(tt.addr); got != tt.want {
+			t.Errorf("expected allows(%s) to be %t, got %t", tt.addr, tt.want, got)
+		}
+	}
+
+	var disabled *backendPinning
+	if disabled.allows(tests[0].addr) {
+		t.Errorf("expected nil pinning to allow nobody")
+	}
+}
+
+func TestBackendPinning_readPreamble(t *testing.T) {
+	p := &backendPinning{timeout: 50 * time.Millisecond}
+	tests := []struct {
+		name   string
+		data   string
+		pinned string
+		rest   string
+		err    bool
+	}{
+		{"preamble", "X-NLB-Backend: 10.0.0.1:80\nhello", "10.0.0.1:80", "hello", false},
+		{"crlf preamble", "X-NLB-Backend:b1\r\n", "b1", "", false},
+		{"no preamble", "hello world", "", "hello world", false},
+		{"partial prefix", "X-NLB", "", "X-NLB", false},
+		{"silent client", "", "", "", false},
+		{"empty name", "X-NLB-Backend: \n", "", "", true},
+		{"too long", "X-NLB-Backend: " + strings.Repeat("a", maxPinLine), "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			go client.Write([]byte(tt.data))
+
+			conn, name, err := p.readPreamble(server)
+			if tt.err {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if name != tt.pinned {
+				t.Errorf("expected backend %q, got %q", tt.pinned, name)
+			}
+			if tt.rest == "" {
+				return
+			}
+			buf := make([]byte, len(tt.rest))
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != tt.rest {
+				t.Errorf("expected %q to be replayed, got %q, %v", tt.rest, buf, err)
+			}
+		})
+	}
+}
+
+func Test_parsePreamble(t *testing.T) {
+	name, rest, ok := parsePreamble([]byte("X-NLB-Backend: b2\nquery"))
+	if !ok || name != "b2" || string(rest) != "query" {
+		t.Errorf("expected b2 and query, got %q, %q, %t", name, rest, ok)
+	}
+	for _, data := range []string{"query", "X-NLB-Backend: b2"} {
+		if _, rest, ok := parsePreamble([]byte(data)); ok || string(rest) != data {
+			t.Errorf("expected %q not to be a preamble", data)
+		}
+	}
+}
+
+func TestTCPServerPool_pinBackend(t *testing.T) {
+	a, b := startNamedBackend(t, "a"), startNamedBackend(t, "b")
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:       "127.0.0.1:0",
+		Backends:   []BackendConfig{{URL: "tcp://" + a}, {URL: "tcp://" + b}},
+		PinBackend: &PinBackendConfig{Enabled: true, AllowedClients: []string{"127.0.0.0/8"}, Timeout: "50ms"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// Pinning ignores health, so b can be tested while out of rotation.
+	pool.backends[0].SetHealthy(true)
+	pool.Start()
+	defer pool.Shutdown(t.Context())
+
+	for range 2 {
+		conn, err := net.Dial("tcp", pool.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		conn.Write([]byte("X-NLB-Backend: " + b + "\nping\n"))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		r := bufio.NewReader(conn)
+		name, _ := r.ReadString('\n')
+		echo, _ := r.ReadString('\n')
+		conn.Close()
+		if name != "b\n" || echo != "ping\n" {
+			t.Errorf("expected b to echo ping without the preamble, got %q, %q", name, echo)
+		}
+	}
+
+	conn, err := net.Dial("tcp", pool.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("X-NLB-Backend: unknown:1\n"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("expected connection pinned to an unknown backend to be closed")
+	}
+}
+
+func TestUDPServerPool_pinBackend(t *testing.T) {
+	a := startUDPResponder(t, func(b []byte) []byte { return append([]byte("a:"), b...) })
+	b := startUDPResponder(t, func(b []byte) []byte { return append([]byte("b:"), b...) })
+	pool, err := NewUDPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:       "127.0.0.1:0",
+		Backends:   []BackendConfig{{URL: "udp://" + a.LocalAddr().String()}, {URL: "udp://" + b.LocalAddr().String()}},
+		PinBackend: &PinBackendConfig{Enabled: true, AllowedClients: []string{"127.0.0.1"}},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	pool.backends[0].SetHealthy(true)
+	if err := pool.Start(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer pool.Shutdown(t.Context())
+
+	client, err := net.DialUDP("udp", nil, pool.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("failed to dial pool: %v", err)
+	}
+	defer client.Close()
+	client.Write([]byte("X-NLB-Backend: " + b.LocalAddr().String() + "\nping"))
+	buf := make([]byte, 64)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "b:ping" {
+		t.Errorf("expected b:ping, got %q, %v", buf[:n], err)
+	}
+}
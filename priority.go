@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+)
+
+// defaultPriorityClass is the class of clients that match no configured
+// class.
+const defaultPriorityClass = "default"
+
+// defaultShedAt is the share of backend capacity in use at which clients in
+// the default class are shed.
+const defaultShedAt = 0.8
+
+// priorityClass is a set of clients that are shed together once the pool's
+// backends are filled to a share of their connection limit.
+type priorityClass struct {
+	name    string
+	clients []netip.Prefix
+	// shedAt is the share of capacity in use at which new connections from
+	// the class are shed; zero never sheds them.
+	shedAt float64
+
+	admitted atomic.Uint64
+	shed     atomic.Uint64
+}
+
+// priorityClasses sheds connections from less important clients first as
+// the pool approaches max_connections, so that internal and health check
+// traffic keeps working while the pool is overloaded. A client belongs to
+// the first class with a prefix that contains its address, or to the
+// default class.
+type priorityClasses struct {
+	classes []*priorityClass
+	// fallback is the class of clients in no configured class.
+	fallback *priorityClass
+}
+
+func newPriorityClasses(config *PriorityClassesConfig, maxConnections int64) (*priorityClasses, error) {
+	if config == nil || len(config.Classes) == 0 {
+		return nil, nil
+	}
+	if maxConnections <= 0 {
+		return nil, fmt.Errorf("priority_classes requires max_connections")
+	}
+	pc := &priorityClasses{fallback: &priorityClass{name: defaultPriorityClass, shedAt: defaultShedAt}}
+	if config.DefaultShedAt != 0 {
+		if err := validShedAt(config.DefaultShedAt); err != nil {
+			return nil, fmt.Errorf("invalid priority_classes default_shed_at: %w", err)
+		}
+		pc.fallback.shedAt = config.DefaultShedAt
+	}
+	for _, cc := range config.Classes {
+		if cc.Name == "" || cc.Name == defaultPriorityClass {
+			return nil, fmt.Errorf("invalid priority class name %q", cc.Name)
+		}
+		if slices.ContainsFunc(pc.classes, func(c *priorityClass) bool { return c.name == cc.Name }) {
+			return nil, fmt.Errorf("duplicate priority class %q", cc.Name)
+		}
+		if len(cc.Clients) == 0 {
+			return nil, fmt.Errorf("priority class %q requires clients", cc.Name)
+		}
+		if err := validShedAt(cc.ShedAt); err != nil {
+			return nil, fmt.Errorf("invalid shed_at for priority class %q: %w", cc.Name, err)
+		}
+		class := &priorityClass{name: cc.Name, shedAt: cc.ShedAt}
+		for _, s := range cc.Clients {
+			prefix, err := parsePrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid client %q in priority class %q: %w", s, cc.Name, err)
+			}
+			class.clients = append(class.clients, prefix)
+		}
+		pc.classes = append(pc.classes, class)
+	}
+	return pc, nil
+}
+
+func validShedAt(shedAt float64) error {
+	if shedAt < 0 || shedAt > 1 {
+		return fmt.Errorf("must be between 0 and 1")
+	}
+	return nil
+}
+
+// classify returns the class of a client.
+func (pc *priorityClasses) classify(client net.Addr) *priorityClass {
+	if addr, ok := addrFromNetAddr(client); ok {
+		for _, c := range pc.classes {
+			if slices.ContainsFunc(c.clients, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+				return c
+			}
+		}
+	}
+	return pc.fallback
+}
+
+// admit reports whether a new connection from client may be served while
+// utilization of the backends' capacity is in use, and returns the client's
+// class. A nil priorityClasses admits every connection.
+func (pc *priorityClasses) admit(client net.Addr, utilization float64) (*priorityClass, bool) {
+	if pc == nil {
+		return nil, true
+	}
+	c := pc.classify(client)
+	if c.shedAt > 0 && utilization >= c.shedAt {
+		c.shed.Add(1)
+		return c, false
+	}
+	c.admitted.Add(1)
+	return c, true
+}
+
+// all returns every class, the default one last.
+func (pc *priorityClasses) all() []*priorityClass {
+	return append(slices.Clone(pc.classes), pc.fallback)
+}
+
+// utilization returns the share of the connection capacity of the healthy,
+// non-draining backends that is in use, or 1 if there is none.
+func (p *BaseServerPool) utilization() float64 {
+	var used, capacity int64
+	for _, b := range p.Backends() {
+		if !b.Healthy() || b.Draining() || isStaticBackend(b) {
+			continue
+		}
+		used += min(b.ActiveConnections(), p.maxConnections)
+		capacity += p.maxConnections
+	}
+	if capacity == 0 {
+		return 1
+	}
+	return float64(used) / float64(capacity)
+}
+
+// admitClient applies the priority classes to a new connection from client,
+// logging to l if it is shed.
+func (p *BaseServerPool) admitClient(client net.Addr, l *log.Logger) bool {
+	if p.priority == nil {
+		return true
+	}
+	utilization := p.utilization()
+	c, ok := p.priority.admit(client, utilization)
+	if !ok {
+		infof(l, "shedding connection from %s: %.0f%% of backend capacity in use, priority class %s is shed at %.0f%%", client, 100*utilization, c.name, 100*c.shedAt)
+	}
+	return ok
+}
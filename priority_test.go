@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_newPriorityClasses(t *testing.T) {
+	if pc, err := newPriorityClasses(nil, 10); pc != nil || err != nil {
+		t.Errorf("expected no priority classes when not configured, got %v, %v", pc, err)
+	}
+	valid := &PriorityClassesConfig{Classes: []PriorityClassConfig{{Name: "internal", Clients: []string{"10.0.0.0/8"}}}}
+	pc, err := newPriorityClasses(valid, 10)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if pc.fallback.shedAt != defaultShedAt {
+		t.Errorf("expected the default class to be shed at %v, got %v", defaultShedAt, pc.fallback.shedAt)
+	}
+	if _, err := newPriorityClasses(valid, 0); err == nil {
+		t.Errorf("expected an error without max_connections")
+	}
+	for _, config := range []*PriorityClassesConfig{
+		{Classes: []PriorityClassConfig{{Name: "", Clients: []string{"10.0.0.1"}}}},
+		{Classes: []PriorityClassConfig{{Name: "default", Clients: []string{"10.0.0.1"}}}},
+		{Classes: []PriorityClassConfig{{Name: "a", Clients: []string{"10.0.0.1"}}, {Name: "a", Clients: []string{"10.0.0.2"}}}},
+		{Classes: []PriorityClassConfig{{Name: "a"}}},
+		{Classes: []PriorityClassConfig{{Name: "a", Clients: []string{"10.0.0.0/33"}}}},
+		{Classes: []PriorityClassConfig{{Name: "a", Clients: []string{"10.0.0.1"}, ShedAt: 1.5}}},
+		{Classes: []PriorityClassConfig{{Name: "a", Clients: []string{"10.0.0.1"}}}, DefaultShedAt: -1},
+	} {
+		if _, err := newPriorityClasses(config, 10); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
+
+func TestPriorityClasses_admit(t *testing.T) {
+	pc, err := newPriorityClasses(&PriorityClassesConfig{
+		Classes: []PriorityClassConfig{
+			{Name: "health", Clients: []string{"10.1.0.0/16"}},
+			{Name: "internal", Clients: []string{"10.0.0.0/8"}, ShedAt: 0.95},
+		},
+		DefaultShedAt: 0.5,
+	}, 10)
+	if err != nil {
+		t.Fatalf("failed to create priority classes: %v", err)
+	}
+	health := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1000}
+	internal := &net.TCPAddr{IP: net.ParseIP("10.2.3.4"), Port: 1000}
+	external := &net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 1000}
+
+	for _, tt := range []struct {
+		client      net.Addr
+		utilization float64
+		class       string
+		admitted    bool
+	}{
+		{external, 0.4, "default", true},
+		{external, 0.5, "default", false},
+		{internal, 0.9, "internal", true},
+		{internal, 0.95, "internal", false},
+		{health, 1, "health", true},
+	} {
+		c, ok := pc.admit(tt.client, tt.utilization)
+		if c.name != tt.class || ok != tt.admitted {
+			t.Errorf("expected %s at %v to be in class %s and admitted %v, got %s and %v", tt.client, tt.utilization, tt.class, tt.admitted, c.name, ok)
+		}
+	}
+	if got := pc.fallback.shed.Load(); got != 1 {
+		t.Errorf("expected 1 shed connection in the default class, got %d", got)
+	}
+
+	var none *priorityClasses
+	if _, ok := none.admit(external, 1); !ok {
+		t.Errorf("expected nil priority classes to admit every connection")
+	}
+}
+
+func TestBaseServerPool_admitClient(t *testing.T) {
+	pool := &BaseServerPool{maxConnections: 2, log: log.New(io.Discard, "", 0)}
+	for _, u := range []string{"127.0.0.1:8080", "127.0.0.1:8081"} {
+		b, err := pool.addBackend(BackendConfig{URL: u})
+		if err != nil {
+			t.Fatalf("failed to add backend: %v", err)
+		}
+		pool.setHealthy(b, true)
+	}
+	pool.priority, _ = newPriorityClasses(&PriorityClassesConfig{
+		Classes: []PriorityClassConfig{{Name: "internal", Clients: []string{"127.0.0.0/8"}}},
+	}, 2)
+
+	backends := pool.Backends()
+	backends[0].acquire()
+	backends[0].acquire()
+	backends[1].acquire()
+	if got := pool.utilization(); got != 0.75 {
+		t.Errorf("expected utilization 0.75, got %v", got)
+	}
+	if !pool.admitClient(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, pool.log) {
+		t.Errorf("expected an internal client to be admitted")
+	}
+	backends[1].acquire()
+	if pool.admitClient(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, pool.log) {
+		t.Errorf("expected a default client to be shed at full capacity")
+	}
+
+	rec := httptest.NewRecorder()
+	pool.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`nlb_priority_connections_total{class="internal",result="admitted"} 1`,
+		`nlb_priority_connections_total{class="default",result="shed"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("expected metrics to contain %q", want)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// probeSeriesSize is the number of probe results kept per backend.
+const probeSeriesSize = 120
+
+// probeSample is the latency and outcome of one health check probe.
+type probeSample struct {
+	Time    time.Time
+	Latency time.Duration
+	Error   string
+}
+
+// probeSeries is a ring buffer of a backend's recent probe results, so that
+// a backend slowing down is visible before its probes fail. The zero value
+// is ready to use.
+type probeSeries struct {
+	mux     sync.Mutex
+	samples [probeSeriesSize]probeSample
+	next    int
+	count   int
+}
+
+// record adds a sample, overwriting the oldest once the buffer is full.
+func (s *probeSeries) record(sample probeSample) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.samples[s.next] = sample
+	s.next = (s.next + 1) % probeSeriesSize
+	s.count = min(s.count+1, probeSeriesSize)
+}
+
+// recent returns the recorded samples, oldest first.
+func (s *probeSeries) recent() []probeSample {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	out := make([]probeSample, 0, s.count)
+	for i := range s.count {
+		out = append(out, s.samples[(s.next-s.count+i+probeSeriesSize)%probeSeriesSize])
+	}
+	return out
+}
+
+// last returns the most recent sample, if any.
+func (s *probeSeries) last() (probeSample, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.count == 0 {
+		return probeSample{}, false
+	}
+	return s.samples[(s.next-1+probeSeriesSize)%probeSeriesSize], true
+}
+
+// newProbeSample returns the result of a probe started at start that
+// returned err.
+func newProbeSample(start time.Time, err error) probeSample {
+	sample := probeSample{Time: start, Latency: time.Since(start)}
+	if err != nil {
+		sample.Error = err.Error()
+	}
+	return sample
+}
+
+// probeSampleView is a probe result in the admin API. Latencies are in
+// seconds.
+type probeSampleView struct {
+	Time    time.Time `json:"time"`
+	Latency float64   `json:"latency"`
+	OK      bool      `json:"ok"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// probeSeriesView summarizes a backend's recent probes: the mean and
+// maximum latency of the successful ones, the number that failed and every
+// sample, oldest first.
+type probeSeriesView struct {
+	Mean     float64           `json:"mean"`
+	Max      float64           `json:"max"`
+	Failures int               `json:"failures"`
+	Samples  []probeSampleView `json:"samples"`
+}
+
+func newProbeSeriesView(b *Backend) probeSeriesView {
+	v := probeSeriesView{Samples: []probeSampleView{}}
+	var sum time.Duration
+	ok := 0
+	for _, s := range b.probes.recent() {
+		v.Samples = append(v.Samples, probeSampleView{Time: s.Time, Latency: s.Latency.Seconds(), OK: s.Error == "", Error: s.Error})
+		if s.Error != "" {
+			v.Failures++
+			continue
+		}
+		ok++
+		sum += s.Latency
+		v.Max = max(v.Max, s.Latency.Seconds())
+	}
+	if ok > 0 {
+		v.Mean = (sum / time.Duration(ok)).Seconds()
+	}
+	return v
+}
+
+// probesAPIHandler returns the latency and outcome of a backend's recent
+// health check probes.
+func (p *BaseServerPool) probesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	b := p.findBackend(r.PathValue("backend"))
+	if b == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("backend %q not found", r.PathValue("backend")))
+		return
+	}
+	writeJSON(w, http.StatusOK, newProbeSeriesView(b))
+}
+
+// Dimensions of the probe latency sparkline on the dashboard.
+const (
+	sparklineWidth  = 120
+	sparklineHeight = 24
+)
+
+// formatSparkline renders probe latencies as an inline SVG chart for the
+// dashboard, scaled to the slowest successful probe. Failed probes are
+// marked at the bottom of the chart.
+func formatSparkline(samples []probeSample) template.HTML {
+	if len(samples) == 0 {
+		return "-"
+	}
+	var slowest time.Duration
+	for _, s := range samples {
+		if s.Error == "" {
+			slowest = max(slowest, s.Latency)
+		}
+	}
+	step := float64(sparklineWidth) / float64(max(probeSeriesSize-1, 1))
+	var points, failures strings.Builder
+	for i, s := range samples {
+		x := float64(i) * step
+		if s.Error != "" {
+			fmt.Fprintf(&failures, `<circle class="probe-failed" cx="%.1f" cy="%d" r="1.5"/>`, x, sparklineHeight-2)
+			continue
+		}
+		y := float64(sparklineHeight)
+		if slowest > 0 {
+			y -= float64(sparklineHeight-4) * float64(s.Latency) / float64(slowest)
+		}
+		fmt.Fprintf(&points, "%.1f,%.1f ", x, y-2)
+	}
+	return template.HTML(fmt.Sprintf(`<svg class="sparkline" width="%d" height="%d" viewBox="0 0 %d %d"><title>max %s</title><polyline points="%s"/>%s</svg>`,
+		sparklineWidth, sparklineHeight, sparklineWidth, sparklineHeight, template.HTMLEscapeString(formatLatency(slowest)), strings.TrimSpace(points.String()), failures.String()))
+}
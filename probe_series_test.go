@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbeSeries(t *testing.T) {
+	var s probeSeries
+	if _, ok := s.last(); ok {
+		t.Errorf("expected no last sample in an empty series")
+	}
+	start := time.Now()
+	for i := range probeSeriesSize + 5 {
+		s.record(probeSample{Time: start.Add(time.Duration(i) * time.Second), Latency: time.Duration(i) * time.Millisecond})
+	}
+	samples := s.recent()
+	if len(samples) != probeSeriesSize {
+		t.Fatalf("expected %d samples, got %d", probeSeriesSize, len(samples))
+	}
+	if samples[0].Latency != 5*time.Millisecond || samples[len(samples)-1].Latency != (probeSeriesSize+4)*time.Millisecond {
+		t.Errorf("expected the oldest samples to be overwritten, got %s to %s", samples[0].Latency, samples[len(samples)-1].Latency)
+	}
+	if last, ok := s.last(); !ok || last != samples[len(samples)-1] {
+		t.Errorf("expected the last sample to be the newest, got %+v", last)
+	}
+}
+
+func TestBaseServerPool_probesAPIHandler(t *testing.T) {
+	pool := &BaseServerPool{
+		healthCheck: healthCheck{prober: tcpProbe{}, timeout: time.Second},
+		log:         log.New(io.Discard, "", 0),
+	}
+	pool.AddBackend("tcp://127.0.0.1:1")
+	b := pool.backends[0]
+	pool.runProbe(t.Context(), b)
+
+	// A probe abandoned because health checks stopped is not recorded.
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	pool.runProbe(ctx, b)
+
+	b.probes.record(probeSample{Time: time.Now(), Latency: 10 * time.Millisecond})
+	b.probes.record(probeSample{Time: time.Now(), Latency: 30 * time.Millisecond})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/backends/{backend}/probes", pool.probesAPIHandler)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/backends/127.0.0.1:1/probes", nil))
+	var v probeSeriesView
+	if err := json.NewDecoder(rec.Body).Decode(&v); err != nil {
+		t.Fatalf("failed to decode view: %v", err)
+	}
+	if len(v.Samples) != 3 || v.Samples[0].OK || v.Samples[0].Error == "" || v.Failures != 1 {
+		t.Fatalf("expected a failed probe and two samples, got %+v", v)
+	}
+	if v.Mean != 0.02 || v.Max != 0.03 {
+		t.Errorf("expected mean 0.02 and max 0.03 of the successful probes, got %g and %g", v.Mean, v.Max)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/backends/missing/probes", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", rec.Code)
+	}
+}
+
+func Test_formatSparkline(t *testing.T) {
+	if got := formatSparkline(nil); got != "-" {
+		t.Errorf("expected - without samples, got %q", got)
+	}
+	got := string(formatSparkline([]probeSample{
+		{Latency: 10 * time.Millisecond},
+		{Latency: 2 * time.Second, Error: errors.New("timeout").Error()},
+		{Latency: 20 * time.Millisecond},
+	}))
+	// The chart is scaled to the slowest successful probe.
+	for _, want := range []string{"<title>max 20ms</title>", `points="0.0,12.0 2.0,2.0"`, `class="probe-failed" cx="1.0"`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in %q", want, got)
+		}
+	}
+}
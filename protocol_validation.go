@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Protocols the first bytes of connections can be validated against.
+const (
+	ValidateTLS  = "tls"
+	ValidateLine = "line"
+	ValidateHTTP = "http"
+)
+
+const (
+	defaultValidationTimeout = time.Second
+	defaultMaxFirstLine      = 4096
+	// maxTLSRecord is the largest TLS record a client may send.
+	maxTLSRecord = 1 << 14
+)
+
+// Outcomes of validating a connection.
+const (
+	validationPassed     = "passed"
+	validationIncomplete = "incomplete"
+	validationInvalid    = "invalid"
+	validationTooLarge   = "too_large"
+	validationTimeout    = "timeout"
+)
+
+// protocolValidator checks that the first bytes clients of a TCP listener
+// send look like the expected protocol before a backend is dialed, so that
+// scanners and clients speaking the wrong protocol never reach a backend.
+type protocolValidator struct {
+	expect      string
+	maxBytes    int
+	timeout     time.Duration
+	allowSilent bool
+
+	results map[string]*atomic.Uint64
+}
+
+func newProtocolValidator(cfg *ProtocolValidationConfig) (*protocolValidator, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	v := &protocolValidator{
+		expect:      cfg.Expect,
+		maxBytes:    cfg.MaxFirstMessage,
+		timeout:     defaultValidationTimeout,
+		allowSilent: cfg.AllowSilent,
+		results:     make(map[string]*atomic.Uint64),
+	}
+	switch v.expect {
+	case ValidateTLS:
+		v.maxBytes = cmp.Or(v.maxBytes, maxTLSRecord)
+		if v.maxBytes < 1 || v.maxBytes > maxTLSRecord {
+			return nil, fmt.Errorf("protocol_validation max_first_message must be between 1 and %d for tls", maxTLSRecord)
+		}
+	case ValidateLine, ValidateHTTP:
+		v.maxBytes = cmp.Or(v.maxBytes, defaultMaxFirstLine)
+		if v.maxBytes < 1 || v.maxBytes > sniffBufferSize {
+			return nil, fmt.Errorf("protocol_validation max_first_message must be between 1 and %d", sniffBufferSize)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported protocol_validation expect: %q", v.expect)
+	}
+	if cfg.Timeout != "" {
+		d, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid protocol_validation timeout: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("protocol_validation timeout must be positive")
+		}
+		v.timeout = d
+	}
+	for _, result := range []string{validationPassed, validationInvalid, validationTooLarge, validationTimeout} {
+		v.results[result] = new(atomic.Uint64)
+	}
+	return v, nil
+}
+
+// check returns the outcome of validating data, the first bytes the client
+// sent, or validationIncomplete if more bytes are needed to tell.
+func (v *protocolValidator) check(data []byte) string {
+	if v.expect == ValidateTLS {
+		return checkTLSRecord(data, v.maxBytes)
+	}
+	if v.expect == ValidateHTTP && httpPrefix(data) == prefixMismatch {
+		return validationInvalid
+	}
+	end := bytes.IndexByte(data, '\n')
+	line := data
+	if end >= 0 {
+		line = data[:end]
+	}
+	for _, c := range line {
+		if (c < ' ' || c > '~') && c != '\t' && c != '\r' {
+			return validationInvalid
+		}
+	}
+	switch {
+	case end < 0 && len(data) >= v.maxBytes:
+		return validationTooLarge
+	case end < 0:
+		return validationIncomplete
+	case v.expect == ValidateHTTP && !isHTTPRequestLine(line):
+		return validationInvalid
+	}
+	return validationPassed
+}
+
+// checkTLSRecord validates the header of the first TLS record, which must
+// be a handshake record of at most maxBytes holding a ClientHello.
+func checkTLSRecord(data []byte, maxBytes int) string {
+	if len(data) > 0 && data[0] != 0x16 {
+		return validationInvalid
+	}
+	if len(data) > 1 && data[1] != 3 {
+		return validationInvalid
+	}
+	if len(data) > 2 && data[2] > 4 {
+		return validationInvalid
+	}
+	if len(data) < 6 {
+		return validationIncomplete
+	}
+	length := int(data[3])<<8 | int(data[4])
+	switch {
+	case length == 0 || data[5] != 1: // ClientHello
+		return validationInvalid
+	case length > maxBytes:
+		return validationTooLarge
+	}
+	return validationPassed
+}
+
+// isHTTPRequestLine reports whether line ends with an HTTP version.
+func isHTTPRequestLine(line []byte) bool {
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	i := bytes.LastIndexByte(line, ' ')
+	return i > 0 && bytes.HasPrefix(line[i+1:], []byte("HTTP/"))
+}
+
+// validate reads the client's first bytes, waiting at most the timeout,
+// and returns a connection replaying them if they look like the expected
+// protocol. Clients that send nothing in time are only let through with
+// allow_silent, for protocols where the server speaks first.
+func (v *protocolValidator) validate(conn net.Conn) (net.Conn, error) {
+	size := v.maxBytes
+	if v.expect == ValidateTLS {
+		size = 16
+	}
+	br := bufio.NewReaderSize(conn, size)
+	conn.SetReadDeadline(time.Now().Add(v.timeout))
+	result := validationIncomplete
+	data := peekUntil(br, func(b []byte) bool {
+		result = v.check(b)
+		return result != validationIncomplete
+	})
+	conn.SetReadDeadline(time.Time{})
+	if result == validationIncomplete {
+		if len(data) == 0 && v.allowSilent {
+			result = validationPassed
+		} else {
+			result = validationTimeout
+		}
+	}
+	v.results[result].Add(1)
+	switch result {
+	case validationTimeout:
+		return nil, fmt.Errorf("no complete %s message within %s", v.expect, v.timeout)
+	case validationTooLarge:
+		return nil, fmt.Errorf("first %s message exceeds %d bytes", v.expect, v.maxBytes)
+	case validationInvalid:
+		return nil, fmt.Errorf("first %d bytes are not valid %s", len(data), v.expect)
+	}
+	return &peekedConn{Conn: conn, r: br}, nil
+}
+
+// Results returns the number of connections by validation outcome.
+func (v *protocolValidator) Results() map[string]uint64 {
+	counts := make(map[string]uint64, len(v.results))
+	for result, n := range v.results {
+		counts[result] = n.Load()
+	}
+	return counts
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_newProtocolValidator(t *testing.T) {
+	if v, err := newProtocolValidator(nil); v != nil || err != nil {
+		t.Errorf("expected no validation when not configured, got %v, %v", v, err)
+	}
+	for _, config := range []*ProtocolValidationConfig{
+		{},
+		{Expect: "ssh"},
+		{Expect: ValidateTLS, MaxFirstMessage: maxTLSRecord + 1},
+		{Expect: ValidateLine, MaxFirstMessage: -1},
+		{Expect: ValidateLine, Timeout: "soon"},
+		{Expect: ValidateLine, Timeout: "0s"},
+	} {
+		if _, err := newProtocolValidator(config); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+	v, err := newProtocolValidator(&ProtocolValidationConfig{Expect: ValidateHTTP})
+	if err != nil {
+		t.Fatalf("failed to create validator: %v", err)
+	}
+	if v.maxBytes != defaultMaxFirstLine || v.timeout != defaultValidationTimeout {
+		t.Errorf("expected the defaults, got %d and %s", v.maxBytes, v.timeout)
+	}
+}
+
+func TestProtocolValidator_check(t *testing.T) {
+	for _, tt := range []struct {
+		expect string
+		data   string
+		want   string
+	}{
+		{ValidateTLS, "\x16\x03\x01\x00\xc8\x01", validationPassed},
+		{ValidateTLS, "\x16\x03", validationIncomplete},
+		{ValidateTLS, "GET / HTTP/1.1\r\n", validationInvalid},
+		{ValidateTLS, "\x16\x03\x01\x02\x00\x02", validationInvalid},
+		{ValidateTLS, "\x16\x03\x01\x00\x00\x01", validationInvalid},
+		{ValidateTLS, "\x16\x03\x01\x01\x01\x01", validationTooLarge},
+		{ValidateLine, "HELO example.com\r\n", validationPassed},
+		{ValidateLine, "HELO exa", validationIncomplete},
+		{ValidateLine, "HELO\x00\x01\r\n", validationInvalid},
+		{ValidateLine, strings.Repeat("a", 256), validationTooLarge},
+		{ValidateHTTP, "GET / HTTP/1.1\r\nHost: a\r\n", validationPassed},
+		{ValidateHTTP, "GET / HT", validationIncomplete},
+		{ValidateHTTP, "HELO example.com\r\n", validationInvalid},
+		{ValidateHTTP, "GET /\r\n", validationInvalid},
+	} {
+		v := &protocolValidator{expect: tt.expect, maxBytes: 256}
+		if got := v.check([]byte(tt.data)); got != tt.want {
+			t.Errorf("%s %q: expected %s, got %s", tt.expect, tt.data, tt.want, got)
+		}
+	}
+}
+
+func Test_proxy_protocolValidation(t *testing.T) {
+	backend := startTCPEcho(t)
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:               "127.0.0.1:0",
+		Backends:           []BackendConfig{{URL: backend}},
+		ProtocolValidation: &ProtocolValidationConfig{Expect: ValidateLine, Timeout: "100ms"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	pool.backends[0].SetHealthy(true)
+	pool.Start()
+	defer pool.Shutdown(t.Context())
+
+	exchange := func(payload string) string {
+		t.Helper()
+		conn, err := net.Dial("tcp", pool.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to connect to load balancer: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write([]byte(payload))
+		buf := make([]byte, 64)
+		n, _ := io.ReadAtLeast(conn, buf, max(1, len(payload)))
+		return string(buf[:n])
+	}
+	if got := exchange("PING\r\n"); got != "PING\r\n" {
+		t.Errorf("expected a valid line to be proxied, got %q", got)
+	}
+	if got := exchange("\x16\x03\x01\x00\x05hello"); got != "" {
+		t.Errorf("expected binary data to be rejected, got %q", got)
+	}
+	if got := exchange(""); got != "" {
+		t.Errorf("expected a silent client to be rejected, got %q", got)
+	}
+	if pool.backends[0].TotalConnections() != 1 {
+		t.Errorf("expected only the valid connection to reach the backend, got %d", pool.backends[0].TotalConnections())
+	}
+
+	rec := httptest.NewRecorder()
+	pool.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`nlb_protocol_validation_connections_total{result="passed"} 1`,
+		`nlb_protocol_validation_connections_total{result="invalid"} 1`,
+		`nlb_protocol_validation_connections_total{result="timeout"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("expected metrics to contain %q", want)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Quarantine defaults.
+const (
+	defaultQuarantineAfter   = 30 * time.Minute
+	defaultQuarantineRecheck = 5 * time.Minute
+)
+
+// quarantinedBackend is a backend removed from its pool after being down
+// for the quarantine period.
+type quarantinedBackend struct {
+	backend *Backend
+	// config adds the backend back as it was configured.
+	config        BackendConfig
+	downSince     time.Time
+	quarantinedAt time.Time
+	lastCheck     time.Time
+	// released is closed once the backend leaves quarantine.
+	released chan struct{}
+}
+
+// quarantine removes backends that have failed their health checks for a
+// long time from rotation, so that selection and regular probes do not
+// waste work on hosts that are gone. Quarantined backends are probed at a
+// slower pace and added back once they recover.
+type quarantine struct {
+	after   time.Duration
+	recheck time.Duration
+	// forget drops a backend for good once it has been quarantined that
+	// long; zero keeps it until it recovers.
+	forget time.Duration
+
+	mux      sync.Mutex
+	backends map[string]*quarantinedBackend
+
+	restored  atomic.Uint64
+	forgotten atomic.Uint64
+}
+
+func newQuarantine(config *QuarantineConfig) (*quarantine, error) {
+	if config == nil || !config.Enabled {
+		return nil, nil
+	}
+	q := &quarantine{
+		after:    defaultQuarantineAfter,
+		recheck:  defaultQuarantineRecheck,
+		backends: make(map[string]*quarantinedBackend),
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"after", config.After, &q.after},
+		{"recheck", config.Recheck, &q.recheck},
+		{"forget", config.Forget, &q.forget},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quarantine %s: %w", d.name, err)
+		}
+		if v <= 0 {
+			return nil, fmt.Errorf("quarantine %s must be positive", d.name)
+		}
+		*d.dst = v
+	}
+	return q, nil
+}
+
+// due reports whether a backend failing its health checks since downSince
+// should be quarantined at now. A nil quarantine never quarantines.
+func (q *quarantine) due(downSince, now time.Time) bool {
+	return q != nil && !downSince.IsZero() && now.Sub(downSince) >= q.after
+}
+
+// Len returns the number of quarantined backends.
+func (q *quarantine) Len() int {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return len(q.backends)
+}
+
+// release takes the backend out of quarantine and reports whether it was
+// quarantined.
+func (q *quarantine) release(qb *quarantinedBackend) bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if q.backends[qb.backend.ID] != qb {
+		return false
+	}
+	delete(q.backends, qb.backend.ID)
+	close(qb.released)
+	return true
+}
+
+// find returns the quarantined backend with the given ID, URL or
+// host:port, or nil if there is none.
+func (q *quarantine) find(ref string) *quarantinedBackend {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	for _, qb := range q.backends {
+		b := qb.backend
+		if ref != "" && (b.ID == ref || b.URL.String() == ref || b.URL.Host == ref) {
+			return qb
+		}
+	}
+	return nil
+}
+
+// backendConfigOf returns the config a backend was added with.
+func backendConfigOf(b *Backend) BackendConfig {
+	config := BackendConfig{
+		URL:         b.URL.String(),
+		Labels:      b.Labels,
+		TLS:         b.tls,
+		runtime:     b.runtime,
+		group:       b.group,
+		sharedGroup: b.sharedGroup,
+	}
+	if b.dialTimeout > 0 {
+		config.DialTimeout = b.dialTimeout.String()
+	}
+	return config
+}
+
+// quarantineBackend removes a backend that has been down since downSince
+// from the pool and probes it every recheck interval until it recovers, is
+// forgotten or health checks stop.
+func (p *BaseServerPool) quarantineBackend(b *Backend, downSince time.Time) {
+	if _, err := p.removeBackend(b.ID); err != nil {
+		return
+	}
+	now := time.Now()
+	qb := &quarantinedBackend{
+		backend:       b,
+		config:        backendConfigOf(b),
+		downSince:     downSince,
+		quarantinedAt: now,
+		released:      make(chan struct{}),
+	}
+	p.quarantine.mux.Lock()
+	p.quarantine.backends[b.ID] = qb
+	p.quarantine.mux.Unlock()
+	infof(p.log, "backend %s has been down for %s, quarantining it", b.URL.Host, now.Sub(downSince).Round(time.Second))
+
+	p.checker.Go(func(ctx context.Context) {
+		for {
+			select {
+			case <-time.After(p.quarantine.recheck):
+			case <-qb.released:
+				return
+			case <-ctx.Done():
+				return
+			}
+			err := p.runProbe(ctx, b)
+			if ctx.Err() != nil {
+				return
+			}
+			b.setLastError(err)
+			now := time.Now()
+			p.quarantine.mux.Lock()
+			qb.lastCheck = now
+			p.quarantine.mux.Unlock()
+			switch {
+			case err == nil:
+				p.restoreQuarantined(qb)
+				return
+			case p.quarantine.forget > 0 && now.Sub(qb.quarantinedAt) >= p.quarantine.forget:
+				if p.quarantine.release(qb) {
+					p.quarantine.forgotten.Add(1)
+					infof(p.log, "forgetting backend %s after %s in quarantine", b.URL.Host, p.quarantine.forget)
+				}
+				return
+			}
+		}
+	})
+}
+
+// restoreQuarantined adds a quarantined backend that passed a health check
+// back to the pool.
+func (p *BaseServerPool) restoreQuarantined(qb *quarantinedBackend) {
+	if !p.quarantine.release(qb) {
+		return
+	}
+	if _, err := p.addBackend(qb.config); err != nil {
+		// The backend was added back in the meantime, by the admin API or
+		// discovery.
+		warnf(p.log, "could not restore quarantined backend %s: %v", qb.backend.URL.Host, err)
+		return
+	}
+	p.quarantine.restored.Add(1)
+	infof(p.log, "quarantined backend %s passed a health check, restoring it", qb.backend.URL.Host)
+}
+
+// quarantinedView describes a quarantined backend.
+type quarantinedView struct {
+	ID            string     `json:"id"`
+	URL           string     `json:"url"`
+	DownSince     time.Time  `json:"down_since"`
+	QuarantinedAt time.Time  `json:"quarantined_at"`
+	LastCheck     *time.Time `json:"last_check,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+// quarantineView reports the quarantine settings and the quarantined
+// backends, longest down first.
+type quarantineView struct {
+	After     string            `json:"after"`
+	Recheck   string            `json:"recheck"`
+	Forget    string            `json:"forget,omitempty"`
+	Restored  uint64            `json:"restored"`
+	Forgotten uint64            `json:"forgotten"`
+	Backends  []quarantinedView `json:"backends"`
+}
+
+// quarantined returns the quarantined backends, longest down first.
+func (q *quarantine) quarantined() []quarantinedView {
+	if q == nil {
+		return nil
+	}
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	views := make([]quarantinedView, 0, len(q.backends))
+	for _, qb := range q.backends {
+		v := quarantinedView{
+			ID:            qb.backend.ID,
+			URL:           qb.backend.URL.String(),
+			DownSince:     qb.downSince,
+			QuarantinedAt: qb.quarantinedAt,
+		}
+		if lastCheck := qb.lastCheck; !lastCheck.IsZero() {
+			v.LastCheck = &lastCheck
+		}
+		if err := qb.backend.LastError(); err != nil {
+			v.LastError = err.Error()
+		}
+		views = append(views, v)
+	}
+	slices.SortFunc(views, func(a, b quarantinedView) int {
+		return cmp.Or(a.DownSince.Compare(b.DownSince), cmp.Compare(a.ID, b.ID))
+	})
+	return views
+}
+
+func (q *quarantine) view() quarantineView {
+	v := quarantineView{
+		After:     q.after.String(),
+		Recheck:   q.recheck.String(),
+		Restored:  q.restored.Load(),
+		Forgotten: q.forgotten.Load(),
+		Backends:  q.quarantined(),
+	}
+	if q.forget > 0 {
+		v.Forget = q.forget.String()
+	}
+	return v
+}
+
+// quarantineAPIHandler lists the quarantined backends.
+func (p *BaseServerPool) quarantineAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	if p.quarantine == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("quarantine is not enabled"))
+		return
+	}
+	writeJSON(w, http.StatusOK, p.quarantine.view())
+}
+
+// forgetQuarantinedAPIHandler drops a quarantined backend for good.
+func (p *BaseServerPool) forgetQuarantinedAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if p.quarantine == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("quarantine is not enabled"))
+		return
+	}
+	qb := p.quarantine.find(r.PathValue("backend"))
+	if qb == nil || !p.quarantine.release(qb) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("backend %q is not quarantined", r.PathValue("backend")))
+		return
+	}
+	p.quarantine.forgotten.Add(1)
+	infof(p.log, "forgot quarantined backend %s", qb.backend.URL.Host)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// switchProbe reports every backend healthy while up is set.
+type switchProbe struct {
+	up *atomic.Bool
+}
+
+func (p switchProbe) probe(context.Context, *Backend) error {
+	if !p.up.Load() {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func Test_newQuarantine(t *testing.T) {
+	if q, err := newQuarantine(nil); q != nil || err != nil {
+		t.Errorf("expected no quarantine when not configured, got %v, %v", q, err)
+	}
+	q, err := newQuarantine(&QuarantineConfig{Enabled: true, Forget: "24h"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if q.after != defaultQuarantineAfter || q.recheck != defaultQuarantineRecheck || q.forget != 24*time.Hour {
+		t.Errorf("unexpected settings %+v", q)
+	}
+	for _, config := range []*QuarantineConfig{
+		{Enabled: true, After: "soon"},
+		{Enabled: true, Recheck: "0s"},
+		{Enabled: true, Forget: "-1h"},
+	} {
+		if _, err := newQuarantine(config); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
+
+func TestQuarantine_due(t *testing.T) {
+	now := time.Now()
+	var q *quarantine
+	if q.due(now.Add(-time.Hour), now) {
+		t.Errorf("expected a nil quarantine never to be due")
+	}
+	q, _ = newQuarantine(&QuarantineConfig{Enabled: true, After: "10m"})
+	if q.due(time.Time{}, now) || q.due(now.Add(-time.Minute), now) {
+		t.Errorf("expected a backend down for less than 10m not to be due")
+	}
+	if !q.due(now.Add(-10*time.Minute), now) {
+		t.Errorf("expected a backend down for 10m to be due")
+	}
+}
+
+func newQuarantineTestPool(t *testing.T, up *atomic.Bool, config *QuarantineConfig) *BaseServerPool {
+	t.Helper()
+	q, err := newQuarantine(config)
+	if err != nil {
+		t.Fatalf("failed to create quarantine: %v", err)
+	}
+	pool := &BaseServerPool{
+		healthcheckInterval: 10 * time.Millisecond,
+		healthCheck:         healthCheck{prober: switchProbe{up}, timeout: time.Second},
+		quarantine:          q,
+		log:                 log.New(io.Discard, "", 0),
+	}
+	if _, err := pool.addBackend(BackendConfig{URL: "tcp://127.0.0.1:8080", Labels: map[string]string{"zone": "a"}}); err != nil {
+		t.Fatalf("failed to add backend: %v", err)
+	}
+	t.Cleanup(func() { pool.stopHealthChecks(context.Background()) })
+	return pool
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBaseServerPool_quarantine(t *testing.T) {
+	var up atomic.Bool
+	pool := newQuarantineTestPool(t, &up, &QuarantineConfig{Enabled: true, After: "50ms", Recheck: "20ms"})
+	pool.StartHealthChecks()
+
+	waitFor(t, "the backend to be quarantined", func() bool { return pool.quarantine.Len() == 1 })
+	if n := len(pool.Backends()); n != 0 {
+		t.Errorf("expected the quarantined backend to be removed from the pool, got %d backends", n)
+	}
+
+	rec := httptest.NewRecorder()
+	pool.quarantineAPIHandler(rec, httptest.NewRequest("GET", "/api/quarantine", nil))
+	var v quarantineView
+	if err := json.NewDecoder(rec.Body).Decode(&v); err != nil {
+		t.Fatalf("failed to decode view: %v", err)
+	}
+	if len(v.Backends) != 1 || v.Backends[0].URL != "tcp://127.0.0.1:8080" || v.Backends[0].LastError != "connection refused" {
+		t.Errorf("unexpected view %+v", v)
+	}
+	if got := pool.dashboard(time.Now()).Quarantined; len(got) != 1 {
+		t.Errorf("expected the dashboard to list the quarantined backend, got %+v", got)
+	}
+
+	// Once a recheck passes the backend is added back as configured.
+	up.Store(true)
+	waitFor(t, "the backend to be restored", func() bool { return pool.quarantine.Len() == 0 && len(pool.Backends()) == 1 })
+	waitFor(t, "the restored backend to be healthy", func() bool { return pool.Backends()[0].Healthy() })
+	if b := pool.Backends()[0]; b.Labels["zone"] != "a" {
+		t.Errorf("expected the restored backend to keep its labels, got %v", b.Labels)
+	}
+
+	rec = httptest.NewRecorder()
+	pool.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{"nlb_quarantined_backends 0", "nlb_quarantine_restored_total 1"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("expected metrics to contain %q", want)
+		}
+	}
+}
+
+func TestBaseServerPool_quarantineForget(t *testing.T) {
+	var up atomic.Bool
+	pool := newQuarantineTestPool(t, &up, &QuarantineConfig{Enabled: true, After: "20ms", Recheck: "10ms", Forget: "30ms"})
+	pool.StartHealthChecks()
+
+	waitFor(t, "the backend to be quarantined", func() bool { return pool.quarantine.Len() == 1 })
+	waitFor(t, "the backend to be forgotten", func() bool { return pool.quarantine.Len() == 0 })
+	up.Store(true)
+	time.Sleep(50 * time.Millisecond)
+	if n := len(pool.Backends()); n != 0 {
+		t.Errorf("expected a forgotten backend not to be restored, got %d backends", n)
+	}
+	if got := pool.quarantine.forgotten.Load(); got != 1 {
+		t.Errorf("expected 1 forgotten backend, got %d", got)
+	}
+}
+
+func TestBaseServerPool_forgetQuarantinedAPIHandler(t *testing.T) {
+	var up atomic.Bool
+	pool := newQuarantineTestPool(t, &up, &QuarantineConfig{Enabled: true, After: "20ms"})
+	pool.StartHealthChecks()
+	waitFor(t, "the backend to be quarantined", func() bool { return pool.quarantine.Len() == 1 })
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("DELETE /api/quarantine/{backend}", pool.forgetQuarantinedAPIHandler)
+	for _, want := range []int{http.StatusNoContent, http.StatusNotFound} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("DELETE", "/api/quarantine/127.0.0.1:8080", nil))
+		if rec.Code != want {
+			t.Errorf("expected status %d, got %d", want, rec.Code)
+		}
+	}
+	if pool.quarantine.Len() != 0 {
+		t.Errorf("expected the backend to be forgotten")
+	}
+}
+
+func TestBaseServerPool_quarantineAPIHandler_disabled(t *testing.T) {
+	pool := newConsoleTestPool("", true)
+	rec := httptest.NewRecorder()
+	pool.quarantineAPIHandler(rec, httptest.NewRequest("GET", "/api/quarantine", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", rec.Code)
+	}
+}
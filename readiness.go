@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// setHealthy records the outcome of a health check for the backend and
+// updates the pool's readiness.
+func (p *BaseServerPool) setHealthy(b *Backend, healthy bool) {
+	changed := b.swapHealthy(healthy) != healthy
+	if changed {
+		p.recordTransition(b, healthy, time.Now())
+	}
+	p.mirror.followHealth(b, healthy)
+	if healthy {
+		p.updateReadiness()
+	}
+	if changed {
+		p.checkHealthFloor()
+	}
+}
+
+// HealthyBackends returns the number of backends currently passing health
+// checks, not counting static backends.
+func (p *BaseServerPool) HealthyBackends() int {
+	healthy := 0
+	for _, b := range p.Backends() {
+		if b.Healthy() && !isStaticBackend(b) {
+			healthy++
+		}
+	}
+	return healthy
+}
+
+// updateReadiness marks the pool ready once the minimum number of healthy
+// backends has been reached. Readiness is latched: it only gates start-up.
+func (p *BaseServerPool) updateReadiness() {
+	if p.ready == nil || p.HealthyBackends() < max(p.minHealthy, 1) {
+		return
+	}
+	p.readyOnce.Do(func() {
+		infof(p.log, "server pool ready: %d healthy backend(s)", p.HealthyBackends())
+		close(p.ready)
+	})
+}
+
+// healthFloor tracks whether a ready pool has dropped below its minimum
+// number of healthy backends, and which backends were healthy when it last
+// met the minimum.
+type healthFloor struct {
+	mux      sync.Mutex
+	below    bool
+	since    time.Time
+	lastGood map[*Backend]bool
+	alarms   atomic.Uint64
+	// static holds lastGood while the pool is failing static.
+	static atomic.Pointer[map[*Backend]bool]
+}
+
+// lastKnownGood reports whether the pool is failing static and b was
+// healthy when it last met its minimum.
+func (f *healthFloor) lastKnownGood(b *Backend) bool {
+	static := f.static.Load()
+	return static != nil && (*static)[b]
+}
+
+// state reports whether the pool is below its minimum and whether it is
+// failing static.
+func (f *healthFloor) state() (below, failingStatic bool) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.below, f.static.Load() != nil
+}
+
+// checkHealthFloor raises or clears the minimum healthy alarm after a
+// health transition. With fail static, a pool below its minimum keeps
+// routing to the backends that were healthy when it last met it, so that an
+// overly aggressive health check does not black-hole all traffic. The alarm
+// is only raised once the pool has been ready.
+func (p *BaseServerPool) checkHealthFloor() {
+	minHealthy := max(p.minHealthy, 1)
+	healthy := make(map[*Backend]bool)
+	for _, b := range p.Backends() {
+		if b.Healthy() && !isStaticBackend(b) {
+			healthy[b] = true
+		}
+	}
+
+	f := &p.floor
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if len(healthy) >= minHealthy {
+		f.lastGood = healthy
+		if f.below {
+			f.below = false
+			f.static.Store(nil)
+			infof(p.log, "healthy backends back to %d/%d after %s",
+				len(healthy), minHealthy, time.Since(f.since).Round(time.Millisecond))
+		}
+		return
+	}
+	if f.below || !p.Ready() {
+		return
+	}
+	f.below = true
+	f.since = time.Now()
+	f.alarms.Add(1)
+	if !p.failStatic || len(f.lastGood) == 0 {
+		warnf(p.log, "CRITICAL: only %d/%d healthy backends", len(healthy), minHealthy)
+		return
+	}
+	lastGood := f.lastGood
+	f.static.Store(&lastGood)
+	warnf(p.log, "CRITICAL: only %d/%d healthy backends, failing static to the %d last known good backend(s)",
+		len(healthy), minHealthy, len(lastGood))
+}
+
+// Ready reports whether enough backends have passed their first health check.
+func (p *BaseServerPool) Ready() bool {
+	select {
+	case <-p.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitReady blocks until the pool is ready, or returns false if shutdown is
+// closed first. It returns immediately unless the pool gates traffic on
+// readiness.
+func (p *BaseServerPool) waitReady(shutdown <-chan struct{}) bool {
+	if !p.waitForReady {
+		return true
+	}
+	select {
+	case <-p.ready:
+		return true
+	case <-shutdown:
+		return false
+	}
+}
+
+// readyHandler responds 200 once the pool is ready and 503 until then.
+func (p *BaseServerPool) readyHandler(w http.ResponseWriter, _ *http.Request) {
+	if !p.Ready() {
+		http.Error(w, fmt.Sprintf("not ready: %d/%d healthy backends", p.HealthyBackends(), max(p.minHealthy, 1)),
+			http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ready")
+}
+
+// poolStatus describes the pool for the liveness and readiness endpoints.
+type poolStatus struct {
+	Listening          bool `json:"listening"`
+	ShuttingDown       bool `json:"shutting_down"`
+	Ready              bool `json:"ready"`
+	HealthyBackends    int  `json:"healthy_backends"`
+	MinHealthyBackends int  `json:"min_healthy_backends"`
+	TotalBackends      int  `json:"total_backends"`
+	BelowMinHealthy    bool `json:"below_min_healthy"`
+	FailingStatic      bool `json:"failing_static"`
+}
+
+// status returns the current state of the pool.
+func (p *BaseServerPool) status() poolStatus {
+	below, failingStatic := p.floor.state()
+	return poolStatus{
+		Listening:          p.listening.Load(),
+		ShuttingDown:       p.shuttingDown.Load(),
+		Ready:              p.Ready(),
+		HealthyBackends:    p.HealthyBackends(),
+		MinHealthyBackends: max(p.minHealthy, 1),
+		TotalBackends:      len(p.Backends()),
+		BelowMinHealthy:    below,
+		FailingStatic:      failingStatic,
+	}
+}
+
+// alive reports whether the pool passes a liveness probe: it fails only if
+// the listener is down while the pool is not shutting down.
+func (s poolStatus) alive() bool {
+	return s.Listening || s.ShuttingDown
+}
+
+// serving reports whether the pool passes a readiness probe: it succeeds
+// while the pool is listening, not shutting down and has enough healthy
+// backends.
+func (s poolStatus) serving() bool {
+	return s.Listening && !s.ShuttingDown && s.Ready && s.HealthyBackends >= s.MinHealthyBackends
+}
+
+// healthzHandler is a liveness probe.
+func (p *BaseServerPool) healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	s := p.status()
+	writeStatus(w, s, s.alive())
+}
+
+// readyzHandler is a readiness probe.
+func (p *BaseServerPool) readyzHandler(w http.ResponseWriter, _ *http.Request) {
+	s := p.status()
+	writeStatus(w, s, s.serving())
+}
+
+// writeStatus writes the pool status as JSON with a status code reflecting ok.
+func writeStatus(w http.ResponseWriter, s poolStatus, ok bool) {
+	code := http.StatusOK
+	if !ok {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, s)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newReadinessTestPool(minHealthy int) *BaseServerPool {
+	pool := &BaseServerPool{
+		minHealthy: minHealthy,
+		ready:      make(chan struct{}),
+		log:        log.New(io.Discard, "", 0),
+	}
+	pool.AddBackend("http://localhost:8080")
+	pool.AddBackend("http://localhost:8081")
+	return pool
+}
+
+func TestBaseServerPool_Ready(t *testing.T) {
+	pool := newReadinessTestPool(2)
+
+	pool.setHealthy(pool.backends[0], true)
+	if pool.Ready() {
+		t.Errorf("expected pool not to be ready with 1/2 healthy backends")
+	}
+
+	pool.setHealthy(pool.backends[1], true)
+	if !pool.Ready() {
+		t.Errorf("expected pool to be ready with 2/2 healthy backends")
+	}
+
+	// Readiness only gates start-up.
+	pool.setHealthy(pool.backends[1], false)
+	if !pool.Ready() {
+		t.Errorf("expected pool to stay ready")
+	}
+}
+
+func Test_readyHandler(t *testing.T) {
+	pool := newReadinessTestPool(0)
+
+	rec := httptest.NewRecorder()
+	pool.readyHandler(rec, httptest.NewRequest("GET", "/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %d", rec.Code)
+	}
+
+	pool.setHealthy(pool.backends[0], true)
+	rec = httptest.NewRecorder()
+	pool.readyHandler(rec, httptest.NewRequest("GET", "/ready", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", rec.Code)
+	}
+}
+
+func TestBaseServerPool_waitReady(t *testing.T) {
+	pool := newReadinessTestPool(1)
+	pool.waitForReady = true
+
+	shutdown := make(chan struct{})
+	close(shutdown)
+	if pool.waitReady(shutdown) {
+		t.Errorf("expected waitReady to return false on shutdown")
+	}
+
+	done := make(chan bool)
+	go func() { done <- pool.waitReady(make(chan struct{})) }()
+	pool.setHealthy(pool.backends[0], true)
+
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Errorf("expected waitReady to return true once ready")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("timeout waiting for readiness")
+	}
+}
+
+func TestNewTCPServerPool_minHealthyExceedsBackends(t *testing.T) {
+	_, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:               "127.0.0.1:0",
+		Backends:           []BackendConfig{{URL: "http://localhost:8080"}},
+		MinHealthyBackends: 2,
+	})
+	if err == nil {
+		t.Errorf("expected error when min_healthy_backends exceeds backends")
+	}
+}
+
+func Test_healthzHandler(t *testing.T) {
+	pool := newReadinessTestPool(1)
+
+	rec := httptest.NewRecorder()
+	pool.healthzHandler(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 before listening, got %d", rec.Code)
+	}
+
+	pool.listening.Store(true)
+	rec = httptest.NewRecorder()
+	pool.healthzHandler(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status 200 while listening, got %d", rec.Code)
+	}
+
+	pool.listening.Store(false)
+	pool.shuttingDown.Store(true)
+	rec = httptest.NewRecorder()
+	pool.healthzHandler(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status 200 while shutting down, got %d", rec.Code)
+	}
+}
+
+func Test_readyzHandler(t *testing.T) {
+	pool := newReadinessTestPool(1)
+	pool.listening.Store(true)
+
+	rec := httptest.NewRecorder()
+	pool.readyzHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 without healthy backends, got %d", rec.Code)
+	}
+
+	pool.setHealthy(pool.backends[0], true)
+	rec = httptest.NewRecorder()
+	pool.readyzHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", rec.Code)
+	}
+
+	var status poolStatus
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatalf("failed to decode status: %v", err)
+	}
+	if status.HealthyBackends != 1 || status.TotalBackends != 2 || !status.Listening {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	pool.shuttingDown.Store(true)
+	rec = httptest.NewRecorder()
+	pool.readyzHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 while shutting down, got %d", rec.Code)
+	}
+}
+
+func TestBaseServerPool_checkHealthFloor(t *testing.T) {
+	for _, failStatic := range []bool{false, true} {
+		pool := newReadinessTestPool(2)
+		pool.failStatic = failStatic
+
+		pool.setHealthy(pool.backends[0], true)
+		pool.setHealthy(pool.backends[0], false)
+		if below, _ := pool.floor.state(); below {
+			t.Errorf("expected no alarm before the pool is ready")
+		}
+
+		pool.setHealthy(pool.backends[0], true)
+		pool.setHealthy(pool.backends[1], true)
+		pool.setHealthy(pool.backends[0], false)
+		pool.setHealthy(pool.backends[1], false)
+		s := pool.status()
+		if !s.BelowMinHealthy || s.FailingStatic != failStatic || pool.floor.alarms.Load() != 1 {
+			t.Errorf("fail static %t: unexpected status %+v after %d alarms", failStatic, s, pool.floor.alarms.Load())
+		}
+		if backend := pool.Next(nil); (backend != nil) != failStatic {
+			t.Errorf("fail static %t: unexpected backend %v with no healthy backends", failStatic, backend)
+		}
+
+		pool.setHealthy(pool.backends[0], true)
+		pool.setHealthy(pool.backends[1], true)
+		if s := pool.status(); s.BelowMinHealthy || s.FailingStatic {
+			t.Errorf("fail static %t: expected the alarm to clear, got %+v", failStatic, s)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const defaultResolverInterval = 30 * time.Second
+
+// fileSettleDelay is how long a file resolver waits after its file changes
+// for further changes before reading it, so that a file being written is not
+// read half way.
+const fileSettleDelay = 100 * time.Millisecond
+
+// BackendSpec is a backend discovered by a resolver.
+type BackendSpec struct {
+	URL    string            `json:"url"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Resolver discovers the members of a backend group. Resolve returns the
+// complete set of backends each time it is called; if it fails, the group
+// keeps its current members.
+type Resolver interface {
+	Resolve(ctx context.Context) ([]BackendSpec, error)
+}
+
+// Watcher is implemented by resolvers that can tell when their backends may
+// have changed, so that groups re-resolve right away rather than at the next
+// interval. The channel is closed when ctx is cancelled. An error means
+// changes cannot be watched, leaving the group to the interval.
+type Watcher interface {
+	Watch(ctx context.Context) (<-chan struct{}, error)
+}
+
+// resolverTypes builds the resolvers a backend group can select by type.
+// A discovery source is added by registering its constructor here; static
+// resolvers are resolved once, the others every interval.
+var resolverTypes = map[string]func(config *ResolverConfig) (Resolver, error){
+	"static": newStaticResolver,
+	"dns":    newDNSResolver,
+	"file":   newFileResolver,
+}
+
+// newResolver builds the resolver selected by config and returns how often
+// it is re-resolved, or zero if its backends never change.
+func newResolver(config *ResolverConfig) (Resolver, time.Duration, error) {
+	build, ok := resolverTypes[config.Type]
+	if !ok {
+		return nil, 0, fmt.Errorf("unsupported resolver type %q", config.Type)
+	}
+	r, err := build(config)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s resolver: %w", config.Type, err)
+	}
+	if config.Type == "static" {
+		return r, 0, nil
+	}
+	interval := defaultResolverInterval
+	if config.Interval != "" {
+		if interval, err = time.ParseDuration(config.Interval); err != nil {
+			return nil, 0, fmt.Errorf("invalid resolver interval: %w", err)
+		}
+		if interval <= 0 {
+			return nil, 0, fmt.Errorf("resolver interval must be positive")
+		}
+	}
+	return r, interval, nil
+}
+
+// backendSpecs converts backend configs to specs.
+func backendSpecs(backends []BackendConfig) []BackendSpec {
+	specs := make([]BackendSpec, 0, len(backends))
+	for _, bc := range backends {
+		specs = append(specs, BackendSpec{URL: bc.URL, Labels: bc.Labels})
+	}
+	return specs
+}
+
+// staticResolver returns a fixed list of backends.
+type staticResolver struct {
+	backends []BackendSpec
+}
+
+func newStaticResolver(config *ResolverConfig) (Resolver, error) {
+	return &staticResolver{backends: backendSpecs(config.Backends)}, nil
+}
+
+func (r *staticResolver) Resolve(context.Context) ([]BackendSpec, error) {
+	return r.backends, nil
+}
+
+// dnsResolver returns the addresses a name resolves to on a port or, if the
+// port is unset, the targets of the name's SRV records.
+type dnsResolver struct {
+	name   string
+	port   int
+	lookup *net.Resolver
+}
+
+func newDNSResolver(config *ResolverConfig) (Resolver, error) {
+	if config.Name == "" {
+		return nil, errors.New("name is required")
+	}
+	if config.Port < 0 || config.Port > 65535 {
+		return nil, fmt.Errorf("invalid port %d", config.Port)
+	}
+	return &dnsResolver{name: config.Name, port: config.Port, lookup: net.DefaultResolver}, nil
+}
+
+func (r *dnsResolver) Resolve(ctx context.Context) ([]BackendSpec, error) {
+	if r.port == 0 {
+		_, records, err := r.lookup.LookupSRV(ctx, "", "", r.name)
+		if err != nil {
+			return nil, err
+		}
+		specs := make([]BackendSpec, 0, len(records))
+		for _, srv := range records {
+			host := strings.TrimSuffix(srv.Target, ".")
+			specs = append(specs, BackendSpec{URL: net.JoinHostPort(host, strconv.Itoa(int(srv.Port)))})
+		}
+		return specs, nil
+	}
+	addrs, err := r.lookup.LookupIPAddr(ctx, r.name)
+	if err != nil {
+		return nil, err
+	}
+	specs := make([]BackendSpec, 0, len(addrs))
+	for _, addr := range addrs {
+		specs = append(specs, BackendSpec{URL: net.JoinHostPort(addr.IP.String(), strconv.Itoa(r.port))})
+	}
+	return specs, nil
+}
+
+// fileResolver reads the backends listed in a file, either as a JSON list in
+// the format of the config's backends or as text with one backend per line,
+// and watches the file for changes.
+type fileResolver struct {
+	path string
+	// settle is how long the file must stay unchanged after a change
+	// before it is signalled.
+	settle time.Duration
+}
+
+func newFileResolver(config *ResolverConfig) (Resolver, error) {
+	if config.Path == "" {
+		return nil, errors.New("path is required")
+	}
+	return &fileResolver{path: config.Path, settle: fileSettleDelay}, nil
+}
+
+func (r *fileResolver) Resolve(context.Context) ([]BackendSpec, error) {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var backends []BackendConfig
+		if err := json.Unmarshal(data, &backends); err != nil {
+			return nil, fmt.Errorf("invalid backends file %s: %w", r.path, err)
+		}
+		return backendSpecs(backends), nil
+	}
+	specs, err := parseBackendList(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid backends file %s: %w", r.path, err)
+	}
+	return specs, nil
+}
+
+// parseBackendList parses a hosts file style list of backends: one address
+// per line, optionally followed by key=value labels, with blank lines and
+// text after a # ignored.
+//
+//	# web fleet
+//	10.0.0.1:8080 zone=a
+//	10.0.0.2:8080 zone=b weight=2
+func parseBackendList(data string) ([]BackendSpec, error) {
+	specs := []BackendSpec{}
+	for i, line := range strings.Split(data, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		spec := BackendSpec{URL: fields[0]}
+		for _, field := range fields[1:] {
+			k, v, ok := strings.Cut(field, "=")
+			if !ok || k == "" {
+				return nil, fmt.Errorf("line %d: invalid label %q", i+1, field)
+			}
+			if spec.Labels == nil {
+				spec.Labels = make(map[string]string)
+			}
+			spec.Labels[k] = v
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// Watch signals when the file is written, created, renamed or removed, once
+// it has stayed unchanged for the settle delay. The directory is watched
+// rather than the file, so that a file replaced by renaming another over it,
+// as config management tools do, is still followed.
+func (r *fileResolver) Watch(ctx context.Context) (<-chan struct{}, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("could not watch %s: %w", r.path, err)
+	}
+	if err := watcher.Add(filepath.Dir(r.path)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("could not watch %s: %w", r.path, err)
+	}
+	name := filepath.Clean(r.path)
+	changes := make(chan struct{})
+	go func() {
+		defer close(changes)
+		defer watcher.Close()
+		var settled <-chan time.Time
+		for {
+			select {
+			case e, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(e.Name) == name && e.Op != fsnotify.Chmod {
+					settled = time.After(r.settle)
+				}
+			case _, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				// Events may have been lost, so the file is read again.
+				settled = time.After(r.settle)
+			case <-settled:
+				settled = nil
+				select {
+				case changes <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return changes, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_newResolver(t *testing.T) {
+	r, refresh, err := newResolver(&ResolverConfig{Type: "static", Backends: []BackendConfig{{URL: "10.0.0.1:8000"}}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if refresh != 0 {
+		t.Errorf("expected a static resolver never to be re-resolved, got %s", refresh)
+	}
+	specs, _ := r.Resolve(t.Context())
+	if len(specs) != 1 || specs[0].URL != "10.0.0.1:8000" {
+		t.Errorf("unexpected backends %+v", specs)
+	}
+	if _, refresh, _ := newResolver(&ResolverConfig{Type: "dns", Name: "backends.internal"}); refresh != defaultResolverInterval {
+		t.Errorf("expected the default interval, got %s", refresh)
+	}
+	for _, config := range []*ResolverConfig{
+		{Type: "consul"},
+		{Type: "dns"},
+		{Type: "dns", Name: "backends.internal", Port: 70000},
+		{Type: "file"},
+		{Type: "file", Path: "backends.json", Interval: "0s"},
+		{Type: "file", Path: "backends.json", Interval: "often"},
+	} {
+		if _, _, err := newResolver(config); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
+
+func TestDNSResolver_Resolve(t *testing.T) {
+	r, _ := newDNSResolver(&ResolverConfig{Name: "localhost", Port: 8080})
+	specs, err := r.Resolve(t.Context())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !slices.ContainsFunc(specs, func(s BackendSpec) bool { return s.URL == "127.0.0.1:8080" || s.URL == "[::1]:8080" }) {
+		t.Errorf("expected localhost on port 8080, got %+v", specs)
+	}
+}
+
+func writeBackendsFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatalf("failed to write backends file: %v", err)
+	}
+}
+
+func TestFileResolver_Resolve(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backends.json")
+	r, _ := newFileResolver(&ResolverConfig{Path: path})
+	if _, err := r.Resolve(t.Context()); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+	writeBackendsFile(t, path, `[{"url": "10.0.0.1:8000", "labels": {"zone": "a"}}]`)
+	specs, err := r.Resolve(t.Context())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(specs) != 1 || specs[0].URL != "10.0.0.1:8000" || specs[0].Labels["zone"] != "a" {
+		t.Errorf("unexpected backends %+v", specs)
+	}
+	writeBackendsFile(t, path, `{"url": "10.0.0.1:8000"}`)
+	if _, err := r.Resolve(t.Context()); err == nil {
+		t.Errorf("expected an error for an invalid file")
+	}
+}
+
+func Test_parseBackendList(t *testing.T) {
+	specs, err := parseBackendList("# web fleet\n\n10.0.0.1:8080 zone=a\r\n  10.0.0.2:8080 zone=b tier=  # spare\n")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	want := []BackendSpec{
+		{URL: "10.0.0.1:8080", Labels: map[string]string{"zone": "a"}},
+		{URL: "10.0.0.2:8080", Labels: map[string]string{"zone": "b", "tier": ""}},
+	}
+	if !reflect.DeepEqual(specs, want) {
+		t.Errorf("expected %+v, got %+v", want, specs)
+	}
+	if _, err := parseBackendList("10.0.0.1:8080\n10.0.0.2:8080 zone"); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected an error for line 2, got %v", err)
+	}
+	if specs, _ := parseBackendList("# empty\n"); specs == nil || len(specs) != 0 {
+		t.Errorf("expected an empty list, got %+v", specs)
+	}
+}
+
+func TestFileResolver_Watch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backends.txt")
+	writeBackendsFile(t, path, "10.0.0.1:8080\n")
+	r := &fileResolver{path: path, settle: 5 * time.Millisecond}
+	ctx, cancel := context.WithCancel(t.Context())
+	changes, err := r.Watch(ctx)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	select {
+	case <-changes:
+		t.Fatalf("expected no change before the file is written")
+	case <-time.After(30 * time.Millisecond):
+	}
+	writeBackendsFile(t, path, "10.0.0.1:8080\n10.0.0.2:8080\n")
+	select {
+	case <-changes:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected a change after the file was written")
+	}
+	specs, err := r.Resolve(ctx)
+	if err != nil || len(specs) != 2 {
+		t.Errorf("expected the text file to list 2 backends, got %+v, %v", specs, err)
+	}
+
+	// A rewrite of the same size, and a file renamed over the watched one,
+	// are changes too.
+	writeBackendsFile(t, path, "10.0.0.3:8080\n10.0.0.4:8080\n")
+	select {
+	case <-changes:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected a change after the file was rewritten")
+	}
+	replacement := filepath.Join(filepath.Dir(path), "backends.tmp")
+	writeBackendsFile(t, replacement, "10.0.0.5:8080\n")
+	if err := os.Rename(replacement, path); err != nil {
+		t.Fatalf("failed to rename: %v", err)
+	}
+	select {
+	case <-changes:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected a change after the file was replaced")
+	}
+	if specs, _ := r.Resolve(ctx); len(specs) != 1 || specs[0].URL != "10.0.0.5:8080" {
+		t.Errorf("expected the replaced file to be read, got %+v", specs)
+	}
+
+	cancel()
+	if _, ok := <-changes; ok {
+		t.Errorf("expected the channel to be closed")
+	}
+
+	missing := &fileResolver{path: filepath.Join(t.TempDir(), "missing", "backends.txt")}
+	if _, err := missing.Watch(t.Context()); err == nil {
+		t.Errorf("expected an error watching a missing directory")
+	}
+}
+
+func TestBackendGroup_resolve(t *testing.T) {
+	l := log.New(io.Discard, "", 0)
+	path := filepath.Join(t.TempDir(), "backends.json")
+	writeBackendsFile(t, path, `[{"url": "tcp://127.0.0.1:1"}, {"url": "tcp://127.0.0.1:2"}]`)
+
+	groups := newBackendGroups(l)
+	pool, err := NewTCPServerPool(l, &Config{
+		Addr:                "127.0.0.1:0",
+		HealthcheckInterval: "1h",
+		MinHealthyBackends:  3,
+		BackendGroup:        "fleet",
+		BackendGroups: map[string]*BackendGroupConfig{
+			"fleet": {Resolver: &ResolverConfig{Type: "file", Path: path, Interval: "10ms"}, HealthcheckInterval: "1h"},
+		},
+		groups: groups,
+	})
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	t.Cleanup(func() { pool.Shutdown(context.Background()) })
+	group := groups.groups["tcp/fleet"]
+	var probes atomic.Int32
+	group.check = healthCheck{prober: countingProbe{&probes}, timeout: time.Second}
+	if n := len(pool.Backends()); n != 2 {
+		t.Fatalf("expected the resolved members in the pool, got %d backends", n)
+	}
+
+	pool.StartHealthChecks()
+	writeBackendsFile(t, path, `[{"url": "tcp://127.0.0.1:2"}, {"url": "tcp://127.0.0.1:3"}, {"url": "tcp://127.0.0.1:4"}]`)
+	hosts := func() []string {
+		var hosts []string
+		for _, b := range pool.Backends() {
+			hosts = append(hosts, b.URL.Host)
+		}
+		slices.Sort(hosts)
+		return hosts
+	}
+	waitFor(t, "the pool to follow the resolver", func() bool {
+		return slices.Equal(hosts(), []string{"127.0.0.1:2", "127.0.0.1:3", "127.0.0.1:4"})
+	})
+	waitFor(t, "the new members to be healthy", func() bool { return pool.HealthyBackends() == 3 })
+
+	// The group keeps its members while the file is unreadable.
+	writeBackendsFile(t, path, `not json`)
+	time.Sleep(50 * time.Millisecond)
+	if n := len(pool.Backends()); n != 3 {
+		t.Errorf("expected the members to be kept, got %d backends", n)
+	}
+
+	pool.stopHealthChecks(t.Context())
+	group.mux.Lock()
+	defer group.mux.Unlock()
+	if group.cancel != nil {
+		t.Errorf("expected resolving to stop with the last pool")
+	}
+}
+
+func TestBackendGroup_watch(t *testing.T) {
+	l := log.New(io.Discard, "", 0)
+	path := filepath.Join(t.TempDir(), "backends.txt")
+	writeBackendsFile(t, path, "tcp://127.0.0.1:1\n")
+
+	groups := newBackendGroups(l)
+	pool, err := NewTCPServerPool(l, &Config{
+		Addr:                "127.0.0.1:0",
+		HealthcheckInterval: "1h",
+		BackendGroup:        "fleet",
+		BackendGroups: map[string]*BackendGroupConfig{
+			"fleet": {Resolver: &ResolverConfig{Type: "file", Path: path, Interval: "1h"}, HealthcheckInterval: "1h"},
+		},
+		groups: groups,
+	})
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	t.Cleanup(func() { pool.Shutdown(context.Background()) })
+	group := groups.groups["tcp/fleet"]
+	var probes atomic.Int32
+	group.check = healthCheck{prober: countingProbe{&probes}, timeout: time.Second}
+	group.source.(*fileResolver).settle = 5 * time.Millisecond
+
+	pool.StartHealthChecks()
+	// Changes are applied on write rather than at the next interval.
+	writeBackendsFile(t, path, "tcp://127.0.0.1:1\ntcp://127.0.0.1:2 zone=b\n")
+	waitFor(t, "the new member to be added", func() bool { return len(pool.Backends()) == 2 })
+	if b := pool.findBackend("127.0.0.1:2"); b == nil || b.Labels["zone"] != "b" {
+		t.Errorf("expected the new member with its labels, got %+v", b)
+	}
+}
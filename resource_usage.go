@@ -0,0 +1,39 @@
+package main
+
+import "sync/atomic"
+
+// copyBufferSize is the size of the buffer io.Copy allocates for each
+// direction of a proxied TCP connection.
+const copyBufferSize = 32 * 1024
+
+// resourceUsage approximates the goroutines and buffer memory held by a
+// pool, so that the resources of a process fronting several services can
+// be attributed to each of them. Only what grows with traffic and backends
+// is counted: the accept and read loops, the goroutines serving
+// connections, datagrams and UDP flows with their buffers, and health
+// checks.
+type resourceUsage struct {
+	goroutines atomic.Int64
+	buffers    atomic.Int64
+}
+
+// add adds goroutines and bytes of buffers to the usage, removing them when
+// negative.
+func (u *resourceUsage) add(goroutines, bytes int) {
+	if goroutines != 0 {
+		u.goroutines.Add(int64(goroutines))
+	}
+	if bytes != 0 {
+		u.buffers.Add(int64(bytes))
+	}
+}
+
+// Goroutines returns the number of goroutines held by the pool.
+func (u *resourceUsage) Goroutines() int64 {
+	return u.goroutines.Load()
+}
+
+// BufferBytes returns the approximate memory held by the pool's buffers.
+func (u *resourceUsage) BufferBytes() int64 {
+	return u.buffers.Load()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResourceUsage_tcp(t *testing.T) {
+	backend := startTCPEcho(t)
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:     "127.0.0.1:0",
+		Backends: []BackendConfig{{URL: backend}},
+	})
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	pool.backends[0].SetHealthy(true)
+	pool.Start()
+	defer pool.Shutdown(t.Context())
+	// Only the accept loop runs until a client connects.
+	waitFor(t, "the accept loop to be counted", func() bool { return pool.resources.Goroutines() == 1 })
+
+	conn, err := net.Dial("tcp", pool.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect to load balancer: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	io.ReadFull(conn, make([]byte, 4))
+	waitFor(t, "the connection to be counted", func() bool {
+		return pool.resources.Goroutines() == 3
+	})
+	if got := pool.resources.BufferBytes(); got != 2*copyBufferSize {
+		t.Errorf("expected %d bytes of copy buffers, got %d", 2*copyBufferSize, got)
+	}
+
+	rec := httptest.NewRecorder()
+	pool.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if want := "nlb_listener_buffer_bytes 65536\n"; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("expected metrics to contain %q", want)
+	}
+
+	conn.Close()
+	waitFor(t, "the connection to be released", func() bool {
+		return pool.resources.Goroutines() == 1 && pool.resources.BufferBytes() == 0
+	})
+}
+
+func TestHealthChecker_resources(t *testing.T) {
+	var u resourceUsage
+	h := newHealthChecker(&u)
+	started := make(chan struct{})
+	h.Go(func(ctx context.Context) {
+		close(started)
+		<-ctx.Done()
+	})
+	<-started
+	if got := u.Goroutines(); got != 1 {
+		t.Errorf("expected the check loop to be counted, got %d goroutines", got)
+	}
+	if err := h.Stop(t.Context()); err != nil {
+		t.Fatalf("failed to stop: %v", err)
+	}
+	if got := u.Goroutines(); got != 0 {
+		t.Errorf("expected no goroutines after stopping, got %d", got)
+	}
+}
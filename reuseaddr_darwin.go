@@ -0,0 +1,7 @@
+package main
+
+import "syscall"
+
+// BSD-derived kernels additionally require SO_REUSEPORT for duplicate UDP
+// bindings.
+var reuseAddrOptions = []int{syscall.SO_REUSEADDR, syscall.SO_REUSEPORT}
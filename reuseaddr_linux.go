@@ -0,0 +1,7 @@
+package main
+
+import "syscall"
+
+// On Linux SO_REUSEADDR alone lets UDP sockets owned by the same user share
+// an address.
+var reuseAddrOptions = []int{syscall.SO_REUSEADDR}
@@ -0,0 +1,23 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+const reuseAddrSupported = false
+
+var errReuseAddrUnsupported = errors.New("sharing a UDP address is not supported on this platform")
+
+// reuseAddrControl is not supported on this platform.
+func reuseAddrControl(network, address string, c syscall.RawConn) error {
+	return errReuseAddrUnsupported
+}
+
+// dialReuseAddr is not supported on this platform.
+func dialReuseAddr(local net.Addr, remote *net.UDPAddr, device string) (*net.UDPConn, error) {
+	return nil, errReuseAddrUnsupported
+}
@@ -0,0 +1,41 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+const reuseAddrSupported = true
+
+// reuseAddrControl sets the reuseAddrOptions socket options so several UDP
+// sockets can share the listener address. The kernel delivers datagrams to
+// the socket connected to the sender in preference to the unconnected
+// listener.
+func reuseAddrControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		for _, opt := range reuseAddrOptions {
+			if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, opt, 1); sockErr != nil {
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// dialReuseAddr opens a UDP socket bound to local, and to the listener's
+// device if any, sharing it with the listener, and connected to remote so
+// that replies leave from the port the client originally targeted.
+func dialReuseAddr(local net.Addr, remote *net.UDPAddr, device string) (*net.UDPConn, error) {
+	d := net.Dialer{LocalAddr: local, Control: chainControl(bindDevice(device), reuseAddrControl)}
+	conn, err := d.Dial("udp", remote.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
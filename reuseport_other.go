@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+const reusePortSupported = false
+
+// reusePortControl is not supported on this platform, where the kernel does
+// not spread datagrams across sockets sharing an address.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT load balancing is not supported on this platform")
+}
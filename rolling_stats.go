@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rollingBucket is the resolution of rolling counters, and rollingBuckets
+// the number of buckets needed to cover the longest window.
+const (
+	rollingBucket  = 10 * time.Second
+	rollingBuckets = int64(15 * time.Minute / rollingBucket)
+)
+
+// rollingWindows are the windows rolling counters are aggregated over.
+var rollingWindows = [...]time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// rollingCounter counts events since statistics were last reset and over
+// the last 1, 5 and 15 minutes, so that dashboard numbers can be read
+// without an external time series store. Unlike the Prometheus counters it
+// can be reset. The zero value is ready to use.
+type rollingCounter struct {
+	mux     sync.Mutex
+	total   uint64
+	counts  [rollingBuckets]uint64
+	buckets [rollingBuckets]int64
+}
+
+// Add records an event at now.
+func (c *rollingCounter) Add(now time.Time) {
+	c.AddN(now, 1)
+}
+
+// AddN records n events at now.
+func (c *rollingCounter) AddN(now time.Time, n uint64) {
+	bucket := now.UnixNano() / int64(rollingBucket)
+	i := bucket % rollingBuckets
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.buckets[i] != bucket {
+		c.buckets[i] = bucket
+		c.counts[i] = 0
+	}
+	c.counts[i] += n
+	c.total += n
+}
+
+// Sum returns the number of events in the window ending at now, which must
+// be at most 15 minutes. The window is rounded to whole buckets, including
+// the current, partial one.
+func (c *rollingCounter) Sum(now time.Time, window time.Duration) uint64 {
+	bucket := now.UnixNano() / int64(rollingBucket)
+	n := int64(window / rollingBucket)
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	var sum uint64
+	for i := range c.counts {
+		if age := bucket - c.buckets[i]; age >= 0 && age < n {
+			sum += c.counts[i]
+		}
+	}
+	return sum
+}
+
+// reset forgets every event recorded.
+func (c *rollingCounter) reset() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.total = 0
+	c.counts = [rollingBuckets]uint64{}
+	c.buckets = [rollingBuckets]int64{}
+}
+
+// rollingView is a rolling counter in the admin API.
+type rollingView struct {
+	Total   uint64 `json:"total"`
+	Last1m  uint64 `json:"1m"`
+	Last5m  uint64 `json:"5m"`
+	Last15m uint64 `json:"15m"`
+}
+
+// add returns the sum of two views.
+func (v rollingView) add(o rollingView) rollingView {
+	return rollingView{v.Total + o.Total, v.Last1m + o.Last1m, v.Last5m + o.Last5m, v.Last15m + o.Last15m}
+}
+
+func (c *rollingCounter) view(now time.Time) rollingView {
+	v := rollingView{
+		Last1m:  c.Sum(now, rollingWindows[0]),
+		Last5m:  c.Sum(now, rollingWindows[1]),
+		Last15m: c.Sum(now, rollingWindows[2]),
+	}
+	c.mux.Lock()
+	v.Total = c.total
+	c.mux.Unlock()
+	return v
+}
+
+// listenerRollingView aggregates the connections a listener handled.
+type listenerRollingView struct {
+	Accepted rollingView `json:"accepted"`
+	Rejected rollingView `json:"rejected"`
+}
+
+// backendRollingView aggregates the traffic a backend handled.
+type backendRollingView struct {
+	ID            string      `json:"id"`
+	URL           string      `json:"url"`
+	Connections   rollingView `json:"connections"`
+	Failures      rollingView `json:"failures"`
+	BytesSent     rollingView `json:"bytes_sent"`
+	BytesReceived rollingView `json:"bytes_received"`
+}
+
+// statsView is returned by /api/stats. Totals count from Since, when the
+// statistics were last reset or the listener started.
+type statsView struct {
+	Time     time.Time            `json:"time"`
+	Since    time.Time            `json:"since"`
+	Listener listenerRollingView  `json:"listener"`
+	Backends []backendRollingView `json:"backends"`
+}
+
+// statsSince returns when the pool's statistics were last reset, or when
+// it started if they never were.
+func (p *BaseServerPool) statsSince() time.Time {
+	if at := p.stats.resetAt.Load(); at != nil {
+		return *at
+	}
+	return p.startTime
+}
+
+func (p *BaseServerPool) rollingStats(now time.Time) statsView {
+	v := statsView{
+		Time:  now,
+		Since: p.statsSince(),
+		Listener: listenerRollingView{
+			Accepted: p.stats.acceptedRecent.view(now),
+			Rejected: p.stats.rejectedRecent.view(now),
+		},
+		Backends: []backendRollingView{},
+	}
+	for _, b := range p.Backends() {
+		v.Backends = append(v.Backends, backendRollingView{
+			ID:            b.ID,
+			URL:           b.URL.String(),
+			Connections:   b.connsRecent.view(now),
+			Failures:      b.failuresRecent.view(now),
+			BytesSent:     b.bytesSent.recent.view(now),
+			BytesReceived: b.bytesReceived.recent.view(now),
+		})
+	}
+	return v
+}
+
+// resetStats zeroes the rolling counters of the listener and its backends.
+// Prometheus counters are left alone, since scrapers expect them never to
+// go down.
+func (p *BaseServerPool) resetStats(now time.Time) {
+	p.stats.acceptedRecent.reset()
+	p.stats.rejectedRecent.reset()
+	for _, b := range p.Backends() {
+		b.connsRecent.reset()
+		b.failuresRecent.reset()
+		b.bytesSent.recent.reset()
+		b.bytesReceived.recent.reset()
+	}
+	p.stats.resetAt.Store(&now)
+}
+
+// statsAPIHandler returns the listener and backend counters since the last
+// reset and over the last 1, 5 and 15 minutes.
+func (p *BaseServerPool) statsAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, p.rollingStats(time.Now()))
+}
+
+// resetStatsAPIHandler resets the statistics returned by /api/stats and
+// returns them.
+func (p *BaseServerPool) resetStatsAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	now := time.Now()
+	p.resetStats(now)
+	infof(p.log, "statistics reset")
+	writeJSON(w, http.StatusOK, p.rollingStats(now))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRollingCounter(t *testing.T) {
+	var c rollingCounter
+	now := time.Unix(10000, 0)
+	c.AddN(now.Add(-20*time.Minute), 1000)
+	c.AddN(now.Add(-10*time.Minute), 100)
+	c.AddN(now.Add(-3*time.Minute), 10)
+	c.Add(now.Add(-5 * time.Second))
+	c.Add(now)
+
+	want := rollingView{Total: 1112, Last1m: 2, Last5m: 12, Last15m: 112}
+	if v := c.view(now); v != want {
+		t.Errorf("expected %+v, got %+v", want, v)
+	}
+	// Buckets reused for newer events drop the old counts.
+	c.Add(now.Add(15 * time.Minute))
+	if got := c.Sum(now.Add(15*time.Minute), 15*time.Minute); got != 1 {
+		t.Errorf("expected 1 event in the last 15m, got %d", got)
+	}
+
+	c.reset()
+	if v := c.view(now); v != (rollingView{}) {
+		t.Errorf("expected a reset counter to be empty, got %+v", v)
+	}
+}
+
+func TestBaseServerPool_resetStatsAPIHandler(t *testing.T) {
+	pool := newConsoleTestPool("", true)
+	pool.startTime = time.Now().Add(-time.Hour)
+	b := pool.Backends()[0]
+	pool.stats.accept()()
+	pool.stats.reject()
+	b.acquire()()
+	b.failed()
+	b.bytesSent.Add(100)
+	b.bytesReceived.Add(200)
+
+	rec := httptest.NewRecorder()
+	pool.statsAPIHandler(rec, httptest.NewRequest("GET", "/api/stats", nil))
+	var v statsView
+	if err := json.NewDecoder(rec.Body).Decode(&v); err != nil {
+		t.Fatalf("failed to decode stats: %v", err)
+	}
+	if !v.Since.Equal(pool.startTime) {
+		t.Errorf("expected stats since the start time, got %s", v.Since)
+	}
+	if v.Listener.Accepted.Last1m != 1 || v.Listener.Rejected.Total != 1 {
+		t.Errorf("unexpected listener stats %+v", v.Listener)
+	}
+	if len(v.Backends) != 1 {
+		t.Fatalf("expected 1 backend, got %d", len(v.Backends))
+	}
+	if got := v.Backends[0]; got.Connections.Last5m != 1 || got.Failures.Last15m != 1 || got.BytesSent.Total != 100 || got.BytesReceived.Last1m != 200 {
+		t.Errorf("unexpected backend stats %+v", got)
+	}
+
+	rec = httptest.NewRecorder()
+	pool.resetStatsAPIHandler(rec, httptest.NewRequest("POST", "/api/stats/reset", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	v = statsView{}
+	if err := json.NewDecoder(rec.Body).Decode(&v); err != nil {
+		t.Fatalf("failed to decode stats: %v", err)
+	}
+	if !v.Since.After(pool.startTime) || v.Listener.Accepted.Total != 0 || v.Backends[0].BytesSent.Total != 0 {
+		t.Errorf("expected statistics to be reset, got %+v", v)
+	}
+
+	// The Prometheus counters keep counting.
+	rec = httptest.NewRecorder()
+	pool.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "nlb_listener_accepted_connections_total 1") {
+		t.Errorf("expected metrics not to be reset")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+)
+
+// sdLabelPrefix prefixes the labels of service discovery targets. Prometheus
+// drops labels starting with __meta_ after relabeling.
+const sdLabelPrefix = "__meta_nlb_"
+
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// sdTargetGroup is a target group in the Prometheus HTTP service discovery
+// format.
+type sdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// inService reports whether the backend is healthy, not draining and in
+// the active blue/green group, ignoring transient limits such as the
+// connection limit.
+func (p *BaseServerPool) inService(b *Backend) bool {
+	return b.Healthy() && !b.Draining() && p.blueGreen.routes(b)
+}
+
+// sdTargets returns a target group for each backend in service. Debug and
+// static backends are skipped since they have no address.
+func (p *BaseServerPool) sdTargets() []sdTargetGroup {
+	groups := []sdTargetGroup{}
+	for _, b := range p.Backends() {
+		if isDebugBackend(b) || isStaticBackend(b) || !p.inService(b) {
+			continue
+		}
+		labels := map[string]string{
+			sdLabelPrefix + "backend_id":  b.ID,
+			sdLabelPrefix + "backend_url": b.URL.String(),
+			sdLabelPrefix + "scheme":      b.URL.Scheme,
+		}
+		if b.group != "" {
+			labels[sdLabelPrefix+"group"] = b.group
+		}
+		if b.sharedGroup != "" {
+			labels[sdLabelPrefix+"backend_group"] = b.sharedGroup
+		}
+		for k, v := range b.Labels {
+			labels[sdLabelPrefix+"label_"+invalidLabelChars.ReplaceAllString(k, "_")] = v
+		}
+		groups = append(groups, sdTargetGroup{Targets: []string{b.URL.Host}, Labels: labels})
+	}
+	return groups
+}
+
+// sdTargetsAPIHandler returns the backends in service in the Prometheus
+// http_sd format.
+func (p *BaseServerPool) sdTargetsAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, p.sdTargets())
+}
+
+// sdTargetsAPIHandler returns the backends in service of every listener in
+// the Prometheus http_sd format, labeled with their listener's name.
+func (c *console) sdTargetsAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	groups := []sdTargetGroup{}
+	for _, np := range c.snapshot() {
+		for _, g := range np.pool.sdTargets() {
+			g.Labels[sdLabelPrefix+"listener"] = np.name
+			groups = append(groups, g)
+		}
+	}
+	writeJSON(w, http.StatusOK, groups)
+}
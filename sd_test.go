@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBaseServerPool_sdTargets(t *testing.T) {
+	pool := newConsoleTestPool("", true)
+	labeled, _ := pool.addBackend(BackendConfig{URL: "tcp://10.0.0.1:9000", Labels: map[string]string{"zone": "a", "rack-id": "r1"}})
+	pool.setHealthy(labeled, true)
+	draining, _ := pool.addBackend(BackendConfig{URL: "tcp://10.0.0.2:9000"})
+	pool.setHealthy(draining, true)
+	draining.startDrain()
+	pool.addBackend(BackendConfig{URL: "tcp://10.0.0.3:9000"})
+	debug, _ := pool.addBackend(BackendConfig{URL: "debug://echo"})
+	pool.setHealthy(debug, true)
+
+	groups := pool.sdTargets()
+	if len(groups) != 2 {
+		t.Fatalf("expected 2 target groups, got %+v", groups)
+	}
+	if groups[0].Targets[0] != "localhost:8080" {
+		t.Errorf("expected the first target to be localhost:8080, got %v", groups[0].Targets)
+	}
+	g := groups[1]
+	if len(g.Targets) != 1 || g.Targets[0] != "10.0.0.1:9000" {
+		t.Errorf("expected target 10.0.0.1:9000, got %v", g.Targets)
+	}
+	for k, want := range map[string]string{
+		"__meta_nlb_backend_id":    labeled.ID,
+		"__meta_nlb_scheme":        "tcp",
+		"__meta_nlb_label_zone":    "a",
+		"__meta_nlb_label_rack_id": "r1",
+		"__meta_nlb_backend_url":   "tcp://10.0.0.1:9000",
+	} {
+		if got := g.Labels[k]; got != want {
+			t.Errorf("expected label %s to be %q, got %q", k, want, got)
+		}
+	}
+}
+
+func TestConsole_sdTargetsAPIHandler(t *testing.T) {
+	a, b := newConsoleTestPool("a", true), newConsoleTestPool("b", false)
+	c := newConsole([]namedPool{{name: "a", pool: consoleTestPool{a}}, {name: "b", pool: consoleTestPool{b}}}, tmpl, nil)
+	srv := httptest.NewServer(c.handler(""))
+	defer srv.Close()
+
+	for path, want := range map[string]int{"/api/sd/targets": 1, "/listeners/a/api/sd/targets": 1, "/listeners/b/api/sd/targets": 0} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("failed to get %s: %v", path, err)
+		}
+		var groups []sdTargetGroup
+		err = json.NewDecoder(resp.Body).Decode(&groups)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to decode %s: %v", path, err)
+		}
+		if len(groups) != want {
+			t.Errorf("expected %d target groups from %s, got %+v", want, path, groups)
+		}
+		if path == "/api/sd/targets" && len(groups) == 1 && groups[0].Labels["__meta_nlb_listener"] != "a" {
+			t.Errorf("expected the target to be labeled with its listener, got %v", groups[0].Labels)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Statuses of a startup check.
+const (
+	checkOK      = "ok"
+	checkWarning = "warning"
+	checkError   = "error"
+	checkSkipped = "skipped"
+)
+
+const defaultSelfTestTimeout = 2 * time.Second
+
+// startupCheck is the outcome of one startup check.
+type startupCheck struct {
+	// Check is the kind of check: conflict, loop, bind or dial.
+	Check    string `json:"check"`
+	Listener string `json:"listener,omitempty"`
+	Target   string `json:"target"`
+	Status   string `json:"status"`
+	Message  string `json:"message,omitempty"`
+}
+
+// startupReport is the result of the startup self-test.
+type startupReport struct {
+	Checks   []startupCheck `json:"checks"`
+	Warnings int            `json:"warnings"`
+	Errors   int            `json:"errors"`
+}
+
+func (r *startupReport) add(c startupCheck) {
+	switch c.Status {
+	case checkWarning:
+		r.Warnings++
+	case checkError:
+		r.Errors++
+	}
+	r.Checks = append(r.Checks, c)
+}
+
+// failed reports whether any check found an error.
+func (r *startupReport) failed() bool {
+	return r.Errors > 0
+}
+
+// log logs the checks that did not pass and a summary.
+func (r *startupReport) log(l *log.Logger) {
+	for _, c := range r.Checks {
+		if c.Status == checkWarning || c.Status == checkError {
+			warnf(l, "startup %s: %s check of %s%s: %s", c.Status, c.Check, c.Target, listenerSuffix(c.Listener), c.Message)
+		}
+	}
+	logf := infof
+	if r.Warnings > 0 || r.Errors > 0 {
+		logf = warnf
+	}
+	logf(l, "startup self-test: %d checks, %d warnings, %d errors", len(r.Checks), r.Warnings, r.Errors)
+}
+
+func listenerSuffix(name string) string {
+	if name == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (listener %s)", name)
+}
+
+// boundAddr is an address bound by a listener or the console.
+type boundAddr struct {
+	console  bool
+	listener string
+	protocol string
+	addr     string
+}
+
+func (a boundAddr) String() string {
+	if a.console {
+		return "console " + a.addr
+	}
+	return fmt.Sprintf("%s %s", a.protocol, a.addr)
+}
+
+// selfTest checks the config for address conflicts, backends pointing back
+// at a listener and addresses that cannot be bound, and if dial is set
+// dials each TCP backend once. Backends that cannot be reached are only
+// warnings.
+func selfTest(ctx context.Context, config *Config, dial bool) (*startupReport, error) {
+	timeout := defaultSelfTestTimeout
+	if config.SelfTest != nil && config.SelfTest.Timeout != "" {
+		d, err := time.ParseDuration(config.SelfTest.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid self_test timeout: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("self_test timeout must be positive")
+		}
+		timeout = d
+	}
+	r := &startupReport{}
+	var addrs []boundAddr
+	if config.ConsoleAddr != "" {
+		addrs = append(addrs, boundAddr{console: true, protocol: "tcp", addr: config.ConsoleAddr})
+	}
+	for _, lc := range config.listenerConfigs() {
+		for _, addr := range append([]string{lc.Addr}, lc.Addrs...) {
+			for _, protocol := range listenerProtocols(lc.Protocol) {
+				addrs = append(addrs, boundAddr{listener: lc.Name, protocol: protocol, addr: addr})
+			}
+		}
+	}
+
+	for i, a := range addrs {
+		conflict := false
+		for _, b := range addrs[:i] {
+			if a.protocol == b.protocol && addrsOverlap(a.addr, b.addr) {
+				r.add(startupCheck{Check: "conflict", Listener: a.listener, Target: a.String(), Status: checkError,
+					Message: fmt.Sprintf("overlaps %s%s", b, listenerSuffix(b.listener))})
+				conflict = true
+			}
+		}
+		if !conflict {
+			r.add(checkBind(a))
+		}
+	}
+
+	for _, lc := range config.listenerConfigs() {
+		for _, u := range selfTestBackends(lc) {
+			if u.Scheme == debugScheme || u.Scheme == staticScheme {
+				continue
+			}
+			for _, a := range addrs {
+				if !a.console && a.listener == lc.Name && a.protocol == backendProtocol(u.Scheme) && isLocalAddr(a.addr, u.Host) {
+					r.add(startupCheck{Check: "loop", Listener: lc.Name, Target: u.String(), Status: checkError,
+						Message: fmt.Sprintf("backend is the listener's own address %s", a.addr)})
+				}
+			}
+		}
+	}
+
+	if dial {
+		for _, c := range dialBackends(ctx, config, timeout) {
+			r.add(c)
+		}
+	}
+	return r, nil
+}
+
+// addrsOverlap reports whether two listen addresses bind the same port on a
+// common IP address. Addresses with port 0 never overlap.
+func addrsOverlap(a, b string) bool {
+	hostA, portA, errA := net.SplitHostPort(a)
+	hostB, portB, errB := net.SplitHostPort(b)
+	if errA != nil || errB != nil || portA != portB || portA == "0" {
+		return false
+	}
+	return isUnspecified(hostA) || isUnspecified(hostB) || hostA == hostB
+}
+
+func isUnspecified(host string) bool {
+	ip := net.ParseIP(host)
+	return host == "" || ip != nil && ip.IsUnspecified()
+}
+
+// isLocalAddr reports whether backend, a host:port, is the listen address
+// addr: the same port on a loopback address, an address of this host, or
+// addr's own host.
+func isLocalAddr(addr, backend string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	bhost, bport, berr := net.SplitHostPort(backend)
+	if err != nil || berr != nil || port != bport || port == "0" {
+		return false
+	}
+	if bhost == host {
+		return true
+	}
+	if !isUnspecified(host) {
+		return false
+	}
+	if bhost == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(bhost)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	local, _ := net.InterfaceAddrs()
+	return slices.ContainsFunc(local, func(a net.Addr) bool {
+		ipNet, ok := a.(*net.IPNet)
+		return ok && ipNet.IP.Equal(ip)
+	})
+}
+
+func backendProtocol(scheme string) string {
+	if scheme == "udp" {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// checkBind binds the address and releases it right away, explaining why
+// it cannot be bound.
+func checkBind(a boundAddr) startupCheck {
+	c := startupCheck{Check: "bind", Listener: a.listener, Target: a.String(), Status: checkOK}
+	var err error
+	switch a.protocol {
+	case "udp":
+		var conn net.PacketConn
+		if conn, err = net.ListenPacket("udp", a.addr); err == nil {
+			conn.Close()
+		}
+	case "tcp":
+		var l net.Listener
+		if l, err = net.Listen("tcp", a.addr); err == nil {
+			l.Close()
+		}
+	default:
+		c.Status, c.Message = checkSkipped, fmt.Sprintf("unsupported protocol %q", a.protocol)
+		return c
+	}
+	if err != nil {
+		c.Status, c.Message = checkError, bindErrorMessage(a.addr, err)
+	}
+	return c
+}
+
+func bindErrorMessage(addr string, err error) string {
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		return "address already in use by another process"
+	case errors.Is(err, os.ErrPermission):
+		if _, port, _ := net.SplitHostPort(addr); privilegedPort(port) {
+			return "permission denied: ports below 1024 need root or the CAP_NET_BIND_SERVICE capability"
+		}
+		return "permission denied"
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		return "address is not assigned to any interface of this host"
+	default:
+		return err.Error()
+	}
+}
+
+func privilegedPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 1024 && runtime.GOOS != "windows"
+}
+
+// selfTestBackends returns the configured backends of a listener, skipping
+// invalid ones, which fail when the pool is created.
+func selfTestBackends(lc *Config) []*url.URL {
+	configs := slices.Clone(lc.Backends)
+	if lc.BlueGreen != nil {
+		for _, name := range slices.Sorted(maps.Keys(lc.BlueGreen.Groups)) {
+			configs = append(configs, lc.BlueGreen.Groups[name]...)
+		}
+	}
+	if group := lc.BackendGroups[lc.BackendGroup]; group != nil {
+		configs = append(configs, group.Backends...)
+	}
+	expanded, err := expandPortRanges(configs)
+	if err != nil {
+		return nil
+	}
+	var backends []*url.URL
+	for _, bc := range expanded {
+		if u, err := parseBackendURL(bc.URL, listenerProtocols(lc.Protocol)[0]); err == nil {
+			backends = append(backends, u)
+		}
+	}
+	return backends
+}
+
+// dialBackends dials each TCP backend of every listener once, concurrently,
+// and resolves the host of each UDP backend, waiting up to timeout for each.
+func dialBackends(ctx context.Context, config *Config, timeout time.Duration) []startupCheck {
+	var checks []startupCheck
+	for _, lc := range config.listenerConfigs() {
+		for _, u := range selfTestBackends(lc) {
+			if u.Scheme == debugScheme || u.Scheme == staticScheme {
+				continue
+			}
+			checks = append(checks, startupCheck{Check: "dial", Listener: lc.Name, Target: u.String(), Status: checkOK})
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := &checks[i]
+			u, _ := parseBackendURL(c.Target, "")
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			var err error
+			if u.Scheme == "udp" {
+				// UDP cannot be tested without a reply, so only the host is
+				// resolved.
+				_, err = net.DefaultResolver.LookupHost(ctx, u.Hostname())
+			} else {
+				var d net.Dialer
+				var conn net.Conn
+				if conn, err = d.DialContext(ctx, "tcp", u.Host); err == nil {
+					conn.Close()
+				}
+			}
+			if err != nil {
+				c.Status, c.Message = checkWarning, err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+	return checks
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func findCheck(r *startupReport, check, status string) *startupCheck {
+	for i, c := range r.Checks {
+		if c.Check == check && c.Status == status {
+			return &r.Checks[i]
+		}
+	}
+	return nil
+}
+
+func Test_addrsOverlap(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"127.0.0.1:8080", "127.0.0.1:8080", true},
+		{":8080", "127.0.0.1:8080", true},
+		{"0.0.0.0:8080", "10.0.0.1:8080", true},
+		{"127.0.0.1:8080", "127.0.0.2:8080", false},
+		{"127.0.0.1:8080", "127.0.0.1:8081", false},
+		{"127.0.0.1:0", "127.0.0.1:0", false},
+	}
+	for _, tt := range tests {
+		if got := addrsOverlap(tt.a, tt.b); got != tt.want {
+			t.Errorf("addrsOverlap(%q, %q): expected %t, got %t", tt.a, tt.b, tt.want, got)
+		}
+	}
+}
+
+func Test_isLocalAddr(t *testing.T) {
+	tests := []struct {
+		addr, backend string
+		want          bool
+	}{
+		{"127.0.0.1:9000", "127.0.0.1:9000", true},
+		{":9000", "localhost:9000", true},
+		{":9000", "127.0.0.1:9000", true},
+		{"127.0.0.1:9000", "127.0.0.1:9001", false},
+		{"127.0.0.1:9000", "10.0.0.1:9000", false},
+		{":9000", "backend.example:9000", false},
+	}
+	for _, tt := range tests {
+		if got := isLocalAddr(tt.addr, tt.backend); got != tt.want {
+			t.Errorf("isLocalAddr(%q, %q): expected %t, got %t", tt.addr, tt.backend, tt.want, got)
+		}
+	}
+}
+
+func TestSelfTest_consoleConflict(t *testing.T) {
+	config := &Config{ConsoleAddr: ":18090", Addr: "127.0.0.1:18090", Protocol: "tcp",
+		Backends: []BackendConfig{{URL: "tcp://127.0.0.1:1"}}}
+	r, err := selfTest(t.Context(), config, false)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !r.failed() {
+		t.Fatalf("expected the self-test to fail")
+	}
+	c := findCheck(r, "conflict", checkError)
+	if c == nil || !strings.Contains(c.Message, "console :18090") {
+		t.Errorf("expected a conflict with the console, got %+v", r.Checks)
+	}
+}
+
+func TestSelfTest_listenerConflict(t *testing.T) {
+	config := &Config{Listeners: []*Config{
+		{Name: "a", Addr: "127.0.0.1:18091", Protocol: "tcp"},
+		{Name: "b", Addrs: []string{"127.0.0.1:18092"}, Addr: ":18091", Protocol: "tcp"},
+		{Name: "c", Addr: ":18091", Protocol: "udp"},
+	}}
+	r, err := selfTest(t.Context(), config, false)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if r.Errors != 1 {
+		t.Fatalf("expected 1 error, got %+v", r.Checks)
+	}
+	c := findCheck(r, "conflict", checkError)
+	if c == nil || c.Listener != "b" || !strings.Contains(c.Message, "listener a") {
+		t.Errorf("expected listener b to conflict with listener a, got %+v", c)
+	}
+}
+
+func TestSelfTest_backendLoop(t *testing.T) {
+	config := &Config{Addr: ":18093", Protocol: "tcp", Backends: []BackendConfig{
+		{URL: "tcp://localhost:18093"}, {URL: "tcp://127.0.0.1:1"},
+	}}
+	r, err := selfTest(t.Context(), config, false)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	c := findCheck(r, "loop", checkError)
+	if c == nil || c.Target != "tcp://localhost:18093" {
+		t.Errorf("expected the backend pointing at the listener to be reported, got %+v", r.Checks)
+	}
+	if r.Errors != 1 {
+		t.Errorf("expected 1 error, got %d", r.Errors)
+	}
+}
+
+func TestSelfTest_addressInUse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	config := &Config{Addr: ln.Addr().String(), Protocol: "tcp"}
+	r, err := selfTest(t.Context(), config, false)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	c := findCheck(r, "bind", checkError)
+	if c == nil || !strings.Contains(c.Message, "already in use") {
+		t.Errorf("expected the address to be reported in use, got %+v", r.Checks)
+	}
+}
+
+func Test_bindErrorMessage(t *testing.T) {
+	_, err := net.Listen("tcp", "192.0.2.1:0")
+	if err == nil {
+		t.Skip("192.0.2.1 is assigned to this host")
+	}
+	if got := bindErrorMessage("192.0.2.1:0", err); !strings.Contains(got, "not assigned") {
+		t.Errorf("expected an unassigned address message, got %q", got)
+	}
+	if got := bindErrorMessage(":80", &net.OpError{Op: "listen", Err: os.ErrPermission}); !strings.Contains(got, "CAP_NET_BIND_SERVICE") {
+		t.Errorf("expected a privileged port message, got %q", got)
+	}
+}
+
+func TestSelfTest_dialBackends(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	config := &Config{Addr: "127.0.0.1:0", Protocol: "tcp", SelfTest: &SelfTestConfig{Timeout: "1s"}, Backends: []BackendConfig{
+		{URL: "tcp://" + ln.Addr().String()}, {URL: "tcp://" + closedAddr}, {URL: "debug://echo"},
+	}}
+	r, err := selfTest(t.Context(), config, true)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if r.failed() {
+		t.Errorf("expected unreachable backends to be warnings, got %+v", r.Checks)
+	}
+	if r.Warnings != 1 {
+		t.Errorf("expected 1 warning, got %+v", r.Checks)
+	}
+	if c := findCheck(r, "dial", checkWarning); c == nil || c.Target != "tcp://"+closedAddr {
+		t.Errorf("expected the closed backend to be reported, got %+v", c)
+	}
+	if c := findCheck(r, "dial", checkOK); c == nil || c.Target != "tcp://"+ln.Addr().String() {
+		t.Errorf("expected the listening backend to pass, got %+v", c)
+	}
+}
+
+func TestSelfTest_invalidTimeout(t *testing.T) {
+	config := &Config{Addr: "127.0.0.1:0", Protocol: "tcp", SelfTest: &SelfTestConfig{Timeout: "soon"}}
+	if _, err := selfTest(t.Context(), config, true); err == nil {
+		t.Errorf("expected an error for an invalid timeout")
+	}
+}
+
+func TestRun_selfTestFlag(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := fmt.Sprintf(`{"addr": %q, "console_addr": "127.0.0.1:0", "protocol": "tcp", "backends": ["tcp://127.0.0.1:1"]}`, ln.Addr())
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	var out syncBuffer
+	if err := run(t.Context(), &out, []string{"-self-test", path}); err == nil {
+		t.Fatalf("expected the self-test to fail")
+	}
+	var r startupReport
+	if err := json.Unmarshal([]byte(out.String()), &r); err != nil {
+		t.Fatalf("expected a JSON report, got %q: %v", out.String(), err)
+	}
+	if findCheck(&r, "bind", checkError) == nil || findCheck(&r, "dial", checkWarning) == nil {
+		t.Errorf("expected bind and dial failures, got %+v", r.Checks)
+	}
+}
+
+func TestRun_startupConflict(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{"addr": "127.0.0.1:18094", "console_addr": "127.0.0.1:18094", "protocol": "tcp", "backends": ["tcp://127.0.0.1:1"]}`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	var out syncBuffer
+	err := run(t.Context(), &out, []string{path})
+	if err == nil || !strings.Contains(err.Error(), "self-test failed") {
+		t.Fatalf("expected the startup self-test to fail, got %v", err)
+	}
+	if !strings.Contains(out.String(), "overlaps console 127.0.0.1:18094") {
+		t.Errorf("expected the conflict to be logged, got %q", out.String())
+	}
+}
@@ -1,101 +1,737 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"fmt"
+	"html/template"
 	"log"
 	"net"
 	"net/http"
-	"net/url"
+	"slices"
+	"strings"
 	"sync"
-	"text/template"
+	"sync/atomic"
 	"time"
 )
 
 type ServerPool interface {
 	Next(conn net.Addr) *Backend
-	AddBackend(rawUrl string)
+	AddBackend(rawUrl string) error
+	Backends() []*Backend
+	MaxConnections() int64
 	StartHealthChecks()
 	Start() error
 	Shutdown(ctx context.Context) error
+	// StopAccepting, Drain and stopHealthChecks are the phases of Shutdown,
+	// for callers that order shutdown across several components.
+	StopAccepting() error
+	Drain(ctx context.Context) error
+	stopHealthChecks(ctx context.Context) error
+	attachShadow(config *Config) error
+	status() poolStatus
+	snapshot() poolSnapshot
+	restore(snap poolSnapshot) error
+	dashboard(now time.Time) dashboardView
 	dashboardHandler(w http.ResponseWriter, r *http.Request)
+	metricsHandler(w http.ResponseWriter, r *http.Request)
+	readyHandler(w http.ResponseWriter, r *http.Request)
+	healthzHandler(w http.ResponseWriter, r *http.Request)
+	readyzHandler(w http.ResponseWriter, r *http.Request)
+	backendsAPIHandler(w http.ResponseWriter, r *http.Request)
+	addBackendAPIHandler(w http.ResponseWriter, r *http.Request)
+	healthHistoryAPIHandler(w http.ResponseWriter, r *http.Request)
+	overrideHealthAPIHandler(w http.ResponseWriter, r *http.Request)
+	stateAPIHandler(w http.ResponseWriter, r *http.Request)
+	statsAPIHandler(w http.ResponseWriter, r *http.Request)
+	resetStatsAPIHandler(w http.ResponseWriter, r *http.Request)
+	captureAPIHandler(w http.ResponseWriter, r *http.Request)
+	startCaptureAPIHandler(w http.ResponseWriter, r *http.Request)
+	stopCaptureAPIHandler(w http.ResponseWriter, r *http.Request)
+	policyAPIHandler(w http.ResponseWriter, r *http.Request)
+	setPolicyAPIHandler(w http.ResponseWriter, r *http.Request)
+	connectionsAPIHandler(w http.ResponseWriter, r *http.Request)
+	closeConnectionAPIHandler(w http.ResponseWriter, r *http.Request)
+	blueGreenAPIHandler(w http.ResponseWriter, r *http.Request)
+	switchGroupAPIHandler(w http.ResponseWriter, r *http.Request)
+	drainStatusAPIHandler(w http.ResponseWriter, r *http.Request)
+	drainBackendAPIHandler(w http.ResponseWriter, r *http.Request)
+	undrainBackendAPIHandler(w http.ResponseWriter, r *http.Request)
+	sloAPIHandler(w http.ResponseWriter, r *http.Request)
+	sdTargetsAPIHandler(w http.ResponseWriter, r *http.Request)
+	floodAPIHandler(w http.ResponseWriter, r *http.Request)
+	shutdownAPIHandler(w http.ResponseWriter, r *http.Request)
+	shutdownReport(now time.Time) shutdownView
+	probesAPIHandler(w http.ResponseWriter, r *http.Request)
+	quarantineAPIHandler(w http.ResponseWriter, r *http.Request)
+	forgetQuarantinedAPIHandler(w http.ResponseWriter, r *http.Request)
+	sdTargets() []sdTargetGroup
+	longConnectionGrace() time.Duration
 }
 
-var (
-	tmpl = template.Must(template.New("dashboard.html.tmpl").
-		Funcs(template.FuncMap{"now": time.Now}).
-		ParseFiles("templates/dashboard.html.tmpl"))
+// defaultDialTimeout bounds connecting to a backend unless dial_timeout is set.
+const defaultDialTimeout = 2 * time.Second
+
+// parseDialTimeout parses a dial_timeout setting, returning zero if unset.
+func parseDialTimeout(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid dial_timeout: %w", err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("dial_timeout must be positive")
+	}
+	return d, nil
+}
+
+// Supported load balancing algorithms.
+const (
+	AlgorithmRoundRobin        = "round-robin"
+	AlgorithmLeastLatency      = "least-latency"
+	AlgorithmLeastResponseTime = "least-response-time"
+	AlgorithmLeastConnections  = "least-connections"
+)
+
+// validateAlgorithm returns the algorithm to use, defaulting to round-robin.
+func validateAlgorithm(algorithm string) (string, error) {
+	switch algorithm {
+	case "":
+		return AlgorithmRoundRobin, nil
+	case AlgorithmRoundRobin, AlgorithmLeastLatency, AlgorithmLeastResponseTime, AlgorithmLeastConnections:
+		return algorithm, nil
+	default:
+		return "", fmt.Errorf("unsupported algorithm: %s", algorithm)
+	}
+}
+
+// Keys sticky sessions hash clients by.
+const (
+	StickyKeyIP     = "ip"
+	StickyKeyIPPort = "ip_port"
+)
+
+// Ways sticky sessions map clients to backends.
+const (
+	StickyHashingModulo     = "modulo"
+	StickyHashingConsistent = "consistent"
 )
 
+// validateStickyHashing returns the sticky session hashing to use,
+// defaulting to modulo.
+func validateStickyHashing(hashing string) (string, error) {
+	switch hashing {
+	case "":
+		return StickyHashingModulo, nil
+	case StickyHashingModulo, StickyHashingConsistent:
+		return hashing, nil
+	default:
+		return "", fmt.Errorf("unsupported sticky_hashing: %s", hashing)
+	}
+}
+
+// validateStickyKey returns the sticky session key to use, defaulting to the
+// client IP.
+func validateStickyKey(key string) (string, error) {
+	switch key {
+	case "":
+		return StickyKeyIP, nil
+	case StickyKeyIP, StickyKeyIPPort:
+		return key, nil
+	default:
+		return "", fmt.Errorf("unsupported sticky_key: %s", key)
+	}
+}
+
 type BaseServerPool struct {
+	shutdown            chan struct{}
+	healthcheckInterval time.Duration
+	healthChecksStarted atomic.Bool
+
+	// selection is the view of the backends and policy that is read
+	// without locking backendsMutex. backends, which it shares, is only
+	// changed under the lock, and replaced rather than modified in place.
+	selection atomic.Pointer[backendSelection]
+
 	backends       []*Backend
-	current        uint64
+	current        atomic.Uint64
 	backendsMutex  sync.Mutex
 	stickySessions bool
-	log            *log.Logger
+	stickyKey      string
+	stickyHashing  string
+	algorithm      string
+	// policyChanged is set once the policy has been changed at runtime.
+	policyChanged  bool
+	maxConnections int64
+	dialTimeout    time.Duration
+	// connTimeout bounds the lifetime of a connection if positive.
+	connTimeout         time.Duration
+	localZone           string
+	zoneLabel           string
+	faults              *faultInjector
+	breakerSettings     *circuitBreakerSettings
+	admissionSettings   *admissionSettings
+	sloSettings         *sloSettings
+	flaps               *flapDetector
+	quarantine          *quarantine
+	checker             *healthChecker
+	healthCheck         healthCheck
+	backendHealthChecks map[string]healthCheck
+	deepCheck           *deepHealthCheck
+	exemplars           bool
+	degradedEvery       uint64
+	minHealthy          int
+	waitForReady        bool
+	failStatic          bool
+	ready               chan struct{}
+	readyOnce           sync.Once
+	floor               healthFloor
+	listening           atomic.Bool
+	shuttingDown        atomic.Bool
+	shutdownDrain       atomic.Pointer[drainState]
+	stats               listenerStats
+	conns               connTracker
+	capture             capturer
+	// sniffer is nil unless protocol sniffing is enabled on a TCP listener.
+	sniffer *sniffer
+	// firstByte is nil unless a TCP listener routes by the first bytes
+	// clients send.
+	firstByte *firstByteRouter
+	// validator is nil unless a TCP listener validates the first bytes
+	// clients send.
+	validator *protocolValidator
+	// affinity is nil unless backends are chosen by a key parsed from the
+	// first bytes clients send.
+	affinity *affinity
+	// queue is nil unless a TCP listener queues connections while its
+	// backends are saturated.
+	queue   *acceptQueue
+	pinning *backendPinning
+	// fdLimit is nil unless new connections are shed while the process
+	// is short of file descriptors.
+	fdLimit *fdLimit
+	// priority is nil unless clients are shed by priority class.
+	priority *priorityClasses
+	// geoIP is nil unless clients are looked up in GeoIP databases.
+	geoIP *geoIP
+	// sourceFilter is nil unless clients are rejected by source address.
+	sourceFilter *sourceFilter
+	// uptime is nil unless backend health transitions are persisted.
+	uptime *uptimeLog
+	// mirror is the UDP pool of a tcp+udp listener, whose backends follow
+	// the health of this pool's, or nil.
+	mirror *BaseServerPool
+	// panics is nil if panics handling connections crash the process.
+	panics *panicRecovery
+	// logSampler is nil unless some connections are logged in detail
+	// whatever the log level.
+	logSampler *logSampler
+	// xds is nil unless backends are discovered from an xDS server.
+	xds *xdsClient
+	// backendTLS holds the TLS settings shared by all backends.
+	backendTLS *BackendTLSConfig
+	// device and backendDevice are the devices, or VRFs, the listener and
+	// connections to backends are bound to, if any.
+	device        string
+	backendDevice string
+	// resolver caches backend hostname resolutions; nil if disabled.
+	resolver *dnsCache
+	// longConns is nil unless a long-connection drain policy is configured.
+	longConns *longConnPolicy
+	// blueGreen is nil unless the listener switches between backend groups.
+	blueGreen *blueGreen
+	// backendGroup is nil unless the listener uses a shared backend group.
+	backendGroup *backendGroup
+	// sharedHealth is nil unless backend health is shared per host.
+	sharedHealth *sharedHealth
+	// flood is nil unless a UDP listener limits the rate of datagrams.
+	flood *udpFloodGuard
+	// resources are the goroutines and buffers the pool holds.
+	resources resourceUsage
+	// stickyFailover tracks the sticky clients moved off a failed backend.
+	stickyFailover *stickyFailover
+	// receivers is nil unless a UDP listener has several sockets per
+	// address.
+	receivers *udpReceivers
+	// shadow is nil unless a candidate config is evaluated as a dry run.
+	shadow *shadowRouter
+	log    *log.Logger
+
+	// Listener and dashboard details shown on the console.
+	name      string
+	protocol  string
+	addr      string
+	tls       bool
+	startTime time.Time
+	tmpl      *template.Template
+
+	// addrs are all addresses of the listener, starting with addr, and
+	// hooks is nil unless commands run as they are bound and released.
+	addrs []string
+	hooks *addressHooks
+}
+
+// beginShutdown marks the pool as shutting down. It returns false if
+// shutdown had already begun.
+func (p *BaseServerPool) beginShutdown() bool {
+	select {
+	case <-p.shutdown:
+		return false
+	default:
+		close(p.shutdown)
+	}
+	p.shuttingDown.Store(true)
+	return true
+}
+
+// waitContext waits for wg, giving up when ctx is done.
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("drain timed out: %w", ctx.Err())
+	}
 }
 
 // AddBackend adds a new backend to the server pool.
-func (p *BaseServerPool) AddBackend(rawUrl string) {
-	p.backendsMutex.Lock()
-	defer p.backendsMutex.Unlock()
-	parsedURL, err := url.Parse(rawUrl)
+func (p *BaseServerPool) AddBackend(rawUrl string) error {
+	_, err := p.addBackend(BackendConfig{URL: rawUrl})
+	return err
+}
+
+// addBackend adds a new backend described by config to the server pool. It
+// returns an error wrapping errDuplicateBackend if a backend with the same
+// address already exists. If health checks are running, the new backend is
+// probed right away.
+func (p *BaseServerPool) addBackend(config BackendConfig) (*Backend, error) {
+	parsedURL, err := parseBackendURL(config.URL, p.protocol)
 	if err != nil {
-		p.log.Printf("error parsing URL %s: %v\n", rawUrl, err)
-		return
+		return nil, err
 	}
+	dialTimeout, err := parseDialTimeout(config.DialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("backend %s: %w", config.URL, err)
+	}
+	if p.protocol == "udp" && config.TLS != nil {
+		return nil, fmt.Errorf("backend %s: tls is only supported by tcp listeners", config.URL)
+	}
+	tlsConfig, err := newBackendTLSConfig(p.backendTLS, config.TLS, parsedURL.Hostname())
+	if err != nil {
+		return nil, fmt.Errorf("backend %s: %w", config.URL, err)
+	}
+	var static []byte
+	if parsedURL.Scheme == staticScheme {
+		if static, err = staticResponse(config.Static); err != nil {
+			return nil, fmt.Errorf("backend %s: %w", config.URL, err)
+		}
+	} else if config.Static != nil {
+		return nil, fmt.Errorf("backend %s: static is only supported by static backends", config.URL)
+	}
+
+	p.backendsMutex.Lock()
+	id := backendID(parsedURL)
+	for _, b := range p.backends {
+		if b.ID == id {
+			p.backendsMutex.Unlock()
+			return nil, fmt.Errorf("%w: %s is already registered as %s", errDuplicateBackend, config.URL, b.URL)
+		}
+	}
+
 	backend := &Backend{
-		URL:       parsedURL,
-		isHealthy: false,
+		ID:          id,
+		keyHash:     hashKey(id),
+		URL:         parsedURL,
+		Labels:      config.Labels,
+		isHealthy:   false,
+		dialTimeout: dialTimeout,
+		tls:         config.TLS,
+		tlsConfig:   tlsConfig,
+		breaker:     newCircuitBreaker(p.breakerSettings),
+		admission:   newAdmissionLimiter(p.admissionSettings),
+		static:      static,
+		slo:         newSLOTracker(p.sloSettings),
+		resolver:    p.resolver,
+		runtime:     config.runtime,
+		group:       config.group,
+		sharedGroup: config.sharedGroup,
+		device:      p.backendDevice,
+		removed:     make(chan struct{}),
 	}
 	p.backends = append(p.backends, backend)
+	p.publishSelection()
+	p.backendsMutex.Unlock()
+
+	if p.healthChecksStarted.Load() {
+		p.startHealthCheck(backend)
+	}
+	return backend, nil
 }
 
-// Next returns the next available backend using round-robin.
-func (p *BaseServerPool) Next(conn net.Addr) *Backend {
+// removeBackend removes the backend with the given ID, URL or host:port from
+// the pool and stops its health checks. Connections already proxied to it
+// are not interrupted.
+func (p *BaseServerPool) removeBackend(ref string) (*Backend, error) {
 	p.backendsMutex.Lock()
 	defer p.backendsMutex.Unlock()
+	i := slices.IndexFunc(p.backends, func(b *Backend) bool {
+		return ref != "" && (b.ID == ref || b.URL.String() == ref || b.URL.Host == ref)
+	})
+	if i < 0 {
+		return nil, fmt.Errorf("backend %q not found", ref)
+	}
+	b := p.backends[i]
+	p.backends = slices.Delete(slices.Clone(p.backends), i, i+1)
+	p.publishSelection()
+	if b.removed != nil {
+		close(b.removed)
+	}
+	return b, nil
+}
 
-	if p.stickySessions {
-		ip := getIpFromAddr(conn)
-		hash := hashIp(ip)
-		idx := hash % len(p.backends)
-		if p.backends[idx].Healthy() {
-			return p.backends[idx]
+// Backends returns a snapshot of the backends in the pool, which is shared
+// and must not be modified.
+func (p *BaseServerPool) Backends() []*Backend {
+	return p.currentSelection().all
+}
+
+// findBackend returns the backend with the given ID, URL or host:port, or nil
+// if there is none.
+func (p *BaseServerPool) findBackend(ref string) *Backend {
+	for _, b := range p.Backends() {
+		if ref != "" && (b.ID == ref || b.URL.String() == ref || b.URL.Host == ref) {
+			return b
 		}
+	}
+	return nil
+}
+
+// MaxConnections returns the per-backend connection limit, or zero if unlimited.
+func (p *BaseServerPool) MaxConnections() int64 {
+	return p.maxConnections
+}
+
+// dialTimeoutFor returns the timeout for connecting to the backend.
+func (p *BaseServerPool) dialTimeoutFor(b *Backend) time.Duration {
+	return cmp.Or(b.dialTimeout, p.dialTimeout, defaultDialTimeout)
+}
+
+// available reports whether the backend is healthy (or last known good while
+// failing static), not draining, not held down for flapping or for burning
+// its error budget, and below the per-backend connection limit and
+// connection rate, if configured.
+func (p *BaseServerPool) available(b *Backend) bool {
+	if p.maxConnections > 0 && b.ActiveConnections() >= p.maxConnections {
+		return false
+	}
+	if _, held := b.history.heldDown(time.Now()); held {
+		return false
+	}
+	if b.slo.exhausted(time.Now()) || !b.admission.ready(time.Now()) {
+		return false
+	}
+	return (b.Healthy() || p.floor.lastKnownGood(b)) && !b.Draining() && b.breaker.Ready() && p.blueGreen.routes(b)
+}
+
+// backendSelection is an immutable view of the backends of a pool and of
+// its policy, rebuilt whenever either changes, so that the hot path reads
+// them without locking or allocating while backends are added and removed.
+type backendSelection struct {
+	// all are the backends of the pool, in order. Its capacity is its
+	// length, so that appending to it copies it.
+	all []*Backend
+	// backends are the backends other than static backends, which are
+	// selected apart.
+	backends []*Backend
+	// local are the backends in the local zone, if one is configured.
+	local          []*Backend
+	static         []*Backend
+	algorithm      string
+	stickySessions bool
+
+	// labelled are the non-static backends by label and value, for routing
+	// by first bytes and region, and hosts the same with lowercased values,
+	// for routing by sniffed host regardless of case.
+	labelled map[labelValue][]*Backend
+	hosts    map[labelValue][]*Backend
+}
 
-		// If the hashed backend is down, find the next healthy one
-		backend := p.findNextHealthyBackend(idx)
-		if backend != nil {
-			return backend
+// labelValue is a label of backends and one of its values.
+type labelValue struct {
+	label, value string
+}
+
+// emptySelection is the view of a pool before its first backend is added.
+var emptySelection = &backendSelection{}
+
+// publishSelection rebuilds the selection view of the pool. backendsMutex
+// must be held.
+func (p *BaseServerPool) publishSelection() {
+	s := &backendSelection{
+		all:            slices.Clip(p.backends),
+		algorithm:      p.algorithm,
+		stickySessions: p.stickySessions,
+		labelled:       make(map[labelValue][]*Backend),
+		hosts:          make(map[labelValue][]*Backend),
+	}
+	for _, b := range p.backends {
+		if isStaticBackend(b) {
+			s.static = append(s.static, b)
+			continue
+		}
+		s.backends = append(s.backends, b)
+		if p.localZone != "" && b.Labels[p.zoneLabel] == p.localZone {
+			s.local = append(s.local, b)
 		}
-		// If no healthy backend found, return nil
+		for label, value := range b.Labels {
+			lv := labelValue{label, value}
+			s.labelled[lv] = append(s.labelled[lv], b)
+			lv.value = strings.ToLower(value)
+			s.hosts[lv] = append(s.hosts[lv], b)
+		}
+	}
+	p.selection.Store(s)
+}
+
+// currentSelection returns the selection view of the pool.
+func (p *BaseServerPool) currentSelection() *backendSelection {
+	if s := p.selection.Load(); s != nil {
+		return s
+	}
+	return emptySelection
+}
+
+// Next returns the next available backend using the configured algorithm.
+// If a local zone is configured, backends in that zone are preferred and
+// other zones are only used when no local backend is available.
+func (p *BaseServerPool) Next(conn net.Addr) *Backend {
+	s := p.currentSelection()
+	if backend := p.selectBackend(s, s.local, conn); backend != nil {
+		return backend
+	}
+	return p.selectBackend(s, s.backends, conn)
+}
+
+// nextForHost returns the next available backend whose label matches host,
+// regardless of case. If no backend is labelled with host, any backend may
+// be chosen.
+func (p *BaseServerPool) nextForHost(conn net.Addr, label, host string) *Backend {
+	s := p.currentSelection()
+	if matching := s.hosts[labelValue{label, strings.ToLower(host)}]; len(matching) > 0 {
+		return p.selectBackend(s, matching, conn)
+	}
+	return p.Next(conn)
+}
+
+// selectBackend picks an available backend from backends, none of which is
+// static, with the policy of s. A degraded backend beyond its share gives
+// way to any other available backend.
+func (p *BaseServerPool) selectBackend(s *backendSelection, backends []*Backend, conn net.Addr) *Backend {
+	b := p.pickBackend(s, backends, conn)
+	if b == nil || !p.throttled(s, b) {
+		return b
+	}
+	if other := p.pickBackend(s, undegraded(backends), conn); other != nil {
+		return other
+	}
+	return b
+}
+
+// pickBackend picks an available backend from backends using the algorithm
+// of s.
+func (p *BaseServerPool) pickBackend(s *backendSelection, backends []*Backend, conn net.Addr) *Backend {
+	if len(backends) == 0 {
 		return nil
 	}
 
-	for i := 0; i < len(p.backends); i++ {
-		p.current = (p.current + 1) % uint64(len(p.backends))
-		if p.backends[p.current].Healthy() {
-			return p.backends[p.current]
+	if s.stickySessions {
+		return p.selectHashed(backends, hashClient(conn, p.stickyKey), stickyClient{addr: conn})
+	}
+
+	switch s.algorithm {
+	case AlgorithmLeastLatency:
+		return p.leastLatency(backends)
+	case AlgorithmLeastResponseTime:
+		return p.leastResponseTime(backends)
+	case AlgorithmLeastConnections:
+		return p.leastConnections(backends)
+	}
+
+	n := uint64(len(backends))
+	start := p.current.Add(1)
+	for i := range n {
+		idx := (start + i) % n
+		if b := backends[idx]; p.available(b) {
+			// The next connection continues from the backend chosen,
+			// rather than landing on it again after an unavailable one.
+			p.current.Store(idx)
+			return b
 		}
 	}
 	return nil
 }
 
-// findNextHealthyBackend finds the next healthy backend starting from the given index.
-func (p *BaseServerPool) findNextHealthyBackend(start int) *Backend {
-	for i := 0; i < len(p.backends); i++ {
-		idx := (start + i) % len(p.backends)
-		if p.backends[idx].Healthy() {
-			return p.backends[idx]
+// selectHashed returns the backend hash maps to or, if it is unavailable,
+// the next available one. client, its address or affinity key, is logged
+// when it is moved to another backend or back.
+func (p *BaseServerPool) selectHashed(backends []*Backend, hash int, client stickyClient) *Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+	idx := p.hashIndex(backends, hash)
+	up := p.available(backends[idx])
+	if p.stickyFailover != nil && (!up || p.stickyFailover.Remapped() > 0) {
+		return p.stickyFailover.route(p, backends, idx, hash, up, client)
+	}
+	if up {
+		return backends[idx]
+	}
+
+	// If the hashed backend is down, find the next healthy one
+	return p.nextHashed(backends, idx, hash)
+}
+
+// hashIndex returns the index of the backend in backends that hash maps to.
+// Modulo hashing depends on the number and order of the backends, while
+// consistent (rendezvous) hashing only moves the clients of the backends
+// added or removed, whatever their order, e.g. as discovered.
+func (p *BaseServerPool) hashIndex(backends []*Backend, hash int) int {
+	if p.stickyHashing != StickyHashingConsistent {
+		// The hash is a uint32, negative as an int on 32-bit platforms.
+		return int(uint32(hash) % uint32(len(backends)))
+	}
+	best, bestScore := 0, uint64(0)
+	for i, b := range backends {
+		if score := rendezvousScore(hash, b.keyHash); i == 0 || score > bestScore {
+			best, bestScore = i, score
 		}
 	}
+	return best
+}
+
+// nextHashed returns the available backend for a client hashing to hash
+// whose own backend, backends[idx], is unavailable: the next one in
+// backends with modulo hashing, or the one scoring highest after it with
+// consistent hashing, so that its clients are spread across the others.
+func (p *BaseServerPool) nextHashed(backends []*Backend, idx, hash int) *Backend {
+	if p.stickyHashing != StickyHashingConsistent {
+		return p.findNextHealthyBackend(backends, idx)
+	}
+	var best *Backend
+	var bestScore uint64
+	for _, b := range backends {
+		if !p.available(b) {
+			continue
+		}
+		if score := rendezvousScore(hash, b.keyHash); best == nil || score > bestScore {
+			best, bestScore = b, score
+		}
+	}
+	return best
+}
+
+// leastLatency returns the healthy backend with the lowest median dial
+// latency. Backends without samples are preferred so that they get measured.
+// The scan starts after the previously selected backend to spread ties.
+func (p *BaseServerPool) leastLatency(backends []*Backend) *Backend {
+	var best *Backend
+	var bestLatency time.Duration
+	n := uint64(len(backends))
+	start := p.current.Add(1)
+	for i := range n {
+		b := backends[(start+i)%n]
+		if !p.available(b) {
+			continue
+		}
+		latency := b.DialLatency.Percentile(50)
+		if best == nil || latency < bestLatency {
+			best, bestLatency = b, latency
+		}
+	}
+	return best
+}
+
+// leastResponseTime returns the healthy backend with the lowest score, where
+// the score is the average response time weighted by the number of active
+// connections. Backends without a recorded response time score zero so that
+// they get measured.
+func (p *BaseServerPool) leastResponseTime(backends []*Backend) *Backend {
+	var best *Backend
+	var bestScore float64
+	n := uint64(len(backends))
+	start := p.current.Add(1)
+	for i := range n {
+		b := backends[(start+i)%n]
+		if !p.available(b) {
+			continue
+		}
+		score := float64(b.ResponseTime.Value()) * float64(b.ActiveConnections()+1)
+		if best == nil || score < bestScore {
+			best, bestScore = b, score
+		}
+	}
+	return best
+}
+
+// leastConnections returns the healthy backend with the fewest active
+// connections. The scan starts after the previously selected backend to
+// spread ties.
+func (p *BaseServerPool) leastConnections(backends []*Backend) *Backend {
+	var best *Backend
+	n := uint64(len(backends))
+	start := p.current.Add(1)
+	for i := range n {
+		b := backends[(start+i)%n]
+		if !p.available(b) {
+			continue
+		}
+		if best == nil || b.ActiveConnections() < best.ActiveConnections() {
+			best = b
+		}
+	}
+	return best
+}
+
+// Policy returns the load balancing algorithm and whether sticky sessions
+// are enabled.
+func (p *BaseServerPool) Policy() (algorithm string, stickySessions bool) {
+	p.backendsMutex.Lock()
+	defer p.backendsMutex.Unlock()
+	return p.algorithm, p.stickySessions
+}
+
+// SetPolicy changes the load balancing algorithm and sticky session setting.
+// The change applies to the next backend selection.
+func (p *BaseServerPool) SetPolicy(algorithm string, stickySessions bool) error {
+	algorithm, err := validateAlgorithm(algorithm)
+	if err != nil {
+		return err
+	}
+
+	p.backendsMutex.Lock()
+	defer p.backendsMutex.Unlock()
+	p.algorithm = algorithm
+	p.stickySessions = stickySessions
+	p.policyChanged = true
+	p.publishSelection()
 	return nil
 }
 
-func (p *BaseServerPool) dashboardHandler(w http.ResponseWriter, _ *http.Request) {
-	if err := tmpl.Execute(w, p.backends); err != nil {
-		p.log.Printf("error executing template: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+// findNextHealthyBackend finds the next healthy backend starting from the given index.
+func (p *BaseServerPool) findNextHealthyBackend(backends []*Backend, start int) *Backend {
+	for i := 0; i < len(backends); i++ {
+		idx := (start + i) % len(backends)
+		if p.available(backends[idx]) {
+			return backends[idx]
+		}
 	}
+	return nil
 }
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -9,8 +13,48 @@ import (
 	"slices"
 	"strings"
 	"testing"
+	"time"
 )
 
+// startTestPool creates a pool with newPool listening on a loopback port and
+// proxying to backends, with its config changed by configure, marks every
+// backend healthy and starts it. The pool is shut down when the test ends.
+func startTestPool[P ServerPool](t *testing.T, newPool func(*log.Logger, *Config) (P, error), configure func(*Config), backends ...string) P {
+	t.Helper()
+	config := &Config{Addr: "127.0.0.1:0"}
+	for _, b := range backends {
+		config.Backends = append(config.Backends, BackendConfig{URL: b})
+	}
+	if configure != nil {
+		configure(config)
+	}
+	pool, err := newPool(log.New(io.Discard, "", 0), config)
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	for _, b := range pool.Backends() {
+		b.SetHealthy(true)
+	}
+	if err := pool.Start(); err != nil {
+		t.Fatalf("failed to start server pool: %v", err)
+	}
+	shutdownOnCleanup(t, pool)
+	return pool
+}
+
+// shutdownOnCleanup shuts pool down when the test ends. t.Context is already
+// cancelled by then, so the shutdown gets a context of its own.
+func shutdownOnCleanup(t *testing.T, pool interface{ Shutdown(context.Context) error }) {
+	t.Helper()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := pool.Shutdown(ctx); err != nil {
+			t.Errorf("failed to shut down server pool: %v", err)
+		}
+	})
+}
+
 func TestNext(t *testing.T) {
 	pool := &BaseServerPool{}
 	pool.AddBackend("http://localhost:8080")
@@ -91,6 +135,30 @@ func TestServerPoolNext_sticky(t *testing.T) {
 	}
 }
 
+func TestServerPoolNext_stickyIPPort(t *testing.T) {
+	pool := &BaseServerPool{stickySessions: true, stickyKey: StickyKeyIPPort}
+	pool.AddBackend("http://localhost:8080")
+	pool.AddBackend("http://localhost:8081")
+	for _, backend := range pool.backends {
+		backend.SetHealthy(true)
+	}
+
+	// Clients behind one NAT address are spread by source port, and each
+	// connection keeps its backend.
+	seen := make(map[*Backend]bool)
+	for port := 1000; port < 1020; port++ {
+		remoteAddr := &net.TCPAddr{IP: net.ParseIP("192.168.1.100"), Port: port}
+		b := pool.Next(remoteAddr)
+		if b == nil || pool.Next(remoteAddr) != b {
+			t.Fatalf("expected port %d to stick to one backend", port)
+		}
+		seen[b] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("expected clients sharing an IP to use both backends, got %d", len(seen))
+	}
+}
+
 func TestServerPoolNext_sticky_findsNextHealthy(t *testing.T) {
 	pool := &BaseServerPool{stickySessions: true}
 	pool.AddBackend("http://localhost:8080")
@@ -122,7 +190,7 @@ func Test_findNextHealthyBackend(t *testing.T) {
 	pool.backends[1].SetHealthy(false)
 	pool.backends[2].SetHealthy(true) // Mark backend at index 2 as healthy
 
-	backend := pool.findNextHealthyBackend(0) // Start from index 0
+	backend := pool.findNextHealthyBackend(pool.backends, 0) // Start from index 0
 	if backend == nil || backend != pool.backends[2] {
 		t.Errorf("expected backend %q, got %v", pool.backends[2].URL.String(), backend)
 	}
@@ -149,13 +217,12 @@ func Test_dashboardHandler_backendStatusColumns(t *testing.T) {
 	if resp.StatusCode != http.StatusOK {
 		t.Errorf("expected status 200, got %d", resp.StatusCode)
 	}
-	buf := make([]byte, 4096)
-	n, err := resp.Body.Read(buf)
-	if err != nil && err.Error() != "EOF" {
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
 		t.Errorf("failed to read response body: %v", err)
 	}
 
-	body := string(buf[:n])
+	body := string(buf)
 	backend1Status := fmt.Sprintf("<td class=\"server-name\">%s</td>\n"+
 		"            <td><span class=\"status up\"><span class=\"status-indicator\"></span>UP</span></td>", backend1)
 	if !strings.Contains(body, backend1Status) {
@@ -170,3 +237,442 @@ func Test_dashboardHandler_backendStatusColumns(t *testing.T) {
 		t.Errorf("expected html to contain timestamp of last update, got %q", body)
 	}
 }
+
+func TestServerPoolNext_leastLatency(t *testing.T) {
+	pool := &BaseServerPool{algorithm: AlgorithmLeastLatency}
+	pool.AddBackend("http://localhost:8080")
+	pool.AddBackend("http://localhost:8081")
+	pool.AddBackend("http://localhost:8082")
+
+	for _, b := range pool.backends {
+		b.SetHealthy(true)
+	}
+	pool.backends[0].DialLatency.Observe(30 * time.Millisecond)
+	pool.backends[1].DialLatency.Observe(10 * time.Millisecond)
+	pool.backends[2].DialLatency.Observe(20 * time.Millisecond)
+
+	for range 3 {
+		if b := pool.Next(&net.TCPAddr{}); b != pool.backends[1] {
+			t.Errorf("expected fastest backend %s, got %v", pool.backends[1].URL, b)
+		}
+	}
+
+	pool.backends[1].SetHealthy(false)
+	if b := pool.Next(&net.TCPAddr{}); b != pool.backends[2] {
+		t.Errorf("expected next fastest backend %s, got %v", pool.backends[2].URL, b)
+	}
+}
+
+func Test_validateAlgorithm(t *testing.T) {
+	if a, err := validateAlgorithm(""); err != nil || a != AlgorithmRoundRobin {
+		t.Errorf("expected default algorithm %q, got %q (%v)", AlgorithmRoundRobin, a, err)
+	}
+	if _, err := validateAlgorithm("random"); err == nil {
+		t.Errorf("expected error for unsupported algorithm")
+	}
+}
+
+func Test_validateStickyKey(t *testing.T) {
+	if k, err := validateStickyKey(""); err != nil || k != StickyKeyIP {
+		t.Errorf("expected default sticky key %q, got %q (%v)", StickyKeyIP, k, err)
+	}
+	if _, err := validateStickyKey("cookie"); err == nil {
+		t.Errorf("expected error for unsupported sticky key")
+	}
+}
+
+func Test_validateStickyHashing(t *testing.T) {
+	if h, err := validateStickyHashing(""); err != nil || h != StickyHashingModulo {
+		t.Errorf("expected default sticky hashing %q, got %q (%v)", StickyHashingModulo, h, err)
+	}
+	if _, err := validateStickyHashing("ring"); err == nil {
+		t.Errorf("expected error for unsupported sticky hashing")
+	}
+}
+
+func TestBaseServerPool_hashIndex(t *testing.T) {
+	pool := &BaseServerPool{}
+	pool.AddBackend("http://localhost:8080")
+	pool.AddBackend("http://localhost:8081")
+	pool.AddBackend("http://localhost:8082")
+	// A hash above 2^31 is negative as an int on 32-bit platforms.
+	hash := int(int32(-0x7fffffff))
+	if idx := pool.hashIndex(pool.backends, hash); idx != int(uint32(hash)%3) {
+		t.Errorf("expected the index of the hash as a uint32, got %d", idx)
+	}
+}
+
+func TestServerPoolNext_stickyConsistent(t *testing.T) {
+	urls := []string{"http://localhost:8080", "http://localhost:8081", "http://localhost:8082", "http://localhost:8083"}
+	newPool := func(urls ...string) *BaseServerPool {
+		pool := &BaseServerPool{stickySessions: true, stickyHashing: StickyHashingConsistent}
+		for _, url := range urls {
+			pool.AddBackend(url)
+		}
+		for _, b := range pool.backends {
+			b.SetHealthy(true)
+		}
+		return pool
+	}
+	pool := newPool(urls...)
+	reordered := newPool(urls[3], urls[1], urls[0], urls[2])
+	grown := newPool(append(urls, "http://localhost:8084")...)
+
+	moved := 0
+	for i := range 1000 {
+		client := &net.TCPAddr{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 5678}
+		b := pool.Next(client)
+		if got := reordered.Next(client); got.URL.String() != b.URL.String() {
+			t.Fatalf("expected %s whatever the order of backends, got %s", b.URL, got.URL)
+		}
+		if got := grown.Next(client); got.URL.String() != b.URL.String() {
+			if got.URL.Host != "localhost:8084" {
+				t.Fatalf("expected a client to move only to the added backend, got %s", got.URL)
+			}
+			moved++
+		}
+	}
+	if moved < 100 || moved > 300 {
+		t.Errorf("expected about a fifth of the clients to move, got %d", moved)
+	}
+}
+
+func TestServerPoolNext_leastResponseTime(t *testing.T) {
+	pool := &BaseServerPool{algorithm: AlgorithmLeastResponseTime}
+	pool.AddBackend("http://localhost:8080")
+	pool.AddBackend("http://localhost:8081")
+
+	for _, b := range pool.backends {
+		b.SetHealthy(true)
+	}
+	pool.backends[0].ResponseTime.Observe(10 * time.Millisecond)
+	pool.backends[1].ResponseTime.Observe(25 * time.Millisecond)
+
+	if b := pool.Next(&net.TCPAddr{}); b != pool.backends[0] {
+		t.Errorf("expected fastest backend %s, got %v", pool.backends[0].URL, b)
+	}
+
+	// Three active connections on the faster backend outweigh its lower latency.
+	for range 3 {
+		pool.backends[0].acquire()
+	}
+	if b := pool.Next(&net.TCPAddr{}); b != pool.backends[1] {
+		t.Errorf("expected less loaded backend %s, got %v", pool.backends[1].URL, b)
+	}
+}
+
+func TestServerPoolNext_maxConnections(t *testing.T) {
+	pool := &BaseServerPool{maxConnections: 1}
+	pool.AddBackend("http://localhost:8080")
+	pool.AddBackend("http://localhost:8081")
+
+	for _, b := range pool.backends {
+		b.SetHealthy(true)
+	}
+	pool.backends[0].acquire()
+
+	for range 2 {
+		if b := pool.Next(&net.TCPAddr{}); b != pool.backends[1] {
+			t.Errorf("expected backend below limit %s, got %v", pool.backends[1].URL, b)
+		}
+	}
+
+	pool.backends[1].acquire()
+	if b := pool.Next(&net.TCPAddr{}); b != nil {
+		t.Errorf("expected nil when all backends are saturated, got %v", b)
+	}
+}
+
+func TestServerPoolNext_localZone(t *testing.T) {
+	pool := &BaseServerPool{localZone: "a", zoneLabel: "zone"}
+	pool.addBackend(BackendConfig{URL: "http://localhost:8080", Labels: map[string]string{"zone": "b"}})
+	pool.addBackend(BackendConfig{URL: "http://localhost:8081", Labels: map[string]string{"zone": "a"}})
+	pool.addBackend(BackendConfig{URL: "http://localhost:8082", Labels: map[string]string{"zone": "a"}})
+
+	for _, b := range pool.backends {
+		b.SetHealthy(true)
+	}
+
+	for range 4 {
+		if b := pool.Next(&net.TCPAddr{}); b == nil || b.Labels["zone"] != "a" {
+			t.Errorf("expected local backend, got %v", b)
+		}
+	}
+
+	// Spill over to the remote zone once local backends are down.
+	pool.backends[1].SetHealthy(false)
+	pool.backends[2].SetHealthy(false)
+	if b := pool.Next(&net.TCPAddr{}); b != pool.backends[0] {
+		t.Errorf("expected remote backend %s, got %v", pool.backends[0].URL, b)
+	}
+}
+
+func TestServerPoolNext_stickyNoBackends(t *testing.T) {
+	pool := &BaseServerPool{stickySessions: true}
+	if b := pool.Next(&net.TCPAddr{IP: net.ParseIP("192.168.1.100")}); b != nil {
+		t.Errorf("expected nil, got %v", b)
+	}
+}
+
+func TestAddBackend_duplicate(t *testing.T) {
+	pool := &BaseServerPool{}
+	if err := pool.AddBackend("http://localhost:8080"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	err := pool.AddBackend("tcp://localhost:8080")
+	if !errors.Is(err, errDuplicateBackend) {
+		t.Errorf("expected duplicate backend error, got %v", err)
+	}
+	if len(pool.backends) != 1 {
+		t.Errorf("expected 1 backend, got %d", len(pool.backends))
+	}
+}
+
+func TestAddBackend_invalid(t *testing.T) {
+	pool := &BaseServerPool{}
+	if err := pool.AddBackend("localhost"); err == nil {
+		t.Errorf("expected error for backend without port")
+	}
+	if len(pool.backends) != 0 {
+		t.Errorf("expected no backends, got %d", len(pool.backends))
+	}
+}
+
+func TestAddBackend_afterHealthChecksStarted(t *testing.T) {
+	pool := &BaseServerPool{ready: make(chan struct{}), log: log.New(io.Discard, "", 0)}
+	pool.StartHealthChecks()
+
+	if err := pool.AddBackend("debug://blue"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !pool.backends[0].Healthy() {
+		t.Errorf("expected backend added at runtime to be health checked")
+	}
+}
+
+func TestServerPoolNext_leastConnections(t *testing.T) {
+	pool := &BaseServerPool{algorithm: AlgorithmLeastConnections}
+	pool.AddBackend("http://localhost:8080")
+	pool.AddBackend("http://localhost:8081")
+
+	for _, b := range pool.backends {
+		b.SetHealthy(true)
+	}
+	pool.backends[0].acquire()
+
+	for range 2 {
+		if b := pool.Next(&net.TCPAddr{}); b != pool.backends[1] {
+			t.Errorf("expected least loaded backend %s, got %v", pool.backends[1].URL, b)
+		}
+	}
+}
+
+func Test_dashboardHandler_listenerPanels(t *testing.T) {
+	pool := &BaseServerPool{}
+	pool.AddBackend("http://localhost:8080")
+	pool.AddBackend("http://localhost:8081")
+
+	for range 3 {
+		pool.stats.accept()()
+		pool.backends[0].acquire()()
+	}
+	pool.backends[1].acquire()()
+	pool.stats.reject()
+	defer pool.stats.accept()()
+
+	rec := httptest.NewRecorder()
+	pool.dashboardHandler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		`<span class="panel-value">1</span><span class="panel-label">Active Connections</span>`,
+		`Accept Rate (4 total)`,
+		`<span class="panel-value">0.02/s</span><span class="panel-label">Reject Rate (1 total)</span>`,
+		`<span class="bar-fill" style="width: 75.0%"></span>`,
+		`<span class="bar-value">1 (25.0%)</span>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected html to contain %q, got %q", want, body)
+		}
+	}
+}
+
+func TestBaseServerPool_dialTimeoutFor(t *testing.T) {
+	pool := &BaseServerPool{}
+	b1, _ := pool.addBackend(BackendConfig{URL: "tcp://localhost:8080"})
+	b2, err := pool.addBackend(BackendConfig{URL: "tcp://localhost:8081", DialTimeout: "500ms"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if got := pool.dialTimeoutFor(b1); got != defaultDialTimeout {
+		t.Errorf("expected default dial timeout %s, got %s", defaultDialTimeout, got)
+	}
+	pool.dialTimeout = 5 * time.Second
+	if got := pool.dialTimeoutFor(b1); got != 5*time.Second {
+		t.Errorf("expected pool dial timeout 5s, got %s", got)
+	}
+	if got := pool.dialTimeoutFor(b2); got != 500*time.Millisecond {
+		t.Errorf("expected backend dial timeout 500ms, got %s", got)
+	}
+
+	for _, timeout := range []string{"never", "0s", "-1s"} {
+		if _, err := pool.addBackend(BackendConfig{URL: "tcp://localhost:9000", DialTimeout: timeout}); err == nil {
+			t.Errorf("expected error for dial timeout %q", timeout)
+		}
+	}
+	if _, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{Addr: "127.0.0.1:0", DialTimeout: "soon"}); err == nil {
+		t.Errorf("expected error for invalid pool dial timeout")
+	}
+}
+
+func TestBaseServerPool_removeBackend(t *testing.T) {
+	pool := newConsoleTestPool("web", true)
+	pool.AddBackend("http://localhost:8081")
+	b, err := pool.removeBackend("localhost:8081")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	select {
+	case <-b.removed:
+	default:
+		t.Errorf("expected removed backend to be marked removed")
+	}
+	if len(pool.Backends()) != 1 {
+		t.Errorf("expected 1 backend, got %d", len(pool.Backends()))
+	}
+	if _, err := pool.removeBackend("localhost:8081"); err == nil {
+		t.Errorf("expected error removing unknown backend")
+	}
+}
+
+func TestAddBackend_hostPort(t *testing.T) {
+	pool := &BaseServerPool{protocol: "udp"}
+	if err := pool.AddBackend("[::1]:5353"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got := pool.backends[0].URL.String(); got != "udp://[::1]:5353" {
+		t.Errorf("expected backend to be normalized to udp://[::1]:5353, got %s", got)
+	}
+	if err := pool.AddBackend("udp://[::1]:5353"); !errors.Is(err, errDuplicateBackend) {
+		t.Errorf("expected the URL form to duplicate the host:port form, got %v", err)
+	}
+	if err := pool.AddBackend("tcp://[::1]:8080"); err == nil {
+		t.Errorf("expected error for a tcp backend on a udp listener")
+	}
+
+	hc := healthCheck{timeout: time.Second}
+	pool.backendHealthChecks = map[string]healthCheck{"[::1]:5353": hc}
+	if got := pool.healthCheckFor(pool.backends[0]); got.timeout != hc.timeout {
+		t.Errorf("expected health check keyed by host:port to apply, got %+v", got)
+	}
+}
+
+func TestServerPoolNext_noAllocations(t *testing.T) {
+	pool := &BaseServerPool{localZone: "a", zoneLabel: "zone"}
+	pool.AddBackend("http://localhost:8080")
+	pool.AddBackend("http://localhost:8081")
+	for _, b := range pool.backends {
+		b.SetHealthy(true)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { pool.Next(nil) }); allocs != 0 {
+		t.Errorf("expected no allocations per selection, got %.1f", allocs)
+	}
+	pool.addBackend(BackendConfig{URL: "tcp://localhost:8082", Labels: map[string]string{"host": "a.example"}})
+	pool.backends[2].SetHealthy(true)
+	if allocs := testing.AllocsPerRun(100, func() { pool.nextForHost(nil, "host", "a.example") }); allocs != 0 {
+		t.Errorf("expected no allocations per selection by host, got %.1f", allocs)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { pool.nextInGroup(nil, "host", "a.example") }); allocs != 0 {
+		t.Errorf("expected no allocations per selection by label, got %.1f", allocs)
+	}
+}
+
+// BenchmarkServerPool_select reports the allocations of each way of
+// selecting a backend. None allocates, except to lowercase a host with
+// capitals and to list the backends that are not degraded when a degraded
+// backend beyond its share gives way.
+func BenchmarkServerPool_select(b *testing.B) {
+	pool := &BaseServerPool{localZone: "a", zoneLabel: "zone"}
+	for i, zone := range []string{"a", "a", "b"} {
+		pool.addBackend(BackendConfig{
+			URL:    fmt.Sprintf("tcp://localhost:%d", 8080+i),
+			Labels: map[string]string{"zone": zone, "host": fmt.Sprintf("%d.example", i), "group": "g"},
+		})
+	}
+	for _, backend := range pool.backends {
+		backend.SetHealthy(true)
+	}
+	client := &net.TCPAddr{IP: net.ParseIP("192.168.1.100"), Port: 5678}
+	for name, sel := range map[string]func() *Backend{
+		"next":  func() *Backend { return pool.Next(client) },
+		"host":  func() *Backend { return pool.nextForHost(client, "host", "1.example") },
+		"group": func() *Backend { return pool.nextInGroup(client, "group", "g") },
+		"key":   func() *Backend { return pool.nextForKey("tenant") },
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if sel() == nil {
+					b.Fatal("expected a backend")
+				}
+			}
+		})
+	}
+}
+
+func TestServerPoolNext_concurrentMembership(t *testing.T) {
+	pool := &BaseServerPool{}
+	pool.AddBackend("http://localhost:8080")
+	pool.backends[0].SetHealthy(true)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 100 {
+			b, err := pool.addBackend(BackendConfig{URL: fmt.Sprintf("http://localhost:%d", 9000+i)})
+			if err != nil {
+				t.Errorf("failed to add backend: %v", err)
+				return
+			}
+			b.SetHealthy(true)
+			pool.removeBackend(b.ID)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if b := pool.Next(nil); b == nil || b.URL.Port() != "8080" {
+				t.Errorf("expected the remaining backend, got %v", b)
+			}
+			return
+		default:
+			if pool.Next(nil) == nil {
+				t.Fatalf("expected a backend while others are added and removed")
+			}
+		}
+	}
+}
+
+func TestBaseServerPool_Backends_snapshot(t *testing.T) {
+	pool := &BaseServerPool{}
+	pool.AddBackend("http://localhost:8080")
+	pool.AddBackend("http://localhost:8081")
+	pool.AddBackend("http://localhost:8082")
+
+	before := pool.Backends()
+	if _, err := pool.removeBackend("localhost:8080"); err != nil {
+		t.Fatalf("failed to remove backend: %v", err)
+	}
+	if len(before) != 3 || before[0].URL.Port() != "8080" || before[2].URL.Port() != "8082" {
+		t.Errorf("expected a snapshot to be unaffected by removals, got %v", before)
+	}
+	_ = append(pool.Backends(), before[0])
+	if after := pool.Backends(); len(after) != 2 || after[0].URL.Port() != "8081" {
+		t.Errorf("expected the remaining backends, got %v", after)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { pool.Backends() }); allocs != 0 {
+		t.Errorf("expected snapshots to be read without allocating, got %.1f", allocs)
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// protocolTCPUDP is the protocol of a listener serving the same port over
+// both TCP and UDP, such as DNS.
+const protocolTCPUDP = "tcp+udp"
+
+// listenerProtocols returns the transport protocols a listener binds.
+func listenerProtocols(protocol string) []string {
+	if protocol == protocolTCPUDP {
+		return []string{"tcp", "udp"}
+	}
+	return []string{protocol}
+}
+
+// servicePool serves one logical service over TCP and UDP on the same port
+// against the same backends. The backends are probed once, by the TCP pool,
+// and each UDP backend follows the health of the TCP backend with the same
+// address. Both pools start, drain and stop together, and the dashboard,
+// statistics and metrics cover both. Other admin API calls act on the TCP
+// pool.
+type servicePool struct {
+	*TCPServerPool
+	udp *UDPServerPool
+}
+
+// splitServiceConfig returns the configs of the TCP and UDP pools of a
+// tcp+udp listener. The UDP pool does not probe its backends, so it is
+// given no health check.
+func splitServiceConfig(config *Config) (tcp, udp *Config) {
+	tc, uc := *config, *config
+	tc.Protocol, uc.Protocol = "tcp", "udp"
+	uc.HealthCheck, uc.BackendHealthChecks, uc.DeepHealthCheck = nil, nil, nil
+	return &tc, &uc
+}
+
+func newServicePool(l *log.Logger, config *Config) (*servicePool, error) {
+	tcpConfig, udpConfig := splitServiceConfig(config)
+	tcp, err := NewTCPServerPool(log.New(l.Writer(), l.Prefix()+"[tcp] ", l.Flags()), tcpConfig)
+	if err != nil {
+		return nil, err
+	}
+	// A listener on an ephemeral port binds UDP on the port TCP was given.
+	if host, port, err := net.SplitHostPort(udpConfig.Addr); err == nil && port == "0" {
+		_, tcpPort, _ := net.SplitHostPort(tcp.listener.Addr().String())
+		udpConfig.Addr = net.JoinHostPort(host, tcpPort)
+	}
+	udp, err := NewUDPServerPool(log.New(l.Writer(), l.Prefix()+"[udp] ", l.Flags()), udpConfig)
+	if err != nil {
+		tcp.Shutdown(context.Background())
+		return nil, err
+	}
+	tcp.mirror = &udp.BaseServerPool
+	return &servicePool{TCPServerPool: tcp, udp: udp}, nil
+}
+
+// followHealth applies the health of b, a backend of another pool, to the
+// backend with the same address in p, if any. A nil pool follows nothing.
+func (p *BaseServerPool) followHealth(b *Backend, healthy bool) {
+	if p == nil {
+		return
+	}
+	if fb := p.findBackend(b.ID); fb != nil {
+		fb.setLastError(b.LastError())
+		fb.degradation.deepFailing.Store(b.degradation.deepFailing.Load())
+		fb.degradation.deepErr.Store(b.degradation.deepErr.Load())
+		fb.degradation.slow.Store(b.degradation.slow.Load())
+		p.setHealthy(fb, healthy)
+	}
+}
+
+// both runs f on the TCP and the UDP pool concurrently and joins their
+// errors.
+func (s *servicePool) both(f func(ServerPool) error) error {
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, pool := range []ServerPool{s.TCPServerPool, s.udp} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = f(pool)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// StartHealthChecks probes the backends through the TCP pool. The UDP pool
+// only follows its backend group's membership.
+func (s *servicePool) StartHealthChecks() {
+	s.TCPServerPool.StartHealthChecks()
+	s.udp.backendGroup.attach(&s.udp.BaseServerPool)
+}
+
+func (s *servicePool) Start() error {
+	if err := s.TCPServerPool.Start(); err != nil {
+		return err
+	}
+	return s.udp.Start()
+}
+
+func (s *servicePool) StopAccepting() error {
+	return errors.Join(s.TCPServerPool.StopAccepting(), s.udp.StopAccepting())
+}
+
+func (s *servicePool) Drain(ctx context.Context) error {
+	return s.both(func(p ServerPool) error { return p.Drain(ctx) })
+}
+
+func (s *servicePool) stopHealthChecks(ctx context.Context) error {
+	return s.both(func(p ServerPool) error { return p.stopHealthChecks(ctx) })
+}
+
+func (s *servicePool) Shutdown(ctx context.Context) error {
+	return s.both(func(p ServerPool) error { return p.Shutdown(ctx) })
+}
+
+func (s *servicePool) longConnectionGrace() time.Duration {
+	return max(s.TCPServerPool.longConnectionGrace(), s.udp.longConnectionGrace())
+}
+
+func (s *servicePool) attachShadow(config *Config) error {
+	if config.Protocol != protocolTCPUDP {
+		return fmt.Errorf("dry-run listener protocol %q does not match %q", config.Protocol, protocolTCPUDP)
+	}
+	tcp, udp := splitServiceConfig(config)
+	return errors.Join(s.TCPServerPool.attachShadow(tcp), s.udp.attachShadow(udp))
+}
+
+// restore restores the runtime state of both pools, adding backends added
+// at runtime to the UDP pool too.
+func (s *servicePool) restore(snap poolSnapshot) error {
+	err := s.TCPServerPool.restore(snap)
+	udp := snap
+	udp.Backends = make([]backendSnapshot, len(snap.Backends))
+	for i, bs := range snap.Backends {
+		bs.URL = strings.Replace(bs.URL, "tcp://", "udp://", 1)
+		udp.Backends[i] = bs
+	}
+	return errors.Join(err, s.udp.restore(udp))
+}
+
+// status reports the service as listening and ready only while both pools
+// are.
+func (s *servicePool) status() poolStatus {
+	st, us := s.TCPServerPool.status(), s.udp.status()
+	st.Listening = st.Listening && us.Listening
+	st.ShuttingDown = st.ShuttingDown || us.ShuttingDown
+	st.Ready = st.Ready && us.Ready
+	return st
+}
+
+func (s *servicePool) readyHandler(w http.ResponseWriter, _ *http.Request) {
+	st := s.status()
+	writeStatus(w, st, st.serving())
+}
+
+func (s *servicePool) healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	st := s.status()
+	writeStatus(w, st, st.alive())
+}
+
+func (s *servicePool) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	s.readyHandler(w, r)
+}
+
+// dashboard shows the connections of both pools, with the backends of each
+// protocol in their own rows.
+func (s *servicePool) dashboard(now time.Time) dashboardView {
+	view := s.TCPServerPool.dashboard(now)
+	udp := s.udp.dashboard(now)
+	view.Listener.Protocol = protocolTCPUDP
+	l, ul := &view.Listener.listenerView, udp.Listener.listenerView
+	l.ActiveConnections += ul.ActiveConnections
+	l.Accepted += ul.Accepted
+	l.Rejected += ul.Rejected
+	l.AcceptRate += ul.AcceptRate
+	l.RejectRate += ul.RejectRate
+	l.DeadPeers += ul.DeadPeers
+	view.Listener.Recent.Accepted = view.Listener.Recent.Accepted.add(udp.Listener.Recent.Accepted)
+	view.Listener.Recent.Rejected = view.Listener.Recent.Rejected.add(udp.Listener.Recent.Rejected)
+	view.Backends = append(view.Backends, udp.Backends...)
+	view.Quarantined = append(view.Quarantined, udp.Quarantined...)
+	var total uint64
+	for _, b := range view.Backends {
+		total += b.Connections
+	}
+	for i := range view.Backends {
+		view.Backends[i].Share = 0
+		if total > 0 {
+			view.Backends[i].Share = 100 * float64(view.Backends[i].Connections) / float64(total)
+		}
+	}
+	return view
+}
+
+func (s *servicePool) dashboardHandler(w http.ResponseWriter, _ *http.Request) {
+	t := s.tmpl
+	if t == nil {
+		t = tmpl
+	}
+	if err := t.Execute(w, s.dashboard(time.Now())); err != nil {
+		warnf(s.log, "error executing template: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+}
+
+// rollingStats sums the listener counters of both pools and lists the
+// backends of each.
+func (s *servicePool) rollingStats(now time.Time) statsView {
+	v, uv := s.TCPServerPool.rollingStats(now), s.udp.rollingStats(now)
+	v.Listener.Accepted = v.Listener.Accepted.add(uv.Listener.Accepted)
+	v.Listener.Rejected = v.Listener.Rejected.add(uv.Listener.Rejected)
+	v.Backends = append(v.Backends, uv.Backends...)
+	return v
+}
+
+func (s *servicePool) statsAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, s.rollingStats(time.Now()))
+}
+
+func (s *servicePool) resetStatsAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	now := time.Now()
+	s.TCPServerPool.resetStats(now)
+	s.udp.resetStats(now)
+	infof(s.log, "statistics reset")
+	writeJSON(w, http.StatusOK, s.rollingStats(now))
+}
+
+// backendsAPIHandler lists the backends of both pools.
+func (s *servicePool) backendsAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	views := []backendView{}
+	for _, b := range append(s.TCPServerPool.Backends(), s.udp.Backends()...) {
+		views = append(views, newBackendView(b))
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// addBackendAPIHandler adds a backend, given as host:port, to both pools.
+func (s *servicePool) addBackendAPIHandler(w http.ResponseWriter, r *http.Request) {
+	var config BackendConfig
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	if strings.Contains(config.URL, "://") {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("backend %s of a %s listener must be host:port", config.URL, protocolTCPUDP))
+		return
+	}
+	config.runtime = true
+	b, err := s.addBackend(config)
+	if errors.Is(err, errDuplicateBackend) {
+		writeError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if _, err := s.udp.addBackend(config); err != nil {
+		s.removeBackend(b.ID)
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	infof(s.log, "added backend %s (%s)", b.URL, b.ID)
+	writeJSON(w, http.StatusCreated, newBackendView(b))
+}
+
+// drainBackendAPIHandler drains a backend in both pools.
+func (s *servicePool) drainBackendAPIHandler(w http.ResponseWriter, r *http.Request) {
+	s.alsoUDP(w, r, s.TCPServerPool.drainBackendAPIHandler, s.udp.drainBackendAPIHandler)
+}
+
+// undrainBackendAPIHandler puts a drained backend back into rotation in
+// both pools.
+func (s *servicePool) undrainBackendAPIHandler(w http.ResponseWriter, r *http.Request) {
+	s.alsoUDP(w, r, s.TCPServerPool.undrainBackendAPIHandler, s.udp.undrainBackendAPIHandler)
+}
+
+// alsoUDP serves a request with the TCP pool's handler and, if it
+// succeeds, repeats it on the UDP pool, whose response is discarded.
+func (s *servicePool) alsoUDP(w http.ResponseWriter, r *http.Request, tcp, udp http.HandlerFunc) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	rec := newResponseBuffer()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	tcp(rec, r)
+	if rec.code < 300 {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		udp(newResponseBuffer(), r)
+	}
+	maps.Copy(w.Header(), rec.header)
+	w.WriteHeader(rec.code)
+	w.Write(rec.Bytes())
+}
+
+// responseBuffer is an http.ResponseWriter that keeps the response, so that
+// the responses of both pools can be combined.
+type responseBuffer struct {
+	bytes.Buffer
+	header http.Header
+	code   int
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{header: make(http.Header), code: http.StatusOK}
+}
+
+func (b *responseBuffer) Header() http.Header { return b.header }
+
+func (b *responseBuffer) WriteHeader(code int) { b.code = code }
+
+// metricsHandler serves the metrics of both pools, each sample labelled
+// with the transport of its pool.
+func (s *servicePool) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	tcp, udp := newResponseBuffer(), newResponseBuffer()
+	s.TCPServerPool.metricsHandler(tcp, r)
+	s.udp.metricsHandler(udp, r)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	mergeTransportMetrics(w, map[string]string{"tcp": tcp.String(), "udp": udp.String()})
+}
+
+// mergeTransportMetrics writes the metrics exposed by the pool of each
+// transport, adding a transport label to every sample, so that each metric
+// family is described once.
+func mergeTransportMetrics(w io.Writer, outputs map[string]string) {
+	type family struct {
+		header  []string
+		samples []string
+	}
+	families := make(map[string]*family)
+	var order []string
+	get := func(name string) *family {
+		f := families[name]
+		if f == nil {
+			f = &family{}
+			families[name] = f
+			order = append(order, name)
+		}
+		return f
+	}
+	for _, transport := range []string{"tcp", "udp"} {
+		var current *family
+		scanner := bufio.NewScanner(strings.NewReader(outputs[transport]))
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch fields := strings.Fields(line); {
+			case len(fields) == 0:
+			case fields[0] == "#":
+				if len(fields) < 3 {
+					continue
+				}
+				current = get(fields[2])
+				if !slices.Contains(current.header, line) {
+					current.header = append(current.header, line)
+				}
+			default:
+				if current == nil {
+					current = get(strings.FieldsFunc(fields[0], func(r rune) bool { return r == '{' })[0])
+				}
+				current.samples = append(current.samples, withLabel(line, "transport", transport))
+			}
+		}
+	}
+	for _, name := range order {
+		f := families[name]
+		for _, line := range append(f.header, f.samples...) {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+// withLabel adds a label to a metric sample.
+func withLabel(sample, name, value string) string {
+	i := strings.IndexAny(sample, "{ ")
+	if i < 0 {
+		return sample
+	}
+	label := fmt.Sprintf("%s=%q", name, value)
+	if sample[i] == '{' {
+		return sample[:i+1] + label + "," + sample[i+1:]
+	}
+	return sample[:i] + "{" + label + "}" + sample[i:]
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// runService reports whether nlb was started as a Windows service, which is
+// never the case on other platforms.
+func runService([]string) (bool, error) {
+	return false, nil
+}
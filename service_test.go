@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startDualEcho starts a backend echoing over both TCP and UDP on the same
+// port and returns its address.
+func startDualEcho(t *testing.T) string {
+	t.Helper()
+	addr := startTCPEcho(t)
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Skipf("could not bind udp on %s: %v", addr, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], from)
+		}
+	}()
+	return addr
+}
+
+func TestServicePool(t *testing.T) {
+	backend := startDualEcho(t)
+	var logs syncBuffer
+	pool, err := newServerPool(log.New(&logs, "", 0), &Config{
+		Addr:                "127.0.0.1:0",
+		Protocol:            protocolTCPUDP,
+		Backends:            []BackendConfig{{URL: backend}},
+		HealthcheckInterval: "20ms",
+	})
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	s := pool.(*servicePool)
+	s.StartHealthChecks()
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start server pool: %v", err)
+	}
+	shutdownOnCleanup(t, s)
+
+	tcpAddr, udpAddr := s.listener.Addr().(*net.TCPAddr), s.udp.conn.LocalAddr().(*net.UDPAddr)
+	if tcpAddr.Port != udpAddr.Port {
+		t.Fatalf("expected tcp and udp on the same port, got %d and %d", tcpAddr.Port, udpAddr.Port)
+	}
+	udpBackend := s.udp.Backends()[0]
+	waitFor(t, "the udp backend to follow the tcp probes", udpBackend.Healthy)
+	if !s.status().serving() {
+		t.Errorf("expected the service to be ready, got %+v", s.status())
+	}
+
+	conn, err := net.Dial("tcp", tcpAddr.String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	conn.Write([]byte("tcp"))
+	buf := make([]byte, 3)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "tcp" {
+		t.Errorf("expected tcp to be echoed, got %q, %v", buf, err)
+	}
+	conn.Close()
+
+	uc, err := net.Dial("udp", udpAddr.String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer uc.Close()
+	uc.Write([]byte("udp"))
+	uc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := uc.Read(buf); err != nil || string(buf[:n]) != "udp" {
+		t.Errorf("expected udp to be echoed, got %q, %v", buf[:n], err)
+	}
+
+	waitFor(t, "both connections to be counted", func() bool { return s.dashboard(time.Now()).Listener.Accepted == 2 })
+	view := s.dashboard(time.Now())
+	if view.Listener.Protocol != protocolTCPUDP || len(view.Backends) != 2 {
+		t.Errorf("expected a tcp+udp dashboard with a row per protocol, got %+v", view.Listener)
+	}
+	var stats statsView
+	rec := httptest.NewRecorder()
+	s.statsAPIHandler(rec, httptest.NewRequest("GET", "/api/stats", nil))
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatalf("failed to decode stats: %v", err)
+	}
+	if stats.Listener.Accepted.Total != 2 || len(stats.Backends) != 2 {
+		t.Errorf("expected stats of both protocols, got %+v", stats)
+	}
+	rec = httptest.NewRecorder()
+	s.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{`nlb_listener_accepted_connections_total{transport="tcp"} 1`, `nlb_listener_accepted_connections_total{transport="udp"} 1`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected metrics to contain %q", want)
+		}
+	}
+	if n := strings.Count(body, "# HELP nlb_listener_accepted_connections_total "); n != 1 {
+		t.Errorf("expected each metric to be described once, got %d", n)
+	}
+
+	// Draining a backend drains it over both protocols.
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/backends/"+udpBackend.ID+"/drain", strings.NewReader(`{"grace":"1m"}`))
+	req.SetPathValue("backend", udpBackend.ID)
+	s.drainBackendAPIHandler(rec, req)
+	if rec.Code != 202 {
+		t.Fatalf("expected status 202, got %d: %s", rec.Code, rec.Body)
+	}
+	if s.udp.available(udpBackend) || s.available(s.TCPServerPool.Backends()[0]) {
+		t.Errorf("expected the backend to be drained in both pools")
+	}
+
+	if err := s.Shutdown(t.Context()); err != nil {
+		t.Fatalf("failed to shut down: %v", err)
+	}
+	if s.status().Listening {
+		t.Errorf("expected the service to stop listening")
+	}
+}
+
+func Test_newServicePool_invalid(t *testing.T) {
+	_, err := newServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:     "127.0.0.1:0",
+		Protocol: protocolTCPUDP,
+		Backends: []BackendConfig{{URL: "tcp://127.0.0.1:53"}},
+	})
+	if err == nil {
+		t.Errorf("expected an error for a backend with a tcp scheme")
+	}
+}
+
+func Test_mergeTransportMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	mergeTransportMetrics(&buf, map[string]string{
+		"tcp": "# HELP a A.\n# TYPE a gauge\na 1\n# HELP b B.\n# TYPE b counter\nb{backend=\"x\"} 2\n",
+		"udp": "# HELP a A.\n# TYPE a gauge\na 3\n# HELP c C.\n# TYPE c gauge\nc 4\n",
+	})
+	want := "# HELP a A.\n# TYPE a gauge\na{transport=\"tcp\"} 1\na{transport=\"udp\"} 3\n" +
+		"# HELP b B.\n# TYPE b counter\nb{transport=\"tcp\",backend=\"x\"} 2\n" +
+		"# HELP c C.\n# TYPE c gauge\nc{transport=\"udp\"} 4\n"
+	if buf.String() != want {
+		t.Errorf("expected %q, got %q", want, buf.String())
+	}
+}
+
+func Test_selfTest_tcpUDP(t *testing.T) {
+	report, err := selfTest(t.Context(), &Config{Addr: "127.0.0.1:0", Protocol: protocolTCPUDP, Backends: []BackendConfig{{URL: "127.0.0.1:53"}}}, false)
+	if err != nil {
+		t.Fatalf("self-test failed: %v", err)
+	}
+	var targets []string
+	for _, c := range report.Checks {
+		if c.Check == "bind" {
+			targets = append(targets, c.Target)
+		}
+	}
+	if len(targets) != 2 || targets[0] != "tcp 127.0.0.1:0" || targets[1] != "udp 127.0.0.1:0" {
+		t.Errorf("expected a tcp and a udp bind check, got %v", targets)
+	}
+}
@@ -0,0 +1,104 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// serviceName is the name nlb registers with the service control manager
+// and the event log.
+const serviceName = "nlb"
+
+// eventID is the id of the events nlb reports to the event log.
+const eventID = 1
+
+// runService runs nlb as a Windows service if it was started by the service
+// control manager, returning once the service has stopped. It reports false
+// if nlb was started from a console.
+func runService(args []string) (bool, error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return false, fmt.Errorf("error detecting the service control manager: %w", err)
+	}
+	if !isService {
+		return false, nil
+	}
+	s := &windowsService{args: args}
+	if err := svc.Run(serviceName, s); err != nil {
+		return true, fmt.Errorf("error running service: %w", err)
+	}
+	return true, s.err
+}
+
+// windowsService runs nlb under the service control manager.
+type windowsService struct {
+	args []string
+	err  error
+}
+
+// Execute runs nlb until it shuts down, stopping it when the service
+// control manager asks to.
+func (s *windowsService) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	var elog *eventLog
+	if l, err := eventlog.Open(serviceName); err == nil {
+		elog = &eventLog{log: l}
+		defer l.Close()
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, elog, s.args) }()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case s.err = <-done:
+			if s.err != nil {
+				elog.error(fmt.Sprintf("nlb stopped: %v", s.err))
+				return true, 1
+			}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending, WaitHint: 30000}
+				cancel(errors.New("service stop requested"))
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			}
+		}
+	}
+}
+
+// eventLog writes log lines to the Windows event log. A nil eventLog
+// discards them.
+type eventLog struct {
+	log *eventlog.Log
+}
+
+func (e *eventLog) error(msg string) {
+	if e != nil {
+		e.log.Error(eventID, msg)
+	}
+}
+
+// Write reports each log line as an informational event.
+func (e *eventLog) Write(b []byte) (int, error) {
+	if e == nil {
+		return len(b), nil
+	}
+	msg := strings.TrimRight(strings.ReplaceAll(string(b), "\x00", ""), "\r\n")
+	if err := e.log.Info(eventID, msg); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
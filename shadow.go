@@ -0,0 +1,156 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// shadowRouter evaluates a candidate config alongside the active one: for
+// every connection it asks a shadow pool built from the candidate config
+// which backend it would choose, and logs when that differs from the
+// backend actually used. The shadow pool never routes traffic.
+type shadowRouter struct {
+	pool *BaseServerPool
+	// owned are the backends that only exist in the candidate config. They
+	// are health checked by the shadow pool; backends in both configs are
+	// shared with the active pool, along with their health and statistics.
+	owned []*Backend
+
+	matched  atomic.Uint64
+	differed atomic.Uint64
+}
+
+// newShadowRouter builds a shadow of active from the candidate listener
+// config.
+func newShadowRouter(l *log.Logger, config *Config, active *BaseServerPool) (*shadowRouter, error) {
+	if config.Protocol != active.protocol {
+		return nil, fmt.Errorf("dry-run listener protocol %q does not match %q", config.Protocol, active.protocol)
+	}
+	healthcheckInterval, err := time.ParseDuration(cmp.Or(config.HealthcheckInterval, "10s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid healthcheck interval: %w", err)
+	}
+	algorithm, err := validateAlgorithm(config.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	stickyKey, err := validateStickyKey(config.StickyKey)
+	if err != nil {
+		return nil, err
+	}
+	stickyHashing, err := validateStickyHashing(config.StickyHashing)
+	if err != nil {
+		return nil, err
+	}
+	breakerSettings, err := newCircuitBreakerSettings(config.CircuitBreaker)
+	if err != nil {
+		return nil, err
+	}
+	flaps, err := newFlapDetector(config.FlapDetection)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &shadowRouter{
+		pool: &BaseServerPool{
+			healthcheckInterval: healthcheckInterval,
+			stickySessions:      config.StickySessions,
+			stickyKey:           stickyKey,
+			stickyHashing:       stickyHashing,
+			algorithm:           algorithm,
+			maxConnections:      config.MaxConnections,
+			localZone:           config.LocalZone,
+			zoneLabel:           cmp.Or(config.ZoneLabel, "zone"),
+			breakerSettings:     breakerSettings,
+			flaps:               flaps,
+			log:                 log.New(l.Writer(), l.Prefix()+"[dry-run] ", l.Flags()),
+			protocol:            active.protocol,
+		},
+	}
+	if err := s.pool.initHealthChecks(active.protocol, config); err != nil {
+		return nil, err
+	}
+	backends, err := expandPortRanges(config.Backends)
+	if err != nil {
+		return nil, err
+	}
+	for _, bc := range backends {
+		u, err := parseBackendURL(bc.URL, active.protocol)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backend: %w", err)
+		}
+		if shared := active.findBackend(backendID(u)); shared != nil {
+			s.pool.backends = append(s.pool.backends, shared)
+			s.pool.publishSelection()
+			continue
+		}
+		b, err := s.pool.addBackend(bc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backend: %w", err)
+		}
+		s.owned = append(s.owned, b)
+	}
+	return s, nil
+}
+
+// compare logs the backend the candidate config would have chosen for a
+// connection if it differs from actual. host and label are set for
+// connections routed by their sniffed host.
+func (s *shadowRouter) compare(client net.Addr, label, host string, actual *Backend) {
+	if s == nil {
+		return
+	}
+	var candidate *Backend
+	if host != "" {
+		candidate = s.pool.nextForHost(client, label, host)
+	} else {
+		candidate = s.pool.Next(client)
+	}
+	if candidate == actual {
+		s.matched.Add(1)
+		return
+	}
+	s.differed.Add(1)
+	infof(s.pool.log, "connection from %s routed to %s, candidate config would route to %s",
+		client, backendName(actual), backendName(candidate))
+}
+
+func backendName(b *Backend) string {
+	if b == nil {
+		return "no backend"
+	}
+	return b.URL.Host
+}
+
+func (s *shadowRouter) startHealthChecks() {
+	if s == nil {
+		return
+	}
+	s.pool.checker = newHealthChecker(&s.pool.resources)
+	s.pool.healthChecksStarted.Store(true)
+	for _, b := range s.owned {
+		s.pool.startHealthCheck(b)
+	}
+}
+
+// attachShadow evaluates config as a dry run alongside the pool's own
+// config. It must be called before the pool starts.
+func (p *BaseServerPool) attachShadow(config *Config) error {
+	s, err := newShadowRouter(p.log, config, p)
+	if err != nil {
+		return err
+	}
+	p.shadow = s
+	var owned []string
+	for _, b := range s.owned {
+		owned = append(owned, b.URL.Host)
+	}
+	infof(p.log, "dry-run: evaluating candidate config (algorithm %s, %d backends, new: %s)",
+		s.pool.algorithm, len(s.pool.backends), cmp.Or(strings.Join(owned, ", "), "none"))
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestBaseServerPool_attachShadow(t *testing.T) {
+	pool := newConsoleTestPool("web", true)
+	var buf bytes.Buffer
+	pool.log = log.New(&buf, "", 0)
+
+	if err := pool.attachShadow(&Config{Protocol: "udp"}); err == nil {
+		t.Errorf("expected error for a candidate config with another protocol")
+	}
+	if err := pool.attachShadow(&Config{Protocol: "tcp", Algorithm: "fastest"}); err == nil {
+		t.Errorf("expected error for an invalid candidate algorithm")
+	}
+
+	err := pool.attachShadow(&Config{
+		Protocol: "tcp",
+		Backends: []BackendConfig{{URL: "http://localhost:8080"}, {URL: "http://localhost:8081"}},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	s := pool.shadow
+	if len(s.pool.backends) != 2 || s.pool.backends[0] != pool.backends[0] {
+		t.Fatalf("expected the existing backend to be shared, got %v", s.pool.backends)
+	}
+	if len(s.owned) != 1 || s.owned[0].URL.Host != "localhost:8081" {
+		t.Errorf("expected the new backend to be owned by the shadow pool, got %v", s.owned)
+	}
+	if len(pool.backends) != 1 {
+		t.Errorf("expected the active pool to be unchanged, got %d backends", len(pool.backends))
+	}
+	if !strings.Contains(buf.String(), "new: localhost:8081") {
+		t.Errorf("expected summary of the candidate config to be logged, got %q", buf.String())
+	}
+}
+
+func TestShadowRouter_compare(t *testing.T) {
+	var nilRouter *shadowRouter
+	nilRouter.compare(nil, "", "", nil)
+
+	pool := newConsoleTestPool("web", true)
+	var buf bytes.Buffer
+	pool.log = log.New(&buf, "", 0)
+	if err := pool.attachShadow(&Config{
+		Protocol: "tcp",
+		Backends: []BackendConfig{{URL: "http://localhost:8080"}},
+	}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	client := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	actual := pool.Next(client)
+	pool.shadow.compare(client, "", "", actual)
+	if pool.shadow.matched.Load() != 1 || pool.shadow.differed.Load() != 0 {
+		t.Errorf("expected a matching decision, got %d matched, %d differed",
+			pool.shadow.matched.Load(), pool.shadow.differed.Load())
+	}
+
+	// A candidate config without the active backend routes elsewhere.
+	pool = newConsoleTestPool("web", true)
+	buf.Reset()
+	pool.log = log.New(&buf, "", 0)
+	if err := pool.attachShadow(&Config{
+		Protocol: "tcp",
+		Backends: []BackendConfig{{URL: "http://localhost:8081"}},
+	}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	pool.shadow.pool.setHealthy(pool.shadow.owned[0], true)
+	pool.shadow.compare(client, "", "", pool.Next(client))
+	if pool.shadow.differed.Load() != 1 {
+		t.Errorf("expected a differing decision, got %d", pool.shadow.differed.Load())
+	}
+	if want := "routed to localhost:8080, candidate config would route to localhost:8081"; !strings.Contains(buf.String(), want) {
+		t.Errorf("expected log to contain %q, got %q", want, buf.String())
+	}
+}
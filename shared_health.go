@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Shared health requirements.
+const (
+	sharedHealthRequireAll = "all"
+	sharedHealthRequireAny = "any"
+)
+
+// sharedHealth combines the health checks of every backend on the same
+// host, across the pools that enable it, into one health state per host.
+// With requireAll a host is healthy while the latest probe of each of its
+// backends passed, otherwise while any did. Backends whose checks are
+// paused or whose health is forced keep their own state.
+type sharedHealth struct {
+	mux        sync.Mutex
+	configured bool
+	requireAll bool
+	// hosts maps each host to the latest probe result of its backends.
+	hosts map[string]map[*Backend]hostReport
+}
+
+// hostReport is the latest probe result of a backend in a pool.
+type hostReport struct {
+	pool    *BaseServerPool
+	healthy bool
+}
+
+func newSharedHealth() *sharedHealth {
+	return &sharedHealth{hosts: make(map[string]map[*Backend]hostReport)}
+}
+
+// join returns the shared health state for a pool with config, or nil if
+// the pool does not share health. The requirement is set by the first pool
+// to join; pools requiring otherwise are rejected. If h is nil the health
+// is only shared between the pool's own backends.
+func (h *sharedHealth) join(config *SharedHealthConfig) (*sharedHealth, error) {
+	if config == nil || !config.Enabled {
+		return nil, nil
+	}
+	var requireAll bool
+	switch config.Require {
+	case "", sharedHealthRequireAll:
+		requireAll = true
+	case sharedHealthRequireAny:
+	default:
+		return nil, fmt.Errorf("invalid shared_health require %q: must be %q or %q", config.Require, sharedHealthRequireAll, sharedHealthRequireAny)
+	}
+	if h == nil {
+		h = newSharedHealth()
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.configured && h.requireAll != requireAll {
+		return nil, fmt.Errorf("shared_health require %q conflicts with another listener", config.Require)
+	}
+	h.configured, h.requireAll = true, requireAll
+	return h, nil
+}
+
+// report records a probe of b, a backend of p, and applies the combined
+// health of its host to every backend on that host.
+func (h *sharedHealth) report(p *BaseServerPool, b *Backend, healthy bool) {
+	host := b.URL.Hostname()
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	reports := h.hosts[host]
+	if reports == nil {
+		reports = make(map[*Backend]hostReport)
+		h.hosts[host] = reports
+	}
+	reports[b] = hostReport{pool: p, healthy: healthy}
+
+	combined := h.requireAll
+	for rb, r := range reports {
+		select {
+		case <-rb.removed:
+			delete(reports, rb)
+			continue
+		default:
+		}
+		if h.requireAll {
+			combined = combined && r.healthy
+		} else {
+			combined = combined || r.healthy
+		}
+	}
+	for rb, r := range reports {
+		if forced, paused := rb.healthOverride(); forced == "" && (!paused || rb == b) {
+			r.pool.setHealthy(rb, combined)
+		}
+	}
+}
+
+// leave stops sharing the health of p's backends.
+func (h *sharedHealth) leave(p *BaseServerPool) {
+	if h == nil {
+		return
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	for host, reports := range h.hosts {
+		for b, r := range reports {
+			if r.pool == p {
+				delete(reports, b)
+			}
+		}
+		if len(reports) == 0 {
+			delete(h.hosts, host)
+		}
+	}
+}
+
+// setProbedHealth sets the backend's health from a probe, combined with the
+// other backends on its host if health is shared.
+func (p *BaseServerPool) setProbedHealth(b *Backend, healthy bool) {
+	if p.sharedHealth != nil {
+		p.sharedHealth.report(p, b, healthy)
+		return
+	}
+	p.setHealthy(b, healthy)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"log"
+	"testing"
+)
+
+func Test_sharedHealth_join(t *testing.T) {
+	h := newSharedHealth()
+	if joined, err := h.join(&SharedHealthConfig{}); joined != nil || err != nil {
+		t.Errorf("expected nil when disabled, got %v, %v", joined, err)
+	}
+	if _, err := h.join(&SharedHealthConfig{Enabled: true, Require: "most"}); err == nil {
+		t.Errorf("expected error for an invalid requirement")
+	}
+	if joined, err := h.join(&SharedHealthConfig{Enabled: true}); joined != h || err != nil || !h.requireAll {
+		t.Errorf("expected to join requiring all checks, got %v, %v", joined, err)
+	}
+	if _, err := h.join(&SharedHealthConfig{Enabled: true, Require: sharedHealthRequireAny}); err == nil {
+		t.Errorf("expected error for a conflicting requirement")
+	}
+	var unshared *sharedHealth
+	if joined, err := unshared.join(&SharedHealthConfig{Enabled: true, Require: sharedHealthRequireAny}); joined == nil || err != nil || joined.requireAll {
+		t.Errorf("expected a health state of the pool's own, got %v, %v", joined, err)
+	}
+}
+
+func TestSharedHealth_report(t *testing.T) {
+	for _, require := range []string{sharedHealthRequireAll, sharedHealthRequireAny} {
+		t.Run(require, func(t *testing.T) {
+			h, _ := newSharedHealth().join(&SharedHealthConfig{Enabled: true, Require: require})
+			newPool := func(protocol string, backends ...string) *BaseServerPool {
+				p := &BaseServerPool{protocol: protocol, sharedHealth: h, log: log.New(io.Discard, "", 0)}
+				for _, b := range backends {
+					p.AddBackend(b)
+				}
+				return p
+			}
+			tcp := newPool("tcp", "10.0.0.1:80", "10.0.0.2:80")
+			udp := newPool("udp", "10.0.0.1:53")
+			web, dns, other := tcp.backends[0], udp.backends[0], tcp.backends[1]
+
+			tcp.setProbedHealth(web, true)
+			if !web.Healthy() || dns.Healthy() {
+				t.Errorf("expected a backend to join its host's health with its first check")
+			}
+			udp.setProbedHealth(dns, true)
+			if !web.Healthy() || !dns.Healthy() {
+				t.Errorf("expected the host to be healthy while its checks pass")
+			}
+			udp.setProbedHealth(dns, false)
+			if want := require == sharedHealthRequireAny; web.Healthy() != want || dns.Healthy() != want {
+				t.Errorf("expected both backends of the host to be healthy=%t, got %t and %t", want, web.Healthy(), dns.Healthy())
+			}
+			if other.Healthy() {
+				t.Errorf("expected a backend on another host not to be affected")
+			}
+
+			// Forced backends keep their own health.
+			web.setHealthOverride(forceHealthy, false)
+			web.SetHealthy(true)
+			udp.setProbedHealth(dns, false)
+			tcp.setProbedHealth(web, false)
+			if !web.Healthy() || dns.Healthy() {
+				t.Errorf("expected the forced backend to stay healthy and the other to be down")
+			}
+			web.setHealthOverride("", false)
+
+			h.leave(udp)
+			tcp.setProbedHealth(web, true)
+			if !web.Healthy() || dns.Healthy() {
+				t.Errorf("expected a pool that left not to share health any more")
+			}
+		})
+	}
+}
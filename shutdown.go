@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Default shutdown phase timeouts.
+const (
+	defaultDrainTimeout        = 5 * time.Second
+	defaultExportersTimeout    = 2 * time.Second
+	defaultHealthChecksTimeout = 2 * time.Second
+	defaultConsoleTimeout      = 5 * time.Second
+)
+
+// shutdownTimeouts bounds each phase of shutdown.
+type shutdownTimeouts struct {
+	drain        time.Duration
+	exporters    time.Duration
+	healthChecks time.Duration
+	console      time.Duration
+	// report is how often the connections still draining are logged.
+	report time.Duration
+}
+
+func newShutdownTimeouts(cfg *ShutdownConfig) (shutdownTimeouts, error) {
+	t := shutdownTimeouts{
+		drain:        defaultDrainTimeout,
+		exporters:    defaultExportersTimeout,
+		healthChecks: defaultHealthChecksTimeout,
+		console:      defaultConsoleTimeout,
+		report:       defaultDrainReportInterval,
+	}
+	if cfg == nil {
+		return t, nil
+	}
+	for _, f := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"drain", cfg.Drain, &t.drain},
+		{"exporters", cfg.Exporters, &t.exporters},
+		{"health_checks", cfg.HealthChecks, &t.healthChecks},
+		{"console", cfg.Console, &t.console},
+		{"report_interval", cfg.ReportInterval, &t.report},
+	} {
+		if f.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(f.value)
+		if err != nil {
+			return t, fmt.Errorf("invalid shutdown %s timeout: %w", f.name, err)
+		}
+		if d <= 0 {
+			return t, fmt.Errorf("shutdown %s timeout must be positive", f.name)
+		}
+		*f.dst = d
+	}
+	return t, nil
+}
+
+// shutdownPhase is one step of an ordered shutdown.
+type shutdownPhase struct {
+	name    string
+	timeout time.Duration
+	stop    func(ctx context.Context) error
+}
+
+// shutdownManager stops components in the order their phases were added.
+// Each phase gets its own deadline, so a slow phase cannot eat into the time
+// of the phases after it.
+type shutdownManager struct {
+	log    *log.Logger
+	phases []shutdownPhase
+}
+
+func newShutdownManager(l *log.Logger) *shutdownManager {
+	return &shutdownManager{log: l}
+}
+
+// add appends a phase. A zero timeout means the phase is not bounded.
+func (m *shutdownManager) add(name string, timeout time.Duration, stop func(ctx context.Context) error) {
+	m.phases = append(m.phases, shutdownPhase{name: name, timeout: timeout, stop: stop})
+}
+
+// run runs every phase, logging its progress. A phase that fails or times
+// out does not prevent later phases from running; their errors are joined.
+func (m *shutdownManager) run() error {
+	start := time.Now()
+	var errs []error
+	for i, phase := range m.phases {
+		infof(m.log, "shutdown phase %d/%d: %s", i+1, len(m.phases), phase.name)
+		if err := m.runPhase(phase); err != nil {
+			warnf(m.log, "shutdown phase %s failed: %v", phase.name, err)
+			errs = append(errs, fmt.Errorf("%s: %w", phase.name, err))
+		}
+	}
+	infof(m.log, "shutdown completed in %s", time.Since(start).Round(time.Millisecond))
+	return errors.Join(errs...)
+}
+
+func (m *shutdownManager) runPhase(phase shutdownPhase) error {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if phase.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, phase.timeout)
+	}
+	defer cancel()
+
+	phaseStart := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- phase.stop(ctx) }()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			infof(m.log, "shutdown phase %s completed in %s", phase.name, time.Since(phaseStart).Round(time.Millisecond))
+		}
+		return err
+	case <-ctx.Done():
+		// Don't wait for a phase that ignores its deadline.
+		return fmt.Errorf("timed out after %s", phase.timeout)
+	}
+}
+
+// forEach runs f for every item concurrently and joins the errors.
+func forEach[T any](items []T, f func(T) error) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(items))
+	for i, item := range items {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = f(item)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
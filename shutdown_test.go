@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_newShutdownTimeouts(t *testing.T) {
+	timeouts, err := newShutdownTimeouts(nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if timeouts.drain != defaultDrainTimeout || timeouts.console != defaultConsoleTimeout {
+		t.Errorf("unexpected defaults %+v", timeouts)
+	}
+
+	timeouts, err = newShutdownTimeouts(&ShutdownConfig{Drain: "30s", HealthChecks: "1s", ReportInterval: "2s"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if timeouts.drain != 30*time.Second || timeouts.healthChecks != time.Second || timeouts.exporters != defaultExportersTimeout || timeouts.report != 2*time.Second {
+		t.Errorf("unexpected timeouts %+v", timeouts)
+	}
+
+	for _, cfg := range []*ShutdownConfig{{Drain: "forever"}, {Console: "0s"}, {Exporters: "-1s"}} {
+		if _, err := newShutdownTimeouts(cfg); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
+
+func TestShutdownManager(t *testing.T) {
+	var logs bytes.Buffer
+	m := newShutdownManager(log.New(&logs, "", 0))
+
+	var mux sync.Mutex
+	var order []string
+	record := func(name string) {
+		mux.Lock()
+		defer mux.Unlock()
+		order = append(order, name)
+	}
+	failed := errors.New("boom")
+	m.add("first", 0, func(context.Context) error {
+		record("first")
+		return failed
+	})
+	m.add("slow", 20*time.Millisecond, func(context.Context) error {
+		record("slow")
+		// Ignore the deadline; the manager must not wait for this.
+		time.Sleep(time.Second)
+		return nil
+	})
+	m.add("last", time.Second, func(ctx context.Context) error {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Errorf("expected phase to have a deadline")
+		}
+		record("last")
+		return nil
+	})
+
+	start := time.Now()
+	err := m.run()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected slow phase to be abandoned, took %s", elapsed)
+	}
+	if !errors.Is(err, failed) || !strings.Contains(err.Error(), "slow: timed out") {
+		t.Errorf("expected failed and timed out phases to be reported, got %v", err)
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if got := strings.Join(order, ","); got != "first,slow,last" {
+		t.Errorf("expected phases to run in order, got %s", got)
+	}
+	for _, want := range []string{"shutdown phase 1/3: first", "shutdown phase last completed", "shutdown completed"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("expected log to contain %q, got %q", want, logs.String())
+		}
+	}
+}
+
+func TestTCPServerPool_drain(t *testing.T) {
+	backend := startNamedBackend(t, "a")
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:     "127.0.0.1:0",
+		Backends: []BackendConfig{{URL: "tcp://" + backend}},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	pool.backends[0].SetHealthy(true)
+	pool.Start()
+
+	conn, err := net.Dial("tcp", pool.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 2)); err != nil {
+		t.Fatalf("failed to read greeting: %v", err)
+	}
+
+	if err := pool.StopAccepting(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := net.Dial("tcp", pool.listener.Addr().String()); err == nil {
+		t.Errorf("expected new connections to be refused")
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	if err := pool.Drain(ctx); err == nil {
+		t.Errorf("expected drain to time out while a connection is open")
+	}
+
+	conn.Close()
+	if err := pool.Drain(t.Context()); err != nil {
+		t.Errorf("expected drain to finish once the connection closed, got %v", err)
+	}
+	if err := pool.Shutdown(t.Context()); err != nil {
+		t.Errorf("expected repeated shutdown to succeed, got %v", err)
+	}
+}
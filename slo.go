@@ -0,0 +1,238 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSLOObjective   = 99.9
+	defaultSLOMinRequests = 10
+	// maxSLOWindow bounds the windows, whose counts are kept per minute.
+	maxSLOWindow = 24 * time.Hour
+)
+
+var defaultSLOWindows = []time.Duration{5 * time.Minute, time.Hour}
+
+// sloSettings holds the validated SLO config shared by every backend of a
+// pool.
+type sloSettings struct {
+	// objective is the fraction of requests that should succeed.
+	objective float64
+	// windows are sorted from shortest to longest.
+	windows     []time.Duration
+	maxBurnRate float64
+	minRequests uint64
+}
+
+// newSLOSettings validates config, returning nil if SLO tracking is not
+// enabled.
+func newSLOSettings(config *SLOConfig) (*sloSettings, error) {
+	if config == nil || !config.Enabled {
+		return nil, nil
+	}
+	s := &sloSettings{
+		objective:   cmp.Or(config.Objective, defaultSLOObjective) / 100,
+		windows:     defaultSLOWindows,
+		maxBurnRate: config.MaxBurnRate,
+		minRequests: defaultSLOMinRequests,
+	}
+	if s.objective <= 0 || s.objective >= 1 {
+		return nil, fmt.Errorf("slo objective must be between 0 and 100 exclusive")
+	}
+	if config.MaxBurnRate < 0 {
+		return nil, fmt.Errorf("slo max_burn_rate must not be negative")
+	}
+	if config.MinRequests < 0 {
+		return nil, fmt.Errorf("slo min_requests must not be negative")
+	} else if config.MinRequests > 0 {
+		s.minRequests = uint64(config.MinRequests)
+	}
+	if len(config.Windows) > 0 {
+		s.windows = nil
+		for _, w := range config.Windows {
+			d, err := time.ParseDuration(w)
+			if err != nil {
+				return nil, fmt.Errorf("invalid slo window: %w", err)
+			}
+			if d < time.Minute || d > maxSLOWindow || d%time.Minute != 0 {
+				return nil, fmt.Errorf("slo window %s must be a whole number of minutes up to %s", w, maxSLOWindow)
+			}
+			s.windows = append(s.windows, d)
+		}
+		slices.Sort(s.windows)
+		s.windows = slices.Compact(s.windows)
+	}
+	return s, nil
+}
+
+// sloTracker counts a backend's successful and failed requests, TCP dials
+// or UDP exchanges, per minute over the pool's longest SLO window. A nil
+// *sloTracker records nothing.
+type sloTracker struct {
+	settings *sloSettings
+
+	mux     sync.Mutex
+	minutes []int64
+	ok      []uint64
+	failed  []uint64
+
+	successes atomic.Uint64
+	failures  atomic.Uint64
+}
+
+func newSLOTracker(settings *sloSettings) *sloTracker {
+	if settings == nil {
+		return nil
+	}
+	n := int(settings.windows[len(settings.windows)-1] / time.Minute)
+	return &sloTracker{
+		settings: settings,
+		minutes:  make([]int64, n),
+		ok:       make([]uint64, n),
+		failed:   make([]uint64, n),
+	}
+}
+
+// record counts a request at now.
+func (t *sloTracker) record(now time.Time, success bool) {
+	if t == nil {
+		return
+	}
+	if success {
+		t.successes.Add(1)
+	} else {
+		t.failures.Add(1)
+	}
+	minute := now.Unix() / 60
+	i := int(minute % int64(len(t.minutes)))
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.minutes[i] != minute {
+		t.minutes[i], t.ok[i], t.failed[i] = minute, 0, 0
+	}
+	if success {
+		t.ok[i]++
+	} else {
+		t.failed[i]++
+	}
+}
+
+// window returns the requests and failures in the window ending at now.
+func (t *sloTracker) window(now time.Time, d time.Duration) (requests, failures uint64) {
+	minute := now.Unix() / 60
+	span := int64(d / time.Minute)
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	for i, m := range t.minutes {
+		if minute-m < span {
+			requests += t.ok[i] + t.failed[i]
+			failures += t.failed[i]
+		}
+	}
+	return requests, failures
+}
+
+// burnRate returns how fast the error budget is consumed over the window
+// ending at now: 1 spends exactly the budget over the window.
+func (t *sloTracker) burnRate(now time.Time, d time.Duration) (rate float64, requests uint64) {
+	requests, failures := t.window(now, d)
+	if requests == 0 {
+		return 0, 0
+	}
+	return float64(failures) / float64(requests) / (1 - t.settings.objective), requests
+}
+
+// exhausted reports whether the backend burns its error budget faster than
+// max_burn_rate over the shortest window, which takes it out of rotation.
+func (t *sloTracker) exhausted(now time.Time) bool {
+	if t == nil || t.settings.maxBurnRate == 0 {
+		return false
+	}
+	rate, requests := t.burnRate(now, t.settings.windows[0])
+	return requests >= t.settings.minRequests && rate > t.settings.maxBurnRate
+}
+
+// succeeded records a successful request in the backend's circuit breaker
+// and SLO.
+func (b *Backend) succeeded() {
+	b.breaker.Success()
+	b.slo.record(time.Now(), true)
+}
+
+// failed records a failed request in the backend's circuit breaker and SLO,
+// reporting whether it opened the circuit.
+func (b *Backend) failed() bool {
+	now := time.Now()
+	b.slo.record(now, false)
+	b.failuresRecent.Add(now)
+	return b.breaker.Failure()
+}
+
+// sloWindowView summarizes a backend's requests over one SLO window.
+type sloWindowView struct {
+	Window     string  `json:"window"`
+	Requests   uint64  `json:"requests"`
+	Failures   uint64  `json:"failures"`
+	ErrorRatio float64 `json:"error_ratio"`
+	BurnRate   float64 `json:"burn_rate"`
+}
+
+// sloBackendView summarizes a backend's SLO. BudgetRemaining is the
+// fraction of the error budget of the longest window left unspent; it is
+// negative once the budget is overspent.
+type sloBackendView struct {
+	ID              string          `json:"id"`
+	URL             string          `json:"url"`
+	Windows         []sloWindowView `json:"windows"`
+	BudgetRemaining float64         `json:"budget_remaining"`
+	Exhausted       bool            `json:"exhausted"`
+}
+
+// sloView is the JSON representation of the pool's SLO tracking.
+type sloView struct {
+	Objective   float64          `json:"objective"`
+	MaxBurnRate float64          `json:"max_burn_rate,omitempty"`
+	Backends    []sloBackendView `json:"backends"`
+}
+
+func newSLOBackendView(b *Backend, now time.Time) sloBackendView {
+	v := sloBackendView{ID: b.ID, URL: b.URL.String(), Exhausted: b.slo.exhausted(now)}
+	for _, d := range b.slo.settings.windows {
+		requests, failures := b.slo.window(now, d)
+		w := sloWindowView{Window: d.String(), Requests: requests, Failures: failures}
+		w.BurnRate, _ = b.slo.burnRate(now, d)
+		if requests > 0 {
+			w.ErrorRatio = float64(failures) / float64(requests)
+		}
+		v.Windows = append(v.Windows, w)
+		v.BudgetRemaining = 1 - w.BurnRate
+	}
+	return v
+}
+
+// sloAPIHandler summarizes each backend's success rate and error budget
+// consumption over the configured windows.
+func (p *BaseServerPool) sloAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	if p.sloSettings == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("slo tracking is not enabled"))
+		return
+	}
+	now := time.Now()
+	v := sloView{
+		Objective:   p.sloSettings.objective * 100,
+		MaxBurnRate: p.sloSettings.maxBurnRate,
+		Backends:    []sloBackendView{},
+	}
+	for _, b := range p.Backends() {
+		if b.slo != nil {
+			v.Backends = append(v.Backends, newSLOBackendView(b, now))
+		}
+	}
+	writeJSON(w, http.StatusOK, v)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func Test_newSLOSettings(t *testing.T) {
+	if s, err := newSLOSettings(&SLOConfig{}); s != nil || err != nil {
+		t.Errorf("expected nil when disabled, got %v, %v", s, err)
+	}
+	s, err := newSLOSettings(&SLOConfig{Enabled: true, Windows: []string{"1h", "5m", "1h"}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if s.objective < 0.9989 || s.objective > 0.9991 || s.minRequests != defaultSLOMinRequests {
+		t.Errorf("expected defaults, got objective %g and min_requests %d", s.objective, s.minRequests)
+	}
+	if !slices.Equal(s.windows, []time.Duration{5 * time.Minute, time.Hour}) {
+		t.Errorf("expected sorted, unique windows, got %v", s.windows)
+	}
+	for _, config := range []SLOConfig{
+		{Enabled: true, Objective: 100},
+		{Enabled: true, Objective: -1},
+		{Enabled: true, MaxBurnRate: -1},
+		{Enabled: true, MinRequests: -1},
+		{Enabled: true, Windows: []string{"30s"}},
+		{Enabled: true, Windows: []string{"90s"}},
+		{Enabled: true, Windows: []string{"48h"}},
+		{Enabled: true, Windows: []string{"a day"}},
+	} {
+		if _, err := newSLOSettings(&config); err == nil {
+			t.Errorf("expected error for %+v", config)
+		}
+	}
+}
+
+func TestSLOTracker(t *testing.T) {
+	settings, _ := newSLOSettings(&SLOConfig{Enabled: true, Objective: 99, Windows: []string{"1m", "10m"}, MaxBurnRate: 5})
+	tracker := newSLOTracker(settings)
+	now := time.Unix(6000, 0)
+	for i := range 100 {
+		tracker.record(now.Add(-5*time.Minute), i%50 != 0)
+	}
+	for i := range 20 {
+		tracker.record(now, i%5 != 0)
+	}
+
+	if requests, failures := tracker.window(now, time.Minute); requests != 20 || failures != 4 {
+		t.Errorf("expected 20 requests and 4 failures in the last minute, got %d and %d", requests, failures)
+	}
+	if requests, failures := tracker.window(now, 10*time.Minute); requests != 120 || failures != 6 {
+		t.Errorf("expected 120 requests and 6 failures in the last 10 minutes, got %d and %d", requests, failures)
+	}
+	// A 20% error ratio spends a 1% budget 20 times too fast.
+	if rate, _ := tracker.burnRate(now, time.Minute); rate < 19.99 || rate > 20.01 {
+		t.Errorf("expected burn rate 20, got %g", rate)
+	}
+	if !tracker.exhausted(now) {
+		t.Errorf("expected a burn rate above max_burn_rate to exhaust the backend")
+	}
+	if tracker.exhausted(now.Add(time.Minute)) {
+		t.Errorf("expected the backend to recover once the window has passed")
+	}
+	if tracker.successes.Load() != 114 || tracker.failures.Load() != 6 {
+		t.Errorf("expected 114 successes and 6 failures, got %d and %d", tracker.successes.Load(), tracker.failures.Load())
+	}
+
+	var nilTracker *sloTracker
+	nilTracker.record(now, false)
+	if nilTracker.exhausted(now) {
+		t.Errorf("expected a nil tracker never to be exhausted")
+	}
+}
+
+func TestBaseServerPool_sloAPIHandler(t *testing.T) {
+	pool := newConsoleTestPool("", true)
+	rec := httptest.NewRecorder()
+	pool.sloAPIHandler(rec, httptest.NewRequest("GET", "/api/slo", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 without slo tracking, got %d", rec.Code)
+	}
+
+	pool.sloSettings, _ = newSLOSettings(&SLOConfig{Enabled: true, MaxBurnRate: 10, MinRequests: 5})
+	b, _ := pool.addBackend(BackendConfig{URL: "http://localhost:8081"})
+	pool.setHealthy(b, true)
+	for range 5 {
+		b.failed()
+	}
+	if pool.available(b) {
+		t.Errorf("expected a backend burning its error budget not to be available")
+	}
+
+	rec = httptest.NewRecorder()
+	pool.sloAPIHandler(rec, httptest.NewRequest("GET", "/api/slo", nil))
+	var view sloView
+	if err := json.NewDecoder(rec.Body).Decode(&view); err != nil {
+		t.Fatalf("failed to decode view: %v", err)
+	}
+	if view.Objective != defaultSLOObjective || len(view.Backends) != 1 {
+		t.Fatalf("expected one tracked backend, got %+v", view)
+	}
+	v := view.Backends[0]
+	if !v.Exhausted || len(v.Windows) != 2 || v.Windows[0].Failures != 5 || v.Windows[0].ErrorRatio != 1 || v.BudgetRemaining >= 0 {
+		t.Errorf("unexpected backend view %+v", v)
+	}
+}
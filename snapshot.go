@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"time"
+)
+
+const defaultStateInterval = 30 * time.Second
+
+// runtimeSnapshot is the runtime state of every listener, saved to disk so
+// that it survives a restart.
+type runtimeSnapshot struct {
+	Time      time.Time               `json:"time"`
+	Listeners map[string]poolSnapshot `json:"listeners"`
+}
+
+// poolSnapshot is the state of one pool that is not described by the config:
+// a traffic policy changed through the admin API, backends added through the
+// admin API, what has been learned about each backend and the sticky
+// clients that failed over.
+type poolSnapshot struct {
+	Policy *policyView `json:"policy,omitempty"`
+	// ActiveGroup is the active blue/green group.
+	ActiveGroup string            `json:"active_group,omitempty"`
+	Backends    []backendSnapshot `json:"backends"`
+	// StickyRemaps are the sticky clients moved off a failed backend.
+	StickyRemaps []stickyRemapSnapshot `json:"sticky_remaps,omitempty"`
+}
+
+type backendSnapshot struct {
+	URL         string            `json:"url"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	DialTimeout string            `json:"dial_timeout,omitempty"`
+	TLS         *BackendTLSConfig `json:"tls,omitempty"`
+	// Runtime marks a backend added through the admin API. It is added again
+	// on restore; other backends are only restored if still configured.
+	Runtime bool `json:"runtime,omitempty"`
+	// ResponseTime is the backend's moving average response time in
+	// seconds, which seeds the least-response-time algorithm on restore.
+	ResponseTime float64 `json:"response_time,omitempty"`
+	// Forced and ChecksPaused are the backend's health override.
+	Forced       string `json:"forced,omitempty"`
+	ChecksPaused bool   `json:"checks_paused,omitempty"`
+}
+
+// snapshot returns the pool's runtime state.
+func (p *BaseServerPool) snapshot() poolSnapshot {
+	p.backendsMutex.Lock()
+	var snap poolSnapshot
+	if p.policyChanged {
+		snap.Policy = &policyView{Algorithm: p.algorithm, StickySessions: p.stickySessions}
+	}
+	p.backendsMutex.Unlock()
+	backends := p.Backends()
+	if p.blueGreen != nil {
+		snap.ActiveGroup = p.blueGreen.Active()
+	}
+
+	snap.Backends = []backendSnapshot{}
+	for _, b := range backends {
+		bs := backendSnapshot{
+			URL:          b.URL.String(),
+			Labels:       b.Labels,
+			TLS:          b.tls,
+			Runtime:      b.runtime,
+			ResponseTime: b.ResponseTime.Value().Seconds(),
+		}
+		if b.dialTimeout > 0 {
+			bs.DialTimeout = b.dialTimeout.String()
+		}
+		bs.Forced, bs.ChecksPaused = b.healthOverride()
+		snap.Backends = append(snap.Backends, bs)
+	}
+	snap.StickyRemaps = p.stickyFailover.snapshot()
+	return snap
+}
+
+// restore applies a snapshot to a newly created pool: the policy is
+// restored, runtime backends are added back and backends are seeded with
+// their learned response times and health overrides.
+func (p *BaseServerPool) restore(snap poolSnapshot) error {
+	var errs []error
+	if snap.Policy != nil {
+		if err := p.SetPolicy(snap.Policy.Algorithm, snap.Policy.StickySessions); err != nil {
+			errs = append(errs, fmt.Errorf("could not restore policy: %w", err))
+		}
+	}
+	if snap.ActiveGroup != "" && p.blueGreen != nil {
+		// The group was active before the restart, so it is not required
+		// to have passed a health check yet.
+		if _, err := p.switchGroup(snap.ActiveGroup, true, 0); err != nil {
+			errs = append(errs, fmt.Errorf("could not restore active group: %w", err))
+		}
+	}
+	for _, bs := range snap.Backends {
+		b := p.findBackend(bs.URL)
+		if b == nil && bs.Runtime {
+			var err error
+			b, err = p.addBackend(BackendConfig{URL: bs.URL, Labels: bs.Labels, DialTimeout: bs.DialTimeout, TLS: bs.TLS, runtime: true})
+			if err != nil {
+				errs = append(errs, fmt.Errorf("could not restore backend %s: %w", bs.URL, err))
+				continue
+			}
+		}
+		if b == nil {
+			continue
+		}
+		if bs.ResponseTime > 0 {
+			b.ResponseTime.Seed(time.Duration(bs.ResponseTime * float64(time.Second)))
+		}
+		if bs.Forced != "" || bs.ChecksPaused {
+			if err := p.overrideHealth(b, &bs.Forced, &bs.ChecksPaused); err != nil {
+				errs = append(errs, fmt.Errorf("could not restore health override of backend %s: %w", bs.URL, err))
+			}
+		}
+	}
+	p.stickyFailover.restore(p, snap.StickyRemaps)
+	return errors.Join(errs...)
+}
+
+// stateStore periodically saves the runtime state of the listeners to a
+// file and restores it at startup.
+type stateStore struct {
+	path     string
+	interval time.Duration
+	log      *log.Logger
+	// saved is the snapshot read at startup.
+	saved runtimeSnapshot
+
+	shutdown chan struct{}
+	done     chan struct{}
+}
+
+// newStateStore creates a store for config and reads the saved snapshot, if
+// any. It returns nil if state persistence is not configured. A snapshot
+// that cannot be read is logged and ignored, so a corrupt file does not stop
+// the balancer from starting.
+func newStateStore(l *log.Logger, config *StateConfig) (*stateStore, error) {
+	if config == nil || config.Path == "" {
+		return nil, nil
+	}
+	s := &stateStore{
+		path:     config.Path,
+		interval: defaultStateInterval,
+		log:      l,
+		shutdown: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if config.Interval != "" {
+		d, err := time.ParseDuration(config.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid state interval: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("state interval must be positive")
+		}
+		s.interval = d
+	}
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		warnf(l, "ignoring saved state: %v", err)
+		return s, nil
+	}
+	if err := json.Unmarshal(data, &s.saved); err != nil {
+		warnf(l, "ignoring saved state: could not decode %s: %v", s.path, err)
+		s.saved = runtimeSnapshot{}
+		return s, nil
+	}
+	infof(l, "restoring state saved at %s", s.saved.Time.Format(time.RFC3339))
+	return s, nil
+}
+
+// restore applies the saved state of the named listener to its pool.
+func (s *stateStore) restore(name string, pool ServerPool) {
+	if s == nil {
+		return
+	}
+	snap, ok := s.saved.Listeners[name]
+	if !ok {
+		return
+	}
+	if err := pool.restore(snap); err != nil {
+		warnf(s.log, "error restoring state of listener %q: %v", name, err)
+	}
+}
+
+// save writes the state of pools to the file.
+func (s *stateStore) save(now time.Time, pools []namedPool) error {
+	snap := runtimeSnapshot{Time: now, Listeners: make(map[string]poolSnapshot, len(pools))}
+	for _, np := range pools {
+		snap.Listeners[np.name] = np.pool.snapshot()
+	}
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode state: %w", err)
+	}
+	return writeFileAtomic(s.path, append(data, '\n'))
+}
+
+// Start begins saving the state of the pools returned by pools every
+// interval.
+func (s *stateStore) Start(pools func() []namedPool) {
+	if s == nil {
+		return
+	}
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				if err := s.save(now, pools()); err != nil {
+					warnf(s.log, "error saving state: %v", err)
+				}
+			case <-s.shutdown:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops saving periodically and saves the state of pools one last time.
+func (s *stateStore) Stop(pools []namedPool) error {
+	if s == nil {
+		return nil
+	}
+	close(s.shutdown)
+	<-s.done
+	return s.save(time.Now(), pools)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBaseServerPool_snapshotRestore(t *testing.T) {
+	pool := newConsoleTestPool("web", true)
+	if err := pool.SetPolicy(AlgorithmLeastResponseTime, false); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := pool.addBackend(BackendConfig{URL: "tcp://10.0.0.2:80", Labels: map[string]string{"zone": "a"}, DialTimeout: "1s", runtime: true}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	pool.backends[0].ResponseTime.Observe(20 * time.Millisecond)
+
+	snap := pool.snapshot()
+	if snap.Policy == nil || snap.Policy.Algorithm != AlgorithmLeastResponseTime {
+		t.Errorf("expected changed policy to be saved, got %+v", snap.Policy)
+	}
+	if len(snap.Backends) != 2 || snap.Backends[0].Runtime || !snap.Backends[1].Runtime {
+		t.Fatalf("expected configured and runtime backends, got %+v", snap.Backends)
+	}
+
+	// A configured backend that is no longer in the config is not restored.
+	snap.Backends = append(snap.Backends, backendSnapshot{URL: "http://10.0.0.3:80"})
+	restored := newConsoleTestPool("web", true)
+	if err := restored.restore(snap); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if algorithm, _ := restored.Policy(); algorithm != AlgorithmLeastResponseTime {
+		t.Errorf("expected policy to be restored, got %s", algorithm)
+	}
+	backends := restored.Backends()
+	if len(backends) != 2 {
+		t.Fatalf("expected runtime backend to be restored, got %d backends", len(backends))
+	}
+	if got := backends[0].ResponseTime.Value(); got != 20*time.Millisecond {
+		t.Errorf("expected response time to be seeded, got %s", got)
+	}
+	if b := backends[1]; !b.runtime || b.Labels["zone"] != "a" || b.dialTimeout != time.Second {
+		t.Errorf("expected runtime backend with its settings, got %+v", b)
+	}
+
+	if snap := newConsoleTestPool("web", true).snapshot(); snap.Policy != nil {
+		t.Errorf("expected unchanged policy not to be saved, got %+v", snap.Policy)
+	}
+}
+
+func TestStateStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	var logs bytes.Buffer
+	l := log.New(&logs, "", 0)
+
+	store, err := newStateStore(l, &StateConfig{Path: path, Interval: "10ms"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	pool := newConsoleTestPool("web", true)
+	pool.SetPolicy(AlgorithmLeastConnections, true)
+	pools := []namedPool{{"web", consoleTestPool{pool}}}
+	store.Start(func() []namedPool { return pools })
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected state to be saved periodically, got %v", err)
+	}
+	if err := store.Stop(pools); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	store, err = newStateStore(l, &StateConfig{Path: path})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	restored := newConsoleTestPool("web", true)
+	store.restore("web", consoleTestPool{restored})
+	store.restore("other", consoleTestPool{newConsoleTestPool("other", true)})
+	if algorithm, sticky := restored.Policy(); algorithm != AlgorithmLeastConnections || !sticky {
+		t.Errorf("expected policy to be restored, got %s, %t", algorithm, sticky)
+	}
+
+	os.WriteFile(path, []byte("{"), 0o600)
+	if store, err := newStateStore(l, &StateConfig{Path: path}); err != nil || len(store.saved.Listeners) != 0 {
+		t.Errorf("expected corrupt state to be ignored, got %v", err)
+	}
+	if !strings.Contains(logs.String(), "ignoring saved state") {
+		t.Errorf("expected corrupt state to be logged, got %q", logs.String())
+	}
+
+	if store, err := newStateStore(log.New(io.Discard, "", 0), nil); store != nil || err != nil {
+		t.Errorf("expected nil store when disabled, got %v, %v", store, err)
+	}
+	if _, err := newStateStore(l, &StateConfig{Path: path, Interval: "0s"}); err == nil {
+		t.Errorf("expected error for zero interval")
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Protocols detected by the sniffer.
+const (
+	sniffTLS  = "tls"
+	sniffHTTP = "http"
+	sniffTCP  = "tcp"
+)
+
+// Sniffing policies. Not every policy applies to every protocol.
+const (
+	SniffPassthrough = "passthrough"
+	SniffTerminate   = "terminate"
+	SniffRoute       = "route"
+	SniffReject      = "reject"
+)
+
+const (
+	defaultSniffTimeout = time.Second
+	// sniffBufferSize bounds how much of an HTTP request header is read to
+	// find its Host.
+	sniffBufferSize = 16 << 10
+)
+
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH", "PRI"}
+
+// sniffer peeks at the first bytes of TCP connections to tell TLS, HTTP and
+// raw TCP apart and applies the configured policy for each.
+type sniffer struct {
+	timeout   time.Duration
+	tlsPolicy string
+	http      string
+	tcp       string
+	hostLabel string
+	tlsConfig *tls.Config
+
+	counts map[string]*atomic.Uint64
+}
+
+func newSniffer(cfg *SniffConfig, tlsConfig *tls.Config) (*sniffer, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+	s := &sniffer{
+		timeout:   defaultSniffTimeout,
+		tlsPolicy: cfg.TLS,
+		http:      cfg.HTTP,
+		tcp:       cfg.TCP,
+		hostLabel: cfg.HostLabel,
+		tlsConfig: tlsConfig,
+		counts: map[string]*atomic.Uint64{
+			sniffTLS:  new(atomic.Uint64),
+			sniffHTTP: new(atomic.Uint64),
+			sniffTCP:  new(atomic.Uint64),
+		},
+	}
+	if cfg.Timeout != "" {
+		d, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sniff timeout: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("sniff timeout must be positive")
+		}
+		s.timeout = d
+	}
+	if s.hostLabel == "" {
+		s.hostLabel = "host"
+	}
+
+	switch s.tlsPolicy {
+	case "":
+		s.tlsPolicy = SniffPassthrough
+	case SniffPassthrough, SniffReject:
+	case SniffTerminate:
+		if tlsConfig == nil {
+			return nil, fmt.Errorf("sniff tls policy %q requires tls_cert_path and tls_key_path", SniffTerminate)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported sniff tls policy: %s", s.tlsPolicy)
+	}
+	switch s.http {
+	case "":
+		s.http = SniffRoute
+	case SniffRoute, SniffPassthrough, SniffReject:
+	default:
+		return nil, fmt.Errorf("unsupported sniff http policy: %s", s.http)
+	}
+	switch s.tcp {
+	case "":
+		s.tcp = SniffPassthrough
+	case SniffPassthrough, SniffReject:
+	default:
+		return nil, fmt.Errorf("unsupported sniff tcp policy: %s", s.tcp)
+	}
+	return s, nil
+}
+
+// peekedConn replays bytes peeked from the connection before reading from
+// the connection.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// CloseWrite shuts down the writing side of the connection, if it can.
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// sniff detects the protocol of conn and applies its policy. It returns the
+// connection to proxy, which replays any peeked bytes and is decrypted if TLS
+// was terminated, and the host the client asked for, if it is to be used for
+// routing. Clients that send nothing within the timeout are treated as raw
+// TCP, since some protocols wait for the server to speak first.
+func (s *sniffer) sniff(conn net.Conn) (net.Conn, string, error) {
+	br := bufio.NewReaderSize(conn, sniffBufferSize)
+	conn.SetReadDeadline(time.Now().Add(s.timeout))
+	protocol, host, err := s.detect(br)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, "", err
+	}
+	s.counts[protocol].Add(1)
+	sniffed := &peekedConn{Conn: conn, r: br}
+
+	switch protocol {
+	case sniffTLS:
+		switch s.tlsPolicy {
+		case SniffReject:
+			return nil, "", errors.New("tls connections are not allowed")
+		case SniffTerminate:
+			tlsConn := tls.Server(sniffed, s.tlsConfig)
+			ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+			defer cancel()
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				return nil, "", fmt.Errorf("tls handshake failed: %w", err)
+			}
+			return tlsConn, normalizeHost(tlsConn.ConnectionState().ServerName), nil
+		}
+		return sniffed, "", nil
+	case sniffHTTP:
+		switch s.http {
+		case SniffReject:
+			return nil, "", errors.New("http connections are not allowed")
+		case SniffRoute:
+			return sniffed, host, nil
+		}
+		return sniffed, "", nil
+	default:
+		if s.tcp == SniffReject {
+			return nil, "", errors.New("raw tcp connections are not allowed")
+		}
+		return sniffed, "", nil
+	}
+}
+
+// detect classifies the connection from the bytes buffered in br without
+// consuming them. For HTTP it also returns the request's Host.
+func (s *sniffer) detect(br *bufio.Reader) (string, string, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		if isTimeout(err) {
+			return sniffTCP, "", nil
+		}
+		return "", "", err
+	}
+	if first[0] == 0x16 { // TLS handshake record
+		return sniffTLS, "", nil
+	}
+
+	data := peekUntil(br, func(b []byte) bool { return httpPrefix(b) != prefixUndecided })
+	if httpPrefix(data) != prefixMatch {
+		return sniffTCP, "", nil
+	}
+	data = peekUntil(br, func(b []byte) bool { return bytes.Contains(b, []byte("\r\n\r\n")) })
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return sniffHTTP, "", nil
+	}
+	return sniffHTTP, normalizeHost(req.Host), nil
+}
+
+// peekUntil peeks at more and more of br until done reports true, the buffer
+// is full or reading fails, and returns the bytes peeked.
+func peekUntil(br *bufio.Reader, done func([]byte) bool) []byte {
+	for {
+		data, _ := br.Peek(br.Buffered())
+		if done(data) || len(data) == br.Size() {
+			return data
+		}
+		if _, err := br.Peek(len(data) + 1); err != nil {
+			data, _ = br.Peek(br.Buffered())
+			return data
+		}
+	}
+}
+
+const (
+	prefixUndecided = iota
+	prefixMatch
+	prefixMismatch
+)
+
+// httpPrefix reports whether b starts with an HTTP request method, or if
+// more bytes are needed to tell.
+func httpPrefix(b []byte) int {
+	undecided := false
+	for _, m := range httpMethods {
+		token := m + " "
+		if bytes.HasPrefix(b, []byte(token)) {
+			return prefixMatch
+		}
+		if len(b) < len(token) && strings.HasPrefix(token, string(b)) {
+			undecided = true
+		}
+	}
+	if undecided {
+		return prefixUndecided
+	}
+	return prefixMismatch
+}
+
+// normalizeHost lowercases host and strips any port.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Sniffed returns the number of connections detected as each protocol.
+func (s *sniffer) Sniffed() map[string]uint64 {
+	counts := make(map[string]uint64, len(s.counts))
+	for protocol, n := range s.counts {
+		counts[protocol] = n.Load()
+	}
+	return counts
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewSniffer(t *testing.T) {
+	s, err := newSniffer(nil, nil)
+	if err != nil || s != nil {
+		t.Errorf("expected nil sniffer when not configured, got %v, %v", s, err)
+	}
+
+	s, err = newSniffer(&SniffConfig{Enabled: true}, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if s.timeout != defaultSniffTimeout || s.tlsPolicy != SniffPassthrough || s.http != SniffRoute ||
+		s.tcp != SniffPassthrough || s.hostLabel != "host" {
+		t.Errorf("unexpected defaults %+v", s)
+	}
+
+	for _, cfg := range []*SniffConfig{
+		{Enabled: true, Timeout: "eventually"},
+		{Enabled: true, Timeout: "0s"},
+		{Enabled: true, TLS: SniffTerminate},
+		{Enabled: true, TLS: SniffRoute},
+		{Enabled: true, HTTP: SniffTerminate},
+		{Enabled: true, TCP: SniffRoute},
+	} {
+		if _, err := newSniffer(cfg, nil); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
+
+// sniffPipe sends data from the client end of a pipe and sniffs the server
+// end.
+func sniffPipe(t *testing.T, s *sniffer, data string) (net.Conn, string, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+	if data != "" {
+		go client.Write([]byte(data))
+	}
+	return s.sniff(server)
+}
+
+func TestSniffer_detect(t *testing.T) {
+	s, _ := newSniffer(&SniffConfig{Enabled: true, Timeout: "50ms"}, nil)
+	tests := []struct {
+		name     string
+		data     string
+		protocol string
+		host     string
+	}{
+		{"http", "GET / HTTP/1.1\r\nHost: Example.COM:8080\r\n\r\n", sniffHTTP, "example.com"},
+		{"http without host", "POST /x HTTP/1.0\r\n\r\n", sniffHTTP, ""},
+		{"tls", "\x16\x03\x01\x00\x05hello", sniffTLS, ""},
+		{"raw tcp", "SSH-2.0-OpenSSH_9.6\r\n", sniffTCP, ""},
+		{"short raw tcp", "GE", sniffTCP, ""},
+		{"silent client", "", sniffTCP, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := s.Sniffed()[tt.protocol]
+			conn, host, err := sniffPipe(t, s, tt.data)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if got := s.Sniffed()[tt.protocol]; got != before+1 {
+				t.Errorf("expected %s count %d, got %d", tt.protocol, before+1, got)
+			}
+			if host != tt.host {
+				t.Errorf("expected host %q, got %q", tt.host, host)
+			}
+			if tt.data == "" {
+				return
+			}
+
+			// The peeked bytes are replayed to the proxy.
+			buf := make([]byte, len(tt.data))
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				t.Fatalf("failed to read sniffed connection: %v", err)
+			}
+			if string(buf) != tt.data {
+				t.Errorf("expected %q, got %q", tt.data, buf)
+			}
+		})
+	}
+}
+
+func TestSniffer_policies(t *testing.T) {
+	s, _ := newSniffer(&SniffConfig{Enabled: true, Timeout: "50ms", TLS: SniffReject, HTTP: SniffPassthrough, TCP: SniffReject}, nil)
+
+	if _, _, err := sniffPipe(t, s, "\x16\x03\x01"); err == nil {
+		t.Errorf("expected tls connection to be rejected")
+	}
+	if _, _, err := sniffPipe(t, s, "SSH-2.0\r\n"); err == nil {
+		t.Errorf("expected raw tcp connection to be rejected")
+	}
+	_, host, err := sniffPipe(t, s, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if err != nil || host != "" {
+		t.Errorf("expected http to pass through without a host, got %q, %v", host, err)
+	}
+}
+
+func TestBaseServerPool_nextForHost(t *testing.T) {
+	pool := &BaseServerPool{}
+	pool.addBackend(BackendConfig{URL: "tcp://localhost:8080", Labels: map[string]string{"host": "a.example"}})
+	pool.addBackend(BackendConfig{URL: "tcp://localhost:8081", Labels: map[string]string{"host": "b.example"}})
+	pool.addBackend(BackendConfig{URL: "tcp://localhost:8082"})
+	for _, b := range pool.backends {
+		b.SetHealthy(true)
+	}
+
+	for range 3 {
+		if b := pool.nextForHost(&net.TCPAddr{}, "host", "b.example"); b != pool.backends[1] {
+			t.Errorf("expected %s, got %v", pool.backends[1].URL, b)
+		}
+	}
+	if b := pool.nextForHost(&net.TCPAddr{}, "host", "c.example"); b == nil {
+		t.Errorf("expected unknown host to use any backend")
+	}
+
+	pool.backends[0].SetHealthy(false)
+	if b := pool.nextForHost(&net.TCPAddr{}, "host", "a.example"); b != nil {
+		t.Errorf("expected no backend when the host's backends are down, got %s", b.URL)
+	}
+}
+
+// startNamedBackend starts a TCP backend that greets each client with its
+// name and then echoes what it receives.
+func startNamedBackend(t *testing.T, name string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte(name + "\n"))
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestTCPServerPool_sniff(t *testing.T) {
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr: "127.0.0.1:0",
+		Backends: []BackendConfig{
+			{URL: "tcp://" + startNamedBackend(t, "a"), Labels: map[string]string{"host": "a.example"}},
+			{URL: "tcp://" + startNamedBackend(t, "b"), Labels: map[string]string{"host": "b.example"}},
+		},
+		TLSCertPath: "testdata/test_cert.pem",
+		TLSKeyPath:  "testdata/test_key.pem",
+		Sniff:       &SniffConfig{Enabled: true, Timeout: "100ms", TLS: SniffTerminate},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, b := range pool.backends {
+		b.SetHealthy(true)
+	}
+	pool.Start()
+	defer pool.Shutdown(t.Context())
+	addr := pool.listener.Addr().String()
+
+	greeting := func(conn net.Conn) (string, *bufio.Reader) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		r := bufio.NewReader(conn)
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read greeting: %v", err)
+		}
+		return strings.TrimSpace(line), r
+	}
+
+	// HTTP is routed by Host and the request reaches the backend intact.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: b.example\r\n\r\n"))
+	name, r := greeting(conn)
+	if name != "b" {
+		t.Errorf("expected http request for b.example to reach b, got %q", name)
+	}
+	if line, _ := r.ReadString('\n'); line != "GET / HTTP/1.1\r\n" {
+		t.Errorf("expected request to be replayed, got %q", line)
+	}
+
+	// TLS is terminated and routed by SNI.
+	tlsConn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "a.example", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("failed to connect over tls: %v", err)
+	}
+	defer tlsConn.Close()
+	if name, _ := greeting(tlsConn); name != "a" {
+		t.Errorf("expected tls connection for a.example to reach a, got %q", name)
+	}
+
+	// A client waiting for the server to speak first is passed through.
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer raw.Close()
+	if name, _ := greeting(raw); name != "a" && name != "b" {
+		t.Errorf("expected a greeting from a backend, got %q", name)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// soakConnections returns the number of concurrent clients the soak tests
+// run, which $NLB_SOAK_CONNECTIONS raises to soak the data path, e.g.
+//
+//	NLB_SOAK_CONNECTIONS=5000 go test -race -run Soak
+func soakConnections(t *testing.T) int {
+	t.Helper()
+	if v := os.Getenv("NLB_SOAK_CONNECTIONS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			t.Fatalf("invalid NLB_SOAK_CONNECTIONS %q", v)
+		}
+		return n
+	}
+	if testing.Short() {
+		return 20
+	}
+	return 200
+}
+
+// startTCPEcho starts a TCP backend echoing everything it receives.
+func startTCPEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// soak runs n clients at once, each exchanging a payload of its own through
+// exchange, and fails the test if any reply is missing or carries another
+// client's data.
+func soak(t *testing.T, n int, exchange func(payload []byte) ([]byte, error)) {
+	t.Helper()
+	var (
+		wg     sync.WaitGroup
+		mux    sync.Mutex
+		failed []string
+	)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			payload := fmt.Appendf(nil, "client %d %s", i, time.Now().Format(time.RFC3339Nano))
+			reply, err := exchange(payload)
+			if err == nil && string(reply) != string(payload) {
+				err = fmt.Errorf("got %q", reply)
+			}
+			if err != nil {
+				mux.Lock()
+				failed = append(failed, fmt.Sprintf("client %d: %v", i, err))
+				mux.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(failed) > 0 {
+		t.Errorf("%d of %d exchanges failed, first: %s", len(failed), n, failed[0])
+	}
+}
+
+func TestSoak_tcp(t *testing.T) {
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:     "127.0.0.1:0",
+		Backends: []BackendConfig{{URL: "tcp://" + startTCPEcho(t)}, {URL: "tcp://" + startTCPEcho(t)}},
+	})
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	for _, b := range pool.backends {
+		b.SetHealthy(true)
+	}
+	if err := pool.Start(); err != nil {
+		t.Fatalf("failed to start server pool: %v", err)
+	}
+	shutdownOnCleanup(t, pool)
+
+	soak(t, soakConnections(t), func(payload []byte) ([]byte, error) {
+		conn, err := net.DialTimeout("tcp", pool.listener.Addr().String(), 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write(payload); err != nil {
+			return nil, err
+		}
+		reply := make([]byte, len(payload))
+		_, err = io.ReadFull(conn, reply)
+		return reply, err
+	})
+}
+
+func TestSoak_udp(t *testing.T) {
+	for name, flows := range map[string]*UDPFlowConfig{
+		"datagrams": nil,
+		"flows":     {Enabled: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			backend := startUDPResponder(t, func(b []byte) []byte { return b })
+			pool := startTestPool(t, NewUDPServerPool, func(c *Config) { c.UDPFlows = flows }, "udp://"+backend.LocalAddr().String())
+
+			soak(t, soakConnections(t), func(payload []byte) ([]byte, error) {
+				conn, err := net.DialUDP("udp", nil, pool.conn.LocalAddr().(*net.UDPAddr))
+				if err != nil {
+					return nil, err
+				}
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				// Datagrams lost under load are resent.
+				for range 5 {
+					if _, err := conn.Write(payload); err != nil {
+						return nil, err
+					}
+					conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+					n, err := conn.Read(buf)
+					if err == nil {
+						return buf[:n], nil
+					}
+				}
+				return nil, fmt.Errorf("no reply")
+			})
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol constants (RFC 1928).
+const (
+	socksVersion          = 5
+	socksMethodNoAuth     = 0x00
+	socksMethodNoAccept   = 0xff
+	socksCmdConnect       = 0x01
+	socksAddrIPv4         = 0x01
+	socksAddrDomain       = 0x03
+	socksAddrIPv6         = 0x04
+	socksSucceeded        = 0x00
+	socksGeneralFailure   = 0x01
+	socksCmdNotSupported  = 0x07
+	socksAddrNotSupported = 0x08
+)
+
+const defaultSocksHandshakeTimeout = 10 * time.Second
+
+// socksIngress accepts SOCKS5 CONNECT requests from clients and forwards
+// them through a backend egress node, itself a SOCKS5 proxy.
+type socksIngress struct {
+	handshakeTimeout time.Duration
+}
+
+func newSocksIngress(cfg *Socks5Config) (*socksIngress, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+	s := &socksIngress{handshakeTimeout: defaultSocksHandshakeTimeout}
+	if cfg.HandshakeTimeout != "" {
+		d, err := time.ParseDuration(cfg.HandshakeTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid socks5 handshake_timeout: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("socks5 handshake_timeout must be positive")
+		}
+		s.handshakeTimeout = d
+	}
+	return s, nil
+}
+
+// socksTarget is the destination of a CONNECT request.
+type socksTarget struct {
+	// raw is the address type, address and port as sent by the client, so
+	// they can be forwarded unchanged.
+	raw  []byte
+	addr string
+	// replied is set once the client has been sent a reply.
+	replied bool
+}
+
+// accept negotiates with a SOCKS5 client and reads its CONNECT request.
+// Unsupported requests are answered with an error reply.
+func (s *socksIngress) accept(conn net.Conn) (*socksTarget, error) {
+	conn.SetDeadline(time.Now().Add(s.handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported socks version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+	method := byte(socksMethodNoAccept)
+	for _, m := range methods {
+		if m == socksMethodNoAuth {
+			method = socksMethodNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return nil, err
+	}
+	if method == socksMethodNoAccept {
+		return nil, errors.New("client does not support unauthenticated socks5")
+	}
+
+	var req [3]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return nil, err
+	}
+	if req[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported socks version %d", req[0])
+	}
+	target, err := readSocksAddr(conn)
+	if err != nil {
+		if errors.Is(err, errSocksAddrType) {
+			writeSocksReply(conn, socksAddrNotSupported)
+		}
+		return nil, err
+	}
+	if req[1] != socksCmdConnect {
+		writeSocksReply(conn, socksCmdNotSupported)
+		return nil, fmt.Errorf("unsupported socks command %d", req[1])
+	}
+	return target, nil
+}
+
+// connect asks the egress node on upstream to connect to target and relays
+// its reply to the client. It returns an error if the connection could not
+// be established.
+func (s *socksIngress) connect(upstream, client net.Conn, target *socksTarget, timeout time.Duration) error {
+	upstream.SetDeadline(time.Now().Add(timeout))
+	defer upstream.SetDeadline(time.Time{})
+
+	if _, err := upstream.Write([]byte{socksVersion, 1, socksMethodNoAuth}); err != nil {
+		return err
+	}
+	var method [2]byte
+	if _, err := io.ReadFull(upstream, method[:]); err != nil {
+		return fmt.Errorf("error reading egress method: %w", err)
+	}
+	if method[0] != socksVersion || method[1] != socksMethodNoAuth {
+		return fmt.Errorf("egress rejected unauthenticated socks5")
+	}
+
+	req := append([]byte{socksVersion, socksCmdConnect, 0}, target.raw...)
+	if _, err := upstream.Write(req); err != nil {
+		return err
+	}
+	var reply [3]byte
+	if _, err := io.ReadFull(upstream, reply[:]); err != nil {
+		return fmt.Errorf("error reading egress reply: %w", err)
+	}
+	bound, err := readSocksAddr(upstream)
+	if err != nil {
+		return fmt.Errorf("error reading egress reply: %w", err)
+	}
+
+	target.replied = true
+	if _, err := client.Write(append(reply[:], bound.raw...)); err != nil {
+		return err
+	}
+	if reply[1] != socksSucceeded {
+		return fmt.Errorf("egress could not connect to %s: reply code %d", target.addr, reply[1])
+	}
+	return nil
+}
+
+var errSocksAddrType = errors.New("unsupported socks address type")
+
+// readSocksAddr reads an address type, address and port.
+func readSocksAddr(r io.Reader) (*socksTarget, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return nil, err
+	}
+	var addr []byte
+	switch atyp[0] {
+	case socksAddrIPv4:
+		addr = make([]byte, net.IPv4len)
+	case socksAddrIPv6:
+		addr = make([]byte, net.IPv6len)
+	case socksAddrDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return nil, err
+		}
+		addr = make([]byte, n[0])
+	default:
+		return nil, fmt.Errorf("%w %d", errSocksAddrType, atyp[0])
+	}
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return nil, err
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return nil, err
+	}
+
+	host := string(addr)
+	raw := append([]byte{atyp[0]}, addr...)
+	if atyp[0] == socksAddrDomain {
+		raw = append([]byte{atyp[0], byte(len(addr))}, addr...)
+	} else {
+		host = net.IP(addr).String()
+	}
+	return &socksTarget{
+		raw:  append(raw, port[:]...),
+		addr: net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))),
+	}, nil
+}
+
+// writeSocksReply sends a reply without a bound address, used for errors.
+func writeSocksReply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socksVersion, code, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
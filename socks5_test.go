@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+// startSocksEgress starts a minimal unauthenticated SOCKS5 server that
+// connects to the requested target, reporting each target it is asked for.
+func startSocksEgress(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	targets := make(chan string, 8)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 3)
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return
+				}
+				conn.Write([]byte{socksVersion, socksMethodNoAuth})
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return
+				}
+				target, err := readSocksAddr(conn)
+				if err != nil {
+					return
+				}
+				targets <- target.addr
+				upstream, err := net.Dial("tcp", target.addr)
+				if err != nil {
+					writeSocksReply(conn, 0x05) // connection refused
+					return
+				}
+				defer upstream.Close()
+				writeSocksReply(conn, socksSucceeded)
+				go func() {
+					io.Copy(upstream, conn)
+					upstream.(*net.TCPConn).CloseWrite()
+				}()
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return ln.Addr().String(), targets
+}
+
+// socksHandshake performs a CONNECT to target through the SOCKS5 server on
+// conn and returns the reply code.
+func socksHandshake(t *testing.T, conn net.Conn, cmd byte, target *net.TCPAddr) byte {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte{socksVersion, 1, socksMethodNoAuth})
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil || method[1] != socksMethodNoAuth {
+		t.Fatalf("expected no-auth method, got %v, %v", method, err)
+	}
+	req := []byte{socksVersion, cmd, 0, socksAddrIPv4}
+	req = append(req, target.IP.To4()...)
+	req = append(req, byte(target.Port>>8), byte(target.Port))
+	conn.Write(req)
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	return reply[1]
+}
+
+func TestTCPServerPool_socks5(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	egress1, targets1 := startSocksEgress(t)
+	egress2, targets2 := startSocksEgress(t)
+	pool := startTestPool(t, NewTCPServerPool, func(c *Config) { c.Socks5 = &Socks5Config{Enabled: true} }, "tcp://"+egress1, "tcp://"+egress2)
+
+	for range 2 {
+		conn, err := net.Dial("tcp", pool.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		if code := socksHandshake(t, conn, socksCmdConnect, target.Addr().(*net.TCPAddr)); code != socksSucceeded {
+			t.Fatalf("expected success, got reply code %d", code)
+		}
+		conn.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, []byte("ping")) {
+			t.Errorf("expected echo through the tunnel, got %q, %v", buf, err)
+		}
+		conn.Close()
+	}
+
+	// Round robin spreads the requests over both egress nodes.
+	for _, targets := range []<-chan string{targets1, targets2} {
+		select {
+		case addr := <-targets:
+			if addr != target.Addr().String() {
+				t.Errorf("expected egress to connect to %s, got %s", target.Addr(), addr)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("expected each egress node to receive a request")
+		}
+	}
+}
+
+func TestTCPServerPool_socks5Errors(t *testing.T) {
+	egress, _ := startSocksEgress(t)
+	pool := startTestPool(t, NewTCPServerPool, func(c *Config) { c.Socks5 = &Socks5Config{Enabled: true} }, "tcp://"+egress)
+	addr := pool.listener.Addr().String()
+	closed := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+
+	tests := []struct {
+		name    string
+		cmd     byte
+		healthy bool
+		want    byte
+	}{
+		{"unsupported command", 0x02, true, socksCmdNotSupported},
+		{"target refused", socksCmdConnect, true, 0x05},
+		{"no egress available", socksCmdConnect, false, socksGeneralFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool.backends[0].SetHealthy(tt.healthy)
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to connect: %v", err)
+			}
+			defer conn.Close()
+			if code := socksHandshake(t, conn, tt.cmd, closed); code != tt.want {
+				t.Errorf("expected reply code %d, got %d", tt.want, code)
+			}
+		})
+	}
+}
+
+func Test_readSocksAddr(t *testing.T) {
+	tests := []struct {
+		raw  []byte
+		addr string
+	}{
+		{[]byte{socksAddrIPv4, 10, 0, 0, 1, 0x01, 0xbb}, "10.0.0.1:443"},
+		{append([]byte{socksAddrDomain, 11}, append([]byte("example.com"), 0, 80)...), "example.com:80"},
+		{append(append([]byte{socksAddrIPv6}, net.ParseIP("::1")...), 0x1f, 0x90), "[::1]:8080"},
+	}
+	for _, tt := range tests {
+		target, err := readSocksAddr(bytes.NewReader(tt.raw))
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if target.addr != tt.addr || !bytes.Equal(target.raw, tt.raw) {
+			t.Errorf("expected %s (%v), got %s (%v)", tt.addr, tt.raw, target.addr, target.raw)
+		}
+	}
+	if _, err := readSocksAddr(bytes.NewReader([]byte{0x09})); err == nil {
+		t.Errorf("expected error for unknown address type")
+	}
+}
+
+func Test_newSocksIngress(t *testing.T) {
+	if s, err := newSocksIngress(&Socks5Config{}); s != nil || err != nil {
+		t.Errorf("expected nil ingress when disabled, got %v, %v", s, err)
+	}
+	if _, err := newSocksIngress(&Socks5Config{Enabled: true, HandshakeTimeout: "-1s"}); err == nil {
+		t.Errorf("expected error for negative handshake timeout")
+	}
+	_, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:   "127.0.0.1:0",
+		Socks5: &Socks5Config{Enabled: true},
+		Sniff:  &SniffConfig{Enabled: true},
+	})
+	if err == nil {
+		t.Errorf("expected error when socks5 and sniff are both enabled")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+)
+
+// Reasons a source filter rejects a client.
+const (
+	filterBogon  = "bogon"
+	filterASN    = "asn"
+	filterDenied = "denied"
+)
+
+// bogonPrefixes are the IPv4 ranges that are reserved, private or
+// unallocated and should never be the source of traffic from the internet.
+// IPv6 sources outside the global unicast range 2000::/3 are bogons as well.
+var bogonPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("2001:10::/28"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("3ffe::/16"),
+}
+
+var globalUnicast = netip.MustParsePrefix("2000::/3")
+
+// isBogon reports whether addr is in a reserved, private or unallocated
+// range.
+func isBogon(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.Is6() && !globalUnicast.Contains(addr) {
+		return true
+	}
+	return slices.ContainsFunc(bogonPrefixes, func(p netip.Prefix) bool { return p.Contains(addr) })
+}
+
+// sourceFilter rejects clients by their address before any work is done
+// for them: sources in bogon ranges on a listener exposed to the internet,
+// denied clients and clients in denied autonomous systems.
+type sourceFilter struct {
+	bogons bool
+	// allow exempts clients, such as internal health checkers, from the
+	// filter.
+	allow    []netip.Prefix
+	deny     []netip.Prefix
+	denyASNs []uint64
+	geoIP    *geoIP
+	// tarpit is nil unless rejected TCP connections are held rather than
+	// closed.
+	tarpit *tarpit
+
+	rejectedBogons atomic.Uint64
+	rejectedASNs   atomic.Uint64
+	rejectedDenied atomic.Uint64
+}
+
+func newSourceFilter(config *SourceFilterConfig, geoIP *geoIP) (*sourceFilter, error) {
+	if config == nil || (!config.Bogons && len(config.Deny) == 0 && len(config.DenyASNs) == 0) {
+		return nil, nil
+	}
+	if len(config.DenyASNs) > 0 && (geoIP == nil || geoIP.asn == nil) {
+		return nil, fmt.Errorf("source_filter deny_asns requires a geoip asn_db")
+	}
+	f := &sourceFilter{bogons: config.Bogons, denyASNs: config.DenyASNs, geoIP: geoIP}
+	for _, s := range config.Allow {
+		prefix, err := parsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source_filter allowed client %q: %w", s, err)
+		}
+		f.allow = append(f.allow, prefix)
+	}
+	for _, s := range config.Deny {
+		prefix, err := parsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source_filter denied client %q: %w", s, err)
+		}
+		f.deny = append(f.deny, prefix)
+	}
+	switch config.Action {
+	case "", filterActionReject:
+	case filterActionTarpit:
+		var err error
+		if f.tarpit, err = newTarpit(config.Tarpit); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid source_filter action %q: must be %q or %q", config.Action, filterActionReject, filterActionTarpit)
+	}
+	return f, nil
+}
+
+// reject returns why a client is rejected, or "" if it is not. A nil
+// sourceFilter rejects no one.
+func (f *sourceFilter) reject(client net.Addr) string {
+	if f == nil {
+		return ""
+	}
+	addr, ok := addrFromNetAddr(client)
+	if !ok || slices.ContainsFunc(f.allow, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+		return ""
+	}
+	if f.bogons && isBogon(addr) {
+		f.rejectedBogons.Add(1)
+		return filterBogon
+	}
+	if slices.ContainsFunc(f.deny, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+		f.rejectedDenied.Add(1)
+		return filterDenied
+	}
+	if len(f.denyASNs) > 0 {
+		if asn := f.geoIP.lookup(client).ASN; asn != 0 && slices.Contains(f.denyASNs, asn) {
+			f.rejectedASNs.Add(1)
+			return filterASN
+		}
+	}
+	return ""
+}
+
+// close closes a rejected client connection, or holds it in the tarpit if
+// there is one.
+func (f *sourceFilter) close(conn net.Conn) {
+	if f == nil {
+		conn.Close()
+		return
+	}
+	f.tarpit.trap(conn)
+}
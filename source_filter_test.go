@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_isBogon(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"10.1.2.3":        true,
+		"127.0.0.1":       true,
+		"100.64.0.1":      true,
+		"192.0.2.1":       true,
+		"224.0.0.1":       true,
+		"255.255.255.255": true,
+		"::ffff:10.0.0.1": true,
+		"::1":             true,
+		"fe80::1":         true,
+		"fd00::1":         true,
+		"2001:db8::1":     true,
+		"8.8.8.8":         false,
+		"::ffff:1.1.1.1":  false,
+		"2606:4700::1111": false,
+		"172.32.0.1":      false,
+	} {
+		if got := isBogon(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("expected %s to be a bogon: %v, got %v", addr, want, got)
+		}
+	}
+}
+
+func Test_newSourceFilter(t *testing.T) {
+	if f, err := newSourceFilter(nil, nil); f != nil || err != nil {
+		t.Errorf("expected no filter when not configured, got %v, %v", f, err)
+	}
+	if f, err := newSourceFilter(&SourceFilterConfig{Allow: []string{"10.0.0.1"}}, nil); f != nil || err != nil {
+		t.Errorf("expected no filter without rules, got %v, %v", f, err)
+	}
+	if _, err := newSourceFilter(&SourceFilterConfig{DenyASNs: []uint64{64500}}, nil); err == nil {
+		t.Errorf("expected an error denying ASNs without an ASN database")
+	}
+	if _, err := newSourceFilter(&SourceFilterConfig{Bogons: true, Allow: []string{"10.0.0.0/33"}}, nil); err == nil {
+		t.Errorf("expected an error for an invalid allowed client")
+	}
+	if _, err := newSourceFilter(&SourceFilterConfig{Deny: []string{"bad"}}, nil); err == nil {
+		t.Errorf("expected an error for an invalid denied client")
+	}
+	if _, err := newSourceFilter(&SourceFilterConfig{Bogons: true, Action: "drop"}, nil); err == nil {
+		t.Errorf("expected an error for an invalid action")
+	}
+}
+
+func TestSourceFilter_reject(t *testing.T) {
+	g, err := newGeoIP(&GeoIPConfig{Enabled: true, ASNDB: writeTestMMDB(t, map[string]map[string]any{
+		"8.8.8.0/24": {"autonomous_system_number": uint32(15169)},
+		"1.1.1.0/24": {"autonomous_system_number": uint32(13335)},
+	})})
+	if err != nil {
+		t.Fatalf("failed to create geoip: %v", err)
+	}
+	f, err := newSourceFilter(&SourceFilterConfig{Bogons: true, Deny: []string{"9.9.9.0/24"}, DenyASNs: []uint64{15169}, Allow: []string{"10.1.0.0/16"}}, g)
+	if err != nil {
+		t.Fatalf("failed to create filter: %v", err)
+	}
+	for addr, want := range map[string]string{
+		"10.2.0.1": filterBogon,
+		"10.1.0.1": "",
+		"8.8.8.8":  filterASN,
+		"1.1.1.1":  "",
+		"9.9.9.9":  filterDenied,
+		"9.9.8.9":  "",
+	} {
+		if got := f.reject(&net.TCPAddr{IP: net.ParseIP(addr)}); got != want {
+			t.Errorf("expected %s to be rejected as %q, got %q", addr, want, got)
+		}
+	}
+	if f.rejectedBogons.Load() != 1 || f.rejectedASNs.Load() != 1 {
+		t.Errorf("expected 1 rejection for each reason, got %d and %d", f.rejectedBogons.Load(), f.rejectedASNs.Load())
+	}
+
+	var none *sourceFilter
+	if got := none.reject(&net.TCPAddr{IP: net.ParseIP("10.0.0.1")}); got != "" {
+		t.Errorf("expected a nil filter to reject no one, got %q", got)
+	}
+}
+
+func TestTCPServerPool_sourceFilter(t *testing.T) {
+	newPool := func(filter *SourceFilterConfig) *TCPServerPool {
+		config := &Config{
+			Addr:         "127.0.0.1:0",
+			Backends:     []BackendConfig{{URL: "tcp://" + startNamedBackend(t, "a")}},
+			SourceFilter: filter,
+		}
+		pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), config)
+		if err != nil {
+			t.Fatalf("failed to create server pool: %v", err)
+		}
+		pool.backends[0].SetHealthy(true)
+		if err := pool.Start(); err != nil {
+			t.Fatalf("failed to start server pool: %v", err)
+		}
+		shutdownOnCleanup(t, pool)
+		return pool
+	}
+	greeting := func(pool *TCPServerPool) (string, error) {
+		conn, err := net.Dial("tcp", pool.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 2)
+		_, err = io.ReadFull(conn, buf)
+		return string(buf), err
+	}
+
+	// Loopback clients are bogons.
+	pool := newPool(&SourceFilterConfig{Bogons: true})
+	if _, err := greeting(pool); err == nil {
+		t.Errorf("expected a connection from a bogon to be closed")
+	}
+	rec := httptest.NewRecorder()
+	pool.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if want := `nlb_source_filter_rejected_total{reason="bogon"} 1`; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("expected metrics to contain %q", want)
+	}
+
+	pool = newPool(&SourceFilterConfig{Bogons: true, Allow: []string{"127.0.0.1"}})
+	if got, err := greeting(pool); err != nil || got != "a\n" {
+		t.Errorf("expected an allowed client to reach the backend, got %q, %v", got, err)
+	}
+}
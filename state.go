@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stateView is the full pool state returned by /api/state.
+type stateView struct {
+	Time     time.Time          `json:"time"`
+	Config   configSummary      `json:"config"`
+	Status   poolStatus         `json:"status"`
+	Listener listenerView       `json:"listener"`
+	Backends []backendStateView `json:"backends"`
+}
+
+// configSummary describes the settings the pool is currently running with.
+type configSummary struct {
+	Algorithm           string `json:"algorithm"`
+	StickySessions      bool   `json:"sticky_sessions"`
+	StickyKey           string `json:"sticky_key,omitempty"`
+	StickyHashing       string `json:"sticky_hashing,omitempty"`
+	MaxConnections      int64  `json:"max_connections"`
+	LocalZone           string `json:"local_zone,omitempty"`
+	ZoneLabel           string `json:"zone_label,omitempty"`
+	HealthcheckInterval string `json:"healthcheck_interval"`
+	WaitForReady        bool   `json:"wait_for_ready"`
+}
+
+// backendStateView extends backendView with connection and latency
+// statistics. Latencies are in seconds.
+type backendStateView struct {
+	backendView
+	TotalConnections    uint64            `json:"total_connections"`
+	ResponseTime        float64           `json:"response_time"`
+	DialLatencyP50      float64           `json:"dial_latency_p50"`
+	DialLatencyP99      float64           `json:"dial_latency_p99"`
+	FirstByteLatencyP50 float64           `json:"first_byte_latency_p50"`
+	FirstByteLatencyP99 float64           `json:"first_byte_latency_p99"`
+	HealthHistory       healthHistoryView `json:"health_history"`
+}
+
+func (p *BaseServerPool) state(now time.Time) stateView {
+	algorithm, sticky := p.Policy()
+	state := stateView{
+		Time: now,
+		Config: configSummary{
+			Algorithm:           algorithm,
+			StickySessions:      sticky,
+			StickyKey:           p.stickyKey,
+			StickyHashing:       p.stickyHashing,
+			MaxConnections:      p.maxConnections,
+			LocalZone:           p.localZone,
+			ZoneLabel:           p.zoneLabel,
+			HealthcheckInterval: p.healthcheckInterval.String(),
+			WaitForReady:        p.waitForReady,
+		},
+		Status:   p.status(),
+		Listener: p.stats.view(now),
+		Backends: []backendStateView{},
+	}
+	for _, b := range p.Backends() {
+		state.Backends = append(state.Backends, backendStateView{
+			backendView:         newBackendView(b),
+			TotalConnections:    b.TotalConnections(),
+			ResponseTime:        b.ResponseTime.Value().Seconds(),
+			DialLatencyP50:      b.DialLatency.Percentile(50).Seconds(),
+			DialLatencyP99:      b.DialLatency.Percentile(99).Seconds(),
+			FirstByteLatencyP50: b.FirstByteLatency.Percentile(50).Seconds(),
+			FirstByteLatencyP99: b.FirstByteLatency.Percentile(99).Seconds(),
+			HealthHistory:       newHealthHistoryView(b, now),
+		})
+	}
+	return state
+}
+
+// stateAPIHandler returns the full pool state as JSON, or the backend table
+// as CSV when requested with ?format=csv or an Accept: text/csv header.
+func (p *BaseServerPool) stateAPIHandler(w http.ResponseWriter, r *http.Request) {
+	state := p.state(time.Now())
+
+	format := r.URL.Query().Get("format")
+	if format == "" && strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		format = "csv"
+	}
+	switch format {
+	case "", "json":
+		writeJSON(w, http.StatusOK, state)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="nlb-state.csv"`)
+		writeStateCSV(w, state.Backends)
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unsupported format %q: must be json or csv", format))
+	}
+}
+
+var stateCSVHeader = []string{
+	"id", "url", "healthy", "error", "labels", "active_connections", "total_connections",
+	"bytes_sent", "bytes_received", "response_time", "dial_latency_p50", "dial_latency_p99",
+	"first_byte_latency_p50", "first_byte_latency_p99",
+}
+
+// writeStateCSV writes one row per backend. Labels are rendered as
+// semicolon-separated key=value pairs, sorted by key.
+func writeStateCSV(w http.ResponseWriter, backends []backendStateView) {
+	cw := csv.NewWriter(w)
+	cw.Write(stateCSVHeader)
+	for _, b := range backends {
+		var labels []string
+		for _, k := range slices.Sorted(maps.Keys(b.Labels)) {
+			labels = append(labels, k+"="+b.Labels[k])
+		}
+		cw.Write([]string{
+			b.ID,
+			b.URL,
+			strconv.FormatBool(b.Healthy),
+			b.Error,
+			strings.Join(labels, ";"),
+			strconv.FormatInt(b.ActiveConnections, 10),
+			strconv.FormatUint(b.TotalConnections, 10),
+			strconv.FormatUint(b.BytesSent, 10),
+			strconv.FormatUint(b.BytesReceived, 10),
+			formatFloat(b.ResponseTime),
+			formatFloat(b.DialLatencyP50),
+			formatFloat(b.DialLatencyP99),
+			formatFloat(b.FirstByteLatencyP50),
+			formatFloat(b.FirstByteLatencyP99),
+		})
+	}
+	cw.Flush()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newStateTestPool() *BaseServerPool {
+	pool := &BaseServerPool{
+		algorithm:           AlgorithmLeastConnections,
+		healthcheckInterval: 10 * time.Second,
+		ready:               make(chan struct{}),
+		log:                 log.New(io.Discard, "", 0),
+	}
+	pool.addBackend(BackendConfig{
+		URL:    "http://localhost:8080",
+		Labels: map[string]string{"zone": "a", "tier": "web"},
+	})
+	pool.AddBackend("http://localhost:8081")
+	pool.setHealthy(pool.backends[0], true)
+	pool.backends[0].DialLatency.Observe(2 * time.Millisecond)
+	pool.backends[0].acquire()()
+	pool.stats.accept()()
+	return pool
+}
+
+func Test_stateAPIHandler(t *testing.T) {
+	pool := newStateTestPool()
+
+	rec := httptest.NewRecorder()
+	pool.stateAPIHandler(rec, httptest.NewRequest("GET", "/api/state", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+
+	var state stateView
+	if err := json.NewDecoder(rec.Body).Decode(&state); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if state.Config.Algorithm != AlgorithmLeastConnections || state.Config.HealthcheckInterval != "10s" {
+		t.Errorf("unexpected config summary %+v", state.Config)
+	}
+	if !state.Status.Ready || state.Status.HealthyBackends != 1 || state.Status.TotalBackends != 2 {
+		t.Errorf("unexpected status %+v", state.Status)
+	}
+	if state.Listener.Accepted != 1 {
+		t.Errorf("expected 1 accepted connection, got %d", state.Listener.Accepted)
+	}
+	if len(state.Backends) != 2 {
+		t.Fatalf("expected 2 backends, got %d", len(state.Backends))
+	}
+	b := state.Backends[0]
+	if b.URL != "http://localhost:8080" || !b.Healthy || b.TotalConnections != 1 || b.DialLatencyP50 != 0.002 {
+		t.Errorf("unexpected backend %+v", b)
+	}
+}
+
+func Test_stateAPIHandler_csv(t *testing.T) {
+	pool := newStateTestPool()
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/api/state?format=csv", nil),
+		func() *http.Request {
+			r := httptest.NewRequest("GET", "/api/state", nil)
+			r.Header.Set("Accept", "text/csv")
+			return r
+		}(),
+	} {
+		rec := httptest.NewRecorder()
+		pool.stateAPIHandler(rec, req)
+		if ct := rec.Header().Get("Content-Type"); ct != "text/csv" {
+			t.Errorf("expected text/csv content type, got %q", ct)
+		}
+
+		records, err := csv.NewReader(rec.Body).ReadAll()
+		if err != nil {
+			t.Fatalf("failed to parse csv: %v", err)
+		}
+		if len(records) != 3 {
+			t.Fatalf("expected header and 2 rows, got %d records", len(records))
+		}
+		if len(records[0]) != len(stateCSVHeader) || records[0][0] != "id" {
+			t.Errorf("unexpected header %v", records[0])
+		}
+		row := records[1]
+		if row[1] != "http://localhost:8080" || row[2] != "true" || row[4] != "tier=web;zone=a" || row[6] != "1" {
+			t.Errorf("unexpected row %v", row)
+		}
+	}
+}
+
+func Test_stateAPIHandler_unsupportedFormat(t *testing.T) {
+	pool := newStateTestPool()
+
+	rec := httptest.NewRecorder()
+	pool.stateAPIHandler(rec, httptest.NewRequest("GET", "/api/state?format=xml", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", rec.Code)
+	}
+}
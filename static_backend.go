@@ -0,0 +1,78 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// staticScheme is the URL scheme of the built-in static backend, a sorry
+// server that replies to every connection with a fixed response and closes
+// it, e.g. "static://maintenance". Static backends only take connections
+// that no other backend can, so clients see a maintenance message rather
+// than a reset while every real backend is down.
+const staticScheme = "static"
+
+const defaultStaticBody = "Service temporarily unavailable, please try again later.\n"
+
+// isStaticBackend reports whether the backend is a built-in static backend.
+func isStaticBackend(b *Backend) bool {
+	return b.URL.Scheme == staticScheme
+}
+
+// staticResponse returns the response of a static backend described by
+// config, reading its file if it has one.
+func staticResponse(config *StaticResponseConfig) ([]byte, error) {
+	if config == nil {
+		config = &StaticResponseConfig{}
+	}
+	if config.Body != "" && config.File != "" {
+		return nil, fmt.Errorf("static response cannot have both a body and a file")
+	}
+	body := []byte(cmp.Or(config.Body, defaultStaticBody))
+	if config.File != "" {
+		var err error
+		if body, err = os.ReadFile(config.File); err != nil {
+			return nil, fmt.Errorf("failed to read static response: %w", err)
+		}
+	}
+	if config.HTTPStatus == 0 {
+		if config.ContentType != "" {
+			return nil, fmt.Errorf("static response content_type requires http_status")
+		}
+		return body, nil
+	}
+	text := http.StatusText(config.HTTPStatus)
+	if text == "" {
+		return nil, fmt.Errorf("invalid static response http_status %d", config.HTTPStatus)
+	}
+	header := "HTTP/1.1 " + strconv.Itoa(config.HTTPStatus) + " " + text + "\r\n" +
+		"Content-Type: " + cmp.Or(config.ContentType, "text/plain; charset=utf-8") + "\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"Connection: close\r\n\r\n"
+	return append([]byte(header), body...), nil
+}
+
+// dialStaticBackend returns an in-memory connection served by a static
+// backend, which writes its response, discards anything it receives and
+// closes the connection.
+func dialStaticBackend(backend *Backend) net.Conn {
+	clientSide, serverSide := net.Pipe()
+	go func() {
+		defer serverSide.Close()
+		go io.Copy(io.Discard, serverSide)
+		serverSide.Write(backend.static)
+	}()
+	return clientSide
+}
+
+// nextStatic returns the next available static backend, if any, for a
+// connection no other backend can take.
+func (p *BaseServerPool) nextStatic(conn net.Addr) *Backend {
+	s := p.currentSelection()
+	return p.pickBackend(s, s.static, conn)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_staticResponse(t *testing.T) {
+	resp, err := staticResponse(nil)
+	if err != nil || string(resp) != defaultStaticBody {
+		t.Errorf("expected the default body, got %q, %v", resp, err)
+	}
+	resp, err = staticResponse(&StaticResponseConfig{Body: "down for maintenance\n", HTTPStatus: 503})
+	if err != nil {
+		t.Fatalf("failed to build response: %v", err)
+	}
+	want := "HTTP/1.1 503 Service Unavailable\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: 21\r\nConnection: close\r\n\r\ndown for maintenance\n"
+	if string(resp) != want {
+		t.Errorf("expected %q, got %q", want, resp)
+	}
+
+	path := filepath.Join(t.TempDir(), "maintenance.html")
+	if err := os.WriteFile(path, []byte("<h1>Back soon</h1>"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if resp, err := staticResponse(&StaticResponseConfig{File: path}); err != nil || string(resp) != "<h1>Back soon</h1>" {
+		t.Errorf("expected the file contents, got %q, %v", resp, err)
+	}
+	for _, config := range []*StaticResponseConfig{
+		{Body: "a", File: path},
+		{File: filepath.Join(path, "missing")},
+		{HTTPStatus: 999},
+		{ContentType: "text/html"},
+	} {
+		if _, err := staticResponse(config); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
+
+func Test_proxy_staticBackend(t *testing.T) {
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr: "127.0.0.1:0",
+		Backends: []BackendConfig{
+			{URL: "static://maintenance", Static: &StaticResponseConfig{Body: "maintenance\n"}},
+			{URL: startNamedBackend(t, "blue")},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	static, blue := pool.backends[0], pool.backends[1]
+	static.SetHealthy(true)
+	blue.SetHealthy(true)
+	pool.Start()
+	defer pool.Shutdown(t.Context())
+
+	read := func() string {
+		t.Helper()
+		conn, err := net.Dial("tcp", pool.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to connect to load balancer: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 64)
+		n, _ := io.ReadAtLeast(conn, buf, 5)
+		return string(buf[:n])
+	}
+	for range 3 {
+		if got := read(); got != "blue\n" {
+			t.Errorf("expected the real backend while it is healthy, got %q", got)
+		}
+	}
+	if pool.HealthyBackends() != 1 {
+		t.Errorf("expected the static backend not to count as healthy, got %d", pool.HealthyBackends())
+	}
+
+	blue.SetHealthy(false)
+	if got := read(); got != "maintenance\n" {
+		t.Errorf("expected the static response with no other backend available, got %q", got)
+	}
+}
+
+func Test_parseBackendURL_static(t *testing.T) {
+	if _, err := parseBackendURL("static://maintenance", "udp"); err == nil {
+		t.Errorf("expected an error for a static backend on a udp listener")
+	}
+	if _, err := parseBackendURL("static://", "tcp"); err == nil {
+		t.Errorf("expected an error for a static backend without a name")
+	}
+	pool := &BaseServerPool{}
+	if _, err := pool.addBackend(BackendConfig{URL: "tcp://a:80", Static: &StaticResponseConfig{}}); err == nil || !strings.Contains(err.Error(), "static") {
+		t.Errorf("expected an error for a static response on a regular backend, got %v", err)
+	}
+}
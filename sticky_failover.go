@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultStickyFailoverTimeout is how long a client that failed over
+	// is remembered after its last connection.
+	defaultStickyFailoverTimeout = 30 * time.Minute
+	// maxStickyRemaps bounds the clients remembered as failed over.
+	maxStickyRemaps = 100000
+)
+
+// stickyFailover tracks the sticky clients moved off the backend they hash
+// to, so that the move and their return are logged and counted, and so that
+// they can stay on the backend they moved to.
+type stickyFailover struct {
+	returnToPrimary bool
+	timeout         time.Duration
+
+	mux       sync.Mutex
+	remaps    map[int]*stickyRemap
+	nextPrune time.Time
+	// tracked is the number of remaps, read without locking mux so that
+	// clients on their own backend are routed without contention.
+	tracked atomic.Int64
+
+	failovers atomic.Uint64
+	returns   atomic.Uint64
+}
+
+// stickyClient identifies a sticky client in logs: its address, or the
+// affinity key it is routed by. It is passed by value so that routing a
+// client does not allocate.
+type stickyClient struct {
+	addr net.Addr
+	key  string
+}
+
+func (c stickyClient) String() string {
+	if c.addr == nil {
+		return c.key
+	}
+	return c.addr.String()
+}
+
+// stickyRemap is a client moved off primary, the backend it hashes to, to
+// backend.
+type stickyRemap struct {
+	primary *Backend
+	backend *Backend
+	last    time.Time
+}
+
+// newStickyFailover returns the failover tracker of a pool. Clients return
+// to their backend unless the config says otherwise.
+func newStickyFailover(config *StickyFailoverConfig) (*stickyFailover, error) {
+	f := &stickyFailover{
+		returnToPrimary: true,
+		timeout:         defaultStickyFailoverTimeout,
+		remaps:          make(map[int]*stickyRemap),
+	}
+	if config == nil {
+		return f, nil
+	}
+	if config.ReturnToPrimary != nil {
+		f.returnToPrimary = *config.ReturnToPrimary
+	}
+	if config.Timeout != "" {
+		timeout, err := time.ParseDuration(config.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sticky_failover timeout: %w", err)
+		}
+		if timeout <= 0 {
+			return nil, fmt.Errorf("sticky_failover timeout must be positive")
+		}
+		f.timeout = timeout
+	}
+	return f, nil
+}
+
+// route returns the backend for the client hashing to backends[idx], whose
+// availability is primaryUp, or nil if no backend is available.
+func (f *stickyFailover) route(p *BaseServerPool, backends []*Backend, idx, hash int, primaryUp bool, client stickyClient) *Backend {
+	primary := backends[idx]
+	now := time.Now()
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.prune(now)
+
+	r := f.remaps[hash]
+	if r != nil && (r.primary != primary || now.Sub(r.last) > f.timeout) {
+		// The backends changed, or the client has been away too long.
+		f.forget(hash)
+		r = nil
+	}
+	if primaryUp {
+		if r == nil {
+			return primary
+		}
+		if !f.returnToPrimary && p.available(r.backend) {
+			r.last = now
+			return r.backend
+		}
+		f.forget(hash)
+		f.returns.Add(1)
+		infof(p.log, "sticky client %v returned to backend %s", client, primary.URL.Host)
+		return primary
+	}
+
+	if r != nil && p.available(r.backend) {
+		r.last = now
+		return r.backend
+	}
+	b := p.nextHashed(backends, idx, hash)
+	if b == nil {
+		return nil
+	}
+	from := primary
+	if r != nil {
+		from = r.backend
+	}
+	if r == nil && len(f.remaps) < maxStickyRemaps {
+		r = &stickyRemap{primary: primary}
+		f.remaps[hash] = r
+		f.tracked.Add(1)
+	}
+	if r != nil {
+		r.backend, r.last = b, now
+	}
+	f.failovers.Add(1)
+	infof(p.log, "sticky client %v remapped from backend %s to %s", client, from.URL.Host, b.URL.Host)
+	return b
+}
+
+// forget removes the remap of hash. mux must be held.
+func (f *stickyFailover) forget(hash int) {
+	delete(f.remaps, hash)
+	f.tracked.Add(-1)
+}
+
+// prune forgets the clients that have been away for the timeout, at most
+// once per timeout. mux must be held.
+func (f *stickyFailover) prune(now time.Time) {
+	if now.Before(f.nextPrune) {
+		return
+	}
+	f.nextPrune = now.Add(f.timeout)
+	for hash, r := range f.remaps {
+		if now.Sub(r.last) > f.timeout {
+			f.forget(hash)
+		}
+	}
+}
+
+// Remapped returns the number of clients currently remembered as moved off
+// their backend.
+func (f *stickyFailover) Remapped() int64 {
+	if f == nil {
+		return 0
+	}
+	return f.tracked.Load()
+}
+
+// stickyRemapSnapshot is a client moved off its backend, saved in the
+// runtime state so that it stays on the backend it moved to across a
+// restart. Backends are identified by URL.
+type stickyRemapSnapshot struct {
+	Hash    int       `json:"hash"`
+	Primary string    `json:"primary"`
+	Backend string    `json:"backend"`
+	Last    time.Time `json:"last"`
+}
+
+// snapshot returns the clients currently moved off their backend.
+func (f *stickyFailover) snapshot() []stickyRemapSnapshot {
+	if f == nil {
+		return nil
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	var remaps []stickyRemapSnapshot
+	for hash, r := range f.remaps {
+		remaps = append(remaps, stickyRemapSnapshot{
+			Hash:    hash,
+			Primary: r.primary.URL.String(),
+			Backend: r.backend.URL.String(),
+			Last:    r.last,
+		})
+	}
+	return remaps
+}
+
+// restore remembers the saved clients moved off their backend, unless they
+// have been away for the timeout or either backend is no longer in p.
+func (f *stickyFailover) restore(p *BaseServerPool, remaps []stickyRemapSnapshot) {
+	if f == nil {
+		return
+	}
+	now := time.Now()
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	for _, rs := range remaps {
+		primary, backend := p.findBackend(rs.Primary), p.findBackend(rs.Backend)
+		if primary == nil || backend == nil || now.Sub(rs.Last) > f.timeout || len(f.remaps) >= maxStickyRemaps {
+			continue
+		}
+		if f.remaps[rs.Hash] == nil {
+			f.tracked.Add(1)
+		}
+		f.remaps[rs.Hash] = &stickyRemap{primary: primary, backend: backend, last: rs.Last}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+	"testing"
+)
+
+func Test_newStickyFailover(t *testing.T) {
+	f, err := newStickyFailover(nil)
+	if err != nil || !f.returnToPrimary || f.timeout != defaultStickyFailoverTimeout {
+		t.Errorf("expected clients to return to their backend by default, got %+v, %v", f, err)
+	}
+	stay := false
+	f, err = newStickyFailover(&StickyFailoverConfig{ReturnToPrimary: &stay, Timeout: "1h"})
+	if err != nil || f.returnToPrimary || f.timeout.Hours() != 1 {
+		t.Errorf("expected clients to stay on their failover backend, got %+v, %v", f, err)
+	}
+	for _, timeout := range []string{"soon", "0s"} {
+		if _, err := newStickyFailover(&StickyFailoverConfig{Timeout: timeout}); err == nil {
+			t.Errorf("expected an error for timeout %q", timeout)
+		}
+	}
+}
+
+// newStickyTestPool returns a sticky pool of three healthy backends, the
+// backend client hashes to and the logs of the pool.
+func newStickyTestPool(t *testing.T, config *StickyFailoverConfig, client net.Addr) (*BaseServerPool, *Backend, *syncBuffer) {
+	t.Helper()
+	f, err := newStickyFailover(config)
+	if err != nil {
+		t.Fatalf("failed to create sticky failover: %v", err)
+	}
+	logs := &syncBuffer{}
+	pool := &BaseServerPool{stickySessions: true, stickyFailover: f, log: log.New(logs, "", 0)}
+	for _, url := range []string{"http://localhost:8080", "http://localhost:8081", "http://localhost:8082"} {
+		pool.AddBackend(url)
+	}
+	for _, b := range pool.backends {
+		b.SetHealthy(true)
+	}
+	return pool, pool.Next(client), logs
+}
+
+func TestStickyFailover_returnToPrimary(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("192.168.1.100"), Port: 5678}
+	pool, primary, logs := newStickyTestPool(t, nil, client)
+
+	primary.SetHealthy(false)
+	failover := pool.Next(client)
+	if failover == nil || failover == primary {
+		t.Fatalf("expected the client to fail over, got %v", failover)
+	}
+	if pool.Next(client) != failover || pool.stickyFailover.failovers.Load() != 1 || pool.stickyFailover.Remapped() != 1 {
+		t.Errorf("expected one failover to be recorded, got %d", pool.stickyFailover.failovers.Load())
+	}
+	if !strings.Contains(logs.String(), "sticky client "+client.String()+" remapped from backend localhost:") {
+		t.Errorf("expected the failover to be logged, got %q", logs.String())
+	}
+
+	primary.SetHealthy(true)
+	if got := pool.Next(client); got != primary {
+		t.Errorf("expected the client to return to %s, got %v", primary.URL, got)
+	}
+	if pool.stickyFailover.returns.Load() != 1 || pool.stickyFailover.Remapped() != 0 {
+		t.Errorf("expected one return to be recorded, got %d", pool.stickyFailover.returns.Load())
+	}
+	if !strings.Contains(logs.String(), "returned to backend "+primary.URL.Host) {
+		t.Errorf("expected the return to be logged, got %q", logs.String())
+	}
+}
+
+func TestStickyFailover_stay(t *testing.T) {
+	stay := false
+	client := &net.TCPAddr{IP: net.ParseIP("192.168.1.100"), Port: 5678}
+	pool, primary, _ := newStickyTestPool(t, &StickyFailoverConfig{ReturnToPrimary: &stay}, client)
+
+	primary.SetHealthy(false)
+	failover := pool.Next(client)
+	primary.SetHealthy(true)
+	if got := pool.Next(client); got != failover {
+		t.Errorf("expected the client to stay on %s, got %v", failover.URL, got)
+	}
+
+	// The client only goes back once its failover backend fails too.
+	failover.SetHealthy(false)
+	if got := pool.Next(client); got != primary {
+		t.Errorf("expected the client to return to %s, got %v", primary.URL, got)
+	}
+	if pool.stickyFailover.returns.Load() != 1 {
+		t.Errorf("expected one return to be recorded, got %d", pool.stickyFailover.returns.Load())
+	}
+}
+
+func TestStickyFailover_snapshotRestore(t *testing.T) {
+	stay := false
+	config := &StickyFailoverConfig{ReturnToPrimary: &stay}
+	client := &net.TCPAddr{IP: net.ParseIP("192.168.1.100"), Port: 5678}
+	pool, primary, _ := newStickyTestPool(t, config, client)
+	primary.SetHealthy(false)
+	failover := pool.Next(client)
+
+	remaps := pool.stickyFailover.snapshot()
+	if len(remaps) != 1 || remaps[0].Primary != primary.URL.String() || remaps[0].Backend != failover.URL.String() {
+		t.Fatalf("expected the failover to be saved, got %+v", remaps)
+	}
+
+	// A restart, with the primary back: the client stays on its failover
+	// backend. Remaps of backends no longer in the pool are dropped.
+	restored, _, _ := newStickyTestPool(t, config, client)
+	remaps = append(remaps, stickyRemapSnapshot{Hash: 1, Primary: primary.URL.String(), Backend: "http://localhost:9090", Last: remaps[0].Last})
+	restored.stickyFailover.restore(restored, remaps)
+	if got := restored.Next(client); got == nil || got.URL.String() != failover.URL.String() {
+		t.Errorf("expected the client to stay on %s, got %v", failover.URL, got)
+	}
+	if restored.stickyFailover.Remapped() != 1 {
+		t.Errorf("expected one remap to be restored, got %d", restored.stickyFailover.Remapped())
+	}
+
+	expired := []stickyRemapSnapshot{{Hash: 2, Primary: primary.URL.String(), Backend: failover.URL.String()}}
+	if restored.stickyFailover.restore(restored, expired); restored.stickyFailover.Remapped() != 1 {
+		t.Errorf("expected an expired remap not to be restored, got %d", restored.stickyFailover.Remapped())
+	}
+}
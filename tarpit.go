@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Actions a source filter takes on the clients it rejects.
+const (
+	filterActionReject = "reject"
+	filterActionTarpit = "tarpit"
+)
+
+const (
+	defaultTarpitHold           = 30 * time.Second
+	defaultTarpitMaxConnections = 1024
+)
+
+// tarpit holds the TCP connections of rejected clients open without reading
+// from them, then resets them, so that scanners are slowed down and cannot
+// tell they were filtered. A held connection costs a timer and its socket;
+// its receive buffer is shrunk so that a client writing to it stalls.
+type tarpit struct {
+	hold time.Duration
+	max  int
+	// jitter returns a random duration in [0, n) added to hold so that
+	// drops are not evenly timed.
+	jitter func(n int64) int64
+
+	mux  sync.Mutex
+	held map[net.Conn]*time.Timer
+
+	trapped  atomic.Uint64
+	overflow atomic.Uint64
+}
+
+func newTarpit(config *TarpitConfig) (*tarpit, error) {
+	t := &tarpit{
+		hold:   defaultTarpitHold,
+		max:    defaultTarpitMaxConnections,
+		jitter: rand.Int64N,
+		held:   make(map[net.Conn]*time.Timer),
+	}
+	if config == nil {
+		return t, nil
+	}
+	if config.Hold != "" {
+		hold, err := time.ParseDuration(config.Hold)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source_filter tarpit hold: %w", err)
+		}
+		if hold <= 0 {
+			return nil, fmt.Errorf("source_filter tarpit hold must be positive")
+		}
+		t.hold = hold
+	}
+	if config.MaxConnections < 0 {
+		return nil, fmt.Errorf("source_filter tarpit max_connections must not be negative")
+	}
+	if config.MaxConnections > 0 {
+		t.max = config.MaxConnections
+	}
+	return t, nil
+}
+
+// trap holds conn until the hold time, plus up to half of it, has passed,
+// and then resets it. Once the tarpit is full, or if t is nil, conn is
+// closed right away.
+func (t *tarpit) trap(conn net.Conn) {
+	if t == nil {
+		conn.Close()
+		return
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if len(t.held) >= t.max {
+		t.overflow.Add(1)
+		conn.Close()
+		return
+	}
+	t.trapped.Add(1)
+	tcpConn := conn
+	if nc, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		tcpConn = nc.NetConn()
+	}
+	if tc, ok := tcpConn.(*net.TCPConn); ok {
+		tc.SetReadBuffer(1)
+		// A zero linger sends RST instead of FIN when the hold is over.
+		tc.SetLinger(0)
+	}
+	hold := t.hold + time.Duration(t.jitter(int64(t.hold/2)+1))
+	t.held[conn] = time.AfterFunc(hold, func() {
+		t.mux.Lock()
+		delete(t.held, conn)
+		t.mux.Unlock()
+		conn.Close()
+	})
+}
+
+// Held returns the number of connections currently held.
+func (t *tarpit) Held() int {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return len(t.held)
+}
+
+// release closes every held connection. A nil tarpit holds none.
+func (t *tarpit) release() {
+	if t == nil {
+		return
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	for conn, timer := range t.held {
+		timer.Stop()
+		conn.Close()
+	}
+	clear(t.held)
+}
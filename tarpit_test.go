@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_newTarpit(t *testing.T) {
+	tp, err := newTarpit(nil)
+	if err != nil || tp.hold != defaultTarpitHold || tp.max != defaultTarpitMaxConnections {
+		t.Errorf("expected the defaults, got %+v, %v", tp, err)
+	}
+	for _, config := range []*TarpitConfig{{Hold: "soon"}, {Hold: "-1s"}, {MaxConnections: -1}} {
+		if _, err := newTarpit(config); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
+
+// tarpitPair returns the two ends of a TCP connection.
+func tarpitPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	client, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	if server, err = ln.Accept(); err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	return client, server
+}
+
+func TestTarpit_trap(t *testing.T) {
+	tp, _ := newTarpit(&TarpitConfig{Hold: "100ms", MaxConnections: 1})
+	tp.jitter = func(int64) int64 { return 0 }
+
+	held, conn := tarpitPair(t)
+	start := time.Now()
+	tp.trap(conn)
+	overflow, conn := tarpitPair(t)
+	tp.trap(conn)
+	if tp.Held() != 1 || tp.overflow.Load() != 1 {
+		t.Errorf("expected 1 held and 1 overflowing connection, got %d and %d", tp.Held(), tp.overflow.Load())
+	}
+	overflow.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := overflow.Read(make([]byte, 1)); err == nil {
+		t.Errorf("expected a connection beyond the limit to be closed")
+	}
+
+	held.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := held.Read(make([]byte, 1)); err == nil {
+		t.Errorf("expected the held connection to be reset")
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("expected the connection to be held for the hold time, got %s", elapsed)
+	}
+	waitFor(t, "the tarpit to be empty", func() bool { return tp.Held() == 0 })
+
+	held, conn = tarpitPair(t)
+	tp.hold = time.Hour
+	tp.trap(conn)
+	tp.release()
+	held.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := held.Read(make([]byte, 1)); err == nil || tp.Held() != 0 {
+		t.Errorf("expected releasing the tarpit to close the held connection")
+	}
+}
+
+func TestTCPServerPool_tarpit(t *testing.T) {
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:         "127.0.0.1:0",
+		Backends:     []BackendConfig{{URL: "tcp://" + startNamedBackend(t, "a")}},
+		SourceFilter: &SourceFilterConfig{Deny: []string{"127.0.0.1"}, Action: filterActionTarpit},
+	})
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	pool.backends[0].SetHealthy(true)
+	if err := pool.Start(); err != nil {
+		t.Fatalf("failed to start server pool: %v", err)
+	}
+	shutdownOnCleanup(t, pool)
+
+	conn, err := net.Dial("tcp", pool.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("expected the denied connection to be held open, got %v", err)
+	}
+	rec := httptest.NewRecorder()
+	pool.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{"nlb_tarpit_connections 1", `nlb_tarpit_connections_total{result="held"} 1`, `nlb_source_filter_rejected_total{reason="denied"} 1`} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("expected metrics to contain %q", want)
+		}
+	}
+
+	pool.StopAccepting()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("expected the held connection to be closed when the listener stops")
+	}
+}
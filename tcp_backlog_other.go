@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+const tcpBacklogSupported = false
+
+// setListenBacklog is not supported on this platform.
+func setListenBacklog(c syscall.RawConn, backlog int) error {
+	return errors.New("setting the listen backlog is not supported on this platform")
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+const tcpBacklogSupported = true
+
+// setListenBacklog changes the accept queue length of a listening socket by
+// calling listen again, which the kernel allows on a bound socket.
+func setListenBacklog(c syscall.RawConn, backlog int) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,21 @@
+package main
+
+import "syscall"
+
+const tcpFastOpenSupported = true
+
+// TCP_FASTOPEN is not exported by the syscall package.
+const sysTCPFastOpen = 0x17
+
+// setTCPFastOpen enables TCP Fast Open on a listening socket with the given
+// pending connection queue length.
+func setTCPFastOpen(c syscall.RawConn, queue int) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, sysTCPFastOpen, queue)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+const tcpFastOpenSupported = false
+
+// setTCPFastOpen is not supported on this platform.
+func setTCPFastOpen(c syscall.RawConn, queue int) error {
+	return errors.New("TCP Fast Open is not supported on this platform")
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// tcpOptions holds the socket options applied to client and backend TCP
+// connections.
+type tcpOptions struct {
+	keepAlive       time.Duration
+	keepAliveConfig net.KeepAliveConfig
+	noDelay         bool
+	fastOpenQueue   int
+	backlog         int
+	// linger is the SO_LINGER timeout in seconds, or -1 for the default.
+	linger     int
+	closeDelay time.Duration
+	// device is the device, or VRF, the listener is bound to, if any.
+	device string
+}
+
+func newTCPOptions(cfg *TCPOptionsConfig) (*tcpOptions, error) {
+	opts := &tcpOptions{noDelay: true, linger: -1}
+	if cfg == nil {
+		return opts, nil
+	}
+
+	if cfg.NoDelay != nil {
+		opts.noDelay = *cfg.NoDelay
+	}
+	if cfg.KeepAliveCount < 0 {
+		return nil, fmt.Errorf("keepalive_count must not be negative")
+	}
+	if cfg.FastOpenQueue < 0 {
+		return nil, fmt.Errorf("fast_open_queue must not be negative")
+	}
+	if cfg.FastOpenQueue > 0 && !tcpFastOpenSupported {
+		return nil, fmt.Errorf("TCP Fast Open is not supported on this platform")
+	}
+	opts.fastOpenQueue = cfg.FastOpenQueue
+	if cfg.Backlog < 0 {
+		return nil, fmt.Errorf("backlog must not be negative")
+	}
+	if cfg.Backlog > 0 && !tcpBacklogSupported {
+		return nil, fmt.Errorf("setting the listen backlog is not supported on this platform")
+	}
+	opts.backlog = cfg.Backlog
+	if cfg.Linger != "" {
+		linger, err := time.ParseDuration(cfg.Linger)
+		if err != nil {
+			return nil, fmt.Errorf("invalid linger: %w", err)
+		}
+		if linger < 0 {
+			return nil, fmt.Errorf("linger must not be negative")
+		}
+		// SO_LINGER counts whole seconds.
+		opts.linger = int((linger + time.Second - 1) / time.Second)
+	}
+	if cfg.CloseDelay != "" {
+		delay, err := time.ParseDuration(cfg.CloseDelay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid close_delay: %w", err)
+		}
+		if delay <= 0 {
+			return nil, fmt.Errorf("close_delay must be positive")
+		}
+		opts.closeDelay = delay
+	}
+
+	var idle, interval time.Duration
+	var err error
+	if cfg.KeepAliveIdle != "" {
+		if idle, err = time.ParseDuration(cfg.KeepAliveIdle); err != nil {
+			return nil, fmt.Errorf("invalid keepalive_idle: %w", err)
+		}
+	}
+	if cfg.KeepAliveInterval != "" {
+		if interval, err = time.ParseDuration(cfg.KeepAliveInterval); err != nil {
+			return nil, fmt.Errorf("invalid keepalive_interval: %w", err)
+		}
+	}
+	if idle < 0 {
+		// A negative idle time disables keepalive probes entirely.
+		opts.keepAlive = -1
+		return opts, nil
+	}
+	if idle > 0 || interval > 0 || cfg.KeepAliveCount > 0 {
+		opts.keepAliveConfig = net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     idle,
+			Interval: interval,
+			Count:    cfg.KeepAliveCount,
+		}
+	}
+	return opts, nil
+}
+
+// listenConfig returns a ListenConfig applying the options to the listener
+// and to accepted connections.
+func (o *tcpOptions) listenConfig() *net.ListenConfig {
+	lc := &net.ListenConfig{
+		KeepAlive:       o.keepAlive,
+		KeepAliveConfig: o.keepAliveConfig,
+	}
+	var fastOpen socketControl
+	if o.fastOpenQueue > 0 {
+		fastOpen = func(network, address string, c syscall.RawConn) error {
+			return setTCPFastOpen(c, o.fastOpenQueue)
+		}
+	}
+	lc.Control = chainControl(bindDevice(o.device), fastOpen)
+	return lc
+}
+
+// listen binds addr with the options, setting the listener's backlog if one
+// is configured.
+func (o *tcpOptions) listen(addr string) (net.Listener, error) {
+	l, err := o.listenConfig().Listen(context.Background(), "tcp", addr)
+	if err != nil || o.backlog == 0 {
+		return l, err
+	}
+	rc, err := l.(*net.TCPListener).SyscallConn()
+	if err == nil {
+		err = setListenBacklog(rc, o.backlog)
+	}
+	if err != nil {
+		l.Close()
+		return nil, fmt.Errorf("error setting backlog on %s: %w", addr, err)
+	}
+	return l, nil
+}
+
+// dialer returns a Dialer for backend connections.
+func (o *tcpOptions) dialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout:         timeout,
+		KeepAlive:       o.keepAlive,
+		KeepAliveConfig: o.keepAliveConfig,
+	}
+}
+
+// applyConn sets per-connection options that cannot be set on the listener
+// or dialer.
+func (o *tcpOptions) applyConn(conn net.Conn) error {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if o.linger >= 0 {
+		if err := tcpConn.SetLinger(o.linger); err != nil {
+			return err
+		}
+	}
+	return tcpConn.SetNoDelay(o.noDelay)
+}
+
+// closeWrite shuts down the writing side of conn, passing on the end of
+// stream, and reports whether it could.
+func closeWrite(conn net.Conn) bool {
+	cw, ok := conn.(interface{ CloseWrite() error })
+	return ok && cw.CloseWrite() == nil
+}
+
+// lingerClient gives a client whose backend has closed up to the close
+// delay to read the rest of the response: the end of stream is passed on
+// to the client, and once it stops sending, or its data can no longer be
+// forwarded, anything more it sends is discarded rather than left unread,
+// which would reset the connection. If the client is done in time, it
+// returns the bytes sent to the backend, received from sent.
+func (o *tcpOptions) lingerClient(conn net.Conn, sent <-chan int64) (int64, bool) {
+	deadline := time.Now().Add(o.closeDelay)
+	if !closeWrite(conn) {
+		return 0, false
+	}
+	timer := time.NewTimer(o.closeDelay)
+	defer timer.Stop()
+	select {
+	case n := <-sent:
+		conn.SetReadDeadline(deadline)
+		io.Copy(io.Discard, conn)
+		return n, true
+	case <-timer.C:
+		return 0, false
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewTCPOptions(t *testing.T) {
+	opts, err := newTCPOptions(nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !opts.noDelay || opts.keepAlive != 0 || opts.keepAliveConfig.Enable {
+		t.Errorf("expected default options, got %+v", opts)
+	}
+
+	noDelay := false
+	opts, err = newTCPOptions(&TCPOptionsConfig{
+		KeepAliveIdle:     "30s",
+		KeepAliveInterval: "5s",
+		KeepAliveCount:    3,
+		NoDelay:           &noDelay,
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	want := net.KeepAliveConfig{Enable: true, Idle: 30 * time.Second, Interval: 5 * time.Second, Count: 3}
+	if opts.keepAliveConfig != want {
+		t.Errorf("expected keepalive config %+v, got %+v", want, opts.keepAliveConfig)
+	}
+	if opts.noDelay {
+		t.Errorf("expected noDelay to be false")
+	}
+
+	opts, err = newTCPOptions(&TCPOptionsConfig{KeepAliveIdle: "-1s"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if opts.keepAlive >= 0 {
+		t.Errorf("expected keepalives to be disabled, got %s", opts.keepAlive)
+	}
+
+	for _, cfg := range []*TCPOptionsConfig{
+		{KeepAliveIdle: "later"},
+		{KeepAliveInterval: "often"},
+		{KeepAliveCount: -1},
+		{FastOpenQueue: -1},
+		{Backlog: -1},
+		{Linger: "soon"},
+		{Linger: "-1s"},
+		{CloseDelay: "later"},
+		{CloseDelay: "0s"},
+	} {
+		if _, err := newTCPOptions(cfg); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
+
+func TestTCPOptions_linger(t *testing.T) {
+	if opts, _ := newTCPOptions(nil); opts.linger != -1 {
+		t.Errorf("expected the OS default linger, got %d", opts.linger)
+	}
+	for _, tt := range []struct {
+		linger string
+		want   int
+	}{{"0s", 0}, {"1500ms", 2}, {"5s", 5}} {
+		opts, err := newTCPOptions(&TCPOptionsConfig{Linger: tt.linger})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if opts.linger != tt.want {
+			t.Errorf("linger %s: expected %d seconds, got %d", tt.linger, tt.want, opts.linger)
+		}
+	}
+}
+
+func Test_proxy_closeDelay(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	late := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Answer and close, then read what the client still sends.
+		conn.Write([]byte("bye\n"))
+		conn.(*net.TCPConn).CloseWrite()
+		data, _ := io.ReadAll(conn)
+		late <- string(data)
+	}()
+
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:       "127.0.0.1:0",
+		Backends:   []BackendConfig{{URL: ln.Addr().String()}},
+		TCPOptions: &TCPOptionsConfig{CloseDelay: "2s", Linger: "1s"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	pool.backends[0].SetHealthy(true)
+	pool.Start()
+	defer pool.Shutdown(t.Context())
+
+	conn, err := net.Dial("tcp", pool.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect to load balancer: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	data, err := io.ReadAll(conn)
+	if err != nil || string(data) != "bye\n" {
+		t.Fatalf("expected the response and end of stream, got %q, %v", data, err)
+	}
+	conn.Write([]byte("late"))
+	conn.(*net.TCPConn).CloseWrite()
+	select {
+	case got := <-late:
+		if got != "late" {
+			t.Errorf("expected data sent after the backend's end of stream to reach it, got %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for the backend")
+	}
+}
+
+func TestTCPOptions_fastOpen(t *testing.T) {
+	opts, err := newTCPOptions(&TCPOptionsConfig{FastOpenQueue: 16})
+	if !tcpFastOpenSupported {
+		if err == nil {
+			t.Errorf("expected error on unsupported platform")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	ln, err := opts.listenConfig().Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected listener with fast open, got %v", err)
+	}
+	ln.Close()
+}
+
+func TestTCPOptions_backlog(t *testing.T) {
+	opts, err := newTCPOptions(&TCPOptionsConfig{Backlog: 16})
+	if !tcpBacklogSupported {
+		if err == nil {
+			t.Errorf("expected error on unsupported platform")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	ln, err := opts.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected listener with backlog, got %v", err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	conn.Close()
+}
+
+func TestTCPOptions_applyConn(t *testing.T) {
+	opts, err := newTCPOptions(&TCPOptionsConfig{KeepAliveIdle: "10s"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	ln, err := opts.listenConfig().Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := opts.dialer(time.Second).Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer conn.Close()
+	if err := opts.applyConn(conn); err != nil {
+		t.Errorf("expected no error applying options, got %v", err)
+	}
+
+	// Non-TCP connections are left alone.
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if err := opts.applyConn(client); err != nil {
+		t.Errorf("expected no error for pipe, got %v", err)
+	}
+}
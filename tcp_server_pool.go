@@ -1,67 +1,339 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"sync"
+	"syscall"
 	"time"
 )
 
 // TCPServerPool holds the collection of backends.
 type TCPServerPool struct {
 	BaseServerPool
-	listener            net.Listener
-	wg                  sync.WaitGroup
-	shutdown            chan struct{}
-	healthcheckInterval time.Duration
+	listener net.Listener
+	wg       sync.WaitGroup
+	tcpOpts  *tcpOptions
+	// socks is nil unless the listener accepts SOCKS5.
+	socks *socksIngress
+	// deferDial is nil unless backends are dialed once clients send data.
+	deferDial *deferredDial
 }
 
 // NewTCPServerPool creates a new ServerPool with the given logger.
 func NewTCPServerPool(l *log.Logger, config *Config) (*TCPServerPool, error) {
-	listener, err := net.Listen("tcp", config.Addr)
+	if config.HealthcheckInterval == "" {
+		config.HealthcheckInterval = "10s"
+	}
+
+	healthcheckInterval, err := time.ParseDuration(config.HealthcheckInterval)
+	if err != nil {
+		return nil, fmt.Errorf("invalid healthcheck interval: %w", err)
+	}
+
+	algorithm, err := validateAlgorithm(config.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	stickyKey, err := validateStickyKey(config.StickyKey)
+	if err != nil {
+		return nil, err
+	}
+	stickyHashing, err := validateStickyHashing(config.StickyHashing)
+	if err != nil {
+		return nil, err
+	}
+	stickyFailover, err := newStickyFailover(config.StickyFailover)
+	if err != nil {
+		return nil, err
+	}
+
+	faults, err := newFaultInjector(config.FaultInjection)
+	if err != nil {
+		return nil, err
+	}
+	if faults != nil {
+		warnf(l, "WARNING: fault injection is enabled")
+	}
+
+	breakerSettings, err := newCircuitBreakerSettings(config.CircuitBreaker)
+	if err != nil {
+		return nil, err
+	}
+	admissionSettings, err := newAdmissionSettings(config.BackendConnectionRate)
+	if err != nil {
+		return nil, err
+	}
+
+	sloSettings, err := newSLOSettings(config.SLO)
+	if err != nil {
+		return nil, err
+	}
+
+	resolver, err := newDNSCache(config.DNSCache)
+	if err != nil {
+		return nil, err
+	}
+
+	dialTimeout, err := parseDialTimeout(config.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	connTimeout, err := parseConnectionTimeout(config.ConnectionTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	longConns, err := newLongConnPolicy(config.LongConnections)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateCaptureDir(config.CaptureDir); err != nil {
+		return nil, err
+	}
+
+	pinning, err := newBackendPinning(config.PinBackend)
+	if err != nil {
+		return nil, err
+	}
+
+	xds, err := newXDSClient(config.XDS)
+	if err != nil {
+		return nil, err
+	}
+
+	flaps, err := newFlapDetector(config.FlapDetection)
+	if err != nil {
+		return nil, err
+	}
+
+	quarantine, err := newQuarantine(config.Quarantine)
 	if err != nil {
 		return nil, err
 	}
 
+	backends, err := expandPortRanges(config.Backends)
+	if err != nil {
+		return nil, err
+	}
+
+	blueGreen, groupBackends, err := newBlueGreen(config.BlueGreen)
+	if err != nil {
+		return nil, err
+	}
+	backends = append(backends, groupBackends...)
+
+	backendGroup, sharedBackends, err := poolBackendGroup(l, config, "tcp")
+	if err != nil {
+		return nil, err
+	}
+	backends = append(backends, sharedBackends...)
+
+	sharedHealth, err := config.health.join(config.SharedHealth)
+	if err != nil {
+		return nil, err
+	}
+
+	// Discovered backends are not known until the pool starts.
+	if config.MinHealthyBackends > len(backends) && xds == nil && !backendGroup.dynamic() {
+		return nil, fmt.Errorf("min_healthy_backends (%d) exceeds the number of backends (%d)",
+			config.MinHealthyBackends, len(backends))
+	}
+
+	tcpOpts, err := newTCPOptions(config.TCPOptions)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDevices(config); err != nil {
+		return nil, err
+	}
+	tcpOpts.device = config.Device
+
+	dashboardTmpl, err := loadDashboardTemplate(config.TemplateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var tlsConfig *tls.Config
 	if config.TLSCertPath != "" && config.TLSKeyPath != "" {
 		cert, err := tls.LoadX509KeyPair(config.TLSCertPath, config.TLSKeyPath)
 		if err != nil {
-			log.Fatalf("Error loading key pair: %v", err)
-		}
-		listener = tls.NewListener(listener, &tls.Config{
-			Certificates: []tls.Certificate{cert},
-		})
-		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("error loading key pair: %w", err)
 		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
 	}
 
-	if config.HealthcheckInterval == "" {
-		config.HealthcheckInterval = "10s"
+	queue, err := newAcceptQueue(config.AcceptQueue, config.MaxConnections)
+	if err != nil {
+		return nil, err
 	}
 
-	healthcheckInterval, err := time.ParseDuration(config.HealthcheckInterval)
+	sniffer, err := newSniffer(config.Sniff, tlsConfig)
 	if err != nil {
-		return nil, fmt.Errorf("invalid healthcheck interval: %w", err)
+		return nil, err
+	}
+
+	socks, err := newSocksIngress(config.Socks5)
+	if err != nil {
+		return nil, err
+	}
+	if socks != nil && sniffer != nil {
+		return nil, fmt.Errorf("socks5 and sniff cannot both be enabled")
+	}
+
+	deferDial, err := newDeferredDial(config.DeferDial)
+	if err != nil {
+		return nil, err
+	}
+
+	firstByte, err := newFirstByteRouter(config.FirstByteRouting)
+	if err != nil {
+		return nil, err
+	}
+	if firstByte != nil && (sniffer != nil || socks != nil) {
+		return nil, fmt.Errorf("first_byte_routing cannot be combined with sniff or socks5")
+	}
+
+	validator, err := newProtocolValidator(config.ProtocolValidation)
+	if err != nil {
+		return nil, err
+	}
+
+	affinity, err := newAffinity(config.Affinity)
+	if err != nil {
+		return nil, err
+	}
+	if affinity != nil && socks != nil {
+		return nil, fmt.Errorf("affinity cannot be combined with socks5")
+	}
+
+	fdLimit, err := newFDLimit(config.FDLimit)
+	if err != nil {
+		return nil, err
+	}
+	priority, err := newPriorityClasses(config.PriorityClasses, config.MaxConnections)
+	if err != nil {
+		return nil, err
+	}
+	geoIP, err := newGeoIP(config.GeoIP)
+	if err != nil {
+		return nil, err
+	}
+	sourceFilter, err := newSourceFilter(config.SourceFilter, geoIP)
+	if err != nil {
+		return nil, err
+	}
+	panics, err := newPanicRecovery(config.PanicRecovery, config.Name)
+	if err != nil {
+		return nil, err
+	}
+	logSampler, err := newLogSampler(config.LogSampling)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := listenAddresses(config)
+	if err != nil {
+		return nil, err
+	}
+	hooks, err := newAddressHooks(config.AddressHooks, config.Name, "tcp", l)
+	if err != nil {
+		return nil, err
+	}
+	listeners, err := bindAddresses(hooks, addrs, tcpOpts.listen)
+	if err != nil {
+		return nil, err
+	}
+	listener := newMultiListener(listeners)
+	// With sniffing enabled, TLS is terminated per connection by the sniffer.
+	if tlsConfig != nil && sniffer == nil {
+		listener = tls.NewListener(listener, tlsConfig)
 	}
 
 	pool := &TCPServerPool{
 		listener: listener,
-		shutdown: make(chan struct{}),
+		tcpOpts:  tcpOpts,
+		socks:    socks,
+
+		deferDial: deferDial,
 		BaseServerPool: BaseServerPool{
-			stickySessions: config.StickySessions,
-			log:            l,
+			shutdown:            make(chan struct{}),
+			healthcheckInterval: healthcheckInterval,
+			stickySessions:      config.StickySessions,
+			exemplars:           config.Exemplars,
+			stickyKey:           stickyKey,
+			stickyHashing:       stickyHashing,
+			stickyFailover:      stickyFailover,
+			algorithm:           algorithm,
+			maxConnections:      config.MaxConnections,
+			dialTimeout:         dialTimeout,
+			connTimeout:         connTimeout,
+			longConns:           longConns,
+			localZone:           config.LocalZone,
+			zoneLabel:           cmp.Or(config.ZoneLabel, "zone"),
+			faults:              faults,
+			breakerSettings:     breakerSettings,
+			admissionSettings:   admissionSettings,
+			sloSettings:         sloSettings,
+			resolver:            resolver,
+			flaps:               flaps,
+			quarantine:          quarantine,
+			minHealthy:          config.MinHealthyBackends,
+			waitForReady:        config.WaitForReady,
+			failStatic:          config.FailStatic,
+			ready:               make(chan struct{}),
+			log:                 l,
+			name:                config.Name,
+			protocol:            "tcp",
+			addr:                config.Addr,
+			addrs:               addrs,
+			hooks:               hooks,
+			tls:                 config.TLSCertPath != "" && config.TLSKeyPath != "",
+			startTime:           time.Now(),
+			tmpl:                dashboardTmpl,
+			capture:             capturer{dir: config.CaptureDir},
+			pinning:             pinning,
+			xds:                 xds,
+			blueGreen:           blueGreen,
+			backendGroup:        backendGroup,
+			sharedHealth:        sharedHealth,
+			backendTLS:          config.BackendTLS,
+			sniffer:             sniffer,
+			firstByte:           firstByte,
+			validator:           validator,
+			affinity:            affinity,
+			fdLimit:             fdLimit,
+			priority:            priority,
+			geoIP:               geoIP,
+			sourceFilter:        sourceFilter,
+			uptime:              config.uptime,
+			device:              config.Device,
+			backendDevice:       config.BackendDevice,
+			panics:              panics,
+			logSampler:          logSampler,
+			queue:               queue,
 		},
-		healthcheckInterval: healthcheckInterval,
+	}
+
+	if err := pool.initHealthChecks("tcp", config); err != nil {
+		pool.closeListener()
+		return nil, err
 	}
 
 	// Add backends from config
-	for _, backend := range config.Backends {
-		pool.AddBackend(backend)
+	for _, backend := range backends {
+		if _, err := pool.addBackend(backend); err != nil {
+			pool.closeListener()
+			return nil, fmt.Errorf("invalid backend: %w", err)
+		}
 	}
 
 	return pool, nil
@@ -69,6 +341,8 @@ func NewTCPServerPool(l *log.Logger, config *Config) (*TCPServerPool, error) {
 
 // Start begins accepting connections and handling them.
 func (p *TCPServerPool) Start() error {
+	p.listening.Store(true)
+	p.startDiscovery(&p.wg)
 	p.wg.Add(1)
 	go p.acceptLoop()
 	return nil
@@ -77,7 +351,16 @@ func (p *TCPServerPool) Start() error {
 // acceptLoop accepts incoming connections and handles them.
 func (p *TCPServerPool) acceptLoop() {
 	defer p.wg.Done()
+	p.resources.add(1, 0)
+	defer p.resources.add(-1, 0)
+
+	if !p.waitReady(p.shutdown) {
+		return
+	}
 
+	// backoff is how long the last accept waited after the process ran out
+	// of file descriptors, so that the loop does not spin on EMFILE.
+	var backoff time.Duration
 	for {
 		select {
 		case <-p.shutdown:
@@ -89,126 +372,382 @@ func (p *TCPServerPool) acceptLoop() {
 				case <-p.shutdown:
 					return // Shutdown signal received
 				default:
-					p.log.Printf("error accepting connection: %v\n", err)
+					if !isFDExhausted(err) {
+						warnf(p.log, "error accepting connection: %v\n", err)
+						continue
+					}
+					backoff = nextAcceptBackoff(backoff)
+					warnf(p.log, "error accepting connection: %v; retrying in %s", err, backoff)
+					select {
+					case <-time.After(backoff):
+					case <-p.shutdown:
+						return
+					}
 					continue
 				}
 			}
-			go proxy(conn, p, p.log)
+			backoff = 0
+			if p.sourceFilter.reject(conn.RemoteAddr()) != "" {
+				p.sourceFilter.close(conn)
+				continue
+			}
+			if !p.fdLimit.admit(time.Now(), p.log) {
+				conn.Close()
+				continue
+			}
+			id := newConnID()
+			ctx, done := p.conns.track(id, conn.RemoteAddr(), p.connTimeout)
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				defer done()
+				p.resources.add(1, 0)
+				defer p.resources.add(-1, 0)
+				l := connLogger(p.log, id)
+				defer p.panics.guard(l, id, conn.RemoteAddr())
+				proxy(ctx, conn, p, l)
+			}()
 		}
 	}
 }
 
+// StopAccepting closes the listener so that no new connections are accepted.
+func (p *TCPServerPool) StopAccepting() error {
+	if !p.beginShutdown() {
+		return nil
+	}
+	err := p.closeListener()
+	p.listening.Store(false)
+	if err != nil {
+		return fmt.Errorf("error closing listener: %w", err)
+	}
+	return nil
+}
+
+// closeListener closes the listener and runs the down hook of each of its
+// addresses.
+func (p *TCPServerPool) closeListener() error {
+	err := p.listener.Close()
+	for _, addr := range p.addrs {
+		p.hooks.addressDown(addr)
+	}
+	if p.sourceFilter != nil {
+		p.sourceFilter.tarpit.release()
+	}
+	return err
+}
+
+// Drain waits for in-flight connections to finish.
+func (p *TCPServerPool) Drain(ctx context.Context) error {
+	defer p.capture.stop()
+	return p.drainOrCancel(ctx, &p.wg)
+}
+
 // Shutdown gracefully shuts down the server pool.
 func (p *TCPServerPool) Shutdown(ctx context.Context) error {
 	start := time.Now()
-
-	select {
-	case <-p.shutdown:
+	if p.shuttingDown.Load() {
 		// Already closed
 		return nil
-	default:
-		close(p.shutdown)
 	}
 
-	if err := p.listener.Close(); err != nil {
-		p.log.Printf("error closing listener: %v\n", err)
+	if err := p.StopAccepting(); err != nil {
+		warnf(p.log, "%v", err)
 	}
-
-	done := make(chan struct{})
-	go func() {
-		p.wg.Wait()
-		close(done)
-	}()
-
-	select {
-	case <-done:
-		// Shutdown completed
-	case <-ctx.Done():
-		return fmt.Errorf("shutdown timed out: %ws", ctx.Err())
+	if err := p.Drain(ctx); err != nil {
+		return err
+	}
+	if err := p.stopHealthChecks(ctx); err != nil {
+		return err
 	}
 
 	elapsed := time.Since(start)
-	p.log.Printf("server pool shutdown completed in %s", elapsed)
+	infof(p.log, "server pool shutdown completed in %s", elapsed)
 	return nil
 }
 
-// Next returns the next available backend using round-robin.
-func (p *TCPServerPool) Next(conn net.Addr) *Backend {
-	p.backendsMutex.Lock()
-	defer p.backendsMutex.Unlock()
-
-	if p.stickySessions {
-		ip := getIpFromAddr(conn)
-		hash := hashIp(ip)
-		idx := hash % len(p.backends)
-		if p.backends[idx].Healthy() {
-			return p.backends[idx]
+// proxy handles the connection between the client and the selected backend.
+// Cancelling ctx closes the connection. Once the connection has been
+// proxied, a line recording its backend, duration and bytes is logged.
+func proxy(ctx context.Context, conn net.Conn, pool *TCPServerPool, l *log.Logger) {
+	start := time.Now()
+	defer conn.Close()
+	defer pool.stats.accept()()
+	sampled := pool.logSampler.sample(conn.RemoteAddr())
+	connDebugf(l, sampled, "accepted connection from %s on %s", conn.RemoteAddr(), conn.LocalAddr())
+	client := conn
+	stop := context.AfterFunc(ctx, func() {
+		infof(l, "closing connection from %s: %v", client.RemoteAddr(), context.Cause(ctx))
+		client.Close()
+	})
+	defer stop()
+	if err := pool.tcpOpts.applyConn(conn); err != nil {
+		warnf(l, "error setting client socket options: %v", err)
+	}
+	if pool.faults.MaybeReset(conn) {
+		infof(l, "fault injection: reset connection from %s", conn.RemoteAddr())
+		return
+	}
+	if !pool.admitClient(conn.RemoteAddr(), l) {
+		pool.stats.reject()
+		return
+	}
+	l, region := pool.geoIP.locate(conn.RemoteAddr(), l)
+	waited, err := pool.deferDial.wait(conn)
+	if err != nil {
+		if errors.Is(err, errNoClientData) {
+			pool.stats.idleClients.Add(1)
+		}
+		infof(l, "closing connection from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	conn = waited
+	var pinned *Backend
+	if pool.pinning.allows(conn.RemoteAddr()) {
+		peeked, name, err := pool.pinning.readPreamble(conn)
+		if err == nil && name != "" {
+			pinned, err = pool.pinnedBackend(name)
+		}
+		if err != nil {
+			infof(l, "rejected connection from %s: %v", conn.RemoteAddr(), err)
+			pool.stats.reject()
+			return
+		}
+		conn = peeked
+		if pinned != nil {
+			infof(l, "connection from %s pinned to backend %s", conn.RemoteAddr(), pinned.URL)
 		}
+	}
 
-		// If the hashed backend is down, find the next healthy one
-		backend := p.findNextHealthyBackend(idx)
-		if backend != nil {
-			return backend
+	if pool.validator != nil {
+		validated, err := pool.validator.validate(conn)
+		if err != nil {
+			debugf(l, "rejected connection from %s: %v", conn.RemoteAddr(), err)
+			pool.stats.reject()
+			return
 		}
-		// If no healthy backend found, return nil
-		return nil
+		conn = validated
 	}
 
-	for i := 0; i < len(p.backends); i++ {
-		p.current = (p.current + 1) % uint64(len(p.backends))
-		if p.backends[p.current].Healthy() {
-			return p.backends[p.current]
+	var host string
+	if pool.sniffer != nil {
+		sniffed, h, err := pool.sniffer.sniff(conn)
+		if err != nil {
+			infof(l, "rejected connection from %s: %v", conn.RemoteAddr(), err)
+			pool.stats.reject()
+			return
 		}
+		defer sniffed.Close()
+		conn, host = sniffed, h
+	}
+	var target *socksTarget
+	if pool.socks != nil {
+		t, err := pool.socks.accept(conn)
+		if err != nil {
+			warnf(l, "socks5 handshake with %s failed: %v", conn.RemoteAddr(), err)
+			pool.stats.reject()
+			return
+		}
+		target = t
+		// Let the client know if no egress node could take the request.
+		defer func() {
+			if !target.replied {
+				writeSocksReply(conn, socksGeneralFailure)
+			}
+		}()
 	}
-	return nil
-}
 
-// StartHealthChecks pings a backend to see if it's alive.
-func (p *TCPServerPool) StartHealthChecks() {
-	for _, b := range p.backends {
-		go func(backend *Backend) {
-			for {
-				conn, err := net.DialTimeout("tcp", backend.URL.Host, 2*time.Second)
-				if err != nil {
-					backend.SetHealthy(false)
-					p.log.Printf("error connecting to backend %s: %v", backend.URL.Host, err)
-					backend.Error = err
-				} else {
-					backend.SetHealthy(true)
-					backend.Error = nil
-					conn.Close()
-				}
+	var group string
+	if pool.firstByte != nil {
+		routed, g, err := pool.firstByte.route(conn)
+		if err != nil {
+			infof(l, "rejected connection from %s: %v", conn.RemoteAddr(), err)
+			pool.stats.reject()
+			return
+		}
+		conn, group = routed, g
+	}
 
-				select {
-				case <-time.After(p.healthcheckInterval):
-				case <-p.shutdown:
-					return
-				}
-			}
-		}(b)
+	// Connections routed otherwise are not keyed.
+	var key string
+	if pool.affinity != nil && pinned == nil && group == "" && host == "" && region == "" {
+		conn, key = pool.affinity.read(conn)
 	}
-}
 
-// proxy handles the connection between the client and the selected backend.
-func proxy(conn net.Conn, pool *TCPServerPool, l *log.Logger) {
-	defer conn.Close()
-	backend := pool.Next(conn.RemoteAddr())
+	var label string
+	if host != "" {
+		label = pool.sniffer.hostLabel
+	}
+	pick := func() *Backend {
+		switch {
+		case pinned != nil:
+			return pinned
+		case group != "":
+			return pool.nextInGroup(conn.RemoteAddr(), pool.firstByte.label, group)
+		case host != "":
+			return pool.nextForHost(conn.RemoteAddr(), label, host)
+		case region != "":
+			return pool.nextInRegion(conn.RemoteAddr(), region)
+		case key != "":
+			return pool.nextForKey(key)
+		default:
+			return pool.Next(conn.RemoteAddr())
+		}
+	}
+	backend, err := pool.queue.admit(ctx, pick, pool.saturated)
+	if backend == nil && pinned == nil {
+		// A static backend takes connections no other backend can.
+		if static := pool.nextStatic(conn.RemoteAddr()); static != nil {
+			backend, err = static, nil
+		}
+	}
+	if err != nil {
+		infof(l, "rejected connection from %s: %v", conn.RemoteAddr(), err)
+		pool.stats.reject()
+		return
+	}
+	if pinned == nil {
+		pool.shadow.compare(conn.RemoteAddr(), label, host, backend)
+	}
 	if backend == nil {
-		l.Println("no backend available")
+		infof(l, "no backend available")
+		pool.stats.reject()
+		return
+	}
+	// The delay comes before the breaker so that a connection ending during
+	// it does not hold a half-open trial that is never reported.
+	if err := pool.faults.WaitConnectDelay(ctx); err != nil {
+		return
+	}
+	if !backend.breaker.Allow() {
+		infof(l, "circuit open for backend %s", backend.URL.Host)
+		pool.stats.reject()
 		return
 	}
+	setConnBackend(ctx, backend)
+	release := backend.acquire()
+	defer func() {
+		release()
+		pool.queue.notify()
+	}()
 
-	backendConn, err := net.DialTimeout("tcp", backend.URL.Host, 2*time.Second)
+	dialStart := time.Now()
+	backendConn, err := dialBackend(ctx, backend, conn.RemoteAddr(), pool.tcpOpts.dialer(pool.dialTimeoutFor(backend)), l)
 	if err != nil {
-		l.Println(err)
+		warnf(l, "%v", err)
+		if backend.failed() {
+			warnf(l, "circuit opened for backend %s after repeated dial failures", backend.URL.Host)
+		}
+		pool.stats.reject()
 		return
 	}
+	backend.succeeded()
 	defer backendConn.Close()
+	defer context.AfterFunc(ctx, func() { backendConn.Close() })()
+	if err := pool.tcpOpts.applyConn(backendConn); err != nil {
+		warnf(l, "error setting backend socket options: %v", err)
+	}
+	dialLatency := time.Since(dialStart)
+	connDebugf(l, sampled, "connected %s to backend %s in %s", conn.RemoteAddr(), backend.URL.Host, dialLatency)
+	backend.observeDial(dialLatency, connID(ctx))
+	backend.ResponseTime.Observe(dialLatency)
+
+	if target != nil {
+		if err := pool.socks.connect(backendConn, conn, target, pool.dialTimeoutFor(backend)); err != nil {
+			warnf(l, "socks5 connect to %s via %s failed: %v", target.addr, backend.URL.Host, err)
+			pool.stats.reject()
+			return
+		}
+	}
+
+	capture := pool.capture.session(backend, conn.RemoteAddr(), "tcp", connID(ctx))
+	defer capture.close()
+
+	pool.resources.add(0, 2*copyBufferSize)
+	defer pool.resources.add(0, -2*copyBufferSize)
+	sent := make(chan int64, 1)
+	go func() {
+		pool.resources.add(1, 0)
+		defer pool.resources.add(-1, 0)
+		n, err := io.Copy(&countingWriter{w: capture.writer(backendConn, captureToBackend), n: &backend.bytesSent}, conn)
+		sent <- n
+		pool.checkDeadPeer(ctx, err, true)
+		// Propagate the client's end of stream to the backend.
+		if !closeWrite(backendConn) {
+			backendConn.Close()
+		}
+	}()
 
-	go io.Copy(backendConn, conn)
+	received, err := io.Copy(&countingWriter{w: capture.writer(conn, captureToClient), n: &backend.bytesReceived}, &firstByteReader{
+		r:       backendConn,
+		start:   time.Now(),
+		observe: backend.FirstByteLatency.Observe,
+	})
+	if err != nil {
+		pool.checkDeadPeer(ctx, err, false)
+		warnf(l, "%v", err)
+	}
+	var sentBytes int64
+	var done bool
+	if err == nil && pool.tcpOpts.closeDelay > 0 {
+		sentBytes, done = pool.tcpOpts.lingerClient(conn, sent)
+	}
+	conn.Close()
+	backendConn.Close()
+	if !done {
+		sentBytes = <-sent
+	}
+	infof(l, "connection from %s to %s closed after %s: %d bytes sent, %d bytes received",
+		conn.RemoteAddr(), backend.URL.Host, time.Since(start).Round(time.Millisecond), sentBytes, received)
+}
 
-	_, err = io.Copy(conn, backendConn)
+// Peers found dead by keepalive probes, reported as the cause of closing
+// their connection.
+var (
+	errDeadClient  = errors.New("client stopped answering keepalive probes")
+	errDeadBackend = errors.New("backend stopped answering keepalive probes")
+)
+
+// checkDeadPeer closes the connection if err, from copying data from the
+// client (fromClient) or from the backend, shows that a peer stopped
+// answering keepalive probes. Without this a dead client would leave the
+// backend side of the connection open, and counted, indefinitely.
+func (p *TCPServerPool) checkDeadPeer(ctx context.Context, err error, fromClient bool) {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || !errors.Is(err, syscall.ETIMEDOUT) {
+		return
+	}
+	// A copy reads from its source and writes to its destination.
+	if (opErr.Op == "read") == fromClient {
+		p.stats.deadClients.Add(1)
+		cancelConn(ctx, errDeadClient)
+	} else {
+		p.stats.deadBackends.Add(1)
+		cancelConn(ctx, errDeadBackend)
+	}
+}
+
+// dialBackend opens a connection to the backend on behalf of the client. If
+// the backend uses TLS, the dial timeout also bounds the handshake.
+func dialBackend(ctx context.Context, backend *Backend, client net.Addr, dialer *net.Dialer, l *log.Logger) (net.Conn, error) {
+	if isDebugBackend(backend) {
+		return dialDebugBackend(backend, client, l), nil
+	}
+	if isStaticBackend(backend) {
+		return dialStaticBackend(backend), nil
+	}
+	addr, err := backend.dialAddr(ctx)
 	if err != nil {
-		l.Println(err)
+		return nil, err
+	}
+	if backend.device != "" {
+		d := *dialer
+		d.Control = bindDevice(backend.device)
+		dialer = &d
+	}
+	if backend.tlsConfig != nil {
+		d := tls.Dialer{NetDialer: dialer, Config: backend.tlsConfig}
+		return d.DialContext(ctx, "tcp", addr)
 	}
+	return dialer.DialContext(ctx, "tcp", addr)
 }
@@ -2,12 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"io"
 	"log"
 	"net"
+	"os"
 	"slices"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -44,10 +47,10 @@ func Test_proxy(t *testing.T) {
 
 	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
 		Addr: ":9090",
-		Backends: []string{
-			"http://localhost:8080",
-			"http://localhost:8081",
-			"http://localhost:8082",
+		Backends: []BackendConfig{
+			{URL: "http://localhost:8080"},
+			{URL: "http://localhost:8081"},
+			{URL: "http://localhost:8082"},
 		},
 	})
 	if err != nil {
@@ -101,7 +104,7 @@ func Test_proxy(t *testing.T) {
 func Test_proxy_noBackends(t *testing.T) {
 	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
 		Addr:     ":9090",
-		Backends: []string{},
+		Backends: []BackendConfig{},
 	})
 	if err != nil {
 		t.Fatalf("failed to create server pool: %v", err)
@@ -155,7 +158,7 @@ func Test_proxy_tls(t *testing.T) {
 
 	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
 		Addr:        "localhost:9091",
-		Backends:    []string{"http://localhost:8080"},
+		Backends:    []BackendConfig{{URL: "http://localhost:8080"}},
 		TLSCertPath: "testdata/test_cert.pem",
 		TLSKeyPath:  "testdata/test_key.pem",
 	})
@@ -197,9 +200,9 @@ func Test_proxy_tls(t *testing.T) {
 func TestHealthCheck(t *testing.T) {
 	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
 		Addr: ":9090",
-		Backends: []string{
-			"http://localhost:8080", // Assume this is down
-			"http://localhost:8081", // This will be started
+		Backends: []BackendConfig{
+			{URL: "http://localhost:8080"}, // Assume this is down
+			{URL: "http://localhost:8081"}, // This will be started
 		},
 	})
 	if err != nil {
@@ -237,3 +240,47 @@ func TestHealthCheck(t *testing.T) {
 		t.Errorf("error during shutdown: %v", err)
 	}
 }
+
+func TestTCPServerPool_checkDeadPeer(t *testing.T) {
+	pool := &TCPServerPool{}
+	timeout := func(op string) error {
+		return &net.OpError{Op: op, Net: "tcp", Err: os.NewSyscallError(op, syscall.ETIMEDOUT)}
+	}
+	for _, tt := range []struct {
+		err        error
+		fromClient bool
+		want       error
+	}{
+		{timeout("read"), true, errDeadClient},
+		{timeout("write"), true, errDeadBackend},
+		{timeout("read"), false, errDeadBackend},
+		{timeout("write"), false, errDeadClient},
+		{io.ErrUnexpectedEOF, true, nil},
+		{&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, true, nil},
+	} {
+		ctx, done := pool.conns.track(newConnID(), &net.TCPAddr{}, 0)
+		pool.checkDeadPeer(ctx, tt.err, tt.fromClient)
+		if got := context.Cause(ctx); got != tt.want {
+			t.Errorf("expected cause %v for %v (from client %t), got %v", tt.want, tt.err, tt.fromClient, got)
+		}
+		done()
+	}
+	if c, b := pool.stats.deadClients.Load(), pool.stats.deadBackends.Load(); c != 2 || b != 2 {
+		t.Errorf("expected 2 dead clients and 2 dead backends, got %d and %d", c, b)
+	}
+}
+
+func TestNewTCPServerPool_portRange(t *testing.T) {
+	pool, err := NewTCPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:               "127.0.0.1:0",
+		Backends:           []BackendConfig{{URL: "127.0.0.1:8000-8003"}},
+		MinHealthyBackends: 4,
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer pool.listener.Close()
+	if len(pool.backends) != 4 || pool.backends[3].URL.String() != "tcp://127.0.0.1:8003" {
+		t.Errorf("expected 4 backends from the port range, got %v", pool.backends)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+
+	"golang.org/x/net/ipv4"
+)
+
+// udpBatchSupported reports whether listeners read datagrams in batches with
+// recvmmsg and write those sunk to backends with sendmmsg. Elsewhere a batch
+// holds a single datagram. Replies to clients, fan-out copies and datagrams
+// on flows are written one per system call by the exchange they belong to.
+const udpBatchSupported = runtime.GOOS == "linux"
+
+const (
+	// defaultUDPBatchSize is the number of datagrams read per system call
+	// on Linux.
+	defaultUDPBatchSize = 32
+	// maxUDPBatchSize bounds the batch size, each datagram of a batch
+	// having a buffer of the maximum UDP payload size.
+	maxUDPBatchSize = 1024
+	// maxUDPPayload is the largest payload of a UDP datagram over IPv4.
+	maxUDPPayload = 65507
+	// maxUDPReadBuffers bounds the memory of the read buffers of each
+	// address of a UDP listener, which has a batch of buffers per socket:
+	// 2048 datagrams, e.g. the default batch size on 64 sockets.
+	maxUDPReadBuffers = 2048 * maxUDPPayload
+)
+
+// validateUDPBatchSize returns the number of datagrams read by a UDP
+// listener per system call, defaulting to defaultUDPBatchSize where batches
+// are supported.
+func validateUDPBatchSize(size int) (int, error) {
+	switch {
+	case size < 0:
+		return 0, fmt.Errorf("udp_batch_size must not be negative")
+	case size > maxUDPBatchSize:
+		return 0, fmt.Errorf("udp_batch_size must be at most %d", maxUDPBatchSize)
+	case size > 1 && !udpBatchSupported:
+		return 0, fmt.Errorf("udp_batch_size is not supported on this platform")
+	case size == 0 && udpBatchSupported:
+		return defaultUDPBatchSize, nil
+	}
+	return max(size, 1), nil
+}
+
+// checkUDPReadBuffers checks that the read buffers of batch datagrams for
+// each of sockets sockets fit within maxUDPReadBuffers.
+func checkUDPReadBuffers(batch, sockets int) error {
+	if n := batch * max(sockets, 1); n*maxUDPPayload > maxUDPReadBuffers {
+		return fmt.Errorf("udp_batch_size times udp_receive_sockets must be at most %d, got %d", maxUDPReadBuffers/maxUDPPayload, n)
+	}
+	return nil
+}
+
+// udpBatch reads datagrams from a socket of a UDP listener, several at a
+// time with recvmmsg when it holds more than one. The datagrams of a read
+// are valid until the next.
+type udpBatch struct {
+	conn *net.UDPConn
+	// pc is nil unless datagrams are read in batches.
+	pc   *ipv4.PacketConn
+	msgs []ipv4.Message
+}
+
+func newUDPBatch(conn *net.UDPConn, size int) *udpBatch {
+	b := &udpBatch{conn: conn, msgs: make([]ipv4.Message, size)}
+	for i := range b.msgs {
+		b.msgs[i].Buffers = [][]byte{make([]byte, maxUDPPayload)}
+	}
+	if size > 1 {
+		b.pc = ipv4.NewPacketConn(conn)
+	}
+	return b
+}
+
+// read reads the next datagrams, returning how many were read.
+func (b *udpBatch) read() (int, error) {
+	if b.pc != nil {
+		return b.pc.ReadBatch(b.msgs, 0)
+	}
+	n, addr, err := b.conn.ReadFromUDP(b.msgs[0].Buffers[0])
+	if err != nil {
+		return 0, err
+	}
+	b.msgs[0].N, b.msgs[0].Addr = n, addr
+	return 1, nil
+}
+
+// datagram returns the sender and payload of the i-th datagram of the last
+// read.
+func (b *udpBatch) datagram(i int) (*net.UDPAddr, []byte) {
+	m := &b.msgs[i]
+	return m.Addr.(*net.UDPAddr), m.Buffers[0][:m.N]
+}
+
+// sinkQueue holds the datagrams of a read batch to be written to the sink
+// socket of each backend, with sendmmsg on Linux, when the batch is
+// flushed. A queue belongs to a read loop.
+type sinkQueue struct {
+	pending map[*net.UDPConn]*sinkWrites
+}
+
+// sinkWrites are the datagrams queued for a backend's sink socket.
+type sinkWrites struct {
+	backend *Backend
+	pc      *ipv4.PacketConn
+	msgs    []ipv4.Message
+}
+
+func newSinkQueue() *sinkQueue {
+	return &sinkQueue{pending: make(map[*net.UDPConn]*sinkWrites)}
+}
+
+// add queues data to be written to conn, the sink socket of backend. data
+// must stay valid until the queue is flushed.
+func (q *sinkQueue) add(backend *Backend, conn *net.UDPConn, data []byte) {
+	w := q.pending[conn]
+	if w == nil {
+		w = &sinkWrites{backend: backend, pc: ipv4.NewPacketConn(conn)}
+		q.pending[conn] = w
+	}
+	w.msgs = append(w.msgs, ipv4.Message{Buffers: [][]byte{data}})
+}
+
+// flushSink writes the datagrams queued in q. Sockets without datagrams
+// since the last flush are forgotten, so that those closed once their
+// backend is removed are not kept.
+func (p *UDPServerPool) flushSink(q *sinkQueue) {
+	for conn, w := range q.pending {
+		if len(w.msgs) == 0 {
+			delete(q.pending, conn)
+			continue
+		}
+		sent, err := writeBatch(w.pc, w.msgs)
+		if err != nil {
+			warnf(p.log, "Error forwarding to backend %s: %v", w.backend.URL.Host, err)
+			p.dropSinkConn(w.backend, conn)
+			p.backendFailed(w.backend)
+			delete(q.pending, conn)
+		}
+		for i := range sent {
+			w.backend.bytesSent.Add(len(w.msgs[i].Buffers[0]))
+			w.backend.succeeded()
+		}
+		// The payloads belong to the read batch.
+		clear(w.msgs)
+		w.msgs = w.msgs[:0]
+	}
+}
+
+// writeBatch writes msgs to pc, returning how many were written before an
+// error.
+func writeBatch(pc *ipv4.PacketConn, msgs []ipv4.Message) (int, error) {
+	sent := 0
+	for sent < len(msgs) {
+		n, err := pc.WriteBatch(msgs[sent:], 0)
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+		if n == 0 {
+			return sent, io.ErrShortWrite
+		}
+	}
+	return sent, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_validateUDPBatchSize(t *testing.T) {
+	want := 1
+	if udpBatchSupported {
+		want = defaultUDPBatchSize
+	}
+	if got, err := validateUDPBatchSize(0); got != want || err != nil {
+		t.Errorf("expected the default of %d, got %d, %v", want, got, err)
+	}
+	if got, err := validateUDPBatchSize(1); got != 1 || err != nil {
+		t.Errorf("expected batches to be disabled, got %d, %v", got, err)
+	}
+	for _, size := range []int{-1, maxUDPBatchSize + 1} {
+		if _, err := validateUDPBatchSize(size); err == nil {
+			t.Errorf("expected an error for %d", size)
+		}
+	}
+}
+
+func Test_checkUDPReadBuffers(t *testing.T) {
+	for _, tt := range []struct {
+		batch, sockets int
+		ok             bool
+	}{
+		{defaultUDPBatchSize, 0, true},
+		{defaultUDPBatchSize, 64, true},
+		{maxUDPBatchSize, 2, true},
+		{maxUDPBatchSize, 3, false},
+		{maxUDPBatchSize, maxUDPReceiveSockets, false},
+	} {
+		if err := checkUDPReadBuffers(tt.batch, tt.sockets); (err == nil) != tt.ok {
+			t.Errorf("expected ok=%t for a batch of %d on %d sockets, got %v", tt.ok, tt.batch, tt.sockets, err)
+		}
+	}
+}
+
+func TestUDPBatch_read(t *testing.T) {
+	for _, network := range []string{"127.0.0.1:0", "[::1]:0"} {
+		conn, err := net.ListenPacket("udp", network)
+		if err != nil {
+			t.Logf("skipping %s: %v", network, err)
+			continue
+		}
+		defer conn.Close()
+		client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		defer client.Close()
+		for i := range 5 {
+			client.Write(fmt.Appendf(nil, "datagram %d", i))
+		}
+
+		for _, size := range []int{1, 4} {
+			batch := newUDPBatch(conn.(*net.UDPConn), size)
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, err := batch.read()
+			if err != nil || n < 1 || n > size {
+				t.Fatalf("%s: expected 1 to %d datagrams, got %d, %v", network, size, n, err)
+			}
+			if udpBatchSupported && n != size {
+				t.Errorf("%s: expected the queued datagrams to be read in a batch of %d, got %d", network, size, n)
+			}
+			addr, data := batch.datagram(0)
+			if addr.String() != client.LocalAddr().String() || len(data) != len("datagram 0") {
+				t.Errorf("%s: unexpected datagram %q from %s", network, data, addr)
+			}
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Fan-out reply modes.
+const (
+	fanOutReplyNone  = "none"
+	fanOutReplyFirst = "first"
+)
+
+const defaultFanOutTimeout = 2 * time.Second
+
+// udpFanOut duplicates each datagram to every available backend of a UDP
+// pool instead of choosing one. Replies are either discarded or, with
+// replyFirst, the first one received within timeout is returned to the
+// client and the rest are dropped.
+type udpFanOut struct {
+	replyFirst bool
+	timeout    time.Duration
+}
+
+// newUDPFanOut validates config, returning nil if fan-out is not enabled.
+func newUDPFanOut(config *UDPFanOutConfig) (*udpFanOut, error) {
+	if config == nil || !config.Enabled {
+		return nil, nil
+	}
+	f := &udpFanOut{timeout: defaultFanOutTimeout}
+	switch config.Reply {
+	case "", fanOutReplyNone:
+	case fanOutReplyFirst:
+		f.replyFirst = true
+	default:
+		return nil, fmt.Errorf("invalid udp_fan_out reply %q: must be %q or %q", config.Reply, fanOutReplyNone, fanOutReplyFirst)
+	}
+	if config.Timeout != "" {
+		d, err := time.ParseDuration(config.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid udp_fan_out timeout: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("udp_fan_out timeout must be positive")
+		}
+		f.timeout = d
+	}
+	return f, nil
+}
+
+// fanOutBackends returns every backend a datagram may currently be sent to.
+func (p *UDPServerPool) fanOutBackends() []*Backend {
+	var backends []*Backend
+	for _, b := range p.Backends() {
+		if p.available(b) {
+			backends = append(backends, b)
+		}
+	}
+	return backends
+}
+
+// fanOutDatagram sends a copy of data to every available backend, replying
+// to clientAddr through conn with the first answer if configured to.
+// Backends whose circuit is open are skipped. Errors exchanging with a
+// backend count as failures in its circuit breaker; exchanges abandoned
+// because another backend answered first or the timeout passed do not.
+func (p *UDPServerPool) fanOutDatagram(ctx context.Context, conn *net.UDPConn, clientAddr *net.UDPAddr, data []byte) {
+	l := connLogger(p.log, newConnID())
+	backends := p.fanOutBackends()
+	if len(backends) == 0 {
+		infof(l, "No healthy backend available")
+		p.stats.reject()
+		return
+	}
+	defer p.stats.accept()()
+
+	ctx, cancel := context.WithTimeout(ctx, p.fanOut.timeout)
+	defer cancel()
+	replies := make(chan []byte, len(backends))
+	var wg sync.WaitGroup
+	for _, backend := range backends {
+		if p.faults.ShouldDrop(backend) || !backend.breaker.Allow() {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.resources.add(1, 0)
+			defer p.resources.add(-1, 0)
+			defer backend.acquire()()
+			var resp []byte
+			var err error
+			switch {
+			case isDebugBackend(backend):
+				resp = debugResponse(backend, clientAddr, data, l)
+			case p.fanOut.replyFirst:
+				resp, err = p.forwardToBackend(ctx, backend, data)
+			default:
+				err = p.sendToBackend(ctx, backend, data)
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					warnf(l, "Error forwarding to backend: %v", err)
+					p.backendFailed(backend)
+				}
+				return
+			}
+			backend.succeeded()
+			if resp != nil {
+				replies <- resp
+			}
+		}()
+	}
+	if !p.fanOut.replyFirst {
+		wg.Wait()
+		return
+	}
+
+	go func() {
+		p.resources.add(1, 0)
+		defer p.resources.add(-1, 0)
+		wg.Wait()
+		close(replies)
+	}()
+	resp, ok := <-replies
+	// The remaining exchanges are abandoned.
+	cancel()
+	wg.Wait()
+	if !ok {
+		infof(l, "No backend replied to datagram from %s", clientAddr)
+		return
+	}
+	if _, err := conn.WriteToUDP(resp, clientAddr); err != nil {
+		warnf(l, "Error writing response to client: %v", err)
+	}
+}
+
+// sendToBackend sends data to the backend without waiting for a reply.
+func (p *UDPServerPool) sendToBackend(ctx context.Context, backend *Backend, data []byte) error {
+	dialStart := time.Now()
+	conn, err := p.dialUDPBackend(ctx, backend)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	backend.observeDial(time.Since(dialStart), connID(ctx))
+
+	if _, err := conn.Write(data); err != nil {
+		return fmt.Errorf("error writing to backend %s: %w", backend.URL.Host, err)
+	}
+	backend.bytesSent.Add(len(data))
+	return nil
+}
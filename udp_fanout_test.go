@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_newUDPFanOut(t *testing.T) {
+	if f, err := newUDPFanOut(&UDPFanOutConfig{}); f != nil || err != nil {
+		t.Errorf("expected nil when disabled, got %v, %v", f, err)
+	}
+	f, err := newUDPFanOut(&UDPFanOutConfig{Enabled: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if f.replyFirst || f.timeout != defaultFanOutTimeout {
+		t.Errorf("expected replies to be discarded with the default timeout, got %+v", f)
+	}
+	for _, config := range []UDPFanOutConfig{
+		{Enabled: true, Reply: "all"},
+		{Enabled: true, Timeout: "soon"},
+		{Enabled: true, Timeout: "0s"},
+	} {
+		if _, err := newUDPFanOut(&config); err == nil {
+			t.Errorf("expected error for %+v", config)
+		}
+	}
+
+	_, err = NewUDPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:      "127.0.0.1:0",
+		UDPFanOut: &UDPFanOutConfig{Enabled: true},
+		UDPFlows:  &UDPFlowConfig{Enabled: true},
+	})
+	if err == nil {
+		t.Errorf("expected error for udp_fan_out with udp_flows")
+	}
+}
+
+// dialFanOut starts a UDP pool fanning out to backends, all healthy, and
+// returns a socket connected to it.
+func dialFanOut(t *testing.T, fanOut *UDPFanOutConfig, backends ...*net.UDPConn) net.Conn {
+	t.Helper()
+	var urls []string
+	for _, b := range backends {
+		urls = append(urls, "udp://"+b.LocalAddr().String())
+	}
+	pool := startTestPool(t, NewUDPServerPool, func(c *Config) { c.UDPFanOut = fanOut }, urls...)
+
+	conn, err := net.Dial("udp", pool.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	return conn
+}
+
+func TestUDPServerPool_fanOut(t *testing.T) {
+	received := make(chan string, 2)
+	var backends []*net.UDPConn
+	for _, name := range []string{"a", "b"} {
+		backends = append(backends, startUDPResponder(t, func(b []byte) []byte {
+			received <- name + ":" + string(b)
+			return []byte(name)
+		}))
+	}
+	conn := dialFanOut(t, &UDPFanOutConfig{Enabled: true}, backends...)
+
+	conn.Write([]byte("gauge:1|g"))
+	got := []string{<-received, <-received}
+	if !strings.Contains(strings.Join(got, ","), "a:gauge:1|g") || !strings.Contains(strings.Join(got, ","), "b:gauge:1|g") {
+		t.Errorf("expected the datagram at both backends, got %v", got)
+	}
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 16)); err == nil {
+		t.Errorf("expected backend replies to be discarded")
+	}
+}
+
+func TestUDPServerPool_fanOutFirstReply(t *testing.T) {
+	fast := startUDPResponder(t, func([]byte) []byte { return []byte("fast") })
+	slow := startUDPResponder(t, func([]byte) []byte {
+		time.Sleep(200 * time.Millisecond)
+		return []byte("slow")
+	})
+	conn := dialFanOut(t, &UDPFanOutConfig{Enabled: true, Reply: fanOutReplyFirst}, slow, fast)
+
+	conn.Write([]byte("query"))
+	buf := make([]byte, 16)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "fast" {
+		t.Errorf("expected the first reply, got %q, %v", buf[:n], err)
+	}
+	conn.SetReadDeadline(time.Now().Add(400 * time.Millisecond))
+	if n, err := conn.Read(buf); err == nil {
+		t.Errorf("expected only one reply, got %q", buf[:n])
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultFloodSourceRate = 100
+	defaultFloodMaxSources = 65536
+	// floodTopSources is the number of sources listed by the API.
+	floodTopSources = 20
+)
+
+// Reasons datagrams are dropped by the flood guard.
+const (
+	dropSourceRate  = "source_rate"
+	dropGlobalRate  = "global_rate"
+	dropSourceTable = "source_table_full"
+)
+
+// tokenBucket allows rate events per second on average, with bursts of up
+// to burst events.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// take takes a token if one is available.
+func (b *tokenBucket) take(now time.Time) bool {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full reports whether the bucket has refilled, so that forgetting it does
+// not change how the source is limited.
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// floodSource is the rate limit and accounting of one source prefix.
+type floodSource struct {
+	bucket   *tokenBucket
+	allowed  uint64
+	dropped  uint64
+	lastSeen time.Time
+}
+
+// udpFloodGuard drops datagrams from sources exceeding their rate, and all
+// datagrams beyond the listener's global rate, before they are forwarded.
+// Sources are grouped by address prefix so that a flood spread over a
+// subnet is limited as one source.
+type udpFloodGuard struct {
+	sourceRate  float64
+	sourceBurst int
+	maxSources  int
+	ipv4Prefix  int
+	ipv6Prefix  int
+
+	mux       sync.Mutex
+	global    *tokenBucket
+	sources   map[netip.Prefix]*floodSource
+	lastSweep time.Time
+
+	dropped map[string]*atomic.Uint64
+}
+
+func newUDPFloodGuard(config *UDPFloodConfig) (*udpFloodGuard, error) {
+	if config == nil || !config.Enabled {
+		return nil, nil
+	}
+	if config.SourceRate < 0 || config.GlobalRate < 0 {
+		return nil, fmt.Errorf("udp_flood rates must not be negative")
+	}
+	if config.SourceBurst < 0 || config.GlobalBurst < 0 || config.MaxSources < 0 {
+		return nil, fmt.Errorf("udp_flood bursts and max_sources must not be negative")
+	}
+	g := &udpFloodGuard{
+		sourceRate: cmp.Or(config.SourceRate, defaultFloodSourceRate),
+		maxSources: cmp.Or(config.MaxSources, defaultFloodMaxSources),
+		ipv4Prefix: cmp.Or(config.IPv4Prefix, 32),
+		ipv6Prefix: cmp.Or(config.IPv6Prefix, 64),
+		sources:    make(map[netip.Prefix]*floodSource),
+		dropped:    make(map[string]*atomic.Uint64),
+	}
+	if g.ipv4Prefix > 32 || g.ipv6Prefix > 128 || g.ipv4Prefix < 0 || g.ipv6Prefix < 0 {
+		return nil, fmt.Errorf("udp_flood prefixes must be at most 32 bits for IPv4 and 128 bits for IPv6")
+	}
+	g.sourceBurst = cmp.Or(config.SourceBurst, max(int(g.sourceRate), 1))
+	if config.GlobalRate > 0 {
+		g.global = newTokenBucket(config.GlobalRate, cmp.Or(config.GlobalBurst, max(int(config.GlobalRate), 1)), time.Now())
+	}
+	for _, reason := range []string{dropSourceRate, dropGlobalRate, dropSourceTable} {
+		g.dropped[reason] = new(atomic.Uint64)
+	}
+	return g, nil
+}
+
+// sourcePrefix returns the prefix a client address is accounted under.
+func (g *udpFloodGuard) sourcePrefix(addr *net.UDPAddr) netip.Prefix {
+	ip := addr.AddrPort().Addr().Unmap()
+	bits := g.ipv6Prefix
+	if ip.Is4() {
+		bits = g.ipv4Prefix
+	}
+	prefix, _ := ip.Prefix(bits)
+	return prefix
+}
+
+// allow reports whether a datagram from addr may be forwarded, counting the
+// reason it is dropped otherwise. A nil guard allows everything.
+func (g *udpFloodGuard) allow(addr *net.UDPAddr, now time.Time) bool {
+	if g == nil {
+		return true
+	}
+	prefix := g.sourcePrefix(addr)
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	src := g.sources[prefix]
+	if src == nil {
+		if len(g.sources) >= g.maxSources && !g.sweep(now) {
+			g.dropped[dropSourceTable].Add(1)
+			return false
+		}
+		src = &floodSource{bucket: newTokenBucket(g.sourceRate, g.sourceBurst, now)}
+		g.sources[prefix] = src
+	}
+	src.lastSeen = now
+	if !src.bucket.take(now) {
+		src.dropped++
+		g.dropped[dropSourceRate].Add(1)
+		return false
+	}
+	if g.global != nil && !g.global.take(now) {
+		src.dropped++
+		g.dropped[dropGlobalRate].Add(1)
+		return false
+	}
+	src.allowed++
+	return true
+}
+
+// sweep forgets the sources whose buckets have refilled, at most once per
+// second, and reports whether there is room for a new source.
+func (g *udpFloodGuard) sweep(now time.Time) bool {
+	if now.Sub(g.lastSweep) >= time.Second {
+		g.lastSweep = now
+		for prefix, src := range g.sources {
+			if src.bucket.full(now) {
+				delete(g.sources, prefix)
+			}
+		}
+	}
+	return len(g.sources) < g.maxSources
+}
+
+// Dropped returns the number of datagrams dropped for reason.
+func (g *udpFloodGuard) Dropped(reason string) uint64 {
+	return g.dropped[reason].Load()
+}
+
+// Sources returns the number of tracked source prefixes.
+func (g *udpFloodGuard) Sources() int {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	return len(g.sources)
+}
+
+// floodSourceView is the accounting of one source prefix.
+type floodSourceView struct {
+	Source   string    `json:"source"`
+	Allowed  uint64    `json:"allowed"`
+	Dropped  uint64    `json:"dropped"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// floodView reports the flood guard's settings, drops by reason and the
+// tracked sources that dropped the most datagrams.
+type floodView struct {
+	SourceRate  float64           `json:"source_rate"`
+	SourceBurst int               `json:"source_burst"`
+	GlobalRate  float64           `json:"global_rate,omitempty"`
+	Dropped     map[string]uint64 `json:"dropped"`
+	Sources     int               `json:"sources"`
+	TopSources  []floodSourceView `json:"top_sources"`
+}
+
+func (g *udpFloodGuard) view() floodView {
+	v := floodView{SourceRate: g.sourceRate, SourceBurst: g.sourceBurst, Dropped: make(map[string]uint64), TopSources: []floodSourceView{}}
+	for reason, n := range g.dropped {
+		v.Dropped[reason] = n.Load()
+	}
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if g.global != nil {
+		v.GlobalRate = g.global.rate
+	}
+	v.Sources = len(g.sources)
+	for prefix, src := range g.sources {
+		v.TopSources = append(v.TopSources, floodSourceView{Source: prefix.String(), Allowed: src.allowed, Dropped: src.dropped, LastSeen: src.lastSeen})
+	}
+	slices.SortFunc(v.TopSources, func(a, b floodSourceView) int {
+		return cmp.Or(cmp.Compare(b.Dropped, a.Dropped), cmp.Compare(b.Allowed, a.Allowed), cmp.Compare(a.Source, b.Source))
+	})
+	if len(v.TopSources) > floodTopSources {
+		v.TopSources = v.TopSources[:floodTopSources]
+	}
+	return v
+}
+
+// floodAPIHandler reports the UDP flood guard's drops and top sources.
+func (p *BaseServerPool) floodAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	if p.flood == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("udp flood protection is not enabled"))
+		return
+	}
+	writeJSON(w, http.StatusOK, p.flood.view())
+}
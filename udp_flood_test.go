@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_newUDPFloodGuard(t *testing.T) {
+	if g, err := newUDPFloodGuard(nil); g != nil || err != nil {
+		t.Errorf("expected no guard when not configured, got %v, %v", g, err)
+	}
+	g, err := newUDPFloodGuard(&UDPFloodConfig{Enabled: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if g.sourceRate != defaultFloodSourceRate || g.sourceBurst != defaultFloodSourceRate || g.global != nil {
+		t.Errorf("unexpected defaults %+v", g)
+	}
+	for _, config := range []*UDPFloodConfig{
+		{Enabled: true, SourceRate: -1},
+		{Enabled: true, MaxSources: -1},
+		{Enabled: true, IPv4Prefix: 33},
+	} {
+		if _, err := newUDPFloodGuard(config); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
+
+func TestUDPFloodGuard_sourceRate(t *testing.T) {
+	g, _ := newUDPFloodGuard(&UDPFloodConfig{Enabled: true, SourceRate: 10, SourceBurst: 2, IPv4Prefix: 24})
+	now := time.Now()
+	a := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}
+	sameSubnet := &net.UDPAddr{IP: net.ParseIP("192.0.2.200"), Port: 2000}
+	other := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 1000}
+
+	if !g.allow(a, now) || !g.allow(sameSubnet, now) {
+		t.Fatalf("expected the burst to be allowed")
+	}
+	if g.allow(a, now) {
+		t.Errorf("expected the source prefix to be limited after its burst")
+	}
+	if !g.allow(other, now) {
+		t.Errorf("expected another source not to be limited")
+	}
+	if !g.allow(a, now.Add(100*time.Millisecond)) {
+		t.Errorf("expected a token to be refilled after 100ms")
+	}
+	if got := g.Dropped(dropSourceRate); got != 1 {
+		t.Errorf("expected 1 datagram dropped for the source rate, got %d", got)
+	}
+
+	v := g.view()
+	if v.Sources != 2 || v.TopSources[0].Source != "192.0.2.0/24" || v.TopSources[0].Dropped != 1 || v.TopSources[0].Allowed != 3 {
+		t.Errorf("unexpected view %+v", v)
+	}
+}
+
+func TestUDPFloodGuard_globalRate(t *testing.T) {
+	g, _ := newUDPFloodGuard(&UDPFloodConfig{Enabled: true, GlobalRate: 2})
+	now := time.Now()
+	for i := range 3 {
+		addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i+1)), Port: 1000}
+		if allowed := g.allow(addr, now); allowed != (i < 2) {
+			t.Errorf("datagram %d: expected allowed %t, got %t", i, i < 2, allowed)
+		}
+	}
+	if got := g.Dropped(dropGlobalRate); got != 1 {
+		t.Errorf("expected 1 datagram dropped for the global rate, got %d", got)
+	}
+}
+
+func TestUDPFloodGuard_sourceTable(t *testing.T) {
+	g, _ := newUDPFloodGuard(&UDPFloodConfig{Enabled: true, SourceRate: 1, SourceBurst: 1, MaxSources: 2})
+	now := time.Now()
+	g.allow(&net.UDPAddr{IP: net.ParseIP("10.0.0.1")}, now)
+	g.allow(&net.UDPAddr{IP: net.ParseIP("10.0.0.2")}, now)
+	if g.allow(&net.UDPAddr{IP: net.ParseIP("10.0.0.3")}, now) {
+		t.Errorf("expected a new source to be dropped while the table is full")
+	}
+	if got := g.Dropped(dropSourceTable); got != 1 {
+		t.Errorf("expected 1 datagram dropped for a full table, got %d", got)
+	}
+	// Once their buckets have refilled the sources are forgotten.
+	if !g.allow(&net.UDPAddr{IP: net.ParseIP("10.0.0.3")}, now.Add(2*time.Second)) {
+		t.Errorf("expected a new source to be tracked once idle sources are swept")
+	}
+	if got := g.Sources(); got != 1 {
+		t.Errorf("expected 1 tracked source after the sweep, got %d", got)
+	}
+}
+
+func TestUDPServerPool_floodProtection(t *testing.T) {
+	backend := startUDPResponder(t, func([]byte) []byte { return []byte("pong") })
+	pool, err := NewUDPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:     "127.0.0.1:0",
+		Backends: []BackendConfig{{URL: backend.LocalAddr().String()}},
+		UDPFlood: &UDPFloodConfig{Enabled: true, SourceRate: 1, SourceBurst: 1},
+	})
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	pool.backends[0].SetHealthy(true)
+	if err := pool.Start(); err != nil {
+		t.Fatalf("failed to start pool: %v", err)
+	}
+	defer pool.Shutdown(t.Context())
+
+	client, err := net.Dial("udp", pool.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("failed to dial pool: %v", err)
+	}
+	defer client.Close()
+	for range 3 {
+		client.Write([]byte("ping"))
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 16)
+	if n, err := client.Read(buf); err != nil || string(buf[:n]) != "pong" {
+		t.Fatalf("expected the first datagram to be answered, got %q, %v", buf[:n], err)
+	}
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := client.Read(buf); err == nil {
+		t.Errorf("expected datagrams beyond the source rate to be dropped")
+	}
+
+	rec := httptest.NewRecorder()
+	pool.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if want := `nlb_udp_dropped_datagrams_total{reason="source_rate"} 2`; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("expected metrics to contain %q", want)
+	}
+
+	rec = httptest.NewRecorder()
+	pool.floodAPIHandler(rec, httptest.NewRequest("GET", "/api/flood", nil))
+	var v floodView
+	if err := json.NewDecoder(rec.Body).Decode(&v); err != nil {
+		t.Fatalf("failed to decode view: %v", err)
+	}
+	if v.Dropped[dropSourceRate] != 2 || len(v.TopSources) != 1 || v.TopSources[0].Source != "127.0.0.1/32" {
+		t.Errorf("unexpected view %+v", v)
+	}
+}
+
+func TestBaseServerPool_floodAPIHandler_disabled(t *testing.T) {
+	pool := newConsoleTestPool("", true)
+	rec := httptest.NewRecorder()
+	pool.floodAPIHandler(rec, httptest.NewRequest("GET", "/api/flood", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", rec.Code)
+	}
+}
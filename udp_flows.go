@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultUDPFlowIdleTimeout = 60 * time.Second
+
+// udpFlow relays datagrams between one client address and the backend it was
+// assigned. The upstream socket is kept for the lifetime of the flow so the
+// backend sees a stable source port and may send any number of replies.
+type udpFlow struct {
+	id      string
+	key     string
+	client  *net.UDPAddr
+	backend *Backend
+	// upstream is connected to the backend.
+	upstream *net.UDPConn
+	// listener is the socket the flow's first datagram was received on.
+	listener *net.UDPConn
+	// downstream is connected to the client and bound to the listener
+	// address. It is nil when replies are written through the listener.
+	downstream *net.UDPConn
+	release    func()
+	capture    *captureSession
+	log        *log.Logger
+	start      time.Time
+	// untrack removes the flow from the pool's in-flight connections.
+	untrack func()
+
+	lastActive atomic.Int64
+	// lastSent is when the most recent unanswered datagram was sent to the
+	// backend, used to measure response time.
+	lastSent  atomic.Int64
+	datagrams atomic.Uint64
+	closeOnce sync.Once
+}
+
+func (f *udpFlow) touch() {
+	f.lastActive.Store(time.Now().UnixNano())
+}
+
+func (f *udpFlow) idleFor() time.Duration {
+	return time.Since(time.Unix(0, f.lastActive.Load()))
+}
+
+// udpFlowTable tracks the active flows of a UDP pool, keyed by client address.
+type udpFlowTable struct {
+	idleTimeout time.Duration
+	// connectedSockets gives each flow its own client-facing socket.
+	connectedSockets bool
+
+	mux   sync.Mutex
+	flows map[string]*udpFlow
+}
+
+func newUDPFlowTable(cfg *UDPFlowConfig) (*udpFlowTable, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+	t := &udpFlowTable{
+		idleTimeout:      defaultUDPFlowIdleTimeout,
+		connectedSockets: cfg.ConnectedSockets,
+		flows:            make(map[string]*udpFlow),
+	}
+	if cfg.IdleTimeout != "" {
+		d, err := time.ParseDuration(cfg.IdleTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid udp_flows idle_timeout: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("udp_flows idle_timeout must be positive")
+		}
+		t.idleTimeout = d
+	}
+	if t.connectedSockets && !reuseAddrSupported {
+		return nil, fmt.Errorf("udp_flows connected_sockets is not supported on this platform")
+	}
+	return t, nil
+}
+
+func (t *udpFlowTable) get(client *net.UDPAddr) *udpFlow {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.flows[client.String()]
+}
+
+// add registers f unless another flow for the same client won the race, in
+// which case the existing flow is returned and f is not stored.
+func (t *udpFlowTable) add(f *udpFlow) (*udpFlow, bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if existing, ok := t.flows[f.key]; ok {
+		return existing, false
+	}
+	t.flows[f.key] = f
+	return f, true
+}
+
+func (t *udpFlowTable) remove(f *udpFlow) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.flows[f.key] == f {
+		delete(t.flows, f.key)
+	}
+}
+
+// Len returns the number of active flows.
+func (t *udpFlowTable) Len() int {
+	if t == nil {
+		return 0
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return len(t.flows)
+}
+
+func (t *udpFlowTable) all() []*udpFlow {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	flows := make([]*udpFlow, 0, len(t.flows))
+	for _, f := range t.flows {
+		flows = append(flows, f)
+	}
+	return flows
+}
+
+// openFlow dials the backend for a new client flow and starts relaying its
+// replies, which are sent from listener, the socket the client used. If a
+// flow for the client already exists it is returned instead.
+// The flow is closed when its own context, derived from the pool's
+// connections, is cancelled.
+func (p *UDPServerPool) openFlow(ctx context.Context, listener *net.UDPConn, id string, client *net.UDPAddr, backend *Backend) (*udpFlow, error) {
+	dialStart := time.Now()
+	upstream, err := p.dialUDPBackend(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
+	backend.observeDial(time.Since(dialStart), id)
+
+	f := &udpFlow{
+		id:       id,
+		key:      client.String(),
+		client:   client,
+		listener: listener,
+		backend:  backend,
+		upstream: upstream,
+		log:      connLogger(p.log, id),
+		start:    time.Now(),
+	}
+	if p.flows.connectedSockets {
+		f.downstream, err = dialReuseAddr(listener.LocalAddr(), client, p.device)
+		if err != nil {
+			upstream.Close()
+			return nil, fmt.Errorf("error opening flow socket for %s: %w", client, err)
+		}
+	}
+	f.touch()
+	f.capture = p.capture.session(backend, client, "udp", id)
+
+	flow, added := p.flows.add(f)
+	if !added {
+		f.capture.close()
+		f.upstream.Close()
+		if f.downstream != nil {
+			f.downstream.Close()
+		}
+		return flow, nil
+	}
+	backend.sockets.open.Add(1)
+	closeConn, release := p.stats.accept(), backend.acquire()
+	f.release = func() {
+		release()
+		closeConn()
+	}
+	flowCtx, untrack := p.conns.track(id, client, p.connTimeout)
+	setConnBackend(flowCtx, backend)
+	stop := context.AfterFunc(flowCtx, func() {
+		infof(f.log, "closing flow from %s: %v", client, context.Cause(flowCtx))
+		p.closeFlow(f)
+	})
+	f.untrack = func() {
+		stop()
+		untrack()
+	}
+
+	p.wg.Add(1)
+	go p.relayReplies(f)
+	if f.downstream != nil {
+		p.wg.Add(1)
+		go p.relayRequests(f)
+	}
+	return f, nil
+}
+
+// closeFlow tears down f and releases its backend connection slot.
+func (p *UDPServerPool) closeFlow(f *udpFlow) {
+	f.closeOnce.Do(func() {
+		p.flows.remove(f)
+		f.upstream.Close()
+		f.backend.sockets.open.Add(-1)
+		if f.lastSent.Swap(0) != 0 {
+			f.backend.sockets.pending.Add(-1)
+		}
+		if f.downstream != nil {
+			f.downstream.Close()
+		}
+		if f.release != nil {
+			f.release()
+		}
+		if f.untrack != nil {
+			f.untrack()
+		}
+		f.capture.close()
+		infof(f.log, "flow from %s to %s closed after %s", f.client, f.backend.URL.Host, time.Since(f.start).Round(time.Millisecond))
+	})
+}
+
+// closeFlows tears down every active flow.
+func (p *UDPServerPool) closeFlows() {
+	if p.flows == nil {
+		return
+	}
+	for _, f := range p.flows.all() {
+		p.closeFlow(f)
+	}
+}
+
+// sendUpstream forwards a client datagram to the flow's backend.
+func (p *UDPServerPool) sendUpstream(f *udpFlow, data []byte) {
+	f.touch()
+	// Every datagram after the one that opened the flow reuses its socket.
+	if f.datagrams.Add(1) > 1 {
+		f.backend.sockets.hits.Add(1)
+	}
+	if p.faults.ShouldDrop(f.backend) {
+		return
+	}
+	if f.lastSent.CompareAndSwap(0, time.Now().UnixNano()) {
+		f.backend.sockets.pending.Add(1)
+	}
+	if _, err := f.upstream.Write(data); err != nil {
+		warnf(f.log, "Error writing to backend %s: %v", f.backend.URL.Host, err)
+		return
+	}
+	f.capture.record(captureToBackend, data)
+	f.backend.bytesSent.Add(len(data))
+}
+
+// relayReplies copies backend replies to the client until the flow has been
+// idle for the configured timeout or is closed.
+func (p *UDPServerPool) relayReplies(f *udpFlow) {
+	defer p.wg.Done()
+	defer p.closeFlow(f)
+	defer p.panics.guard(f.log, f.id, f.client)
+
+	buf := make([]byte, 65507)
+	p.resources.add(1, len(buf))
+	defer p.resources.add(-1, -len(buf))
+	for {
+		f.upstream.SetReadDeadline(time.Now().Add(p.flows.idleTimeout))
+		n, err := f.upstream.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && f.idleFor() < p.flows.idleTimeout {
+				continue
+			}
+			return
+		}
+		f.touch()
+		f.backend.bytesReceived.Add(n)
+		if sent := f.lastSent.Swap(0); sent != 0 {
+			f.backend.sockets.pending.Add(-1)
+			rtt := time.Since(time.Unix(0, sent))
+			f.backend.FirstByteLatency.Observe(rtt)
+			f.backend.ResponseTime.Observe(rtt)
+		}
+
+		f.capture.record(captureToClient, buf[:n])
+		if f.downstream != nil {
+			_, err = f.downstream.Write(buf[:n])
+		} else {
+			_, err = f.listener.WriteToUDP(buf[:n], f.client)
+		}
+		if err != nil {
+			warnf(f.log, "Error writing response to client: %v", err)
+		}
+	}
+}
+
+// relayRequests forwards datagrams the kernel delivers to the flow's
+// connected client socket rather than to the listener.
+func (p *UDPServerPool) relayRequests(f *udpFlow) {
+	defer p.wg.Done()
+	defer p.closeFlow(f)
+	defer p.panics.guard(f.log, f.id, f.client)
+
+	buf := make([]byte, 65507)
+	p.resources.add(1, len(buf))
+	defer p.resources.add(-1, -len(buf))
+	for {
+		n, err := f.downstream.Read(buf)
+		if err != nil {
+			return
+		}
+		p.sendUpstream(f, buf[:n])
+	}
+}
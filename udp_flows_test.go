@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewUDPFlowTable(t *testing.T) {
+	flows, err := newUDPFlowTable(nil)
+	if err != nil || flows != nil {
+		t.Errorf("expected nil table and no error for nil config, got %v, %v", flows, err)
+	}
+	flows, err = newUDPFlowTable(&UDPFlowConfig{IdleTimeout: "5s"})
+	if err != nil || flows != nil {
+		t.Errorf("expected nil table and no error when disabled, got %v, %v", flows, err)
+	}
+
+	flows, err = newUDPFlowTable(&UDPFlowConfig{Enabled: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if flows.idleTimeout != defaultUDPFlowIdleTimeout {
+		t.Errorf("expected default idle timeout %s, got %s", defaultUDPFlowIdleTimeout, flows.idleTimeout)
+	}
+
+	for _, timeout := range []string{"soon", "0s", "-1s"} {
+		if _, err := newUDPFlowTable(&UDPFlowConfig{Enabled: true, IdleTimeout: timeout}); err == nil {
+			t.Errorf("expected error for idle timeout %q", timeout)
+		}
+	}
+}
+
+// startMultiReplyBackend starts a UDP backend that answers every datagram
+// with two replies and reports the source address of each datagram.
+func startMultiReplyBackend(t *testing.T) (*net.UDPConn, <-chan string) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("failed to start backend: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	sources := make(chan string, 16)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			sources <- addr.String()
+			conn.WriteToUDP(append([]byte("1:"), buf[:n]...), addr)
+			conn.WriteToUDP(append([]byte("2:"), buf[:n]...), addr)
+		}
+	}()
+	return conn, sources
+}
+
+func testUDPFlowExchange(t *testing.T, flows *UDPFlowConfig) {
+	backend, sources := startMultiReplyBackend(t)
+	pool := startTestPool(t, NewUDPServerPool, func(c *Config) { c.UDPFlows = flows }, "udp://"+backend.LocalAddr().String())
+
+	client, err := net.DialUDP("udp", nil, pool.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("failed to dial pool: %v", err)
+	}
+	defer client.Close()
+
+	replies := make(map[string]bool)
+	buf := make([]byte, 1024)
+	for _, msg := range []string{"a", "b"} {
+		if _, err := client.Write([]byte(msg)); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		for range 2 {
+			client.SetReadDeadline(time.Now().Add(2 * time.Second))
+			// The client socket is connected, so any reply it reads came
+			// from the listener address it targeted.
+			n, err := client.Read(buf)
+			if err != nil {
+				t.Fatalf("failed to read reply: %v", err)
+			}
+			replies[string(buf[:n])] = true
+		}
+	}
+	for _, want := range []string{"1:a", "2:a", "1:b", "2:b"} {
+		if !replies[want] {
+			t.Errorf("expected reply %q, got %v", want, replies)
+		}
+	}
+
+	first, second := <-sources, <-sources
+	if first != second {
+		t.Errorf("expected backend to see one source address, got %s and %s", first, second)
+	}
+	if pool.flows.Len() != 1 {
+		t.Errorf("expected 1 flow, got %d", pool.flows.Len())
+	}
+	if got := pool.backends[0].ActiveConnections(); got != 1 {
+		t.Errorf("expected 1 active connection, got %d", got)
+	}
+	// The second datagram reused the flow's socket, which has been answered.
+	if v := pool.backends[0].sockets.view(); v.Hits != 1 || v.Misses != 1 || v.Open != 1 || v.Idle != 1 || v.RequestsPerSocket != 2 {
+		t.Errorf("unexpected socket reuse %+v", v)
+	}
+}
+
+func TestUDPFlows(t *testing.T) {
+	testUDPFlowExchange(t, &UDPFlowConfig{Enabled: true})
+}
+
+func TestUDPFlows_connectedSockets(t *testing.T) {
+	if !reuseAddrSupported {
+		t.Skip("connected flow sockets are not supported on this platform")
+	}
+	testUDPFlowExchange(t, &UDPFlowConfig{Enabled: true, ConnectedSockets: true})
+}
+
+func TestUDPFlows_idleTimeout(t *testing.T) {
+	backend, _ := startMultiReplyBackend(t)
+	flows := &UDPFlowConfig{Enabled: true, IdleTimeout: "50ms"}
+	pool := startTestPool(t, NewUDPServerPool, func(c *Config) { c.UDPFlows = flows }, "udp://"+backend.LocalAddr().String())
+
+	client := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+	pool.handleConnection(t.Context(), pool.conn, client, []byte("hello"))
+	if pool.flows.Len() != 1 {
+		t.Fatalf("expected 1 flow, got %d", pool.flows.Len())
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for pool.flows.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pool.flows.Len() != 0 {
+		t.Errorf("expected idle flow to be closed, got %d flows", pool.flows.Len())
+	}
+	if got := pool.backends[0].ActiveConnections(); got != 0 {
+		t.Errorf("expected 0 active connections, got %d", got)
+	}
+	if v := pool.backends[0].sockets.view(); v.Open != 0 || v.Idle != 0 {
+		t.Errorf("expected no open sockets after the flow closed, got %+v", v)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Health check probe types.
+const (
+	HealthCheckDNS = "dns"
+)
+
+// udpProbe sends a payload to a UDP backend and validates its response.
+type udpProbe struct {
+	payload     []byte
+	expect      []byte
+	expectRegex *regexp.Regexp
+	dnsName     string
+}
+
+// defaultUDPProbe sends "ping" and expects "pong".
+var defaultUDPProbe = &udpProbe{payload: []byte("ping"), expect: []byte("pong")}
+
+// newUDPProbe builds a probe from the health check config. A nil config
+// yields the default ping/pong probe.
+func newUDPProbe(config *HealthCheckConfig) (*udpProbe, error) {
+	if config == nil {
+		return defaultUDPProbe, nil
+	}
+
+	switch config.Type {
+	case "":
+	case HealthCheckDNS:
+		name := config.DNSName
+		if name == "" {
+			name = "."
+		}
+		if _, err := encodeDNSName(name); err != nil {
+			return nil, err
+		}
+		return &udpProbe{dnsName: name}, nil
+	default:
+		return nil, fmt.Errorf("unsupported udp health check type: %s", config.Type)
+	}
+
+	probe := &udpProbe{payload: []byte(config.Payload), expect: []byte(config.Expect)}
+	if config.PayloadHex != "" {
+		payload, err := hex.DecodeString(config.PayloadHex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health check payload_hex: %w", err)
+		}
+		probe.payload = payload
+	}
+	if config.ExpectHex != "" {
+		expect, err := hex.DecodeString(config.ExpectHex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health check expect_hex: %w", err)
+		}
+		probe.expect = expect
+	}
+	if config.ExpectRegex != "" {
+		re, err := regexp.Compile(config.ExpectRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health check expect_regex: %w", err)
+		}
+		probe.expectRegex = re
+	}
+	if len(probe.payload) == 0 {
+		return nil, fmt.Errorf("udp health check requires a payload")
+	}
+	return probe, nil
+}
+
+func (p *udpProbe) probe(ctx context.Context, b *Backend) error {
+	addr, err := b.dialAddr(ctx)
+	if err != nil {
+		return err
+	}
+	d := net.Dialer{Control: bindDevice(b.device)}
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return fmt.Errorf("error connecting to backend: %w", err)
+	}
+	defer conn.Close()
+
+	defer bindDeadline(ctx, conn)()
+	return p.check(conn)
+}
+
+// check sends the probe over conn and validates the response. The caller is
+// responsible for setting deadlines on conn.
+func (p *udpProbe) check(conn net.Conn) error {
+	if p.dnsName != "" {
+		return p.checkDNS(conn)
+	}
+
+	if _, err := conn.Write(p.payload); err != nil {
+		return fmt.Errorf("error writing probe: %w", err)
+	}
+
+	buf := make([]byte, 65507)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return fmt.Errorf("error reading probe response: %w", err)
+	}
+	resp := buf[:n]
+
+	if p.expectRegex != nil {
+		if !p.expectRegex.Match(resp) {
+			return fmt.Errorf("unexpected response: %q", resp)
+		}
+		return nil
+	}
+	if len(p.expect) > 0 && !bytes.Equal(resp, p.expect) {
+		return fmt.Errorf("unexpected response: %q", resp)
+	}
+	return nil
+}
+
+// checkDNS sends an A query for the probe's name and accepts any well-formed
+// reply with a NOERROR or NXDOMAIN response code.
+func (p *udpProbe) checkDNS(conn net.Conn) error {
+	id := uint16(rand.Uint32())
+	query, err := dnsQuery(id, p.dnsName, dnsTypeA)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(query); err != nil {
+		return fmt.Errorf("error writing dns query: %w", err)
+	}
+
+	buf := make([]byte, 65507)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return fmt.Errorf("error reading dns response: %w", err)
+	}
+	if n < 12 {
+		return fmt.Errorf("short dns response: %d bytes", n)
+	}
+	if respID := binary.BigEndian.Uint16(buf[0:2]); respID != id {
+		return fmt.Errorf("dns response id mismatch: got %d, want %d", respID, id)
+	}
+	flags := binary.BigEndian.Uint16(buf[2:4])
+	if flags&0x8000 == 0 {
+		return fmt.Errorf("dns response is not a reply")
+	}
+	switch rcode := flags & 0x000f; rcode {
+	case 0, 3: // NOERROR, NXDOMAIN
+		return nil
+	default:
+		return fmt.Errorf("dns response code %d", rcode)
+	}
+}
+
+// dnsQuery builds a recursive DNS query for the qtype records of name.
+func dnsQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	qname, err := encodeDNSName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, 12, 12+len(qname)+4)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	binary.BigEndian.PutUint16(msg[2:4], 0x0100) // RD
+	binary.BigEndian.PutUint16(msg[4:6], 1)      // QDCOUNT
+	msg = append(msg, qname...)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, 1) // QCLASS IN
+	return msg, nil
+}
+
+// encodeDNSName encodes a domain name in DNS wire format.
+func encodeDNSName(name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	var out []byte
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid dns name: %q", name)
+			}
+			out = append(out, byte(len(label)))
+			out = append(out, label...)
+		}
+	}
+	if len(out) > 254 {
+		return nil, fmt.Errorf("dns name too long: %q", name)
+	}
+	return append(out, 0), nil
+}
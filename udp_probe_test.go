@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startUDPResponder starts a UDP server that replies to each datagram with
+// the result of respond.
+func startUDPResponder(t *testing.T, respond func([]byte) []byte) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(respond(buf[:n]), addr)
+		}
+	}()
+	return conn
+}
+
+func runProbe(t *testing.T, probe *udpProbe, server *net.UDPConn) error {
+	t.Helper()
+	conn, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	return probe.check(conn)
+}
+
+func Test_newUDPProbe(t *testing.T) {
+	probe, err := newUDPProbe(nil)
+	if err != nil || probe != defaultUDPProbe {
+		t.Errorf("expected default probe, got %v (%v)", probe, err)
+	}
+
+	probe, err = newUDPProbe(&HealthCheckConfig{PayloadHex: "00ff", ExpectHex: "ff00"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(probe.payload, []byte{0x00, 0xff}) || !bytes.Equal(probe.expect, []byte{0xff, 0x00}) {
+		t.Errorf("expected hex payloads to be decoded, got %x/%x", probe.payload, probe.expect)
+	}
+
+	for _, config := range []*HealthCheckConfig{
+		{PayloadHex: "zz"},
+		{Payload: "ping", ExpectRegex: "("},
+		{Expect: "pong"},
+		{Type: "smtp"},
+		{Type: HealthCheckDNS, DNSName: "bad..name"},
+	} {
+		if _, err := newUDPProbe(config); err == nil {
+			t.Errorf("expected error for config %+v", config)
+		}
+	}
+}
+
+func TestUDPProbe_check(t *testing.T) {
+	server := startUDPResponder(t, func(b []byte) []byte {
+		return append([]byte("OK "), b...)
+	})
+
+	probe, _ := newUDPProbe(&HealthCheckConfig{Payload: "status", ExpectRegex: "^OK "})
+	if err := runProbe(t, probe, server); err != nil {
+		t.Errorf("expected regex probe to pass, got %v", err)
+	}
+
+	probe, _ = newUDPProbe(&HealthCheckConfig{Payload: "status", Expect: "OK status"})
+	if err := runProbe(t, probe, server); err != nil {
+		t.Errorf("expected exact probe to pass, got %v", err)
+	}
+
+	probe, _ = newUDPProbe(&HealthCheckConfig{Payload: "status", Expect: "pong"})
+	if err := runProbe(t, probe, server); err == nil {
+		t.Errorf("expected exact probe to fail")
+	}
+}
+
+func TestUDPProbe_checkDNS(t *testing.T) {
+	var rcode atomic.Uint32
+	server := startUDPResponder(t, func(query []byte) []byte {
+		resp := bytes.Clone(query)
+		binary.BigEndian.PutUint16(resp[2:4], 0x8180|uint16(rcode.Load()))
+		return resp
+	})
+
+	probe, err := newUDPProbe(&HealthCheckConfig{Type: HealthCheckDNS, DNSName: "example.com"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := runProbe(t, probe, server); err != nil {
+		t.Errorf("expected dns probe to pass, got %v", err)
+	}
+
+	rcode.Store(2) // SERVFAIL
+	if err := runProbe(t, probe, server); err == nil {
+		t.Errorf("expected dns probe to fail on SERVFAIL")
+	}
+}
+
+func Test_dnsQuery(t *testing.T) {
+	query, err := dnsQuery(0x1234, "example.com.", dnsTypeA)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := []byte{
+		0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+		0x00, 0x01, 0x00, 0x01,
+	}
+	if !bytes.Equal(query, expected) {
+		t.Errorf("expected %x, got %x", expected, query)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// maxUDPReceiveSockets bounds the sockets bound to each address of a UDP
+// listener.
+const maxUDPReceiveSockets = 256
+
+// udpReceivers shards the receive path of a UDP listener across several
+// sockets bound to each of its addresses with SO_REUSEPORT. Each socket has
+// a read loop of its own, and the kernel hashes the source and destination
+// of datagrams to pick the socket, so a client stays on one read loop while
+// clients as a whole are spread across cores.
+type udpReceivers struct {
+	sockets  int
+	received []paddedCounter
+}
+
+// paddedCounter is a counter on a cache line of its own, so that read loops
+// on different cores do not contend for the line holding their neighbour's
+// counter.
+type paddedCounter struct {
+	atomic.Uint64
+	_ [56]byte
+}
+
+// newUDPReceivers returns the receive sharding of sockets sockets per
+// address, or nil for a single socket.
+func newUDPReceivers(sockets int) (*udpReceivers, error) {
+	switch {
+	case sockets < 0:
+		return nil, fmt.Errorf("udp_receive_sockets must not be negative")
+	case sockets <= 1:
+		return nil, nil
+	case sockets > maxUDPReceiveSockets:
+		return nil, fmt.Errorf("udp_receive_sockets must be at most %d", maxUDPReceiveSockets)
+	case !reusePortSupported:
+		return nil, fmt.Errorf("udp_receive_sockets is not supported on this platform")
+	}
+	return &udpReceivers{sockets: sockets, received: make([]paddedCounter, sockets)}, nil
+}
+
+// udpSocketGroup holds the sockets bound to one address of a UDP listener.
+type udpSocketGroup []*net.UDPConn
+
+// Close closes all sockets of the group.
+func (g udpSocketGroup) Close() error {
+	var errs []error
+	for _, conn := range g {
+		errs = append(errs, conn.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// listen binds the sockets of the group for addr with lc. Sockets after the
+// first bind the address the first was given, so that they share its port
+// when addr has none.
+func (r *udpReceivers) listen(lc net.ListenConfig, addr string) (udpSocketGroup, error) {
+	sockets := 1
+	if r != nil {
+		sockets = r.sockets
+		lc.Control = chainControl(lc.Control, reusePortControl)
+	}
+	var group udpSocketGroup
+	for range sockets {
+		conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			group.Close()
+			return nil, err
+		}
+		group = append(group, conn.(*net.UDPConn))
+		addr = conn.LocalAddr().String()
+	}
+	return group, nil
+}
+
+// receive counts a datagram read by the socket of index shard.
+func (r *udpReceivers) receive(shard int) {
+	if r != nil {
+		r.received[shard].Add(1)
+	}
+}
+
+// Received returns the datagrams read by the socket of index shard of
+// every address.
+func (r *udpReceivers) Received(shard int) uint64 {
+	if r == nil {
+		return 0
+	}
+	return r.received[shard].Load()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_newUDPReceivers(t *testing.T) {
+	for _, sockets := range []int{0, 1} {
+		if r, err := newUDPReceivers(sockets); r != nil || err != nil {
+			t.Errorf("expected no sharding for %d sockets, got %v, %v", sockets, r, err)
+		}
+	}
+	for _, sockets := range []int{-1, maxUDPReceiveSockets + 1} {
+		if _, err := newUDPReceivers(sockets); err == nil {
+			t.Errorf("expected an error for %d sockets", sockets)
+		}
+	}
+	if _, err := newUDPReceivers(4); (err == nil) != reusePortSupported {
+		t.Errorf("expected an error only where SO_REUSEPORT is unsupported, got %v", err)
+	}
+}
+
+func TestUDPServerPool_receiveSockets(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("SO_REUSEPORT is not supported on this platform")
+	}
+	backend, received := startUDPSink(t)
+	pool, err := NewUDPServerPool(log.New(io.Discard, "", 0), &Config{
+		Addr:              "127.0.0.1:0",
+		Backends:          []BackendConfig{{URL: "udp://" + backend.LocalAddr().String()}},
+		UDPSink:           &UDPSinkConfig{Enabled: true},
+		UDPReceiveSockets: 4,
+	})
+	if err != nil {
+		t.Fatalf("failed to create server pool: %v", err)
+	}
+	pool.backends[0].SetHealthy(true)
+	if err := pool.Start(); err != nil {
+		t.Fatalf("failed to start server pool: %v", err)
+	}
+	defer pool.Shutdown(t.Context())
+
+	if len(pool.sockets) != 1 || len(pool.sockets[0]) != 4 {
+		t.Fatalf("expected 4 sockets on one address, got %v", pool.sockets)
+	}
+	for _, conn := range pool.sockets[0] {
+		if conn.LocalAddr().String() != pool.conn.LocalAddr().String() {
+			t.Errorf("expected every socket on %s, got %s", pool.conn.LocalAddr(), conn.LocalAddr())
+		}
+	}
+
+	// The kernel spreads clients across the sockets by their source port.
+	const clients = 32
+	for range clients {
+		client, err := net.DialUDP("udp", nil, pool.conn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatalf("failed to dial pool: %v", err)
+		}
+		client.Write([]byte("metric:1|c"))
+		client.Close()
+	}
+	for i := range clients {
+		select {
+		case <-received:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for datagram %d", i)
+		}
+	}
+	var total uint64
+	used := 0
+	for shard := range 4 {
+		n := pool.receivers.Received(shard)
+		total += n
+		if n > 0 {
+			used++
+		}
+	}
+	if total != clients || used < 2 {
+		t.Errorf("expected %d datagrams spread across sockets, got %d on %d sockets", clients, total, used)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const defaultUDPResponseTimeout = 5 * time.Second
+
+// udpResponse is how a UDP pool waits for the backend's reply to a datagram
+// it forwards outside a flow.
+type udpResponse struct {
+	// timeout bounds the wait for the reply.
+	timeout time.Duration
+	// fireAndForget sends datagrams without waiting for a reply.
+	fireAndForget bool
+}
+
+func newUDPResponse(config *UDPResponseConfig) (udpResponse, error) {
+	r := udpResponse{timeout: defaultUDPResponseTimeout}
+	if config == nil {
+		return r, nil
+	}
+	r.fireAndForget = config.FireAndForget
+	if config.Timeout != "" {
+		d, err := time.ParseDuration(config.Timeout)
+		if err != nil {
+			return r, fmt.Errorf("invalid udp_response timeout: %w", err)
+		}
+		if d <= 0 {
+			return r, fmt.Errorf("udp_response timeout must be positive")
+		}
+		r.timeout = d
+	}
+	return r, nil
+}
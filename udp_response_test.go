@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_newUDPResponse(t *testing.T) {
+	r, err := newUDPResponse(nil)
+	if err != nil || r.timeout != defaultUDPResponseTimeout || r.fireAndForget {
+		t.Errorf("expected the default timeout, got %+v, %v", r, err)
+	}
+	r, err = newUDPResponse(&UDPResponseConfig{Timeout: "250ms", FireAndForget: true})
+	if err != nil || r.timeout != 250*time.Millisecond || !r.fireAndForget {
+		t.Errorf("unexpected response settings %+v, %v", r, err)
+	}
+	for _, timeout := range []string{"soon", "0s", "-1s"} {
+		if _, err := newUDPResponse(&UDPResponseConfig{Timeout: timeout}); err == nil {
+			t.Errorf("expected an error for timeout %q", timeout)
+		}
+	}
+}
+
+// startUDPSink starts a UDP backend that never replies and returns the
+// datagrams it receives.
+func startUDPSink(t *testing.T) (*net.UDPConn, <-chan string) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	received := make(chan string, 16)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			received <- string(buf[:n])
+		}
+	}()
+	return conn, received
+}
+
+func TestUDPServerPool_responseTimeout(t *testing.T) {
+	backend, received := startUDPSink(t)
+	pool := startTestPool(t, NewUDPServerPool, func(c *Config) { c.UDPResponse = &UDPResponseConfig{Timeout: "50ms"} }, "udp://"+backend.LocalAddr().String())
+
+	client := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9}
+	start := time.Now()
+	pool.handleConnection(t.Context(), pool.conn, client, []byte("ping"))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the exchange to be abandoned after 50ms, took %s", elapsed)
+	}
+	if got := <-received; got != "ping" {
+		t.Errorf("expected the backend to receive ping, got %q", got)
+	}
+	if got := pool.stats.rejected.Load(); got != 1 {
+		t.Errorf("expected the unanswered datagram to be rejected, got %d rejections", got)
+	}
+}
+
+func TestUDPServerPool_fireAndForget(t *testing.T) {
+	backend, received := startUDPSink(t)
+	pool := startTestPool(t, NewUDPServerPool, func(c *Config) { c.UDPResponse = &UDPResponseConfig{FireAndForget: true} }, "udp://"+backend.LocalAddr().String())
+
+	client, err := net.DialUDP("udp", nil, pool.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("failed to dial pool: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("<13>hello")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	select {
+	case got := <-received:
+		if got != "<13>hello" {
+			t.Errorf("expected the backend to receive the message, got %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for the backend to receive the message")
+	}
+	waitFor(t, "the datagram to be handled", func() bool { return pool.stats.accepted.Load() == 1 && pool.stats.active.Load() == 0 })
+	if got := pool.stats.rejected.Load(); got != 0 {
+		t.Errorf("expected no rejections, got %d", got)
+	}
+}
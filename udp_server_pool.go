@@ -1,21 +1,34 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"sync"
 	"time"
 )
 
 type UDPServerPool struct {
 	BaseServerPool
-	conn                *net.UDPConn
-	wg                  sync.WaitGroup
-	shutdown            chan struct{}
-	healthcheckInterval time.Duration
-	addr                string
+	// conn is the first socket of the first address and sockets those of
+	// all addresses of the listener.
+	conn    *net.UDPConn
+	sockets []udpSocketGroup
+	wg      sync.WaitGroup
+	flows   *udpFlowTable
+	// fanOut is nil unless datagrams are sent to every backend.
+	fanOut *udpFanOut
+	// response is how replies to datagrams outside flows are awaited.
+	response udpResponse
+	// sink is nil unless datagrams are forwarded one way.
+	sink *udpSink
+	// batch is the number of datagrams read per system call.
+	batch int
 }
 
 func NewUDPServerPool(l *log.Logger, config *Config) (*UDPServerPool, error) {
@@ -28,198 +41,632 @@ func NewUDPServerPool(l *log.Logger, config *Config) (*UDPServerPool, error) {
 		return nil, fmt.Errorf("invalid healthcheck interval: %w", err)
 	}
 
-	pool := &UDPServerPool{
-		shutdown:            make(chan struct{}),
-		addr:                config.Addr,
-		healthcheckInterval: healthcheckInterval,
-		BaseServerPool: BaseServerPool{
-			stickySessions: config.StickySessions,
-			log:            l,
-		},
+	algorithm, err := validateAlgorithm(config.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	stickyKey, err := validateStickyKey(config.StickyKey)
+	if err != nil {
+		return nil, err
+	}
+	stickyHashing, err := validateStickyHashing(config.StickyHashing)
+	if err != nil {
+		return nil, err
+	}
+	stickyFailover, err := newStickyFailover(config.StickyFailover)
+	if err != nil {
+		return nil, err
 	}
 
-	// Add backends from config
-	for _, backend := range config.Backends {
-		pool.AddBackend(backend)
+	faults, err := newFaultInjector(config.FaultInjection)
+	if err != nil {
+		return nil, err
+	}
+	if faults != nil {
+		warnf(l, "WARNING: fault injection is enabled")
 	}
-	return pool, nil
-}
 
-func (p *UDPServerPool) StartHealthChecks() {
-	for _, b := range p.backends {
-		go func(backend *Backend) {
-			first := true
-			for {
-				if !first {
-					select {
-					case <-time.After(p.healthcheckInterval):
-					case <-p.shutdown:
-						return
-					}
-				}
-				first = false
+	breakerSettings, err := newCircuitBreakerSettings(config.CircuitBreaker)
+	if err != nil {
+		return nil, err
+	}
+	admissionSettings, err := newAdmissionSettings(config.BackendConnectionRate)
+	if err != nil {
+		return nil, err
+	}
 
-				addr, err := net.ResolveUDPAddr("udp", backend.URL.Host)
-				if err != nil {
-					p.log.Printf("error resolving backend address %s: %v", backend.URL.Host, err)
-					backend.SetHealthy(false)
-					backend.Error = err
-					continue
-				}
-				conn, err := net.DialUDP("udp", nil, addr)
-				if err != nil {
-					p.log.Printf("error connecting to backend %s: %v", backend.URL.Host, err)
-					backend.SetHealthy(false)
-					backend.Error = err
-					continue
-				}
+	sloSettings, err := newSLOSettings(config.SLO)
+	if err != nil {
+		return nil, err
+	}
 
-				// Send health check ping
-				conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
-				if _, err := conn.Write([]byte("ping")); err != nil {
-					backend.SetHealthy(false)
-					p.log.Printf("error writing to backend %s: %v", backend.URL.Host, err)
-					backend.Error = err
-					continue
-				}
+	resolver, err := newDNSCache(config.DNSCache)
+	if err != nil {
+		return nil, err
+	}
 
-				buf := make([]byte, 1024)
-				conn.SetReadDeadline(time.Now().Add(2 * time.Second))
-				n, backendAddr, err := conn.ReadFrom(buf)
-				if err != nil {
-					backend.SetHealthy(false)
-					p.log.Printf("error reading from backend %s: %v", backend.URL.Host, err)
-					backend.Error = err
-				} else {
-					if string(buf[:n]) == "pong" {
-						backend.SetHealthy(true)
-						backend.Error = nil
-					} else {
-						backend.SetHealthy(false)
-						p.log.Printf("unexpected response from backend %s: %s", backendAddr.String(), string(buf[:n]))
-						backend.Error = fmt.Errorf("unexpected response from backend %s: %s", backendAddr.String(), string(buf[:n]))
-					}
-				}
-				conn.Close()
-			}
-		}(b)
+	dialTimeout, err := parseDialTimeout(config.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	connTimeout, err := parseConnectionTimeout(config.ConnectionTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	longConns, err := newLongConnPolicy(config.LongConnections)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateCaptureDir(config.CaptureDir); err != nil {
+		return nil, err
+	}
+
+	pinning, err := newBackendPinning(config.PinBackend)
+	if err != nil {
+		return nil, err
+	}
+
+	xds, err := newXDSClient(config.XDS)
+	if err != nil {
+		return nil, err
+	}
+
+	flaps, err := newFlapDetector(config.FlapDetection)
+	if err != nil {
+		return nil, err
+	}
+
+	quarantine, err := newQuarantine(config.Quarantine)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Sniff != nil && config.Sniff.Enabled {
+		return nil, fmt.Errorf("protocol sniffing is only supported by tcp listeners")
+	}
+	if config.Socks5 != nil && config.Socks5.Enabled {
+		return nil, fmt.Errorf("socks5 ingress is only supported by tcp listeners")
+	}
+	if config.AcceptQueue != nil && config.AcceptQueue.Enabled {
+		return nil, fmt.Errorf("accept_queue is only supported by tcp listeners")
+	}
+	if config.FirstByteRouting != nil && config.FirstByteRouting.Enabled {
+		return nil, fmt.Errorf("first_byte_routing is only supported by tcp listeners")
+	}
+	if config.DeferDial != nil && config.DeferDial.Enabled {
+		return nil, fmt.Errorf("defer_dial is only supported by tcp listeners")
+	}
+	if config.ProtocolValidation != nil {
+		return nil, fmt.Errorf("protocol_validation is only supported by tcp listeners")
+	}
+
+	addrs, err := listenAddresses(config)
+	if err != nil {
+		return nil, err
+	}
+	hooks, err := newAddressHooks(config.AddressHooks, config.Name, "udp", l)
+	if err != nil {
+		return nil, err
+	}
+
+	backends, err := expandPortRanges(config.Backends)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.BackendTLS != nil {
+		return nil, fmt.Errorf("backend_tls is only supported by tcp listeners")
+	}
+
+	blueGreen, groupBackends, err := newBlueGreen(config.BlueGreen)
+	if err != nil {
+		return nil, err
+	}
+	backends = append(backends, groupBackends...)
+
+	backendGroup, sharedBackends, err := poolBackendGroup(l, config, "udp")
+	if err != nil {
+		return nil, err
+	}
+	backends = append(backends, sharedBackends...)
+
+	sharedHealth, err := config.health.join(config.SharedHealth)
+	if err != nil {
+		return nil, err
+	}
+
+	// Discovered backends are not known until the pool starts.
+	if config.MinHealthyBackends > len(backends) && xds == nil && !backendGroup.dynamic() {
+		return nil, fmt.Errorf("min_healthy_backends (%d) exceeds the number of backends (%d)",
+			config.MinHealthyBackends, len(backends))
+	}
+
+	flows, err := newUDPFlowTable(config.UDPFlows)
+	if err != nil {
+		return nil, err
+	}
+
+	fanOut, err := newUDPFanOut(config.UDPFanOut)
+	if err != nil {
+		return nil, err
+	}
+	if fanOut != nil && flows != nil {
+		return nil, fmt.Errorf("udp_fan_out cannot be combined with udp_flows")
+	}
+
+	affinity, err := newAffinity(config.Affinity)
+	if err != nil {
+		return nil, err
+	}
+
+	fdLimit, err := newFDLimit(config.FDLimit)
+	if err != nil {
+		return nil, err
+	}
+	priority, err := newPriorityClasses(config.PriorityClasses, config.MaxConnections)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDevices(config); err != nil {
+		return nil, err
+	}
+	geoIP, err := newGeoIP(config.GeoIP)
+	if err != nil {
+		return nil, err
+	}
+	sourceFilter, err := newSourceFilter(config.SourceFilter, geoIP)
+	if err != nil {
+		return nil, err
+	}
+	panics, err := newPanicRecovery(config.PanicRecovery, config.Name)
+	if err != nil {
+		return nil, err
+	}
+	logSampler, err := newLogSampler(config.LogSampling)
+	if err != nil {
+		return nil, err
+	}
+
+	sink := newUDPSink(config.UDPSink)
+	if sink != nil && (flows != nil || fanOut != nil) {
+		return nil, fmt.Errorf("udp_sink cannot be combined with udp_flows or udp_fan_out")
+	}
+
+	flood, err := newUDPFloodGuard(config.UDPFlood)
+	if err != nil {
+		return nil, err
 	}
+	receivers, err := newUDPReceivers(config.UDPReceiveSockets)
+	if err != nil {
+		return nil, err
+	}
+	batchSize, err := validateUDPBatchSize(config.UDPBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkUDPReadBuffers(batchSize, config.UDPReceiveSockets); err != nil {
+		return nil, err
+	}
+
+	response, err := newUDPResponse(config.UDPResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	dashboardTmpl, err := loadDashboardTemplate(config.TemplateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := &UDPServerPool{
+		flows:    flows,
+		fanOut:   fanOut,
+		response: response,
+		sink:     sink,
+		batch:    batchSize,
+		BaseServerPool: BaseServerPool{
+			shutdown:            make(chan struct{}),
+			healthcheckInterval: healthcheckInterval,
+			stickySessions:      config.StickySessions,
+			exemplars:           config.Exemplars,
+			stickyKey:           stickyKey,
+			stickyHashing:       stickyHashing,
+			stickyFailover:      stickyFailover,
+			algorithm:           algorithm,
+			maxConnections:      config.MaxConnections,
+			dialTimeout:         dialTimeout,
+			connTimeout:         connTimeout,
+			longConns:           longConns,
+			localZone:           config.LocalZone,
+			zoneLabel:           cmp.Or(config.ZoneLabel, "zone"),
+			faults:              faults,
+			breakerSettings:     breakerSettings,
+			admissionSettings:   admissionSettings,
+			sloSettings:         sloSettings,
+			resolver:            resolver,
+			flaps:               flaps,
+			quarantine:          quarantine,
+			minHealthy:          config.MinHealthyBackends,
+			waitForReady:        config.WaitForReady,
+			failStatic:          config.FailStatic,
+			ready:               make(chan struct{}),
+			log:                 l,
+			name:                config.Name,
+			protocol:            "udp",
+			addr:                config.Addr,
+			addrs:               addrs,
+			hooks:               hooks,
+			startTime:           time.Now(),
+			tmpl:                dashboardTmpl,
+			capture:             capturer{dir: config.CaptureDir},
+			pinning:             pinning,
+			xds:                 xds,
+			blueGreen:           blueGreen,
+			backendGroup:        backendGroup,
+			sharedHealth:        sharedHealth,
+			flood:               flood,
+			receivers:           receivers,
+			affinity:            affinity,
+			fdLimit:             fdLimit,
+			priority:            priority,
+			geoIP:               geoIP,
+			sourceFilter:        sourceFilter,
+			uptime:              config.uptime,
+			device:              config.Device,
+			backendDevice:       config.BackendDevice,
+			panics:              panics,
+			logSampler:          logSampler,
+		},
+	}
+
+	if err := pool.initHealthChecks("udp", config); err != nil {
+		return nil, err
+	}
+
+	// Add backends from config
+	for _, backend := range backends {
+		if _, err := pool.addBackend(backend); err != nil {
+			return nil, fmt.Errorf("invalid backend: %w", err)
+		}
+	}
+	return pool, nil
 }
 
 func (p *UDPServerPool) Start() error {
-	var err error
-	p.conn, err = net.ListenUDP("udp", &net.UDPAddr{
-		Port: 9090,
+	var reuseAddr socketControl
+	if p.flows != nil && p.flows.connectedSockets {
+		// Per-flow sockets share the listener address.
+		reuseAddr = reuseAddrControl
+	}
+	lc := net.ListenConfig{Control: chainControl(bindDevice(p.device), reuseAddr)}
+	groups, err := bindAddresses(p.hooks, p.listenAddrs(), func(addr string) (udpSocketGroup, error) {
+		return p.receivers.listen(lc, addr)
 	})
 	if err != nil {
 		return fmt.Errorf("error starting udp server: %w", err)
 	}
-	p.log.Printf("udp server started on %s", p.conn.LocalAddr().String())
+	p.conn, p.sockets = groups[0][0], groups
+	p.listening.Store(true)
 
-	p.wg.Add(1)
-	go p.acceptUDPConnections()
+	p.startDiscovery(&p.wg)
+	for _, group := range groups {
+		if len(group) > 1 {
+			infof(p.log, "udp server started on %s with %d receive sockets", group[0].LocalAddr().String(), len(group))
+		} else {
+			infof(p.log, "udp server started on %s", group[0].LocalAddr().String())
+		}
+		for shard, conn := range group {
+			p.wg.Add(1)
+			go p.acceptUDPConnections(conn, shard)
+		}
+	}
 	return nil
 }
 
+// StopAccepting closes the listening sockets and all flows.
+func (p *UDPServerPool) StopAccepting() error {
+	if !p.beginShutdown() {
+		return nil
+	}
+	err := releaseAddresses(p.hooks, p.listenAddrs(), p.sockets)
+	p.listening.Store(false)
+	p.closeFlows()
+	if err != nil {
+		return fmt.Errorf("error closing UDP connection: %w", err)
+	}
+	return nil
+}
+
+// Drain waits for the read loop and flow relays to finish.
+func (p *UDPServerPool) Drain(ctx context.Context) error {
+	defer p.capture.stop()
+	return p.drainOrCancel(ctx, &p.wg)
+}
+
+// Shutdown gracefully shuts down the server pool.
 func (p *UDPServerPool) Shutdown(ctx context.Context) error {
 	start := time.Now()
-
-	select {
-	case <-p.shutdown:
+	if p.shuttingDown.Load() {
 		// Already closed
 		return nil
-	default:
-		close(p.shutdown)
 	}
 
-	var err error
-	if p.conn != nil {
-		err = p.conn.Close()
+	if err := p.StopAccepting(); err != nil {
+		return err
 	}
-	if err != nil {
-		return fmt.Errorf("error closing UDP connection: %w", err)
+	if err := p.Drain(ctx); err != nil {
+		return err
 	}
-
-	done := make(chan struct{})
-	go func() {
-		p.wg.Wait()
-		close(done)
-	}()
-
-	select {
-	case <-done:
-		// Shutdown completed
-	case <-ctx.Done():
-		return fmt.Errorf("shutdown timed out: %ws", ctx.Err())
+	if err := p.stopHealthChecks(ctx); err != nil {
+		return err
 	}
 
 	elapsed := time.Since(start)
-	p.log.Printf("server pool shutdown completed in %s", elapsed)
+	infof(p.log, "server pool shutdown completed in %s", elapsed)
 	return nil
 }
 
-func (p *UDPServerPool) acceptUDPConnections() {
+// acceptUDPConnections reads datagrams from one of the listener's sockets,
+// of index shard among those bound to its address.
+func (p *UDPServerPool) acceptUDPConnections(conn *net.UDPConn, shard int) {
 	defer p.wg.Done()
+	p.resources.add(1, p.batch*maxUDPPayload)
+	defer p.resources.add(-1, -p.batch*maxUDPPayload)
 
-	buf := make([]byte, 65507) // Max UDP payload size
+	if !p.waitReady(p.shutdown) {
+		return
+	}
+
+	ctx := p.conns.context()
+	batch := newUDPBatch(conn, p.batch)
+	var queue *sinkQueue
+	if p.sink != nil {
+		queue = newSinkQueue()
+	}
 	for {
 		select {
 		case <-p.shutdown:
 			return
 		default:
-			n, addr, err := p.conn.ReadFromUDP(buf)
+			n, err := batch.read()
 			if err != nil {
 				select {
 				case <-p.shutdown:
 					return // Shutdown signal received
 				default:
-					p.log.Printf("error accepting connection: %v\n", err)
+					warnf(p.log, "error accepting connection: %v\n", err)
 					continue
 				}
 			}
-			go p.handleConnection(addr, buf[:n])
+			for i := range n {
+				addr, data := batch.datagram(i)
+				p.receivers.receive(shard)
+				if p.sourceFilter.reject(addr) != "" || !p.flood.allow(addr, time.Now()) {
+					continue
+				}
+				if queue != nil {
+					p.sinkDatagram(queue, addr, data)
+					continue
+				}
+				// The batch's buffers are reused by the next read while
+				// the datagram is handled.
+				data = bytes.Clone(data)
+				p.wg.Add(1)
+				go func() {
+					defer p.wg.Done()
+					p.resources.add(1, len(data))
+					defer p.resources.add(-1, -len(data))
+					defer p.panics.guard(p.log, "", addr)
+					p.handleConnection(ctx, conn, addr, data)
+				}()
+			}
+			if queue != nil {
+				p.flushSink(queue)
+			}
 		}
 	}
 }
 
-func (p *UDPServerPool) handleConnection(clientAddr *net.UDPAddr, data []byte) {
-	backend := p.Next(clientAddr)
+// handleConnection routes a datagram from clientAddr received on conn,
+// through which it is answered. Cancelling ctx abandons the exchange with
+// the backend.
+func (p *UDPServerPool) handleConnection(ctx context.Context, conn *net.UDPConn, clientAddr *net.UDPAddr, data []byte) {
+	if p.flows != nil {
+		if flow := p.flows.get(clientAddr); flow != nil {
+			p.sendUpstream(flow, data)
+			return
+		}
+	}
+	// Datagrams on an open flow reuse its socket, but new exchanges need
+	// sockets of their own.
+	if !p.fdLimit.admit(time.Now(), p.log) {
+		return
+	}
+	if !p.admitClient(clientAddr, p.log) {
+		p.stats.reject()
+		return
+	}
+	if p.fanOut != nil {
+		p.fanOutDatagram(ctx, conn, clientAddr, data)
+		return
+	}
+
+	id := newConnID()
+	l := connLogger(p.log, id)
+	l, region := p.geoIP.locate(clientAddr, l)
+	var backend *Backend
+	if p.pinning.allows(clientAddr) {
+		if name, rest, ok := parsePreamble(data); ok {
+			pinned, err := p.pinnedBackend(name)
+			if err != nil {
+				infof(l, "rejected datagram from %s: %v", clientAddr, err)
+				p.stats.reject()
+				return
+			}
+			infof(l, "datagram from %s pinned to backend %s", clientAddr, pinned.URL)
+			backend, data = pinned, rest
+		}
+	}
+	if backend == nil && region != "" {
+		backend = p.nextInRegion(clientAddr, region)
+	}
+	if backend == nil {
+		backend = p.keyedBackend(data)
+	}
 	if backend == nil {
-		p.log.Printf("No healthy backend available")
+		backend = p.Next(clientAddr)
+		p.shadow.compare(clientAddr, "", "", backend)
+	}
+	if backend == nil {
+		infof(l, "No healthy backend available")
+		p.stats.reject()
+		return
+	}
+	if p.flows != nil && !isDebugBackend(backend) {
+		if err := p.faults.WaitConnectDelay(ctx); err != nil {
+			return
+		}
+		if !p.allow(backend) {
+			return
+		}
+		flow, err := p.openFlow(ctx, conn, id, clientAddr, backend)
+		if err != nil {
+			warnf(l, "Error forwarding to backend: %v", err)
+			p.backendFailed(backend)
+			p.stats.reject()
+			return
+		}
+		backend.succeeded()
+		p.sendUpstream(flow, data)
 		return
 	}
-	resp, err := p.forwardToBackend(backend, data)
+
+	defer p.stats.accept()()
+	defer backend.acquire()()
+	// A datagram dropped during the delay must not hold a half-open trial.
+	if err := p.faults.WaitConnectDelay(ctx); err != nil {
+		return
+	}
+	if p.faults.ShouldDrop(backend) || !p.allow(backend) {
+		return
+	}
+	capture := p.capture.session(backend, clientAddr, "udp", id)
+	defer capture.close()
+	capture.record(captureToBackend, data)
+
+	var resp []byte
+	var err error
+	switch {
+	case isDebugBackend(backend):
+		resp = debugResponse(backend, clientAddr, data, l)
+	case p.response.fireAndForget:
+		err = p.sendToBackend(ctx, backend, data)
+	default:
+		resp, err = p.forwardToBackend(ctx, backend, data)
+	}
 	if err != nil {
-		p.log.Printf("Error forwarding to backend: %v", err)
+		warnf(l, "Error forwarding to backend: %v", err)
+		p.backendFailed(backend)
+		p.stats.reject()
+		return
+	}
+	backend.succeeded()
+	connDebugf(l, p.logSampler.sample(clientAddr), "datagram from %s forwarded to backend %s, %d byte reply", clientAddr, backend.URL.Host, len(resp))
+	if resp == nil {
 		return
 	}
-	if _, err := p.conn.WriteToUDP(resp, clientAddr); err != nil {
-		p.log.Printf("Error writing response to client: %v", err)
+	capture.record(captureToClient, resp)
+	if _, err := conn.WriteToUDP(resp, clientAddr); err != nil {
+		warnf(l, "Error writing response to client: %v", err)
 	}
 }
 
-func (p *UDPServerPool) forwardToBackend(backend *Backend, data []byte) ([]byte, error) {
-	remoteAddr, err := net.ResolveUDPAddr("udp", backend.URL.Host)
+// keyedBackend returns the backend the affinity key of a datagram hashes
+// to, or nil if affinity is disabled or the datagram holds no key.
+func (p *UDPServerPool) keyedBackend(data []byte) *Backend {
+	if p.affinity == nil {
+		return nil
+	}
+	if key := p.affinity.datagramKey(data); key != "" {
+		return p.nextForKey(key)
+	}
+	return nil
+}
+
+// allow checks the backend's circuit breaker, rejecting the datagram if the
+// circuit is open.
+func (p *UDPServerPool) allow(backend *Backend) bool {
+	if backend.breaker.Allow() {
+		return true
+	}
+	infof(p.log, "circuit open for backend %s", backend.URL.Host)
+	p.stats.reject()
+	return false
+}
+
+// backendFailed records a failed exchange with the backend in its circuit
+// breaker.
+func (p *UDPServerPool) backendFailed(backend *Backend) {
+	if backend.failed() {
+		warnf(p.log, "circuit opened for backend %s after repeated failures", backend.URL.Host)
+	}
+}
+
+// dialUDPBackend opens a socket connected to the backend, bounding address
+// resolution by the backend's dial timeout. The address is resolved through
+// the pool's DNS cache rather than for every datagram.
+func (p *UDPServerPool) dialUDPBackend(ctx context.Context, backend *Backend) (*net.UDPConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.dialTimeoutFor(backend))
+	defer cancel()
+	addr, err := backend.dialAddr(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("error resolving backend address %s: %w", backend.URL.Host, err)
+		return nil, err
 	}
-	conn, err := net.DialUDP("udp", nil, remoteAddr)
+	d := net.Dialer{Control: bindDevice(backend.device)}
+	conn, err := d.DialContext(ctx, "udp", addr)
 	if err != nil {
 		return nil, fmt.Errorf("error dialing backend %s: %w", backend.URL.Host, err)
 	}
+	backend.sockets.misses.Add(1)
+	return conn.(*net.UDPConn), nil
+}
+
+func (p *UDPServerPool) forwardToBackend(ctx context.Context, backend *Backend, data []byte) ([]byte, error) {
+	dialStart := time.Now()
+	conn, err := p.dialUDPBackend(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
 	defer conn.Close()
+	defer context.AfterFunc(ctx, func() { conn.Close() })()
+	backend.observeDial(time.Since(dialStart), connID(ctx))
 
+	sent := time.Now()
 	if _, err := conn.Write(data); err != nil {
 		return nil, fmt.Errorf("error writing to backend %s: %w", backend.URL.Host, err)
 	}
+	backend.bytesSent.Add(len(data))
 
+	conn.SetReadDeadline(sent.Add(p.response.timeout))
 	buf := make([]byte, 65507)
+	p.resources.add(0, len(buf))
+	defer p.resources.add(0, -len(buf))
 	n, addr, err := conn.ReadFromUDP(buf)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, fmt.Errorf("no reply from backend %s within %s", backend.URL.Host, p.response.timeout)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("error reading from backend %s: %w", backend.URL.Host, err)
 	}
+	backend.bytesReceived.Add(n)
+	rtt := time.Since(sent)
+	backend.FirstByteLatency.Observe(rtt)
+	backend.ResponseTime.Observe(rtt)
 
-	if addr.String() != backend.URL.Host {
+	if addr.String() != conn.RemoteAddr().String() {
 		return nil, fmt.Errorf("received response from unexpected address %s", addr.String())
 	}
 
@@ -13,9 +13,9 @@ func TestNewUDPServerPool(t *testing.T) {
 	l := log.New(nil, "", 0)
 	pool, err := NewUDPServerPool(l, &Config{
 		Addr: ":9090",
-		Backends: []string{
-			"http://localhost:8080",
-			"http://localhost:8081",
+		Backends: []BackendConfig{
+			{URL: "http://localhost:8080"},
+			{URL: "http://localhost:8081"},
 		},
 		StickySessions:      true,
 		HealthcheckInterval: "10s",
@@ -80,7 +80,7 @@ func Test_forwardToBackend(t *testing.T) {
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
-	resp, err := pool.forwardToBackend(&Backend{URL: backendUrl}, []byte("test data"))
+	resp, err := pool.forwardToBackend(t.Context(), &Backend{URL: backendUrl}, []byte("test data"))
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
@@ -95,8 +95,8 @@ func Test_forwardToBackend(t *testing.T) {
 func Test_handleConnection(t *testing.T) {
 	pool, err := NewUDPServerPool(log.New(io.Discard, "", 0), &Config{
 		Addr: ":9090",
-		Backends: []string{
-			"http://127.0.0.1:8080",
+		Backends: []BackendConfig{
+			{URL: "http://127.0.0.1:8080"},
 		},
 	})
 	if err != nil {
@@ -167,7 +167,7 @@ func Test_handleConnection(t *testing.T) {
 
 	time.Sleep(100 * time.Millisecond)
 
-	pool.handleConnection(clientAddr, []byte("hello"))
+	pool.handleConnection(t.Context(), pool.conn, clientAddr, []byte("hello"))
 
 	select {
 	case data := <-dataChan:
@@ -186,9 +186,9 @@ func Test_handleConnection(t *testing.T) {
 func TestUDPServerPoolHealthCheck(t *testing.T) {
 	pool, err := NewUDPServerPool(log.New(io.Discard, "", 0), &Config{
 		Addr: ":9090",
-		Backends: []string{
-			"http://127.0.0.1:8080", // Assume this is down
-			"http://127.0.0.1:8081", // This will be started
+		Backends: []BackendConfig{
+			{URL: "http://127.0.0.1:8080"}, // Assume this is down
+			{URL: "http://127.0.0.1:8081"}, // This will be started
 		},
 	})
 	if err != nil {
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// udpSink forwards datagrams of one-way workloads, such as metrics, logs or
+// NetFlow, straight from the listener's read loop: each backend has a single
+// connected socket the datagrams of each read batch are written to,
+// nothing is read back and no goroutine or buffer is allocated per
+// datagram.
+type udpSink struct {
+	mux   sync.Mutex
+	conns map[*Backend]*net.UDPConn
+}
+
+// newUDPSink returns nil unless the sink mode is enabled.
+func newUDPSink(config *UDPSinkConfig) *udpSink {
+	if config == nil || !config.Enabled {
+		return nil
+	}
+	return &udpSink{conns: make(map[*Backend]*net.UDPConn)}
+}
+
+// sinkConn returns the backend's socket, dialing it on first use. The
+// socket is closed once the backend is removed or the pool shuts down.
+func (p *UDPServerPool) sinkConn(backend *Backend) (*net.UDPConn, error) {
+	p.sink.mux.Lock()
+	conn := p.sink.conns[backend]
+	p.sink.mux.Unlock()
+	if conn != nil {
+		backend.sockets.hits.Add(1)
+		return conn, nil
+	}
+
+	conn, err := p.dialUDPBackend(p.conns.context(), backend)
+	if err != nil {
+		return nil, err
+	}
+	p.sink.mux.Lock()
+	defer p.sink.mux.Unlock()
+	if existing := p.sink.conns[backend]; existing != nil {
+		// Another read loop dialed it first.
+		conn.Close()
+		return existing, nil
+	}
+	p.sink.conns[backend] = conn
+	backend.sockets.open.Add(1)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.resources.add(1, 0)
+		defer p.resources.add(-1, 0)
+		select {
+		case <-backend.removed:
+		case <-p.shutdown:
+		}
+		p.dropSinkConn(backend, conn)
+	}()
+	return conn, nil
+}
+
+// dropSinkConn closes the backend's socket if it is still conn, so that the
+// next datagram dials a new one.
+func (p *UDPServerPool) dropSinkConn(backend *Backend, conn *net.UDPConn) {
+	p.sink.mux.Lock()
+	defer p.sink.mux.Unlock()
+	if p.sink.conns[backend] != conn {
+		return
+	}
+	delete(p.sink.conns, backend)
+	backend.sockets.open.Add(-1)
+	conn.Close()
+}
+
+// sinkDatagram queues a datagram from clientAddr in q, to be sent to the
+// backend chosen for it without waiting for a reply. data is used until q
+// is flushed.
+func (p *UDPServerPool) sinkDatagram(q *sinkQueue, clientAddr *net.UDPAddr, data []byte) {
+	backend := p.keyedBackend(data)
+	if backend == nil {
+		backend = p.Next(clientAddr)
+	}
+	if backend == nil {
+		infof(p.log, "No healthy backend available")
+		p.stats.reject()
+		return
+	}
+	defer p.stats.accept()()
+	if isDebugBackend(backend) || p.faults.ShouldDrop(backend) || !p.allow(backend) {
+		return
+	}
+	conn, err := p.sinkConn(backend)
+	if err != nil {
+		warnf(p.log, "Error forwarding to backend %s: %v", backend.URL.Host, err)
+		p.backendFailed(backend)
+		return
+	}
+	q.add(backend, conn, data)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPServerPool_sink(t *testing.T) {
+	backend, received := startUDPSink(t)
+	pool := startTestPool(t, NewUDPServerPool, func(c *Config) { c.UDPSink = &UDPSinkConfig{Enabled: true} }, "udp://"+backend.LocalAddr().String())
+
+	client, err := net.DialUDP("udp", nil, pool.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("failed to dial pool: %v", err)
+	}
+	defer client.Close()
+	for i := range 3 {
+		if _, err := client.Write(fmt.Appendf(nil, "metric.%d:1|c", i)); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+	}
+	for i := range 3 {
+		select {
+		case got := <-received:
+			if want := fmt.Sprintf("metric.%d:1|c", i); got != want {
+				t.Errorf("expected %q, got %q", want, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for datagram %d", i)
+		}
+	}
+
+	// Every datagram is sent on the backend's single socket.
+	v := pool.backends[0].sockets.view()
+	if v.Misses != 1 || v.Hits != 2 || v.Open != 1 {
+		t.Errorf("expected one socket reused for every datagram, got %+v", v)
+	}
+	if got := pool.stats.accepted.Load(); got != 3 {
+		t.Errorf("expected 3 accepted datagrams, got %d", got)
+	}
+}
+
+func TestUDPServerPool_sinkRemovedBackend(t *testing.T) {
+	backend, _ := startUDPSink(t)
+	pool := startTestPool(t, NewUDPServerPool, func(c *Config) { c.UDPSink = &UDPSinkConfig{Enabled: true} }, "udp://"+backend.LocalAddr().String())
+	b := pool.backends[0]
+	client := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9}
+
+	q := newSinkQueue()
+	pool.sinkDatagram(q, client, []byte("a"))
+	pool.flushSink(q)
+	if _, err := pool.removeBackend(b.ID); err != nil {
+		t.Fatalf("failed to remove backend: %v", err)
+	}
+	waitFor(t, "the socket to be closed", func() bool {
+		pool.sink.mux.Lock()
+		defer pool.sink.mux.Unlock()
+		return len(pool.sink.conns) == 0
+	})
+	if got := b.sockets.open.Load(); got != 0 {
+		t.Errorf("expected no open sockets, got %d", got)
+	}
+}
+
+func TestNewUDPServerPool_sinkConflicts(t *testing.T) {
+	for name, config := range map[string]*Config{
+		"flows":   {UDPFlows: &UDPFlowConfig{Enabled: true}},
+		"fan-out": {UDPFanOut: &UDPFanOutConfig{Enabled: true}},
+	} {
+		config.Addr = "127.0.0.1:0"
+		config.UDPSink = &UDPSinkConfig{Enabled: true}
+		if _, err := NewUDPServerPool(log.New(io.Discard, "", 0), config); err == nil {
+			t.Errorf("expected an error combining udp_sink with %s", name)
+		}
+	}
+}
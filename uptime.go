@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultUptimeRetention is how long backend health transitions are kept
+// by default, enough for the 7 day uptime strip.
+const defaultUptimeRetention = 7 * 24 * time.Hour
+
+// uptimeCompactAfter is the number of events appended to the uptime file
+// after which it is rewritten without the events past retention.
+const uptimeCompactAfter = 1000
+
+// Backend states in the uptime history. A backend's state is unknown while
+// its listener is not running.
+const (
+	uptimeUp      = "up"
+	uptimeDown    = "down"
+	uptimeUnknown = "unknown"
+)
+
+// uptimeEvent is a line of the uptime file: a backend entering a state.
+type uptimeEvent struct {
+	Time     time.Time `json:"time"`
+	Listener string    `json:"listener,omitempty"`
+	Backend  string    `json:"backend"`
+	State    string    `json:"state"`
+}
+
+// uptimeLog persists the health transitions of the backends of every
+// listener to an append-only file, so that their uptime over the last day
+// and week survives restarts. The file holds one JSON event per line and is
+// compacted at startup and as it grows.
+type uptimeLog struct {
+	path      string
+	retention time.Duration
+
+	mux      sync.Mutex
+	f        *os.File
+	appended int
+	// events are each backend's events, oldest first, keyed by listener
+	// and backend URL.
+	events map[string][]uptimeEvent
+}
+
+func newUptimeLog(config *UptimeHistoryConfig) (*uptimeLog, error) {
+	if config == nil || config.Path == "" {
+		return nil, nil
+	}
+	u := &uptimeLog{path: config.Path, retention: defaultUptimeRetention, events: make(map[string][]uptimeEvent)}
+	if config.Retention != "" {
+		d, err := time.ParseDuration(config.Retention)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uptime_history retention: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("uptime_history retention must be positive")
+		}
+		u.retention = d
+	}
+	if err := u.load(); err != nil {
+		return nil, fmt.Errorf("failed to load uptime history: %w", err)
+	}
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	if err := u.compact(time.Now()); err != nil {
+		return nil, fmt.Errorf("failed to compact uptime history: %w", err)
+	}
+	return u, nil
+}
+
+func uptimeKey(listener, backend string) string {
+	return listener + " " + backend
+}
+
+// load reads the events in the file. Lines that cannot be parsed, such as
+// one cut short by a crash, are skipped.
+func (u *uptimeLog) load() error {
+	f, err := os.Open(u.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e uptimeEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil || e.Backend == "" {
+			continue
+		}
+		key := uptimeKey(e.Listener, e.Backend)
+		u.events[key] = append(u.events[key], e)
+	}
+	for _, events := range u.events {
+		slices.SortStableFunc(events, func(a, b uptimeEvent) int { return a.Time.Compare(b.Time) })
+	}
+	return scanner.Err()
+}
+
+// prune drops the events past retention at now, except the last of them,
+// which holds the state at the start of the retained period.
+func (u *uptimeLog) prune(now time.Time) {
+	cutoff := now.Add(-u.retention)
+	for key, events := range u.events {
+		i := 0
+		for i+1 < len(events) && !events[i+1].Time.After(cutoff) {
+			i++
+		}
+		if i > 0 {
+			u.events[key] = slices.Clone(events[i:])
+		}
+	}
+}
+
+// compact rewrites the file with the events within retention and opens it
+// for appending. The caller must hold u.mux.
+func (u *uptimeLog) compact(now time.Time) error {
+	u.prune(now)
+	tmp, err := os.CreateTemp(filepath.Dir(u.path), filepath.Base(u.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, key := range slices.Sorted(maps.Keys(u.events)) {
+		for _, e := range u.events[key] {
+			if err := enc.Encode(e); err != nil {
+				tmp.Close()
+				return err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), u.path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(u.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if u.f != nil {
+		u.f.Close()
+	}
+	u.f, u.appended = f, 0
+	return nil
+}
+
+// record appends a backend entering a state at now. A nil uptimeLog
+// records nothing.
+func (u *uptimeLog) record(listener, backend, state string, now time.Time) error {
+	if u == nil {
+		return nil
+	}
+	e := uptimeEvent{Time: now.UTC(), Listener: listener, Backend: backend, State: state}
+	key := uptimeKey(listener, backend)
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	if events := u.events[key]; len(events) > 0 && events[len(events)-1].State == state {
+		return nil
+	}
+	u.events[key] = append(u.events[key], e)
+	if u.f == nil {
+		return nil
+	}
+	if u.appended >= uptimeCompactAfter {
+		if err := u.compact(now); err != nil {
+			return err
+		}
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	u.appended++
+	_, err = u.f.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the file. Events recorded afterwards are only kept in
+// memory.
+func (u *uptimeLog) Close() error {
+	if u == nil {
+		return nil
+	}
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	if u.f == nil {
+		return nil
+	}
+	err := u.f.Close()
+	u.f = nil
+	return err
+}
+
+// uptimeSlot is the share of a period a backend was up, of the time its
+// state is known. Known is false if its state was never known during the
+// period.
+type uptimeSlot struct {
+	Start time.Time
+	End   time.Time
+	Up    float64
+	Known bool
+}
+
+// strip divides the window ending at now into n slots and returns the
+// uptime of a backend in each, oldest first.
+func (u *uptimeLog) strip(listener, backend string, now time.Time, window time.Duration, n int) []uptimeSlot {
+	u.mux.Lock()
+	events := slices.Clone(u.events[uptimeKey(listener, backend)])
+	u.mux.Unlock()
+
+	slots := make([]uptimeSlot, n)
+	step := window / time.Duration(n)
+	for i := range slots {
+		start := now.Add(-window + time.Duration(i)*step)
+		slots[i] = uptimeBetween(events, start, start.Add(step))
+	}
+	return slots
+}
+
+// uptime returns the uptime of a backend over the window ending at now.
+func (u *uptimeLog) uptime(listener, backend string, now time.Time, window time.Duration) uptimeSlot {
+	return u.strip(listener, backend, now, window, 1)[0]
+}
+
+// uptimeBetween returns the uptime between start and end given a backend's
+// events, oldest first.
+func uptimeBetween(events []uptimeEvent, start, end time.Time) uptimeSlot {
+	slot := uptimeSlot{Start: start, End: end}
+	var up, known time.Duration
+	state := uptimeUnknown
+	from := start
+	for _, e := range events {
+		if !e.Time.After(start) {
+			state = e.State
+			continue
+		}
+		if !e.Time.Before(end) {
+			break
+		}
+		if state != uptimeUnknown {
+			known += e.Time.Sub(from)
+			if state == uptimeUp {
+				up += e.Time.Sub(from)
+			}
+		}
+		state, from = e.State, e.Time
+	}
+	if state != uptimeUnknown {
+		known += end.Sub(from)
+		if state == uptimeUp {
+			up += end.Sub(from)
+		}
+	}
+	if known > 0 {
+		slot.Up, slot.Known = float64(up)/float64(known), true
+	}
+	return slot
+}
+
+// Dimensions of the uptime strips on the dashboard.
+const (
+	uptimeStripHeight = 14
+	uptimeSlotWidth   = 4
+)
+
+// formatUptimeStrip renders uptime slots as an inline SVG strip for the
+// dashboard, one bar per slot colored by how much of it the backend was up.
+func formatUptimeStrip(slots []uptimeSlot) template.HTML {
+	if len(slots) == 0 {
+		return "-"
+	}
+	var bars strings.Builder
+	for i, s := range slots {
+		class := "uptime-unknown"
+		switch {
+		case !s.Known:
+		case s.Up >= 1:
+			class = "uptime-up"
+		case s.Up >= 0.99:
+			class = "uptime-degraded"
+		default:
+			class = "uptime-down"
+		}
+		title := "no data"
+		if s.Known {
+			title = fmt.Sprintf("%.2f%% up", 100*s.Up)
+		}
+		fmt.Fprintf(&bars, `<rect class="%s" x="%d" y="0" width="%d" height="%d"><title>%s – %s: %s</title></rect>`,
+			class, i*uptimeSlotWidth, uptimeSlotWidth-1, uptimeStripHeight, template.HTMLEscapeString(s.Start.Format("Jan 2 15:04")),
+			template.HTMLEscapeString(s.End.Format("Jan 2 15:04")), template.HTMLEscapeString(title))
+	}
+	width := len(slots) * uptimeSlotWidth
+	return template.HTML(fmt.Sprintf(`<svg class="uptime-strip" width="%d" height="%d" viewBox="0 0 %d %d">%s</svg>`, width, uptimeStripHeight, width, uptimeStripHeight, bars.String()))
+}
+
+// formatUptime renders a backend's uptime over a window for the dashboard.
+func formatUptime(s uptimeSlot) string {
+	if !s.Known {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f%%", 100*s.Up)
+}
+
+// recordUptime records a backend of the pool entering a state, logging
+// errors writing the uptime file.
+func (p *BaseServerPool) recordUptime(b *Backend, state string, now time.Time) {
+	if err := p.uptime.record(p.name, b.URL.String(), state, now); err != nil {
+		warnf(p.log, "error recording uptime history: %v", err)
+	}
+}
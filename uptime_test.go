@@ -0,0 +1,187 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_uptimeBetween(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := []uptimeEvent{
+		{Time: t0, State: uptimeUp},
+		{Time: t0.Add(30 * time.Minute), State: uptimeDown},
+		{Time: t0.Add(45 * time.Minute), State: uptimeUp},
+		{Time: t0.Add(2 * time.Hour), State: uptimeUnknown},
+	}
+	for _, tt := range []struct {
+		start, end time.Duration
+		up         float64
+		known      bool
+	}{
+		{0, time.Hour, 0.75, true},
+		{-time.Hour, 0, 0, false},
+		{-time.Hour, time.Hour, 0.75, true},
+		{time.Hour, 3 * time.Hour, 1, true},
+		{30 * time.Minute, 45 * time.Minute, 0, true},
+		{3 * time.Hour, 4 * time.Hour, 0, false},
+	} {
+		slot := uptimeBetween(events, t0.Add(tt.start), t0.Add(tt.end))
+		if math.Abs(slot.Up-tt.up) > 1e-9 || slot.Known != tt.known {
+			t.Errorf("%s to %s: expected uptime %v (known %v), got %v (known %v)", tt.start, tt.end, tt.up, tt.known, slot.Up, slot.Known)
+		}
+	}
+}
+
+func Test_newUptimeLog(t *testing.T) {
+	if u, err := newUptimeLog(nil); u != nil || err != nil {
+		t.Errorf("expected no uptime history when not configured, got %v, %v", u, err)
+	}
+	path := filepath.Join(t.TempDir(), "uptime.jsonl")
+	for _, retention := range []string{"soon", "-1h"} {
+		if _, err := newUptimeLog(&UptimeHistoryConfig{Path: path, Retention: retention}); err == nil {
+			t.Errorf("expected an error for retention %q", retention)
+		}
+	}
+	if _, err := newUptimeLog(&UptimeHistoryConfig{Path: filepath.Join(path, "missing", "uptime.jsonl")}); err == nil {
+		t.Errorf("expected an error for a path in a missing directory")
+	}
+}
+
+func TestUptimeLog_persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uptime.jsonl")
+	now := time.Now()
+	u, err := newUptimeLog(&UptimeHistoryConfig{Path: path, Retention: "24h"})
+	if err != nil {
+		t.Fatalf("failed to create uptime history: %v", err)
+	}
+	for _, e := range []struct {
+		ago   time.Duration
+		state string
+	}{
+		{48 * time.Hour, uptimeUp},
+		{36 * time.Hour, uptimeDown},
+		{30 * time.Hour, uptimeUp},
+		{6 * time.Hour, uptimeDown},
+		{5 * time.Hour, uptimeDown}, // not a change
+		{3 * time.Hour, uptimeUp},
+	} {
+		if err := u.record("web", "tcp://a:80", e.state, now.Add(-e.ago)); err != nil {
+			t.Fatalf("failed to record: %v", err)
+		}
+	}
+	if err := u.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	if err := u.record("web", "tcp://a:80", uptimeDown, now); err != nil {
+		t.Errorf("expected recording after close to be kept in memory, got %v", err)
+	}
+
+	// Reopening compacts the file, keeping the up event 30h ago as the
+	// state at the start of the retained period.
+	u, err = newUptimeLog(&UptimeHistoryConfig{Path: path, Retention: "24h"})
+	if err != nil {
+		t.Fatalf("failed to reopen uptime history: %v", err)
+	}
+	t.Cleanup(func() { u.Close() })
+	if n := len(u.events[uptimeKey("web", "tcp://a:80")]); n != 3 {
+		t.Errorf("expected 3 events after compaction, got %d", n)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read uptime file: %v", err)
+	}
+	if n := strings.Count(string(data), "\n"); n != 3 {
+		t.Errorf("expected 3 lines in the compacted file, got %d", n)
+	}
+	if got := u.uptime("web", "tcp://a:80", now, 24*time.Hour); math.Abs(got.Up-21.0/24) > 1e-6 {
+		t.Errorf("expected 87.5%% uptime over 24h, got %v", got.Up)
+	}
+	if got := u.uptime("web", "tcp://b:80", now, 24*time.Hour); got.Known {
+		t.Errorf("expected unknown uptime for a backend without history, got %+v", got)
+	}
+	strip := u.strip("web", "tcp://a:80", now, 24*time.Hour, 24)
+	if len(strip) != 24 || strip[0].Up != 1 || strip[18].Up != 0 || strip[23].Up != 1 {
+		t.Errorf("unexpected strip %+v", strip)
+	}
+
+	// A line cut short by a crash is skipped.
+	if err := os.WriteFile(path, append(data, `{"time":"2024-`...), 0o644); err != nil {
+		t.Fatalf("failed to write uptime file: %v", err)
+	}
+	u2, err := newUptimeLog(&UptimeHistoryConfig{Path: path, Retention: "24h"})
+	if err != nil {
+		t.Fatalf("failed to reopen uptime history: %v", err)
+	}
+	defer u2.Close()
+	if n := len(u2.events[uptimeKey("web", "tcp://a:80")]); n != 3 {
+		t.Errorf("expected 3 events after a truncated line, got %d", n)
+	}
+
+	var none *uptimeLog
+	if err := none.record("web", "tcp://a:80", uptimeUp, now); err != nil || none.Close() != nil {
+		t.Errorf("expected a nil uptime history to record nothing")
+	}
+}
+
+func Test_formatUptimeStrip(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	strip := string(formatUptimeStrip([]uptimeSlot{
+		{Start: start, End: start.Add(time.Hour), Up: 1, Known: true},
+		{Start: start, End: start.Add(time.Hour), Up: 0.995, Known: true},
+		{Start: start, End: start.Add(time.Hour), Up: 0.5, Known: true},
+		{Start: start, End: start.Add(time.Hour)},
+	}))
+	for _, want := range []string{`width="16"`, `class="uptime-up"`, `class="uptime-degraded"`, `class="uptime-down"`, `class="uptime-unknown"`, "50.00% up", "no data"} {
+		if !strings.Contains(strip, want) {
+			t.Errorf("expected strip to contain %q, got %q", want, strip)
+		}
+	}
+	if got := formatUptimeStrip(nil); got != "-" {
+		t.Errorf("expected - for no slots, got %q", got)
+	}
+	if got := formatUptime(uptimeSlot{Up: 0.995, Known: true}); got != "99.50%" {
+		t.Errorf("expected 99.50%%, got %q", got)
+	}
+	if got := formatUptime(uptimeSlot{}); got != "-" {
+		t.Errorf("expected - for unknown uptime, got %q", got)
+	}
+}
+
+func TestBaseServerPool_uptimeHistory(t *testing.T) {
+	u, err := newUptimeLog(&UptimeHistoryConfig{Path: filepath.Join(t.TempDir(), "uptime.jsonl")})
+	if err != nil {
+		t.Fatalf("failed to create uptime history: %v", err)
+	}
+	t.Cleanup(func() { u.Close() })
+	pool := newConsoleTestPool("web", true)
+	pool.uptime = u
+	b := pool.backends[0]
+	pool.setHealthy(b, false)
+	pool.setHealthy(b, true)
+
+	events := u.events[uptimeKey("web", b.URL.String())]
+	if len(events) != 2 || events[0].State != uptimeDown || events[1].State != uptimeUp {
+		t.Errorf("expected the pool's transitions to be recorded, got %+v", events)
+	}
+
+	rec := httptest.NewRecorder()
+	pool.dashboardHandler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	for _, want := range []string{"Uptime 24h / 7d", `class="uptime-strip"`} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("expected dashboard to contain %q", want)
+		}
+	}
+
+	pool.uptime = nil
+	rec = httptest.NewRecorder()
+	pool.dashboardHandler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if strings.Contains(rec.Body.String(), "Uptime 24h") {
+		t.Errorf("expected no uptime column without uptime history")
+	}
+}
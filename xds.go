@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// xDS resource types fetched over the REST-JSON transport.
+const (
+	xdsClusterType   = "type.googleapis.com/envoy.config.cluster.v3.Cluster"
+	xdsEndpointsType = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+)
+
+const (
+	defaultXDSInterval = 30 * time.Second
+	defaultXDSTimeout  = 5 * time.Second
+)
+
+// xdsClient discovers a pool's backends from the endpoints of an Envoy
+// cluster, polling an xDS management server with the REST-JSON transport
+// (CDS then EDS). Backends it discovers are added to and removed from the
+// pool as the cluster changes; backends from the config or the admin API
+// are left alone.
+type xdsClient struct {
+	server   *url.URL
+	cluster  string
+	node     xdsNode
+	interval time.Duration
+	client   *http.Client
+
+	// versions and nonces of the last accepted response of each type.
+	versions map[string]string
+	nonces   map[string]string
+	// cluster state from the last CDS response.
+	edsName     string
+	dialTimeout string
+	static      *xdsLoadAssignment
+	// owned holds the host:port of the backends added by the client.
+	owned map[string]bool
+}
+
+func newXDSClient(config *XDSConfig) (*xdsClient, error) {
+	if config == nil {
+		return nil, nil
+	}
+	if config.Server == "" || config.Cluster == "" {
+		return nil, fmt.Errorf("xds requires a server and a cluster")
+	}
+	server, err := url.Parse(config.Server)
+	if err != nil || (server.Scheme != "http" && server.Scheme != "https") || server.Host == "" {
+		return nil, fmt.Errorf("invalid xds server %q: must be an http or https url", config.Server)
+	}
+
+	c := &xdsClient{
+		server:   server,
+		cluster:  config.Cluster,
+		node:     xdsNode{ID: config.NodeID, Cluster: config.NodeCluster},
+		interval: defaultXDSInterval,
+		versions: make(map[string]string),
+		nonces:   make(map[string]string),
+		owned:    make(map[string]bool),
+	}
+	if c.node.ID == "" {
+		c.node.ID, _ = os.Hostname()
+	}
+	timeout := defaultXDSTimeout
+	for _, f := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"interval", config.Interval, &c.interval},
+		{"timeout", config.Timeout, &timeout},
+	} {
+		if f.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(f.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid xds %s: %w", f.name, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("xds %s must be positive", f.name)
+		}
+		*f.dst = d
+	}
+	c.client = &http.Client{Timeout: timeout}
+	return c, nil
+}
+
+type xdsNode struct {
+	ID      string `json:"id"`
+	Cluster string `json:"cluster,omitempty"`
+}
+
+type xdsDiscoveryRequest struct {
+	VersionInfo   string   `json:"version_info,omitempty"`
+	Node          xdsNode  `json:"node"`
+	ResourceNames []string `json:"resource_names"`
+	TypeURL       string   `json:"type_url"`
+	ResponseNonce string   `json:"response_nonce,omitempty"`
+}
+
+type xdsDiscoveryResponse struct {
+	VersionInfo string            `json:"version_info"`
+	Resources   []json.RawMessage `json:"resources"`
+	TypeURL     string            `json:"type_url"`
+	Nonce       string            `json:"nonce"`
+}
+
+// xdsCluster holds the fields of an envoy.config.cluster.v3.Cluster used
+// by nlb.
+type xdsCluster struct {
+	Name             string `json:"name"`
+	Type             string `json:"type"`
+	ConnectTimeout   string `json:"connect_timeout"`
+	EDSClusterConfig *struct {
+		ServiceName string `json:"service_name"`
+	} `json:"eds_cluster_config"`
+	LoadAssignment *xdsLoadAssignment `json:"load_assignment"`
+}
+
+// xdsLoadAssignment is an envoy.config.endpoint.v3.ClusterLoadAssignment.
+type xdsLoadAssignment struct {
+	ClusterName string `json:"cluster_name"`
+	Endpoints   []struct {
+		Locality *struct {
+			Zone string `json:"zone"`
+		} `json:"locality"`
+		LBEndpoints []struct {
+			Endpoint struct {
+				Address struct {
+					SocketAddress struct {
+						Address   string `json:"address"`
+						PortValue int    `json:"port_value"`
+					} `json:"socket_address"`
+				} `json:"address"`
+			} `json:"endpoint"`
+			HealthStatus string `json:"health_status"`
+		} `json:"lb_endpoints"`
+	} `json:"endpoints"`
+}
+
+// discover fetches a resource of typeURL by name. It returns false if the
+// resource has not changed since the last response.
+func (c *xdsClient) discover(ctx context.Context, path, typeURL, name string, resource any) (bool, error) {
+	body, err := json.Marshal(xdsDiscoveryRequest{
+		VersionInfo:   c.versions[typeURL],
+		Node:          c.node,
+		ResourceNames: []string{name},
+		TypeURL:       typeURL,
+		ResponseNonce: c.nonces[typeURL],
+	})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.server.JoinPath(path).String(), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status from %s: %s", path, resp.Status)
+	}
+
+	var dr xdsDiscoveryResponse
+	if err := json.NewDecoder(resp.Body).Decode(&dr); err != nil {
+		return false, fmt.Errorf("could not decode %s response: %w", path, err)
+	}
+	if dr.VersionInfo != "" && dr.VersionInfo == c.versions[typeURL] {
+		return false, nil
+	}
+	var found bool
+	for _, raw := range dr.Resources {
+		var named struct {
+			Name        string `json:"name"`
+			ClusterName string `json:"cluster_name"`
+		}
+		if err := json.Unmarshal(raw, &named); err != nil {
+			return false, fmt.Errorf("could not decode %s resource: %w", path, err)
+		}
+		if cmp.Or(named.Name, named.ClusterName) != name {
+			continue
+		}
+		if err := json.Unmarshal(raw, resource); err != nil {
+			return false, fmt.Errorf("could not decode %s resource: %w", path, err)
+		}
+		found = true
+	}
+	if !found {
+		return false, fmt.Errorf("%s response does not contain %q", path, name)
+	}
+	c.versions[typeURL] = dr.VersionInfo
+	c.nonces[typeURL] = dr.Nonce
+	return true, nil
+}
+
+// poll fetches the cluster and its endpoints and updates the pool's
+// backends to match.
+func (c *xdsClient) poll(ctx context.Context, p *BaseServerPool) error {
+	var cluster xdsCluster
+	changed, err := c.discover(ctx, "/v3/discovery:clusters", xdsClusterType, c.cluster, &cluster)
+	if err != nil {
+		return fmt.Errorf("cds: %w", err)
+	}
+	if changed {
+		c.dialTimeout = strings.TrimSpace(cluster.ConnectTimeout)
+		c.edsName, c.static = "", nil
+		// An omitted type is the proto default, STATIC.
+		switch cluster.Type {
+		case "EDS":
+			c.edsName = c.cluster
+			if cluster.EDSClusterConfig != nil && cluster.EDSClusterConfig.ServiceName != "" {
+				c.edsName = cluster.EDSClusterConfig.ServiceName
+			}
+		case "", "STATIC":
+			c.static = cluster.LoadAssignment
+		default:
+			return fmt.Errorf("cds: unsupported cluster type %s", cluster.Type)
+		}
+		// Endpoints must be fetched again for the new cluster.
+		delete(c.versions, xdsEndpointsType)
+	}
+
+	assignment := c.static
+	if c.edsName != "" {
+		var eds xdsLoadAssignment
+		changed, err := c.discover(ctx, "/v3/discovery:endpoints", xdsEndpointsType, c.edsName, &eds)
+		if err != nil {
+			return fmt.Errorf("eds: %w", err)
+		}
+		if !changed {
+			return nil
+		}
+		assignment = &eds
+	} else if !changed {
+		return nil
+	}
+	return c.apply(p, assignment)
+}
+
+// apply makes the backends owned by the client match the endpoints of
+// assignment. Endpoints reported unhealthy, draining or timed out by the
+// control plane are left out.
+func (c *xdsClient) apply(p *BaseServerPool, assignment *xdsLoadAssignment) error {
+	desired := make(map[string]BackendConfig)
+	if assignment != nil {
+		for _, locality := range assignment.Endpoints {
+			for _, lbe := range locality.LBEndpoints {
+				switch lbe.HealthStatus {
+				case "UNHEALTHY", "DRAINING", "TIMEOUT":
+					continue
+				}
+				sa := lbe.Endpoint.Address.SocketAddress
+				config := BackendConfig{
+					URL:         p.protocol + "://" + net.JoinHostPort(sa.Address, strconv.Itoa(sa.PortValue)),
+					DialTimeout: c.dialTimeout,
+				}
+				if locality.Locality != nil && locality.Locality.Zone != "" {
+					config.Labels = map[string]string{p.zoneLabel: locality.Locality.Zone}
+				}
+				desired[net.JoinHostPort(sa.Address, strconv.Itoa(sa.PortValue))] = config
+			}
+		}
+	}
+
+	var added, removed []string
+	for id := range c.owned {
+		if _, ok := desired[id]; ok {
+			continue
+		}
+		if b, err := p.removeBackend(id); err == nil {
+			removed = append(removed, b.URL.String())
+		}
+		delete(c.owned, id)
+	}
+	for id, config := range desired {
+		if c.owned[id] || p.findBackend(id) != nil {
+			continue
+		}
+		b, err := p.addBackend(config)
+		if err != nil {
+			warnf(p.log, "xds: could not add endpoint %s: %v", id, err)
+			continue
+		}
+		c.owned[id] = true
+		added = append(added, b.URL.String())
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		slices.Sort(added)
+		slices.Sort(removed)
+		infof(p.log, "xds: cluster %s updated: added %v, removed %v", c.cluster, added, removed)
+	}
+	return nil
+}
+
+// run polls the management server until the pool shuts down.
+func (c *xdsClient) run(p *BaseServerPool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-p.shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		if err := c.poll(ctx, p); err != nil && ctx.Err() == nil {
+			warnf(p.log, "xds: %v", err)
+		}
+		select {
+		case <-time.After(c.interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// startDiscovery starts polling the xDS management server, if configured,
+// in a goroutine tracked by wg.
+func (p *BaseServerPool) startDiscovery(wg *sync.WaitGroup) {
+	if p.xds == nil {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.xds.run(p)
+	}()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewXDSClient(t *testing.T) {
+	if c, err := newXDSClient(nil); c != nil || err != nil {
+		t.Errorf("expected nil client when disabled, got %v, %v", c, err)
+	}
+	c, err := newXDSClient(&XDSConfig{Server: "http://cp:8080", Cluster: "web"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if c.interval != defaultXDSInterval || c.node.ID == "" {
+		t.Errorf("expected default interval and hostname node id, got %s, %q", c.interval, c.node.ID)
+	}
+	for _, cfg := range []*XDSConfig{
+		{Cluster: "web"},
+		{Server: "http://cp:8080"},
+		{Server: "grpc://cp:8080", Cluster: "web"},
+		{Server: "http://cp:8080", Cluster: "web", Interval: "0s"},
+		{Server: "http://cp:8080", Cluster: "web", Timeout: "soon"},
+	} {
+		if _, err := newXDSClient(cfg); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
+
+// fakeXDSServer serves a cluster and its endpoints over the xDS REST-JSON
+// transport.
+type fakeXDSServer struct {
+	mux       sync.Mutex
+	version   string
+	endpoints []map[string]any
+	requests  []xdsDiscoveryRequest
+}
+
+func (s *fakeXDSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var req xdsDiscoveryRequest
+	json.NewDecoder(r.Body).Decode(&req)
+	s.requests = append(s.requests, req)
+
+	var resource map[string]any
+	switch r.URL.Path {
+	case "/v3/discovery:clusters":
+		resource = map[string]any{
+			"@type":              xdsClusterType,
+			"name":               "web",
+			"type":               "EDS",
+			"connect_timeout":    "0.250s",
+			"eds_cluster_config": map[string]any{"service_name": "web-eds"},
+		}
+		if req.VersionInfo == "1" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"version_info": "1", "nonce": "c1", "resources": []any{resource}})
+	case "/v3/discovery:endpoints":
+		resource = map[string]any{"@type": xdsEndpointsType, "cluster_name": "web-eds", "endpoints": s.endpoints}
+		writeJSON(w, http.StatusOK, map[string]any{"version_info": s.version, "nonce": "e" + s.version, "resources": []any{resource}})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func xdsLocality(zone string, endpoints ...map[string]any) map[string]any {
+	return map[string]any{"locality": map[string]any{"zone": zone}, "lb_endpoints": endpoints}
+}
+
+func xdsEndpoint(addr string, port int, health string) map[string]any {
+	return map[string]any{
+		"endpoint":      map[string]any{"address": map[string]any{"socket_address": map[string]any{"address": addr, "port_value": port}}},
+		"health_status": health,
+	}
+}
+
+func TestXDSClient_poll(t *testing.T) {
+	cp := &fakeXDSServer{
+		version: "1",
+		endpoints: []map[string]any{
+			xdsLocality("a", xdsEndpoint("10.0.0.1", 80, "HEALTHY"), xdsEndpoint("10.0.0.2", 80, "DRAINING")),
+			xdsLocality("b", xdsEndpoint("10.0.0.3", 80, "")),
+		},
+	}
+	srv := httptest.NewServer(cp)
+	defer srv.Close()
+
+	pool := newConsoleTestPool("web", true)
+	pool.zoneLabel = "zone"
+	c, err := newXDSClient(&XDSConfig{Server: srv.URL, Cluster: "web", NodeID: "nlb-1"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	hosts := func() []string {
+		var hosts []string
+		for _, b := range pool.Backends() {
+			hosts = append(hosts, b.URL.Host)
+		}
+		slices.Sort(hosts)
+		return hosts
+	}
+
+	if err := c.poll(t.Context(), pool); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got := hosts(); !slices.Equal(got, []string{"10.0.0.1:80", "10.0.0.3:80", "localhost:8080"}) {
+		t.Errorf("expected healthy endpoints to be added next to the configured backend, got %v", got)
+	}
+	b := pool.findBackend("10.0.0.3:80")
+	if b == nil || b.Labels["zone"] != "b" || b.dialTimeout != 250*time.Millisecond || b.URL.Scheme != "tcp" {
+		t.Errorf("expected endpoint with zone label and connect timeout, got %+v", b)
+	}
+
+	cp.mux.Lock()
+	cp.version = "2"
+	cp.endpoints = []map[string]any{xdsLocality("a", xdsEndpoint("10.0.0.1", 80, "HEALTHY"), xdsEndpoint("localhost", 8080, "HEALTHY"))}
+	cp.mux.Unlock()
+	if err := c.poll(t.Context(), pool); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got := hosts(); !slices.Equal(got, []string{"10.0.0.1:80", "localhost:8080"}) {
+		t.Errorf("expected removed endpoint to be removed, got %v", got)
+	}
+
+	// An empty cluster removes only the backends the client added.
+	cp.mux.Lock()
+	cp.version = "3"
+	cp.endpoints = nil
+	cp.mux.Unlock()
+	if err := c.poll(t.Context(), pool); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got := hosts(); !slices.Equal(got, []string{"localhost:8080"}) {
+		t.Errorf("expected configured backend to be kept, got %v", got)
+	}
+
+	cp.mux.Lock()
+	defer cp.mux.Unlock()
+	last := cp.requests[len(cp.requests)-1]
+	if last.Node.ID != "nlb-1" || last.TypeURL != xdsEndpointsType || last.VersionInfo != "2" || last.ResponseNonce != "e2" || !slices.Equal(last.ResourceNames, []string{"web-eds"}) {
+		t.Errorf("expected EDS request acknowledging version 2, got %+v", last)
+	}
+}